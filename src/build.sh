@@ -22,6 +22,7 @@ go get github.com/vektra/mockery/.../
 go get gopkg.in/yaml.v2
 go get github.com/coreos/etcd/clientv3
 go get github.com/hanwen/go-fuse/fuse
+go get golang.org/x/net/http2/h2c
 
 export PATH="$GOPATH/bin:$(pwd)/protobuf/bin:$PATH"
 
@@ -0,0 +1,24 @@
+package apis
+
+import "os"
+
+// A read that a chunkserver has opened for sending straight from one of its storage files, rather than copying the data
+// through memory first. See BulkReader.
+type BulkRead struct {
+	// The version being read.
+	Version Version
+	// The file holding the data, which must be closed once the read is done. The data starts Offset bytes into the file
+	// and runs for Length bytes; the rest of the requested region, if any, is zeroes.
+	File   *os.File
+	Offset int64
+	Length int64
+	// The CRC-32 (IEEE) of the Length bytes of data, as recorded when they were stored.
+	Checksum uint32
+}
+
+// Implemented by chunkservers that can serve large reads as open files. Optional: any read can also be done with Read.
+type BulkReader interface {
+	// Like Read, but opens the data instead of returning it. Not every read can be opened this way; if this one can't,
+	// ok is false, and the read should be done with Read instead. Fails in the same ways as Read.
+	OpenRead(chunk ChunkNum, offset uint32, length uint32, minimum Version) (read *BulkRead, ok bool, err error)
+}
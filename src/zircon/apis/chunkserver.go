@@ -1,5 +1,12 @@
 package apis
 
+import (
+	"context"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
 // The version number of a chunk
 type Version uint64
 
@@ -9,17 +16,65 @@ type ChunkNum uint64
 // Size in bits of a ChunkNum
 const ChunkNumSize = 64
 
-// 8 MiB, the maximum size of a chunk stored on the chunkserver
+// 8 MiB, the maximum size of a chunk stored on the chunkserver. Deployments can configure a smaller size, which every
+// server in the cluster must agree on; this is the default, and the largest that can be configured.
 const MaxChunkSize = 8 * 1024 * 1024
 
 // Represents "any version is valid" when passed as a chunk version number
 const AnyVersion Version = 0
 
+// Computes a CRC-32 of a chunk's data, for checking that it wasn't damaged while being copied. Trailing zeroes are left
+// out, since storage backends may or may not keep them.
+func ChunkChecksum(data []byte) uint32 {
+	end := len(data)
+	for end > 0 && data[end-1] == 0 {
+		end--
+	}
+	return crc32.ChecksumIEEE(data[:end])
+}
+
+// One of the commits in a CommitWriteBatch, with the same meaning as the arguments to CommitWrite.
+type CommitWriteRequest struct {
+	Chunk      ChunkNum
+	Hash       CommitHash
+	OldVersion Version
+	NewVersion Version
+}
+
 type ChunkVersion struct {
 	Chunk   ChunkNum
 	Version Version
 }
 
+// A version of a chunk, along with the hashes of the commits that produced it, in the order they were applied. Hashes is
+// empty if the version was created some other way, such as by Add or ForceAdd, or if the hashes weren't kept.
+type ChunkVersionHashes struct {
+	Chunk   ChunkNum
+	Version Version
+	Hashes  []CommitHash
+}
+
+// Selects the chunk versions returned by ListChunks. The zero value selects everything.
+type ChunkFilter struct {
+	// Only chunks numbered from FirstChunk to LastChunk (inclusive) are included. A LastChunk of zero leaves the range
+	// unbounded above.
+	FirstChunk ChunkNum
+	LastChunk  ChunkNum
+	// Only versions from MinVersion to MaxVersion (inclusive) are included. Either bound may be AnyVersion, in which
+	// case it does not restrict the results.
+	MinVersion Version
+	MaxVersion Version
+}
+
+// A record that a chunkserver deleted a chunk, kept so that a copy of the chunk that missed the deletion (such as one on
+// a replica that was down at the time) can be recognized as dead, rather than as the last surviving copy.
+type Tombstone struct {
+	Chunk ChunkNum
+	// the newest version of the chunk that was deleted
+	Version Version
+	Deleted time.Time
+}
+
 // note: this API is strongly consistent, because it's a connection to just a single chunkserver
 type Chunkserver interface {
 	ChunkserverSingle
@@ -28,12 +83,100 @@ type Chunkserver interface {
 	// If replicas is nonempty, this will also replicate the prepared write to those servers.
 	// Additionally fails if another server fails to start a write.
 	StartWriteReplicated(chunk ChunkNum, offset uint32, data []byte, replicas []ServerAddress) error
+	// Like StartWriteReplicated, but the writes forwarded to other chunkservers are made with ctx, so that they carry its
+	// deadline, cancellation, and caller, and stop being retried once it's done.
+	StartWriteReplicatedWithContext(ctx context.Context, chunk ChunkNum, offset uint32, data []byte, replicas []ServerAddress) error
 
 	// Tells this chunkserver to directly replicate a particular chunk to another specified chunkserver.
 	// This will use 'subref' to call 'Add' on the other chunkserver at 'serverAddress'.
 	// Replication will only take place assuming that the 'version' specified is the version stored.
 	// This will return success once the operation has completed successfully.
+	// Fails with ErrReplicationSuperseded if the chunk changes here before the other server has stored it, in which
+	// case the replication should be started over at the version carried by the error.
 	Replicate(chunk ChunkNum, serverAddress ServerAddress, version Version) error
+	// Like Replicate, but the chunk is sent to the other chunkserver with ctx.
+	ReplicateWithContext(ctx context.Context, chunk ChunkNum, serverAddress ServerAddress, version Version) error
+
+	// Tells this chunkserver to push whichever version of a chunk it currently serves to another chunkserver, replacing
+	// any older copy there. This is for when this server is known to be ahead of the other (such as when the other is
+	// recovering), but the caller doesn't need to know exactly which version is current.
+	// Succeeds without changing anything if the other server already has the same version, and fails with
+	// ErrChunkExists if it has a newer one. Returns the version that the other server now holds. Like Replicate, fails
+	// with ErrReplicationSuperseded if the chunk changes here partway through.
+	Push(chunk ChunkNum, serverAddress ServerAddress) (Version, error)
+	// Like Push, but the chunk is sent to the other chunkserver with ctx.
+	PushWithContext(ctx context.Context, chunk ChunkNum, serverAddress ServerAddress) (Version, error)
+
+	// Tells this chunkserver to replace its damaged copy of a particular version of a chunk with one from another
+	// replica. The sources are tried in order, and the first copy whose ChunkChecksum matches 'checksum' is used; the
+	// damaged copy is quarantined rather than deleted. Returns the address of the source that the copy came from.
+	// If no source has a matching copy, the local copy is left alone and an error is returned.
+	RepairChunk(chunk ChunkNum, version Version, checksum uint32, sources []ServerAddress) (ServerAddress, error)
+	// Like RepairChunk, but the copies are fetched from the sources with ctx.
+	RepairChunkWithContext(ctx context.Context, chunk ChunkNum, version Version, checksum uint32, sources []ServerAddress) (ServerAddress, error)
+}
+
+// What AddWithMode does when the chunk being added already exists. None of these bring back a chunk that was deleted;
+// a chunk with a tombstone still fails with ErrAlreadyDeleted.
+type AddMode int
+
+const (
+	// Fail with ErrChunkExists, carrying the existing version, as Add does.
+	AddFailIfExists AddMode = iota
+	// If the chunk's latest version is the one being added, replace its contents, and discard any newer versions that
+	// were never made latest, since they were built on the old contents. Otherwise, fail with ErrChunkExists. Meant for
+	// bulk loads that may be rerun from the start.
+	AddOverwriteSameVersion
+	// Succeed without changing anything, whatever version the chunk is at.
+	AddIgnoreIfExists
+)
+
+// What VerifyAll found out about a single version.
+type VerifyStatus int
+
+const (
+	// The version is stored intact, as far as the storage can tell.
+	VerifyOK VerifyStatus = iota
+	// The version is stored, but can't be read, or doesn't match its recorded length or checksum.
+	VerifyCorrupt
+	// The version is recorded as its chunk's latest version, but isn't stored at all.
+	VerifyMissing
+)
+
+var verifyStatusNames = []string{"ok", "corrupt", "missing"}
+
+func (s VerifyStatus) String() string {
+	if s < 0 || int(s) >= len(verifyStatusNames) {
+		return fmt.Sprintf("verify-status(%d)", int(s))
+	}
+	return verifyStatusNames[s]
+}
+
+type VerifyFinding struct {
+	Chunk ChunkNum
+	// zero if the problem is with the chunk as a whole, such as when its versions can't even be listed
+	Version Version
+	Status  VerifyStatus
+	// What is wrong with the version; empty if it's OK
+	Detail string
+}
+
+type VerifyOptions struct {
+	// The most bytes per second to read from storage while verifying, on average, so that a full check doesn't starve
+	// client traffic. Zero means no limit.
+	BytesPerSecond int64
+	// Include a finding for every version that was found intact, rather than only for the ones with problems.
+	IncludeOK bool
+}
+
+// The totals of what VerifyAll found. The findings themselves are handed over one at a time as they're made.
+type VerifyReport struct {
+	// Versions found intact, found corrupt, and found missing
+	OK      uint64
+	Corrupt uint64
+	Missing uint64
+	// Bytes read from storage along the way
+	Bytes uint64
 }
 
 // A limited form of the chunkserver interface that doesn't include any APIs that connect to other chunkservers.
@@ -45,38 +188,122 @@ type ChunkserverSingle interface {
 	// If 'minimum' is AnyVersion, then whichever version the chunkserver currently has will be returned.
 	// If the version of the chunk that this chunkserver has is at least the minimum version, it will be returned.
 	// Otherwise, an error will be returned, along with the most recent available version.
-	// The sum of offset + length must not be greater than MaxChunkSize. The number of bytes returned is always exactly
+	// The sum of offset + length must not be greater than MaxChunkSize, or else ErrOutOfBounds is returned.
+	// The number of bytes returned is always exactly
 	// the same number of bytes requested, unless an error condition is signaled.
-	// The version of the data actually read will be returned.
-	// Fails if a copy of this chunk isn't located on this chunkserver.
+	// The version of the data actually read will be returned, and the data is always entirely from that version, even
+	// if commits to the same chunk are happening at the same time.
+	// Fails with ErrChunkNotFound if a copy of this chunk isn't located on this chunkserver. A chunk that does exist but
+	// has no data at the requested offset reads successfully as zeroes, since chunks are padded out to MaxChunkSize.
 	Read(chunk ChunkNum, offset uint32, length uint32, minimum Version) ([]byte, Version, error)
 
 	// Given a chunk reference, send data to be used for a write to this chunk.
 	// This method does not actually perform a write.
-	// The sum of 'offset' and 'len(data)' must not be greater than MaxChunkSize.
+	// The sum of 'offset' and 'len(data)' must not be greater than MaxChunkSize, or else ErrOutOfBounds is returned.
 	// Fails if a copy of this chunk isn't located on this chunkserver.
 	StartWrite(chunk ChunkNum, offset uint32, data []byte) error
 
 	// Commit a write -- persistently store it as the data for a particular version.
 	// Takes existing saved data for oldVersion, apply this cached write, and saved it as newVersion.
+	// If other writes have already been committed from oldVersion into newVersion, this write is applied on top of them,
+	// as long as it doesn't overlap any of them; otherwise, fails with ErrWriteConflict.
+	// Retrying a commit that has already been applied succeeds, as long as newVersion is still pending or is now the
+	// latest version.
 	CommitWrite(chunk ChunkNum, hash CommitHash, oldVersion Version, newVersion Version) error
 
+	// Commits several writes at once, as if by calling CommitWrite for each of them in order, so that a client finishing
+	// a write across many chunks needs only one round trip. Each commit succeeds or fails independently of the others:
+	// the result for each is at the same index as the commit itself, and is nil if it succeeded. The separate error is
+	// only returned if the batch could not be attempted at all, in which case none of the commits were made.
+	CommitWriteBatch(commits []CommitWriteRequest) ([]error, error)
+
 	// Update the version of this chunk that will be returned to clients.
 	// Deletes any chunk versions older than this new version.
-	// If the current version reported to clients is different from the oldVersion, errors.
+	// If newVersion is not greater than oldVersion, fails with ErrVersionRollback. If the current version reported to
+	// clients is different from the oldVersion, fails with ErrWrongVersion. Both carry the current latest version.
+	// newVersion need not be exactly one greater than oldVersion, since versions can be consumed by failed writes.
 	UpdateLatestVersion(chunk ChunkNum, oldVersion Version, newVersion Version) error
 
+	// Administrative override for disaster recovery: make an already-stored version the latest, even if it is older
+	// than the current latest version. Unlike UpdateLatestVersion, nothing is deleted, so any newer versions remain
+	// available for inspection and can be removed individually with Delete.
+	// This must never be used in normal operation, since it breaks the guarantee that versions only increase.
+	OverrideLatestVersion(chunk ChunkNum, version Version) error
+
 	// ** methods used by internal cluster systems **
 
 	// Allocates a new chunk on this chunkserver.
 	// initialData will be padded with zeroes up to the MaxChunkSize
 	// initialVersion must be positive
+	// If the chunk already exists, fails with ErrChunkExists, carrying the existing version. If the chunk was deleted,
+	// and initialVersion is no newer than the deleted version, fails with ErrAlreadyDeleted; see ListTombstones.
 	Add(chunk ChunkNum, initialData []byte, initialVersion Version) error
 
-	// Deletes a chunk stored on this chunkserver with a specific version.
+	// Like Add, but with a choice of what to do if the chunk already exists; see AddMode. Add is the same as
+	// AddWithMode with AddFailIfExists. Fails without doing anything if the mode isn't one of the AddModes.
+	AddWithMode(chunk ChunkNum, initialData []byte, initialVersion Version, mode AddMode) error
+
+	// Like Add, but if the chunk already exists at an older version, replaces it entirely, including any versions that
+	// were never made latest. Meant for re-replication and recovery, where a stale copy may legitimately be present.
+	// If the existing version is the same or newer, fails with ErrChunkExists, carrying the existing version.
+	ForceAdd(chunk ChunkNum, initialData []byte, initialVersion Version) error
+
+	// Like ForceAdd, but first checks initialData against a checksum computed by ChunkChecksum before it was sent, and
+	// fails with ErrChecksumMismatch without storing anything if they don't match. Used by Replicate and Push, so that
+	// data damaged on its way between chunkservers never becomes a replica.
+	ForceAddChecked(chunk ChunkNum, initialData []byte, initialVersion Version, checksum uint32) error
+
+	// Deletes a chunk stored on this chunkserver with a specific version. Deleting the latest version deletes the entire
+	// chunk, and leaves a tombstone behind; deleting a newer version (one that was never made latest) rolls back just
+	// that version.
+	// If the chunk (or that version of it) is already gone, fails with ErrAlreadyDeleted, which callers may treat as
+	// success. If the chunk has moved on past that version, fails with ErrWrongVersion, carrying the latest version.
 	Delete(chunk ChunkNum, version Version) error
 
 	// Requests a list of all chunks currently held by this chunkserver.
+	// Only chunk versions between 'minimum' and 'maximum' (inclusive) are included. Either bound may be AnyVersion,
+	// in which case it does not restrict the results.
+	// There is no guaranteed order for the returned slice.
+	ListAllChunks(minimum Version, maximum Version) ([]ChunkVersion, error)
+
+	// Like ListAllChunks, but also includes the hashes of the commits that produced each version, as passed to
+	// CommitWrite, for verifying and deduplicating chunks across servers. The hashes are recorded when each commit is
+	// made, so listing them never reads chunk data.
+	ListAllChunksWithHashes(minimum Version, maximum Version) ([]ChunkVersionHashes, error)
+
+	// Like ListAllChunks, but only includes the chunk versions selected by the filter, so that a caller looking for
+	// particular chunks doesn't have to receive and sift through every chunk on the server. Chunks outside of the
+	// filter's range are skipped without being looked at in storage.
+	// The returned slice is ordered by chunk number, and then by version.
+	ListChunks(filter ChunkFilter) ([]ChunkVersion, error)
+
+	// Requests a list of the tombstones left by chunks that were deleted from this chunkserver, to go along with
+	// ListAllChunks. A tombstone is kept until ForgetTombstone is called for it, or until the chunkserver's retention
+	// period for tombstones has passed. While a chunk has a tombstone, Add and ForceAdd refuse to bring back any version
+	// of it up to the deleted one, failing with ErrAlreadyDeleted.
 	// There is no guaranteed order for the returned slice.
-	ListAllChunks() ([]ChunkVersion, error)
+	ListTombstones() ([]Tombstone, error)
+
+	// Discards the tombstone for a chunk, once every replica that held the chunk has confirmed that it is gone.
+	// Does nothing if there is no tombstone for the chunk.
+	ForgetTombstone(chunk ChunkNum) error
+
+	// Get a snapshot of how much storage this chunkserver is using, for placement decisions and monitoring.
+	GetStats() (ChunkserverStats, error)
+
+	// Changes how long operations can take before they're logged as slow, starting with the next operations to finish.
+	// The thresholds in use are reported by GetStats. Fails if either threshold is negative.
+	SetSlowOperationThresholds(thresholds SlowOperationThresholds) error
+
+	// Stops background compaction of storage from starting on any more chunks, or lets it carry on from where it was
+	// paused. Whether it's paused is reported by GetStats. Fails if compaction is disabled on this chunkserver.
+	SetCompactionPaused(paused bool) error
+
+	// Checks every version stored here against its recorded length and checksum, and every latest version against the
+	// versions stored, without comparing anything with other replicas. Other operations carry on while it runs, so a
+	// chunk changed partway through is checked as it was at some point during the check. Only one check can run at a
+	// time. The totals are also added to the counters reported by GetStats.
+	// Each finding is handed to found, ordered by chunk number and then by version; found may be nil if only the totals
+	// are wanted. Stops early with ctx's error if ctx is cancelled, or if the chunkserver shuts down.
+	VerifyAll(ctx context.Context, options VerifyOptions, found func(VerifyFinding)) (VerifyReport, error)
 }
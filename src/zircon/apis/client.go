@@ -7,12 +7,12 @@ type Client interface {
 	// If this chunk isn't written to before the connection to the server closes, the empty chunk will be deleted.
 	New() (ChunkNum, error)
 
-	// Read part or all of the contents of a chunk. offset + length cannot exceed MaxChunkSize.
+	// Read part or all of the contents of a chunk. offset + length cannot exceed GetChunkSize().
 	// Returns the data read and the version of the data read. The version can be used with Write.
 	// If the chunk does not exist, returns an error.
 	Read(ref ChunkNum, offset uint32, length uint32) ([]byte, Version, error)
 
-	// Write part or all of the contents of a chunk. offset + len(data) cannot exceed MaxChunkSize.
+	// Write part or all of the contents of a chunk. offset + len(data) cannot exceed GetChunkSize().
 	// Takes a version; if the version is not AnyVersion and doesn't match the latest version of the chunk, the write is
 	// rejected.
 	// Returns the new version, if the request succeeds, or the most recent version number, if the request fails due to
@@ -25,6 +25,9 @@ type Client interface {
 	// If the chunk does not exist, returns an error.
 	Delete(ref ChunkNum, version Version) error
 
+	// Reports the maximum chunk size of the cluster, which is the most that can be read from or written to a chunk.
+	GetChunkSize() (uint32, error)
+
 	// Close all connections used by this client.
 	Close() error
 }
@@ -0,0 +1,105 @@
+package apis
+
+import (
+	"fmt"
+	"time"
+)
+
+// A machine-readable classification of a failure, so that callers can react to specific conditions without needing to
+// parse error messages.
+type ErrorCode string
+
+const (
+	// Returned when an operation expects a chunk to be at a particular version, but the chunkserver holds another.
+	ErrWrongVersion ErrorCode = "wrong-version"
+	// Returned when a server hit an unexpected internal failure (such as a panic) while handling a request.
+	ErrInternal ErrorCode = "internal"
+	// Returned when a server is no longer accepting new operations because it is being shut down.
+	ErrShuttingDown ErrorCode = "shutting-down"
+	// Returned when a remote server could not be reached, or the connection failed partway through a request. Unlike
+	// other errors, this means that the request may or may not have been processed.
+	ErrUnreachable ErrorCode = "unreachable"
+	// Returned when deleting something that is already gone. Callers that only care that it no longer exists can treat
+	// this as success.
+	ErrAlreadyDeleted ErrorCode = "already-deleted"
+	// Returned when adding a chunk that already exists. Carries the version of the existing chunk.
+	ErrChunkExists ErrorCode = "chunk-exists"
+	// Returned when asked to move a chunk's latest version backwards (or nowhere), which would break the guarantee that
+	// versions only ever increase. Carries the latest version.
+	ErrVersionRollback ErrorCode = "version-rollback"
+	// Returned when a chunkserver cannot accept more data because its storage is full.
+	ErrOutOfSpace ErrorCode = "out-of-space"
+	// Returned when a write cannot be committed into a version because another write already committed into it touches
+	// the same bytes.
+	ErrWriteConflict ErrorCode = "write-conflict"
+	// Returned when an offset, a length, or the two together reach past the end of a chunk, as limited by the
+	// configured maximum chunk size, which is at most MaxChunkSize.
+	ErrOutOfBounds ErrorCode = "out-of-bounds"
+	// Returned when data sent from one server to another doesn't match the checksum sent along with it, meaning that it
+	// was damaged on the way. Sending it again may succeed.
+	ErrChecksumMismatch ErrorCode = "checksum-mismatch"
+	// Returned when a chunkserver is already sending as many chunks to other servers as it is allowed to, and the request
+	// couldn't get a turn in time. Carries a suggested wait in RetryAfter; another replica may be able to serve the
+	// request sooner.
+	ErrSourceBusy ErrorCode = "source-busy"
+	// Returned when a chunkserver is asked for a chunk that it holds no copy of, either because the chunk was never added
+	// to it, or because it has since been deleted from it.
+	ErrChunkNotFound ErrorCode = "chunk-not-found"
+	// Returned when an exclusive claim on a metadata block is refused because other servers hold shared claims to read
+	// it. Nothing can write to the block until they give those up.
+	ErrLeaseShared ErrorCode = "lease-shared"
+	// Returned when a chunk changed on the source while it was being replicated, so that the copy sent may already be
+	// out of date. Carries the chunk's latest version on the source, at which the replication should be restarted.
+	ErrReplicationSuperseded ErrorCode = "replication-superseded"
+	// Returned when a metadata block is too small to hold the allocation bitset or an entry that should be within it,
+	// which means that the block layout is misconfigured, rather than that anything is wrong with the request.
+	ErrBlockGeometry ErrorCode = "block-geometry"
+)
+
+// An error tagged with an ErrorCode. If relevant, also carries the most recent version of the chunk in question.
+type Error struct {
+	Code    ErrorCode
+	Message string
+	// The latest version of the chunk at the time of the error, or zero if not applicable.
+	Version Version
+	// How long to wait before trying again, or zero if the server didn't suggest anything.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Construct an error tagged with a particular code, and the latest version of the relevant chunk (if applicable).
+func NewError(code ErrorCode, version Version, format string, args ...interface{}) error {
+	return &Error{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+		Version: version,
+	}
+}
+
+// Like NewError, for errors that suggest how long to wait before trying again.
+func NewRetryableError(code ErrorCode, retryAfter time.Duration, format string, args ...interface{}) error {
+	return &Error{
+		Code:       code,
+		Message:    fmt.Sprintf(format, args...),
+		RetryAfter: retryAfter,
+	}
+}
+
+// Get how long an error suggests waiting before trying again, or zero if it doesn't suggest anything.
+func RetryAfterOf(err error) time.Duration {
+	if coded, ok := err.(*Error); ok && coded != nil {
+		return coded.RetryAfter
+	}
+	return 0
+}
+
+// Get the code associated with an error, or the empty string if the error is nil or has no code.
+func ErrorCodeOf(err error) ErrorCode {
+	if coded, ok := err.(*Error); ok && coded != nil {
+		return coded.Code
+	}
+	return ""
+}
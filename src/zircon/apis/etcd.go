@@ -20,6 +20,35 @@ const (
 	CHUNKSERVER   ServerType = iota
 )
 
+// What happened to a key, as seen by a watch.
+type WatchEventType int
+
+const (
+	WatchPut WatchEventType = iota
+	WatchDelete
+)
+
+func (t WatchEventType) String() string {
+	switch t {
+	case WatchPut:
+		return "put"
+	case WatchDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// A single change to a key, as delivered by EtcdInterface.Watch.
+type WatchEvent struct {
+	Type WatchEventType
+	Key  string
+	// The key's new value; empty for deletions.
+	Value string
+	// The revision of etcd at which the change was made. Changes made together in a single transaction share a revision.
+	Revision int64
+}
+
 type EtcdInterface interface {
 	// Get the name of this server
 	GetName() ServerName
@@ -35,15 +64,40 @@ type EtcdInterface interface {
 	// Lists server names by type of server
 	ListServers(kind ServerType) ([]ServerName, error)
 
+	// Publishes a record that this server is alive at an address, bound to a lease of its own that expires after the
+	// given TTL unless renewed. Fails if this interface already holds a live registration.
+	RegisterLive(address ServerAddress, kind ServerType, ttl time.Duration) error
+	// Renews the lease behind this server's live registration. Fails if the lease has already expired, in which case the
+	// registration is gone and must be made again.
+	RenewLiveRegistration() error
+	// Removes this server's live registration immediately, rather than waiting for its lease to expire.
+	UnregisterLive() error
+	// Lists the names of servers of a type that currently hold a live registration
+	ListLiveServers(kind ServerType) ([]ServerName, error)
+
 	// Prepares this interface to accept claims for metadata
 	BeginMetadataLease() error
 	// Gets the metadata lease timeout for this configuration.
 	GetMetadataLeaseTimeout() time.Duration
 	// Attempt to claim a particular metadata block; if already claimed, returns the original owner (no error).
 	// if successfully claimed, returns our name.
+	// Fails with ErrLeaseShared if other servers hold shared claims on the block. A shared claim held by this server is
+	// upgraded to an exclusive one.
 	TryClaimingMetadata(blockid MetadataID) (owner ServerName, err error)
+	// Attempt to claim a particular metadata block for reading only, alongside any other servers with shared claims on
+	// it. If another server holds an exclusive claim, returns that server (no error); if this server holds either kind
+	// of claim afterwards, returns our name.
+	TryClaimingMetadataShared(blockid MetadataID) (owner ServerName, err error)
+	// Looks up which server holds the exclusive claim on a metadata block, without trying to claim it. Reports false if
+	// nobody does, which includes blocks that are only held through shared claims. Works without a metadata lease.
+	GetMetadataOwner(blockid MetadataID) (owner ServerName, held bool, err error)
 	// Assuming that this server owns a particular block of metadata, release that metadata back out into the wild.
 	DisclaimMetadata(blockid MetadataID) error
+	// Turn this server's exclusive claim on a metadata block into a shared claim, so that other servers can claim it for
+	// reading too.
+	DowngradeMetadata(blockid MetadataID) error
+	// Give up this server's shared claim on a metadata block.
+	DisclaimMetadataShared(blockid MetadataID) error
 	// Claim some unclaimed metametablock. If everything that exists is claimed, return 0 and no error.
 	LeaseAnyMetametadata() (MetadataID, error)
 	// Lists the MetadataIDs of every metadata block that exists
@@ -51,7 +105,8 @@ type EtcdInterface interface {
 	// Renew the claim on all metadata blocks
 	RenewMetadataClaims() error
 
-	// Get metametadata for a metadata block; only allowed if this server has a current claim on the block
+	// Get metametadata for a metadata block; only allowed if this server has a current claim on the block, which may be
+	// a shared claim
 	GetMetametadata(blockid MetadataID) (MetadataEntry, error)
 	// Update metametadata for a metadata block; only allowed if this server has a current claim on the block
 	// If the previous value does not match the current contents, fails.
@@ -66,6 +121,22 @@ type EtcdInterface interface {
 	// Reads the filesystem root chunk number, or 0 if nonexistent
 	ReadFSRoot() (ChunkNum, error)
 
+	// Records the maximum chunk size used across the cluster, unless one was already recorded, and returns whichever
+	// size is recorded, so that every server can check that it agrees with the rest of the cluster.
+	RecordChunkSize(size uint32) (uint32, error)
+
+	// Reads the maximum chunk size recorded for the cluster, or 0 if no chunkserver has recorded one yet.
+	GetChunkSize() (uint32, error)
+
+	// Watches every key that starts with prefix, delivering each change made at or after fromRevision in revision order,
+	// until cancel is called, after which the channel is closed and nothing more is delivered. A fromRevision of zero
+	// means every change made after Watch returns. If the connection to etcd is lost, the watch is re-established from
+	// where it left off, so that no change is missed or delivered twice. The channel is only closed without cancel
+	// being called if the watch cannot go on, such as when the changes it still had to deliver have been compacted
+	// away, in which case the caller has to read the keys again and start a new watch.
+	// Every watch must be cancelled once it is no longer needed, even if its channel was closed.
+	Watch(prefix string, fromRevision int64) (events <-chan WatchEvent, cancel func(), err error)
+
 	// tear down this connection
 	Close() error
 }
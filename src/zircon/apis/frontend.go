@@ -25,12 +25,19 @@ type Frontend interface {
 	// Destroys an old chunk, assuming that the metadata version matches. This includes sending messages to all relevant
 	// chunkservers.
 	Delete(chunk ChunkNum, version Version) error
+
+	// Reports the maximum chunk size of the cluster, which offset + length of every read and write must fit within.
+	GetChunkSize() (uint32, error)
 }
 
 // Calculates a hash of a write. This is used to ensure that the same data has been replicated to all chunkservers,
 // without having to compare the entire message.
+// Chunkservers stage writes under this hash, so it's always calculated, and it must never change: hashes are kept across
+// restarts, and compared between chunkservers and clients of different builds.
 func CalculateCommitHash(offset uint32, data []byte) CommitHash {
-	hashInput := fmt.Sprintf("%d %d %s", offset, len(data), string(data))
-	hashArray := sha256.Sum256([]byte(hashInput))
-	return CommitHash(hex.EncodeToString(hashArray[:]))
+	hash := sha256.New()
+	// hashes "<offset> <length> <data>", without copying the data, which can be a whole chunk, into a string first
+	fmt.Fprintf(hash, "%d %d ", offset, len(data))
+	hash.Write(data)
+	return CommitHash(hex.EncodeToString(hash.Sum(nil)))
 }
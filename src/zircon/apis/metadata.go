@@ -1,5 +1,7 @@
 package apis
 
+import "context"
+
 // Note: the metadata chunk for metadata block N is stored in chunk N
 // Note: this means that there is NO METADATA BLOCK for 0! because that would be metametadata, which is stored in etcd.
 type MetadataID uint64
@@ -45,16 +47,56 @@ const BitsetSize = 4096
 // trying again on another server.
 const NoRedirect = ""
 
+// How up-to-date the result of a metadata read needs to be.
+type Consistency int
+
+const (
+	// Always read the authoritative copy of the metadata. This is the default, because it is always safe.
+	Fresh Consistency = iota
+	// Allow the read to be served from a locally cached copy, which may be slightly stale. Only suitable for callers
+	// that do not base updates on the result.
+	Cached
+)
+
 type MetadataCache interface {
 	// Allocate a new metadata entry and corresponding chunk number
 	NewEntry() (ChunkNum, error)
-	// Reads the metadata entry of a particular chunk.
+	// Reads the metadata entry of a particular chunk, at the requested level of consistency.
 	// If another server holds the lease on the metametadata the entry belongs to, returns its name
-	ReadEntry(chunk ChunkNum) (MetadataEntry, ServerName, error)
+	ReadEntry(chunk ChunkNum, consistency Consistency) (MetadataEntry, ServerName, error)
+	// Checks whether a chunk has a metadata entry, at the requested level of consistency, without decoding the entry.
+	// A missing entry is not an error.
+	// If another server holds the lease on the metametadata the entry belongs to, returns its name
+	EntryExists(chunk ChunkNum, consistency Consistency) (bool, ServerName, error)
 	// Update the metadate entry of a particular chunk.
 	// If another server holds the lease on the metametadata the entry belongs to, returns its name
 	UpdateEntry(chunk ChunkNum, previousEntry MetadataEntry, newEntry MetadataEntry) (ServerName, error)
+	// Atomically replace the replica list of a chunk's entry, if the entry still matches expectedEntry. Fails, without
+	// making any change, if the entry was changed concurrently.
+	// If another server holds the lease on the metametadata the entry belongs to, returns its name
+	SwapReplicas(chunk ChunkNum, expectedEntry MetadataEntry, newReplicas []ServerID) (ServerName, error)
 	// Delete a metadata entry and allow the garbage collection of the underlying chunks
 	// If another server holds the lease on the metametadata the entry belongs to, returns its name
 	DeleteEntry(chunk ChunkNum, previousEntry MetadataEntry) (ServerName, error)
+
+	// Like NewEntry, UpdateEntry, SwapReplicas and DeleteEntry, but give up once ctx is done, and attribute the change
+	// to the caller attached to ctx with WithCaller, including when the call is made over RPC.
+	NewEntryWithContext(ctx context.Context) (ChunkNum, error)
+	UpdateEntryWithContext(ctx context.Context, chunk ChunkNum, previousEntry MetadataEntry, newEntry MetadataEntry) (ServerName, error)
+	SwapReplicasWithContext(ctx context.Context, chunk ChunkNum, expectedEntry MetadataEntry, newReplicas []ServerID) (ServerName, error)
+	DeleteEntryWithContext(ctx context.Context, chunk ChunkNum, previousEntry MetadataEntry) (ServerName, error)
+}
+
+type callerKey struct{}
+
+// Attaches the identity of a caller to a context, so that changes to metadata made with the context are attributed to
+// it, such as in the audit log of a metadata cache.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return context.WithValue(ctx, callerKey{}, caller)
+}
+
+// Gets the caller identity attached to a context, or an empty string if there isn't one.
+func CallerFrom(ctx context.Context) string {
+	caller, _ := ctx.Value(callerKey{}).(string)
+	return caller
 }
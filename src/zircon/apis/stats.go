@@ -0,0 +1,131 @@
+package apis
+
+import "time"
+
+// Upper bounds of the buckets of a latency histogram. An additional final bucket counts anything slower than the last
+// bound.
+var LatencyBucketBounds = [...]time.Duration{
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// Number of buckets in a latency histogram, including the overflow bucket.
+const LatencyBucketCount = len(LatencyBucketBounds) + 1
+
+// Counters describing every invocation of a single method on a server.
+type OperationStats struct {
+	// Number of times the method was called, including calls that failed
+	Calls uint64
+	// Number of calls that returned an error
+	Errors uint64
+	// Number of bytes of chunk data passed in or out of the method
+	Bytes uint64
+	// Total time spent in the method, across all calls
+	TotalLatency time.Duration
+	// Number of calls whose latency fell into each bucket; see LatencyBucketBounds
+	LatencyHistogram [LatencyBucketCount]uint64
+	// Number of errors of each ErrorCode; errors without a code are counted under the empty code
+	ErrorsByCode map[ErrorCode]uint64
+}
+
+// Find the histogram bucket that a particular latency should be counted in.
+func LatencyBucket(latency time.Duration) int {
+	for i, bound := range LatencyBucketBounds {
+		if latency < bound {
+			return i
+		}
+	}
+	return len(LatencyBucketBounds)
+}
+
+// A snapshot of a chunkserver's storage usage, used for placement decisions and monitoring.
+type ChunkserverStats struct {
+	// Bytes of storage taken up by chunk data, counting each stored version as a full chunk of the configured maximum
+	// size. This is an upper bound, since storage backends are free (but not required) to avoid storing trailing zeroes.
+	UsedBytes uint64
+	// Upper limit on UsedBytes, or zero if no limit is configured
+	Quota uint64
+	// Number of chunks with at least one stored version
+	Chunks uint64
+	// Number of stored versions, across all chunks
+	Versions uint64
+	// Fewest, most, and average number of stored versions per chunk; all zero if there are no chunks
+	MinVersionsPerChunk  uint64
+	MaxVersionsPerChunk  uint64
+	MeanVersionsPerChunk float64
+	// Number of writes that have been started but not yet committed
+	StagedWrites uint64
+	// Bytes of data held by writes that have been started but not yet committed
+	StagedBytes uint64
+	// Bytes of chunk data across all stored versions, before and after compression. Only reported if the storage is
+	// compressed; otherwise both are zero.
+	LogicalBytes  uint64
+	PhysicalBytes uint64
+	// Bytes of chunk data as the storage actually holds it, after any compression, deltas, or sharing between versions
+	StoredBytes uint64
+	// Bytes of disk allocated to hold StoredBytes, which is less if the storage leaves holes in sparse chunks. Zero if
+	// the storage can't tell.
+	AllocatedBytes uint64
+	// File descriptors that the storage keeps open between operations
+	OpenFiles uint64
+	// How hard the storage works to make acknowledged writes survive a power loss: "none", "commit", or
+	// "stage-and-commit"
+	Durability string
+	// Reads served from memory by read-ahead, and reads that had to go to storage. Both are zero if read-ahead is
+	// disabled.
+	ReadAheadHits   uint64
+	ReadAheadMisses uint64
+	// Transfers to other chunkservers through Replicate and Push that had to wait for a turn under the outbound limits,
+	// and the ones among those that gave up waiting with ErrSourceBusy
+	ThrottledTransfers uint64
+	RejectedTransfers  uint64
+	// Time since the chunkserver was started
+	Uptime time.Duration
+	// How long operations can take before they're logged as slow, and how many operations have been logged as slow
+	// since the chunkserver was started
+	SlowOperationThresholds SlowOperationThresholds
+	SlowOperations          uint64
+	// Whether background compaction of storage has been paused through SetCompactionPaused, how far it has got through
+	// its current pass over every chunk (from 0 to 1), how many passes it has finished, and how many bytes of storage
+	// it has given back since the chunkserver was started. All zero if compaction is disabled.
+	CompactionPaused         bool
+	CompactionProgress       float64
+	CompactionPasses         uint64
+	CompactionReclaimedBytes uint64
+	// How many checks VerifyAll has finished since the chunkserver was started, and how many versions they found intact,
+	// corrupt, and missing, all told
+	VerifyRuns    uint64
+	VerifyOK      uint64
+	VerifyCorrupt uint64
+	VerifyMissing uint64
+	// Counters for each method, keyed by method name. Only populated if the chunkserver is metered.
+	Operations map[string]OperationStats
+	// What the storage itself has done since the chunkserver was started, such as files opened and synced and bytes
+	// read and written, keyed by counter name, and how long its reads, writes, syncs, and compactions have taken,
+	// keyed by name, with only Calls, TotalLatency, and LatencyHistogram filled in. Only populated if the storage
+	// reports these.
+	StorageCounters  map[string]uint64
+	StorageLatencies map[string]OperationStats
+}
+
+// How long an operation on a chunkserver can take before it's logged as slow, for each class of operation. Zero means
+// that operations of that class are never logged.
+type SlowOperationThresholds struct {
+	// Operations that read or write chunk data: Read, StartWrite, StartWriteReplicated, CommitWrite, CommitWriteBatch,
+	// Add, ForceAdd, and ForceAddChecked
+	Data time.Duration
+	// Every other operation
+	Control time.Duration
+}
+
+// Get the amount of space remaining under the quota, or zero if there is no quota or it has been exceeded.
+func (s ChunkserverStats) FreeBytes() uint64 {
+	if s.Quota <= s.UsedBytes {
+		return 0
+	}
+	return s.Quota - s.UsedBytes
+}
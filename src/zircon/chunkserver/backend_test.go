@@ -0,0 +1,62 @@
+package chunkserver
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"strconv"
+	"testing"
+	"zircon/apis"
+	"zircon/chunkserver/control"
+	"zircon/chunkserver/storage"
+	"zircon/rpc"
+	"zircon/util"
+)
+
+// A bespoke backend, as a downstream user might write: memory storage that counts how many versions it's asked to write.
+type countingStorage struct {
+	storage.ChunkStorage
+	writes *int
+}
+
+func (c countingStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	*c.writes += 1
+	return c.ChunkStorage.WriteVersion(chunk, version, data)
+}
+
+var countedWrites = map[string]*int{}
+
+func init() {
+	storage.RegisterBackend("counting-test", func(config map[string]string) (storage.ChunkStorage, error) {
+		capacity, err := strconv.Atoi(config["capacity"])
+		if err != nil {
+			return nil, err
+		}
+		mem, err := storage.ConfigureMemoryStorageWithCap(capacity)
+		if err != nil {
+			return nil, err
+		}
+		writes := new(int)
+		countedWrites[config["name"]] = writes
+		return countingStorage{ChunkStorage: mem, writes: writes}, nil
+	})
+}
+
+func TestCustomBackend(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+	cs, stats, teardown := NewTestChunkserverWithOptions(t, cache, control.ChunkserverOptions{
+		Backend:       "counting-test",
+		BackendConfig: map[string]string{"name": "custom", "capacity": "0"},
+	}, ChatterOptions{})
+	defer teardown()
+
+	assert.NoError(cs.Add(7, []byte("on a custom backend"), 1))
+	data, version, err := cs.Read(7, 0, 32, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(1), version)
+	assert.Equal("on a custom backend", string(util.StripTrailingZeroes(data)))
+	assert.Equal(1, *countedWrites["custom"])
+	assert.Equal(uint64(1), stats().Versions)
+	assert.Contains(storage.Backends(), "counting-test")
+}
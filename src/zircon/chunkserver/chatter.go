@@ -1,31 +1,175 @@
 package chunkserver
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 	"zircon/apis"
+	"zircon/chunkserver/control"
 	"zircon/rpc"
 	"zircon/util"
 )
 
 type wrapper struct {
-	Single apis.ChunkserverSingle
-	Cache  rpc.ConnectionCache
+	Single  apis.ChunkserverSingle
+	Cache   rpc.ConnectionCache
+	Options ChatterOptions
+	// shared by every transfer made to repair another chunkserver
+	replication *throttle
+	outbound    *transferLimiter
+}
+
+// Optional behaviors for talking to other chunkservers. The zero value gives the default behavior.
+type ChatterOptions struct {
+	// How many times to try forwarding a staged write to each replica before giving up. Zero means the default of
+	// DefaultForwardAttempts.
+	ForwardAttempts int
+	// How long to wait before the first retry of a forward; the wait doubles after each further failure. Zero means the
+	// default of DefaultForwardBackoff.
+	ForwardBackoff time.Duration
+	// How many times to send a chunk through Replicate or Push before giving up, if it keeps arriving damaged. Zero means
+	// the default of DefaultTransferAttempts.
+	TransferAttempts int
+	// The most bytes per second to send to other chunkservers through Replicate and Push, averaged over time, so that
+	// large-scale repairs don't starve client traffic. Reads by clients are not limited. Zero means no limit.
+	ReplicationBandwidth int64
+	// The most transfers through Replicate and Push that can be underway at once, in total and to any one chunkserver.
+	// Zero means no limit.
+	MaxOutboundTransfers        int
+	MaxOutboundTransfersPerPeer int
+	// How long a transfer waits for its turn under the limits above before giving up with ErrSourceBusy. Zero means the
+	// default of DefaultTransferQueueTimeout.
+	TransferQueueTimeout time.Duration
+}
+
+// Rejects options that could never work as intended, rather than letting them silently do nothing.
+func (o ChatterOptions) Validate() error {
+	if o.ForwardAttempts < 0 {
+		return fmt.Errorf("forward attempts cannot be negative: %d", o.ForwardAttempts)
+	}
+	if o.ForwardBackoff < 0 {
+		return fmt.Errorf("forward backoff cannot be negative: %v", o.ForwardBackoff)
+	}
+	if o.TransferAttempts < 0 {
+		return fmt.Errorf("transfer attempts cannot be negative: %d", o.TransferAttempts)
+	}
+	if o.ReplicationBandwidth < 0 {
+		return fmt.Errorf("replication bandwidth cannot be negative: %d", o.ReplicationBandwidth)
+	}
+	if o.MaxOutboundTransfers < 0 || o.MaxOutboundTransfersPerPeer < 0 {
+		return fmt.Errorf("outbound transfer limits cannot be negative: %d total, %d per peer",
+			o.MaxOutboundTransfers, o.MaxOutboundTransfersPerPeer)
+	}
+	if o.TransferQueueTimeout < 0 {
+		return fmt.Errorf("transfer queue timeout cannot be negative: %v", o.TransferQueueTimeout)
+	}
+	if o.ForwardAttempts == 1 && o.ForwardBackoff != 0 {
+		return fmt.Errorf("forward backoff of %v set, but forwards are never retried", o.ForwardBackoff)
+	}
+	return nil
+}
+
+// Fills in the defaults for anything left unset.
+func (o ChatterOptions) withDefaults() ChatterOptions {
+	if o.ForwardAttempts == 0 {
+		o.ForwardAttempts = DefaultForwardAttempts
+	}
+	if o.ForwardBackoff == 0 {
+		o.ForwardBackoff = DefaultForwardBackoff
+	}
+	if o.TransferAttempts == 0 {
+		o.TransferAttempts = DefaultTransferAttempts
+	}
+	if o.TransferQueueTimeout == 0 {
+		o.TransferQueueTimeout = DefaultTransferQueueTimeout
+	}
+	return o
 }
 
 // Supplement a basic chunkserver interface with the ability to connect to other chunkservers
 func WithChatter(server apis.ChunkserverSingle, conncache rpc.ConnectionCache) (apis.Chunkserver, error) {
-	return &wrapper{Single: server, Cache: conncache}, nil
+	return WithChatterOptions(server, conncache, ChatterOptions{})
+}
+
+// Like WithChatter, but with non-default options, which are checked with Validate first.
+func WithChatterOptions(server apis.ChunkserverSingle, conncache rpc.ConnectionCache, options ChatterOptions) (apis.Chunkserver, error) {
+	if err := options.Validate(); err != nil {
+		return nil, fmt.Errorf("[chatter.go/OPT] %v", err)
+	}
+	options = options.withDefaults()
+	return &wrapper{
+		Single:      server,
+		Cache:       conncache,
+		Options:     options,
+		replication: newThrottle(options.ReplicationBandwidth),
+		outbound: newTransferLimiter(options.MaxOutboundTransfers, options.MaxOutboundTransfersPerPeer,
+			options.TransferQueueTimeout),
+	}, nil
+}
+
+func (w *wrapper) ListAllChunks(minimum apis.Version, maximum apis.Version) ([]apis.ChunkVersion, error) {
+	return w.Single.ListAllChunks(minimum, maximum)
+}
+
+func (w *wrapper) ListAllChunksWithHashes(minimum apis.Version, maximum apis.Version) ([]apis.ChunkVersionHashes, error) {
+	return w.Single.ListAllChunksWithHashes(minimum, maximum)
+}
+
+func (w *wrapper) ListChunks(filter apis.ChunkFilter) ([]apis.ChunkVersion, error) {
+	return w.Single.ListChunks(filter)
+}
+
+func (w *wrapper) ListTombstones() ([]apis.Tombstone, error) {
+	return w.Single.ListTombstones()
+}
+
+func (w *wrapper) ForgetTombstone(chunk apis.ChunkNum) error {
+	return w.Single.ForgetTombstone(chunk)
+}
+
+func (w *wrapper) SetSlowOperationThresholds(thresholds apis.SlowOperationThresholds) error {
+	return w.Single.SetSlowOperationThresholds(thresholds)
+}
+
+func (w *wrapper) SetCompactionPaused(paused bool) error {
+	return w.Single.SetCompactionPaused(paused)
 }
 
-func (w *wrapper) ListAllChunks() ([]apis.ChunkVersion, error) {
-	return w.Single.ListAllChunks()
+func (w *wrapper) VerifyAll(ctx context.Context, options apis.VerifyOptions, found func(apis.VerifyFinding)) (apis.VerifyReport, error) {
+	return w.Single.VerifyAll(ctx, options, found)
+}
+
+func (w *wrapper) GetStats() (apis.ChunkserverStats, error) {
+	stats, err := w.Single.GetStats()
+	if err != nil {
+		return apis.ChunkserverStats{}, err
+	}
+	stats.ThrottledTransfers, stats.RejectedTransfers = w.outbound.counts()
+	return stats, nil
+}
+
+func (w *wrapper) OverrideLatestVersion(chunk apis.ChunkNum, version apis.Version) error {
+	return w.Single.OverrideLatestVersion(chunk, version)
 }
 
 func (w *wrapper) Add(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
 	return w.Single.Add(chunk, initialData, initialVersion)
 }
 
+func (w *wrapper) AddWithMode(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version, mode apis.AddMode) error {
+	return w.Single.AddWithMode(chunk, initialData, initialVersion, mode)
+}
+
+func (w *wrapper) ForceAdd(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
+	return w.Single.ForceAdd(chunk, initialData, initialVersion)
+}
+
+func (w *wrapper) ForceAddChecked(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version, checksum uint32) error {
+	return w.Single.ForceAddChecked(chunk, initialData, initialVersion, checksum)
+}
+
 func (w *wrapper) Delete(chunk apis.ChunkNum, version apis.Version) error {
 	return w.Single.Delete(chunk, version)
 }
@@ -34,6 +178,13 @@ func (w *wrapper) Read(chunk apis.ChunkNum, offset uint32, length uint32, minimu
 	return w.Single.Read(chunk, offset, length, minimum)
 }
 
+func (w *wrapper) OpenRead(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) (*apis.BulkRead, bool, error) {
+	if reader, ok := w.Single.(apis.BulkReader); ok {
+		return reader.OpenRead(chunk, offset, length, minimum)
+	}
+	return nil, false, nil
+}
+
 func (w *wrapper) StartWrite(chunk apis.ChunkNum, offset uint32, data []byte) error {
 	return w.Single.StartWrite(chunk, offset, data)
 }
@@ -42,38 +193,242 @@ func (w *wrapper) CommitWrite(chunk apis.ChunkNum, hash apis.CommitHash, oldVers
 	return w.Single.CommitWrite(chunk, hash, oldVersion, newVersion)
 }
 
+func (w *wrapper) CommitWriteBatch(commits []apis.CommitWriteRequest) ([]error, error) {
+	return w.Single.CommitWriteBatch(commits)
+}
+
 func (w *wrapper) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.Version, newVersion apis.Version) error {
 	return w.Single.UpdateLatestVersion(chunk, oldVersion, newVersion)
 }
 
+// How many times to try forwarding a staged write to each replica before giving up, and how long to wait before the
+// first retry, unless ChatterOptions says otherwise. The wait doubles after each further failure.
+const (
+	DefaultForwardAttempts = 3
+	DefaultForwardBackoff  = 50 * time.Millisecond
+)
+
+// Describes why forwarding a staged write to a particular replica failed.
+type ReplicaFailure struct {
+	Address  apis.ServerAddress
+	Attempts int
+	Err      error
+}
+
+// Returned by StartWriteReplicated when the write was staged locally, but could not be forwarded to every replica.
+type FanOutError struct {
+	Replicas int
+	Failures []ReplicaFailure
+}
+
+func (e *FanOutError) Error() string {
+	parts := make([]string, len(e.Failures))
+	for i, failure := range e.Failures {
+		parts[i] = fmt.Sprintf("%s (after %d attempts): %v", failure.Address, failure.Attempts, failure.Err)
+	}
+	return fmt.Sprintf("[chatter.go/SSW] could not forward write to %d of %d replicas: %s",
+		len(e.Failures), e.Replicas, strings.Join(parts, "; "))
+}
+
+// Only failures to communicate with the replica are worth retrying; if the replica itself rejected the write, it will
+// just do so again.
+func isRetryableForward(err error) bool {
+	return apis.ErrorCodeOf(err) == apis.ErrUnreachable
+}
+
+// Connects to another chunkserver, such that every request made to it is made with ctx.
+func (w *wrapper) subscribe(ctx context.Context, address apis.ServerAddress) (apis.Chunkserver, error) {
+	server, err := w.Cache.SubscribeChunkserver(address)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.ChunkserverWithContext(ctx, server), nil
+}
+
+// Forwarding a staged write is idempotent, so it is always safe to retry, until ctx is done. Returns the number of
+// attempts made.
+func (w *wrapper) forwardWrite(ctx context.Context, replica apis.ServerAddress, chunk apis.ChunkNum, offset uint32, data []byte) (int, error) {
+	server, err := w.subscribe(ctx, replica)
+	if err != nil {
+		return 0, fmt.Errorf("[chatter.go/CSC] %v", err)
+	}
+	backoff := util.ExponentialBackoff(w.Options.ForwardBackoff, 0)
+	retryable := func(err error) bool {
+		return isRetryableForward(err) && ctx.Err() == nil
+	}
+	return util.Retry(w.Options.ForwardAttempts, backoff, retryable, func() error {
+		return server.StartWrite(chunk, offset, data)
+	})
+}
+
 func (w *wrapper) StartWriteReplicated(chunk apis.ChunkNum, offset uint32, data []byte, replicas []apis.ServerAddress) error {
+	return w.StartWriteReplicatedWithContext(context.Background(), chunk, offset, data, replicas)
+}
+
+func (w *wrapper) StartWriteReplicatedWithContext(ctx context.Context, chunk apis.ChunkNum, offset uint32, data []byte, replicas []apis.ServerAddress) error {
+	start := time.Now()
 	if err := w.Single.StartWrite(chunk, offset, data); err != nil {
 		return fmt.Errorf("[chatter.go/WSW] %v", err)
 	}
+	forwarding := time.Now()
+	var failures []ReplicaFailure
 	for _, replica := range replicas {
-		server, err := w.Cache.SubscribeChunkserver(replica)
-		if err != nil {
-			return fmt.Errorf("[chatter.go/CSC] %v", err)
-		}
-		err = server.StartWrite(chunk, offset, data)
+		attempts, err := w.forwardWrite(ctx, replica, chunk, offset, data)
 		if err != nil {
-			return fmt.Errorf("[chatter.go/SSW] %v", err)
+			failures = append(failures, ReplicaFailure{Address: replica, Attempts: attempts, Err: err})
 		}
 	}
+	// the local part of the write has already been reported on its own, as a StartWrite
+	if reporter, ok := w.Single.(control.SlowOperationReporter); ok {
+		reporter.ReportOperation(control.SlowOperation{
+			Method:      "StartWriteReplicated",
+			Chunk:       chunk,
+			Offset:      offset,
+			Length:      uint32(len(data)),
+			Duration:    time.Since(start),
+			Replication: time.Since(forwarding),
+		})
+	}
+	if len(failures) > 0 {
+		return &FanOutError{Replicas: len(replicas), Failures: failures}
+	}
 	return nil
 }
 
+// How many times to send a chunk through Replicate or Push, and how long to wait for a turn to send it, unless
+// ChatterOptions says otherwise.
+const (
+	DefaultTransferAttempts     = 3
+	DefaultTransferQueueTimeout = 250 * time.Millisecond
+)
+
+// Damage in transit is the only failure worth sending a chunk again for; the data is reread each time, in case it was
+// damaged before it ever left this server.
+func isRetryableTransfer(err error) bool {
+	return apis.ErrorCodeOf(err) == apis.ErrChecksumMismatch
+}
+
+// Sends this server's copy of a chunk to another chunkserver through ForceAddChecked, so that the other server refuses
+// it if it arrives damaged. If required isn't AnyVersion, only that version is sent. Returns the version sent.
+// If the chunk is committed into or moves to a new version here before the other server has stored it, the transfer
+// fails with ErrReplicationSuperseded, and should be started over at the version carried by the error; see
+// control.ReplicationTracker.
+func (w *wrapper) transfer(server apis.Chunkserver, peer apis.ServerAddress, chunk apis.ChunkNum, required apis.Version) (apis.Version, error) {
+	release, err := w.outbound.acquire(peer)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	tracker, _ := w.Single.(control.ReplicationTracker)
+	var version apis.Version
+	_, err = util.Retry(w.Options.TransferAttempts, util.ConstantBackoff(0), isRetryableTransfer, func() error {
+		// each attempt rereads the chunk, so only changes made since this attempt started can make it stale
+		var replication *control.Replication
+		if tracker != nil {
+			replication = tracker.BeginReplication(chunk)
+			defer replication.End()
+		}
+		data, readVersion, err := w.Single.Read(chunk, 0, control.MaxChunkSizeOf(w.Single), required)
+		if err != nil {
+			return err
+		}
+		if required != apis.AnyVersion && readVersion != required {
+			return errors.New("attempt to replicate from non-primary version")
+		}
+		version = readVersion
+		data = util.StripTrailingZeroes(data)
+		w.replication.wait(len(data))
+		if err := server.ForceAddChecked(chunk, data, version, apis.ChunkChecksum(data)); err != nil {
+			return err
+		}
+		if replication != nil {
+			return replication.Check()
+		}
+		return nil
+	})
+	return version, err
+}
+
 func (w *wrapper) Replicate(chunk apis.ChunkNum, serverAddress apis.ServerAddress, required apis.Version) error {
-	server, err := w.Cache.SubscribeChunkserver(serverAddress)
+	return w.ReplicateWithContext(context.Background(), chunk, serverAddress, required)
+}
+
+func (w *wrapper) ReplicateWithContext(ctx context.Context, chunk apis.ChunkNum, serverAddress apis.ServerAddress, required apis.Version) error {
+	server, err := w.subscribe(ctx, serverAddress)
 	if err != nil {
 		return err
 	}
-	data, version, err := w.Single.Read(chunk, 0, apis.MaxChunkSize, required)
+	// the target may hold a stale copy from before it fell out of the replica set, which should be replaced
+	_, err = w.transfer(server, serverAddress, chunk, required)
+	return err
+}
+
+func (w *wrapper) Push(chunk apis.ChunkNum, serverAddress apis.ServerAddress) (apis.Version, error) {
+	return w.PushWithContext(context.Background(), chunk, serverAddress)
+}
+
+func (w *wrapper) PushWithContext(ctx context.Context, chunk apis.ChunkNum, serverAddress apis.ServerAddress) (apis.Version, error) {
+	server, err := w.subscribe(ctx, serverAddress)
 	if err != nil {
-		return err
+		return 0, fmt.Errorf("[chatter.go/PSC] %v", err)
+	}
+	version, err := w.transfer(server, serverAddress, chunk, apis.AnyVersion)
+	if coded, ok := err.(*apis.Error); ok && coded.Code == apis.ErrChunkExists && coded.Version == version {
+		// the target already caught up on its own
+		return version, nil
+	}
+	if err != nil {
+		return 0, err
 	}
-	if version != required {
-		return errors.New("attempt to replicate from non-primary version")
+	return version, nil
+}
+
+// Fetches a copy of a version from another chunkserver, and makes sure that it's the one we're looking for.
+func (w *wrapper) fetchVerified(ctx context.Context, source apis.ServerAddress, chunk apis.ChunkNum, version apis.Version, checksum uint32) ([]byte, error) {
+	server, err := w.subscribe(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	data, readVersion, err := server.Read(chunk, 0, control.MaxChunkSizeOf(w.Single), version)
+	if err != nil {
+		return nil, err
+	}
+	if readVersion != version {
+		return nil, fmt.Errorf("source has moved on to version %d", readVersion)
+	}
+	data = util.StripTrailingZeroes(data)
+	if apis.ChunkChecksum(data) != checksum {
+		return nil, apis.NewError(apis.ErrChecksumMismatch, version, "copy of %d/%d failed checksum verification", chunk, version)
+	}
+	return data, nil
+}
+
+func (w *wrapper) RepairChunk(chunk apis.ChunkNum, version apis.Version, checksum uint32, sources []apis.ServerAddress) (apis.ServerAddress, error) {
+	return w.RepairChunkWithContext(context.Background(), chunk, version, checksum, sources)
+}
+
+// Stops trying further sources once ctx is done.
+func (w *wrapper) RepairChunkWithContext(ctx context.Context, chunk apis.ChunkNum, version apis.Version, checksum uint32, sources []apis.ServerAddress) (apis.ServerAddress, error) {
+	repairer, ok := w.Single.(control.Repairer)
+	if !ok {
+		return "", errors.New("[chatter.go/RPR] chunkserver cannot replace versions")
+	}
+	var failures []string
+	for _, source := range sources {
+		if err := ctx.Err(); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", source, err))
+			break
+		}
+		data, err := w.fetchVerified(ctx, source, chunk, version, checksum)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", source, err))
+			continue
+		}
+		if err := repairer.ReplaceVersion(chunk, version, data); err != nil {
+			return "", fmt.Errorf("[chatter.go/RRV] %v", err)
+		}
+		return source, nil
 	}
-	return server.Add(chunk, util.StripTrailingZeroes(data), version)
+	return "", fmt.Errorf("[chatter.go/RNS] no verified copy of %d/%d among %d sources: %s",
+		chunk, version, len(sources), strings.Join(failures, "; "))
 }
@@ -1,9 +1,15 @@
 package chunkserver
 
 import (
+	"bytes"
 	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
 	"testing"
+	"time"
 	"zircon/apis"
+	"zircon/chunkserver/control"
+	"zircon/chunkserver/storage"
 	"zircon/rpc"
 	"zircon/util"
 )
@@ -35,6 +41,149 @@ func TestChatterReplicate(t *testing.T) {
 	assert.Equal("hello world", string(util.StripTrailingZeroes(data)))
 }
 
+func TestChatterPush(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+
+	main, _, mainT := NewTestChunkserver(t, cache)
+	defer mainT()
+	alt, _, altT := NewTestChunkserver(t, cache)
+	defer altT()
+
+	teardown, address, err := rpc.PublishChunkserver(alt, ":0")
+	assert.NoError(err)
+	defer teardown(true)
+
+	assert.NoError(main.Add(73, []byte("hello world"), 2))
+
+	// the target starts out empty
+	version, err := main.Push(73, address)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), version)
+
+	data, ver, err := alt.Read(73, 0, 16, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), ver)
+	assert.Equal("hello world", string(util.StripTrailingZeroes(data)))
+
+	// the source moves ahead while the target isn't listening, and then pushes again to bring it back up to date
+	assert.NoError(main.StartWrite(73, 0, []byte("HELLO")))
+	assert.NoError(main.CommitWrite(73, apis.CalculateCommitHash(0, []byte("HELLO")), 2, 3))
+	assert.NoError(main.UpdateLatestVersion(73, 2, 3))
+
+	version, err = main.Push(73, address)
+	assert.NoError(err)
+	assert.Equal(apis.Version(3), version)
+
+	data, ver, err = alt.Read(73, 0, 16, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(3), ver)
+	assert.Equal("HELLO world", string(util.StripTrailingZeroes(data)))
+
+	chunks, err := alt.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkVersion{{Chunk: 73, Version: 3}}, chunks)
+
+	// once converged, pushing again changes nothing
+	version, err = main.Push(73, address)
+	assert.NoError(err)
+	assert.Equal(apis.Version(3), version)
+
+	// but a source that has fallen behind must not clobber a newer copy
+	assert.NoError(alt.StartWrite(73, 0, []byte("howdy")))
+	assert.NoError(alt.CommitWrite(73, apis.CalculateCommitHash(0, []byte("howdy")), 3, 4))
+	assert.NoError(alt.UpdateLatestVersion(73, 3, 4))
+
+	_, err = main.Push(73, address)
+	assert.Equal(apis.ErrChunkExists, apis.ErrorCodeOf(err))
+	data, ver, err = alt.Read(73, 0, 16, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(4), ver)
+	assert.Equal("howdy world", string(util.StripTrailingZeroes(data)))
+}
+
+func TestChatterReplicateVerifiesTransfer(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+	faulty := rpc.NewFaultyCache(cache)
+
+	main, _, mainT := NewTestChunkserver(t, faulty)
+	defer mainT()
+	alt, _, altT := NewTestChunkserver(t, cache)
+	defer altT()
+
+	teardown, address, err := rpc.PublishChunkserver(alt, ":0")
+	assert.NoError(err)
+	defer teardown(true)
+
+	assert.NoError(main.Add(73, []byte("hello world"), 2))
+
+	// damage that happens on every attempt means that the replica refuses to store anything
+	faulty.CorruptNext(address, DefaultTransferAttempts)
+	err = main.Replicate(73, address, 2)
+	assert.Equal(apis.ErrChecksumMismatch, apis.ErrorCodeOf(err))
+	_, _, err = alt.Read(73, 0, 16, apis.AnyVersion)
+	assert.Error(err)
+
+	// but damage to a single attempt is recovered from by sending the data again
+	faulty.CorruptNext(address, 1)
+	assert.NoError(main.Replicate(73, address, 2))
+	data, ver, err := alt.Read(73, 0, 16, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), ver)
+	assert.Equal("hello world", string(util.StripTrailingZeroes(data)))
+}
+
+func TestChatterReplicateSupersededByCommit(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	faulty := storage.WithFaults(mem)
+	single, teardownSingle, err := control.ExposeChunkserver(faulty)
+	require.NoError(t, err)
+	defer teardownSingle()
+	main, err := WithChatter(single, cache)
+	require.NoError(t, err)
+	alt, _, altT := NewTestChunkserver(t, cache)
+	defer altT()
+
+	teardown, address, err := rpc.PublishChunkserver(alt, ":0")
+	assert.NoError(err)
+	defer teardown(true)
+
+	assert.NoError(main.Add(73, []byte("hello world"), 2))
+	assert.NoError(main.StartWrite(73, 0, []byte("HELLO")))
+
+	// a write lands while the source is still reading the chunk to send it
+	faulty.SetReadLatency(100 * time.Millisecond)
+	replicated := make(chan error)
+	go func() {
+		replicated <- main.Replicate(73, address, 2)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	assert.NoError(main.CommitWrite(73, apis.CalculateCommitHash(0, []byte("HELLO")), 2, 3))
+	assert.NoError(main.UpdateLatestVersion(73, 2, 3))
+	err = <-replicated
+	assert.Equal(apis.ErrReplicationSuperseded, apis.ErrorCodeOf(err))
+	assert.Equal(apis.Version(3), err.(*apis.Error).Version)
+
+	// restarting at the newer version brings the replica up to date
+	faulty.SetReadLatency(0)
+	assert.NoError(main.Replicate(73, address, 3))
+	data, ver, err := alt.Read(73, 0, 16, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(3), ver)
+	assert.Equal("HELLO world", string(util.StripTrailingZeroes(data)))
+}
+
 func TestChatterStartReplicated(t *testing.T) {
 	assert := testifyAssert.New(t)
 
@@ -81,3 +230,360 @@ func TestChatterStartReplicated(t *testing.T) {
 		assert.Equal("hello universe", string(util.StripTrailingZeroes(data)))
 	}
 }
+
+func TestChatterStartReplicatedRetriesDroppedForward(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+	faulty := rpc.NewFaultyCache(cache)
+
+	main, _, mainT := NewTestChunkserver(t, faulty)
+	defer mainT()
+	alt, _, altT := NewTestChunkserver(t, cache)
+	defer altT()
+
+	teardown, address, err := rpc.PublishChunkserver(alt, ":0")
+	assert.NoError(err)
+	defer teardown(true)
+
+	assert.NoError(main.Add(73, []byte("hello world"), 2))
+	assert.NoError(alt.Add(73, []byte("hello world"), 2))
+
+	faulty.DropNext(address, 1)
+	assert.NoError(main.StartWriteReplicated(73, 6, []byte("universe"), []apis.ServerAddress{address}))
+
+	// the retried forward should have staged the write on the replica
+	assert.NoError(alt.CommitWrite(73, apis.CalculateCommitHash(6, []byte("universe")), 2, 3))
+}
+
+func TestChatterStartReplicatedReportsFailures(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+	faulty := rpc.NewFaultyCache(cache)
+
+	main, _, mainT := NewTestChunkserver(t, faulty)
+	defer mainT()
+	alt1, _, alt1T := NewTestChunkserver(t, cache)
+	defer alt1T()
+	alt2, _, alt2T := NewTestChunkserver(t, cache)
+	defer alt2T()
+
+	teardown1, address1, err := rpc.PublishChunkserver(alt1, ":0")
+	assert.NoError(err)
+	defer teardown1(true)
+	teardown2, address2, err := rpc.PublishChunkserver(alt2, ":0")
+	assert.NoError(err)
+	defer teardown2(true)
+
+	assert.NoError(main.Add(73, []byte("hello world"), 2))
+	assert.NoError(alt1.Add(73, []byte("hello world"), 2))
+	// alt2 does not have the chunk, so it will reject the write outright
+
+	faulty.DropNext(address1, 100)
+	err = main.StartWriteReplicated(73, 6, []byte("universe"), []apis.ServerAddress{address1, address2})
+	assert.Error(err)
+
+	fanout, ok := err.(*FanOutError)
+	if assert.True(ok) {
+		assert.Equal(2, fanout.Replicas)
+		assert.Equal(2, len(fanout.Failures))
+
+		assert.Equal(address1, fanout.Failures[0].Address)
+		assert.Equal(DefaultForwardAttempts, fanout.Failures[0].Attempts)
+		assert.Equal(apis.ErrUnreachable, apis.ErrorCodeOf(fanout.Failures[0].Err))
+
+		// rejections by the replica itself are not retried
+		assert.Equal(address2, fanout.Failures[1].Address)
+		assert.Equal(1, fanout.Failures[1].Attempts)
+	}
+}
+
+func TestChatterOptions(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	assert.NoError(ChatterOptions{}.Validate())
+	assert.NoError(ChatterOptions{ForwardAttempts: 1}.Validate())
+	assert.NoError(ChatterOptions{ForwardAttempts: 5, ForwardBackoff: time.Millisecond}.Validate())
+	assert.Error(ChatterOptions{ForwardAttempts: -1}.Validate())
+	assert.Error(ChatterOptions{ForwardBackoff: -time.Millisecond}.Validate())
+	assert.Error(ChatterOptions{TransferAttempts: -1}.Validate())
+	assert.Error(ChatterOptions{MaxOutboundTransfersPerPeer: -1}.Validate())
+	assert.Error(ChatterOptions{TransferQueueTimeout: -time.Millisecond}.Validate())
+	// a backoff that is never waited out is a sign of a mistake
+	assert.Error(ChatterOptions{ForwardAttempts: 1, ForwardBackoff: time.Second}.Validate())
+
+	// unset fields fall back to the defaults, and set ones are kept
+	assert.Equal(ChatterOptions{ForwardAttempts: DefaultForwardAttempts, ForwardBackoff: DefaultForwardBackoff,
+		TransferAttempts: DefaultTransferAttempts, TransferQueueTimeout: DefaultTransferQueueTimeout},
+		ChatterOptions{}.withDefaults())
+	assert.Equal(ChatterOptions{ForwardAttempts: 7, ForwardBackoff: DefaultForwardBackoff,
+		TransferAttempts: DefaultTransferAttempts, TransferQueueTimeout: DefaultTransferQueueTimeout},
+		ChatterOptions{ForwardAttempts: 7}.withDefaults())
+
+	_, err := WithChatterOptions(nil, nil, ChatterOptions{ForwardAttempts: -1})
+	assert.Error(err)
+}
+
+func TestChatterForwardAttemptsOption(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+	faulty := rpc.NewFaultyCache(cache)
+
+	main, _, mainT := NewTestChunkserverWithOptions(t, faulty, control.ChunkserverOptions{}, ChatterOptions{ForwardAttempts: 1})
+	defer mainT()
+	alt, _, altT := NewTestChunkserver(t, cache)
+	defer altT()
+
+	teardown, address, err := rpc.PublishChunkserver(alt, ":0")
+	assert.NoError(err)
+	defer teardown(true)
+
+	assert.NoError(main.Add(73, []byte("hello world"), 2))
+	assert.NoError(alt.Add(73, []byte("hello world"), 2))
+
+	// with only a single attempt, a dropped forward is not retried
+	faulty.DropNext(address, 1)
+	err = main.StartWriteReplicated(73, 6, []byte("universe"), []apis.ServerAddress{address})
+	fanout, ok := err.(*FanOutError)
+	if assert.True(ok) {
+		assert.Equal(1, fanout.Failures[0].Attempts)
+	}
+}
+
+func TestChatterReplicationBandwidth(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+
+	const bandwidth = 256 * 1024
+	main, _, mainT := NewTestChunkserverWithOptions(t, cache, control.ChunkserverOptions{}, ChatterOptions{ReplicationBandwidth: bandwidth})
+	defer mainT()
+	alt, _, altT := NewTestChunkserver(t, cache)
+	defer altT()
+
+	teardown, address, err := rpc.PublishChunkserver(alt, ":0")
+	assert.NoError(err)
+	defer teardown(true)
+
+	data := bytes.Repeat([]byte("z"), 64*1024)
+	const chunks = 4
+	for i := 0; i < chunks; i++ {
+		assert.NoError(main.Add(apis.ChunkNum(80+i), data, 1))
+	}
+	assert.NoError(main.Add(90, []byte("client data"), 1))
+
+	// clients keep reading from the same chunkserver while it replicates
+	done := make(chan struct{})
+	slowest := make(chan time.Duration, 1)
+	go func() {
+		var worst time.Duration
+		defer func() { slowest <- worst }()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			start := time.Now()
+			_, _, err := main.Read(90, 0, 11, apis.AnyVersion)
+			assert.NoError(err)
+			if elapsed := time.Since(start); elapsed > worst {
+				worst = elapsed
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < chunks; i++ {
+		assert.NoError(main.Replicate(apis.ChunkNum(80+i), address, 1))
+	}
+	elapsed := time.Since(start)
+	close(done)
+
+	throughput := float64(chunks*len(data)) / elapsed.Seconds()
+	assert.True(throughput <= bandwidth, "replicated at %.0f bytes/sec, over the cap of %d", throughput, bandwidth)
+	assert.True(<-slowest < 100*time.Millisecond, "client reads should not wait behind replication")
+
+	for i := 0; i < chunks; i++ {
+		replica, _, err := alt.Read(apis.ChunkNum(80+i), 0, uint32(len(data)), 1)
+		assert.NoError(err)
+		assert.Equal(data, replica)
+	}
+}
+
+// A chunkserver that takes its time storing forced chunks, and keeps track of how many it is storing at once.
+type slowReceiver struct {
+	apis.Chunkserver
+	delay time.Duration
+
+	mu      *sync.Mutex
+	current *int
+	peak    *int
+}
+
+func (r *slowReceiver) ForceAddChecked(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version, checksum uint32) error {
+	r.mu.Lock()
+	*r.current += 1
+	if *r.current > *r.peak {
+		*r.peak = *r.current
+	}
+	r.mu.Unlock()
+	time.Sleep(r.delay)
+	r.mu.Lock()
+	*r.current -= 1
+	r.mu.Unlock()
+	return nil
+}
+
+func TestChatterOutboundTransferLimits(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	var mu sync.Mutex
+	var current, peak, peerCurrent, peerPeak int
+	cache := &rpc.MockCache{Chunkservers: map[apis.ServerAddress]apis.Chunkserver{}}
+	addresses := []apis.ServerAddress{"busy-peer", "peer-1", "peer-2", "peer-3"}
+	for i, address := range addresses {
+		if i == 0 {
+			// the first peer is counted on its own as well, to check the limit for a single peer
+			cache.Chunkservers[address] = &slowReceiver{delay: 20 * time.Millisecond, mu: &mu, current: &peerCurrent, peak: &peerPeak}
+		} else {
+			cache.Chunkservers[address] = &slowReceiver{delay: 20 * time.Millisecond, mu: &mu, current: &current, peak: &peak}
+		}
+	}
+
+	main, _, mainT := NewTestChunkserverWithOptions(t, cache, control.ChunkserverOptions{}, ChatterOptions{
+		MaxOutboundTransfers:        2,
+		MaxOutboundTransfersPerPeer: 1,
+		TransferQueueTimeout:        5 * time.Second,
+	})
+	defer mainT()
+	assert.NoError(main.Add(73, []byte("hello world"), 2))
+
+	// many servers all asking for the same chunk at once get their turns one or two at a time
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(address apis.ServerAddress) {
+			defer wg.Done()
+			assert.NoError(main.Replicate(73, address, 2))
+		}(addresses[i%len(addresses)])
+	}
+	wg.Wait()
+	assert.Equal(1, peerPeak)
+	assert.True(peak <= 2, "peak of %d concurrent transfers", peak)
+	stats, err := main.GetStats()
+	assert.NoError(err)
+	assert.True(stats.ThrottledTransfers > 0)
+	assert.Equal(uint64(0), stats.RejectedTransfers)
+}
+
+func TestChatterOutboundTransferRejection(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	var mu sync.Mutex
+	var current, peak int
+	cache := &rpc.MockCache{Chunkservers: map[apis.ServerAddress]apis.Chunkserver{
+		"peer": &slowReceiver{delay: 200 * time.Millisecond, mu: &mu, current: &current, peak: &peak},
+	}}
+	main, _, mainT := NewTestChunkserverWithOptions(t, cache, control.ChunkserverOptions{}, ChatterOptions{
+		MaxOutboundTransfers: 1,
+		TransferQueueTimeout: 10 * time.Millisecond,
+	})
+	defer mainT()
+	assert.NoError(main.Add(73, []byte("hello world"), 2))
+
+	done := make(chan error)
+	go func() {
+		done <- main.Replicate(73, "peer", 2)
+	}()
+	// give the first transfer time to get going
+	time.Sleep(50 * time.Millisecond)
+
+	// a transfer that can't get a turn in time is turned away, with a hint about when to try again
+	_, err := main.Push(73, "peer")
+	assert.Equal(apis.ErrSourceBusy, apis.ErrorCodeOf(err))
+	assert.Equal(10*time.Millisecond, apis.RetryAfterOf(err))
+	assert.NoError(<-done)
+
+	stats, err := main.GetStats()
+	assert.NoError(err)
+	assert.Equal(uint64(1), stats.ThrottledTransfers)
+	assert.Equal(uint64(1), stats.RejectedTransfers)
+}
+
+// Like NewTestChunkserver, but with storage that can be told to return damaged data.
+func newFaultyTestChunkserver(t *testing.T, cache rpc.ConnectionCache) (apis.Chunkserver, *storage.FaultyStorage, func()) {
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	faulty := storage.WithFaults(mem)
+	single, shutdown, err := control.ExposeChunkserverWithShutdown(faulty)
+	require.NoError(t, err)
+	server, err := WithChatter(single, cache)
+	require.NoError(t, err)
+	return server, faulty, func() {
+		shutdown(time.Now().Add(control.TeardownGracePeriod))
+		mem.Close()
+	}
+}
+
+func TestChatterRepairChunk(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+
+	main, mainStorage, mainT := newFaultyTestChunkserver(t, cache)
+	defer mainT()
+	damaged, damagedStorage, damagedT := newFaultyTestChunkserver(t, cache)
+	defer damagedT()
+	healthy, _, healthyT := NewTestChunkserver(t, cache)
+	defer healthyT()
+
+	var addresses []apis.ServerAddress
+	for _, server := range []apis.Chunkserver{damaged, healthy} {
+		teardown, address, err := rpc.PublishChunkserver(server, ":0")
+		assert.NoError(err)
+		defer teardown(true)
+		addresses = append(addresses, address)
+	}
+
+	for _, server := range []apis.Chunkserver{main, damaged, healthy} {
+		assert.NoError(server.Add(73, []byte("hello world"), 2))
+	}
+	checksum := apis.ChunkChecksum([]byte("hello world"))
+	mainStorage.CorruptChunk(73, 2)
+	damagedStorage.CorruptChunk(73, 2)
+
+	// the first source's copy is just as damaged, so the copy comes from the second
+	source, err := main.RepairChunk(73, 2, checksum, addresses)
+	assert.NoError(err)
+	assert.Equal(addresses[1], source)
+
+	data, ver, err := main.Read(73, 0, 16, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), ver)
+	assert.Equal("hello world", string(util.StripTrailingZeroes(data)))
+
+	// without a good copy anywhere, nothing changes
+	mainStorage.CorruptChunk(73, 2)
+	_, err = main.RepairChunk(73, 2, checksum, addresses[:1])
+	assert.Error(err)
+	assert.Contains(err.Error(), string(addresses[0]))
+	data, _, err = main.Read(73, 0, 16, apis.AnyVersion)
+	assert.NoError(err)
+	assert.NotEqual("hello world", string(util.StripTrailingZeroes(data)))
+
+	// and a source that has moved on to a newer version isn't used either
+	assert.NoError(healthy.StartWrite(73, 0, []byte("HELLO")))
+	assert.NoError(healthy.CommitWrite(73, apis.CalculateCommitHash(0, []byte("HELLO")), 2, 3))
+	assert.NoError(healthy.UpdateLatestVersion(73, 2, 3))
+	_, err = main.RepairChunk(73, 2, checksum, addresses[1:])
+	assert.Error(err)
+}
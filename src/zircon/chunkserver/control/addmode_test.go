@@ -0,0 +1,100 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// A chunk at version 2, with a newer version 3 that was committed but never made latest.
+func newAddModeTestServer(t *testing.T) (apis.ChunkserverSingle, storage.ChunkStorage, func()) {
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+
+	require.NoError(t, cs.Add(7, []byte("original"), 2))
+	require.NoError(t, cs.StartWrite(7, 0, []byte("ORIG")))
+	require.NoError(t, cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("ORIG")), 2, 3))
+	return cs, mem, func() {
+		shutdown(time.Now().Add(time.Second))
+		mem.Close()
+	}
+}
+
+func TestAddFailIfExists(t *testing.T) {
+	assert := testifyAssert.New(t)
+	cs, _, teardown := newAddModeTestServer(t)
+	defer teardown()
+
+	err := cs.AddWithMode(7, []byte("replacement"), 2, apis.AddFailIfExists)
+	assert.Equal(apis.ErrChunkExists, apis.ErrorCodeOf(err))
+	assert.Equal(apis.Version(2), err.(*apis.Error).Version)
+
+	data, version, err := cs.Read(7, 0, 8, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), version)
+	assert.Equal("original", string(data))
+}
+
+func TestAddOverwriteSameVersion(t *testing.T) {
+	assert := testifyAssert.New(t)
+	cs, mem, teardown := newAddModeTestServer(t)
+	defer teardown()
+
+	// a different version is still refused
+	err := cs.AddWithMode(7, []byte("replacement"), 3, apis.AddOverwriteSameVersion)
+	assert.Equal(apis.ErrChunkExists, apis.ErrorCodeOf(err))
+	assert.Equal(apis.Version(2), err.(*apis.Error).Version)
+
+	assert.NoError(cs.AddWithMode(7, []byte("replacement"), 2, apis.AddOverwriteSameVersion))
+	data, version, err := cs.Read(7, 0, 11, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), version)
+	assert.Equal("replacement", string(data))
+
+	// the newer version was built on the old contents, so it's gone, and a commit can't be joined into it anymore
+	versions, err := mem.ListVersions(7)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{2}, versions)
+	assert.Error(cs.UpdateLatestVersion(7, 2, 3))
+
+	// running the load again changes nothing
+	assert.NoError(cs.AddWithMode(7, []byte("replacement"), 2, apis.AddOverwriteSameVersion))
+	data, _, err = cs.Read(7, 0, 11, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("replacement", string(data))
+}
+
+func TestAddIgnoreIfExists(t *testing.T) {
+	assert := testifyAssert.New(t)
+	cs, mem, teardown := newAddModeTestServer(t)
+	defer teardown()
+
+	assert.NoError(cs.AddWithMode(7, []byte("replacement"), 2, apis.AddIgnoreIfExists))
+	assert.NoError(cs.AddWithMode(7, []byte("replacement"), 9, apis.AddIgnoreIfExists))
+	data, version, err := cs.Read(7, 0, 8, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), version)
+	assert.Equal("original", string(data))
+	versions, err := mem.ListVersions(7)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{2, 3}, versions)
+
+	// chunks that don't exist are added as usual, except that deleted chunks stay deleted
+	assert.NoError(cs.AddWithMode(8, []byte("new"), 1, apis.AddIgnoreIfExists))
+	data, _, err = cs.Read(8, 0, 3, 1)
+	assert.NoError(err)
+	assert.Equal("new", string(data))
+	assert.NoError(cs.Delete(8, 1))
+	err = cs.AddWithMode(8, []byte("new"), 1, apis.AddIgnoreIfExists)
+	assert.Equal(apis.ErrAlreadyDeleted, apis.ErrorCodeOf(err))
+
+	assert.Error(cs.AddWithMode(9, []byte("new"), 1, apis.AddMode(17)))
+	versions, err = mem.ListVersions(9)
+	assert.NoError(err)
+	assert.Empty(versions)
+}
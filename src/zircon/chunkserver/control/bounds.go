@@ -0,0 +1,31 @@
+package control
+
+import "zircon/apis"
+
+// Fails with ErrOutOfBounds unless the range of bytes starting at offset and running for length bytes fits within a
+// chunk of the configured maximum size. The arithmetic is done in 64 bits, so that a range whose end would overflow a
+// uint32 is caught rather than wrapping around to a small number.
+func (cs *chunkserver) checkBounds(offset uint32, length uint64) error {
+	if uint64(offset)+length > uint64(cs.chunkSize) {
+		return apis.NewError(apis.ErrOutOfBounds, 0, "range at offset %d of length %d extends past the maximum chunk size of %d",
+			offset, length, cs.chunkSize)
+	}
+	return nil
+}
+
+// Implemented by chunkservers that can report the maximum chunk size they were configured with.
+type ChunkSizeReporter interface {
+	MaxChunkSize() uint32
+}
+
+func (cs *chunkserver) MaxChunkSize() uint32 {
+	return cs.chunkSize
+}
+
+// Reports the maximum chunk size of any chunkserver, treating one that can't report it as using the default.
+func MaxChunkSizeOf(single apis.ChunkserverSingle) uint32 {
+	if reporter, ok := single.(ChunkSizeReporter); ok {
+		return reporter.MaxChunkSize()
+	}
+	return apis.MaxChunkSize
+}
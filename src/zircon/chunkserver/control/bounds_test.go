@@ -0,0 +1,86 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestBoundsChecks(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+	assert.NoError(cs.Add(1, []byte("hello"), 1))
+
+	ranges := []struct {
+		name    string
+		offset  uint32
+		length  uint32
+		inRange bool
+	}{
+		{"empty at start", 0, 0, true},
+		{"empty at end", apis.MaxChunkSize, 0, true},
+		{"whole chunk", 0, apis.MaxChunkSize, true},
+		{"last byte", apis.MaxChunkSize - 1, 1, true},
+		{"one past the end", 1, apis.MaxChunkSize, false},
+		{"starts past the end", apis.MaxChunkSize + 1, 0, false},
+		{"offset 2^31", 1 << 31, 1, false},
+		{"end overflows uint32", math.MaxUint32, 2, false},
+		{"both at maximum", math.MaxUint32, math.MaxUint32, false},
+	}
+	for _, r := range ranges {
+		_, _, err := cs.Read(1, r.offset, r.length, apis.AnyVersion)
+		if r.inRange {
+			assert.NoError(err, "read: %s", r.name)
+		} else {
+			assert.Equal(apis.ErrOutOfBounds, apis.ErrorCodeOf(err), "read: %s", r.name)
+		}
+	}
+
+	// writes are only checked with lengths that can actually be allocated
+	for _, r := range ranges {
+		if r.length > apis.MaxChunkSize {
+			continue
+		}
+		err := cs.StartWrite(1, r.offset, make([]byte, r.length))
+		if r.inRange {
+			assert.NoError(err, "write: %s", r.name)
+		} else {
+			assert.Equal(apis.ErrOutOfBounds, apis.ErrorCodeOf(err), "write: %s", r.name)
+		}
+	}
+
+	sizes := []struct {
+		length  int
+		inRange bool
+	}{{0, true}, {apis.MaxChunkSize, true}, {apis.MaxChunkSize + 1, false}}
+	for i, size := range sizes {
+		chunk := apis.ChunkNum(10 + i)
+		err := cs.Add(chunk, make([]byte, size.length), 1)
+		if size.inRange {
+			assert.NoError(err, "add: %d bytes", size.length)
+		} else {
+			assert.Equal(apis.ErrOutOfBounds, apis.ErrorCodeOf(err), "add: %d bytes", size.length)
+		}
+		err = cs.ForceAdd(chunk, make([]byte, size.length), 2)
+		if size.inRange {
+			assert.NoError(err, "force add: %d bytes", size.length)
+		} else {
+			assert.Equal(apis.ErrOutOfBounds, apis.ErrorCodeOf(err), "force add: %d bytes", size.length)
+		}
+	}
+
+	// nothing out of bounds made it as far as storage
+	versions, err := mem.ListVersions(12)
+	assert.NoError(err)
+	assert.Empty(versions)
+}
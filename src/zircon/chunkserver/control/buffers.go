@@ -0,0 +1,37 @@
+package control
+
+import (
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+	"zircon/util"
+)
+
+// Buffers for reading versions out of storage and for assembling new versions in CommitWrite, shared by every
+// chunkserver in the process. They are only ever used by one operation at a time, and are put back before the operation
+// returns. Nothing that an operation returns is ever part of one of these buffers: results are copied out
+// first, because the RPC layer keeps hold of them until they've been sent, long after the operation has returned.
+var chunkBuffers = util.NewBufferPool(4096, storage.ReadBufferSize)
+
+// Reads a version into a buffer from chunkBuffers, or straight from its mapping if the storage maps versions. The
+// returned release function must be called once the data is no longer needed, after which neither the data nor anything
+// sliced from it may be used. The data must never be modified.
+func (cs *chunkserver) readPooled(chunk apis.ChunkNum, version apis.Version) ([]byte, func(), error) {
+	if mapper, ok := cs.Storage.(storage.MappedReader); ok && mapper.MapsVersions() {
+		start := time.Now()
+		data, release, err := mapper.ReadVersionMapped(chunk, version)
+		cs.timeStorage(start)
+		return data, release, err
+	}
+	buf := chunkBuffers.Get(storage.ReadBufferSizeFor(cs.chunkSize))
+	start := time.Now()
+	data, err := storage.ReadVersionInto(cs.Storage, chunk, version, buf)
+	cs.timeStorage(start)
+	if err != nil {
+		chunkBuffers.Put(buf)
+		return nil, nil, err
+	}
+	return data, func() {
+		chunkBuffers.Put(buf)
+	}, nil
+}
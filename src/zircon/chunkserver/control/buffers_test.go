@@ -0,0 +1,178 @@
+package control
+
+import (
+	"bytes"
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// Hides whether the storage underneath can read into pooled buffers, so that every read allocates, as they all did
+// before reads were pooled.
+type unpooledStorage struct {
+	storage.ChunkStorage
+}
+
+// Reads return data that's copied out of pooled buffers, so a result has to stay intact no matter how many other reads
+// and commits happen after it. Run with -race to also catch a buffer being handed out while still in use.
+func TestPooledBuffersNotShared(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	const chunkCount = 16
+	contents := func(chunk apis.ChunkNum, version apis.Version) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("<%d/%d>", chunk, version)), 1000)
+	}
+	for chunk := apis.ChunkNum(1); chunk <= chunkCount; chunk++ {
+		require.NoError(t, cs.Add(chunk, contents(chunk, 1), 1))
+	}
+
+	var wg sync.WaitGroup
+	for chunk := apis.ChunkNum(1); chunk <= chunkCount; chunk++ {
+		wg.Add(1)
+		go func(chunk apis.ChunkNum) {
+			defer wg.Done()
+			var results [][]byte
+			for i := 0; i < 20; i++ {
+				data, _, err := cs.Read(chunk, 0, uint32(len(contents(chunk, 1))), 1)
+				assert.NoError(err)
+				results = append(results, data)
+			}
+			// commits assemble the new version in a pooled buffer too
+			update := contents(chunk, 2)[:100]
+			hash := apis.CalculateCommitHash(0, update)
+			assert.NoError(cs.StartWrite(chunk, 0, update))
+			assert.NoError(cs.CommitWrite(chunk, hash, 1, 2))
+			for _, data := range results {
+				assert.Equal(contents(chunk, 1), data)
+			}
+		}(chunk)
+	}
+	wg.Wait()
+
+	for chunk := apis.ChunkNum(1); chunk <= chunkCount; chunk++ {
+		expected := contents(chunk, 1)
+		copy(expected, contents(chunk, 2)[:100])
+		data, err := mem.ReadVersion(chunk, 2)
+		assert.NoError(err)
+		assert.Equal(expected, data)
+	}
+}
+
+// Reads from mapped storage are sliced straight out of the mapping, which must never leak into a result, and must stay
+// readable while a version that's being replaced is deleted underneath it.
+func TestMappedReadsNotShared(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "mapped-reads-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	options := storage.FilesystemOptions{MappedReadCapacity: 1024 * 1024}
+	fs, err := storage.ConfigureFilesystemStorageWithOptions(dir, options)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	require.NoError(t, cs.Add(1, []byte("hello world"), 1))
+	first, _, err := cs.Read(1, 0, 11, 1)
+	assert.NoError(err)
+	require.NoError(t, cs.StartWrite(1, 0, []byte("HELLO")))
+	require.NoError(t, cs.CommitWrite(1, apis.CalculateCommitHash(0, []byte("HELLO")), 1, 2))
+	require.NoError(t, cs.UpdateLatestVersion(1, 1, 2))
+	second, _, err := cs.Read(1, 0, 11, 2)
+	assert.NoError(err)
+
+	// replacing the latest version reads the old one while deleting it
+	require.NoError(t, cs.AddWithMode(1, []byte("replacement"), 2, apis.AddOverwriteSameVersion))
+	third, _, err := cs.Read(1, 0, 11, 2)
+	assert.NoError(err)
+
+	assert.Equal("hello world", string(first))
+	assert.Equal("HELLO world", string(second))
+	assert.Equal("replacement", string(third))
+}
+
+func benchmarkRead(b *testing.B, pooled bool) {
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(b, err)
+	defer mem.Close()
+	var backend storage.ChunkStorage = mem
+	if !pooled {
+		backend = unpooledStorage{mem}
+	}
+	cs, shutdown, err := ExposeChunkserverWithShutdown(backend)
+	require.NoError(b, err)
+	defer shutdown(time.Now().Add(time.Second))
+	require.NoError(b, cs.Add(1, make([]byte, apis.MaxChunkSize), 1))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := cs.Read(1, uint32(i*7%64)*4096, 4096, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Small reads from a full chunk, which without pooling allocate the whole chunk every time.
+func BenchmarkReadUnpooled(b *testing.B) {
+	benchmarkRead(b, false)
+}
+
+func BenchmarkReadPooled(b *testing.B) {
+	benchmarkRead(b, true)
+}
+
+func benchmarkCommit(b *testing.B, pooled bool) {
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(b, err)
+	defer mem.Close()
+	var backend storage.ChunkStorage = mem
+	if !pooled {
+		backend = unpooledStorage{mem}
+	}
+	cs, shutdown, err := ExposeChunkserverWithShutdown(backend)
+	require.NoError(b, err)
+	defer shutdown(time.Now().Add(time.Second))
+	require.NoError(b, cs.Add(1, make([]byte, 1024*1024), 1))
+	update := []byte("hello world")
+	hash := apis.CalculateCommitHash(0, update)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		version := apis.Version(i + 1)
+		if err := cs.StartWrite(1, 0, update); err != nil {
+			b.Fatal(err)
+		}
+		if err := cs.CommitWrite(1, hash, version, version+1); err != nil {
+			b.Fatal(err)
+		}
+		if err := cs.UpdateLatestVersion(1, version, version+1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCommitUnpooled(b *testing.B) {
+	benchmarkCommit(b, false)
+}
+
+func BenchmarkCommitPooled(b *testing.B) {
+	benchmarkCommit(b, true)
+}
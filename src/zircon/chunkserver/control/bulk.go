@@ -0,0 +1,59 @@
+package control
+
+import (
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+var _ apis.BulkReader = &chunkserver{}
+
+// Opens a read for sending straight from storage, if storage keeps versions in files of their own. Only reads that cover
+// all of a version's stored data can be opened, so that the checksum recorded with the data covers everything that is
+// sent, and so that damage on disk is still caught, as it is by Read. The file is opened with the chunk locked, so it
+// stays readable even if the version is deleted before the read has been sent.
+func (cs *chunkserver) OpenRead(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) (*apis.BulkRead, bool, error) {
+	timing, release, err := cs.enterChunk(operation{method: "Read", chunk: chunk, offset: offset, length: length}, false)
+	if err != nil {
+		return nil, false, err
+	}
+	defer release()
+
+	opener, ok := cs.Storage.(storage.VersionOpener)
+	if !ok || offset != 0 {
+		return nil, false, nil
+	}
+	if err := cs.checkBounds(offset, uint64(length)); err != nil {
+		return nil, false, err
+	}
+	cs.mu.Lock()
+	version, err := cs.latestVersion(chunk)
+	cs.mu.Unlock()
+	if err != nil {
+		return nil, false, err
+	}
+	if version < minimum {
+		return nil, false, apis.NewError(apis.ErrWrongVersion, version, "requested newer version than was available")
+	}
+	var file storage.VersionFile
+	cs.withStorage(timing, func() {
+		start := time.Now()
+		file, err = opener.OpenVersion(chunk, version)
+		cs.timeStorage(start)
+	})
+	if err != nil {
+		// whatever the problem is, Read can report it properly
+		return nil, false, nil
+	}
+	if file.Length > int64(length) {
+		file.File.Close()
+		return nil, false, nil
+	}
+	return &apis.BulkRead{
+		Version:  version,
+		File:     file.File,
+		Offset:   file.Offset,
+		Length:   file.Length,
+		Checksum: file.Checksum,
+	}, true, nil
+}
@@ -0,0 +1,77 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestOpenRead(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "open-read-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+	reader := cs.(apis.BulkReader)
+
+	require.NoError(t, cs.Add(1, []byte("sent straight from the file"), 1))
+
+	read, ok, err := reader.OpenRead(1, 0, 100, 1)
+	require.NoError(t, err)
+	require.True(t, ok)
+	defer read.File.Close()
+	assert.Equal(apis.Version(1), read.Version)
+	assert.Equal(int64(len("sent straight from the file")), read.Length)
+	assert.Equal(crc32.ChecksumIEEE([]byte("sent straight from the file")), read.Checksum)
+
+	// deleting the version doesn't affect a read that's already open
+	assert.NoError(cs.Delete(1, 1))
+	data := make([]byte, read.Length)
+	_, err = read.File.ReadAt(data, read.Offset)
+	assert.NoError(err)
+	assert.Equal("sent straight from the file", string(data))
+
+	require.NoError(t, cs.Add(2, []byte("partial reads are left to Read"), 3))
+	_, ok, err = reader.OpenRead(2, 8, 100, 1)
+	assert.NoError(err)
+	assert.False(ok)
+	_, ok, err = reader.OpenRead(2, 0, 8, 1)
+	assert.NoError(err)
+	assert.False(ok)
+
+	_, ok, err = reader.OpenRead(2, 0, 100, 4)
+	assert.Equal(apis.ErrWrongVersion, apis.ErrorCodeOf(err))
+	assert.False(ok)
+	_, ok, err = reader.OpenRead(3, 0, 100, 1)
+	assert.Error(err)
+	assert.False(ok)
+}
+
+func TestOpenReadInMemory(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	// there's no file to send from, so the read has to go through Read
+	require.NoError(t, cs.Add(1, []byte("only in memory"), 1))
+	_, ok, err := cs.(apis.BulkReader).OpenRead(1, 0, 100, 1)
+	assert.NoError(err)
+	assert.False(ok)
+}
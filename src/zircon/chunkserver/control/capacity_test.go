@@ -0,0 +1,178 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestStagedWritesCountTowardsCapacity(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorageWithCap(1000)
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+	stats := mem.(*storage.MemoryStorage).StatsForTesting
+
+	assert.NoError(cs.Add(7, make([]byte, 100), 1))
+
+	// nothing is committed yet, but the staged data alone is enough to fill the cap
+	writes := make([][]byte, 4)
+	for i := range writes {
+		writes[i] = make([]byte, 200)
+		writes[i][0] = byte(i + 1)
+		assert.NoError(cs.StartWrite(7, 0, writes[i]))
+	}
+	assert.Equal(storage.MemoryStats{Buffers: 1, Committed: 100, Staged: 800}, stats())
+
+	extra := make([]byte, 200)
+	err = cs.StartWrite(7, 0, extra)
+	assert.Equal(apis.ErrOutOfSpace, apis.ErrorCodeOf(err))
+	assert.Equal(storage.MemoryStats{Buffers: 1, Committed: 100, Staged: 800}, stats())
+
+	// starting a write that is already staged doesn't take any more space
+	assert.NoError(cs.StartWrite(7, 0, writes[3]))
+	assert.Equal(800, stats().Staged)
+
+	// committing moves the data from staged to committed, even though storage is nearly full
+	assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, writes[0]), 1, 2))
+	assert.Equal(storage.MemoryStats{Buffers: 2, Committed: 300, Staged: 600}, stats())
+	assert.Equal(apis.ErrOutOfSpace, apis.ErrorCodeOf(cs.StartWrite(7, 0, extra)))
+
+	// and then getting rid of old data makes room again
+	assert.NoError(cs.UpdateLatestVersion(7, 1, 2))
+	assert.Equal(storage.MemoryStats{Buffers: 1, Committed: 200, Staged: 600}, stats())
+	assert.NoError(cs.Delete(7, 2))
+	assert.Equal(storage.MemoryStats{Buffers: 0, Committed: 0, Staged: 600}, stats())
+	assert.NoError(cs.Add(8, make([]byte, 100), 1))
+	assert.NoError(cs.StartWrite(8, 0, extra))
+	assert.Equal(storage.MemoryStats{Buffers: 1, Committed: 100, Staged: 800}, stats())
+
+	// uncommitted writes are released on shutdown
+	assert.NoError(shutdown(time.Now().Add(time.Second)))
+	assert.Equal(storage.MemoryStats{Buffers: 1, Committed: 100, Staged: 0}, stats())
+}
+
+func TestReservedSpace(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorageWithCap(1000)
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithOptions(mem, ChunkserverOptions{ReservedSpace: 300})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	// fill up to the edge of the reserve
+	assert.NoError(cs.Add(1, make([]byte, 400), 1))
+	assert.NoError(cs.StartWrite(1, 0, make([]byte, 300)))
+
+	// nothing new fits anymore, even though the storage itself still has room
+	assert.Equal(apis.ErrOutOfSpace, apis.ErrorCodeOf(cs.Add(2, []byte("x"), 1)))
+	assert.Equal(apis.ErrOutOfSpace, apis.ErrorCodeOf(cs.StartWrite(1, 0, []byte("x"))))
+
+	// but data that's already here can still be committed into the reserve, and repairs can still land
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(0, make([]byte, 300)), 1, 2))
+	assert.NoError(cs.ForceAdd(3, make([]byte, 100), 1))
+
+	// and deleting makes room again
+	assert.NoError(cs.Delete(3, 1))
+	assert.NoError(cs.Delete(1, 1))
+	assert.NoError(cs.Add(2, []byte("x"), 1))
+	assert.NoError(cs.StartWrite(2, 0, make([]byte, 600)))
+}
+
+func TestStagedBytesPerChunk(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithOptions(mem, ChunkserverOptions{MaxStagedBytesPerChunk: 500})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.NoError(cs.Add(1, []byte("one"), 1))
+	assert.NoError(cs.Add(2, []byte("two"), 1))
+
+	// a write that reaches past the end of a chunk is refused before anything is staged
+	err = cs.StartWrite(1, apis.MaxChunkSize-100, make([]byte, 101))
+	assert.Equal(apis.ErrOutOfBounds, apis.ErrorCodeOf(err))
+
+	first := make([]byte, 300)
+	first[0] = 1
+	second := make([]byte, 200)
+	second[0] = 2
+	assert.NoError(cs.StartWrite(1, 0, first))
+	assert.NoError(cs.StartWrite(1, 0, second))
+	assert.Equal(apis.ErrOutOfSpace, apis.ErrorCodeOf(cs.StartWrite(1, 0, []byte("x"))))
+	// the limit is per chunk, and starting a write that is already staged doesn't hold any more data
+	assert.NoError(cs.StartWrite(2, 0, first))
+	assert.NoError(cs.StartWrite(1, 0, first))
+
+	// committing makes room again, but only in the chunk it was committed into
+	hash := apis.CalculateCommitHash(0, first)
+	assert.NoError(cs.CommitWrite(1, hash, 1, 2))
+	assert.NoError(cs.StartWrite(1, 0, []byte("x")))
+	// retrying the commit doesn't use up the start for the other chunk
+	assert.NoError(cs.CommitWrite(1, hash, 1, 2))
+	assert.Equal(apis.ErrOutOfSpace, apis.ErrorCodeOf(cs.StartWrite(2, 0, make([]byte, 201))))
+	assert.NoError(cs.CommitWrite(2, hash, 1, 2))
+	assert.NoError(cs.StartWrite(2, 0, make([]byte, 201)))
+}
+
+func TestIdenticalStagedWritesShared(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.NoError(cs.Add(1, []byte("hello world"), 1))
+	assert.NoError(cs.Add(2, []byte("hello world"), 1))
+	stats, err := mem.Stats()
+	require.NoError(t, err)
+	base := stats.StagedBytes
+
+	// the same write, started twice for the same chunk, is only held once
+	data := []byte("HELLO")
+	hash := apis.CalculateCommitHash(0, data)
+	assert.NoError(cs.StartWrite(1, 0, data))
+	assert.NoError(cs.StartWrite(1, 0, data))
+	stats, err = mem.Stats()
+	require.NoError(t, err)
+	assert.Equal(base+uint64(len(data)), stats.StagedBytes)
+
+	// and a single commit uses it up
+	assert.NoError(cs.CommitWrite(1, hash, 1, 2))
+	stats, err = mem.Stats()
+	require.NoError(t, err)
+	assert.Equal(base, stats.StagedBytes)
+	assert.Empty(cs.(*chunkserver).Hashes)
+
+	// the same write for two different chunks shares the data too, but has to be committed into both
+	assert.NoError(cs.StartWrite(1, 0, data))
+	assert.NoError(cs.StartWrite(2, 0, data))
+	stats, err = mem.Stats()
+	require.NoError(t, err)
+	assert.Equal(base+uint64(len(data)), stats.StagedBytes)
+	assert.NoError(cs.CommitWrite(2, hash, 1, 2))
+	stats, err = mem.Stats()
+	require.NoError(t, err)
+	assert.Equal(base+uint64(len(data)), stats.StagedBytes)
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+	assert.NoError(cs.CommitWrite(1, hash, 2, 3))
+	stats, err = mem.Stats()
+	require.NoError(t, err)
+	assert.Equal(base, stats.StagedBytes)
+	assert.Empty(cs.(*chunkserver).Hashes)
+}
@@ -0,0 +1,155 @@
+package control
+
+import (
+	"log"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// The writes that have been committed into a version that isn't the latest yet. Several clients can each commit a write
+// to a different part of a chunk, all moving it from the same old version to the same new version; as long as none of
+// the writes overlap, they all end up in the new version, rather than only the first one to arrive.
+type versionCommits struct {
+	writes []committedWrite
+}
+
+type committedWrite struct {
+	hash   apis.CommitHash
+	offset uint32
+	length uint32
+}
+
+func (w committedWrite) overlaps(offset uint32, length uint32) bool {
+	return uint64(offset) < uint64(w.offset)+uint64(w.length) && uint64(w.offset) < uint64(offset)+uint64(length)
+}
+
+// Looks up the writes already committed into a version, if it was produced by CommitWrite since the chunk's latest
+// version last changed.
+func (cs *chunkserver) commitsTo(chunk apis.ChunkNum, version apis.Version) (*versionCommits, bool) {
+	commits, found := cs.commits[chunk][version]
+	return commits, found
+}
+
+func (cs *chunkserver) recordCommit(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash, write commit) {
+	versions := cs.commits[chunk]
+	if versions == nil {
+		versions = map[apis.Version]*versionCommits{}
+		cs.commits[chunk] = versions
+	}
+	commits := versions[version]
+	if commits == nil {
+		commits = &versionCommits{}
+		versions[version] = commits
+	}
+	commits.writes = append(commits.writes, committedWrite{hash: hash, offset: write.Offset, length: uint32(len(write.Data))})
+}
+
+// Once a chunk's latest version changes, nothing more can be committed on top of the old one, so none of the versions
+// built from it can be joined anymore. This also means that every write recorded for a version was applied on top of
+// the same old version.
+func (cs *chunkserver) forgetCommits(chunk apis.ChunkNum) {
+	delete(cs.commits, chunk)
+	delete(cs.applied, chunk)
+}
+
+// Like forgetCommits, but for when a version built by CommitWrite becomes the latest: the writes that went into it are
+// remembered, so that retries of those commits can still be recognized.
+func (cs *chunkserver) promoteCommits(chunk apis.ChunkNum, oldVersion apis.Version, newVersion apis.Version) {
+	commits, found := cs.commitsTo(chunk, newVersion)
+	cs.forgetCommits(chunk)
+	if found {
+		cs.applied[chunk] = appliedCommits{base: oldVersion, version: newVersion, commits: commits}
+	}
+}
+
+// The writes that were committed into a chunk's latest version, and the version they were committed on top of.
+type appliedCommits struct {
+	base    apis.Version
+	version apis.Version
+	commits *versionCommits
+}
+
+// Checks whether a commit has already been applied, in which case a client is retrying a commit whose response it never
+// received. That's the case if the write is part of newVersion, and newVersion was built on top of oldVersion and is
+// either still pending or has become the latest version since. Only commits since the chunkserver started are known.
+func (cs *chunkserver) alreadyApplied(chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version, newVersion apis.Version, latest apis.Version) bool {
+	if latest == oldVersion {
+		commits, found := cs.commitsTo(chunk, newVersion)
+		return found && commits.contains(hash)
+	}
+	applied, found := cs.applied[chunk]
+	return found && latest == newVersion && applied.version == newVersion && applied.base == oldVersion &&
+		applied.commits.contains(hash)
+}
+
+func (c *versionCommits) contains(hash apis.CommitHash) bool {
+	for _, existing := range c.writes {
+		if existing.hash == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks whether a write can join the others already committed into a version. The write must not already be part of
+// it.
+func (c *versionCommits) check(chunk apis.ChunkNum, base apis.Version, version apis.Version, write commit) error {
+	for _, existing := range c.writes {
+		if existing.overlaps(write.Offset, uint32(len(write.Data))) {
+			return apis.NewError(apis.ErrWriteConflict, base,
+				"write to [%d, %d) of %d/%d overlaps a write to [%d, %d) already committed",
+				write.Offset, int(write.Offset)+len(write.Data), chunk, version,
+				existing.offset, existing.offset+existing.length)
+		}
+	}
+	return nil
+}
+
+func (c *versionCommits) hashes() []apis.CommitHash {
+	hashes := make([]apis.CommitHash, len(c.writes))
+	for i, write := range c.writes {
+		hashes[i] = write.hash
+	}
+	return hashes
+}
+
+// Lists the hashes of the commits that went into a version, for saveCommitHashes, unless storage can't keep them. Must
+// be called with the main lock held.
+func (cs *chunkserver) commitHashesToSave(chunk apis.ChunkNum, version apis.Version) ([]apis.CommitHash, bool) {
+	if _, ok := cs.Storage.(storage.CommitHashKeeper); !ok {
+		return nil, false
+	}
+	commits, found := cs.commitsTo(chunk, version)
+	if !found {
+		return nil, false
+	}
+	return commits.hashes(), true
+}
+
+// Records the hashes of the commits that went into a version in storage, if it can keep them, so that they can still
+// be listed after a restart. Only the listing depends on them, so failing to save them doesn't fail the commit. Must be
+// called with the storage lock held.
+func (cs *chunkserver) saveCommitHashes(chunk apis.ChunkNum, version apis.Version, hashes []apis.CommitHash) {
+	keeper, ok := cs.Storage.(storage.CommitHashKeeper)
+	if !ok {
+		return
+	}
+	if err := keeper.SetCommitHashes(chunk, version, hashes); err != nil {
+		log.Printf("could not record commit hashes for %d/%d: %v", chunk, version, err)
+	}
+}
+
+// Looks up the hashes of the commits that produced a version, without reading its data. Returns nil if the version
+// wasn't produced by CommitWrite, or if it was produced before a restart and storage couldn't keep its hashes.
+func (cs *chunkserver) commitHashesOf(chunk apis.ChunkNum, version apis.Version) ([]apis.CommitHash, error) {
+	if commits, found := cs.commitsTo(chunk, version); found {
+		return commits.hashes(), nil
+	}
+	if applied, found := cs.applied[chunk]; found && applied.version == version {
+		return applied.commits.hashes(), nil
+	}
+	if keeper, ok := cs.Storage.(storage.CommitHashKeeper); ok {
+		return keeper.CommitHashes(chunk, version)
+	}
+	return nil, nil
+}
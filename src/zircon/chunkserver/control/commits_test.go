@@ -0,0 +1,328 @@
+package control
+
+import (
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestConcurrentNonOverlappingWriters(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "concurrent-writers-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.NoError(cs.Add(1, []byte("hello world, goodbye world"), 1))
+
+	writes := []struct {
+		offset uint32
+		data   string
+	}{{0, "HELLO"}, {13, "GOODBYE"}}
+	wg := sync.WaitGroup{}
+	errs := make([]error, len(writes))
+	for i, write := range writes {
+		wg.Add(1)
+		go func(i int, offset uint32, data []byte) {
+			defer wg.Done()
+			if err := cs.StartWrite(1, offset, data); err != nil {
+				errs[i] = err
+				return
+			}
+			errs[i] = cs.CommitWrite(1, apis.CalculateCommitHash(offset, data), 1, 2)
+		}(i, write.offset, []byte(write.data))
+	}
+	wg.Wait()
+	for _, err := range errs {
+		assert.NoError(err)
+	}
+
+	// a write that overlaps either of them can't join in
+	assert.NoError(cs.StartWrite(1, 3, []byte("p!")))
+	err = cs.CommitWrite(1, apis.CalculateCommitHash(3, []byte("p!")), 1, 2)
+	assert.Equal(apis.ErrWriteConflict, apis.ErrorCodeOf(err))
+
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+	data, _, err := cs.Read(1, 0, 26, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("HELLO world, GOODBYE world", string(data))
+
+	// once the version is the latest, it can only be built on, not joined
+	assert.Error(cs.CommitWrite(1, apis.CalculateCommitHash(3, []byte("p!")), 1, 2))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(3, []byte("p!")), 2, 3))
+	assert.NoError(cs.UpdateLatestVersion(1, 2, 3))
+	data, _, err = cs.Read(1, 0, 26, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("HELp! world, GOODBYE world", string(data))
+
+	stats, err := cs.GetStats()
+	assert.NoError(err)
+	assert.Equal(uint64(0), stats.StagedWrites)
+}
+
+func TestJoinedCommitsAfterRollback(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.NoError(cs.Add(1, []byte("abcdef"), 1))
+	assert.NoError(cs.StartWrite(1, 0, []byte("A")))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(0, []byte("A")), 1, 3))
+	// rolling back the version means the next commit into it starts fresh
+	assert.NoError(cs.Delete(1, 3))
+	assert.NoError(cs.StartWrite(1, 0, []byte("Z")))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(0, []byte("Z")), 1, 3))
+	assert.NoError(cs.StartWrite(1, 5, []byte("F")))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(5, []byte("F")), 1, 3))
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 3))
+	data, _, err := cs.Read(1, 0, 6, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("ZbcdeF", string(data))
+}
+
+func TestCommitWriteRetries(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.NoError(cs.Add(1, []byte("hello world"), 1))
+	hello := apis.CalculateCommitHash(0, []byte("HELLO"))
+	assert.NoError(cs.StartWrite(1, 0, []byte("HELLO")))
+	assert.NoError(cs.CommitWrite(1, hello, 1, 2))
+
+	// the response was lost, so the client commits again, before and after the new version becomes the latest
+	assert.NoError(cs.CommitWrite(1, hello, 1, 2))
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+	assert.NoError(cs.CommitWrite(1, hello, 1, 2))
+	data, version, err := cs.Read(1, 0, 11, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), version)
+	assert.Equal("HELLO world", string(data))
+
+	// a commit that was never applied still conflicts with the version that is there now
+	world := apis.CalculateCommitHash(6, []byte("WORLD"))
+	assert.NoError(cs.StartWrite(1, 6, []byte("WORLD")))
+	err = cs.CommitWrite(1, world, 1, 2)
+	assert.Equal(apis.ErrWrongVersion, apis.ErrorCodeOf(err))
+	// and so does a retry of the right commit, but with a different transition
+	err = cs.CommitWrite(1, hello, 1, 3)
+	assert.Equal(apis.ErrWrongVersion, apis.ErrorCodeOf(err))
+
+	// an overlapping commit that lost out to a concurrent one fails every time it is retried
+	hi := apis.CalculateCommitHash(0, []byte("HI"))
+	assert.NoError(cs.StartWrite(1, 0, []byte("HI")))
+	assert.NoError(cs.CommitWrite(1, world, 2, 3))
+	assert.NoError(cs.StartWrite(1, 0, []byte("HOWDY")))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(0, []byte("HOWDY")), 2, 3))
+	for i := 0; i < 2; i++ {
+		err = cs.CommitWrite(1, hi, 2, 3)
+		assert.Equal(apis.ErrWriteConflict, apis.ErrorCodeOf(err))
+	}
+	assert.NoError(cs.UpdateLatestVersion(1, 2, 3))
+	err = cs.CommitWrite(1, hi, 2, 3)
+	assert.Equal(apis.ErrWrongVersion, apis.ErrorCodeOf(err))
+	// while both of the commits that made it in can still be retried
+	assert.NoError(cs.CommitWrite(1, world, 2, 3))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(0, []byte("HOWDY")), 2, 3))
+	data, _, err = cs.Read(1, 0, 11, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("HOWDY WORLD", string(data))
+
+	// once the chunk moves on again, retries of the older commits are genuine conflicts
+	assert.NoError(cs.CommitWrite(1, hi, 3, 4))
+	assert.NoError(cs.UpdateLatestVersion(1, 3, 4))
+	err = cs.CommitWrite(1, world, 2, 3)
+	assert.Equal(apis.ErrWrongVersion, apis.ErrorCodeOf(err))
+
+	stats, err := cs.GetStats()
+	assert.NoError(err)
+	assert.Equal(uint64(0), stats.StagedWrites)
+}
+
+func TestCommitWriteBatch(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	var commits []apis.CommitWriteRequest
+	for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+		require.NoError(t, cs.Add(chunk, []byte("hello world"), 1))
+		update := []byte{'H', byte('0' + chunk)}
+		require.NoError(t, cs.StartWrite(chunk, 0, update))
+		commits = append(commits, apis.CommitWriteRequest{
+			Chunk:      chunk,
+			Hash:       apis.CalculateCommitHash(0, update),
+			OldVersion: 1,
+			NewVersion: 2,
+		})
+	}
+	// a hash that was never staged, and a version that the chunk isn't at, only fail their own commits
+	commits[1].Hash = apis.CalculateCommitHash(0, []byte("never started"))
+	commits = append(commits, apis.CommitWriteRequest{Chunk: 3, Hash: commits[2].Hash, OldVersion: 5, NewVersion: 6})
+
+	results, err := cs.CommitWriteBatch(commits)
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+	assert.NoError(results[0])
+	assert.Error(results[1])
+	assert.NoError(results[2])
+	assert.Equal(apis.ErrWrongVersion, apis.ErrorCodeOf(results[3]))
+
+	for chunk, expected := range map[apis.ChunkNum]string{1: "H1llo world", 3: "H3llo world"} {
+		data, err := mem.ReadVersion(chunk, 2)
+		assert.NoError(err)
+		assert.Equal(expected, string(data))
+	}
+	versions, err := mem.ListVersions(2)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1}, versions)
+
+	// retrying the whole batch succeeds for what was committed before, and still fails for the rest
+	results, err = cs.CommitWriteBatch(commits[:3])
+	require.NoError(t, err)
+	assert.NoError(results[0])
+	assert.Error(results[1])
+	assert.NoError(results[2])
+
+	// an empty batch has nothing to do
+	results, err = cs.CommitWriteBatch(nil)
+	assert.NoError(err)
+	assert.Empty(results)
+}
+
+// Staged writes are found by their commit hash, so it has to come out the same as it always has, or chunkservers would
+// no longer agree with clients, and writes kept across a restart could no longer be committed.
+func TestCommitHashUnchanged(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	assert.Equal(apis.CommitHash("51bf5a9f1ed7633a193f6fdd17a7a3af8e032dfe72a9669c85e8639aa8a7c195"),
+		apis.CalculateCommitHash(0, nil))
+	assert.Equal(apis.CommitHash("98dc3f5007bb52b0b291056fc29ecda80dba44594a3d93bebef02ab2b961a8a4"),
+		apis.CalculateCommitHash(6, []byte("universe")))
+	assert.Equal(apis.CommitHash("a1a8b0bc50c30ffec9eb659153c2ea2a168464bcf211af5c28764c35d3143dfb"),
+		apis.CalculateCommitHash(4096, []byte("hello world")))
+}
+
+// Measures what hashing costs StartWrite, for writes up to the size of a whole chunk.
+func BenchmarkCommitHash(b *testing.B) {
+	for _, size := range []int{4096, 64 * 1024, 1024 * 1024, apis.MaxChunkSize} {
+		data := make([]byte, size)
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				apis.CalculateCommitHash(0, data)
+			}
+		})
+	}
+}
+
+// Damages a write after it has been staged, and checks that it is only committed if verification is off.
+func TestCommitHashVerification(t *testing.T) {
+	for name, options := range map[string]ChunkserverOptions{
+		"default": {},
+		"sampled": {CommitHashVerification: VerifySampledCommits, CommitHashSampleRate: 1},
+		"off":     {CommitHashVerification: VerifyNoCommits},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := testifyAssert.New(t)
+
+			mem, err := storage.ConfigureMemoryStorage()
+			require.NoError(t, err)
+			defer mem.Close()
+			cs, shutdown, err := ExposeChunkserverWithOptions(mem, options)
+			require.NoError(t, err)
+			defer shutdown(time.Now().Add(time.Second))
+
+			require.NoError(t, cs.Add(1, []byte("original"), 1))
+			data := []byte("change")
+			hash := apis.CalculateCommitHash(0, data)
+			require.NoError(t, cs.StartWrite(1, 0, data))
+			// the chunkserver keeps hold of the data it was given, so this damages the staged write
+			data[0] = 'X'
+
+			err = cs.CommitWrite(1, hash, 1, 2)
+			if options.CommitHashVerification == VerifyNoCommits {
+				// nothing notices, and the damage is stored
+				assert.NoError(err)
+				assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+				read, _, err := cs.Read(1, 0, 8, apis.AnyVersion)
+				assert.NoError(err)
+				assert.Equal("Xhangeal", string(read))
+				return
+			}
+			assert.Equal(apis.ErrChecksumMismatch, apis.ErrorCodeOf(err))
+			// the damaged write is discarded, so that starting it again works
+			assert.Empty(cs.(*chunkserver).Hashes)
+			assert.NoError(cs.StartWrite(1, 0, []byte("change")))
+			assert.NoError(cs.CommitWrite(1, hash, 1, 2))
+			assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+			read, _, err := cs.Read(1, 0, 8, apis.AnyVersion)
+			assert.NoError(err)
+			assert.Equal("changeal", string(read))
+		})
+	}
+}
+
+// Measures what verifying commit hashes costs CommitWrite, for writes of a whole chunk.
+func BenchmarkCommitHashVerification(b *testing.B) {
+	for _, verification := range []CommitHashVerification{VerifyEveryCommit, VerifyNoCommits} {
+		name := "on"
+		if verification == VerifyNoCommits {
+			name = "off"
+		}
+		b.Run(name, func(b *testing.B) {
+			mem, err := storage.ConfigureMemoryStorage()
+			require.NoError(b, err)
+			defer mem.Close()
+			cs, shutdown, err := ExposeChunkserverWithOptions(mem, ChunkserverOptions{CommitHashVerification: verification})
+			require.NoError(b, err)
+			defer shutdown(time.Now().Add(time.Second))
+
+			data := make([]byte, apis.MaxChunkSize)
+			hash := apis.CalculateCommitHash(0, data)
+			require.NoError(b, cs.Add(1, data, 1))
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for version := apis.Version(1); version <= apis.Version(b.N); version++ {
+				// only the commit itself is measured
+				b.StopTimer()
+				require.NoError(b, cs.StartWrite(1, 0, data))
+				b.StartTimer()
+				require.NoError(b, cs.CommitWrite(1, hash, version, version+1))
+				b.StopTimer()
+				require.NoError(b, cs.UpdateLatestVersion(1, version, version+1))
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package control
+
+import (
+	"errors"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// Compaction enters the chunkserver just like every operation, one chunk at a time, so it only ever sees the storage
+// between operations, shows up among slow operations, and is turned away once shutting down begins. Must be called
+// before anything else can use the chunkserver.
+func (cs *chunkserver) startCompaction(options storage.CompactionOptions) {
+	cs.compaction = storage.StartGuardedCompaction(cs.Storage, func() (func(), error) {
+		return cs.enter(operation{method: "Compaction"})
+	}, options)
+}
+
+// Doesn't take the lock, since compaction only checks whether it's paused between chunks.
+func (cs *chunkserver) SetCompactionPaused(paused bool) error {
+	if cs.compaction == nil {
+		return errors.New("[compaction.go/DIS] compaction is disabled on this chunkserver")
+	}
+	if paused {
+		cs.compaction.Pause()
+	} else {
+		cs.compaction.Resume()
+	}
+	return nil
+}
+
+func (cs *chunkserver) compactionStats(stats *apis.ChunkserverStats) {
+	if cs.compaction == nil {
+		return
+	}
+	compaction := cs.compaction.Stats()
+	stats.CompactionPaused = compaction.Paused
+	stats.CompactionPasses = compaction.Passes
+	stats.CompactionReclaimedBytes = compaction.Totals.ReclaimedBytes
+	if compaction.PassTotal > 0 {
+		stats.CompactionProgress = float64(compaction.PassDone) / float64(compaction.PassTotal)
+	}
+}
@@ -0,0 +1,70 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestCompactionDisabled(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithOptions(mem, ChunkserverOptions{})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.Error(cs.SetCompactionPaused(true))
+	stats, err := cs.GetStats()
+	assert.NoError(err)
+	assert.False(stats.CompactionPaused)
+	assert.Equal(uint64(0), stats.CompactionPasses)
+}
+
+func TestCompactionInBackground(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "compaction-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer fs.Close()
+
+	cs, shutdown, err := ExposeChunkserverWithOptions(fs, ChunkserverOptions{
+		Compaction: &storage.CompactionOptions{Interval: time.Hour},
+	})
+	require.NoError(t, err)
+	for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+		assert.NoError(cs.Add(chunk, []byte("hello"), 1))
+	}
+
+	// compaction goes on alongside everything else, and finishes its first pass soon enough
+	deadline := time.Now().Add(5 * time.Second)
+	var stats apis.ChunkserverStats
+	for stats.CompactionPasses == 0 {
+		require.True(t, time.Now().Before(deadline), "compaction never finished a pass")
+		time.Sleep(time.Millisecond)
+		stats, err = cs.GetStats()
+		require.NoError(t, err)
+	}
+	assert.False(stats.CompactionPaused)
+	assert.Equal(1.0, stats.CompactionProgress)
+
+	assert.NoError(cs.SetCompactionPaused(true))
+	stats, err = cs.GetStats()
+	assert.NoError(err)
+	assert.True(stats.CompactionPaused)
+	// nothing is held up while compaction is paused, including shutting down
+	data, _, err := cs.Read(2, 0, 5, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("hello", string(data))
+	assert.NoError(shutdown(time.Now().Add(time.Second)))
+}
@@ -0,0 +1,55 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// Commit the same bytes that are already in the chunk, and report how much storage is in use once both versions exist.
+func storageAfterIdenticalCommit(t *testing.T, options ChunkserverOptions) storage.MemoryStats {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithOptions(mem, options)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.NoError(cs.Add(7, []byte("hello world"), 3))
+	assert.NoError(cs.StartWrite(7, 6, []byte("world")))
+	assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(6, []byte("world")), 3, 4))
+
+	stats := mem.(*storage.MemoryStorage).StatsForTesting()
+
+	// the new version must behave like any other, even once the version it shares storage with is gone
+	assert.NoError(cs.UpdateLatestVersion(7, 3, 4))
+	data, version, err := cs.Read(7, 0, 11, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(4), version)
+	assert.Equal("hello world", string(data))
+
+	// and later writes that do change something must not affect anything else
+	assert.NoError(cs.StartWrite(7, 0, []byte("HELLO")))
+	assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("HELLO")), 4, 5))
+	data, _, err = cs.Read(7, 0, 11, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("hello world", string(data))
+
+	return stats
+}
+
+func TestCommitWriteDeduplication(t *testing.T) {
+	duplicated := storageAfterIdenticalCommit(t, ChunkserverOptions{})
+	deduplicated := storageAfterIdenticalCommit(t, ChunkserverOptions{Deduplicate: true})
+
+	assert := testifyAssert.New(t)
+	assert.Equal(2, duplicated.Buffers)
+	assert.Equal(22, duplicated.Committed)
+	assert.Equal(1, deduplicated.Buffers)
+	assert.Equal(11, deduplicated.Committed)
+}
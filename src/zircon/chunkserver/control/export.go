@@ -0,0 +1,383 @@
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"zircon/apis"
+)
+
+// Export format, all little-endian:
+//   magic (8 bytes)
+//   for each exported version: record kind (1 byte), chunk number (8 bytes), version (8 bytes), checksum (4 bytes),
+//     length (4 bytes), data (length bytes)
+//   terminator: record kind zero (1 byte), followed by the number of versions exported (8 bytes)
+// Every version of a chunk is exported together, with the chunk's latest version last, so that a chunk can be
+// restored in one step once its latest version is reached. The trailing count means that a truncated export is
+// detected on import, rather than silently restoring only some of the chunks.
+
+var chunkExportMagic = []byte("ZCHUNK01")
+
+const (
+	recordEnd byte = iota
+	// a version that isn't the chunk's latest; more versions of the same chunk follow
+	recordVersion
+	// the chunk's latest version, which is always the last version exported for that chunk
+	recordLatest
+)
+
+const exportHeaderSize = 1 + 8 + 8 + 4 + 4
+
+// Implemented by the chunkservers returned by ExposeChunkserver, for taking backups without stopping the server.
+type Exporter interface {
+	// Streams the contents of every chunk. Each chunk is exported as it was at some point during the export, but
+	// different chunks may be exported as of different points, because the server keeps serving requests throughout.
+	// Only one chunk is held in memory at a time.
+	Export(w io.Writer, options ExportOptions) error
+	// Restores the chunks produced by Export. Only possible while the chunkserver holds no chunks. Returns the number
+	// of versions that were restored. Nothing is restored unless the whole export is intact, so a failed import can
+	// simply be tried again.
+	Import(r io.Reader) (int, error)
+}
+
+type ExportOptions struct {
+	// Export every version that the chunkserver still holds, rather than only the latest version of each chunk.
+	AllVersions bool
+}
+
+type exportedVersion struct {
+	version apis.Version
+	data    []byte
+}
+
+func (cs *chunkserver) exportedChunks() ([]apis.ChunkNum, error) {
+	release, err := cs.enter(operation{method: "Export"})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	chunks := make([]apis.ChunkNum, 0, len(cs.latest))
+	for chunk := range cs.latest {
+		chunks = append(chunks, chunk)
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i] < chunks[j]
+	})
+	return chunks, nil
+}
+
+// Reads the versions of a chunk to export, with the latest version last. Returns nothing if the chunk was deleted after
+// the export started.
+func (cs *chunkserver) snapshotChunk(chunk apis.ChunkNum, allVersions bool) ([]exportedVersion, error) {
+	release, err := cs.enter(operation{method: "Export", chunk: chunk})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	latest, err := cs.latestVersion(chunk)
+	if apis.ErrorCodeOf(err) == apis.ErrChunkNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	versions := []apis.Version{latest}
+	if allVersions {
+		all, err := cs.Storage.ListVersions(chunk)
+		if err != nil {
+			return nil, err
+		}
+		versions = versions[:0]
+		for _, version := range all {
+			if version != latest {
+				versions = append(versions, version)
+			}
+		}
+		versions = append(versions, latest)
+	}
+	result := make([]exportedVersion, len(versions))
+	for i, version := range versions {
+		data, err := cs.readVersion(chunk, version)
+		if err != nil {
+			return nil, fmt.Errorf("reading %d/%d: %v", chunk, version, err)
+		}
+		result[i] = exportedVersion{version: version, data: data}
+	}
+	return result, nil
+}
+
+func (cs *chunkserver) Export(w io.Writer, options ExportOptions) error {
+	chunks, err := cs.exportedChunks()
+	if err != nil {
+		return fmt.Errorf("[export.go/LST] %v", err)
+	}
+	out := bufio.NewWriter(w)
+	if _, err := out.Write(chunkExportMagic); err != nil {
+		return err
+	}
+	header := make([]byte, exportHeaderSize)
+	count := uint64(0)
+	for _, chunk := range chunks {
+		versions, err := cs.snapshotChunk(chunk, options.AllVersions)
+		if err != nil {
+			return fmt.Errorf("[export.go/SNP] %v", err)
+		}
+		for i, exported := range versions {
+			header[0] = recordVersion
+			if i == len(versions)-1 {
+				header[0] = recordLatest
+			}
+			binary.LittleEndian.PutUint64(header[1:], uint64(chunk))
+			binary.LittleEndian.PutUint64(header[9:], uint64(exported.version))
+			binary.LittleEndian.PutUint32(header[17:], apis.ChunkChecksum(exported.data))
+			binary.LittleEndian.PutUint32(header[21:], uint32(len(exported.data)))
+			if _, err := out.Write(header); err != nil {
+				return err
+			}
+			if _, err := out.Write(exported.data); err != nil {
+				return err
+			}
+			count += 1
+		}
+	}
+	terminator := make([]byte, 9)
+	terminator[0] = recordEnd
+	binary.LittleEndian.PutUint64(terminator[1:], count)
+	if _, err := out.Write(terminator); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// Versions are written to storage as they're read, so that only one chunk is held in memory at a time, but no chunk is
+// given a latest version until the whole export has been read and checked. Until then, the versions are invisible, and
+// are either removed again if the import fails, or cleaned up as orphans on startup if we crash.
+func (cs *chunkserver) Import(r io.Reader) (int, error) {
+	if err := cs.checkEmpty(); err != nil {
+		return 0, fmt.Errorf("[export.go/EMP] %v", err)
+	}
+	var staged []importedChunk
+	count, err := cs.stageImport(r, &staged)
+	if err != nil {
+		if err2 := cs.discardImport(staged); err2 != nil {
+			return 0, fmt.Errorf("%v (and then could not discard the import: %v)", err, err2)
+		}
+		return 0, err
+	}
+	if left, err := cs.commitImport(staged); err != nil {
+		if err2 := cs.discardImport(left); err2 != nil {
+			return 0, fmt.Errorf("[export.go/IMP] %v (and then could not discard the import: %v)", err, err2)
+		}
+		return 0, fmt.Errorf("[export.go/IMP] %v", err)
+	}
+	return count, nil
+}
+
+// A chunk whose versions have been written by an import, but which hasn't been given its latest version yet.
+type importedChunk struct {
+	chunk    apis.ChunkNum
+	versions []apis.Version
+}
+
+// Reads an export, and writes every version in it to storage, adding each chunk to staged as it's written. Returns the
+// number of versions written.
+func (cs *chunkserver) stageImport(r io.Reader, staged *[]importedChunk) (int, error) {
+	in := bufio.NewReader(r)
+	magic := make([]byte, len(chunkExportMagic))
+	if _, err := io.ReadFull(in, magic); err != nil {
+		return 0, fmt.Errorf("[export.go/MAG] %v", err)
+	}
+	if !bytes.Equal(magic, chunkExportMagic) {
+		return 0, errors.New("[export.go/MAG] not a chunkserver export")
+	}
+	header := make([]byte, exportHeaderSize)
+	var pending []exportedVersion
+	var pendingChunk apis.ChunkNum
+	seen, written := uint64(0), 0
+	for {
+		if _, err := io.ReadFull(in, header[:1]); err != nil {
+			return 0, fmt.Errorf("[export.go/TRN] export truncated after %d versions: %v", seen, err)
+		}
+		if header[0] == recordEnd {
+			break
+		}
+		if header[0] != recordVersion && header[0] != recordLatest {
+			return 0, fmt.Errorf("[export.go/KND] unknown record kind %d after %d versions", header[0], seen)
+		}
+		if _, err := io.ReadFull(in, header[1:]); err != nil {
+			return 0, fmt.Errorf("[export.go/TRN] export truncated after %d versions: %v", seen, err)
+		}
+		chunk := apis.ChunkNum(binary.LittleEndian.Uint64(header[1:]))
+		version := apis.Version(binary.LittleEndian.Uint64(header[9:]))
+		checksum := binary.LittleEndian.Uint32(header[17:])
+		length := binary.LittleEndian.Uint32(header[21:])
+		if len(pending) > 0 && chunk != pendingChunk {
+			return 0, fmt.Errorf("[export.go/ORD] chunk %d has no latest version in the export", pendingChunk)
+		}
+		if err := cs.checkBounds(0, uint64(length)); err != nil {
+			return 0, fmt.Errorf("[export.go/LEN] %d/%d: %v", chunk, version, err)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(in, data); err != nil {
+			return 0, fmt.Errorf("[export.go/TRN] export truncated after %d versions: %v", seen, err)
+		}
+		if actual := apis.ChunkChecksum(data); actual != checksum {
+			return 0, apis.NewError(apis.ErrChecksumMismatch, version, "export of %d/%d is damaged: checksum %08x, expected %08x",
+				chunk, version, actual, checksum)
+		}
+		seen += 1
+		pending = append(pending, exportedVersion{version: version, data: data})
+		pendingChunk = chunk
+		if header[0] == recordLatest {
+			imported, err := cs.stageImportedChunk(chunk, pending)
+			if err != nil {
+				return 0, fmt.Errorf("[export.go/IMP] chunk %d: %v", chunk, err)
+			}
+			*staged = append(*staged, imported)
+			written += len(pending)
+			pending = nil
+		}
+	}
+	if len(pending) > 0 {
+		return 0, fmt.Errorf("[export.go/ORD] chunk %d has no latest version in the export", pendingChunk)
+	}
+	if _, err := io.ReadFull(in, header[:8]); err != nil {
+		return 0, fmt.Errorf("[export.go/TRN] export missing version count: %v", err)
+	}
+	if expected := binary.LittleEndian.Uint64(header[:8]); expected != seen {
+		return 0, fmt.Errorf("[export.go/CNT] export claims %d versions, but contained %d", expected, seen)
+	}
+	return written, nil
+}
+
+func (cs *chunkserver) checkEmpty() error {
+	release, err := cs.enter(operation{method: "Import"})
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if len(cs.latest) > 0 {
+		return fmt.Errorf("can only import onto an empty chunkserver, but this one holds %d chunks", len(cs.latest))
+	}
+	return nil
+}
+
+// Writes every exported version of a chunk, without giving it a latest version yet. Either all of the versions are
+// written, or none of them are.
+func (cs *chunkserver) stageImportedChunk(chunk apis.ChunkNum, versions []exportedVersion) (importedChunk, error) {
+	release, err := cs.enter(operation{method: "Import", chunk: chunk})
+	if err != nil {
+		return importedChunk{}, err
+	}
+	defer release()
+	cs.readAhead.invalidate(chunk)
+
+	existing, err := cs.Storage.ListVersions(chunk)
+	if err != nil {
+		return importedChunk{}, err
+	}
+	if len(existing) > 0 {
+		return importedChunk{}, apis.NewError(apis.ErrChunkExists, 0, "chunk %d already exists", chunk)
+	}
+	total := 0
+	for _, exported := range versions {
+		total += len(exported.data)
+	}
+	if err := cs.checkReserve(total); err != nil {
+		return importedChunk{}, err
+	}
+	if err := cs.checkTombstone(chunk, versions[len(versions)-1].version); err != nil {
+		return importedChunk{}, err
+	}
+	imported := importedChunk{chunk: chunk}
+	for _, exported := range versions {
+		if err := cs.writeVersion(chunk, exported.version, exported.data); err != nil {
+			if err2 := cs.discardImported(imported); err2 != nil {
+				return importedChunk{}, fmt.Errorf("%v (and then %v)", err, err2)
+			}
+			return importedChunk{}, err
+		}
+		imported.versions = append(imported.versions, exported.version)
+	}
+	return imported, nil
+}
+
+// Gives every staged chunk its latest version, all at once, so that nothing can see the import partway through. If any
+// of them can't be, those that already were are taken back, and the chunks that are left staged are returned for
+// discardImport. A chunk whose latest version can't be taken back stays imported, and isn't among them.
+func (cs *chunkserver) commitImport(staged []importedChunk) ([]importedChunk, error) {
+	release, err := cs.enter(operation{method: "Import"})
+	if err != nil {
+		return staged, err
+	}
+	defer release()
+
+	for i, imported := range staged {
+		chunk := imported.chunk
+		latest := imported.versions[len(imported.versions)-1]
+		err := cs.checkTombstone(chunk, latest)
+		if _, found := cs.latest[chunk]; found && err == nil {
+			err = apis.NewError(apis.ErrChunkExists, 0, "chunk %d was created during the import", chunk)
+		}
+		if err == nil {
+			err = cs.setLatestVersion(chunk, latest)
+		}
+		if err != nil {
+			err = fmt.Errorf("chunk %d: %v", chunk, err)
+			left := append([]importedChunk(nil), staged[i:]...)
+			for _, committed := range staged[:i] {
+				if err2 := cs.deleteLatestVersion(committed.chunk); err2 != nil {
+					// its versions are in use now, so they must not be discarded along with the rest
+					err = fmt.Errorf("%v (and then could not take back chunk %d: %v)", err, committed.chunk, err2)
+					continue
+				}
+				left = append(left, committed)
+			}
+			return left, err
+		}
+	}
+	for _, imported := range staged {
+		cs.forgetCommits(imported.chunk)
+		// the chunk is restored regardless, and a tombstone older than its latest version doesn't stand in its way
+		if err := cs.forgetTombstone(imported.chunk); err != nil {
+			log.Printf("could not forget tombstone of imported chunk %d: %v", imported.chunk, err)
+		}
+	}
+	return nil, nil
+}
+
+// Removes every version written by an import that didn't go through. Carries on past chunks that can't be removed, and
+// reports the first of them; whatever is left behind has no latest version, and so is cleaned up on startup.
+func (cs *chunkserver) discardImport(staged []importedChunk) error {
+	var first error
+	for _, imported := range staged {
+		release, err := cs.enter(operation{method: "Import", chunk: imported.chunk})
+		if err != nil {
+			// shutting down; the rest is cleaned up on startup
+			return first
+		}
+		if err := cs.discardImported(imported); err != nil && first == nil {
+			first = err
+		}
+		release()
+	}
+	return first
+}
+
+// Must be called with the lock held.
+func (cs *chunkserver) discardImported(imported importedChunk) error {
+	for _, version := range imported.versions {
+		if err := cs.Storage.DeleteVersion(imported.chunk, version); err != nil {
+			return fmt.Errorf("[export.go/DSC] chunk %d: could not discard imported version %d: %v",
+				imported.chunk, version, err)
+		}
+	}
+	return nil
+}
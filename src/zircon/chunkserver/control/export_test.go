@@ -0,0 +1,228 @@
+package control
+
+import (
+	"bytes"
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func newExportTestServer(t *testing.T) (apis.ChunkserverSingle, storage.ChunkStorage, func()) {
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+	return cs, mem, func() {
+		shutdown(time.Now().Add(time.Second))
+		mem.Close()
+	}
+}
+
+// Every version held by the server, along with its contents.
+func contentsOf(t *testing.T, cs apis.ChunkserverSingle, mem storage.ChunkStorage) map[apis.ChunkVersion]string {
+	chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+	require.NoError(t, err)
+	contents := map[apis.ChunkVersion]string{}
+	for _, cv := range chunks {
+		data, err := mem.ReadVersion(cv.Chunk, cv.Version)
+		require.NoError(t, err)
+		contents[cv] = string(data)
+	}
+	return contents
+}
+
+func TestExportImport(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	source, sourceMem, sourceT := newExportTestServer(t)
+	defer sourceT()
+
+	const chunkCount = 300
+	for chunk := apis.ChunkNum(1); chunk <= chunkCount; chunk++ {
+		data := []byte(fmt.Sprintf("chunk number %d", chunk))
+		require.NoError(t, source.Add(chunk, data, 1))
+		if chunk%3 == 0 {
+			// a newer version that has become the latest
+			hash := apis.CalculateCommitHash(0, []byte("CHUNK"))
+			require.NoError(t, source.StartWrite(chunk, 0, []byte("CHUNK")))
+			require.NoError(t, source.CommitWrite(chunk, hash, 1, 2))
+			require.NoError(t, source.UpdateLatestVersion(chunk, 1, 2))
+		}
+		if chunk%7 == 0 {
+			// and one that hasn't yet
+			latest := apis.Version(1)
+			if chunk%3 == 0 {
+				latest = 2
+			}
+			hash := apis.CalculateCommitHash(6, []byte("NUMBER"))
+			require.NoError(t, source.StartWrite(chunk, 6, []byte("NUMBER")))
+			require.NoError(t, source.CommitWrite(chunk, hash, latest, latest+1))
+		}
+	}
+	everything := contentsOf(t, source, sourceMem)
+
+	// only the latest version of each chunk
+	var latestOnly bytes.Buffer
+	assert.NoError(source.(Exporter).Export(&latestOnly, ExportOptions{}))
+	target, targetMem, targetT := newExportTestServer(t)
+	defer targetT()
+	count, err := target.(Exporter).Import(bytes.NewReader(latestOnly.Bytes()))
+	assert.NoError(err)
+	assert.Equal(chunkCount, count)
+	restored := contentsOf(t, target, targetMem)
+	assert.Equal(chunkCount, len(restored))
+	for cv, data := range restored {
+		assert.Equal(everything[cv], data)
+	}
+	for chunk := apis.ChunkNum(1); chunk <= chunkCount; chunk++ {
+		expected, _, err := source.Read(chunk, 0, 32, apis.AnyVersion)
+		assert.NoError(err)
+		data, _, err := target.Read(chunk, 0, 32, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(expected, data)
+	}
+
+	// every retained version
+	var allVersions bytes.Buffer
+	assert.NoError(source.(Exporter).Export(&allVersions, ExportOptions{AllVersions: true}))
+	full, fullMem, fullT := newExportTestServer(t)
+	defer fullT()
+	count, err = full.(Exporter).Import(bytes.NewReader(allVersions.Bytes()))
+	assert.NoError(err)
+	assert.Equal(len(everything), count)
+	assert.Equal(everything, contentsOf(t, full, fullMem))
+	for chunk := apis.ChunkNum(1); chunk <= chunkCount; chunk++ {
+		_, expected, err := source.Read(chunk, 0, 1, apis.AnyVersion)
+		assert.NoError(err)
+		_, version, err := full.Read(chunk, 0, 1, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(expected, version)
+	}
+
+	// a server that already holds chunks can't be restored onto
+	_, err = full.(Exporter).Import(bytes.NewReader(allVersions.Bytes()))
+	assert.Error(err)
+}
+
+func TestImportDetectsDamage(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	source, _, sourceT := newExportTestServer(t)
+	defer sourceT()
+	for chunk := apis.ChunkNum(1); chunk <= 10; chunk++ {
+		require.NoError(t, source.Add(chunk, []byte("hello world"), 1))
+	}
+	var export bytes.Buffer
+	require.NoError(t, source.(Exporter).Export(&export, ExportOptions{}))
+
+	for name, damaged := range map[string][]byte{
+		"not an export": []byte("hello world"),
+		"truncated":     export.Bytes()[:export.Len()-20],
+		"missing count": export.Bytes()[:export.Len()-4],
+		"corrupted": func() []byte {
+			data := append([]byte(nil), export.Bytes()...)
+			data[len(chunkExportMagic)+exportHeaderSize] ^= 0xFF
+			return data
+		}(),
+	} {
+		target, mem, targetT := newExportTestServer(t)
+		count, err := target.(Exporter).Import(bytes.NewReader(damaged))
+		assert.Error(err, name)
+		assert.Equal(0, count, name)
+		// nothing is left behind, not even versions without a latest one, so the import can be tried again
+		assert.Empty(contentsOf(t, target, mem), name)
+		withData, err := mem.ListChunksWithData()
+		assert.NoError(err, name)
+		assert.Empty(withData, name)
+		count, err = target.(Exporter).Import(bytes.NewReader(export.Bytes()))
+		assert.NoError(err, name)
+		assert.Equal(10, count, name)
+		targetT()
+	}
+}
+
+// Fails changes to particular chunks, so that an import fails partway through, and then can't be fully cleaned up.
+type failingImportStorage struct {
+	storage.ChunkStorage
+	failWrite     apis.ChunkNum
+	failSetLatest apis.ChunkNum
+	failDelete    apis.ChunkNum
+}
+
+func (f *failingImportStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	if chunk == f.failWrite {
+		return fmt.Errorf("cannot write chunk %d", chunk)
+	}
+	return f.ChunkStorage.WriteVersion(chunk, version, data)
+}
+
+func (f *failingImportStorage) SetLatestVersion(chunk apis.ChunkNum, version apis.Version) error {
+	if chunk == f.failSetLatest {
+		return fmt.Errorf("cannot set latest version of chunk %d", chunk)
+	}
+	return f.ChunkStorage.SetLatestVersion(chunk, version)
+}
+
+func (f *failingImportStorage) DeleteVersion(chunk apis.ChunkNum, version apis.Version) error {
+	if chunk == f.failDelete {
+		return fmt.Errorf("cannot delete versions of chunk %d", chunk)
+	}
+	return f.ChunkStorage.DeleteVersion(chunk, version)
+}
+
+func (f *failingImportStorage) DeleteLatestVersion(chunk apis.ChunkNum) error {
+	if chunk == f.failDelete {
+		return fmt.Errorf("cannot delete latest version of chunk %d", chunk)
+	}
+	return f.ChunkStorage.DeleteLatestVersion(chunk)
+}
+
+func TestImportReportsFailedCleanup(t *testing.T) {
+	source, _, sourceT := newExportTestServer(t)
+	defer sourceT()
+	for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+		require.NoError(t, source.Add(chunk, []byte("hello world"), 1))
+	}
+	var export bytes.Buffer
+	require.NoError(t, source.(Exporter).Export(&export, ExportOptions{}))
+
+	for name, failing := range map[string]*failingImportStorage{
+		// chunk 3 can't be written, and then chunk 1 can't be discarded
+		"staging": {failWrite: 3, failDelete: 1},
+		// chunk 3 can't be given its latest version, and then chunk 1 can't be taken back
+		"committing": {failSetLatest: 3, failDelete: 1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := testifyAssert.New(t)
+
+			mem, err := storage.ConfigureMemoryStorage()
+			require.NoError(t, err)
+			defer mem.Close()
+			failing.ChunkStorage = mem
+			target, shutdown, err := ExposeChunkserverWithShutdown(failing)
+			require.NoError(t, err)
+			defer shutdown(time.Now().Add(time.Second))
+
+			count, err := target.(Exporter).Import(bytes.NewReader(export.Bytes()))
+			assert.Equal(0, count)
+			require.Error(t, err)
+			assert.Contains(err.Error(), "chunk 3")
+			assert.Contains(err.Error(), "chunk 1")
+
+			// everything else is cleaned up
+			withData, err := mem.ListChunksWithData()
+			assert.NoError(err)
+			assert.Equal([]apis.ChunkNum{1}, withData)
+			if failing.failSetLatest != 0 {
+				// chunk 1 couldn't be taken back, so it stays imported, with its data intact
+				data, _, err := target.Read(1, 0, 5, apis.AnyVersion)
+				assert.NoError(err)
+				assert.Equal("hello", string(data))
+			}
+		})
+	}
+}
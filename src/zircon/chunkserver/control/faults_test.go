@@ -0,0 +1,109 @@
+package control
+
+import (
+	"errors"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestCommitAfterStorageFailure(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	faulty := storage.WithFaults(mem)
+	cs, shutdown, err := ExposeChunkserverWithShutdown(faulty)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.NoError(cs.Add(1, []byte("hello world"), 1))
+	assert.NoError(cs.StartWrite(1, 6, []byte("there")))
+
+	// the disk fails between staging and commit
+	faulty.FailNextWrite(errors.New("I/O error"))
+	hash := apis.CalculateCommitHash(6, []byte("there"))
+	assert.Error(cs.CommitWrite(1, hash, 1, 2))
+	versions, err := mem.ListVersions(1)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1}, versions)
+
+	// the write stays staged, so the commit can simply be retried
+	stats, err := cs.GetStats()
+	assert.NoError(err)
+	assert.Equal(uint64(1), stats.StagedWrites)
+	assert.NoError(cs.CommitWrite(1, hash, 1, 2))
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+	data, _, err := cs.Read(1, 0, 11, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("hello there", string(data))
+	assert.Equal(1, faulty.Faults().FailedWrites)
+}
+
+func TestJoinedCommitAfterStorageFailure(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	faulty := storage.WithFaults(mem)
+	cs, shutdown, err := ExposeChunkserverWithShutdown(faulty)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.NoError(cs.Add(1, []byte("abcdef"), 1))
+	assert.NoError(cs.StartWrite(1, 0, []byte("A")))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(0, []byte("A")), 1, 2))
+
+	// a failure while rewriting the version for a second commit must not lose the first one
+	assert.NoError(cs.StartWrite(1, 5, []byte("F")))
+	faulty.FailNextWrite(errors.New("I/O error"))
+	assert.Error(cs.CommitWrite(1, apis.CalculateCommitHash(5, []byte("F")), 1, 2))
+	data, err := mem.ReadVersion(1, 2)
+	assert.NoError(err)
+	assert.Equal("Abcdef", string(data[:6]))
+
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(5, []byte("F")), 1, 2))
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+	result, _, err := cs.Read(1, 0, 6, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("AbcdeF", string(result))
+}
+
+func TestMigrateDetectsDamagedCopy(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	fast, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	slowMem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	slow := storage.WithFaults(slowMem)
+	tiered, err := storage.WithTiers([]storage.Tier{{Name: "fast", Storage: fast}, {Name: "slow", Storage: slow}})
+	require.NoError(t, err)
+	defer tiered.Close()
+	server, shutdown, err := ExposeChunkserverWithShutdown(tiered)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.NoError(server.Add(1, []byte("precious data"), 1))
+
+	// the copy in the slow tier reads back damaged, so the move has to be called off
+	slow.CorruptChunk(1, 1)
+	assert.Error(server.(Migrator).MigrateChunk(1, "slow"))
+	assert.Equal(1, slow.Faults().CorruptedReads)
+	assert.Equal("fast", tiered.TierOf(1))
+	data, _, err := server.Read(1, 0, 13, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("precious data", string(data))
+
+	// retrying cleans up the damaged copy first, which clears the fault
+	assert.NoError(server.(Migrator).MigrateChunk(1, "slow"))
+	assert.Equal("slow", tiered.TierOf(1))
+	data, _, err = server.Read(1, 0, 13, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("precious data", string(data))
+}
@@ -1,37 +1,214 @@
 package control
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"log"
+	"sort"
 	"sync"
+	"time"
 	"zircon/apis"
 	"zircon/chunkserver/storage"
+	"zircon/util"
 )
 
 // a nullary function to tear down any internal state of a ChunkserverSingle instance
 type Teardown func()
 
+// Gracefully shuts down a ChunkserverSingle instance: new operations are rejected with ErrShuttingDown, in-flight
+// operations are given until the deadline to finish, and then storage is flushed and staged writes are released.
+// The storage itself is not closed; that remains the responsibility of whoever opened it.
+type Shutdown func(deadline time.Time) error
+
+// How long the Teardown returned by ExposeChunkserver waits for in-flight operations.
+const TeardownGracePeriod = 10 * time.Second
+
 type commit struct {
 	Offset uint32
 	Data   []byte
+	// the number of chunks this write has been started for but not yet committed into; identical writes share an
+	// entry, whatever chunk they are for
+	Pending int
+	// the chunks with a pending start of this write; nil for writes restored after a restart, which aren't associated
+	// with any chunk
+	Chunks map[apis.ChunkNum]bool
 }
 
 // an implementation of apis.ChunkserverSingle
 type chunkserver struct {
-	mu      sync.Mutex
-	Storage storage.ChunkStorage
-	Hashes  map[apis.CommitHash]commit
+	// held shared by the operations that only touch one chunk, and exclusively by every other operation; see locks.go
+	exclusive sync.RWMutex
+	// held by an operation on one chunk from start to finish, so that a read never sees a chunk partway through being
+	// changed, while operations on other chunks carry on
+	chunkLocks *chunkLocks
+	// held for as long as the state guarded by it is used; never held while waiting for storage, except by operations
+	// that already hold the exclusive lock outright
+	mu sync.Mutex
+	// held for as long as storage is used, since storage isn't threadsafe
+	storageMu sync.Mutex
+	Storage   storage.ChunkStorage
+	Hashes    map[apis.CommitHash]commit
+	started   time.Time
+	options   ChunkserverOptions
+	// options.MaxChunkSize, with the default filled in
+	chunkSize uint32
+	// guarded by mu
+	readAhead *readAheadCache
+	// guarded by mu; the writes committed into each chunk's versions that haven't become the latest yet
+	commits map[apis.ChunkNum]map[apis.Version]*versionCommits
+	// guarded by mu; the writes committed into each chunk's latest version, if it was built by CommitWrite
+	applied map[apis.ChunkNum]appliedCommits
+	// guarded by mu; the latest version of every chunk, as also recorded in storage
+	latest map[apis.ChunkNum]apis.Version
+	// guarded by mu; the chunks deleted from here, as also recorded in storage if it can keep them
+	tombstones map[apis.ChunkNum]apis.Tombstone
+	// guarded by storageMu; where the time has gone in storage, for the operation that holds the lock
+	timing operationTiming
+	// guarded by mu; the chunks being sent to other chunkservers, which are watched for changes
+	replicating map[apis.ChunkNum]*inflightReplications
+	// not guarded by mu, since it has its own lock
+	slowOps *slowOperations
+	// nil if compaction is disabled; takes the locks itself, and so must never be stopped while any of them are held
+	compaction *storage.Compaction
+	// nil if the storage doesn't report any measurements; not guarded by mu, since it only uses atomic operations
+	metrics *storage.StorageMetrics
+	// guarded by mu; what VerifyAll has found so far
+	verified verifyTotals
+
+	// separate from mu, so that shutting down does not need to wait in line behind operations
+	lifecycle    sync.Mutex
+	shuttingDown bool
+	inflight     sync.WaitGroup
+	// guarded by lifecycle; cancels the check that VerifyAll is running, or nil if there isn't one
+	verifying context.CancelFunc
 }
 
 // This includes most of the chunkserver implementation; which it exports through the ChunkserverSingle interface, based
-// on just a storage layer.
+// on just a storage layer. Before returning, the storage is scanned to clean up after anything a previous run left
+// unfinished; see RecoveryReport.
 func ExposeChunkserver(storage storage.ChunkStorage) (apis.ChunkserverSingle, Teardown, error) {
+	cs, shutdown, err := ExposeChunkserverWithShutdown(storage)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cs, func() {
+		if err := shutdown(time.Now().Add(TeardownGracePeriod)); err != nil {
+			log.Printf("chunkserver did not shut down cleanly: %v", err)
+		}
+	}, nil
+}
+
+// Like ExposeChunkserver, but gives the caller control over how long to wait for in-flight operations on shutdown.
+func ExposeChunkserverWithShutdown(storage storage.ChunkStorage) (apis.ChunkserverSingle, Shutdown, error) {
+	return ExposeChunkserverWithOptions(storage, ChunkserverOptions{})
+}
+
+// Like ExposeChunkserverWithShutdown, but with non-default options, which are checked with Validate first.
+func ExposeChunkserverWithOptions(storage storage.ChunkStorage, options ChunkserverOptions) (apis.ChunkserverSingle, Shutdown, error) {
+	if err := options.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("[handle.go/OPT] %v", err)
+	}
+	limitChunkSize(storage, options.chunkSize())
 	cs := &chunkserver{
-		Storage: storage,
-		Hashes:  map[apis.CommitHash]commit{},
+		chunkLocks:  newChunkLocks(),
+		Storage:     storage,
+		Hashes:      map[apis.CommitHash]commit{},
+		started:     time.Now(),
+		options:     options,
+		chunkSize:   options.chunkSize(),
+		readAhead:   newReadAheadCache(options.ReadAheadCapacity, options.chunkSize()),
+		commits:     map[apis.ChunkNum]map[apis.Version]*versionCommits{},
+		applied:     map[apis.ChunkNum]appliedCommits{},
+		latest:      map[apis.ChunkNum]apis.Version{},
+		tombstones:  map[apis.ChunkNum]apis.Tombstone{},
+		replicating: map[apis.ChunkNum]*inflightReplications{},
+		slowOps:     newSlowOperations(options),
+		metrics:     meterStorage(storage),
 	}
-	// TODO: RECOVERY PROCESS
-	return cs, cs.Teardown, nil
+	// nothing else has a reference to this chunkserver yet, so no operations can arrive until recovery is done
+	report, err := cs.recover()
+	if err != nil {
+		return nil, nil, err
+	}
+	if report != (RecoveryReport{}) {
+		log.Printf("recovered chunkserver state from storage: %v", report)
+	}
+	if options.MaxStartupDamage > 0 && report.Damaged() > options.MaxStartupDamage {
+		return nil, nil, fmt.Errorf("[handle.go/DMG] refusing to serve: found %d damaged versions on startup, "+
+			"more than the limit of %d", report.Damaged(), options.MaxStartupDamage)
+	}
+	if options.Compaction != nil {
+		// only once recovery is done, so that compaction never sees anything left half-finished
+		cs.startCompaction(*options.Compaction)
+	}
+	return cs, cs.Shutdown, nil
+}
+
+// Like ExposeChunkserverWithOptions, but opens the storage itself, from the backend named in the options, and closes it
+// again once the chunkserver has shut down cleanly. If in-flight operations are still running at the deadline, the
+// storage is left open, since they may still be using it. The storage is returned too, for callers that want to look
+// at it directly.
+func OpenChunkserver(options ChunkserverOptions) (apis.ChunkserverSingle, storage.ChunkStorage, Shutdown, error) {
+	if options.Backend == "" {
+		return nil, nil, nil, errors.New("[handle.go/BKN] no storage backend specified")
+	}
+	store, err := storage.ConfigureStorage(options.Backend, options.BackendConfig)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("[handle.go/BKE] %v", err)
+	}
+	cs, shutdown, err := ExposeChunkserverWithOptions(store, options)
+	if err != nil {
+		store.Close()
+		return nil, nil, nil, err
+	}
+	return cs, store, func(deadline time.Time) error {
+		if err := shutdown(deadline); err != nil {
+			return err
+		}
+		store.Close()
+		return nil
+	}, nil
+}
+
+// Registers an in-flight operation and takes the exclusive lock, the main lock, and the storage lock. The returned
+// function must be called once the operation is complete, at which point the operation is logged if it was slow. Fails
+// if the chunkserver is shutting down.
+func (cs *chunkserver) enter(op operation) (func(), error) {
+	cs.lifecycle.Lock()
+	if cs.shuttingDown {
+		cs.lifecycle.Unlock()
+		return nil, apis.NewError(apis.ErrShuttingDown, 0, "chunkserver is shutting down")
+	}
+	cs.inflight.Add(1)
+	cs.lifecycle.Unlock()
+
+	start := time.Now()
+	cs.exclusive.Lock()
+	cs.mu.Lock()
+	cs.storageMu.Lock()
+	cs.timing = operationTiming{start: start, lockWait: time.Since(start)}
+	return func() {
+		timing := cs.timing
+		cs.storageMu.Unlock()
+		cs.mu.Unlock()
+		cs.exclusive.Unlock()
+		cs.inflight.Done()
+		cs.reportTiming(op, timing)
+	}, nil
+}
+
+func (cs *chunkserver) reportTiming(op operation, timing operationTiming) {
+	cs.slowOps.report(SlowOperation{
+		Method:   op.method,
+		Chunk:    op.chunk,
+		Offset:   op.offset,
+		Length:   op.length,
+		Duration: time.Since(timing.start),
+		LockWait: timing.lockWait,
+		Storage:  timing.storage,
+	})
 }
 
 func checkInvariantSameChunks(a []apis.ChunkNum, b []apis.ChunkNum) {
@@ -53,10 +230,149 @@ func checkInvariantSameChunks(a []apis.ChunkNum, b []apis.ChunkNum) {
 	}
 }
 
-func (cs *chunkserver) ListAllChunks() ([]apis.ChunkVersion, error) {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+// Checks whether a version falls within the (inclusive) bounds passed to ListAllChunks, where AnyVersion is unbounded.
+func versionInRange(version apis.Version, minimum apis.Version, maximum apis.Version) bool {
+	if minimum != apis.AnyVersion && version < minimum {
+		return false
+	}
+	if maximum != apis.AnyVersion && version > maximum {
+		return false
+	}
+	return true
+}
+
+// Has the storage refuse versions larger than the configured chunk size as well, if it checks sizes at all; the
+// chunkserver checks every write against the same size before the storage sees it either way.
+func limitChunkSize(store storage.ChunkStorage, size uint32) {
+	storage.SetMaxChunkSize(store, size)
+}
+
+// Collects the measurements that the storage reports, if it reports any, for GetStats.
+func meterStorage(store storage.ChunkStorage) *storage.StorageMetrics {
+	metrics := &storage.StorageMetrics{}
+	if !storage.SetMetricsSink(store, metrics) {
+		return nil
+	}
+	return metrics
+}
+
+func (cs *chunkserver) GetStats() (apis.ChunkserverStats, error) {
+	release, err := cs.enter(operation{method: "GetStats"})
+	if err != nil {
+		return apis.ChunkserverStats{}, err
+	}
+	defer release()
 
+	stats := apis.ChunkserverStats{
+		StagedWrites:    uint64(len(cs.Hashes)),
+		Uptime:          time.Since(cs.started),
+		Durability:      storage.DurabilityOf(cs.Storage).String(),
+		ReadAheadHits:   cs.readAhead.hits,
+		ReadAheadMisses: cs.readAhead.misses,
+	}
+	stats.SlowOperationThresholds, stats.SlowOperations = cs.slowOps.snapshot()
+	cs.compactionStats(&stats)
+	cs.verifyStats(&stats)
+	if cs.metrics != nil {
+		stats.StorageCounters, stats.StorageLatencies = cs.metrics.Snapshot()
+	}
+	stored, err := cs.Storage.Stats()
+	if err != nil {
+		return apis.ChunkserverStats{}, err
+	}
+	stats.Chunks = stored.Chunks
+	stats.Versions = stored.Versions
+	stats.MinVersionsPerChunk = stored.VersionsPerChunk.Min
+	stats.MaxVersionsPerChunk = stored.VersionsPerChunk.Max
+	stats.MeanVersionsPerChunk = stored.VersionsPerChunk.Mean
+	stats.StoredBytes = stored.CommittedBytes
+	stats.AllocatedBytes = stored.AllocatedBytes
+	stats.OpenFiles = stored.OpenFiles
+	// kept as an upper bound, so that there is always room to grow a chunk in place; StoredBytes has the real figure
+	stats.UsedBytes = stats.Versions * uint64(cs.chunkSize)
+	for _, staged := range cs.Hashes {
+		stats.StagedBytes += uint64(len(staged.Data))
+	}
+	if reporter, ok := cs.Storage.(storage.UsageReporter); ok {
+		usage, known, err := reporter.Usage()
+		if err != nil {
+			return apis.ChunkserverStats{}, err
+		}
+		if known {
+			stats.LogicalBytes = usage.LogicalBytes
+			stats.PhysicalBytes = usage.PhysicalBytes
+		}
+	}
+	return stats, nil
+}
+
+func (cs *chunkserver) ListAllChunks(minimum apis.Version, maximum apis.Version) ([]apis.ChunkVersion, error) {
+	release, err := cs.enter(operation{method: "ListAllChunks"})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	return cs.listChunks(minimum, maximum)
+}
+
+func (cs *chunkserver) ListAllChunksWithHashes(minimum apis.Version, maximum apis.Version) ([]apis.ChunkVersionHashes, error) {
+	release, err := cs.enter(operation{method: "ListAllChunksWithHashes"})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	chunks, err := cs.listChunks(minimum, maximum)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]apis.ChunkVersionHashes, len(chunks))
+	for i, cv := range chunks {
+		hashes, err := cs.commitHashesOf(cv.Chunk, cv.Version)
+		if err != nil {
+			return nil, err
+		}
+		result[i] = apis.ChunkVersionHashes{Chunk: cv.Chunk, Version: cv.Version, Hashes: hashes}
+	}
+	return result, nil
+}
+
+func (cs *chunkserver) ListChunks(filter apis.ChunkFilter) ([]apis.ChunkVersion, error) {
+	release, err := cs.enter(operation{method: "ListChunks"})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	// the index of latest versions names every chunk, so chunks outside of the range never need to be asked about
+	var chunks []apis.ChunkNum
+	for chunk := range cs.latest {
+		if chunk >= filter.FirstChunk && (filter.LastChunk == 0 || chunk <= filter.LastChunk) {
+			chunks = append(chunks, chunk)
+		}
+	}
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i] < chunks[j]
+	})
+	var result []apis.ChunkVersion
+	for _, chunk := range chunks {
+		versions, err := cs.Storage.ListVersions(chunk)
+		if err != nil {
+			return nil, fmt.Errorf("[handle.go/LCV] %v", err)
+		}
+		// already in ascending order
+		for _, version := range versions {
+			if versionInRange(version, filter.MinVersion, filter.MaxVersion) {
+				result = append(result, apis.ChunkVersion{Chunk: chunk, Version: version})
+			}
+		}
+	}
+	return result, nil
+}
+
+// Must be called with the lock held.
+func (cs *chunkserver) listChunks(minimum apis.Version, maximum apis.Version) ([]apis.ChunkVersion, error) {
 	var result []apis.ChunkVersion
 	latestChunks, err := cs.Storage.ListChunksWithLatest()
 	if err != nil {
@@ -72,19 +388,22 @@ func (cs *chunkserver) ListAllChunks() ([]apis.ChunkVersion, error) {
 		if err != nil {
 			return nil, err
 		}
-		versionExpected, err := cs.Storage.GetLatestVersion(chunk)
+		versionExpected, err := cs.latestVersion(chunk)
 		if err != nil {
 			return nil, err
 		}
 		foundExpected := false
 		for _, version := range versions {
+			if version == versionExpected {
+				foundExpected = true
+			}
+			if !versionInRange(version, minimum, maximum) {
+				continue
+			}
 			result = append(result, struct {
 				Chunk   apis.ChunkNum
 				Version apis.Version
 			}{Chunk: chunk, Version: version})
-			if version == versionExpected {
-				foundExpected = true
-			}
 		}
 		if !foundExpected {
 			panic("violated invariant: expected latest version to be present in list of actual versions")
@@ -94,21 +413,82 @@ func (cs *chunkserver) ListAllChunks() ([]apis.ChunkVersion, error) {
 }
 
 func (cs *chunkserver) Add(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+	return cs.AddWithMode(chunk, initialData, initialVersion, apis.AddFailIfExists)
+}
 
+func (cs *chunkserver) AddWithMode(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version, mode apis.AddMode) error {
+	if mode < apis.AddFailIfExists || mode > apis.AddIgnoreIfExists {
+		return fmt.Errorf("[handle.go/AMD] unknown add mode: %d", mode)
+	}
+	release, err := cs.enter(operation{method: "Add", chunk: chunk, length: uint32(len(initialData))})
+	if err != nil {
+		return err
+	}
+	defer release()
+	cs.readAhead.invalidate(chunk)
+
+	if err := cs.checkBounds(0, uint64(len(initialData))); err != nil {
+		return err
+	}
 	versions, err := cs.Storage.ListVersions(chunk)
 	if err != nil {
 		return err
 	}
 	if len(versions) > 0 {
-		return fmt.Errorf("attempt to create duplicate chunk: %d/%d", chunk, initialVersion)
+		existing, err := cs.latestVersion(chunk)
+		if err != nil {
+			return err
+		}
+		if mode == apis.AddIgnoreIfExists {
+			return nil
+		}
+		if mode == apis.AddOverwriteSameVersion && existing == initialVersion {
+			return cs.overwriteLatest(chunk, initialData, initialVersion, versions)
+		}
+		return apis.NewError(apis.ErrChunkExists, existing, "attempt to create duplicate chunk: %d/%d when %d/%d exists",
+			chunk, initialVersion, chunk, existing)
+	}
+	if err := cs.checkReserve(len(initialData)); err != nil {
+		return err
+	}
+	return cs.addNew(chunk, initialData, initialVersion)
+}
+
+// Replaces the contents of a chunk's latest version, for AddOverwriteSameVersion. Versions newer than the latest are
+// discarded first, since they were built on the contents being replaced. Must be called with the lock held.
+func (cs *chunkserver) overwriteLatest(chunk apis.ChunkNum, data []byte, version apis.Version, versions []apis.Version) error {
+	if err := cs.checkReserve(len(data)); err != nil {
+		return err
+	}
+	oldData, releaseBuffer, err := cs.readPooled(chunk, version)
+	if err != nil {
+		return fmt.Errorf("[handle.go/OWR] %v", err)
+	}
+	defer releaseBuffer()
+	for _, ver := range versions {
+		if ver > version {
+			if err := cs.Storage.DeleteVersion(chunk, ver); err != nil {
+				return fmt.Errorf("[handle.go/OWD] %v", err)
+			}
+		}
 	}
-	err = cs.Storage.WriteVersion(chunk, initialVersion, initialData)
+	cs.forgetCommits(chunk)
+	cs.noteChange(chunk)
+	// nothing is left to be joined, so there's nothing to forget if the old contents are lost
+	_, err = cs.replaceVersion(chunk, version, oldData, data)
+	return err
+}
+
+// Must be called with the lock held, and only once it's known that no versions of this chunk exist.
+func (cs *chunkserver) addNew(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
+	if err := cs.checkTombstone(chunk, initialVersion); err != nil {
+		return err
+	}
+	err := cs.writeVersion(chunk, initialVersion, initialData)
 	if err != nil {
 		return err
 	}
-	err = cs.Storage.SetLatestVersion(chunk, initialVersion)
+	err = cs.setLatestVersion(chunk, initialVersion)
 	if err != nil {
 		err2 := cs.Storage.DeleteVersion(chunk, initialVersion)
 		if err2 != nil {
@@ -116,85 +496,237 @@ func (cs *chunkserver) Add(chunk apis.ChunkNum, initialData []byte, initialVersi
 		}
 		return err
 	}
-	return nil
+	cs.forgetCommits(chunk)
+	return cs.forgetTombstone(chunk)
 }
 
-func (cs *chunkserver) Delete(chunk apis.ChunkNum, version apis.Version) error {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-
-	if version < 0 {
-		return fmt.Errorf("deleted version was not positive: %d/%d", chunk, version)
+func (cs *chunkserver) ForceAdd(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
+	release, err := cs.enter(operation{method: "ForceAdd", chunk: chunk, length: uint32(len(initialData))})
+	if err != nil {
+		return err
 	}
+	defer release()
+	cs.readAhead.invalidate(chunk)
 
-	latest, err := cs.Storage.GetLatestVersion(chunk)
+	if err := cs.checkBounds(0, uint64(len(initialData))); err != nil {
+		return err
+	}
+	versions, err := cs.Storage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return cs.addNew(chunk, initialData, initialVersion)
+	}
+	existing, err := cs.latestVersion(chunk)
 	if err != nil {
 		return err
 	}
+	if initialVersion <= existing {
+		return apis.NewError(apis.ErrChunkExists, existing, "refusing to replace chunk %d/%d with non-newer %d/%d",
+			chunk, existing, chunk, initialVersion)
+	}
+	if err := cs.checkTombstone(chunk, initialVersion); err != nil {
+		return err
+	}
 
-	// if we delete the latest version, we also delete everything newer... and because nothing older will exist at this
-	// point, we delete everything.
-	if latest == version {
-		versions, err := cs.Storage.ListVersions(chunk)
-		if err != nil {
-			return err
-		}
-		// mark the entire chunk as able to be deleted
-		if err := cs.Storage.DeleteLatestVersion(chunk); err != nil {
-			return err
+	// the new version might collide with one that was never made latest; it has to go first
+	for _, ver := range versions {
+		if ver == initialVersion {
+			if err := cs.Storage.DeleteVersion(chunk, ver); err != nil {
+				return err
+			}
 		}
-		// then delete all versions of the chunk
-		for _, delver := range versions {
-			if err := cs.Storage.DeleteVersion(chunk, delver); err != nil {
+	}
+	// write the new version before we get rid of anything, so that we always have a complete copy of the chunk
+	if err := cs.writeVersion(chunk, initialVersion, initialData); err != nil {
+		return err
+	}
+	if err := cs.setLatestVersion(chunk, initialVersion); err != nil {
+		return err
+	}
+	cs.forgetCommits(chunk)
+	for _, ver := range versions {
+		if ver != initialVersion {
+			if err := cs.Storage.DeleteVersion(chunk, ver); err != nil {
 				return err
 			}
 		}
-	} else {
-		// just delete the single version
-		if err := cs.Storage.DeleteVersion(chunk, version); err != nil {
+	}
+	return cs.forgetTombstone(chunk)
+}
+
+func (cs *chunkserver) ForceAddChecked(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version, checksum uint32) error {
+	if actual := apis.ChunkChecksum(initialData); actual != checksum {
+		return apis.NewError(apis.ErrChecksumMismatch, 0, "data for %d/%d was damaged in transit: checksum %08x, expected %08x",
+			chunk, initialVersion, actual, checksum)
+	}
+	return cs.ForceAdd(chunk, initialData, initialVersion)
+}
+
+func (cs *chunkserver) Delete(chunk apis.ChunkNum, version apis.Version) error {
+	release, err := cs.enter(operation{method: "Delete", chunk: chunk})
+	if err != nil {
+		return err
+	}
+	defer release()
+	cs.readAhead.invalidate(chunk)
+
+	versions, err := cs.Storage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return apis.NewError(apis.ErrAlreadyDeleted, 0, "chunk already deleted: %d/%d", chunk, version)
+	}
+
+	latest, err := cs.latestVersion(chunk)
+	if err != nil {
+		return err
+	}
+	if version < latest {
+		return apis.NewError(apis.ErrWrongVersion, latest, "attempt to delete stale version %d/%d when latest is %d/%d",
+			chunk, version, chunk, latest)
+	}
+	if version > latest {
+		// just roll back this one version, which was never made the latest
+		found := false
+		for _, ver := range versions {
+			found = found || (ver == version)
+		}
+		if !found {
+			return apis.NewError(apis.ErrAlreadyDeleted, 0, "version already deleted: %d/%d", chunk, version)
+		}
+		delete(cs.commits[chunk], version)
+		return cs.Storage.DeleteVersion(chunk, version)
+	}
+
+	// deleting the latest version deletes everything: both newer versions that were never made latest, and any older
+	// versions that haven't been cleaned up yet.
+	// the tombstone goes first, so that the chunk can't come back even if we crash partway through
+	if err := cs.recordTombstone(chunk, versions[len(versions)-1]); err != nil {
+		return err
+	}
+	cs.forgetCommits(chunk)
+	// mark the entire chunk as able to be deleted
+	if err := cs.deleteLatestVersion(chunk); err != nil {
+		return err
+	}
+	// then delete all versions of the chunk
+	for _, delver := range versions {
+		if err := cs.Storage.DeleteVersion(chunk, delver); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (cs *chunkserver) Teardown() {
+func (cs *chunkserver) Shutdown(deadline time.Time) error {
+	cs.lifecycle.Lock()
+	cs.shuttingDown = true
+	if cs.verifying != nil {
+		cs.verifying()
+	}
+	cs.lifecycle.Unlock()
+	if cs.compaction != nil {
+		cs.compaction.Stop()
+	}
+
+	// no new operations can start at this point, so we only need to wait for the ones already running
+	done := make(chan struct{})
+	go func() {
+		cs.inflight.Wait()
+		close(done)
+	}()
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		return errors.New("[handle.go/SDL] timed out waiting for in-flight operations to finish")
+	}
+
 	cs.mu.Lock()
 	defer cs.mu.Unlock()
+	cs.storageMu.Lock()
+	defer cs.storageMu.Unlock()
+
+	if err := cs.Storage.Flush(); err != nil {
+		return fmt.Errorf("[handle.go/FLS] %v", err)
+	}
 
 	// wipe away any pending hashes
 	// TODO: have a way to regularly wipe away stale pending hashes
+	if len(cs.Hashes) > 0 {
+		log.Printf("discarding %d staged writes that were never committed", len(cs.Hashes))
+	}
+	for hash, staged := range cs.Hashes {
+		cs.Storage.UnstageData(len(staged.Data))
+		cs.forgetStaged(hash)
+	}
 	cs.Hashes = map[apis.CommitHash]commit{}
+	return nil
+}
+
+// Once a staged write is no longer needed, the storage can stop keeping it. This can't fail the operation that led to
+// it, because at worst the write is staged again after a restart, and takes up space until the next shutdown.
+func (cs *chunkserver) forgetStaged(hash apis.CommitHash) {
+	if keeper, ok := cs.Storage.(storage.StagedWriteKeeper); ok {
+		if err := keeper.ForgetStaged(hash); err != nil {
+			log.Printf("could not discard staged write %s: %v", hash, err)
+		}
+	}
 }
 
 // Given a chunk reference, read out part or all of a chunk.
 // If 'minimum' is AnyVersion, then whichever version the chunkserver currently has will be returned.
 // If the version of the chunk that this chunkserver has is at least the minimum version, it will be returned.
 // Otherwise, an error will be returned, along with the most recent available version.
-// The sum of offset + length must not be greater than MaxChunkSize. The number of bytes returned is always exactly
+// The sum of offset + length must not be greater than the maximum chunk size, or else ErrOutOfBounds is returned.
+// The number of bytes returned is always exactly
 // the same number of bytes requested if there is no error.
 // The version of the data actually read will be returned.
 // Fails if a copy of this chunk isn't located on this chunkserver.
 func (cs *chunkserver) Read(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, error) {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+	timing, release, err := cs.enterChunk(operation{method: "Read", chunk: chunk, offset: offset, length: length}, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer release()
 
-	if offset+length > apis.MaxChunkSize {
-		return nil, 0, errors.New("too much data")
+	if err := cs.checkBounds(offset, uint64(length)); err != nil {
+		return nil, 0, err
 	}
 
-	version, err := cs.Storage.GetLatestVersion(chunk)
+	cs.mu.Lock()
+	version, err := cs.latestVersion(chunk)
+	var result []byte
+	found := false
+	if err == nil && version >= minimum {
+		result, found = cs.readAhead.lookup(chunk, version, offset, length)
+	}
+	cs.mu.Unlock()
 	if err != nil {
 		return nil, 0, err
 	}
 	if version < minimum {
-		return nil, version, errors.New("requested newer version than was available")
+		return nil, version, apis.NewError(apis.ErrWrongVersion, version, "requested newer version than was available")
+	}
+	if found {
+		return result, version, nil
 	}
-	data, err := cs.Storage.ReadVersion(chunk, version)
+
+	var data []byte
+	var done func()
+	cs.withStorage(timing, func() {
+		data, done, err = cs.readPooled(chunk, version)
+	})
 	if err != nil {
 		return nil, version, err
 	}
-	result := make([]byte, length)
+	// a mapped read is given back to storage, so the release has to be done under the storage lock as well
+	defer cs.withStorage(timing, done)
+	result = make([]byte, length)
 	realEnd := int(offset) + int(length)
 	if realEnd > len(data) {
 		realEnd = len(data)
@@ -202,63 +734,177 @@ func (cs *chunkserver) Read(chunk apis.ChunkNum, offset uint32, length uint32, m
 	if realEnd > int(offset) {
 		copy(result, data[offset:realEnd])
 	}
+	cs.mu.Lock()
+	cs.readAhead.record(chunk, version, offset, length, data)
+	cs.mu.Unlock()
 	return result, version, nil
 }
 
 // Given a chunk reference, send data to be used for a write to this chunk.
 // This method does not actually perform a write.
-// The sum of 'offset' and 'len(data)' must not be greater than MaxChunkSize.
+// The sum of 'offset' and 'len(data)' must not be greater than the maximum chunk size, or else ErrOutOfBounds is
+// returned.
 // Fails if a copy of this chunk isn't located on this chunkserver.
+// Staged writes are keyed by their commit hash, which covers both the offset and the data. Starting a write that is
+// already staged for the same chunk, as retries and hedged writes do, does nothing, and a single CommitWrite uses it up.
+// Different writes to overlapping parts of the same chunk are staged separately, and whichever is committed first wins;
+// committing the other into the same version afterwards fails with ErrWriteConflict.
 func (cs *chunkserver) StartWrite(chunk apis.ChunkNum, offset uint32, data []byte) error {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+	release, err := cs.enter(operation{method: "StartWrite", chunk: chunk, offset: offset, length: uint32(len(data))})
+	if err != nil {
+		return err
+	}
+	defer release()
 
-	_, err := cs.Storage.GetLatestVersion(chunk)
+	if err := cs.checkBounds(offset, uint64(len(data))); err != nil {
+		return err
+	}
+
+	_, err = cs.latestVersion(chunk)
 	if err != nil {
 		return fmt.Errorf("[handle.go/GLV] %v", err)
 	}
 
-	if int(offset)+len(data) > int(apis.MaxChunkSize) {
-		return errors.New("too much data to write")
+	hash := apis.CalculateCommitHash(offset, data)
+	staged, found := cs.Hashes[hash]
+	if found && staged.Chunks[chunk] {
+		// an identical write is already waiting to be committed into this chunk
+		return nil
+	}
+	if err := cs.checkStagedLimit(chunk, len(data)); err != nil {
+		return err
+	}
+	if found {
+		// the data is already being held for another chunk, so it doesn't need to be accounted for again
+		staged.Pending += 1
+		if staged.Chunks == nil {
+			staged.Chunks = map[apis.ChunkNum]bool{}
+		}
+		staged.Chunks[chunk] = true
+		cs.Hashes[hash] = staged
+		return nil
 	}
+	if err := cs.checkReserve(len(data)); err != nil {
+		return err
+	}
+	if err := cs.Storage.StageData(len(data)); err != nil {
+		return err
+	}
+	if keeper, ok := cs.Storage.(storage.StagedWriteKeeper); ok {
+		if err := keeper.KeepStaged(storage.StagedWrite{Hash: hash, Offset: offset, Data: data}); err != nil {
+			cs.Storage.UnstageData(len(data))
+			return fmt.Errorf("[handle.go/KSW] %v", err)
+		}
+	}
+	cs.Hashes[hash] = commit{Offset: offset, Data: data, Pending: 1, Chunks: map[apis.ChunkNum]bool{chunk: true}}
 
-	cs.Hashes[apis.CalculateCommitHash(offset, data)] = struct {
-		Offset uint32
-		Data   []byte
-	}{Offset: offset, Data: data}
+	return nil
+}
 
+// Fails with ErrOutOfSpace if staging this many more bytes for a chunk would go over MaxStagedBytesPerChunk.
+func (cs *chunkserver) checkStagedLimit(chunk apis.ChunkNum, bytes int) error {
+	limit := cs.options.MaxStagedBytesPerChunk
+	if limit == 0 {
+		return nil
+	}
+	staged := 0
+	for _, write := range cs.Hashes {
+		if write.Chunks[chunk] {
+			staged += len(write.Data)
+		}
+	}
+	if staged+bytes > limit {
+		return apis.NewError(apis.ErrOutOfSpace, 0, "too much staged for chunk %d: %d staged + %d new > %d",
+			chunk, staged, bytes, limit)
+	}
 	return nil
 }
 
 // Commit a write -- persistently store it as the data for a particular version.
 // Takes existing saved data for oldVersion, apply this cached write, and saved it as newVersion.
+// If other writes have already been committed from oldVersion into newVersion, this write is applied on top of them,
+// as long as it doesn't overlap any of them; otherwise, fails with ErrWriteConflict.
+// If this exact commit has already been applied, and newVersion is still pending or is now the latest version, succeeds
+// without doing anything, so that clients can safely retry commits whose responses were lost.
+// Unless ChunkserverOptions.CommitHashVerification says otherwise, the staged data is checked against the hash first;
+// if it has been damaged, it's discarded, and this fails with ErrChecksumMismatch, so that the write can be started again.
 func (cs *chunkserver) CommitWrite(chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version, newVersion apis.Version) error {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
+	timing, release, err := cs.enterChunk(operation{method: "CommitWrite", chunk: chunk}, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+	return cs.commitWrite(timing, chunk, hash, oldVersion, newVersion)
+}
+
+// Commits several writes in turn, locking each chunk only while its commit is made. Each commit is checked on its own,
+// so a bad hash or version only fails that commit; the error returned separately is only for the batch as a whole.
+func (cs *chunkserver) CommitWriteBatch(commits []apis.CommitWriteRequest) ([]error, error) {
+	timing, release, err := cs.enterShared(operation{method: "CommitWriteBatch"})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	results := make([]error, len(commits))
+	for i, c := range commits {
+		unlock := cs.chunkLocks.lock(c.Chunk, true)
+		results[i] = cs.commitWrite(timing, c.Chunk, c.Hash, c.OldVersion, c.NewVersion)
+		unlock()
+	}
+	return results, nil
+}
 
+// Must be called with the chunk locked exclusively, and with neither the main lock nor the storage lock held. The
+// stored version is read and written without the main lock, so that operations on other chunks can carry on meanwhile;
+// the start of the write that is being committed is claimed beforehand, so that concurrent commits of the same write
+// into other chunks can't use it up as well.
+func (cs *chunkserver) commitWrite(timing *operationTiming, chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version, newVersion apis.Version) error {
 	if newVersion <= oldVersion {
 		return errors.New("cannot rewrite history")
 	}
 
-	latest, err := cs.Storage.GetLatestVersion(chunk)
+	cs.mu.Lock()
+	claim, base, joining, retried, err := cs.prepareCommit(chunk, hash, oldVersion, newVersion)
+	cs.mu.Unlock()
 	if err != nil {
 		return err
 	}
-
-	if latest != oldVersion {
-		return fmt.Errorf("attempt to write to mismatched version (%d/%d -> %d/%d) when latest is %d/%d",
-			chunk, oldVersion, chunk, newVersion, chunk, latest)
+	write := claim.write
+	if retried {
+		if claim.last {
+			cs.withStorage(timing, func() {
+				cs.Storage.UnstageData(len(write.Data))
+				cs.forgetStaged(hash)
+			})
+		}
+		return nil
 	}
 
-	write, found := cs.Hashes[hash]
-	if !found {
-		return errors.New("could not locate write by commit hash")
+	if cs.options.verifyCommit() && apis.CalculateCommitHash(write.Offset, write.Data) != hash {
+		// the staged data no longer matches what was sent, so it can never be committed; it has to be started again
+		cs.mu.Lock()
+		delete(cs.Hashes, hash)
+		cs.mu.Unlock()
+		cs.withStorage(timing, func() {
+			cs.Storage.UnstageData(len(write.Data))
+			cs.forgetStaged(hash)
+		})
+		return apis.NewError(apis.ErrChecksumMismatch, 0, "staged write %s for %d/%d was damaged after it was staged",
+			hash, chunk, newVersion)
 	}
 
-	data, err := cs.Storage.ReadVersion(chunk, oldVersion)
+	var data []byte
+	var done func()
+	cs.withStorage(timing, func() {
+		data, done, err = cs.readPooled(chunk, base)
+	})
 	if err != nil {
+		cs.mu.Lock()
+		cs.unclaimWrite(hash, claim)
+		cs.mu.Unlock()
 		return err
 	}
+	defer cs.withStorage(timing, done)
 
 	dataLen := int(write.Offset) + len(write.Data)
 	if dataLen < len(data) {
@@ -268,36 +914,221 @@ func (cs *chunkserver) CommitWrite(chunk apis.ChunkNum, hash apis.CommitHash, ol
 		panic("invariant broken: length of block should never exceed MaxChunkSize")
 	}
 
-	newData := make([]byte, dataLen)
-	copy(newData, data)
+	// storage never keeps hold of the data it's given, so this can go back to the pool once the commit is over
+	newData := chunkBuffers.Get(dataLen)
+	defer chunkBuffers.Put(newData)
+	copied := copy(newData, data)
+	for i := copied; i < dataLen; i++ {
+		newData[i] = 0
+	}
 	copy(newData[write.Offset:], write.Data)
 
-	return cs.Storage.WriteVersion(chunk, newVersion, newData)
+	unchanged := bytes.Equal(util.StripTrailingZeroes(newData), util.StripTrailingZeroes(data))
+	lost, dropped := false, false
+	cs.withStorage(timing, func() {
+		// the staged data is about to become part of a stored version, so stop counting it separately; otherwise
+		// storage that has filled up with staged writes could never make room by committing them
+		if claim.last {
+			cs.Storage.UnstageData(len(write.Data))
+		}
+		if joining {
+			if !unchanged {
+				lost, err = cs.replaceVersion(chunk, newVersion, data, newData)
+			}
+		} else if cs.options.Deduplicate && unchanged {
+			// nothing actually changed, so there's no need to store the same bytes twice
+			start := time.Now()
+			err = cs.Storage.LinkVersion(chunk, oldVersion, newVersion)
+			cs.timeStorage(start)
+		} else {
+			err = cs.writeVersion(chunk, newVersion, newData)
+		}
+		if err != nil && claim.last {
+			// leave the write staged, so that the commit can be retried, unless a commit into another chunk has
+			// taken the space that was just released
+			if err2 := cs.Storage.StageData(len(write.Data)); err2 != nil {
+				log.Printf("could not keep write %s staged after failing to commit it: %v", hash, err2)
+				cs.forgetStaged(hash)
+				dropped = true
+			}
+		}
+		if err == nil && claim.last {
+			cs.forgetStaged(hash)
+		}
+	})
+
+	cs.mu.Lock()
+	if lost {
+		// the earlier commits are gone, so they must not be joined anymore
+		delete(cs.commits[chunk], newVersion)
+	}
+	if err != nil {
+		if !dropped {
+			cs.unclaimWrite(hash, claim)
+		}
+		cs.mu.Unlock()
+		return err
+	}
+	cs.recordCommit(chunk, newVersion, hash, write)
+	cs.noteChange(chunk)
+	hashes, keep := cs.commitHashesToSave(chunk, newVersion)
+	cs.mu.Unlock()
+
+	if keep {
+		cs.withStorage(timing, func() {
+			cs.saveCommitHashes(chunk, newVersion, hashes)
+		})
+	}
+	return nil
+}
+
+// Checks a commit against the chunk's versions and the commits already made into them, and claims the start of the
+// write that it uses up. If the commit has already been applied, reports it as retried, and claims the start only if
+// the write was started again for this chunk in the meantime. Must be called with the main lock held.
+func (cs *chunkserver) prepareCommit(chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version, newVersion apis.Version) (claim claimedWrite, base apis.Version, joining bool, retried bool, err error) {
+	cs.readAhead.invalidate(chunk)
+
+	latest, err := cs.latestVersion(chunk)
+	if err != nil {
+		return claim, 0, false, false, err
+	}
+
+	if cs.alreadyApplied(chunk, hash, oldVersion, newVersion, latest) {
+		// a retry of a commit that already succeeded; if the write was started again for this chunk in the meantime,
+		// that start has nothing left to do, but one for another chunk still does
+		if write, found := cs.Hashes[hash]; found && (write.Chunks[chunk] || len(write.Chunks) == 0) {
+			claim = cs.claimWrite(chunk, hash, write)
+		}
+		return claim, 0, false, true, nil
+	}
+
+	if latest != oldVersion {
+		return claim, 0, false, false, apis.NewError(apis.ErrWrongVersion, latest,
+			"attempt to write to mismatched version (%d/%d -> %d/%d) when latest is %d/%d",
+			chunk, oldVersion, chunk, newVersion, chunk, latest)
+	}
+
+	write, found := cs.Hashes[hash]
+	if !found {
+		return claim, 0, false, false, errors.New("could not locate write by commit hash")
+	}
+
+	// if other writes have already been committed into this version, this one gets applied on top of them
+	base = oldVersion
+	commits, joining := cs.commitsTo(chunk, newVersion)
+	if joining {
+		if err := commits.check(chunk, oldVersion, newVersion, write); err != nil {
+			return claim, 0, false, false, err
+		}
+		base = newVersion
+	}
+	return cs.claimWrite(chunk, hash, write), base, joining, false, nil
+}
+
+// One pending start of a write, taken by a commit that is using it up.
+type claimedWrite struct {
+	write commit
+	// the chunk that the start was for, if it was for any chunk in particular
+	chunk    apis.ChunkNum
+	forChunk bool
+	// whether this was the last start of the write, in which case the write is no longer staged for anything else
+	last bool
+}
+
+// Drops one pending start of a write that is being committed, so that no other commit can use it up as well. If this
+// was the last one, the space for the data must be unstaged and the write forgotten by storage once the commit is done.
+// Must be called with the main lock held.
+func (cs *chunkserver) claimWrite(chunk apis.ChunkNum, hash apis.CommitHash, write commit) claimedWrite {
+	// a write can be committed into a different chunk than it was started for, since the hash doesn't name the chunk;
+	// in that case, the start for another chunk is used up instead
+	if !write.Chunks[chunk] {
+		for other := range write.Chunks {
+			chunk = other
+			break
+		}
+	}
+	claim := claimedWrite{write: write, chunk: chunk, forChunk: write.Chunks[chunk]}
+	delete(write.Chunks, chunk)
+	write.Pending -= 1
+	if write.Pending == 0 {
+		delete(cs.Hashes, hash)
+		claim.last = true
+	} else {
+		cs.Hashes[hash] = write
+	}
+	return claim
+}
+
+// Puts back a start claimed by claimWrite, after the commit failed, so that the commit can be retried. Must be called
+// with the main lock held.
+func (cs *chunkserver) unclaimWrite(hash apis.CommitHash, claim claimedWrite) {
+	write, found := cs.Hashes[hash]
+	if !found {
+		write = claim.write
+		write.Pending = 0
+		write.Chunks = nil
+	}
+	write.Pending += 1
+	if claim.forChunk {
+		if write.Chunks == nil {
+			write.Chunks = map[apis.ChunkNum]bool{}
+		}
+		write.Chunks[claim.chunk] = true
+	}
+	cs.Hashes[hash] = write
+}
+
+// Storage has no way to overwrite a version in place, so the old contents are deleted before the new ones are written.
+// If the new contents can't be written, the old ones are put back, so that earlier commits into the version aren't lost;
+// if even that fails, reports that they were lost. Must be called with the storage lock held.
+func (cs *chunkserver) replaceVersion(chunk apis.ChunkNum, version apis.Version, oldData []byte, newData []byte) (bool, error) {
+	if err := cs.Storage.DeleteVersion(chunk, version); err != nil {
+		return false, fmt.Errorf("[handle.go/RDV] %v", err)
+	}
+	if err := cs.writeVersion(chunk, version, newData); err != nil {
+		lost := false
+		if err2 := cs.writeVersion(chunk, version, oldData); err2 != nil {
+			lost = true
+			log.Printf("could not restore %d/%d after failing to update it: %v", chunk, version, err2)
+		}
+		return lost, fmt.Errorf("[handle.go/RWV] %v", err)
+	}
+	return false, nil
 }
 
 // Update the version of this chunk that will be returned to clients. (Also allowing this chunkserver to delete
 // older versions.)
 // If the specified chunk does not exist on this chunkserver, errors.
-// If the current version reported to clients is different from the oldVersion, errors.
+// If newVersion is not greater than oldVersion, errors with ErrVersionRollback.
+// If the current version reported to clients is different from the oldVersion, errors with ErrWrongVersion.
 func (cs *chunkserver) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.Version, newVersion apis.Version) error {
-	cs.mu.Lock()
-	defer cs.mu.Unlock()
-
-	if newVersion <= oldVersion {
-		return errors.New("cannot rewrite history")
+	timing, release, err := cs.enterChunk(operation{method: "UpdateLatestVersion", chunk: chunk}, true)
+	if err != nil {
+		return err
 	}
+	defer release()
 
-	latest, err := cs.Storage.GetLatestVersion(chunk)
+	cs.mu.Lock()
+	cs.readAhead.invalidate(chunk)
+	latest, err := cs.latestVersion(chunk)
+	cs.mu.Unlock()
 	if err != nil {
 		return err
 	}
+	if newVersion <= oldVersion {
+		return apis.NewError(apis.ErrVersionRollback, latest, "cannot rewrite history (%d/%d -> %d/%d)",
+			chunk, oldVersion, chunk, newVersion)
+	}
 	if latest != oldVersion {
-		return fmt.Errorf("attempt to update to mismatched version (%d/%d -> %d/%d) when latest is %d/%d",
+		return apis.NewError(apis.ErrWrongVersion, latest, "attempt to update to mismatched version (%d/%d -> %d/%d) when latest is %d/%d",
 			chunk, oldVersion, chunk, newVersion, chunk, latest)
 	}
 
 	// TODO: have an api to just check, rather than needing to iterate
-	versions, err := cs.Storage.ListVersions(chunk)
+	var versions []apis.Version
+	cs.withStorage(timing, func() {
+		versions, err = cs.Storage.ListVersions(chunk)
+	})
 	if err != nil {
 		return err
 	}
@@ -309,21 +1140,61 @@ func (cs *chunkserver) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.
 		return fmt.Errorf("no write found for version: %d/%d", chunk, newVersion)
 	}
 
-	// change the latest version
-	if err := cs.Storage.SetLatestVersion(chunk, newVersion); err != nil {
+	// change the latest version; with the chunk locked, nothing else can change it in between
+	cs.withStorage(timing, func() {
+		err = cs.Storage.SetLatestVersion(chunk, newVersion)
+	})
+	if err != nil {
 		return err
 	}
+	cs.mu.Lock()
+	cs.latest[chunk] = newVersion
+	cs.noteChange(chunk)
+	cs.promoteCommits(chunk, oldVersion, newVersion)
+	cs.mu.Unlock()
 
 	// TODO: be able to recover from a failure in here
 
 	// eliminate everything older
-	for _, ver := range versions {
-		if ver < newVersion {
-			if err := cs.Storage.DeleteVersion(chunk, ver); err != nil {
-				return err
+	cs.withStorage(timing, func() {
+		for _, ver := range versions {
+			if ver < newVersion {
+				if err = cs.Storage.DeleteVersion(chunk, ver); err != nil {
+					return
+				}
 			}
 		}
+	})
+	return err
+}
+
+// Make an already-stored version the latest version, regardless of whether it's older or newer than the current one.
+// Nothing is deleted. Only for disaster recovery.
+func (cs *chunkserver) OverrideLatestVersion(chunk apis.ChunkNum, version apis.Version) error {
+	release, err := cs.enter(operation{method: "OverrideLatestVersion", chunk: chunk})
+	if err != nil {
+		return err
 	}
+	defer release()
+	cs.readAhead.invalidate(chunk)
 
-	return nil
+	versions, err := cs.Storage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, ver := range versions {
+		found = found || (ver == version)
+	}
+	if !found {
+		return fmt.Errorf("no write found for version: %d/%d", chunk, version)
+	}
+
+	latest, err := cs.latestVersion(chunk)
+	if err != nil {
+		return err
+	}
+	log.Printf("administrative override of latest version: %d/%d -> %d/%d", chunk, latest, chunk, version)
+	cs.forgetCommits(chunk)
+	return cs.setLatestVersion(chunk, version)
 }
@@ -2,7 +2,9 @@ package control
 
 import (
 	testifyAssert "github.com/stretchr/testify/assert"
+	"sort"
 	"testing"
+	"time"
 	"zircon/apis"
 	"zircon/chunkserver/storage"
 	"zircon/util"
@@ -10,8 +12,28 @@ import (
 
 // just for the chunk part, not for the version part
 func TestChunkserverSingle(t *testing.T) {
+	testChunkserverSingle(t, ChunkserverOptions{})
+}
+
+// the same, but with chunks small enough that their limits are cheap to reach
+func TestChunkserverSingleSmallChunks(t *testing.T) {
+	testChunkserverSingle(t, ChunkserverOptions{MaxChunkSize: 4096})
+}
+
+func testChunkserverSingle(t *testing.T, options ChunkserverOptions) {
 	assert := testifyAssert.New(t)
 
+	size := options.chunkSize()
+	expose := func(chunkStorage storage.ChunkStorage) (apis.ChunkserverSingle, Teardown, error) {
+		cs, shutdown, err := ExposeChunkserverWithOptions(chunkStorage, options)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cs, func() {
+			assert.NoError(shutdown(time.Now().Add(TeardownGracePeriod)))
+		}, nil
+	}
+
 	var chunkStorage storage.ChunkStorage = nil
 	var cs apis.ChunkserverSingle = nil
 	var teardown Teardown = nil
@@ -23,16 +45,16 @@ func TestChunkserverSingle(t *testing.T) {
 
 		chunkStorage = newStorage
 
-		cs, teardown, err = ExposeChunkserver(chunkStorage)
+		cs, teardown, err = expose(chunkStorage)
 		assert.NoError(err)
 
 		defer func() {
 			if chunkStorage != nil {
-				chunkStorage.Close()
-				chunkStorage = nil
-
 				teardown()
 				cs = nil
+
+				chunkStorage.Close()
+				chunkStorage = nil
 			}
 		}()
 		run()
@@ -42,23 +64,41 @@ func TestChunkserverSingle(t *testing.T) {
 		// preserve storage, just recreate this interface.
 		teardown()
 
-		ncs, nteardown, err := ExposeChunkserver(chunkStorage)
+		ncs, nteardown, err := expose(chunkStorage)
 		assert.NoError(err)
 
 		cs, teardown = ncs, nteardown
 	}
 
 	test("empty by default", func() {
-		chunks, err := cs.ListAllChunks()
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		assert.NoError(err)
 		assert.Empty(chunks)
 	})
 
 	test("can't read uncreated", func() {
 		_, _, err := cs.Read(1, 0, 10, apis.AnyVersion)
-		assert.Error(err)
+		assert.Equal(apis.ErrChunkNotFound, apis.ErrorCodeOf(err))
 		_, _, err = cs.Read(1, 0, 10, 1)
-		assert.Error(err)
+		assert.Equal(apis.ErrChunkNotFound, apis.ErrorCodeOf(err))
+	})
+
+	test("read past the end of a short chunk", func() {
+		assert.NoError(cs.Add(1, []byte{}, 1))
+		assert.NoError(cs.Add(2, []byte("short"), 1))
+
+		data, version, err := cs.Read(1, 0, 10, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(apis.Version(1), version)
+		assert.Equal(make([]byte, 10), data)
+		data, _, err = cs.Read(2, 100, 4, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(make([]byte, 4), data)
+
+		// once deleted, it's as if the chunk was never there
+		assert.NoError(cs.Delete(2, 1))
+		_, _, err = cs.Read(2, 0, 4, apis.AnyVersion)
+		assert.Equal(apis.ErrChunkNotFound, apis.ErrorCodeOf(err))
 	})
 
 	test("can't write uncreated", func() {
@@ -69,19 +109,19 @@ func TestChunkserverSingle(t *testing.T) {
 		assert.Error(cs.UpdateLatestVersion(1, apis.AnyVersion, 1))
 
 		// ensure that chunks weren't created, despite errors
-		chunks, err := cs.ListAllChunks()
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		assert.NoError(err)
 		assert.Empty(chunks)
 	})
 
 	test("can't delete uncreated", func() {
-		assert.Error(cs.Delete(1, 1))
+		assert.Equal(apis.ErrAlreadyDeleted, apis.ErrorCodeOf(cs.Delete(1, 1)))
 	})
 
 	test("create new entry", func() {
 		assert.NoError(cs.Add(7, []byte("hello world"), 3))
 
-		chunks, err := cs.ListAllChunks()
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		assert.NoError(err)
 		assert.Equal([]apis.ChunkVersion{
 			{7, 3},
@@ -116,7 +156,7 @@ func TestChunkserverSingle(t *testing.T) {
 
 		reopen()
 
-		chunks, err := cs.ListAllChunks()
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		assert.NoError(err)
 		assert.Equal([]apis.ChunkVersion{
 			{7, 3},
@@ -131,24 +171,96 @@ func TestChunkserverSingle(t *testing.T) {
 
 	test("create new entry duplicate", func() {
 		assert.NoError(cs.Add(7, []byte("hello world"), 3))
-		assert.Error(cs.Add(7, []byte("goodbye world"), 4))
+		for _, version := range []apis.Version{2, 3, 4} {
+			err := cs.Add(7, []byte("goodbye world"), version)
+			assert.Equal(apis.ErrChunkExists, apis.ErrorCodeOf(err))
+			assert.Equal(apis.Version(3), err.(*apis.Error).Version)
+		}
 
-		chunks, err := cs.ListAllChunks()
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		assert.NoError(err)
 		assert.Equal([]apis.ChunkVersion{
 			{7, 3},
 		}, chunks)
+
+		data, _, err := cs.Read(7, 0, 11, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal("hello world", string(data))
+	})
+
+	test("force add new entry", func() {
+		assert.NoError(cs.ForceAdd(7, []byte("hello world"), 3))
+
+		data, version, err := cs.Read(7, 0, 11, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(apis.Version(3), version)
+		assert.Equal("hello world", string(data))
+	})
+
+	test("force add over older or equal entry", func() {
+		assert.NoError(cs.Add(7, []byte("hello world"), 3))
+		for _, version := range []apis.Version{2, 3} {
+			err := cs.ForceAdd(7, []byte("goodbye world"), version)
+			assert.Equal(apis.ErrChunkExists, apis.ErrorCodeOf(err))
+			assert.Equal(apis.Version(3), err.(*apis.Error).Version)
+		}
+
+		data, version, err := cs.Read(7, 0, 11, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(apis.Version(3), version)
+		assert.Equal("hello world", string(data))
+	})
+
+	test("force add over newer entry", func() {
+		assert.NoError(cs.Add(7, []byte("hello world"), 3))
+		// leave an uncommitted version lying around at exactly the version we're about to force
+		assert.NoError(cs.StartWrite(7, 0, []byte("HELLO")))
+		assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("HELLO")), 3, 5))
+
+		assert.NoError(cs.ForceAdd(7, []byte("goodbye world"), 5))
+
+		reopen()
+
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal([]apis.ChunkVersion{
+			{7, 5},
+		}, chunks)
+
+		data, version, err := cs.Read(7, 0, 13, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(apis.Version(5), version)
+		assert.Equal("goodbye world", string(data))
+	})
+
+	test("force add checks data against checksum", func() {
+		assert.NoError(cs.Add(7, []byte("hello world"), 3))
+
+		// a checksum that doesn't match means the data was damaged, and nothing gets replaced
+		err := cs.ForceAddChecked(7, []byte("goodbye world"), 5, apis.ChunkChecksum([]byte("goodbye wurld")))
+		assert.Equal(apis.ErrChecksumMismatch, apis.ErrorCodeOf(err))
+		data, version, err := cs.Read(7, 0, 11, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(apis.Version(3), version)
+		assert.Equal("hello world", string(data))
+
+		// trailing zeroes don't count towards the checksum
+		assert.NoError(cs.ForceAddChecked(7, []byte("goodbye world\x00\x00"), 5, apis.ChunkChecksum([]byte("goodbye world"))))
+		data, version, err = cs.Read(7, 0, 13, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(apis.Version(5), version)
+		assert.Equal("goodbye world", string(data))
 	})
 
 	test("delete entry", func() {
 		assert.NoError(cs.Add(7, []byte("hello world"), 3))
 
-		assert.Error(cs.Delete(7, 2))
-		assert.Error(cs.Delete(7, 4))
+		assert.Equal(apis.ErrWrongVersion, apis.ErrorCodeOf(cs.Delete(7, 2)))
+		assert.Equal(apis.ErrAlreadyDeleted, apis.ErrorCodeOf(cs.Delete(7, 4)))
 		assert.NoError(cs.Delete(7, 3))
-		assert.Error(cs.Delete(7, 3))
+		assert.Equal(apis.ErrAlreadyDeleted, apis.ErrorCodeOf(cs.Delete(7, 3)))
 
-		chunks, err := cs.ListAllChunks()
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		assert.NoError(err)
 		assert.Empty(chunks)
 
@@ -158,19 +270,46 @@ func TestChunkserverSingle(t *testing.T) {
 		assert.Empty(data)                     // no data on failure
 	})
 
+	test("delete at stale version", func() {
+		assert.NoError(cs.Add(7, []byte("hello world"), 3))
+		assert.NoError(cs.StartWrite(7, 0, []byte("HELLO")))
+		assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("HELLO")), 3, 4))
+		assert.NoError(cs.UpdateLatestVersion(7, 3, 4))
+
+		err := cs.Delete(7, 3)
+		assert.Equal(apis.ErrWrongVersion, apis.ErrorCodeOf(err))
+		assert.Equal(apis.Version(4), err.(*apis.Error).Version)
+
+		// the newer version must survive
+		data, version, err := cs.Read(7, 0, 5, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(apis.Version(4), version)
+		assert.Equal("HELLO", string(data))
+	})
+
+	test("delete twice", func() {
+		assert.NoError(cs.Add(7, []byte("hello world"), 3))
+		assert.NoError(cs.Delete(7, 3))
+		assert.Equal(apis.ErrAlreadyDeleted, apis.ErrorCodeOf(cs.Delete(7, 3)))
+
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Empty(chunks)
+	})
+
 	test("delete entry with durability", func() {
 		assert.NoError(cs.Add(7, []byte("hello world"), 3))
 
 		reopen()
 
-		assert.Error(cs.Delete(7, 2))
-		assert.Error(cs.Delete(7, 4))
+		assert.Equal(apis.ErrWrongVersion, apis.ErrorCodeOf(cs.Delete(7, 2)))
+		assert.Equal(apis.ErrAlreadyDeleted, apis.ErrorCodeOf(cs.Delete(7, 4)))
 		assert.NoError(cs.Delete(7, 3))
-		assert.Error(cs.Delete(7, 3))
+		assert.Equal(apis.ErrAlreadyDeleted, apis.ErrorCodeOf(cs.Delete(7, 3)))
 
 		reopen()
 
-		chunks, err := cs.ListAllChunks()
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		assert.NoError(err)
 		assert.Empty(chunks)
 
@@ -192,7 +331,7 @@ func TestChunkserverSingle(t *testing.T) {
 		assert.Error(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("HELL0")), 4, 5))
 		assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("Hell")), 3, 4))
 
-		chunks, err := cs.ListAllChunks()
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		assert.NoError(err)
 		assert.Equal(2, len(chunks))
 		assert.Equal(apis.ChunkNum(7), chunks[0].Chunk)
@@ -220,7 +359,7 @@ func TestChunkserverSingle(t *testing.T) {
 		assert.Error(cs.UpdateLatestVersion(7, 3, 5))
 		assert.NoError(cs.UpdateLatestVersion(7, 3, 4))
 
-		chunks, err = cs.ListAllChunks()
+		chunks, err = cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		assert.NoError(err)
 		assert.Equal([]apis.ChunkVersion{
 			{7, 4},
@@ -248,7 +387,7 @@ func TestChunkserverSingle(t *testing.T) {
 
 		reopen()
 
-		chunks, err := cs.ListAllChunks()
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		assert.NoError(err)
 		assert.Equal(2, len(chunks))
 		assert.Equal(apis.ChunkNum(7), chunks[0].Chunk)
@@ -278,7 +417,7 @@ func TestChunkserverSingle(t *testing.T) {
 
 		reopen()
 
-		chunks, err = cs.ListAllChunks()
+		chunks, err = cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		assert.NoError(err)
 		assert.Equal([]apis.ChunkVersion{
 			{7, 4},
@@ -294,21 +433,21 @@ func TestChunkserverSingle(t *testing.T) {
 	})
 
 	test("add data too large", func() {
-		test := make([]byte, apis.MaxChunkSize+1)
+		test := make([]byte, size+1)
 		assert.Error(cs.Add(7, test, 3))
 	})
 
 	test("write data too large", func() {
-		test := make([]byte, apis.MaxChunkSize)
+		test := make([]byte, size)
 		assert.NoError(cs.Add(7, test, 3))
 
-		test = make([]byte, apis.MaxChunkSize+1)
+		test = make([]byte, size+1)
 		assert.Error(cs.StartWrite(7, 0, test))
 
-		test = make([]byte, apis.MaxChunkSize)
+		test = make([]byte, size)
 		assert.Error(cs.StartWrite(7, 1, test))
 
-		test = make([]byte, apis.MaxChunkSize-1)
+		test = make([]byte, size-1)
 		assert.NoError(cs.StartWrite(7, 1, test))
 	})
 
@@ -334,10 +473,168 @@ func TestChunkserverSingle(t *testing.T) {
 
 		assert.Error(cs.UpdateLatestVersion(7, 3, 4))
 
-		chunks, err := cs.ListAllChunks()
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		assert.NoError(err)
 		assert.Equal([]apis.ChunkVersion{
 			{7, 3},
 		}, chunks)
 	})
+	test("list chunks within version range", func() {
+		assert.NoError(cs.Add(7, []byte("seven"), 3))
+		assert.NoError(cs.Add(8, []byte("eight"), 5))
+		assert.NoError(cs.Add(9, []byte("nine"), 9))
+		assert.NoError(cs.StartWrite(7, 0, []byte("SEVEN")))
+		assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("SEVEN")), 3, 6))
+
+		chunks, err := cs.ListAllChunks(4, 6)
+		assert.NoError(err)
+		sort.Slice(chunks, func(i, j int) bool {
+			return chunks[i].Chunk < chunks[j].Chunk
+		})
+		assert.Equal([]apis.ChunkVersion{
+			{7, 6},
+			{8, 5},
+		}, chunks)
+
+		chunks, err = cs.ListAllChunks(6, apis.AnyVersion)
+		assert.NoError(err)
+		sort.Slice(chunks, func(i, j int) bool {
+			return chunks[i].Chunk < chunks[j].Chunk
+		})
+		assert.Equal([]apis.ChunkVersion{
+			{7, 6},
+			{9, 9},
+		}, chunks)
+
+		chunks, err = cs.ListAllChunks(apis.AnyVersion, 3)
+		assert.NoError(err)
+		assert.Equal([]apis.ChunkVersion{
+			{7, 3},
+		}, chunks)
+
+		chunks, err = cs.ListAllChunks(10, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Empty(chunks)
+	})
+
+	test("update latest version refuses rollback", func() {
+		assert.NoError(cs.Add(7, []byte("hello world"), 3))
+		assert.NoError(cs.StartWrite(7, 0, []byte("HELLO")))
+		assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("HELLO")), 3, 4))
+		assert.NoError(cs.UpdateLatestVersion(7, 3, 4))
+
+		// back to where we were
+		err := cs.UpdateLatestVersion(7, 4, 3)
+		assert.Equal(apis.ErrVersionRollback, apis.ErrorCodeOf(err))
+		assert.Equal(apis.Version(4), err.(*apis.Error).Version)
+		// nowhere at all
+		err = cs.UpdateLatestVersion(7, 4, 4)
+		assert.Equal(apis.ErrVersionRollback, apis.ErrorCodeOf(err))
+		assert.Equal(apis.Version(4), err.(*apis.Error).Version)
+
+		_, version, err := cs.Read(7, 0, 5, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(apis.Version(4), version)
+	})
+
+	test("update latest version skipping versions", func() {
+		assert.NoError(cs.Add(7, []byte("hello world"), 3))
+		assert.NoError(cs.StartWrite(7, 0, []byte("HELLO")))
+		// versions 4 and 5 went to writes that never completed
+		assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("HELLO")), 3, 6))
+
+		// skipping past our actual latest version is not allowed
+		err := cs.UpdateLatestVersion(7, 5, 6)
+		assert.Equal(apis.ErrWrongVersion, apis.ErrorCodeOf(err))
+		assert.Equal(apis.Version(3), err.(*apis.Error).Version)
+
+		// but skipping over consumed versions is fine
+		assert.NoError(cs.UpdateLatestVersion(7, 3, 6))
+
+		data, version, err := cs.Read(7, 0, 5, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(apis.Version(6), version)
+		assert.Equal("HELLO", string(data))
+	})
+
+	test("override latest version", func() {
+		assert.NoError(cs.Add(7, []byte("hello world"), 3))
+		assert.NoError(cs.StartWrite(7, 0, []byte("HELLO")))
+		assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("HELLO")), 3, 4))
+		assert.NoError(cs.UpdateLatestVersion(7, 3, 4))
+		assert.NoError(cs.StartWrite(7, 0, []byte("JELLO")))
+		assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("JELLO")), 4, 5))
+		assert.NoError(cs.UpdateLatestVersion(7, 4, 5))
+
+		// older versions were deleted by the updates, so they can't be restored
+		assert.Error(cs.OverrideLatestVersion(7, 3))
+		assert.Error(cs.OverrideLatestVersion(7, 4))
+
+		// move forward to a version that was never made latest, and then backward again
+		assert.NoError(cs.StartWrite(7, 0, []byte("HELLO")))
+		assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("HELLO")), 5, 6))
+		assert.NoError(cs.OverrideLatestVersion(7, 6))
+		assert.NoError(cs.OverrideLatestVersion(7, 5))
+
+		data, version, err := cs.Read(7, 0, 5, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(apis.Version(5), version)
+		assert.Equal("JELLO", string(data))
+
+		// the newer version is still around, until someone deletes it
+		assert.NoError(cs.Delete(7, 6))
+		assert.NoError(cs.Delete(7, 5))
+		chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Empty(chunks)
+	})
+
+	test("stats track writes and deletes", func() {
+		stats, err := cs.GetStats()
+		assert.NoError(err)
+		assert.Equal(uint64(0), stats.Chunks)
+		assert.Equal(uint64(0), stats.Versions)
+		assert.Equal(uint64(0), stats.UsedBytes)
+		assert.Equal(uint64(0), stats.StoredBytes)
+		assert.Equal(uint64(0), stats.StagedWrites)
+		assert.Equal(uint64(0), stats.OpenFiles)
+
+		assert.NoError(cs.Add(7, []byte("hello world"), 3))
+		assert.NoError(cs.Add(8, []byte("hello world"), 3))
+		assert.NoError(cs.StartWrite(7, 0, []byte("HELLO")))
+
+		stats, err = cs.GetStats()
+		assert.NoError(err)
+		assert.Equal(uint64(2), stats.Chunks)
+		assert.Equal(uint64(2), stats.Versions)
+		assert.Equal(uint64(2*size), stats.UsedBytes)
+		assert.Equal(uint64(2*len("hello world")), stats.StoredBytes)
+		assert.Equal(uint64(1), stats.StagedWrites)
+		assert.Equal(uint64(5), stats.StagedBytes)
+
+		assert.NoError(cs.CommitWrite(7, apis.CalculateCommitHash(0, []byte("HELLO")), 3, 4))
+
+		stats, err = cs.GetStats()
+		assert.NoError(err)
+		assert.Equal(uint64(2), stats.Chunks)
+		assert.Equal(uint64(3), stats.Versions)
+		assert.Equal(uint64(1), stats.MinVersionsPerChunk)
+		assert.Equal(uint64(2), stats.MaxVersionsPerChunk)
+		assert.Equal(1.5, stats.MeanVersionsPerChunk)
+		assert.Equal(uint64(0), stats.StagedWrites)
+		assert.Equal(uint64(0), stats.StagedBytes)
+
+		assert.NoError(cs.UpdateLatestVersion(7, 3, 4))
+		assert.NoError(cs.Delete(8, 3))
+
+		stats, err = cs.GetStats()
+		assert.NoError(err)
+		assert.Equal(uint64(1), stats.Chunks)
+		assert.Equal(uint64(1), stats.Versions)
+		assert.Equal(uint64(size), stats.UsedBytes)
+		assert.Equal(uint64(len("HELLO world")), stats.StoredBytes)
+		assert.Equal(uint64(1), stats.MinVersionsPerChunk)
+		assert.Equal(uint64(1), stats.MaxVersionsPerChunk)
+		assert.True(stats.Uptime > 0)
+	})
 }
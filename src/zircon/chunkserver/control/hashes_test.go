@@ -0,0 +1,101 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func hashesByVersion(t *testing.T, cs apis.ChunkserverSingle) map[apis.ChunkVersion][]apis.CommitHash {
+	chunks, err := cs.ListAllChunksWithHashes(apis.AnyVersion, apis.AnyVersion)
+	require.NoError(t, err)
+	result := map[apis.ChunkVersion][]apis.CommitHash{}
+	for _, chunk := range chunks {
+		result[apis.ChunkVersion{Chunk: chunk.Chunk, Version: chunk.Version}] = chunk.Hashes
+	}
+	return result
+}
+
+func TestListAllChunksWithHashes(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	faulty := storage.WithFaults(mem)
+	cs, shutdown, err := ExposeChunkserverWithShutdown(faulty)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.NoError(cs.Add(1, []byte("hello world"), 1))
+	assert.NoError(cs.Add(2, []byte("second"), 4))
+	hello := apis.CalculateCommitHash(0, []byte("HELLO"))
+	world := apis.CalculateCommitHash(6, []byte("WORLD"))
+	second := apis.CalculateCommitHash(0, []byte("SECOND"))
+	assert.NoError(cs.StartWrite(1, 0, []byte("HELLO")))
+	assert.NoError(cs.StartWrite(1, 6, []byte("WORLD")))
+	assert.NoError(cs.StartWrite(2, 0, []byte("SECOND")))
+	// both writes are joined into version 2
+	assert.NoError(cs.CommitWrite(1, hello, 1, 2))
+	assert.NoError(cs.CommitWrite(1, world, 1, 2))
+	assert.NoError(cs.CommitWrite(2, second, 4, 5))
+
+	// every read from here on is counted, to make sure that listing doesn't read any chunk data
+	faulty.SetReadLatency(time.Nanosecond)
+	assert.Equal(map[apis.ChunkVersion][]apis.CommitHash{
+		{Chunk: 1, Version: 1}: nil,
+		{Chunk: 1, Version: 2}: {hello, world},
+		{Chunk: 2, Version: 4}: nil,
+		{Chunk: 2, Version: 5}: {second},
+	}, hashesByVersion(t, cs))
+	assert.Equal(0, faulty.Faults().DelayedReads)
+	faulty.SetReadLatency(0)
+
+	// the hashes stay with the version once it becomes the latest
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+	assert.Equal(map[apis.ChunkVersion][]apis.CommitHash{
+		{Chunk: 1, Version: 2}: {hello, world},
+		{Chunk: 2, Version: 4}: nil,
+		{Chunk: 2, Version: 5}: {second},
+	}, hashesByVersion(t, cs))
+
+	// and the version bounds apply as for ListAllChunks
+	chunks, err := cs.ListAllChunksWithHashes(5, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkVersionHashes{{Chunk: 2, Version: 5, Hashes: []apis.CommitHash{second}}}, chunks)
+}
+
+func TestCommitHashesSurviveRestart(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "hashes-restart-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	cs, shutdown, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+	hash := apis.CalculateCommitHash(3, []byte("data"))
+	assert.NoError(cs.Add(1, []byte{}, 1))
+	assert.NoError(cs.StartWrite(1, 3, []byte("data")))
+	assert.NoError(cs.CommitWrite(1, hash, 1, 2))
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+	assert.NoError(shutdown(time.Now().Add(time.Second)))
+	fs.Close()
+
+	fs, err = storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs, shutdown, err = ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+	assert.Equal(map[apis.ChunkVersion][]apis.CommitHash{
+		{Chunk: 1, Version: 2}: {hash},
+	}, hashesByVersion(t, cs))
+}
@@ -0,0 +1,38 @@
+package control
+
+import (
+	"zircon/apis"
+)
+
+// The latest version of every chunk is kept in memory as well as in storage, so that checking versions never needs to
+// go to storage. The index is filled in by the startup scan, and then kept up to date by every operation that sets or
+// removes a latest version; storage remains the source of truth across restarts.
+
+// Looks up the latest version of a chunk. Fails with ErrChunkNotFound if the chunk doesn't exist here.
+func (cs *chunkserver) latestVersion(chunk apis.ChunkNum) (apis.Version, error) {
+	latest, found := cs.latest[chunk]
+	if !found {
+		return 0, apis.NewError(apis.ErrChunkNotFound, 0, "no latest version for chunk %d", chunk)
+	}
+	return latest, nil
+}
+
+// Changes the latest version of a chunk, both in storage and in the index.
+func (cs *chunkserver) setLatestVersion(chunk apis.ChunkNum, version apis.Version) error {
+	if err := cs.Storage.SetLatestVersion(chunk, version); err != nil {
+		return err
+	}
+	cs.latest[chunk] = version
+	cs.noteChange(chunk)
+	return nil
+}
+
+// Removes the latest version of a chunk, both in storage and in the index.
+func (cs *chunkserver) deleteLatestVersion(chunk apis.ChunkNum) error {
+	if err := cs.Storage.DeleteLatestVersion(chunk); err != nil {
+		return err
+	}
+	delete(cs.latest, chunk)
+	cs.noteChange(chunk)
+	return nil
+}
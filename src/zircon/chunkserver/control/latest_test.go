@@ -0,0 +1,148 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// The in-memory index must always agree with what storage says.
+func assertLatestConsistent(t *testing.T, server apis.ChunkserverSingle) {
+	cs := server.(*chunkserver)
+	chunks, err := cs.Storage.ListChunksWithLatest()
+	require.NoError(t, err)
+	expected := map[apis.ChunkNum]apis.Version{}
+	for _, chunk := range chunks {
+		latest, err := cs.Storage.GetLatestVersion(chunk)
+		require.NoError(t, err)
+		expected[chunk] = latest
+	}
+	testifyAssert.Equal(t, expected, cs.latest)
+}
+
+func TestLatestVersionIndex(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "latest-index-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	cs, shutdown, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+	assertLatestConsistent(t, cs)
+
+	assert.NoError(cs.Add(1, []byte("one"), 1))
+	assert.NoError(cs.Add(2, []byte("two"), 3))
+	assert.Error(cs.Add(2, []byte("two again"), 4))
+	assertLatestConsistent(t, cs)
+
+	// a commit alone doesn't change the latest version, but making it latest does
+	assert.NoError(cs.StartWrite(1, 0, []byte("ONE")))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(0, []byte("ONE")), 1, 2))
+	assertLatestConsistent(t, cs)
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+	assert.Error(cs.UpdateLatestVersion(1, 1, 3))
+	assertLatestConsistent(t, cs)
+
+	// rolling back a version that never became latest leaves the chunk alone
+	assert.NoError(cs.StartWrite(2, 0, []byte("TWO")))
+	assert.NoError(cs.CommitWrite(2, apis.CalculateCommitHash(0, []byte("TWO")), 3, 4))
+	assert.NoError(cs.Delete(2, 4))
+	assertLatestConsistent(t, cs)
+
+	assert.NoError(cs.ForceAdd(2, []byte("forced"), 7))
+	assert.NoError(cs.ForceAdd(3, []byte("three"), 1))
+	assertLatestConsistent(t, cs)
+
+	assert.NoError(cs.Delete(3, 1))
+	assertLatestConsistent(t, cs)
+	_, _, err = cs.Read(3, 0, 5, apis.AnyVersion)
+	assert.Error(err)
+
+	assert.NoError(cs.StartWrite(2, 0, []byte("FORCED")))
+	assert.NoError(cs.CommitWrite(2, apis.CalculateCommitHash(0, []byte("FORCED")), 7, 8))
+	assert.NoError(cs.OverrideLatestVersion(2, 8))
+	assertLatestConsistent(t, cs)
+	assert.NoError(shutdown(time.Now().Add(time.Second)))
+	fs.Close()
+
+	// after a restart, the index is rebuilt from storage
+	fs, err = storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs, shutdown, err = ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+	assert.Equal(map[apis.ChunkNum]apis.Version{1: 2, 2: 8}, cs.(*chunkserver).latest)
+	assertLatestConsistent(t, cs)
+	data, version, err := cs.Read(2, 0, 6, 8)
+	assert.NoError(err)
+	assert.Equal(apis.Version(8), version)
+	assert.Equal("FORCED", string(data))
+}
+
+func BenchmarkCommitWriteFilesystem(b *testing.B) {
+	dir, err := ioutil.TempDir("", "commit-benchmark-")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(b, err)
+	defer fs.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(b, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	data := []byte("benchmark data")
+	hash := apis.CalculateCommitHash(0, data)
+	require.NoError(b, cs.Add(1, data, 1))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		version := apis.Version(i + 1)
+		if err := cs.StartWrite(1, 0, data); err != nil {
+			b.Fatal(err)
+		}
+		if err := cs.CommitWrite(1, hash, version, version+1); err != nil {
+			b.Fatal(err)
+		}
+		if err := cs.UpdateLatestVersion(1, version, version+1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Compares what each version check costs with the index, and what it used to cost by going to storage.
+func BenchmarkLatestVersionLookup(b *testing.B) {
+	dir, err := ioutil.TempDir("", "latest-benchmark-")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(b, err)
+	defer fs.Close()
+	server, shutdown, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(b, err)
+	defer shutdown(time.Now().Add(time.Second))
+	require.NoError(b, server.Add(1, []byte("data"), 1))
+	cs := server.(*chunkserver)
+
+	b.Run("index", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := cs.latestVersion(1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("storage", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := fs.GetLatestVersion(1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
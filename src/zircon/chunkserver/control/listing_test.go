@@ -0,0 +1,94 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// Counts how many chunks have had their versions listed.
+type listCountingStorage struct {
+	storage.ChunkStorage
+	listed int
+}
+
+func (l *listCountingStorage) ListVersions(chunk apis.ChunkNum) ([]apis.Version, error) {
+	l.listed += 1
+	return l.ChunkStorage.ListVersions(chunk)
+}
+
+func TestListChunksFiltered(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	counting := &listCountingStorage{ChunkStorage: mem}
+	cs, shutdown, err := ExposeChunkserverWithShutdown(counting)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	const chunkCount = 3000
+	for chunk := apis.ChunkNum(1); chunk <= chunkCount; chunk++ {
+		version := apis.Version(chunk%5) + 1
+		require.NoError(t, cs.Add(chunk, []byte("data"), version))
+		if chunk%10 == 0 {
+			// a newer version that hasn't become the latest yet
+			require.NoError(t, cs.StartWrite(chunk, 0, []byte("DATA")))
+			require.NoError(t, cs.CommitWrite(chunk, apis.CalculateCommitHash(0, []byte("DATA")), version, version+1))
+		}
+	}
+
+	everything, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+	require.NoError(t, err)
+	expect := func(filter apis.ChunkFilter) []apis.ChunkVersion {
+		var expected []apis.ChunkVersion
+		for _, cv := range everything {
+			if cv.Chunk < filter.FirstChunk || (filter.LastChunk != 0 && cv.Chunk > filter.LastChunk) {
+				continue
+			}
+			if !versionInRange(cv.Version, filter.MinVersion, filter.MaxVersion) {
+				continue
+			}
+			expected = append(expected, cv)
+		}
+		sort.Slice(expected, func(i, j int) bool {
+			if expected[i].Chunk != expected[j].Chunk {
+				return expected[i].Chunk < expected[j].Chunk
+			}
+			return expected[i].Version < expected[j].Version
+		})
+		return expected
+	}
+
+	for _, filter := range []apis.ChunkFilter{
+		{},
+		{FirstChunk: 1000, LastChunk: 1099},
+		{FirstChunk: 2990},
+		{LastChunk: 25},
+		{MaxVersion: 2},
+		{MinVersion: 5},
+		{MinVersion: 3, MaxVersion: 4},
+		{FirstChunk: 500, LastChunk: 800, MinVersion: 5, MaxVersion: 6},
+	} {
+		chunks, err := cs.ListChunks(filter)
+		assert.NoError(err)
+		assert.Equal(expect(filter), chunks, "filter: %+v", filter)
+	}
+
+	// only the chunks within the range are ever looked up
+	counting.listed = 0
+	chunks, err := cs.ListChunks(apis.ChunkFilter{FirstChunk: 1000, LastChunk: 1009, MinVersion: 5})
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkVersion{{Chunk: 1004, Version: 5}, {Chunk: 1009, Version: 5}}, chunks)
+	assert.Equal(10, counting.listed)
+
+	// a range with nothing in it
+	chunks, err = cs.ListChunks(apis.ChunkFilter{FirstChunk: chunkCount + 1})
+	assert.NoError(err)
+	assert.Empty(chunks)
+}
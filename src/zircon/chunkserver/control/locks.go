@@ -0,0 +1,113 @@
+package control
+
+import (
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+// Reads, commits, and version updates only ever touch one chunk, so they lock that chunk rather than the whole
+// chunkserver: reads of a chunk share its lock, and commits and updates of it take it exclusively. They hold the
+// exclusive lock shared while they run, and the main lock and the storage lock only for as long as they use the state
+// or the storage guarded by them, so that operations on different chunks can overlap everywhere except in storage
+// itself. Every other operation goes through enter, which takes the exclusive lock outright, along with the main lock
+// and the storage lock, and so still has the chunkserver all to itself.
+//
+// Locks are always taken in this order: exclusive, chunk, main (mu), storage (storageMu).
+
+// A reader/writer lock for each chunk that is in use, created when first needed, and dropped once nothing holds it or
+// is waiting for it.
+type chunkLocks struct {
+	mu    sync.Mutex
+	locks map[apis.ChunkNum]*chunkLock
+}
+
+type chunkLock struct {
+	sync.RWMutex
+	// guarded by chunkLocks.mu; the number of operations that hold this lock or are waiting for it
+	users int
+}
+
+func newChunkLocks() *chunkLocks {
+	return &chunkLocks{locks: map[apis.ChunkNum]*chunkLock{}}
+}
+
+// Locks a chunk, for writing if exclusive is set and for reading otherwise. The returned function unlocks it again.
+func (l *chunkLocks) lock(chunk apis.ChunkNum, exclusive bool) func() {
+	l.mu.Lock()
+	lock := l.locks[chunk]
+	if lock == nil {
+		lock = &chunkLock{}
+		l.locks[chunk] = lock
+	}
+	lock.users += 1
+	l.mu.Unlock()
+
+	if exclusive {
+		lock.Lock()
+	} else {
+		lock.RLock()
+	}
+	return func() {
+		if exclusive {
+			lock.Unlock()
+		} else {
+			lock.RUnlock()
+		}
+		l.mu.Lock()
+		lock.users -= 1
+		if lock.users == 0 {
+			delete(l.locks, chunk)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Like enter, but for an operation that only touches the chunk named by op: registers it as in-flight and locks that
+// chunk, exclusively if asked to, without taking the main lock or the storage lock. The returned timing belongs to the
+// operation, and is counted towards by withStorage.
+func (cs *chunkserver) enterChunk(op operation, exclusive bool) (*operationTiming, func(), error) {
+	timing, release, err := cs.enterShared(op)
+	if err != nil {
+		return nil, nil, err
+	}
+	unlock := cs.chunkLocks.lock(op.chunk, exclusive)
+	timing.lockWait = time.Since(timing.start)
+	return timing, func() {
+		unlock()
+		release()
+	}, nil
+}
+
+// Registers an in-flight operation and takes the exclusive lock shared, leaving the caller to lock each chunk that it
+// touches. The returned function must be called once the operation is complete, at which point the operation is
+// logged if it was slow. Fails if the chunkserver is shutting down.
+func (cs *chunkserver) enterShared(op operation) (*operationTiming, func(), error) {
+	cs.lifecycle.Lock()
+	if cs.shuttingDown {
+		cs.lifecycle.Unlock()
+		return nil, nil, apis.NewError(apis.ErrShuttingDown, 0, "chunkserver is shutting down")
+	}
+	cs.inflight.Add(1)
+	cs.lifecycle.Unlock()
+
+	start := time.Now()
+	cs.exclusive.RLock()
+	timing := &operationTiming{start: start, lockWait: time.Since(start)}
+	return timing, func() {
+		cs.exclusive.RUnlock()
+		cs.inflight.Done()
+		cs.reportTiming(op, *timing)
+	}, nil
+}
+
+// Runs fn with the storage lock held, counting the time that fn spends in storage towards timing. For operations that
+// came in through enterChunk or enterShared, and must not be called with the main lock held.
+func (cs *chunkserver) withStorage(timing *operationTiming, fn func()) {
+	cs.storageMu.Lock()
+	defer cs.storageMu.Unlock()
+	// whoever holds the storage lock owns cs.timing, so it only needs to be handed over
+	cs.timing = operationTiming{}
+	fn()
+	timing.storage += cs.timing.storage
+}
@@ -0,0 +1,136 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// Holds up every write of one chunk's versions until it is told to carry on.
+type stalledStorage struct {
+	storage.ChunkStorage
+	chunk   apis.ChunkNum
+	stalled chan struct{}
+	proceed chan struct{}
+}
+
+func (s *stalledStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	if chunk == s.chunk {
+		s.stalled <- struct{}{}
+		<-s.proceed
+	}
+	return s.ChunkStorage.WriteVersion(chunk, version, data)
+}
+
+type readResult struct {
+	data    []byte
+	version apis.Version
+	err     error
+}
+
+func readAsync(cs apis.ChunkserverSingle, chunk apis.ChunkNum, offset uint32, length uint32) chan readResult {
+	result := make(chan readResult, 1)
+	go func() {
+		data, version, err := cs.Read(chunk, offset, length, apis.AnyVersion)
+		result <- readResult{data: data, version: version, err: err}
+	}()
+	return result
+}
+
+func TestCommitOnlyHoldsUpItsOwnChunk(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	stalled := &stalledStorage{ChunkStorage: mem, stalled: make(chan struct{}), proceed: make(chan struct{})}
+	cs, shutdown, err := ExposeChunkserverWithOptions(stalled, ChunkserverOptions{ReadAheadCapacity: 4 * readAheadWindow})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	require.NoError(t, cs.Add(1, []byte("first chunk"), 1))
+	require.NoError(t, cs.Add(2, []byte("second chunk"), 1))
+	stalled.chunk = 2
+	// read front-to-back, so that the rest of the first chunk is prefetched and doesn't need storage to be read
+	for offset := uint32(0); offset < 4; offset += 2 {
+		_, _, err := cs.Read(1, offset, 2, apis.AnyVersion)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, cs.StartWrite(2, 0, []byte("SECOND")))
+	committed := make(chan error, 1)
+	go func() {
+		committed <- cs.CommitWrite(2, apis.CalculateCommitHash(0, []byte("SECOND")), 1, 2)
+	}()
+	<-stalled.stalled
+
+	// the commit is partway through writing, but only the chunk it's writing to has to wait for it
+	select {
+	case result := <-readAsync(cs, 1, 4, 5):
+		assert.NoError(result.err)
+		assert.Equal("t chu", string(result.data))
+	case <-time.After(5 * time.Second):
+		t.Error("read of another chunk was held up by a commit")
+	}
+	sameChunk := readAsync(cs, 2, 0, 6)
+	select {
+	case <-sameChunk:
+		t.Error("read of a chunk did not wait for a commit into it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(stalled.proceed)
+	assert.NoError(<-committed)
+	result := <-sameChunk
+	assert.NoError(result.err)
+	assert.Equal(apis.Version(1), result.version)
+	assert.Equal("second", string(result.data))
+
+	assert.NoError(cs.UpdateLatestVersion(2, 1, 2))
+	data, version, err := cs.Read(2, 0, 6, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), version)
+	assert.Equal("SECOND", string(data))
+}
+
+func TestConcurrentCommitsOfSameWrite(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithOptions(mem, ChunkserverOptions{})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	const chunks = 8
+	data := []byte("shared")
+	hash := apis.CalculateCommitHash(0, data)
+	for chunk := apis.ChunkNum(1); chunk <= chunks; chunk++ {
+		require.NoError(t, cs.Add(chunk, []byte("original"), 1))
+		require.NoError(t, cs.StartWrite(chunk, 0, data))
+	}
+
+	// each start is used up by exactly one commit, whichever chunk it lands in
+	errs := make(chan error, chunks)
+	for chunk := apis.ChunkNum(1); chunk <= chunks; chunk++ {
+		go func(chunk apis.ChunkNum) {
+			errs <- cs.CommitWrite(chunk, hash, 1, 2)
+		}(chunk)
+	}
+	for i := 0; i < chunks; i++ {
+		assert.NoError(<-errs)
+	}
+	for chunk := apis.ChunkNum(1); chunk <= chunks; chunk++ {
+		assert.NoError(cs.UpdateLatestVersion(chunk, 1, 2))
+		read, _, err := cs.Read(chunk, 0, 8, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal("sharedal", string(read))
+	}
+	// nothing is left staged once every start has been used up
+	assert.Error(cs.CommitWrite(1, hash, 2, 3))
+	assert.Equal(0, len(cs.(*chunkserver).Hashes))
+}
@@ -0,0 +1,160 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// Implemented by the chunkservers returned by ExposeChunkserver, for moving chunks between storage tiers.
+type Migrator interface {
+	// Move every retained version of a chunk into another tier, and then remove it from its current one. Only possible
+	// if the chunkserver's storage is a *storage.TieredStorage.
+	// The chunk stays available throughout: the lock is only held for one step of the move at a time, and Reads are
+	// served from the old tier until the new copy is complete.
+	MigrateChunk(chunk apis.ChunkNum, tier string) error
+}
+
+type migration struct {
+	tiered *storage.TieredStorage
+	chunk  apis.ChunkNum
+	tier   string
+	target storage.ChunkStorage
+	// checksums of the versions copied so far, as read from the source
+	copied map[apis.Version]uint32
+}
+
+func (cs *chunkserver) MigrateChunk(chunk apis.ChunkNum, tier string) error {
+	tiered, ok := cs.Storage.(*storage.TieredStorage)
+	if !ok {
+		return errors.New("[migrate.go/TRD] storage is not tiered")
+	}
+	target, found := tiered.Tier(tier)
+	if !found {
+		return fmt.Errorf("[migrate.go/TGT] no such tier: %s", tier)
+	}
+	m := &migration{
+		tiered: tiered,
+		chunk:  chunk,
+		tier:   tier,
+		target: target,
+		copied: map[apis.Version]uint32{},
+	}
+	for first := true; ; first = false {
+		done, err := cs.migrateStep(m, first)
+		if err != nil {
+			return fmt.Errorf("[migrate.go/MST] %v", err)
+		}
+		if done {
+			return nil
+		}
+	}
+}
+
+// Copies a single version, or finishes the move once everything has been copied. Returns whether the move is over.
+func (cs *chunkserver) migrateStep(m *migration, first bool) (bool, error) {
+	release, err := cs.enter(operation{method: "Migrate", chunk: m.chunk})
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	if m.tiered.TierOf(m.chunk) == m.tier {
+		return true, nil
+	}
+	if first {
+		// clear out anything left behind by an earlier move that didn't finish
+		if err := m.tiered.RemoveFromTier(m.chunk, m.tier); err != nil {
+			return false, err
+		}
+	}
+	versions, err := cs.Storage.ListVersions(m.chunk)
+	if err != nil {
+		return false, err
+	}
+	if len(versions) == 0 {
+		if err := m.tiered.RemoveFromTier(m.chunk, m.tier); err != nil {
+			return false, err
+		}
+		return false, apis.NewError(apis.ErrAlreadyDeleted, 0, "chunk %d was deleted during migration", m.chunk)
+	}
+	for _, version := range versions {
+		if _, copied := m.copied[version]; !copied {
+			return false, cs.copyVersion(m, version)
+		}
+	}
+	return true, cs.finishMigration(m, versions)
+}
+
+// Copies a version into the target tier, and makes sure that it reads back correctly there.
+func (cs *chunkserver) copyVersion(m *migration, version apis.Version) error {
+	data, err := cs.readVersion(m.chunk, version)
+	if err != nil {
+		return err
+	}
+	if _, copied := m.copied[version]; copied {
+		if err := m.target.DeleteVersion(m.chunk, version); err != nil {
+			return err
+		}
+		delete(m.copied, version)
+	}
+	if err := m.target.WriteVersion(m.chunk, version, data); err != nil {
+		return err
+	}
+	checksum := apis.ChunkChecksum(data)
+	readBack, err := m.target.ReadVersion(m.chunk, version)
+	if err != nil {
+		return err
+	}
+	if apis.ChunkChecksum(readBack) != checksum {
+		return fmt.Errorf("copy of %d/%d in tier %s failed checksum verification", m.chunk, version, m.tier)
+	}
+	m.copied[version] = checksum
+	return nil
+}
+
+// Brings the copy up to date with anything that changed while it was being made, and then switches over to it.
+func (cs *chunkserver) finishMigration(m *migration, versions []apis.Version) error {
+	present := map[apis.Version]bool{}
+	for _, version := range versions {
+		present[version] = true
+		data, err := cs.readVersion(m.chunk, version)
+		if err != nil {
+			return err
+		}
+		if m.copied[version] != apis.ChunkChecksum(data) {
+			if err := cs.copyVersion(m, version); err != nil {
+				return err
+			}
+		}
+	}
+	for version := range m.copied {
+		if !present[version] {
+			if err := m.target.DeleteVersion(m.chunk, version); err != nil {
+				return err
+			}
+			delete(m.copied, version)
+		}
+	}
+
+	latest, err := cs.latestVersion(m.chunk)
+	if err != nil {
+		return err
+	}
+	// a latest version marks the copy as complete, so that it wins out if we crash before the old copy is removed
+	if err := m.target.SetLatestVersion(m.chunk, latest); err != nil {
+		return err
+	}
+	source := m.tiered.TierOf(m.chunk)
+	if err := m.tiered.SwitchTier(m.chunk, m.tier); err != nil {
+		return err
+	}
+	cs.readAhead.invalidate(m.chunk)
+	if err := m.tiered.RemoveFromTier(m.chunk, source); err != nil {
+		// the move itself is complete, and the old copy will be cleaned up the next time the storage is opened
+		log.Printf("moved chunk %d to tier %s, but could not remove it from tier %s: %v", m.chunk, m.tier, source, err)
+	}
+	return nil
+}
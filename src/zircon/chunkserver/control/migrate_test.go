@@ -0,0 +1,118 @@
+package control
+
+import (
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestMigrateChunkWhileReading(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "migrate-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	tiered, err := storage.WithTiers([]storage.Tier{{Name: "fast", Storage: mem}, {Name: "slow", Storage: fs}})
+	require.NoError(t, err)
+	defer tiered.Close()
+	cs, shutdown, err := ExposeChunkserverWithOptions(tiered, ChunkserverOptions{ReadAheadCapacity: 4 * readAheadWindow})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	// several versions, so that the move takes several steps
+	assert.NoError(cs.Add(1, []byte("version one"), 1))
+	assert.NoError(cs.StartWrite(1, 8, []byte("two")))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(8, []byte("two")), 1, 2))
+	assert.NoError(cs.StartWrite(1, 8, []byte("333")))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(8, []byte("333")), 1, 3))
+	assert.NoError(cs.Add(2, []byte("unrelated"), 1))
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	failures := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				data, version, err := cs.Read(1, 0, 11, apis.AnyVersion)
+				if err == nil && (version != 1 || string(data) != "version one") {
+					err = fmt.Errorf("read wrong data: %d, %q", version, string(data))
+				}
+				if err != nil {
+					failures <- err
+					return
+				}
+			}
+		}()
+	}
+
+	migrator := cs.(Migrator)
+	for i := 0; i < 20; i++ {
+		assert.NoError(migrator.MigrateChunk(1, "slow"))
+		assert.Equal("slow", tiered.TierOf(1))
+		assert.NoError(migrator.MigrateChunk(1, "fast"))
+		assert.Equal("fast", tiered.TierOf(1))
+	}
+	assert.NoError(migrator.MigrateChunk(1, "slow"))
+	close(done)
+	wg.Wait()
+	close(failures)
+	for err := range failures {
+		assert.NoError(err)
+	}
+
+	// every version came along, and nothing was left behind
+	chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+	assert.NoError(err)
+	assert.ElementsMatch([]apis.ChunkVersion{{Chunk: 1, Version: 1}, {Chunk: 1, Version: 2}, {Chunk: 1, Version: 3}, {Chunk: 2, Version: 1}}, chunks)
+	versions, err := mem.ListVersions(1)
+	assert.NoError(err)
+	assert.Empty(versions)
+	data, err := fs.ReadVersion(1, 2)
+	assert.NoError(err)
+	assert.Equal("version two", string(data))
+	assert.Equal("fast", tiered.TierOf(2))
+
+	// and the chunk can still be updated in its new tier
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 3))
+	data, _, err = cs.Read(1, 0, 11, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("version 333", string(data))
+	latest, err := fs.GetLatestVersion(1)
+	assert.NoError(err)
+	assert.Equal(apis.Version(3), latest)
+
+	assert.Error(migrator.MigrateChunk(1, "nonexistent"))
+	assert.Error(migrator.MigrateChunk(3, "slow"))
+}
+
+func TestMigrateRequiresTiers(t *testing.T) {
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert := testifyAssert.New(t)
+	assert.NoError(cs.Add(1, []byte("data"), 1))
+	assert.Error(cs.(Migrator).MigrateChunk(1, "slow"))
+}
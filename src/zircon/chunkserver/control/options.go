@@ -0,0 +1,143 @@
+package control
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// Optional behaviors for a chunkserver. The zero value gives the default behavior.
+type ChunkserverOptions struct {
+	// When a commit leaves a chunk's contents exactly as they were, store the new version by sharing the bytes of the
+	// old one, rather than writing out a second copy.
+	Deduplicate bool
+	// Bytes of memory to use for prefetching chunks that are being read sequentially, across all chunks. Zero disables
+	// read-ahead; otherwise, it must be enough to hold at least one prefetched region.
+	ReadAheadCapacity int
+	// Bytes of storage to keep free: new chunks and writes that would leave less than this are refused with
+	// ErrOutOfSpace, so that there's still room for commits, repairs, and the bookkeeping of deletions. Only enforced if
+	// the storage is a storage.SpaceReporter.
+	ReservedSpace uint64
+	// How long to keep the tombstone of a deleted chunk if ForgetTombstone is never called for it. Zero means the
+	// default of DefaultTombstoneRetention.
+	TombstoneRetention time.Duration
+	// Most bytes of staged writes to hold for any one chunk, so that a single client can't tie up memory with writes that
+	// will never all be committed. StartWrites past the limit are refused with ErrOutOfSpace. Zero means no limit.
+	MaxStagedBytesPerChunk int
+	// How long to keep a damaged copy of a version that was replaced through ReplaceVersion, for inspection. Zero means
+	// the default of DefaultQuarantineRetention.
+	QuarantineRetention time.Duration
+	// The largest a chunk can be, in bytes. Reads, writes, and new chunks that would reach past it are refused with
+	// ErrOutOfBounds. Every chunkserver in a cluster must use the same size; see RecordChunkSize on apis.EtcdInterface.
+	// Zero means the default of apis.MaxChunkSize, which is also the most that can be configured.
+	MaxChunkSize uint32
+	// How long operations can take before they're logged as slow. Zero thresholds never log anything. Can be changed
+	// later through SetSlowOperationThresholds.
+	SlowOperationThresholds apis.SlowOperationThresholds
+	// Where slow operations are logged. Nil means LogSlowOperation.
+	SlowOperationLogger SlowOperationLogger
+	// Most versions that can be found damaged on startup, counting both what the storage set aside when it was opened
+	// and what the startup scan quarantines, before the chunkserver refuses to serve at all, on the grounds that the
+	// disk itself is failing. Zero means no limit.
+	MaxStartupDamage int
+	// Compact storage in the background, removing versions that are no longer needed and tidying up what's left, as
+	// described by storage.Compaction. Nil disables compaction.
+	Compaction *storage.CompactionOptions
+	// Whether CommitWrite recomputes the hash of each staged write before making it part of a version, and checks it
+	// against the hash that the write was staged and committed under. This costs a pass of SHA-256 over the write's
+	// data on every commit, which adds up for writes of whole chunks. Without it, a write whose data was damaged after
+	// it was staged, whether in memory or in the staging log that keeps it across restarts, is committed as if nothing
+	// were wrong: the damage becomes the latest version of the chunk, is served to readers and copied to other
+	// chunkservers, and nothing is left to catch it. Sampling only catches such damage some of the time. Only turn
+	// verification down where that risk is acceptable, such as on hardware with ECC memory and storage that checks
+	// itself. The zero value verifies every commit.
+	CommitHashVerification CommitHashVerification
+	// The fraction of commits to verify with VerifySampledCommits, greater than zero and at most one. Must be zero
+	// otherwise.
+	CommitHashSampleRate float64
+	// The storage backend to open, by the name it was registered under with storage.RegisterBackend, and the settings
+	// to open it with. Only used by OpenChunkserver; ExposeChunkserverWithOptions is handed its storage directly.
+	Backend       string
+	BackendConfig map[string]string
+}
+
+// How CommitWrite checks staged writes against their commit hashes; see ChunkserverOptions.CommitHashVerification.
+type CommitHashVerification int
+
+const (
+	// Recompute the hash of every write before committing it. The default.
+	VerifyEveryCommit CommitHashVerification = iota
+	// Never recompute the hash, trusting that staged data is never damaged.
+	VerifyNoCommits
+	// Recompute the hash of a random fraction of commits, given by CommitHashSampleRate.
+	VerifySampledCommits
+)
+
+// Rejects options that could never work as intended, rather than letting them silently do nothing.
+func (o ChunkserverOptions) Validate() error {
+	if o.ReadAheadCapacity < 0 {
+		return fmt.Errorf("read-ahead capacity cannot be negative: %d", o.ReadAheadCapacity)
+	}
+	if o.ReadAheadCapacity > 0 && o.ReadAheadCapacity < readAheadWindow {
+		return fmt.Errorf("read-ahead capacity of %d is too small to prefetch anything; must be zero or at least %d",
+			o.ReadAheadCapacity, readAheadWindow)
+	}
+	if o.MaxStagedBytesPerChunk < 0 {
+		return fmt.Errorf("staged bytes per chunk cannot be negative: %d", o.MaxStagedBytesPerChunk)
+	}
+	if o.TombstoneRetention < 0 {
+		return fmt.Errorf("tombstone retention cannot be negative: %v", o.TombstoneRetention)
+	}
+	if o.MaxStartupDamage < 0 {
+		return fmt.Errorf("startup damage limit cannot be negative: %d", o.MaxStartupDamage)
+	}
+	if o.QuarantineRetention < 0 {
+		return fmt.Errorf("quarantine retention cannot be negative: %v", o.QuarantineRetention)
+	}
+	if err := validateSlowOperationThresholds(o.SlowOperationThresholds); err != nil {
+		return err
+	}
+	if o.Compaction != nil {
+		if err := o.Compaction.Validate(); err != nil {
+			return err
+		}
+	}
+	switch o.CommitHashVerification {
+	case VerifyEveryCommit, VerifyNoCommits:
+		if o.CommitHashSampleRate != 0 {
+			return fmt.Errorf("commit hash sample rate of %v only applies when sampling commits", o.CommitHashSampleRate)
+		}
+	case VerifySampledCommits:
+		if !(o.CommitHashSampleRate > 0 && o.CommitHashSampleRate <= 1) {
+			return fmt.Errorf("commit hash sample rate must be greater than zero and at most one: %v", o.CommitHashSampleRate)
+		}
+	default:
+		return fmt.Errorf("unknown commit hash verification mode: %d", o.CommitHashVerification)
+	}
+	if o.MaxChunkSize > apis.MaxChunkSize {
+		return fmt.Errorf("maximum chunk size of %d is larger than the supported limit of %d", o.MaxChunkSize, apis.MaxChunkSize)
+	}
+	return nil
+}
+
+// The maximum chunk size, with the default filled in.
+func (o ChunkserverOptions) chunkSize() uint32 {
+	if o.MaxChunkSize == 0 {
+		return apis.MaxChunkSize
+	}
+	return o.MaxChunkSize
+}
+
+// Decides whether to recompute the hash of a write that is about to be committed.
+func (o ChunkserverOptions) verifyCommit() bool {
+	switch o.CommitHashVerification {
+	case VerifyNoCommits:
+		return false
+	case VerifySampledCommits:
+		return rand.Float64() < o.CommitHashSampleRate
+	default:
+		return true
+	}
+}
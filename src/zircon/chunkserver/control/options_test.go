@@ -0,0 +1,58 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestChunkserverOptionsValidation(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	// the defaults are always valid
+	assert.NoError(ChunkserverOptions{}.Validate())
+	assert.NoError(ChunkserverOptions{Deduplicate: true, ReadAheadCapacity: readAheadWindow, ReservedSpace: 1}.Validate())
+
+	assert.Error(ChunkserverOptions{ReadAheadCapacity: -1}.Validate())
+	// too small to ever prefetch anything
+	assert.Error(ChunkserverOptions{ReadAheadCapacity: readAheadWindow - 1}.Validate())
+	assert.Error(ChunkserverOptions{MaxStagedBytesPerChunk: -1}.Validate())
+	assert.Error(ChunkserverOptions{QuarantineRetention: -time.Second}.Validate())
+	assert.Error(ChunkserverOptions{MaxStartupDamage: -1}.Validate())
+	assert.NoError(ChunkserverOptions{Compaction: &storage.CompactionOptions{}}.Validate())
+	assert.Error(ChunkserverOptions{Compaction: &storage.CompactionOptions{BytesPerSecond: -1}}.Validate())
+	assert.NoError(ChunkserverOptions{MaxChunkSize: 1}.Validate())
+	assert.NoError(ChunkserverOptions{MaxChunkSize: apis.MaxChunkSize}.Validate())
+	assert.Error(ChunkserverOptions{MaxChunkSize: apis.MaxChunkSize + 1}.Validate())
+	assert.NoError(ChunkserverOptions{SlowOperationThresholds: apis.SlowOperationThresholds{Data: time.Second}}.Validate())
+	assert.Error(ChunkserverOptions{SlowOperationThresholds: apis.SlowOperationThresholds{Control: -time.Second}}.Validate())
+	assert.NoError(ChunkserverOptions{CommitHashVerification: VerifyNoCommits}.Validate())
+	assert.NoError(ChunkserverOptions{CommitHashVerification: VerifySampledCommits, CommitHashSampleRate: 0.1}.Validate())
+	assert.Error(ChunkserverOptions{CommitHashVerification: VerifySampledCommits}.Validate())
+	assert.Error(ChunkserverOptions{CommitHashVerification: VerifySampledCommits, CommitHashSampleRate: 1.5}.Validate())
+	// a rate that would be ignored
+	assert.Error(ChunkserverOptions{CommitHashSampleRate: 0.5}.Validate())
+	assert.Error(ChunkserverOptions{CommitHashVerification: VerifySampledCommits + 1}.Validate())
+}
+
+func TestExposeChunkserverRejectsInvalidOptions(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+
+	_, _, err = ExposeChunkserverWithOptions(mem, ChunkserverOptions{ReadAheadCapacity: 1024})
+	assert.Error(err)
+
+	// the defaults behave exactly as if no options had been given
+	cs, shutdown, err := ExposeChunkserverWithOptions(mem, ChunkserverOptions{})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+	assert.Equal(ChunkserverOptions{}, cs.(*chunkserver).options)
+	assert.Equal(0, cs.(*chunkserver).readAhead.capacity)
+	assert.NoError(cs.Add(1, []byte("hello"), 1))
+}
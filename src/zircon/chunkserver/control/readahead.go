@@ -0,0 +1,187 @@
+package control
+
+import (
+	"container/list"
+	"zircon/apis"
+)
+
+// How much of a chunk to prefetch once it is being read sequentially.
+const readAheadWindow = 256 * 1024
+
+// The most chunks whose read position is tracked at once, whether or not anything has been prefetched for them.
+const readAheadTracked = 1024
+
+type readAheadBuffer struct {
+	chunk   apis.ChunkNum
+	version apis.Version
+	// where the most recent Read of this chunk ended, so that the next one can be recognized as sequential
+	next uint32
+	// prefetched contents, starting at offset start; empty until sequential reading is detected
+	start uint32
+	data  []byte
+}
+
+// Implemented by the chunkservers returned by ExposeChunkserver, so that operators can keep critical chunks, such as hot
+// metadata blocks, from being pushed out of the read-ahead cache by everything else being read.
+type CachePinner interface {
+	// Protect whatever is prefetched for a chunk from eviction, until Unpin is called. Pinned data still counts against
+	// ReadAheadCapacity, but is only evicted once nothing unpinned is left to make room. A chunk stays pinned even
+	// while it has nothing prefetched, such as after it has been written to. Does nothing if read-ahead is disabled.
+	Pin(chunk apis.ChunkNum) error
+	// Let a chunk be evicted like any other again. Does nothing if the chunk isn't pinned.
+	Unpin(chunk apis.ChunkNum) error
+}
+
+var _ CachePinner = &chunkserver{}
+
+func (cs *chunkserver) Pin(chunk apis.ChunkNum) error {
+	release, err := cs.enter(operation{method: "Pin", chunk: chunk})
+	if err != nil {
+		return err
+	}
+	defer release()
+	cs.readAhead.pin(chunk)
+	return nil
+}
+
+func (cs *chunkserver) Unpin(chunk apis.ChunkNum) error {
+	release, err := cs.enter(operation{method: "Unpin", chunk: chunk})
+	if err != nil {
+		return err
+	}
+	defer release()
+	cs.readAhead.unpin(chunk)
+	return nil
+}
+
+// Holds prefetched regions of chunks that are being read front-to-back, so that a series of small Reads doesn't need to
+// go to storage every time. Bounded in total size, with the least recently read chunks evicted first, other than those
+// that are pinned.
+// Not threadsafe; only used with the main lock held.
+type readAheadCache struct {
+	// zero if read-ahead is disabled
+	capacity int
+	// prefetching never reaches past the end of a chunk
+	chunkSize uint32
+	used      int
+	buffers   map[apis.ChunkNum]*list.Element
+	// most recently used at the front
+	lru    *list.List
+	hits   uint64
+	misses uint64
+	// chunks whose buffers are passed over for eviction, whether or not they have one
+	pinned map[apis.ChunkNum]bool
+}
+
+func newReadAheadCache(capacity int, chunkSize uint32) *readAheadCache {
+	return &readAheadCache{
+		capacity:  capacity,
+		chunkSize: chunkSize,
+		buffers:   map[apis.ChunkNum]*list.Element{},
+		lru:       list.New(),
+		pinned:    map[apis.ChunkNum]bool{},
+	}
+}
+
+// Serves a Read from prefetched data, if all of it is available for the right version.
+func (c *readAheadCache) lookup(chunk apis.ChunkNum, version apis.Version, offset uint32, length uint32) ([]byte, bool) {
+	if c.capacity == 0 {
+		return nil, false
+	}
+	element, found := c.buffers[chunk]
+	if !found {
+		c.misses += 1
+		return nil, false
+	}
+	buffer := element.Value.(*readAheadBuffer)
+	if buffer.version != version {
+		c.remove(element)
+		c.misses += 1
+		return nil, false
+	}
+	if offset < buffer.start || uint64(offset)+uint64(length) > uint64(buffer.start)+uint64(len(buffer.data)) {
+		c.misses += 1
+		return nil, false
+	}
+	result := make([]byte, length)
+	copy(result, buffer.data[offset-buffer.start:])
+	buffer.next = offset + length
+	c.lru.MoveToFront(element)
+	c.hits += 1
+	return result, true
+}
+
+// Records a Read that had to go to storage, given the full contents of the version that was read. If the Read picked
+// up where the last one left off, prefetches the region starting at its offset.
+func (c *readAheadCache) record(chunk apis.ChunkNum, version apis.Version, offset uint32, length uint32, contents []byte) {
+	if c.capacity == 0 {
+		return
+	}
+	element, found := c.buffers[chunk]
+	if !found {
+		element = c.lru.PushFront(&readAheadBuffer{chunk: chunk, version: version})
+		c.buffers[chunk] = element
+	}
+	buffer := element.Value.(*readAheadBuffer)
+	sequential := found && buffer.version == version && buffer.next == offset
+	c.used -= len(buffer.data)
+	buffer.version, buffer.next, buffer.start, buffer.data = version, offset+length, offset, nil
+	c.lru.MoveToFront(element)
+
+	window := uint32(readAheadWindow)
+	if length > window {
+		window = length
+	}
+	if window > c.chunkSize-offset {
+		window = c.chunkSize - offset
+	}
+	if sequential && int(window) <= c.capacity {
+		// Read returns zeroes past the end of the stored data, so the buffer does too
+		buffer.data = make([]byte, window)
+		if int(offset) < len(contents) {
+			copy(buffer.data, contents[offset:])
+		}
+		c.used += len(buffer.data)
+	}
+	c.evict()
+}
+
+// Removes the least recently used buffers until the cache is back within its bounds, passing over pinned chunks. If
+// only pinned chunks are left, they're allowed to stay over the bounds.
+func (c *readAheadCache) evict() {
+	for element := c.lru.Back(); element != nil && (c.used > c.capacity || c.lru.Len() > readAheadTracked); {
+		prev := element.Prev()
+		if !c.pinned[element.Value.(*readAheadBuffer).chunk] {
+			c.remove(element)
+		}
+		element = prev
+	}
+}
+
+func (c *readAheadCache) pin(chunk apis.ChunkNum) {
+	if c.capacity == 0 {
+		return
+	}
+	c.pinned[chunk] = true
+}
+
+func (c *readAheadCache) unpin(chunk apis.ChunkNum) {
+	if c.pinned[chunk] {
+		delete(c.pinned, chunk)
+		c.evict()
+	}
+}
+
+// Forgets everything about a chunk, because its contents may be about to change.
+func (c *readAheadCache) invalidate(chunk apis.ChunkNum) {
+	if element, found := c.buffers[chunk]; found {
+		c.remove(element)
+	}
+}
+
+func (c *readAheadCache) remove(element *list.Element) {
+	buffer := element.Value.(*readAheadBuffer)
+	c.used -= len(buffer.data)
+	delete(c.buffers, buffer.chunk)
+	c.lru.Remove(element)
+}
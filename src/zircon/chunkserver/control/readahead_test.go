@@ -0,0 +1,199 @@
+package control
+
+import (
+	"bytes"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestReadAheadSequential(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithOptions(mem, ChunkserverOptions{ReadAheadCapacity: 4 * readAheadWindow})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	assert.NoError(cs.Add(1, contents, 1))
+
+	var read []byte
+	for offset := uint32(0); offset < uint32(len(contents))+64; offset += 64 {
+		data, version, err := cs.Read(1, offset, 64, apis.AnyVersion)
+		assert.NoError(err)
+		assert.Equal(apis.Version(1), version)
+		read = append(read, data...)
+	}
+	// reading past the end of the data is served from the buffer too, as zeroes
+	assert.Equal(contents, read[:len(contents)])
+	assert.Equal(make([]byte, 64), read[len(contents):])
+
+	stats, err := cs.GetStats()
+	assert.NoError(err)
+	// the first read can't be recognized as sequential, and the second one starts the prefetch
+	assert.Equal(uint64(2), stats.ReadAheadMisses)
+	assert.Equal(uint64(len(read)/64-2), stats.ReadAheadHits)
+
+	// a new version must be visible immediately, even partway through the prefetched region
+	assert.NoError(cs.StartWrite(1, 128, []byte("XYZ")))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(128, []byte("XYZ")), 1, 2))
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+	data, version, err := cs.Read(1, 128, 3, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), version)
+	assert.Equal("XYZ", string(data))
+}
+
+func TestReadAheadEviction(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := newReadAheadCache(2*readAheadWindow, apis.MaxChunkSize)
+	contents := make([]byte, apis.MaxChunkSize)
+	for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+		cache.record(chunk, 1, 0, 16, contents)
+		cache.record(chunk, 1, 16, 16, contents)
+		assert.True(cache.used <= cache.capacity)
+	}
+	// chunk 1 was the least recently used, so it made room for chunk 3
+	_, found := cache.lookup(1, 1, 32, 16)
+	assert.False(found)
+	_, found = cache.lookup(2, 1, 32, 16)
+	assert.True(found)
+	_, found = cache.lookup(3, 1, 32, 16)
+	assert.True(found)
+	assert.Equal(2*readAheadWindow, cache.used)
+
+	// a stale version is never served, and its buffer is dropped
+	_, found = cache.lookup(2, 2, 48, 16)
+	assert.False(found)
+	assert.Equal(readAheadWindow, cache.used)
+
+	cache.invalidate(3)
+	assert.Equal(0, cache.used)
+	assert.Equal(0, cache.lru.Len())
+}
+
+func TestReadAheadPinning(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := newReadAheadCache(2*readAheadWindow, apis.MaxChunkSize)
+	contents := make([]byte, apis.MaxChunkSize)
+	prefetch := func(chunk apis.ChunkNum) {
+		cache.record(chunk, 1, 0, 16, contents)
+		cache.record(chunk, 1, 16, 16, contents)
+	}
+	cache.pin(1)
+	prefetch(1)
+	// far more than fits alongside chunk 1, which is the least recently used the whole way through
+	for chunk := apis.ChunkNum(2); chunk <= 10; chunk++ {
+		prefetch(chunk)
+		assert.True(cache.used <= cache.capacity)
+	}
+	_, found := cache.lookup(1, 1, 32, 16)
+	assert.True(found)
+	_, found = cache.lookup(9, 1, 32, 16)
+	assert.False(found)
+	_, found = cache.lookup(10, 1, 32, 16)
+	assert.True(found)
+
+	// pinned chunks are only allowed over the bounds when there's nothing else left to evict
+	cache.pin(10)
+	prefetch(11)
+	_, found = cache.lookup(11, 1, 32, 16)
+	assert.False(found)
+	assert.Equal(2*readAheadWindow, cache.used)
+
+	// and once unpinned, a chunk is evicted like any other
+	cache.unpin(1)
+	prefetch(12)
+	_, found = cache.lookup(1, 1, 32, 16)
+	assert.False(found)
+	_, found = cache.lookup(10, 1, 32, 16)
+	assert.True(found)
+	_, found = cache.lookup(12, 1, 32, 16)
+	assert.True(found)
+
+	// a chunk stays pinned after its buffer is dropped by a write
+	cache.invalidate(10)
+	prefetch(10)
+	prefetch(13)
+	_, found = cache.lookup(10, 1, 32, 16)
+	assert.True(found)
+}
+
+func TestPinThroughChunkserver(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithOptions(mem, ChunkserverOptions{ReadAheadCapacity: 2 * readAheadWindow})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+	readTwice := func(chunk apis.ChunkNum) {
+		for offset := uint32(0); offset < 128; offset += 64 {
+			_, _, err := cs.Read(chunk, offset, 64, apis.AnyVersion)
+			assert.NoError(err)
+		}
+	}
+	for chunk := apis.ChunkNum(1); chunk <= 4; chunk++ {
+		assert.NoError(cs.Add(chunk, contents, 1))
+	}
+	assert.NoError(cs.(CachePinner).Pin(1))
+	for chunk := apis.ChunkNum(1); chunk <= 4; chunk++ {
+		readTwice(chunk)
+	}
+	before, err := cs.GetStats()
+	assert.NoError(err)
+	_, _, err = cs.Read(1, 128, 64, apis.AnyVersion)
+	assert.NoError(err)
+	after, err := cs.GetStats()
+	assert.NoError(err)
+	assert.Equal(before.ReadAheadHits+1, after.ReadAheadHits)
+
+	assert.NoError(cs.(CachePinner).Unpin(1))
+	assert.NoError(cs.(CachePinner).Unpin(1))
+}
+
+// Reads an entire chunk from filesystem storage in 4 KB pieces.
+func benchmarkSequentialReads(b *testing.B, capacity int) {
+	dir, err := ioutil.TempDir("", "readahead-bench-")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(b, err)
+	defer fs.Close()
+	cs, shutdown, err := ExposeChunkserverWithOptions(fs, ChunkserverOptions{ReadAheadCapacity: capacity})
+	require.NoError(b, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	const chunkSize, readSize = 1024 * 1024, 4096
+	require.NoError(b, cs.Add(1, bytes.Repeat([]byte{0x5A}, chunkSize), 1))
+	b.SetBytes(chunkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for offset := uint32(0); offset < chunkSize; offset += readSize {
+			if _, _, err := cs.Read(1, offset, readSize, apis.AnyVersion); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkSequentialReadsWithoutReadAhead(b *testing.B) {
+	benchmarkSequentialReads(b, 0)
+}
+
+func BenchmarkSequentialReadsWithReadAhead(b *testing.B) {
+	benchmarkSequentialReads(b, 4*readAheadWindow)
+}
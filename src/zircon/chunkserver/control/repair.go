@@ -0,0 +1,111 @@
+package control
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// How long a damaged copy set aside by ReplaceVersion is kept for inspection, unless ChunkserverOptions says otherwise.
+const DefaultQuarantineRetention = time.Hour
+
+// Implemented by the chunkservers returned by ExposeChunkserver, for repairing damaged chunks with good copies fetched
+// from other replicas.
+type Repairer interface {
+	// Sets the stored copy of a version aside, and stores data as that version in its place. Both happen at once, so
+	// that the version is never missing in between. Only possible if the storage is a storage.Quarantiner. The damaged
+	// copy is kept for the quarantine retention period, and then cleaned up by a later repair, if the storage is also
+	// a storage.QuarantinePurger.
+	ReplaceVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error
+}
+
+func (cs *chunkserver) quarantineRetention() time.Duration {
+	if cs.options.QuarantineRetention == 0 {
+		return DefaultQuarantineRetention
+	}
+	return cs.options.QuarantineRetention
+}
+
+func (cs *chunkserver) ReplaceVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	release, err := cs.enter(operation{method: "ReplaceVersion", chunk: chunk, length: uint32(len(data))})
+	if err != nil {
+		return err
+	}
+	defer release()
+	cs.readAhead.invalidate(chunk)
+
+	if err := cs.checkBounds(0, uint64(len(data))); err != nil {
+		return err
+	}
+	quarantiner, ok := cs.Storage.(storage.Quarantiner)
+	if !ok {
+		return fmt.Errorf("[repair.go/QRN] storage cannot quarantine %d/%d", chunk, version)
+	}
+	if purger, ok := cs.Storage.(storage.QuarantinePurger); ok {
+		// nothing depends on this succeeding, so it can wait until the next repair
+		if _, err := purger.PurgeQuarantine(time.Now().Add(-cs.quarantineRetention())); err != nil {
+			log.Printf("could not clean up quarantined versions: %v", err)
+		}
+	}
+	latest, err := cs.latestVersion(chunk)
+	if err != nil {
+		return err
+	}
+	versions, err := cs.Storage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, existing := range versions {
+		found = found || existing == version
+	}
+	if !found {
+		return fmt.Errorf("[repair.go/NVR] no copy of %d/%d to replace", chunk, version)
+	}
+
+	// the repaired copy was produced by the same commits, but quarantining may forget which those were
+	hashes, err := cs.commitHashesOf(chunk, version)
+	if err != nil {
+		return err
+	}
+	if err := quarantiner.QuarantineVersion(chunk, version); err != nil {
+		return fmt.Errorf("[repair.go/QVR] %v", err)
+	}
+	if err := cs.writeVersion(chunk, version, data); err != nil {
+		if version == latest {
+			// without its latest version, the chunk is unusable here; the replicator will copy it back from another
+			// replica, as long as it doesn't find a tombstone
+			log.Printf("dropping chunk %d, because its latest version %d could not be replaced: %v", chunk, version, err)
+			if err2 := cs.dropChunk(chunk); err2 != nil {
+				log.Printf("could not drop chunk %d: %v", chunk, err2)
+			}
+		}
+		return fmt.Errorf("[repair.go/WVR] %v", err)
+	}
+	if keeper, ok := cs.Storage.(storage.CommitHashKeeper); ok && len(hashes) > 0 {
+		if err := keeper.SetCommitHashes(chunk, version, hashes); err != nil {
+			log.Printf("could not record commit hashes for %d/%d: %v", chunk, version, err)
+		}
+	}
+	return nil
+}
+
+// Removes every trace of a chunk that can no longer be served, without leaving a tombstone behind.
+func (cs *chunkserver) dropChunk(chunk apis.ChunkNum) error {
+	if err := cs.deleteLatestVersion(chunk); err != nil {
+		return err
+	}
+	cs.forgetCommits(chunk)
+	versions, err := cs.Storage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if err := cs.Storage.DeleteVersion(chunk, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+	"zircon/util"
+)
+
+func TestReplaceVersion(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "replace-version-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer fs.Close()
+	faulty := storage.WithFaults(fs)
+	cs, shutdown, err := ExposeChunkserverWithOptions(faulty, ChunkserverOptions{QuarantineRetention: time.Millisecond})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+	repairer := cs.(Repairer)
+
+	assert.NoError(cs.Add(1, []byte("hello world"), 1))
+	hello := apis.CalculateCommitHash(0, []byte("HELLO"))
+	assert.NoError(cs.StartWrite(1, 0, []byte("HELLO")))
+	assert.NoError(cs.CommitWrite(1, hello, 1, 2))
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+
+	faulty.CorruptChunk(1, 2)
+	data, _, err := cs.Read(1, 0, 11, apis.AnyVersion)
+	assert.NoError(err)
+	assert.NotEqual("HELLO world", string(data))
+
+	assert.NoError(repairer.ReplaceVersion(1, 2, []byte("HELLO world")))
+	data, version, err := cs.Read(1, 0, 16, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), version)
+	assert.Equal("HELLO world", string(util.StripTrailingZeroes(data)))
+	// the damaged copy is set aside, and the repaired one still knows which commits produced it
+	_, err = os.Stat(dir + "/quarantine/chunk-1-2")
+	assert.NoError(err)
+	assert.Equal([]apis.CommitHash{hello}, hashesByVersion(t, cs)[apis.ChunkVersion{Chunk: 1, Version: 2}])
+
+	// there has to be something to replace
+	assert.Error(repairer.ReplaceVersion(1, 3, []byte("HELLO world")))
+	assert.Error(repairer.ReplaceVersion(2, 1, []byte("HELLO world")))
+
+	// once the retention period is over, the damaged copy is cleaned up by the next repair
+	assert.NoError(cs.Add(3, []byte("third"), 1))
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(repairer.ReplaceVersion(3, 1, []byte("third")))
+	_, err = os.Stat(dir + "/quarantine/chunk-1-2")
+	assert.True(os.IsNotExist(err))
+	_, err = os.Stat(dir + "/quarantine/chunk-3-1")
+	assert.NoError(err)
+}
+
+func TestReplaceVersionRequiresQuarantine(t *testing.T) {
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(&listCountingStorage{ChunkStorage: mem})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	require.NoError(t, cs.Add(1, []byte("hello"), 1))
+	testifyAssert.Error(t, cs.(Repairer).ReplaceVersion(1, 1, []byte("hello")))
+}
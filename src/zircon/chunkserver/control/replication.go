@@ -0,0 +1,82 @@
+package control
+
+import (
+	"zircon/apis"
+)
+
+// A chunk can change while a copy of it is on its way to another chunkserver: a commit or a new latest version can land
+// between reading the chunk and the other server storing it. Rather than hold up those writes until the transfer is
+// done, which would let one slow peer stall every client of the chunk, the writes go ahead, and the transfer is
+// abandoned with ErrReplicationSuperseded once it notices. The error carries the chunk's new latest version, so that
+// whoever asked for the transfer can start it over from there. The other server may be left holding the stale copy
+// until then, which is no worse than the copy it would have had if the transfer had finished just before the write.
+
+// Implemented by the chunkservers returned by ExposeChunkserver, so that the layers wrapping them can notice when a
+// chunk that they're sending elsewhere changes underneath them.
+type ReplicationTracker interface {
+	// Starts watching a chunk for changes, before it's read for a transfer. The returned Replication must be ended
+	// once the transfer is over, whether or not it succeeded.
+	BeginReplication(chunk apis.ChunkNum) *Replication
+}
+
+var _ ReplicationTracker = &chunkserver{}
+
+// A transfer of a chunk that's underway, as started by BeginReplication.
+type Replication struct {
+	cs         *chunkserver
+	chunk      apis.ChunkNum
+	generation uint64
+}
+
+// The transfers of a single chunk that are underway, and how many times the chunk has changed since the first of them
+// started.
+type inflightReplications struct {
+	count      int
+	generation uint64
+}
+
+func (cs *chunkserver) BeginReplication(chunk apis.ChunkNum) *Replication {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	inflight := cs.replicating[chunk]
+	if inflight == nil {
+		inflight = &inflightReplications{}
+		cs.replicating[chunk] = inflight
+	}
+	inflight.count += 1
+	return &Replication{cs: cs, chunk: chunk, generation: inflight.generation}
+}
+
+// Fails with ErrReplicationSuperseded if the chunk has been committed into, or has had its latest version changed or
+// removed, since the replication began. The error carries the latest version, or zero if the chunk was deleted.
+func (r *Replication) Check() error {
+	cs := r.cs
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.replicating[r.chunk].generation == r.generation {
+		return nil
+	}
+	latest := cs.latest[r.chunk]
+	return apis.NewError(apis.ErrReplicationSuperseded, latest,
+		"chunk %d changed while being replicated; latest version is now %d", r.chunk, latest)
+}
+
+// Stops watching the chunk for this replication. Must be called exactly once.
+func (r *Replication) End() {
+	cs := r.cs
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	inflight := cs.replicating[r.chunk]
+	inflight.count -= 1
+	if inflight.count == 0 {
+		delete(cs.replicating, r.chunk)
+	}
+}
+
+// Supersedes any replications of a chunk that are underway. Must be called with the lock held, by everything that
+// changes what a transfer of the chunk would send.
+func (cs *chunkserver) noteChange(chunk apis.ChunkNum) {
+	if inflight := cs.replicating[chunk]; inflight != nil {
+		inflight.generation += 1
+	}
+}
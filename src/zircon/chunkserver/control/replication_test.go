@@ -0,0 +1,106 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestReplicationSuperseded(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+	tracker := cs.(ReplicationTracker)
+
+	require.NoError(t, cs.Add(1, []byte("hello world"), 1))
+	require.NoError(t, cs.Add(2, []byte("elsewhere"), 1))
+
+	// changes made before the replication began, or made to other chunks, don't matter
+	require.NoError(t, cs.StartWrite(1, 0, []byte("HELLO")))
+	require.NoError(t, cs.CommitWrite(1, apis.CalculateCommitHash(0, []byte("HELLO")), 1, 2))
+	replication := tracker.BeginReplication(1)
+	require.NoError(t, cs.StartWrite(2, 0, []byte("ELSE")))
+	require.NoError(t, cs.CommitWrite(2, apis.CalculateCommitHash(0, []byte("ELSE")), 1, 2))
+	require.NoError(t, cs.UpdateLatestVersion(2, 1, 2))
+	assert.NoError(replication.Check())
+
+	// but a new latest version supersedes it, and says where to start over
+	require.NoError(t, cs.UpdateLatestVersion(1, 1, 2))
+	err = replication.Check()
+	assert.Equal(apis.ErrReplicationSuperseded, apis.ErrorCodeOf(err))
+	assert.Equal(apis.Version(2), err.(*apis.Error).Version)
+	replication.End()
+
+	// as does a commit, even though the latest version stays the same, and so does deleting the chunk
+	first := tracker.BeginReplication(1)
+	second := tracker.BeginReplication(1)
+	require.NoError(t, cs.StartWrite(1, 6, []byte("there")))
+	require.NoError(t, cs.CommitWrite(1, apis.CalculateCommitHash(6, []byte("there")), 2, 3))
+	err = first.Check()
+	assert.Equal(apis.ErrReplicationSuperseded, apis.ErrorCodeOf(err))
+	assert.Equal(apis.Version(2), err.(*apis.Error).Version)
+	first.End()
+	require.NoError(t, cs.Delete(1, 2))
+	err = second.Check()
+	assert.Equal(apis.ErrReplicationSuperseded, apis.ErrorCodeOf(err))
+	assert.Equal(apis.Version(0), err.(*apis.Error).Version)
+	second.End()
+
+	// nothing is left behind once every replication is over
+	assert.Empty(cs.(*chunkserver).replicating)
+}
+
+func TestReplicationSupersededDuringSlowRead(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	faulty := storage.WithFaults(mem)
+	cs, shutdown, err := ExposeChunkserverWithShutdown(faulty)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+	tracker := cs.(ReplicationTracker)
+
+	require.NoError(t, cs.Add(1, []byte("hello world"), 1))
+	require.NoError(t, cs.StartWrite(1, 0, []byte("HELLO")))
+
+	// a replication that's still reading the chunk when a commit comes in
+	faulty.SetReadLatency(100 * time.Millisecond)
+	replication := tracker.BeginReplication(1)
+	defer replication.End()
+	var sent []byte
+	done := whileRunning(func() {
+		data, version, err := cs.Read(1, 0, 11, 1)
+		assert.NoError(err)
+		assert.Equal(apis.Version(1), version)
+		sent = data
+	})
+	require.NoError(t, cs.CommitWrite(1, apis.CalculateCommitHash(0, []byte("HELLO")), 1, 2))
+	require.NoError(t, cs.UpdateLatestVersion(1, 1, 2))
+	<-done
+
+	// got the old data, so it must not be passed off as a finished replication
+	assert.Equal("hello world", string(sent))
+	err = replication.Check()
+	assert.Equal(apis.ErrReplicationSuperseded, apis.ErrorCodeOf(err))
+	assert.Equal(apis.Version(2), err.(*apis.Error).Version)
+
+	// starting over picks up the new version, which stays good as long as nothing else changes
+	faulty.SetReadLatency(0)
+	restarted := tracker.BeginReplication(1)
+	defer restarted.End()
+	data, version, err := cs.Read(1, 0, 11, 2)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), version)
+	assert.Equal("HELLO world", string(data))
+	assert.NoError(restarted.Check())
+}
@@ -0,0 +1,31 @@
+package control
+
+import (
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// Fails with ErrOutOfSpace if taking on this many more bytes would eat into the reserved space. Only new data is held
+// to this: operations that work with data already on the chunkserver, such as CommitWrite, ForceAdd for repairs, and
+// Delete, are allowed into the reserve.
+func (cs *chunkserver) checkReserve(bytes int) error {
+	if cs.options.ReservedSpace == 0 {
+		return nil
+	}
+	reporter, ok := cs.Storage.(storage.SpaceReporter)
+	if !ok {
+		return nil
+	}
+	space, known, err := reporter.Space()
+	if err != nil {
+		return err
+	}
+	if !known {
+		return nil
+	}
+	if space.UsedBytes+uint64(bytes)+cs.options.ReservedSpace > space.TotalBytes {
+		return apis.NewError(apis.ErrOutOfSpace, 0, "storage is nearly full: %d used + %d new would leave less than the %d reserved of %d",
+			space.UsedBytes, bytes, cs.options.ReservedSpace, space.TotalBytes)
+	}
+	return nil
+}
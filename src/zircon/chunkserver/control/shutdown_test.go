@@ -0,0 +1,99 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync/atomic"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// A storage backend with slow writes, so that shutdown can be tested while a write is still in progress.
+type slowStorage struct {
+	storage.ChunkStorage
+	delay   time.Duration
+	flushes int32
+}
+
+func (s *slowStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	time.Sleep(s.delay)
+	return s.ChunkStorage.WriteVersion(chunk, version, data)
+}
+
+func (s *slowStorage) Flush() error {
+	atomic.AddInt32(&s.flushes, 1)
+	return s.ChunkStorage.Flush()
+}
+
+func TestShutdownDuringSlowWrite(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	slow := &slowStorage{ChunkStorage: mem}
+
+	cs, shutdown, err := ExposeChunkserverWithShutdown(slow)
+	require.NoError(t, err)
+
+	require.NoError(t, cs.Add(71, []byte("hello, world!"), 1))
+	require.NoError(t, cs.StartWrite(71, 0, []byte("HELLO")))
+
+	slow.delay = 200 * time.Millisecond
+	writeErr := make(chan error)
+	go func() {
+		writeErr <- cs.CommitWrite(71, apis.CalculateCommitHash(0, []byte("HELLO")), 1, 2)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	assert.NoError(shutdown(time.Now().Add(5 * time.Second)))
+	assert.Equal(int32(1), atomic.LoadInt32(&slow.flushes))
+
+	err = <-writeErr
+	versions, lerr := mem.ListVersions(71)
+	assert.NoError(lerr)
+	if err == nil {
+		// completed durably
+		assert.Equal([]apis.Version{1, 2}, versions)
+		data, rerr := mem.ReadVersion(71, 2)
+		assert.NoError(rerr)
+		assert.Equal("HELLO, world!", string(data))
+	} else {
+		// cleanly rejected
+		assert.Equal(apis.ErrShuttingDown, apis.ErrorCodeOf(err))
+		assert.Equal([]apis.Version{1}, versions)
+	}
+
+	// no further operations are accepted
+	_, _, err = cs.Read(71, 0, 5, apis.AnyVersion)
+	assert.Equal(apis.ErrShuttingDown, apis.ErrorCodeOf(err))
+	assert.Equal(apis.ErrShuttingDown, apis.ErrorCodeOf(cs.StartWrite(71, 0, []byte("AGAIN"))))
+}
+
+func TestShutdownDeadlineExceeded(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	slow := &slowStorage{ChunkStorage: mem, delay: 300 * time.Millisecond}
+
+	cs, shutdown, err := ExposeChunkserverWithShutdown(slow)
+	require.NoError(t, err)
+
+	addErr := make(chan error)
+	go func() {
+		addErr <- cs.Add(71, []byte("hello, world!"), 1)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	assert.Error(shutdown(time.Now().Add(10 * time.Millisecond)))
+	assert.Equal(int32(0), atomic.LoadInt32(&slow.flushes))
+
+	// the in-flight operation is still allowed to finish
+	assert.NoError(<-addErr)
+	assert.NoError(shutdown(time.Now().Add(time.Second)))
+	assert.Equal(int32(1), atomic.LoadInt32(&slow.flushes))
+}
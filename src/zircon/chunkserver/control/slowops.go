@@ -0,0 +1,156 @@
+package control
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+// An operation that took longer than its threshold, along with where the time went. Offset and Length are zero for
+// operations that don't cover a particular range of a chunk, and Chunk is zero for operations that aren't about a
+// particular chunk.
+type SlowOperation struct {
+	Method   string
+	Chunk    apis.ChunkNum
+	Offset   uint32
+	Length   uint32
+	Duration time.Duration
+	// Time spent waiting for the chunkserver lock, behind other operations
+	LockWait time.Duration
+	// Time spent reading and writing chunk data in storage
+	Storage time.Duration
+	// Time spent forwarding data to other chunkservers
+	Replication time.Duration
+}
+
+func (op SlowOperation) String() string {
+	return fmt.Sprintf("slow %s of chunk %d [%d+%d] took %v (lock wait %v, storage %v, replication %v)",
+		op.Method, op.Chunk, op.Offset, op.Length, op.Duration, op.LockWait, op.Storage, op.Replication)
+}
+
+// Called once for every operation that takes longer than its threshold. Must be safe to call concurrently.
+type SlowOperationLogger func(op SlowOperation)
+
+// A SlowOperationLogger that writes each slow operation to the standard logger.
+func LogSlowOperation(op SlowOperation) {
+	log.Printf("%v", op)
+}
+
+// Implemented by chunkservers from this package, so that the layers wrapping them can report operations that they
+// handle partly on their own, such as StartWriteReplicated.
+type SlowOperationReporter interface {
+	// Logs an operation if it took longer than the threshold for its method.
+	ReportOperation(op SlowOperation)
+}
+
+var _ SlowOperationReporter = &chunkserver{}
+
+// The operations that read or write chunk data; anything else is a control operation.
+var dataMethods = map[string]bool{
+	"Read": true, "StartWrite": true, "StartWriteReplicated": true, "CommitWrite": true, "CommitWriteBatch": true,
+	"Add": true, "ForceAdd": true, "ForceAddChecked": true,
+}
+
+// What an operation is working on, as passed to enter, so that it can be described if it turns out to be slow.
+type operation struct {
+	method string
+	chunk  apis.ChunkNum
+	offset uint32
+	length uint32
+}
+
+// The time taken so far by the operation that holds the chunkserver lock.
+type operationTiming struct {
+	start    time.Time
+	lockWait time.Duration
+	storage  time.Duration
+}
+
+// Keeps the slow operation thresholds, which can be changed at any time, separately from the main lock, so that
+// changing them never has to wait behind a slow operation.
+type slowOperations struct {
+	mu         sync.Mutex
+	thresholds apis.SlowOperationThresholds
+	count      uint64
+	logger     SlowOperationLogger
+}
+
+func newSlowOperations(options ChunkserverOptions) *slowOperations {
+	logger := options.SlowOperationLogger
+	if logger == nil {
+		logger = LogSlowOperation
+	}
+	return &slowOperations{
+		thresholds: options.SlowOperationThresholds,
+		logger:     logger,
+	}
+}
+
+func (s *slowOperations) report(op SlowOperation) {
+	s.mu.Lock()
+	threshold := s.thresholds.Control
+	if dataMethods[op.Method] {
+		threshold = s.thresholds.Data
+	}
+	slow := threshold > 0 && op.Duration > threshold
+	if slow {
+		s.count += 1
+	}
+	s.mu.Unlock()
+	// logged without the lock held, so that a slow logger only holds up the operation that it's logging
+	if slow {
+		s.logger(op)
+	}
+}
+
+func (s *slowOperations) set(thresholds apis.SlowOperationThresholds) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.thresholds = thresholds
+}
+
+func (s *slowOperations) snapshot() (apis.SlowOperationThresholds, uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.thresholds, s.count
+}
+
+func validateSlowOperationThresholds(thresholds apis.SlowOperationThresholds) error {
+	if thresholds.Data < 0 || thresholds.Control < 0 {
+		return fmt.Errorf("slow operation thresholds cannot be negative: %v", thresholds)
+	}
+	return nil
+}
+
+// Counts time since start as spent in storage, for the operation in progress. Must be called with the storage lock held.
+func (cs *chunkserver) timeStorage(start time.Time) {
+	cs.timing.storage += time.Since(start)
+}
+
+// Like Storage.ReadVersion, but counts the time taken towards the operation in progress. Must be called with the storage
+// lock held.
+func (cs *chunkserver) readVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
+	defer cs.timeStorage(time.Now())
+	return cs.Storage.ReadVersion(chunk, version)
+}
+
+// Like Storage.WriteVersion, but counts the time taken towards the operation in progress. Must be called with the storage
+// lock held.
+func (cs *chunkserver) writeVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	defer cs.timeStorage(time.Now())
+	return cs.Storage.WriteVersion(chunk, version, data)
+}
+
+func (cs *chunkserver) ReportOperation(op SlowOperation) {
+	cs.slowOps.report(op)
+}
+
+func (cs *chunkserver) SetSlowOperationThresholds(thresholds apis.SlowOperationThresholds) error {
+	if err := validateSlowOperationThresholds(thresholds); err != nil {
+		return fmt.Errorf("[slowops.go/SST] %v", err)
+	}
+	cs.slowOps.set(thresholds)
+	return nil
+}
@@ -0,0 +1,122 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// Collects slow operations instead of logging them.
+type slowOperationLog struct {
+	mu  sync.Mutex
+	ops []SlowOperation
+}
+
+func (l *slowOperationLog) log(op SlowOperation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ops = append(l.ops, op)
+}
+
+// Returns everything logged since the last call, ordered by method, since operations that run at the same time can
+// finish in either order.
+func (l *slowOperationLog) take() []SlowOperation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ops := l.ops
+	l.ops = nil
+	sort.Slice(ops, func(i, j int) bool {
+		return ops[i].Method < ops[j].Method
+	})
+	return ops
+}
+
+// Runs an operation in the background, and waits long enough for it to have taken the lock.
+func whileRunning(operation func()) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		operation()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	return done
+}
+
+func TestSlowOperationLog(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	slow := &slowStorage{ChunkStorage: mem}
+	logged := &slowOperationLog{}
+	const threshold = 50 * time.Millisecond
+	cs, shutdown, err := ExposeChunkserverWithOptions(slow, ChunkserverOptions{
+		SlowOperationThresholds: apis.SlowOperationThresholds{Data: threshold, Control: threshold},
+		SlowOperationLogger:     logged.log,
+	})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	// fast operations aren't logged
+	require.NoError(t, cs.Add(1, []byte("fast"), 1))
+	_, _, err = cs.Read(1, 0, 4, 1)
+	require.NoError(t, err)
+	_, err = cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+	require.NoError(t, err)
+	assert.Empty(logged.take())
+
+	// a slow write is logged, with the time taken by storage
+	slow.delay = 100 * time.Millisecond
+	require.NoError(t, cs.Add(2, []byte("slow write"), 1))
+	ops := logged.take()
+	require.Equal(t, 1, len(ops))
+	assert.Equal("Add", ops[0].Method)
+	assert.Equal(apis.ChunkNum(2), ops[0].Chunk)
+	assert.Equal(uint32(len("slow write")), ops[0].Length)
+	assert.True(ops[0].Storage >= slow.delay)
+	assert.True(ops[0].Duration >= ops[0].Storage)
+	assert.True(ops[0].LockWait < threshold)
+
+	// a fast read stuck behind a slow write is logged too, with the time spent waiting for the lock
+	done := whileRunning(func() {
+		assert.NoError(cs.Add(3, []byte("slow write"), 1))
+	})
+	_, _, err = cs.Read(1, 0, 4, 1)
+	require.NoError(t, err)
+	<-done
+	ops = logged.take()
+	require.Equal(t, 2, len(ops))
+	assert.Equal("Add", ops[0].Method)
+	assert.Equal(apis.ChunkNum(3), ops[0].Chunk)
+	assert.Equal("Read", ops[1].Method)
+	assert.Equal(apis.ChunkNum(1), ops[1].Chunk)
+	assert.Equal(uint32(0), ops[1].Offset)
+	assert.Equal(uint32(4), ops[1].Length)
+	assert.True(ops[1].LockWait >= threshold)
+	assert.True(ops[1].Storage < threshold)
+
+	// thresholds can be changed while running, separately for data and control operations
+	assert.Error(cs.SetSlowOperationThresholds(apis.SlowOperationThresholds{Data: -time.Second}))
+	require.NoError(t, cs.SetSlowOperationThresholds(apis.SlowOperationThresholds{Control: threshold}))
+	done = whileRunning(func() {
+		assert.NoError(cs.Add(4, []byte("slow write"), 1))
+	})
+	_, err = cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+	require.NoError(t, err)
+	<-done
+	ops = logged.take()
+	require.Equal(t, 1, len(ops))
+	assert.Equal("ListAllChunks", ops[0].Method)
+	assert.True(ops[0].LockWait >= threshold)
+
+	stats, err := cs.GetStats()
+	require.NoError(t, err)
+	assert.Equal(apis.SlowOperationThresholds{Control: threshold}, stats.SlowOperationThresholds)
+	assert.Equal(uint64(4), stats.SlowOperations)
+}
@@ -0,0 +1,189 @@
+package control
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// How often to log progress while scanning storage on startup.
+const recoveryProgressInterval = 5 * time.Second
+
+// What the startup scan found and did.
+type RecoveryReport struct {
+	// Chunks and versions that are available once recovery has finished
+	Chunks   int
+	Versions int
+	// Versions that the storage found damaged and set aside itself, when it was opened; see storage.IntegrityCheck
+	DamagedOnOpen int
+	// Versions that could not be read back intact, and were set aside
+	Quarantined int
+	// Versions of chunks that had no latest version, left behind by an interrupted Add or Delete
+	Orphaned int
+	// Versions older than the latest version, left behind by an interrupted UpdateLatestVersion
+	Stale int
+	// Chunks that had to be dropped entirely, because their latest version was missing or damaged
+	Lost int
+	// Staged writes that the storage kept across the restart, which can still be committed
+	Staged int
+	// Tombstones of deleted chunks that the storage kept across the restart
+	Tombstones int
+}
+
+func (r RecoveryReport) String() string {
+	return fmt.Sprintf("%d chunks (%d versions) available; storage set aside %d damaged files when opened; "+
+		"quarantined %d damaged versions; removed %d orphaned and %d stale versions; lost %d chunks; restored %d "+
+		"staged writes and %d tombstones", r.Chunks, r.Versions, r.DamagedOnOpen, r.Quarantined, r.Orphaned, r.Stale,
+		r.Lost, r.Staged, r.Tombstones)
+}
+
+// How many versions were found damaged, whether by the storage when it was opened, or by the scan.
+func (r RecoveryReport) Damaged() int {
+	return r.DamagedOnOpen + r.Quarantined
+}
+
+// Scans storage left behind by a previous run, so that the chunkserver only ever presents a consistent view: every
+// chunk has a latest version, which is present and intact, and nothing older than it. Versions newer than the latest are
+// kept, because they may be commits that are about to be made latest.
+// Staged writes and tombstones are restored if the storage kept them; otherwise, they only ever existed in memory.
+// Must be called before the chunkserver is made available to anyone else.
+func (cs *chunkserver) recover() (RecoveryReport, error) {
+	var report RecoveryReport
+	if reporter, ok := cs.Storage.(storage.IntegrityReporter); ok {
+		if integrity, checked := reporter.IntegrityReport(); checked {
+			log.Printf("recovery: storage integrity check: %v", integrity)
+			for _, problem := range integrity.Problems {
+				log.Printf("recovery: storage integrity problem: %v", problem)
+			}
+			report.DamagedOnOpen = integrity.Quarantined
+		}
+	}
+	withData, err := cs.Storage.ListChunksWithData()
+	if err != nil {
+		return report, fmt.Errorf("[startup.go/LCD] %v", err)
+	}
+	withLatest, err := cs.Storage.ListChunksWithLatest()
+	if err != nil {
+		return report, fmt.Errorf("[startup.go/LCL] %v", err)
+	}
+	hasLatest := map[apis.ChunkNum]bool{}
+	for _, chunk := range withLatest {
+		hasLatest[chunk] = true
+	}
+	chunks := withLatest
+	for _, chunk := range withData {
+		if !hasLatest[chunk] {
+			chunks = append(chunks, chunk)
+		}
+	}
+
+	lastProgress := time.Now()
+	for i, chunk := range chunks {
+		if time.Since(lastProgress) >= recoveryProgressInterval {
+			log.Printf("recovery: scanned %d of %d chunks", i, len(chunks))
+			lastProgress = time.Now()
+		}
+		if err := cs.recoverChunk(chunk, hasLatest[chunk], &report); err != nil {
+			return report, fmt.Errorf("[startup.go/RCC] chunk %d: %v", chunk, err)
+		}
+	}
+
+	if keeper, ok := cs.Storage.(storage.StagedWriteKeeper); ok {
+		staged, err := keeper.ListStaged()
+		if err != nil {
+			return report, fmt.Errorf("[startup.go/LSW] %v", err)
+		}
+		for _, write := range staged {
+			if err := cs.Storage.StageData(len(write.Data)); err != nil {
+				return report, fmt.Errorf("[startup.go/STG] %v", err)
+			}
+			// how many commits were expected is not kept, so the write is available for just one more
+			cs.Hashes[write.Hash] = commit{Offset: write.Offset, Data: write.Data, Pending: 1}
+			report.Staged += 1
+		}
+	}
+
+	if keeper, ok := cs.Storage.(storage.TombstoneKeeper); ok {
+		tombstones, err := keeper.ListTombstones()
+		if err != nil {
+			return report, fmt.Errorf("[startup.go/LTS] %v", err)
+		}
+		for _, tombstone := range tombstones {
+			cs.tombstones[tombstone.Chunk] = tombstone
+			report.Tombstones += 1
+		}
+	}
+	return report, nil
+}
+
+func (cs *chunkserver) recoverChunk(chunk apis.ChunkNum, hasLatest bool, report *RecoveryReport) error {
+	versions, err := cs.Storage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	var intact []apis.Version
+	for _, version := range versions {
+		if _, err := cs.Storage.ReadVersion(chunk, version); err != nil {
+			log.Printf("recovery: quarantining damaged version %d/%d: %v", chunk, version, err)
+			quarantiner, ok := cs.Storage.(storage.Quarantiner)
+			if !ok {
+				return fmt.Errorf("cannot quarantine damaged version %d: %v", version, err)
+			}
+			if err := quarantiner.QuarantineVersion(chunk, version); err != nil {
+				return err
+			}
+			report.Quarantined += 1
+			continue
+		}
+		intact = append(intact, version)
+	}
+
+	if !hasLatest {
+		for _, version := range intact {
+			if err := cs.Storage.DeleteVersion(chunk, version); err != nil {
+				return err
+			}
+			report.Orphaned += 1
+		}
+		return nil
+	}
+
+	latest, err := cs.Storage.GetLatestVersion(chunk)
+	if err != nil {
+		return err
+	}
+	foundLatest := false
+	for _, version := range intact {
+		foundLatest = foundLatest || version == latest
+	}
+	if !foundLatest {
+		// there's no way to tell what's actually current; the replicator will copy it back from another replica
+		log.Printf("recovery: dropping chunk %d, because its latest version %d is missing or damaged", chunk, latest)
+		if err := cs.Storage.DeleteLatestVersion(chunk); err != nil {
+			return err
+		}
+		for _, version := range intact {
+			if err := cs.Storage.DeleteVersion(chunk, version); err != nil {
+				return err
+			}
+		}
+		report.Lost += 1
+		return nil
+	}
+
+	for _, version := range intact {
+		if version < latest {
+			if err := cs.Storage.DeleteVersion(chunk, version); err != nil {
+				return err
+			}
+			report.Stale += 1
+		} else {
+			report.Versions += 1
+		}
+	}
+	cs.latest[chunk] = latest
+	report.Chunks += 1
+	return nil
+}
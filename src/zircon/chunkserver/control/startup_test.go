@@ -0,0 +1,225 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestRecoveryAfterCrash(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "recovery-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	cs, shutdown, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+
+	// chunk 1 has a commit that was never made the latest version
+	assert.NoError(cs.Add(1, []byte("one"), 1))
+	assert.NoError(cs.StartWrite(1, 0, []byte("ONE")))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(0, []byte("ONE")), 1, 2))
+	// chunk 2 is about to be written when the server dies
+	assert.NoError(cs.Add(2, []byte("two"), 1))
+	// chunk 3 is partway through cleaning up after moving to a new version
+	assert.NoError(cs.Add(3, []byte("three"), 2))
+	// and a write that was staged, but never committed
+	assert.NoError(cs.StartWrite(3, 0, []byte("staged")))
+	assert.NoError(shutdown(time.Now().Add(time.Second)))
+
+	// simulate the state the server would have left behind, had it been killed at those points
+	assert.NoError(fs.WriteVersion(3, 1, []byte("old three")))
+	assert.NoError(fs.WriteVersion(4, 1, []byte("added, but never made latest")))
+	info, err := os.Stat(dir + "/chunks/02/2/1")
+	require.NoError(t, err)
+	assert.NoError(os.Truncate(dir+"/chunks/02/2/1", info.Size()-1))
+	fs.Close()
+
+	fs, err = storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs, shutdown, err = ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkVersion{{Chunk: 1, Version: 1}, {Chunk: 1, Version: 2}, {Chunk: 3, Version: 2}}, chunks)
+
+	data, version, err := cs.Read(1, 0, 3, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(1), version)
+	assert.Equal("one", string(data))
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 2))
+	data, _, err = cs.Read(1, 0, 3, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("ONE", string(data))
+
+	data, version, err = cs.Read(3, 0, 5, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), version)
+	assert.Equal("three", string(data))
+
+	// the damaged file is kept around for inspection
+	quarantined, err := os.Stat(dir + "/quarantine/chunk-2-1")
+	assert.NoError(err)
+	assert.Equal(info.Size()-1, quarantined.Size())
+
+	// and the recovered server is fully usable
+	assert.NoError(cs.Add(2, []byte("two again"), 5))
+	data, _, err = cs.Read(2, 0, 9, 5)
+	assert.NoError(err)
+	assert.Equal("two again", string(data))
+}
+
+func TestStartupDamageLimit(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "damage-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	cs, shutdown, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+	for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+		assert.NoError(cs.Add(chunk, []byte("chunk data"), 1))
+	}
+	assert.NoError(shutdown(time.Now().Add(time.Second)))
+	fs.Close()
+	// one version is caught by the storage when it's opened, and the other only by the startup scan
+	assert.NoError(os.Truncate(dir+"/chunks/01/1/1", 14))
+	encoded, err := ioutil.ReadFile(dir + "/chunks/02/2/1")
+	require.NoError(t, err)
+	encoded[len(encoded)-1] ^= 0xFF
+	require.NoError(t, ioutil.WriteFile(dir+"/chunks/02/2/1", encoded, 0644))
+
+	options := storage.FilesystemOptions{Integrity: storage.IntegrityCheckLengths}
+	fs, err = storage.ConfigureFilesystemStorageWithOptions(dir, options)
+	require.NoError(t, err)
+	_, _, err = ExposeChunkserverWithOptions(fs, ChunkserverOptions{MaxStartupDamage: 1})
+	assert.Error(err)
+	fs.Close()
+
+	// the damage was already set aside the first time around, so it isn't counted again
+	fs, err = storage.ConfigureFilesystemStorageWithOptions(dir, options)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs, shutdown, err = ExposeChunkserverWithOptions(fs, ChunkserverOptions{MaxStartupDamage: 1})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+	chunks, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkVersion{{Chunk: 3, Version: 1}}, chunks)
+}
+
+func TestStagedWritesSurviveCrash(t *testing.T) {
+	testStagedWritesSurviveCrash(t, storage.FilesystemOptions{Durability: storage.DurabilityStageAndCommit})
+}
+
+func TestStagedWritesSurviveCrashInLog(t *testing.T) {
+	// the log keeps staged writes even though nothing else is synced
+	testStagedWritesSurviveCrash(t, storage.FilesystemOptions{Durability: storage.DurabilityNone, StagingLog: true})
+}
+
+func testStagedWritesSurviveCrash(t *testing.T, options storage.FilesystemOptions) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "staged-recovery-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := storage.ConfigureFilesystemStorageWithOptions(dir, options)
+	require.NoError(t, err)
+	cs, _, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+
+	stats, err := cs.GetStats()
+	assert.NoError(err)
+	assert.Equal(options.Durability.String(), stats.Durability)
+
+	assert.NoError(cs.Add(1, []byte("hello world"), 1))
+	assert.NoError(cs.StartWrite(1, 6, []byte("there")))
+	assert.NoError(cs.StartWrite(1, 0, []byte("HELLO")))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(0, []byte("HELLO")), 1, 2))
+	// the server dies without shutting down
+	fs.Close()
+
+	fs, err = storage.ConfigureFilesystemStorageWithOptions(dir, options)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+
+	stats, err = cs.GetStats()
+	assert.NoError(err)
+	assert.Equal(uint64(1), stats.StagedWrites)
+
+	// only the write that was never committed is still staged
+	assert.Error(cs.CommitWrite(1, apis.CalculateCommitHash(0, []byte("HELLO")), 1, 3))
+	assert.NoError(cs.CommitWrite(1, apis.CalculateCommitHash(6, []byte("there")), 1, 3))
+	assert.NoError(cs.UpdateLatestVersion(1, 1, 3))
+	data, _, err := cs.Read(1, 0, 11, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("hello there", string(data))
+
+	assert.NoError(shutdown(time.Now().Add(time.Second)))
+	staged, err := fs.(storage.StagedWriteKeeper).ListStaged()
+	assert.NoError(err)
+	assert.Empty(staged)
+}
+
+// Compares what StartWrite costs when staged writes aren't kept, when they're kept in files, and when they're kept in
+// the staging log.
+func BenchmarkStartWriteStaging(b *testing.B) {
+	for _, bench := range []struct {
+		name    string
+		options storage.FilesystemOptions
+	}{
+		{"unkept", storage.FilesystemOptions{Durability: storage.DurabilityCommit}},
+		{"files", storage.FilesystemOptions{Durability: storage.DurabilityStageAndCommit}},
+		{"log", storage.FilesystemOptions{Durability: storage.DurabilityCommit, StagingLog: true}},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "staging-benchmark-")
+			require.NoError(b, err)
+			defer os.RemoveAll(dir)
+			fs, err := storage.ConfigureFilesystemStorageWithOptions(dir, bench.options)
+			require.NoError(b, err)
+			defer fs.Close()
+			cs, shutdown, err := ExposeChunkserverWithShutdown(fs)
+			require.NoError(b, err)
+			defer shutdown(time.Now().Add(time.Second))
+
+			data := make([]byte, 4096)
+			require.NoError(b, cs.Add(1, data, 1))
+			b.SetBytes(int64(len(data)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				version := apis.Version(i + 1)
+				data[0], data[1] = byte(i), byte(i>>8)
+				if err := cs.StartWrite(1, 0, data); err != nil {
+					b.Fatal(err)
+				}
+				// only the staging is being measured, but the write is committed so that it doesn't stay staged
+				b.StopTimer()
+				if err := cs.CommitWrite(1, apis.CalculateCommitHash(0, data), version, version+1); err != nil {
+					b.Fatal(err)
+				}
+				if err := cs.UpdateLatestVersion(1, version, version+1); err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
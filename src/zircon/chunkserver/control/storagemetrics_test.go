@@ -0,0 +1,46 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestStorageMetricsInStats(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithOptions(mem, ChunkserverOptions{})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.NoError(cs.Add(1, []byte("hello world"), 1))
+	data, _, err := cs.Read(1, 0, 5, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal("hello", string(data))
+
+	stats, err := cs.GetStats()
+	assert.NoError(err)
+	assert.Equal(uint64(1), stats.StorageCounters["versions-written"])
+	assert.Equal(uint64(11), stats.StorageCounters["bytes-written"])
+	assert.True(stats.StorageCounters["bytes-read"] >= 5)
+	assert.Equal(uint64(1), stats.StorageLatencies["write"].Calls)
+	assert.True(stats.StorageLatencies["read"].Calls >= 1)
+
+	// storage that doesn't report anything leaves the maps out entirely
+	other, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer other.Close()
+	cs2, shutdown2, err := ExposeChunkserverWithOptions(struct{ storage.ChunkStorage }{other}, ChunkserverOptions{})
+	require.NoError(t, err)
+	defer shutdown2(time.Now().Add(time.Second))
+	stats, err = cs2.GetStats()
+	assert.NoError(err)
+	assert.Nil(stats.StorageCounters)
+	assert.Nil(stats.StorageLatencies)
+}
@@ -0,0 +1,106 @@
+package control
+
+import (
+	"sort"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// Deleting a whole chunk leaves a tombstone behind, so that a copy of the chunk that missed the deletion can't be
+// brought back here by re-replication. Like the latest version index, tombstones are kept in memory, and also in storage
+// if it is a storage.TombstoneKeeper, in which case they are reloaded by the startup scan.
+
+// How long a tombstone is kept if ForgetTombstone is never called for it, unless ChunkserverOptions says otherwise.
+const DefaultTombstoneRetention = 24 * time.Hour
+
+func (cs *chunkserver) tombstoneRetention() time.Duration {
+	if cs.options.TombstoneRetention == 0 {
+		return DefaultTombstoneRetention
+	}
+	return cs.options.TombstoneRetention
+}
+
+// Records that a chunk was deleted, up to and including the given version.
+func (cs *chunkserver) recordTombstone(chunk apis.ChunkNum, version apis.Version) error {
+	tombstone := apis.Tombstone{Chunk: chunk, Version: version, Deleted: time.Now()}
+	if keeper, ok := cs.Storage.(storage.TombstoneKeeper); ok {
+		if err := keeper.KeepTombstone(tombstone); err != nil {
+			return err
+		}
+	}
+	cs.tombstones[chunk] = tombstone
+	return nil
+}
+
+func (cs *chunkserver) forgetTombstone(chunk apis.ChunkNum) error {
+	if _, found := cs.tombstones[chunk]; !found {
+		return nil
+	}
+	if keeper, ok := cs.Storage.(storage.TombstoneKeeper); ok {
+		if err := keeper.ForgetTombstone(chunk); err != nil {
+			return err
+		}
+	}
+	delete(cs.tombstones, chunk)
+	return nil
+}
+
+// Discards every tombstone that has outlived the retention period.
+func (cs *chunkserver) expireTombstones() error {
+	cutoff := time.Now().Add(-cs.tombstoneRetention())
+	for chunk, tombstone := range cs.tombstones {
+		if tombstone.Deleted.Before(cutoff) {
+			if err := cs.forgetTombstone(chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Fails with ErrAlreadyDeleted if adding this version of the chunk would bring back a deleted copy. Adding a newer
+// version than the one that was deleted means that the chunk has been legitimately created again, and so must only be
+// done once the add has succeeded.
+func (cs *chunkserver) checkTombstone(chunk apis.ChunkNum, version apis.Version) error {
+	if err := cs.expireTombstones(); err != nil {
+		return err
+	}
+	tombstone, found := cs.tombstones[chunk]
+	if found && version <= tombstone.Version {
+		return apis.NewError(apis.ErrAlreadyDeleted, 0, "refusing to bring back chunk %d/%d, which was deleted at version %d",
+			chunk, version, tombstone.Version)
+	}
+	return nil
+}
+
+func (cs *chunkserver) ListTombstones() ([]apis.Tombstone, error) {
+	release, err := cs.enter(operation{method: "ListTombstones"})
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if err := cs.expireTombstones(); err != nil {
+		return nil, err
+	}
+	result := make([]apis.Tombstone, 0, len(cs.tombstones))
+	for _, tombstone := range cs.tombstones {
+		result = append(result, tombstone)
+	}
+	// not guaranteed by the interface, but it makes the output far easier to read
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Chunk < result[j].Chunk
+	})
+	return result, nil
+}
+
+func (cs *chunkserver) ForgetTombstone(chunk apis.ChunkNum) error {
+	release, err := cs.enter(operation{method: "ForgetTombstone", chunk: chunk})
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return cs.forgetTombstone(chunk)
+}
@@ -0,0 +1,145 @@
+package control
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// A replica that was down while a chunk was deleted comes back still holding it. Copying the chunk from there back onto
+// a replica that did delete it, as re-replication would, must not bring it back.
+func TestTombstonePreventsResurrection(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	upMem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer upMem.Close()
+	up, shutdown, err := ExposeChunkserverWithShutdown(upMem)
+	require.NoError(t, err)
+	downMem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer downMem.Close()
+	down, downShutdown, err := ExposeChunkserverWithShutdown(downMem)
+	require.NoError(t, err)
+	defer downShutdown(time.Now().Add(time.Second))
+
+	for _, cs := range []apis.ChunkserverSingle{up, down} {
+		assert.NoError(cs.Add(5, []byte("doomed"), 2))
+		assert.NoError(cs.Add(6, []byte("survivor"), 1))
+	}
+	assert.NoError(up.StartWrite(5, 0, []byte("DOOMED")))
+	assert.NoError(up.CommitWrite(5, apis.CalculateCommitHash(0, []byte("DOOMED")), 2, 3))
+
+	before := time.Now()
+	assert.NoError(up.Delete(5, 2))
+	tombstones, err := up.ListTombstones()
+	assert.NoError(err)
+	require.Len(t, tombstones, 1)
+	// the tombstone covers versions that were never made latest, too
+	assert.Equal(apis.ChunkNum(5), tombstones[0].Chunk)
+	assert.Equal(apis.Version(3), tombstones[0].Version)
+	assert.False(tombstones[0].Deleted.Before(before))
+	// rolling back a single version doesn't leave a tombstone
+	assert.NoError(up.StartWrite(6, 0, []byte("SURVIVOR")))
+	assert.NoError(up.CommitWrite(6, apis.CalculateCommitHash(0, []byte("SURVIVOR")), 1, 2))
+	assert.NoError(up.Delete(6, 2))
+	tombstones, err = up.ListTombstones()
+	assert.NoError(err)
+	assert.Len(tombstones, 1)
+
+	// the stale copy on the returning replica is refused, at any version the deletion covered
+	data, version, err := down.Read(5, 0, 6, apis.AnyVersion)
+	require.NoError(t, err)
+	for v := apis.Version(1); v <= 3; v++ {
+		err = up.ForceAdd(5, data, v)
+		assert.Equal(apis.ErrAlreadyDeleted, apis.ErrorCodeOf(err))
+	}
+	err = up.Add(5, data, version)
+	assert.Equal(apis.ErrAlreadyDeleted, apis.ErrorCodeOf(err))
+	chunks, err := up.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkVersion{{Chunk: 6, Version: 1}}, chunks)
+
+	// deleting the stale copy leaves a tombstone there too
+	assert.NoError(down.Delete(5, version))
+	tombstones, err = down.ListTombstones()
+	assert.NoError(err)
+	assert.Len(tombstones, 1)
+
+	// once every replica has confirmed the deletion, the chunk can be created again
+	assert.NoError(up.ForgetTombstone(5))
+	assert.NoError(up.ForgetTombstone(5))
+	assert.NoError(up.Add(5, []byte("reborn"), 1))
+	// and a newer version than the deleted one is a new chunk, so it replaces the tombstone
+	assert.NoError(down.ForceAdd(5, []byte("reborn"), 4))
+	tombstones, err = down.ListTombstones()
+	assert.NoError(err)
+	assert.Empty(tombstones)
+
+	assert.NoError(shutdown(time.Now().Add(time.Second)))
+	_, err = up.ListTombstones()
+	assert.Equal(apis.ErrShuttingDown, apis.ErrorCodeOf(err))
+}
+
+func TestTombstoneRetention(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	_, _, err := ExposeChunkserverWithOptions(nil, ChunkserverOptions{TombstoneRetention: -time.Second})
+	assert.Error(err)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithOptions(mem, ChunkserverOptions{TombstoneRetention: 50 * time.Millisecond})
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	assert.NoError(cs.Add(1, []byte("one"), 1))
+	assert.NoError(cs.Delete(1, 1))
+	assert.Error(cs.Add(1, []byte("one"), 1))
+
+	time.Sleep(100 * time.Millisecond)
+	tombstones, err := cs.ListTombstones()
+	assert.NoError(err)
+	assert.Empty(tombstones)
+	// expired tombstones are gone from storage too
+	tombstones, err = mem.(storage.TombstoneKeeper).ListTombstones()
+	assert.NoError(err)
+	assert.Empty(tombstones)
+	assert.NoError(cs.Add(1, []byte("one"), 1))
+}
+
+func TestTombstonesSurviveRestart(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "tombstone-restart-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	cs, shutdown, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+	assert.NoError(cs.Add(9, []byte("nine"), 4))
+	assert.NoError(cs.Delete(9, 4))
+	assert.NoError(shutdown(time.Now().Add(time.Second)))
+	fs.Close()
+
+	fs, err = storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs, shutdown, err = ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+	tombstones, err := cs.ListTombstones()
+	assert.NoError(err)
+	require.Len(t, tombstones, 1)
+	assert.Equal(apis.ChunkNum(9), tombstones[0].Chunk)
+	assert.Equal(apis.Version(4), tombstones[0].Version)
+	assert.Equal(apis.ErrAlreadyDeleted, apis.ErrorCodeOf(cs.ForceAdd(9, []byte("nine"), 4)))
+}
@@ -0,0 +1,150 @@
+package control
+
+import (
+	"bytes"
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+const tornTestLength = 64 * 1024
+
+// The contents of each version in the torn read test: every byte is the same, and says which version it came from.
+func tornTestData(version apis.Version) []byte {
+	return bytes.Repeat([]byte{byte(version)}, tornTestLength)
+}
+
+// Checks that data is exactly what the version it was read as holds, rather than parts of two different versions.
+func checkNotTorn(data []byte, version apis.Version) error {
+	if len(data) != tornTestLength {
+		return fmt.Errorf("read %d bytes of version %d, not %d", len(data), version, tornTestLength)
+	}
+	for i, b := range data {
+		if b != byte(version) {
+			return fmt.Errorf("byte %d of version %d is from version %d", i, version, b)
+		}
+	}
+	return nil
+}
+
+// Commits new versions of one chunk as fast as possible, while reads of the same chunk run alongside, and checks that
+// every read sees a single version in full.
+func hammerReadsAndCommits(t *testing.T, cs apis.ChunkserverSingle, commits int) {
+	require.NoError(t, cs.Add(1, tornTestData(1), 1))
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func(bulk bool) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				var err error
+				if bulk {
+					err = readOpened(cs, 1)
+				} else {
+					data, version, err2 := cs.Read(1, 0, tornTestLength, apis.AnyVersion)
+					err = err2
+					if err == nil {
+						err = checkNotTorn(data, version)
+					}
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(reader%2 == 1)
+	}
+
+	for version := apis.Version(1); version <= apis.Version(commits); version++ {
+		data := tornTestData(version + 1)
+		require.NoError(t, cs.StartWrite(1, 0, data))
+		require.NoError(t, cs.CommitWrite(1, apis.CalculateCommitHash(0, data), version, version+1))
+		require.NoError(t, cs.UpdateLatestVersion(1, version, version+1))
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// Reads a chunk through OpenRead, if the chunkserver can open it, and through Read otherwise.
+func readOpened(cs apis.ChunkserverSingle, chunk apis.ChunkNum) error {
+	read, ok, err := cs.(apis.BulkReader).OpenRead(chunk, 0, tornTestLength, apis.AnyVersion)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		data, version, err := cs.Read(chunk, 0, tornTestLength, apis.AnyVersion)
+		if err != nil {
+			return err
+		}
+		return checkNotTorn(data, version)
+	}
+	defer read.File.Close()
+	// read well after the lock is given up, so that the next commit has a chance to land first
+	time.Sleep(time.Millisecond)
+	data := make([]byte, read.Length)
+	if _, err := read.File.ReadAt(data, read.Offset); err != nil {
+		return err
+	}
+	return checkNotTorn(data, read.Version)
+}
+
+func TestNoTornReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torn-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	backends := map[string]func(dir string) (storage.ChunkStorage, error){
+		"memory": func(dir string) (storage.ChunkStorage, error) {
+			return storage.ConfigureMemoryStorage()
+		},
+		"filesystem": func(dir string) (storage.ChunkStorage, error) {
+			return storage.ConfigureFilesystemStorage(dir, false)
+		},
+		"mapped": func(dir string) (storage.ChunkStorage, error) {
+			return storage.ConfigureFilesystemStorageWithOptions(dir, storage.FilesystemOptions{
+				MappedReadCapacity: 16 * tornTestLength,
+			})
+		},
+		"copy-on-write": func(dir string) (storage.ChunkStorage, error) {
+			mem, err := storage.ConfigureMemoryStorage()
+			if err != nil {
+				return nil, err
+			}
+			return storage.WithCopyOnWrite(mem), nil
+		},
+	}
+	for name, configure := range backends {
+		t.Run(name, func(t *testing.T) {
+			sub, err := ioutil.TempDir(dir, name+"-")
+			require.NoError(t, err)
+			s, err := configure(sub)
+			require.NoError(t, err)
+			defer s.Close()
+			cs, shutdown, err := ExposeChunkserverWithOptions(s, ChunkserverOptions{ReadAheadCapacity: 4 * readAheadWindow})
+			require.NoError(t, err)
+			defer shutdown(time.Now().Add(time.Second))
+
+			hammerReadsAndCommits(t, cs, 200)
+			testifyAssert.New(t).NoError(readOpened(cs, 1))
+		})
+	}
+}
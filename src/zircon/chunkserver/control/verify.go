@@ -0,0 +1,74 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+// The totals of every check that VerifyAll has finished, for GetStats.
+type verifyTotals struct {
+	runs    uint64
+	ok      uint64
+	corrupt uint64
+	missing uint64
+}
+
+// Counts as an in-flight operation for as long as it runs, but only holds the storage lock one chunk at a time, like
+// compaction, so that everything else carries on in between. found is never called with the storage lock held.
+func (cs *chunkserver) VerifyAll(ctx context.Context, options apis.VerifyOptions, found func(apis.VerifyFinding)) (apis.VerifyReport, error) {
+	if options.BytesPerSecond < 0 {
+		return apis.VerifyReport{}, fmt.Errorf("[verify.go/BPS] verify bandwidth cannot be negative: %d", options.BytesPerSecond)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	cs.lifecycle.Lock()
+	if cs.shuttingDown {
+		cs.lifecycle.Unlock()
+		return apis.VerifyReport{}, apis.NewError(apis.ErrShuttingDown, 0, "chunkserver is shutting down")
+	}
+	if cs.verifying != nil {
+		cs.lifecycle.Unlock()
+		return apis.VerifyReport{}, errors.New("[verify.go/RUN] a check is already running on this chunkserver")
+	}
+	cs.verifying = cancel
+	cs.inflight.Add(1)
+	cs.lifecycle.Unlock()
+	defer func() {
+		cs.lifecycle.Lock()
+		cs.verifying = nil
+		cs.lifecycle.Unlock()
+		cs.inflight.Done()
+	}()
+
+	report, err := storage.VerifyAll(ctx, cs.Storage, storage.VerifyOptions{
+		BytesPerSecond: options.BytesPerSecond,
+		Lock:           &cs.storageMu,
+	}, func(finding apis.VerifyFinding) {
+		if found != nil && (finding.Status != apis.VerifyOK || options.IncludeOK) {
+			found(finding)
+		}
+	})
+	if err != nil {
+		return report, fmt.Errorf("[verify.go/VFY] %v", err)
+	}
+
+	cs.mu.Lock()
+	cs.verified.runs += 1
+	cs.verified.ok += report.OK
+	cs.verified.corrupt += report.Corrupt
+	cs.verified.missing += report.Missing
+	cs.mu.Unlock()
+	return report, nil
+}
+
+// Must be called with the lock held.
+func (cs *chunkserver) verifyStats(stats *apis.ChunkserverStats) {
+	stats.VerifyRuns = cs.verified.runs
+	stats.VerifyOK = cs.verified.ok
+	stats.VerifyCorrupt = cs.verified.corrupt
+	stats.VerifyMissing = cs.verified.missing
+}
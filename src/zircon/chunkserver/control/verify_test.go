@@ -0,0 +1,113 @@
+package control
+
+import (
+	"context"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/storage"
+)
+
+func TestVerifyAll(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "verify-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer fs.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+	defer shutdown(time.Now().Add(time.Second))
+
+	for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+		require.NoError(t, cs.Add(chunk, []byte("hello"), 1))
+	}
+	// damaged behind the chunkserver's back, as a failing disk would
+	path := dir + "/chunks/02/2/1"
+	encoded, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	encoded[len(encoded)-1] ^= 0x01
+	require.NoError(t, ioutil.WriteFile(path, encoded, 0644))
+
+	var findings []apis.VerifyFinding
+	collect := func(finding apis.VerifyFinding) {
+		findings = append(findings, finding)
+	}
+	report, err := cs.VerifyAll(context.Background(), apis.VerifyOptions{}, collect)
+	require.NoError(t, err)
+	assert.Equal(uint64(2), report.OK)
+	assert.Equal(uint64(1), report.Corrupt)
+	assert.Equal(uint64(0), report.Missing)
+	require.Len(t, findings, 1)
+	assert.Equal(apis.ChunkNum(2), findings[0].Chunk)
+	assert.Equal(apis.Version(1), findings[0].Version)
+	assert.Equal(apis.VerifyCorrupt, findings[0].Status)
+
+	// without anywhere for the findings to go, only the totals are reported
+	findings = nil
+	report, err = cs.VerifyAll(context.Background(), apis.VerifyOptions{IncludeOK: true}, nil)
+	require.NoError(t, err)
+	assert.Equal(uint64(2), report.OK)
+	_, err = cs.VerifyAll(context.Background(), apis.VerifyOptions{IncludeOK: true}, collect)
+	require.NoError(t, err)
+	assert.Len(findings, 3)
+
+	stats, err := cs.GetStats()
+	require.NoError(t, err)
+	assert.Equal(uint64(3), stats.VerifyRuns)
+	assert.Equal(uint64(6), stats.VerifyOK)
+	assert.Equal(uint64(3), stats.VerifyCorrupt)
+	assert.Equal(uint64(0), stats.VerifyMissing)
+
+	_, err = cs.VerifyAll(context.Background(), apis.VerifyOptions{BytesPerSecond: -1}, nil)
+	assert.Error(err)
+
+	// a cancelled context stops the check before it gets anywhere
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = cs.VerifyAll(ctx, apis.VerifyOptions{}, collect)
+	assert.Error(err)
+}
+
+func TestVerifyAllStreaming(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	cs, shutdown, err := ExposeChunkserverWithShutdown(mem)
+	require.NoError(t, err)
+	for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+		require.NoError(t, cs.Add(chunk, make([]byte, 1000), 1))
+	}
+
+	// other operations carry on while a slow check is running, and a second check has to wait its turn
+	started := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		_, err := cs.VerifyAll(context.Background(), apis.VerifyOptions{BytesPerSecond: 1000, IncludeOK: true},
+			func(finding apis.VerifyFinding) {
+				if finding.Chunk == 1 {
+					close(started)
+				}
+			})
+		done <- err
+	}()
+	<-started
+	_, _, err = cs.Read(3, 0, 5, apis.AnyVersion)
+	assert.NoError(err)
+	_, err = cs.VerifyAll(context.Background(), apis.VerifyOptions{}, nil)
+	assert.Error(err)
+
+	// and shutting down cancels it, rather than waiting for it to finish
+	start := time.Now()
+	assert.NoError(shutdown(time.Now().Add(5 * time.Second)))
+	assert.Error(<-done)
+	assert.True(time.Since(start) < time.Second)
+}
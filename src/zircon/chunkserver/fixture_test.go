@@ -0,0 +1,41 @@
+package chunkserver
+
+import (
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"testing"
+	"zircon/apis"
+	"zircon/rpc"
+	"zircon/util"
+)
+
+func TestFixtureSubtests(t *testing.T) {
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+
+	fixture := BuildTestFixture(t, cache, func(server apis.Chunkserver) {
+		for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+			testifyAssert.NoError(t, server.Add(chunk, []byte(fmt.Sprintf("chunk %d", chunk)), 1))
+		}
+	})
+
+	for i := 0; i < 4; i++ {
+		t.Run(fmt.Sprintf("subtest %d", i), func(t *testing.T) {
+			t.Parallel()
+			assert := testifyAssert.New(t)
+
+			cs, stats, teardown := fixture.NewChunkserver(t, cache)
+			defer teardown()
+			// every subtest starts from the same state, whatever the others have done to theirs
+			assert.Equal(uint64(3), stats().Chunks)
+			data, version, err := cs.Read(2, 0, 32, apis.AnyVersion)
+			assert.NoError(err)
+			assert.Equal(apis.Version(1), version)
+			assert.Equal("chunk 2", string(util.StripTrailingZeroes(data)))
+
+			assert.NoError(cs.Delete(2, 1))
+			assert.NoError(cs.Add(4, []byte("mine"), 1))
+			assert.Equal(uint64(3), stats().Chunks)
+		})
+	}
+}
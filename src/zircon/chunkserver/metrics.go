@@ -0,0 +1,275 @@
+package chunkserver
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+	"zircon/apis"
+)
+
+type operationCounters struct {
+	calls        uint64
+	errors       uint64
+	bytes        uint64
+	totalLatency int64
+	histogram    [apis.LatencyBucketCount]uint64
+
+	mu     sync.Mutex
+	byCode map[apis.ErrorCode]uint64
+}
+
+// Count a single call. Only the error path takes a lock, so this is cheap enough to leave enabled.
+func (o *operationCounters) record(start time.Time, bytes int, err error) {
+	latency := time.Since(start)
+	atomic.AddUint64(&o.calls, 1)
+	atomic.AddUint64(&o.bytes, uint64(bytes))
+	atomic.AddInt64(&o.totalLatency, int64(latency))
+	atomic.AddUint64(&o.histogram[apis.LatencyBucket(latency)], 1)
+	if err != nil {
+		atomic.AddUint64(&o.errors, 1)
+		o.mu.Lock()
+		o.byCode[apis.ErrorCodeOf(err)] += 1
+		o.mu.Unlock()
+	}
+}
+
+func (o *operationCounters) snapshot() apis.OperationStats {
+	stats := apis.OperationStats{
+		Calls:        atomic.LoadUint64(&o.calls),
+		Errors:       atomic.LoadUint64(&o.errors),
+		Bytes:        atomic.LoadUint64(&o.bytes),
+		TotalLatency: time.Duration(atomic.LoadInt64(&o.totalLatency)),
+		ErrorsByCode: map[apis.ErrorCode]uint64{},
+	}
+	for i := range o.histogram {
+		stats.LatencyHistogram[i] = atomic.LoadUint64(&o.histogram[i])
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for code, count := range o.byCode {
+		stats.ErrorsByCode[code] = count
+	}
+	return stats
+}
+
+type metered struct {
+	server     apis.Chunkserver
+	operations map[string]*operationCounters
+}
+
+var meteredMethods = []string{
+	"StartWriteReplicated", "Replicate", "Push", "RepairChunk", "Read", "StartWrite", "CommitWrite", "CommitWriteBatch",
+	"UpdateLatestVersion", "OverrideLatestVersion", "Add", "AddWithMode", "ForceAdd", "ForceAddChecked", "Delete",
+	"ListAllChunks", "ListAllChunksWithHashes", "ListChunks", "ListTombstones", "ForgetTombstone",
+}
+
+// Wrap any chunkserver (such as one returned by WithChatter) so that calls to it are counted and timed. The counters
+// are reported in the Operations field of GetStats.
+func WithMetrics(server apis.Chunkserver) apis.Chunkserver {
+	m := &metered{
+		server:     server,
+		operations: map[string]*operationCounters{},
+	}
+	for _, method := range meteredMethods {
+		m.operations[method] = &operationCounters{byCode: map[apis.ErrorCode]uint64{}}
+	}
+	return m
+}
+
+func (m *metered) GetStats() (apis.ChunkserverStats, error) {
+	stats, err := m.server.GetStats()
+	if err != nil {
+		return apis.ChunkserverStats{}, err
+	}
+	stats.Operations = map[string]apis.OperationStats{}
+	for method, counters := range m.operations {
+		stats.Operations[method] = counters.snapshot()
+	}
+	return stats, nil
+}
+
+func (m *metered) SetSlowOperationThresholds(thresholds apis.SlowOperationThresholds) error {
+	return m.server.SetSlowOperationThresholds(thresholds)
+}
+
+func (m *metered) SetCompactionPaused(paused bool) error {
+	return m.server.SetCompactionPaused(paused)
+}
+
+func (m *metered) VerifyAll(ctx context.Context, options apis.VerifyOptions, found func(apis.VerifyFinding)) (apis.VerifyReport, error) {
+	return m.server.VerifyAll(ctx, options, found)
+}
+
+func (m *metered) StartWriteReplicated(chunk apis.ChunkNum, offset uint32, data []byte, replicas []apis.ServerAddress) error {
+	return m.StartWriteReplicatedWithContext(context.Background(), chunk, offset, data, replicas)
+}
+
+func (m *metered) StartWriteReplicatedWithContext(ctx context.Context, chunk apis.ChunkNum, offset uint32, data []byte, replicas []apis.ServerAddress) error {
+	start := time.Now()
+	err := m.server.StartWriteReplicatedWithContext(ctx, chunk, offset, data, replicas)
+	m.operations["StartWriteReplicated"].record(start, len(data), err)
+	return err
+}
+
+func (m *metered) Replicate(chunk apis.ChunkNum, serverAddress apis.ServerAddress, version apis.Version) error {
+	return m.ReplicateWithContext(context.Background(), chunk, serverAddress, version)
+}
+
+func (m *metered) ReplicateWithContext(ctx context.Context, chunk apis.ChunkNum, serverAddress apis.ServerAddress, version apis.Version) error {
+	start := time.Now()
+	err := m.server.ReplicateWithContext(ctx, chunk, serverAddress, version)
+	m.operations["Replicate"].record(start, 0, err)
+	return err
+}
+
+func (m *metered) Push(chunk apis.ChunkNum, serverAddress apis.ServerAddress) (apis.Version, error) {
+	return m.PushWithContext(context.Background(), chunk, serverAddress)
+}
+
+func (m *metered) PushWithContext(ctx context.Context, chunk apis.ChunkNum, serverAddress apis.ServerAddress) (apis.Version, error) {
+	start := time.Now()
+	version, err := m.server.PushWithContext(ctx, chunk, serverAddress)
+	m.operations["Push"].record(start, 0, err)
+	return version, err
+}
+
+func (m *metered) RepairChunk(chunk apis.ChunkNum, version apis.Version, checksum uint32, sources []apis.ServerAddress) (apis.ServerAddress, error) {
+	return m.RepairChunkWithContext(context.Background(), chunk, version, checksum, sources)
+}
+
+func (m *metered) RepairChunkWithContext(ctx context.Context, chunk apis.ChunkNum, version apis.Version, checksum uint32, sources []apis.ServerAddress) (apis.ServerAddress, error) {
+	start := time.Now()
+	source, err := m.server.RepairChunkWithContext(ctx, chunk, version, checksum, sources)
+	m.operations["RepairChunk"].record(start, 0, err)
+	return source, err
+}
+
+func (m *metered) Read(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, error) {
+	start := time.Now()
+	data, version, err := m.server.Read(chunk, offset, length, minimum)
+	m.operations["Read"].record(start, len(data), err)
+	return data, version, err
+}
+
+// Counted as a Read, since that's what it is to the client. Only the time to open the read is included, since the data
+// is sent afterwards.
+func (m *metered) OpenRead(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) (*apis.BulkRead, bool, error) {
+	reader, ok := m.server.(apis.BulkReader)
+	if !ok {
+		return nil, false, nil
+	}
+	start := time.Now()
+	read, ok, err := reader.OpenRead(chunk, offset, length, minimum)
+	if ok {
+		m.operations["Read"].record(start, int(read.Length), nil)
+	} else if err != nil {
+		m.operations["Read"].record(start, 0, err)
+	}
+	return read, ok, err
+}
+
+func (m *metered) StartWrite(chunk apis.ChunkNum, offset uint32, data []byte) error {
+	start := time.Now()
+	err := m.server.StartWrite(chunk, offset, data)
+	m.operations["StartWrite"].record(start, len(data), err)
+	return err
+}
+
+func (m *metered) CommitWrite(chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version, newVersion apis.Version) error {
+	start := time.Now()
+	err := m.server.CommitWrite(chunk, hash, oldVersion, newVersion)
+	m.operations["CommitWrite"].record(start, 0, err)
+	return err
+}
+
+func (m *metered) CommitWriteBatch(commits []apis.CommitWriteRequest) ([]error, error) {
+	start := time.Now()
+	results, err := m.server.CommitWriteBatch(commits)
+	m.operations["CommitWriteBatch"].record(start, 0, err)
+	return results, err
+}
+
+func (m *metered) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.Version, newVersion apis.Version) error {
+	start := time.Now()
+	err := m.server.UpdateLatestVersion(chunk, oldVersion, newVersion)
+	m.operations["UpdateLatestVersion"].record(start, 0, err)
+	return err
+}
+
+func (m *metered) OverrideLatestVersion(chunk apis.ChunkNum, version apis.Version) error {
+	start := time.Now()
+	err := m.server.OverrideLatestVersion(chunk, version)
+	m.operations["OverrideLatestVersion"].record(start, 0, err)
+	return err
+}
+
+func (m *metered) Add(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
+	start := time.Now()
+	err := m.server.Add(chunk, initialData, initialVersion)
+	m.operations["Add"].record(start, len(initialData), err)
+	return err
+}
+
+func (m *metered) AddWithMode(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version, mode apis.AddMode) error {
+	start := time.Now()
+	err := m.server.AddWithMode(chunk, initialData, initialVersion, mode)
+	m.operations["AddWithMode"].record(start, len(initialData), err)
+	return err
+}
+
+func (m *metered) ForceAdd(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
+	start := time.Now()
+	err := m.server.ForceAdd(chunk, initialData, initialVersion)
+	m.operations["ForceAdd"].record(start, len(initialData), err)
+	return err
+}
+
+func (m *metered) ForceAddChecked(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version, checksum uint32) error {
+	start := time.Now()
+	err := m.server.ForceAddChecked(chunk, initialData, initialVersion, checksum)
+	m.operations["ForceAddChecked"].record(start, len(initialData), err)
+	return err
+}
+
+func (m *metered) Delete(chunk apis.ChunkNum, version apis.Version) error {
+	start := time.Now()
+	err := m.server.Delete(chunk, version)
+	m.operations["Delete"].record(start, 0, err)
+	return err
+}
+
+func (m *metered) ListAllChunks(minimum apis.Version, maximum apis.Version) ([]apis.ChunkVersion, error) {
+	start := time.Now()
+	chunks, err := m.server.ListAllChunks(minimum, maximum)
+	m.operations["ListAllChunks"].record(start, 0, err)
+	return chunks, err
+}
+
+func (m *metered) ListAllChunksWithHashes(minimum apis.Version, maximum apis.Version) ([]apis.ChunkVersionHashes, error) {
+	start := time.Now()
+	chunks, err := m.server.ListAllChunksWithHashes(minimum, maximum)
+	m.operations["ListAllChunksWithHashes"].record(start, 0, err)
+	return chunks, err
+}
+
+func (m *metered) ListChunks(filter apis.ChunkFilter) ([]apis.ChunkVersion, error) {
+	start := time.Now()
+	chunks, err := m.server.ListChunks(filter)
+	m.operations["ListChunks"].record(start, 0, err)
+	return chunks, err
+}
+
+func (m *metered) ListTombstones() ([]apis.Tombstone, error) {
+	start := time.Now()
+	tombstones, err := m.server.ListTombstones()
+	m.operations["ListTombstones"].record(start, 0, err)
+	return tombstones, err
+}
+
+func (m *metered) ForgetTombstone(chunk apis.ChunkNum) error {
+	start := time.Now()
+	err := m.server.ForgetTombstone(chunk)
+	m.operations["ForgetTombstone"].record(start, 0, err)
+	return err
+}
@@ -0,0 +1,61 @@
+package chunkserver
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"testing"
+	"zircon/apis"
+	"zircon/rpc"
+)
+
+func TestMetricsCountEachMethod(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+
+	inner, _, teardown := NewTestChunkserver(t, cache)
+	defer teardown()
+	server := WithMetrics(inner)
+
+	assert.NoError(server.Add(73, []byte("hello world"), 2))
+	assert.NoError(server.StartWrite(73, 0, []byte("HELLO")))
+	assert.NoError(server.StartWriteReplicated(73, 6, []byte("WORLD"), nil))
+	assert.NoError(server.CommitWrite(73, apis.CalculateCommitHash(0, []byte("HELLO")), 2, 3))
+	assert.Error(server.CommitWrite(73, apis.CalculateCommitHash(6, []byte("WORLD")), 1, 4))
+	assert.NoError(server.UpdateLatestVersion(73, 2, 3))
+	data, _, err := server.Read(73, 0, 16, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Equal(16, len(data))
+	_, err = server.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+	assert.NoError(err)
+	assert.Error(server.Replicate(73, "127.0.0.1:1", 3))
+	assert.NoError(server.Delete(73, 3))
+
+	allStats, err := server.GetStats()
+	assert.NoError(err)
+	stats := allStats.Operations
+
+	for _, method := range []string{"Add", "StartWrite", "StartWriteReplicated", "UpdateLatestVersion", "Read",
+		"ListAllChunks", "Replicate", "Delete"} {
+		assert.Equal(uint64(1), stats[method].Calls, method)
+	}
+	assert.Equal(uint64(2), stats["CommitWrite"].Calls)
+
+	assert.Equal(uint64(11), stats["Add"].Bytes)
+	assert.Equal(uint64(5), stats["StartWrite"].Bytes)
+	assert.Equal(uint64(5), stats["StartWriteReplicated"].Bytes)
+	assert.Equal(uint64(16), stats["Read"].Bytes)
+
+	assert.Equal(uint64(0), stats["Read"].Errors)
+	assert.Equal(uint64(1), stats["CommitWrite"].Errors)
+	assert.Equal(uint64(1), stats["CommitWrite"].ErrorsByCode[apis.ErrWrongVersion])
+	assert.Equal(uint64(1), stats["Replicate"].Errors)
+
+	for method, op := range stats {
+		var histogramTotal uint64
+		for _, count := range op.LatencyHistogram {
+			histogramTotal += count
+		}
+		assert.Equal(op.Calls, histogramTotal, method)
+	}
+}
@@ -0,0 +1,63 @@
+package chunkserver
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+	"zircon/chunkserver/control"
+	"zircon/chunkserver/storage"
+	"zircon/rpc"
+)
+
+// A storage backend that panics whenever a particular chunk is read, to simulate a bug in a real backend.
+type panickingStorage struct {
+	storage.ChunkStorage
+	poisoned apis.ChunkNum
+}
+
+func (p *panickingStorage) ReadVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
+	if chunk == p.poisoned {
+		panic("simulated index bug in storage backend")
+	}
+	return p.ChunkStorage.ReadVersion(chunk, version)
+}
+
+func TestPanicInStorageReturnsInternalError(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	single, teardownSingle, err := control.ExposeChunkserver(&panickingStorage{ChunkStorage: mem, poisoned: 13})
+	require.NoError(t, err)
+	defer teardownSingle()
+
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+	local, err := WithChatter(single, cache)
+	require.NoError(t, err)
+
+	teardownServer, address, err := rpc.PublishChunkserver(local, ":0")
+	require.NoError(t, err)
+	defer teardownServer(true)
+
+	server, err := cache.SubscribeChunkserver(address)
+	require.NoError(t, err)
+
+	assert.NoError(server.Add(13, []byte("poisoned"), 1))
+	assert.NoError(server.Add(14, []byte("healthy"), 1))
+
+	_, _, err = server.Read(13, 0, 8, 1)
+	assert.Error(err)
+	assert.Equal(apis.ErrInternal, apis.ErrorCodeOf(err))
+
+	// the server should still be up, and the lock should have been released
+	data, version, err := server.Read(14, 0, 7, 1)
+	assert.NoError(err)
+	assert.Equal(apis.Version(1), version)
+	assert.Equal("healthy", string(data))
+
+	_, _, err = server.Read(13, 0, 8, 1)
+	assert.Equal(apis.ErrInternal, apis.ErrorCodeOf(err))
+}
@@ -0,0 +1,107 @@
+package chunkserver
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"zircon/apis"
+)
+
+// How long a chunkserver's live registration lasts without a heartbeat. A chunkserver that crashes stops being offered
+// for new chunks within about this long.
+const DefaultRegistrationTTL = 5 * time.Second
+
+// Keeps a chunkserver listed in etcd as live, by renewing its registration's lease in the background, until Unregister
+// is called.
+type Registration struct {
+	etcd    apis.EtcdInterface
+	address apis.ServerAddress
+	ttl     time.Duration
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Publishes the address of a chunkserver to etcd, and registers it as live, so that it can be selected as a replica for
+// new chunks. The registration expires if it isn't renewed within the TTL; renewals happen several times per TTL.
+func Register(etcd apis.EtcdInterface, address apis.ServerAddress, ttl time.Duration) (*Registration, error) {
+	ticker := time.NewTicker(ttl / 3)
+	r, err := register(etcd, address, ttl, ticker.C, ticker.Stop)
+	if err != nil {
+		ticker.Stop()
+	}
+	return r, err
+}
+
+// Works like Register, but sends a heartbeat whenever ticks delivers, so that tests can decide when that happens.
+// stopTicks is called once no more heartbeats will be sent.
+func register(etcd apis.EtcdInterface, address apis.ServerAddress, ttl time.Duration, ticks <-chan time.Time,
+	stopTicks func()) (*Registration, error) {
+	if err := etcd.UpdateAddress(address, apis.CHUNKSERVER); err != nil {
+		return nil, fmt.Errorf("[registration.go/UAD] %v", err)
+	}
+	if err := etcd.RegisterLive(address, apis.CHUNKSERVER, ttl); err != nil {
+		return nil, fmt.Errorf("[registration.go/RGL] %v", err)
+	}
+	r := &Registration{
+		etcd:    etcd,
+		address: address,
+		ttl:     ttl,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go r.heartbeat(ticks, stopTicks)
+	return r, nil
+}
+
+// Checks that a chunkserver's maximum chunk size matches the one recorded for the cluster, recording it if this is the
+// first chunkserver to start. A chunkserver that disagrees with the rest of the cluster must not be started, because
+// chunks that fit on one replica would be out of bounds on another.
+func AgreeOnChunkSize(etcd apis.EtcdInterface, size uint32) error {
+	recorded, err := etcd.RecordChunkSize(size)
+	if err != nil {
+		return fmt.Errorf("[registration.go/RCS] %v", err)
+	}
+	if recorded != size {
+		return fmt.Errorf("chunkserver is configured for a maximum chunk size of %d bytes, but the cluster was set up "+
+			"with a maximum of %d bytes; refusing to start", size, recorded)
+	}
+	return nil
+}
+
+func (r *Registration) heartbeat(ticks <-chan time.Time, stopTicks func()) {
+	defer close(r.done)
+	defer stopTicks()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticks:
+		}
+		if err := r.etcd.RenewLiveRegistration(); err != nil {
+			// the lease may have expired while we couldn't reach etcd, in which case the registration has to be made
+			// again from scratch
+			log.Printf("could not renew live registration of %s: %v", r.address, err)
+			if err := r.etcd.RegisterLive(r.address, apis.CHUNKSERVER, r.ttl); err != nil {
+				log.Printf("could not restore live registration of %s: %v", r.address, err)
+			}
+		}
+	}
+}
+
+// Stops sending heartbeats, without removing the registration, as if the chunkserver had crashed. Doesn't wait for a
+// heartbeat that is already underway, in case etcd is no longer there to answer it.
+func (r *Registration) abandon() {
+	close(r.stop)
+}
+
+// Removes the chunkserver's live registration, so that it stops being offered for new chunks immediately. Must only be
+// called once.
+func (r *Registration) Unregister() error {
+	r.abandon()
+	// a heartbeat that fails after this point would register the chunkserver all over again
+	<-r.done
+	if err := r.etcd.UnregisterLive(); err != nil {
+		return fmt.Errorf("[registration.go/URG] %v", err)
+	}
+	return nil
+}
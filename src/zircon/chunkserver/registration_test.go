@@ -0,0 +1,108 @@
+package chunkserver
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkupdate"
+	"zircon/etcd/mocketcd"
+)
+
+// Registers a chunkserver whose heartbeats are sent only when the test asks for them.
+func registerForTesting(t *testing.T, etcd apis.EtcdInterface, address apis.ServerAddress, ttl time.Duration) (*Registration, func()) {
+	ticks := make(chan time.Time)
+	reg, err := register(etcd, address, ttl, ticks, func() {})
+	require.NoError(t, err)
+	return reg, func() {
+		// the second tick can only be taken once the heartbeat for the first has been sent
+		ticks <- time.Time{}
+		ticks <- time.Time{}
+	}
+}
+
+func TestRegistrationLifecycle(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	store, etcds := mocketcd.PrepareSubscribeForTesting(t)
+	etcd0, teardown0 := etcds("cs0")
+	defer teardown0()
+	etcd1, teardown1 := etcds("cs1")
+	defer teardown1()
+	observer, teardown2 := etcds("observer")
+	defer teardown2()
+
+	live := func() []apis.ServerName {
+		ids, err := chunkupdate.ListLiveChunkservers(observer)
+		assert.NoError(err)
+		var names []apis.ServerName
+		for _, id := range ids {
+			name, err := observer.GetNameByID(id)
+			assert.NoError(err)
+			names = append(names, name)
+		}
+		return names
+	}
+
+	assert.Empty(live())
+	reg0, beat0 := registerForTesting(t, etcd0, "cs-address-0", time.Second)
+	reg1, beat1 := registerForTesting(t, etcd1, "cs-address-1", time.Second)
+	assert.ElementsMatch([]apis.ServerName{"cs0", "cs1"}, live())
+	address, err := observer.GetAddress("cs1", apis.CHUNKSERVER)
+	assert.NoError(err)
+	assert.Equal(apis.ServerAddress("cs-address-1"), address)
+
+	// heartbeats keep the registrations alive well past their TTL
+	for i := 0; i < 4; i++ {
+		store.Advance(700 * time.Millisecond)
+		beat0()
+		beat1()
+	}
+	assert.ElementsMatch([]apis.ServerName{"cs0", "cs1"}, live())
+
+	// once cs1 stops sending heartbeats, its registration lapses on its own
+	reg1.abandon()
+	for i := 0; i < 2; i++ {
+		store.Advance(700 * time.Millisecond)
+		beat0()
+	}
+	assert.Equal([]apis.ServerName{"cs0"}, live())
+	// but it is still known as a chunkserver, since it may yet come back with its data
+	all, err := chunkupdate.ListChunkservers(observer)
+	assert.NoError(err)
+	assert.Len(all, 2)
+
+	// a registration that lapsed while etcd couldn't be reached is made again by the next heartbeat
+	store.Advance(2 * time.Second)
+	assert.Empty(live())
+	beat0()
+	assert.Equal([]apis.ServerName{"cs0"}, live())
+
+	// a graceful shutdown removes the registration immediately
+	assert.NoError(reg0.Unregister())
+	assert.Empty(live())
+}
+
+func TestAgreeOnChunkSize(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	_, etcds := mocketcd.PrepareSubscribeForTesting(t)
+	etcd0, teardown0 := etcds("cs0")
+	defer teardown0()
+	etcd1, teardown1 := etcds("cs1")
+	defer teardown1()
+
+	// the first chunkserver to start decides the size for everyone
+	assert.NoError(AgreeOnChunkSize(etcd0, 64*1024))
+	assert.NoError(AgreeOnChunkSize(etcd1, 64*1024))
+	assert.NoError(AgreeOnChunkSize(etcd0, 64*1024))
+
+	err := AgreeOnChunkSize(etcd1, apis.MaxChunkSize)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "refusing to start")
+	}
+	recorded, err := etcd1.RecordChunkSize(apis.MaxChunkSize)
+	assert.NoError(err)
+	assert.Equal(uint32(64*1024), recorded)
+}
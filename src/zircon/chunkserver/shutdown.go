@@ -0,0 +1,24 @@
+package chunkserver
+
+import (
+	"fmt"
+	"time"
+	"zircon/chunkserver/control"
+)
+
+// Combines the teardown of a published RPC server (as returned by rpc.PublishChunkserver) with the shutdown of the
+// control layer behind it, so that a single call shuts down the whole chunkserver. The control layer goes first, so
+// that requests still arriving over RPC are cleanly rejected with ErrShuttingDown while in-flight operations finish.
+func ComposeShutdown(finish func(kill bool) error, shutdown control.Shutdown) control.Shutdown {
+	return func(deadline time.Time) error {
+		err1 := shutdown(deadline)
+		err2 := finish(true)
+		if err1 == nil {
+			return err2
+		} else if err2 == nil {
+			return err1
+		} else {
+			return fmt.Errorf("multiple errors: { %v } and { %v }", err1, err2)
+		}
+	}
+}
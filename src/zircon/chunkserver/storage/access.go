@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+// A ChunkStorage that remembers when each chunk was last read or written, so that a chunkserver with bounded storage,
+// such as a cache tier, can pick out the chunks that have gone coldest and drop them. Wraps any real backend, which does
+// all of the actual work. Which of the cold chunks are safe to drop, because enough copies of them live elsewhere, is up
+// to the eviction policy; this only says how recently they were used.
+//
+// Access times are only kept in memory. Chunks that are already in the backend when it's wrapped are treated as having
+// been accessed right then, in no particular order, so that they neither jump the queue nor hang on forever.
+type AccessTrackingStorage struct {
+	ChunkStorage
+
+	mu       sync.Mutex
+	accessed map[apis.ChunkNum]chunkAccess
+	// incremented on every access, so that accesses made within the same tick of the clock still have an order
+	sequence uint64
+	now      func() time.Time
+}
+
+type chunkAccess struct {
+	at       time.Time
+	sequence uint64
+}
+
+var _ ChunkStorage = &AccessTrackingStorage{}
+var _ VersionOpener = &AccessTrackingStorage{}
+var _ MappedReader = &AccessTrackingStorage{}
+var _ CursorOpener = &AccessTrackingStorage{}
+
+func WithAccessTracking(inner ChunkStorage) (*AccessTrackingStorage, error) {
+	a := &AccessTrackingStorage{
+		ChunkStorage: inner,
+		accessed:     map[apis.ChunkNum]chunkAccess{},
+		now:          time.Now,
+	}
+	chunks, err := inner.ListChunksWithData()
+	if err != nil {
+		return nil, fmt.Errorf("[access.go/LST] %v", err)
+	}
+	for _, chunk := range chunks {
+		a.touch(chunk)
+	}
+	return a, nil
+}
+
+func (a *AccessTrackingStorage) touch(chunk apis.ChunkNum) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.sequence += 1
+	a.accessed[chunk] = chunkAccess{at: a.now(), sequence: a.sequence}
+}
+
+// Once the last version of a chunk is gone, there's nothing left to evict.
+func (a *AccessTrackingStorage) forgetIfGone(chunk apis.ChunkNum) error {
+	versions, err := a.ChunkStorage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		a.mu.Lock()
+		delete(a.accessed, chunk)
+		a.mu.Unlock()
+	}
+	return nil
+}
+
+// Get the last time a chunk was read or written. ok is false if the chunk has no data stored.
+func (a *AccessTrackingStorage) LastAccess(chunk apis.ChunkNum) (accessed time.Time, ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	access, ok := a.accessed[chunk]
+	return access.at, ok
+}
+
+// List up to n of the chunks that have gone the longest without being read or written, least recently used first.
+func (a *AccessTrackingStorage) ColdestChunks(n int) []apis.ChunkNum {
+	a.mu.Lock()
+	chunks := make([]apis.ChunkNum, 0, len(a.accessed))
+	sequences := make(map[apis.ChunkNum]uint64, len(a.accessed))
+	for chunk, access := range a.accessed {
+		chunks = append(chunks, chunk)
+		sequences[chunk] = access.sequence
+	}
+	a.mu.Unlock()
+
+	sort.Slice(chunks, func(i, j int) bool {
+		return sequences[chunks[i]] < sequences[chunks[j]]
+	})
+	if n < 0 {
+		n = 0
+	}
+	if n < len(chunks) {
+		chunks = chunks[:n]
+	}
+	return chunks
+}
+
+func (a *AccessTrackingStorage) ReadVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
+	data, err := a.ChunkStorage.ReadVersion(chunk, version)
+	if err == nil {
+		a.touch(chunk)
+	}
+	return data, err
+}
+
+func (a *AccessTrackingStorage) ReadVersionInto(chunk apis.ChunkNum, version apis.Version, buf []byte) ([]byte, error) {
+	data, err := ReadVersionInto(a.ChunkStorage, chunk, version, buf)
+	if err == nil {
+		a.touch(chunk)
+	}
+	return data, err
+}
+
+// Fails if the backend can't open versions, which only means that the version has to be read some other way.
+func (a *AccessTrackingStorage) OpenVersion(chunk apis.ChunkNum, version apis.Version) (VersionFile, error) {
+	opener, ok := a.ChunkStorage.(VersionOpener)
+	if !ok {
+		return VersionFile{}, fmt.Errorf("underlying storage cannot open %d/%d", chunk, version)
+	}
+	file, err := opener.OpenVersion(chunk, version)
+	if err == nil {
+		a.touch(chunk)
+	}
+	return file, err
+}
+
+func (a *AccessTrackingStorage) MapsVersions() bool {
+	mapper, ok := a.ChunkStorage.(MappedReader)
+	return ok && mapper.MapsVersions()
+}
+
+func (a *AccessTrackingStorage) ReadVersionMapped(chunk apis.ChunkNum, version apis.Version) ([]byte, func(), error) {
+	mapper, ok := a.ChunkStorage.(MappedReader)
+	if !ok {
+		data, err := a.ReadVersion(chunk, version)
+		return data, func() {}, err
+	}
+	data, release, err := mapper.ReadVersionMapped(chunk, version)
+	if err == nil {
+		a.touch(chunk)
+	}
+	return data, release, err
+}
+
+// Iterating over the stored chunks doesn't count as using them.
+func (a *AccessTrackingStorage) OpenCursor(token CursorToken) (Cursor, error) {
+	return OpenCursor(a.ChunkStorage, token)
+}
+
+func (a *AccessTrackingStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	if err := a.ChunkStorage.WriteVersion(chunk, version, data); err != nil {
+		return err
+	}
+	a.touch(chunk)
+	return nil
+}
+
+func (a *AccessTrackingStorage) LinkVersion(chunk apis.ChunkNum, existing apis.Version, version apis.Version) error {
+	if err := a.ChunkStorage.LinkVersion(chunk, existing, version); err != nil {
+		return err
+	}
+	a.touch(chunk)
+	return nil
+}
+
+func (a *AccessTrackingStorage) DeleteVersion(chunk apis.ChunkNum, version apis.Version) error {
+	if err := a.ChunkStorage.DeleteVersion(chunk, version); err != nil {
+		return err
+	}
+	return a.forgetIfGone(chunk)
+}
+
+func (a *AccessTrackingStorage) CompactChunk(chunk apis.ChunkNum, oldest apis.Version) (CompactionResult, error) {
+	result, err := CompactChunk(a.ChunkStorage, chunk, oldest)
+	if err != nil {
+		return result, err
+	}
+	return result, a.forgetIfGone(chunk)
+}
+
+func (a *AccessTrackingStorage) QuarantineVersion(chunk apis.ChunkNum, version apis.Version) error {
+	quarantiner, ok := a.ChunkStorage.(Quarantiner)
+	if !ok {
+		return fmt.Errorf("underlying storage cannot quarantine %d/%d", chunk, version)
+	}
+	if err := quarantiner.QuarantineVersion(chunk, version); err != nil {
+		return err
+	}
+	return a.forgetIfGone(chunk)
+}
+
+func (a *AccessTrackingStorage) PurgeQuarantine(cutoff time.Time) (int, error) {
+	if purger, ok := a.ChunkStorage.(QuarantinePurger); ok {
+		return purger.PurgeQuarantine(cutoff)
+	}
+	return 0, nil
+}
+
+func (a *AccessTrackingStorage) Durability() Durability {
+	return DurabilityOf(a.ChunkStorage)
+}
+
+func (a *AccessTrackingStorage) KeepStaged(write StagedWrite) error {
+	if keeper, ok := a.ChunkStorage.(StagedWriteKeeper); ok {
+		return keeper.KeepStaged(write)
+	}
+	return nil
+}
+
+func (a *AccessTrackingStorage) ForgetStaged(hash apis.CommitHash) error {
+	if keeper, ok := a.ChunkStorage.(StagedWriteKeeper); ok {
+		return keeper.ForgetStaged(hash)
+	}
+	return nil
+}
+
+func (a *AccessTrackingStorage) ListStaged() ([]StagedWrite, error) {
+	if keeper, ok := a.ChunkStorage.(StagedWriteKeeper); ok {
+		return keeper.ListStaged()
+	}
+	return nil, nil
+}
+
+func (a *AccessTrackingStorage) SetCommitHashes(chunk apis.ChunkNum, version apis.Version, hashes []apis.CommitHash) error {
+	if keeper, ok := a.ChunkStorage.(CommitHashKeeper); ok {
+		return keeper.SetCommitHashes(chunk, version, hashes)
+	}
+	return nil
+}
+
+func (a *AccessTrackingStorage) CommitHashes(chunk apis.ChunkNum, version apis.Version) ([]apis.CommitHash, error) {
+	if keeper, ok := a.ChunkStorage.(CommitHashKeeper); ok {
+		return keeper.CommitHashes(chunk, version)
+	}
+	return nil, nil
+}
+
+func (a *AccessTrackingStorage) KeepTombstone(tombstone apis.Tombstone) error {
+	if keeper, ok := a.ChunkStorage.(TombstoneKeeper); ok {
+		return keeper.KeepTombstone(tombstone)
+	}
+	return nil
+}
+
+func (a *AccessTrackingStorage) ForgetTombstone(chunk apis.ChunkNum) error {
+	if keeper, ok := a.ChunkStorage.(TombstoneKeeper); ok {
+		return keeper.ForgetTombstone(chunk)
+	}
+	return nil
+}
+
+func (a *AccessTrackingStorage) ListTombstones() ([]apis.Tombstone, error) {
+	if keeper, ok := a.ChunkStorage.(TombstoneKeeper); ok {
+		return keeper.ListTombstones()
+	}
+	return nil, nil
+}
+
+func (a *AccessTrackingStorage) Space() (StorageSpace, bool, error) {
+	if reporter, ok := a.ChunkStorage.(SpaceReporter); ok {
+		return reporter.Space()
+	}
+	return StorageSpace{}, false, nil
+}
+
+func (a *AccessTrackingStorage) IntegrityReport() (IntegrityReport, bool) {
+	if reporter, ok := a.ChunkStorage.(IntegrityReporter); ok {
+		return reporter.IntegrityReport()
+	}
+	return IntegrityReport{}, false
+}
+
+func (a *AccessTrackingStorage) SetMaxChunkSize(size uint32) bool {
+	return SetMaxChunkSize(a.ChunkStorage, size)
+}
+
+func (a *AccessTrackingStorage) SetMetricsSink(sink MetricsSink) bool {
+	return SetMetricsSink(a.ChunkStorage, sink)
+}
+
+func (a *AccessTrackingStorage) VerifyAll(ctx context.Context, options VerifyOptions, found func(apis.VerifyFinding)) (apis.VerifyReport, error) {
+	return VerifyAll(ctx, a.ChunkStorage, options, found)
+}
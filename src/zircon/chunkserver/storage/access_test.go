@@ -0,0 +1,118 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+func TestAccessOrderFollowsReads(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	require.NoError(t, mem.WriteVersion(1, 1, []byte("already here")))
+
+	tracked, err := WithAccessTracking(mem)
+	require.NoError(t, err)
+	clock := time.Unix(1000, 0)
+	tracked.now = func() time.Time {
+		return clock
+	}
+
+	for chunk := apis.ChunkNum(2); chunk <= 4; chunk++ {
+		require.NoError(t, tracked.WriteVersion(chunk, 1, []byte("data")))
+	}
+	// chunks that were there before tracking started are the coldest
+	assert.Equal([]apis.ChunkNum{1, 2, 3, 4}, tracked.ColdestChunks(10))
+
+	// reads made within the same instant still count in the order they happened
+	clock = clock.Add(time.Minute)
+	for _, chunk := range []apis.ChunkNum{3, 1, 2} {
+		_, err := tracked.ReadVersion(chunk, 1)
+		assert.NoError(err)
+	}
+	assert.Equal([]apis.ChunkNum{4, 3, 1, 2}, tracked.ColdestChunks(10))
+	assert.Equal([]apis.ChunkNum{4, 3}, tracked.ColdestChunks(2))
+
+	accessed, ok := tracked.LastAccess(3)
+	assert.True(ok)
+	assert.Equal(time.Unix(1060, 0), accessed)
+
+	// failed reads don't count, but every way of writing does
+	_, err = tracked.ReadVersion(4, 7)
+	assert.Error(err)
+	_, err = tracked.ReadVersionInto(3, 1, make([]byte, ReadBufferSize))
+	assert.NoError(err)
+	assert.NoError(tracked.LinkVersion(1, 1, 2))
+	assert.Equal([]apis.ChunkNum{4, 2, 3, 1}, tracked.ColdestChunks(10))
+
+	// a chunk stays listed until its last version is gone
+	assert.NoError(tracked.DeleteVersion(1, 1))
+	assert.Equal([]apis.ChunkNum{4, 2, 3, 1}, tracked.ColdestChunks(10))
+	assert.NoError(tracked.DeleteVersion(1, 2))
+	assert.Equal([]apis.ChunkNum{4, 2, 3}, tracked.ColdestChunks(10))
+	_, ok = tracked.LastAccess(1)
+	assert.False(ok)
+	assert.Empty(tracked.ColdestChunks(0))
+	assert.Empty(tracked.ColdestChunks(-1))
+}
+
+func TestAccessTrackingForwardsFastReads(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "access-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs, err := ConfigureFilesystemStorageWithOptions(dir, FilesystemOptions{MappedReadCapacity: 1024 * 1024})
+	require.NoError(t, err)
+	defer fs.Close()
+	for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+		require.NoError(t, fs.WriteVersion(chunk, 1, []byte("data")))
+	}
+
+	tracked, err := WithAccessTracking(fs)
+	require.NoError(t, err)
+	assert.Equal(fs.(MappedReader).MapsVersions(), tracked.MapsVersions())
+
+	// reads that skip ReadVersion still count as accesses
+	data, release, err := tracked.ReadVersionMapped(1, 1)
+	if assert.NoError(err) {
+		assert.Equal([]byte("data"), data)
+		release()
+	}
+	file, err := tracked.OpenVersion(2, 1)
+	if assert.NoError(err) {
+		file.File.Close()
+	}
+	assert.Equal([]apis.ChunkNum{3, 1, 2}, tracked.ColdestChunks(10))
+
+	// but iterating over the chunks doesn't
+	cursor, err := tracked.OpenCursor("")
+	require.NoError(t, err)
+	versions, err := cursor.Next(10)
+	assert.NoError(err)
+	assert.Len(versions, 3)
+	assert.Equal([]apis.ChunkNum{3, 1, 2}, tracked.ColdestChunks(10))
+
+	// a backend that can't open versions says so, so that the caller falls back to reading them
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	require.NoError(t, mem.WriteVersion(1, 1, []byte("data")))
+	trackedMem, err := WithAccessTracking(mem)
+	require.NoError(t, err)
+	_, err = trackedMem.OpenVersion(1, 1)
+	assert.Error(err)
+	assert.False(trackedMem.MapsVersions())
+	data, release, err = trackedMem.ReadVersionMapped(1, 1)
+	if assert.NoError(err) {
+		assert.Equal([]byte("data"), data)
+		release()
+	}
+}
@@ -1,6 +1,12 @@
 package storage
 
-import "zircon/apis"
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+	"zircon/apis"
+)
 
 // An interface to a storage system for chunks and version information.
 // This interface is expected to be write-immediate; changes made should be
@@ -19,9 +25,13 @@ type ChunkStorage interface {
 	// note: version *cannot* be AnyVersion
 	ReadVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error)
 	// Write the entire contents of a new version for a chunk.
-	// data cannot be larger than apis.MaxChunkSize. The storage layer may pad
-	// out the written data with additional zeroes, up to apis.MaxChunkSize.
+	// data cannot be larger than apis.MaxChunkSize, or the size set by SetMaxChunkSize. The storage layer may pad
+	// out the written data with additional zeroes, up to that size.
+	// The storage must not keep hold of data once this returns, so that the caller can reuse it.
 	WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error
+	// Store a new version of a chunk with exactly the same contents as an existing version, sharing the stored bytes
+	// if the backend is able to. Deleting either version afterwards leaves the other intact.
+	LinkVersion(chunk apis.ChunkNum, existing apis.Version, version apis.Version) error
 	// Delete an existing version of a chunk.
 	DeleteVersion(chunk apis.ChunkNum, version apis.Version) error
 
@@ -38,7 +48,287 @@ type ChunkStorage interface {
 	// Remove records storing the latest version for a particular chunk.
 	DeleteLatestVersion(chunk apis.ChunkNum) error
 
+	// *** part 3: staged writes ***
+
+	// Account for the data of a write that has been started but not yet committed, which the chunkserver holds in
+	// memory until then. Fails with ErrOutOfSpace if the storage has a size limit that this would exceed.
+	StageData(bytes int) error
+	// Release space previously accounted for by StageData, once the write has been committed or discarded.
+	UnstageData(bytes int)
+
+	// *** part 4: housekeeping ***
+
+	// Report what the storage currently holds. Meant for monitoring, so it may have to list every chunk to find out.
+	Stats() (StorageStats, error)
+
+	// Make sure that every mutation made so far has reached stable storage. Called before shutting down.
+	Flush() error
+
 	// Empty any caches and tear down all storage state.
 	// Use of other methods after call this method is undefined behavior. Calling Close() again has no effect.
 	Close()
 }
+
+// A snapshot of what a storage backend holds.
+type StorageStats struct {
+	// Chunks with at least one stored version, and stored versions across all of those chunks
+	Chunks   uint64
+	Versions uint64
+	// How many versions each chunk has stored; all zero if there are no chunks
+	VersionsPerChunk VersionSpread
+	// Bytes of chunk data as actually stored, after any compression, deltas, or sharing between linked versions
+	CommittedBytes uint64
+	// Bytes of disk actually allocated to hold CommittedBytes, which is less if the backend leaves holes in sparse
+	// chunks. Zero if the backend can't tell; storage made up of several backends only counts the ones that can.
+	AllocatedBytes uint64
+	// Bytes accounted for by StageData that haven't been released yet
+	StagedBytes uint64
+	// Bytes of bookkeeping kept besides chunk data, such as latest versions, commit hashes, and tombstones. Zero if the
+	// backend doesn't count it.
+	OverheadBytes uint64
+	// File descriptors that the backend keeps open between calls, such as for a write-ahead log
+	OpenFiles uint64
+}
+
+type VersionSpread struct {
+	Min  uint64
+	Max  uint64
+	Mean float64
+}
+
+// Fills in the chunk and version counts of stats by listing everything in a storage backend.
+func countVersions(storage ChunkStorage, stats *StorageStats) error {
+	chunks, err := storage.ListChunksWithData()
+	if err != nil {
+		return err
+	}
+	stats.Chunks, stats.Versions, stats.VersionsPerChunk = 0, 0, VersionSpread{}
+	for _, chunk := range chunks {
+		versions, err := storage.ListVersions(chunk)
+		if err != nil {
+			return err
+		}
+		count := uint64(len(versions))
+		if count == 0 {
+			continue
+		}
+		if stats.Chunks == 0 || count < stats.VersionsPerChunk.Min {
+			stats.VersionsPerChunk.Min = count
+		}
+		if count > stats.VersionsPerChunk.Max {
+			stats.VersionsPerChunk.Max = count
+		}
+		stats.Chunks += 1
+		stats.Versions += count
+	}
+	if stats.Chunks > 0 {
+		stats.VersionsPerChunk.Mean = float64(stats.Versions) / float64(stats.Chunks)
+	}
+	return nil
+}
+
+// Implemented by storage backends that can set damaged data aside, rather than only being able to delete it.
+type Quarantiner interface {
+	// Move a version out of the way, so that it is no longer listed, but keep its data around for later inspection.
+	QuarantineVersion(chunk apis.ChunkNum, version apis.Version) error
+}
+
+// Implemented by Quarantiners that can clean up after themselves, once quarantined data has been kept long enough to
+// be inspected.
+type QuarantinePurger interface {
+	// Permanently remove every version that was quarantined before the cutoff. Returns how many were removed.
+	PurgeQuarantine(cutoff time.Time) (int, error)
+}
+
+// How hard a storage backend works to make sure that acknowledged changes survive a power loss.
+type Durability int
+
+const (
+	// Leave it to the operating system to write changes out eventually.
+	DurabilityNone Durability = iota
+	// Before a new version is acknowledged, sync its data and the directory entry naming it. Since the latest version
+	// is only ever pointed at a version that has already been written, a crash can never expose a latest version whose
+	// data was lost.
+	DurabilityCommit
+	// Like DurabilityCommit, but also sync staged writes before they are acknowledged, so that they can still be
+	// committed after a crash.
+	DurabilityStageAndCommit
+)
+
+var durabilityNames = []string{"none", "commit", "stage-and-commit"}
+
+func (d Durability) String() string {
+	if d < 0 || int(d) >= len(durabilityNames) {
+		return fmt.Sprintf("durability(%d)", int(d))
+	}
+	return durabilityNames[d]
+}
+
+// Parses the name of a durability level, as returned by String. An empty name means DurabilityNone.
+func ParseDurability(name string) (Durability, error) {
+	if name == "" {
+		return DurabilityNone, nil
+	}
+	for i, known := range durabilityNames {
+		if name == known {
+			return Durability(i), nil
+		}
+	}
+	return DurabilityNone, fmt.Errorf("no such durability level: %s", name)
+}
+
+// Implemented by storage backends that can report their durability level. Anything else is assumed to be
+// DurabilityNone.
+type DurabilityReporter interface {
+	Durability() Durability
+}
+
+// A write that has been started but not yet committed.
+type StagedWrite struct {
+	Hash   apis.CommitHash
+	Offset uint32
+	Data   []byte
+}
+
+// Implemented by storage backends that can hold on to staged writes across a restart. Whether they actually do is up
+// to their durability level; below DurabilityStageAndCommit, KeepStaged may do nothing.
+type StagedWriteKeeper interface {
+	// Hold on to a newly staged write, until ForgetStaged is called for its hash.
+	KeepStaged(write StagedWrite) error
+	// Discard a staged write, once it has been committed or abandoned. Does nothing if the write was never kept.
+	ForgetStaged(hash apis.CommitHash) error
+	// List every staged write that is being held on to, including ones kept before a restart, in no particular order.
+	ListStaged() ([]StagedWrite, error)
+}
+
+// Implemented by storage that can read a version into a buffer supplied by the caller, so that the buffers used for
+// reads can be reused rather than allocated afresh every time.
+type BufferedReader interface {
+	// Like ReadVersion, but the result is placed in buf if buf has enough capacity for it, and may share buf's memory.
+	// A buffer of ReadBufferSize bytes is always enough.
+	ReadVersionInto(chunk apis.ChunkNum, version apis.Version, buf []byte) ([]byte, error)
+}
+
+// Enough room for ReadVersionInto to read any version of a chunk without allocating, including the header that some
+// backends read along with the data.
+const ReadBufferSize = apis.MaxChunkSize + chunkFileHeaderSize
+
+// Like ReadBufferSize, but only enough for chunks no larger than chunkSize, for deployments that use smaller chunks.
+func ReadBufferSizeFor(chunkSize uint32) int {
+	return int(chunkSize) + chunkFileHeaderSize
+}
+
+// The file holding a stored version, opened so that its data can be sent straight from the file. See VersionOpener.
+type VersionFile struct {
+	File *os.File
+	// Where the version's data starts within the file, and how many bytes of it there are.
+	Offset int64
+	Length int64
+	// The CRC-32 (IEEE) of the data, as recorded when the version was written.
+	Checksum uint32
+}
+
+// Implemented by storage that keeps every version in a file of its own, so that large reads can be sent from the file
+// without being read into memory first.
+type VersionOpener interface {
+	// Opens the file holding a version, which the caller must close. Versions are never modified in place, so the file
+	// keeps its contents until it's closed, even if the version is deleted or replaced in the meantime. Fails for any
+	// version that can't be checked against a recorded checksum.
+	OpenVersion(chunk apis.ChunkNum, version apis.Version) (VersionFile, error)
+}
+
+// Implemented by storage that can map versions into memory, so that they can be read without being copied first.
+type MappedReader interface {
+	// Whether ReadVersionMapped actually maps versions, rather than reading them into buffers of their own; if not,
+	// ReadVersionInto with a reused buffer is the better choice.
+	MapsVersions() bool
+	// Like ReadVersion, but the result may be part of a mapping of the stored version. It must not be modified, and
+	// must not be used once the returned release function has been called, which must happen exactly once.
+	ReadVersionMapped(chunk apis.ChunkNum, version apis.Version) (data []byte, release func(), err error)
+}
+
+// Reads a version into buf if the storage supports it, and allocates a new slice for it otherwise.
+func ReadVersionInto(storage ChunkStorage, chunk apis.ChunkNum, version apis.Version, buf []byte) ([]byte, error) {
+	if reader, ok := storage.(BufferedReader); ok {
+		return reader.ReadVersionInto(chunk, version, buf)
+	}
+	return storage.ReadVersion(chunk, version)
+}
+
+// Reports the durability level of any storage, treating storage that can't report one as DurabilityNone.
+func DurabilityOf(storage ChunkStorage) Durability {
+	if reporter, ok := storage.(DurabilityReporter); ok {
+		return reporter.Durability()
+	}
+	return DurabilityNone
+}
+
+// How full a storage backend is, counting everything it holds, including staged writes if it keeps track of them.
+type StorageSpace struct {
+	UsedBytes  uint64
+	TotalBytes uint64
+}
+
+// Implemented by storage backends that know how much room they have.
+type SpaceReporter interface {
+	// ok is false if this storage has no fixed limit on how much it can hold.
+	Space() (space StorageSpace, ok bool, err error)
+}
+
+// Implemented by storage backends that can check their files when they're opened; see IntegrityCheck.
+type IntegrityReporter interface {
+	// What the check found and did. ok is false if no check was made.
+	IntegrityReport() (report IntegrityReport, ok bool)
+}
+
+// Implemented by storage backends that can check what they hold more thoroughly than by reading every version; see
+// VerifyAll.
+type IntegrityVerifier interface {
+	// Check every stored version against its recorded length and checksum, and every latest version against the
+	// versions stored, handing each finding to found as it's made, never while holding options.Lock. The report has
+	// the totals, but no findings. Stops early with ctx's error if ctx is cancelled.
+	VerifyAll(ctx context.Context, options VerifyOptions, found func(apis.VerifyFinding)) (apis.VerifyReport, error)
+}
+
+// Implemented by storage backends that check the size of each version they write; see SetMaxChunkSize.
+type ChunkSizeLimiter interface {
+	// Refuse versions larger than size from now on, rather than only those larger than apis.MaxChunkSize. Returns false
+	// if nothing will actually be refused, as for a wrapper around storage that doesn't check sizes.
+	SetMaxChunkSize(size uint32) bool
+}
+
+// Implemented by storage backends that can report measurements to a MetricsSink. Until a sink is set, measurements go
+// nowhere.
+type MetricsReporter interface {
+	// Send measurements to sink from now on. Must be called before the storage is in use. A nil sink discards them.
+	// Returns false if nothing will actually be measured, as for a wrapper around storage that doesn't report any.
+	SetMetricsSink(sink MetricsSink) bool
+}
+
+// Implemented by storage backends that can do more to tidy up a chunk than deleting its old versions; see CompactChunk.
+type ChunkCompactor interface {
+	// Remove every version of a chunk older than oldest, and rewrite whatever is kept of the rest into a more compact
+	// form, without changing what any remaining version reads as.
+	CompactChunk(chunk apis.ChunkNum, oldest apis.Version) (CompactionResult, error)
+}
+
+// Implemented by storage backends that can remember which chunks were deleted, so that a chunkserver still knows about
+// its tombstones after a restart.
+type TombstoneKeeper interface {
+	// Record a tombstone, replacing any earlier tombstone for the same chunk.
+	KeepTombstone(tombstone apis.Tombstone) error
+	// Discard the tombstone for a chunk. Does nothing if there isn't one.
+	ForgetTombstone(chunk apis.ChunkNum) error
+	// List every tombstone being held on to, in no particular order.
+	ListTombstones() ([]apis.Tombstone, error)
+}
+
+// Implemented by storage backends that can record the hashes of the commits that produced each version of a chunk, so
+// that they can be listed without reading the chunk's data. A version's hashes go away along with the version.
+type CommitHashKeeper interface {
+	// Record the hashes of the commits that produced an existing version, in the order they were applied, replacing any
+	// recorded before.
+	SetCommitHashes(chunk apis.ChunkNum, version apis.Version, hashes []apis.CommitHash) error
+	// Look up the hashes recorded for a version. Returns nil if there are none.
+	CommitHashes(chunk apis.ChunkNum, version apis.Version) ([]apis.CommitHash, error)
+}
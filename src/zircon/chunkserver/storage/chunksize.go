@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"fmt"
+	"sync/atomic"
+	"zircon/apis"
+)
+
+// Has storage refuse versions larger than size, for chunkservers configured with a maximum chunk size below
+// apis.MaxChunkSize. Returns false if the storage doesn't check the size of what it writes, and so accepts versions of
+// up to apis.MaxChunkSize regardless.
+func SetMaxChunkSize(storage ChunkStorage, size uint32) bool {
+	if limiter, ok := storage.(ChunkSizeLimiter); ok {
+		return limiter.SetMaxChunkSize(size)
+	}
+	return false
+}
+
+// The largest version that a storage accepts. The zero value is apis.MaxChunkSize.
+type chunkSizeLimit struct {
+	// accessed atomically, since nothing stops it from being set while the storage is in use
+	size uint32
+}
+
+func (l *chunkSizeLimit) set(size uint32) {
+	atomic.StoreUint32(&l.size, size)
+}
+
+func (l *chunkSizeLimit) get() int {
+	size := atomic.LoadUint32(&l.size)
+	if size == 0 || size > apis.MaxChunkSize {
+		return apis.MaxChunkSize
+	}
+	return int(size)
+}
+
+// Returns an error if data is too large to be written as a version of a chunk.
+func (l *chunkSizeLimit) check(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	if len(data) > l.get() {
+		return fmt.Errorf("chunk is too large: %d/%d = data[%d]", chunk, version, len(data))
+	}
+	return nil
+}
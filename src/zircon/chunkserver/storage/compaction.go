@@ -0,0 +1,548 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+// How long background compaction waits after each pass over every chunk, unless configured otherwise.
+const DefaultCompactionInterval = time.Hour
+
+// How many of each chunk's newest versions background compaction keeps, latest included, unless configured otherwise.
+// The one before the latest is kept so that a read that was started against metadata that hadn't caught up with the
+// newest version yet still finds what it asked for.
+const DefaultCompactionKeepVersions = 2
+
+// What compacting a chunk did. Counts add up across layers of storage and across chunks.
+type CompactionResult struct {
+	// Versions removed for being older than the oldest version to keep
+	RemovedVersions uint64
+	// Versions that were stored as deltas, and were rewritten as full copies
+	MaterializedVersions uint64
+	// Chunk directories that were rewritten to give back the space they had grown to
+	RewrittenDirectories uint64
+	// Bytes of storage given back by removing files, not counting files that are still linked elsewhere
+	ReclaimedBytes uint64
+	// Bytes read and written along the way, which is what counts against CompactionOptions.BytesPerSecond
+	IOBytes uint64
+}
+
+func (r *CompactionResult) add(other CompactionResult) {
+	r.RemovedVersions += other.RemovedVersions
+	r.MaterializedVersions += other.MaterializedVersions
+	r.RewrittenDirectories += other.RewrittenDirectories
+	r.ReclaimedBytes += other.ReclaimedBytes
+	r.IOBytes += other.IOBytes
+}
+
+// Compacts a chunk with the storage's own ChunkCompactor if it has one, and otherwise by just deleting the versions
+// older than oldest.
+func CompactChunk(storage ChunkStorage, chunk apis.ChunkNum, oldest apis.Version) (CompactionResult, error) {
+	if compactor, ok := storage.(ChunkCompactor); ok {
+		return compactor.CompactChunk(chunk, oldest)
+	}
+	var result CompactionResult
+	versions, err := storage.ListVersions(chunk)
+	if err != nil {
+		return result, err
+	}
+	for _, version := range versions {
+		if version >= oldest {
+			break
+		}
+		if err := storage.DeleteVersion(chunk, version); err != nil {
+			return result, err
+		}
+		result.RemovedVersions += 1
+	}
+	return result, nil
+}
+
+type CompactionOptions struct {
+	// Most bytes per second that compaction reads and writes, on average. Zero means no limit.
+	BytesPerSecond int64
+	// How long to wait after each pass over every chunk before starting the next. Zero means
+	// DefaultCompactionInterval.
+	Interval time.Duration
+	// How many of each chunk's newest versions to keep, the latest included. Zero means
+	// DefaultCompactionKeepVersions.
+	KeepVersions int
+	// How long a version has to have been superseded before it's removed, on top of KeepVersions. Compaction only
+	// notices that a version was superseded when a pass comes across it, so versions can be kept for up to one
+	// Interval longer than this. Zero means versions are removed as soon as KeepVersions allows.
+	MinAge time.Duration
+}
+
+func (o CompactionOptions) Validate() error {
+	if o.BytesPerSecond < 0 {
+		return fmt.Errorf("compaction bandwidth cannot be negative: %d", o.BytesPerSecond)
+	}
+	if o.Interval < 0 {
+		return fmt.Errorf("compaction interval cannot be negative: %v", o.Interval)
+	}
+	if o.KeepVersions < 0 {
+		return fmt.Errorf("number of versions to keep cannot be negative: %d", o.KeepVersions)
+	}
+	if o.MinAge < 0 {
+		return fmt.Errorf("minimum age of removed versions cannot be negative: %v", o.MinAge)
+	}
+	return nil
+}
+
+func (o CompactionOptions) keepVersions() int {
+	if o.KeepVersions == 0 {
+		return DefaultCompactionKeepVersions
+	}
+	return o.KeepVersions
+}
+
+// Takes whatever has to be held to use the storage, and returns the function that gives it back. Fails if the storage
+// can't be used any more, such as while shutting down, in which case compaction gives up on the rest of its pass.
+type CompactionGuard func() (release func(), err error)
+
+// Guards compaction with a plain lock, which never fails.
+func LockGuard(lock sync.Locker) CompactionGuard {
+	return func() (func(), error) {
+		lock.Lock()
+		return lock.Unlock, nil
+	}
+}
+
+type CompactionStats struct {
+	Paused bool
+	// Passes over every chunk that have finished
+	Passes uint64
+	// How many chunks the current pass has got through, out of how many it covers
+	PassDone  uint64
+	PassTotal uint64
+	// Everything done since compaction was started
+	Totals CompactionResult
+}
+
+// Tidies up storage in the background, one chunk at a time, by going over every chunk that has a latest version
+// and compacting it. Versions older than the latest are removed once they fall outside of the retention window set by
+// CompactionOptions.KeepVersions and CompactionOptions.MinAge.
+//
+// The storage isn't threadsafe, so each chunk is compacted while holding the guard that everything else using the
+// storage holds. Every step of compacting a chunk is atomic on its own, so a crash partway through leaves every version
+// readable. Versions are only removed while nothing else holds the lock, and anything reading a version after giving
+// up the lock does so through a file or mapping opened beforehand, which stays readable after the version is removed.
+type Compaction struct {
+	storage ChunkStorage
+	guard   CompactionGuard
+	options CompactionOptions
+	now     func() time.Time
+	// only used by the compaction goroutine; when each chunk's versions were first found to be superseded
+	superseded map[apis.ChunkNum]map[apis.Version]time.Time
+
+	mu      sync.Mutex
+	resumed *sync.Cond
+	paused  bool
+	stopped bool
+	stop    chan struct{}
+	done    chan struct{}
+	stats   CompactionStats
+}
+
+// Starts compacting storage in the background, holding lock around every use of the storage. Stop must be called
+// once the storage is no longer to be used.
+func StartCompaction(storage ChunkStorage, lock sync.Locker, options CompactionOptions) *Compaction {
+	return StartGuardedCompaction(storage, LockGuard(lock), options)
+}
+
+// Like StartCompaction, but holds a guard that can fail rather than a lock.
+func StartGuardedCompaction(storage ChunkStorage, guard CompactionGuard, options CompactionOptions) *Compaction {
+	return startCompaction(storage, guard, options, time.Now)
+}
+
+func startCompaction(storage ChunkStorage, guard CompactionGuard, options CompactionOptions, now func() time.Time) *Compaction {
+	c := &Compaction{
+		storage:    storage,
+		guard:      guard,
+		options:    options,
+		now:        now,
+		superseded: map[apis.ChunkNum]map[apis.Version]time.Time{},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	c.resumed = sync.NewCond(&c.mu)
+	go c.run()
+	return c
+}
+
+// Stops compaction from starting on any more chunks until Resume is called. A chunk already being compacted is
+// finished first.
+func (c *Compaction) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = true
+	c.stats.Paused = true
+}
+
+func (c *Compaction) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.paused = false
+	c.stats.Paused = false
+	c.resumed.Broadcast()
+}
+
+func (c *Compaction) Stats() CompactionStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Stops compaction for good, waiting for the chunk being compacted, if any, to be finished. Must not be called while
+// holding the lock that compaction takes.
+func (c *Compaction) Stop() {
+	c.mu.Lock()
+	if !c.stopped {
+		c.stopped = true
+		close(c.stop)
+		c.resumed.Broadcast()
+	}
+	c.mu.Unlock()
+	<-c.done
+}
+
+func (c *Compaction) run() {
+	defer close(c.done)
+	interval := c.options.Interval
+	if interval == 0 {
+		interval = DefaultCompactionInterval
+	}
+	for {
+		if err := c.pass(); err != nil && !c.isStopped() {
+			log.Printf("compaction pass failed: %v", err)
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Waits until compaction isn't paused. Returns false if it was stopped instead.
+func (c *Compaction) waitWhilePaused() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.paused && !c.stopped {
+		c.resumed.Wait()
+	}
+	return !c.stopped
+}
+
+func (c *Compaction) isStopped() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stopped
+}
+
+// Goes over every chunk once. Problems with a single chunk are logged, and don't hold up the rest.
+func (c *Compaction) pass() error {
+	release, err := c.guard()
+	if err != nil {
+		return fmt.Errorf("[compaction.go/GRD] %v", err)
+	}
+	chunks, err := c.storage.ListChunksWithLatest()
+	release()
+	if err != nil {
+		return fmt.Errorf("[compaction.go/LCL] %v", err)
+	}
+	sortChunks(chunks)
+	c.mu.Lock()
+	c.stats.PassDone, c.stats.PassTotal = 0, uint64(len(chunks))
+	c.mu.Unlock()
+
+	for _, chunk := range chunks {
+		if !c.waitWhilePaused() {
+			return nil
+		}
+		release, err := c.guard()
+		if err != nil {
+			return fmt.Errorf("[compaction.go/GRD] %v", err)
+		}
+		result, err := c.compactOne(chunk)
+		release()
+		if err != nil {
+			log.Printf("could not compact chunk %d: %v", chunk, err)
+		}
+		c.mu.Lock()
+		c.stats.PassDone += 1
+		c.stats.Totals.add(result)
+		c.mu.Unlock()
+		if !c.throttle(result.IOBytes) {
+			return nil
+		}
+	}
+
+	c.mu.Lock()
+	c.stats.Passes += 1
+	c.mu.Unlock()
+	return nil
+}
+
+// Waits long enough that the IO just done stays within the budget, on average. Returns false if compaction was stopped
+// in the meantime.
+func (c *Compaction) throttle(bytes uint64) bool {
+	if c.options.BytesPerSecond > 0 && bytes > 0 {
+		select {
+		case <-c.stop:
+		case <-time.After(time.Duration(float64(bytes) / float64(c.options.BytesPerSecond) * float64(time.Second))):
+		}
+	}
+	select {
+	case <-c.stop:
+		return false
+	default:
+		return true
+	}
+}
+
+// Must be called with the guard held.
+func (c *Compaction) compactOne(chunk apis.ChunkNum) (CompactionResult, error) {
+	latest, err := c.storage.GetLatestVersion(chunk)
+	if err != nil {
+		// most likely deleted since the pass began; anything worse will come up on the next operation on the chunk
+		delete(c.superseded, chunk)
+		return CompactionResult{}, nil
+	}
+	versions, err := c.storage.ListVersions(chunk)
+	if err != nil {
+		return CompactionResult{}, err
+	}
+	oldest := c.oldestToKeep(chunk, versions, latest)
+	result, err := CompactChunk(c.storage, chunk, oldest)
+	for version := range c.superseded[chunk] {
+		if version < oldest {
+			delete(c.superseded[chunk], version)
+		}
+	}
+	if len(c.superseded[chunk]) == 0 {
+		delete(c.superseded, chunk)
+	}
+	return result, err
+}
+
+// Works out the oldest of a chunk's versions, in ascending order, that is still within the retention window, and
+// notes when any newly superseded versions were first seen.
+func (c *Compaction) oldestToKeep(chunk apis.ChunkNum, versions []apis.Version, latest apis.Version) apis.Version {
+	var older []apis.Version
+	for _, version := range versions {
+		if version < latest {
+			older = append(older, version)
+		}
+	}
+	// the latest version counts towards those kept
+	removable := len(older) - (c.options.keepVersions() - 1)
+	if removable <= 0 {
+		if len(older) > 0 {
+			return older[0]
+		}
+		return latest
+	}
+	oldest := latest
+	if removable < len(older) {
+		oldest = older[removable]
+	}
+	now := c.now()
+	seen := c.superseded[chunk]
+	if seen == nil {
+		seen = map[apis.Version]time.Time{}
+		c.superseded[chunk] = seen
+	}
+	for _, version := range older[:removable] {
+		if _, found := seen[version]; !found {
+			seen[version] = now
+		}
+	}
+	// versions are superseded in order, so once one is too young to remove, so are all those after it
+	for _, version := range older[:removable] {
+		if now.Sub(seen[version]) < c.options.MinAge {
+			return version
+		}
+	}
+	return oldest
+}
+
+// Chunk directories are rewritten once they take up at least this much space, and at least four times what the files
+// they hold need, since on most filesystems a directory never shrinks once it has grown.
+const fragmentedDirSize = 16 * 1024
+
+// A generous estimate of how much space a directory takes up for each file in it.
+const dirEntrySize = 64
+
+func isFragmented(size int64, entries int) bool {
+	needed := int64(entries) * dirEntrySize
+	if needed < 4096 {
+		needed = 4096
+	}
+	return size >= fragmentedDirSize && size >= 4*needed
+}
+
+// A chunk directory is rewritten by linking every file in it into <chunk>.rewrite, moving the original aside to
+// <chunk>.old, and then renaming <chunk>.rewrite into its place. cleanUp finishes or undoes whatever a crash cut short.
+const rewriteSuffix = ".rewrite"
+const asideSuffix = ".old"
+
+// Removes the versions of a chunk older than oldest, and rewrites the chunk's directory if it's fragmented.
+func (m *FilesystemStorage) CompactChunk(chunk apis.ChunkNum, oldest apis.Version) (CompactionResult, error) {
+	m.assertOpen()
+	defer observeSince(m.metrics, LatencyCompaction, time.Now())
+	var result CompactionResult
+	versions, err := m.ListVersions(chunk)
+	if err != nil {
+		return result, err
+	}
+	for _, version := range versions {
+		if version >= oldest {
+			break
+		}
+		fi, err := os.Stat(m.chunkFilename(chunk, version))
+		if err != nil {
+			return result, err
+		}
+		reclaimed := uint64(fi.Size())
+		if links, ok := linkCount(fi); ok && links > 1 {
+			// still linked as another version
+			reclaimed = 0
+		}
+		if err := m.DeleteVersion(chunk, version); err != nil {
+			return result, err
+		}
+		result.RemovedVersions += 1
+		result.ReclaimedBytes += reclaimed
+	}
+	rewrite, err := m.rewriteChunkDir(chunk)
+	if err != nil {
+		return result, fmt.Errorf("cannot rewrite directory of chunk %d: %v", chunk, err)
+	}
+	result.add(rewrite)
+	m.metrics.Add(CounterCompactedBytes, result.ReclaimedBytes)
+	return result, nil
+}
+
+// Rewrites a chunk's directory if it's fragmented.
+func (m *FilesystemStorage) rewriteChunkDir(chunk apis.ChunkNum) (CompactionResult, error) {
+	dir := m.chunkDir(chunk)
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return CompactionResult{}, nil
+	} else if err != nil {
+		return CompactionResult{}, err
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return CompactionResult{}, err
+	}
+	if !m.fragmented(info.Size(), len(fis)) {
+		return CompactionResult{}, nil
+	}
+
+	fresh, aside := dir+rewriteSuffix, dir+asideSuffix
+	if err := os.RemoveAll(fresh); err != nil {
+		return CompactionResult{}, err
+	}
+	if err := m.linkRewrite(dir, fresh, fis); err != nil {
+		// we don't care if this succeeds, since cleanUp would throw it away too
+		_ = os.RemoveAll(fresh)
+		return CompactionResult{}, err
+	}
+	freshInfo, err := os.Stat(fresh)
+	if err != nil {
+		_ = os.RemoveAll(fresh)
+		return CompactionResult{}, err
+	}
+	m.reached("rewrite-linked")
+	if err := os.Rename(dir, aside); err != nil {
+		_ = os.RemoveAll(fresh)
+		return CompactionResult{}, err
+	}
+	m.reached("rewrite-moved-aside")
+	if err := os.Rename(fresh, dir); err != nil {
+		// put the original back, so that the chunk doesn't go missing until the next restart
+		if err2 := os.Rename(aside, dir); err2 != nil {
+			return CompactionResult{}, fmt.Errorf("%v (and then could not put the original back: %v)", err, err2)
+		}
+		_ = os.RemoveAll(fresh)
+		return CompactionResult{}, err
+	}
+	if m.durability >= DurabilityCommit {
+		if err := syncPath(m.fanoutDir(chunk), m.metrics); err != nil {
+			return CompactionResult{}, err
+		}
+	}
+	m.reached("rewrite-renamed")
+	if err := os.RemoveAll(aside); err != nil {
+		return CompactionResult{}, err
+	}
+	// both directories are read or written in full, but none of the files they hold are
+	result := CompactionResult{RewrittenDirectories: 1, IOBytes: uint64(info.Size() + freshInfo.Size())}
+	if freshInfo.Size() < info.Size() {
+		result.ReclaimedBytes = uint64(info.Size() - freshInfo.Size())
+	}
+	return result, nil
+}
+
+// Links every file in a chunk directory into a new directory. The links share the files' contents, which never change
+// once written, so nothing is copied.
+func (m *FilesystemStorage) linkRewrite(dir string, fresh string, fis []os.FileInfo) error {
+	if err := os.Mkdir(fresh, os.FileMode(0755)); err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if err := os.Link(filepath.Join(dir, fi.Name()), filepath.Join(fresh, fi.Name())); err != nil {
+			return err
+		}
+	}
+	if m.durability >= DurabilityCommit {
+		return syncPath(fresh, m.metrics)
+	}
+	return nil
+}
+
+// Finishes or undoes chunk directory rewrites that a crash cut short. A rewritten directory is complete before the
+// original is moved aside, so it's used if the original is no longer in place, and thrown away otherwise.
+func (m *FilesystemStorage) cleanUpRewrites() error {
+	fanouts, err := ioutil.ReadDir(m.chunksDir())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, fanout := range fanouts {
+		fanoutDir := filepath.Join(m.chunksDir(), fanout.Name())
+		fis, err := ioutil.ReadDir(fanoutDir)
+		if err != nil {
+			return err
+		}
+		// every rewritten directory is dealt with before any original that was moved aside
+		for _, suffix := range []string{rewriteSuffix, asideSuffix} {
+			for _, fi := range fis {
+				if !strings.HasSuffix(fi.Name(), suffix) {
+					continue
+				}
+				leftover := filepath.Join(fanoutDir, fi.Name())
+				dir := strings.TrimSuffix(leftover, suffix)
+				if _, err := os.Stat(dir); os.IsNotExist(err) {
+					err = os.Rename(leftover, dir)
+				} else if err == nil {
+					err = os.RemoveAll(leftover)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
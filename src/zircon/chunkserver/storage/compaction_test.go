@@ -0,0 +1,326 @@
+package storage
+
+import (
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+func openCompactionTest(t *testing.T, dir string) *FilesystemStorage {
+	s, err := ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	return s.(*FilesystemStorage)
+}
+
+func TestCompactChunkRemovesOldVersions(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "compaction-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs := openCompactionTest(t, dir)
+	defer fs.Close()
+
+	require.NoError(t, fs.WriteVersion(5, 1, []byte("version one")))
+	require.NoError(t, fs.WriteVersion(5, 2, []byte("version two")))
+	require.NoError(t, fs.LinkVersion(5, 2, 3))
+	require.NoError(t, fs.SetLatestVersion(5, 3))
+
+	result, err := CompactChunk(fs, 5, 3)
+	assert.NoError(err)
+	assert.Equal(uint64(2), result.RemovedVersions)
+	// version 2 is still there as version 3, so only version 1 gives anything back
+	assert.Equal(uint64(chunkFileHeaderSize+len("version one")), result.ReclaimedBytes)
+	assert.Equal(uint64(0), result.RewrittenDirectories)
+
+	versions, err := fs.ListVersions(5)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{3}, versions)
+	data, err := fs.ReadVersion(5, 3)
+	assert.NoError(err)
+	assert.Equal("version two", string(data))
+
+	// and there's nothing left to do the second time around
+	result, err = CompactChunk(fs, 5, 3)
+	assert.NoError(err)
+	assert.Equal(CompactionResult{}, result)
+}
+
+func TestCompactChunkMergesDeltas(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	cow := WithCopyOnWrite(mem)
+	defer cow.Close()
+	expected := runUpdateHeavyWorkload(t, cow, 6)
+	// as if we crashed partway through materializing version 2
+	require.NoError(t, mem.WriteVersion(1, fullCopyID(2), expected[1]))
+
+	result, err := CompactChunk(cow, 1, 4)
+	assert.NoError(err)
+	assert.Equal(uint64(3), result.RemovedVersions)
+	// version 4 depended on version 3, and version 6 on version 5, which was itself a delta
+	assert.Equal(uint64(2), result.MaterializedVersions)
+	assert.Equal(uint64(4*len(expected[0])), result.IOBytes)
+
+	versions, err := cow.ListVersions(1)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{4, 5, 6}, versions)
+	for v := apis.Version(4); v <= 6; v++ {
+		read, err := cow.ReadVersion(1, v)
+		assert.NoError(err)
+		assert.Equal(expected[v-1], read, "version %d", v)
+		chain, err := cow.(*copyOnWrite).chainLength(1, v)
+		assert.NoError(err)
+		assert.True(chain <= 1, "version %d", v)
+	}
+}
+
+func TestCompactChunkRewritesDirectory(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "compaction-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs := openCompactionTest(t, dir)
+	defer fs.Close()
+
+	require.NoError(t, fs.WriteVersion(5, 1, []byte("version one")))
+	require.NoError(t, fs.SetLatestVersion(5, 1))
+	result, err := CompactChunk(fs, 5, 1)
+	assert.NoError(err)
+	assert.Equal(CompactionResult{}, result)
+
+	fs.fragmented = func(size int64, entries int) bool {
+		return entries == 1
+	}
+	result, err = CompactChunk(fs, 5, 1)
+	assert.NoError(err)
+	assert.Equal(uint64(1), result.RewrittenDirectories)
+	assert.NotZero(result.IOBytes)
+
+	data, err := fs.ReadVersion(5, 1)
+	assert.NoError(err)
+	assert.Equal("version one", string(data))
+	fis, err := ioutil.ReadDir(fs.fanoutDir(5))
+	assert.NoError(err)
+	require.Len(t, fis, 1)
+	assert.Equal("5", fis[0].Name())
+
+	assert.False(isFragmented(4096, 1))
+	assert.False(isFragmented(64*1024, 1024))
+	assert.True(isFragmented(64*1024, 10))
+}
+
+func TestCompactChunkRewriteKillPoints(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "compaction-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var steps []string
+	for index := 0; ; index++ {
+		context := fmt.Sprintf("kill point %d", index)
+		require.NoError(t, os.RemoveAll(dir))
+		require.NoError(t, os.Mkdir(dir, 0755))
+
+		fs := openCompactionTest(t, dir)
+		require.NoError(t, fs.WriteVersion(5, 1, []byte("version one")))
+		require.NoError(t, fs.WriteVersion(5, 2, []byte("version two")))
+		require.NoError(t, fs.SetLatestVersion(5, 2))
+		fs.fragmented = func(size int64, entries int) bool {
+			return true
+		}
+		reached := 0
+		fs.killPoint = func(step string) {
+			if reached == index {
+				panic(simulatedCrash{step: step})
+			}
+			reached += 1
+		}
+		step := func() (step string) {
+			defer func() {
+				if r := recover(); r != nil {
+					step = r.(simulatedCrash).step
+					fs.isClosed = true
+				}
+			}()
+			_, err := CompactChunk(fs, 5, 1)
+			require.NoError(t, err)
+			return ""
+		}()
+		if step == "" {
+			fs.Close()
+			break
+		}
+		steps = append(steps, step)
+
+		// whichever copy of the directory survives, both versions are intact, and nothing else is left behind
+		fs = openCompactionTest(t, dir)
+		versions, err := fs.ListVersions(5)
+		assert.NoError(err, context)
+		assert.Equal([]apis.Version{1, 2}, versions, context)
+		for v, expected := range map[apis.Version]string{1: "version one", 2: "version two"} {
+			data, err := fs.ReadVersion(5, v)
+			assert.NoError(err, context)
+			assert.Equal(expected, string(data), context)
+		}
+		fis, err := ioutil.ReadDir(fs.fanoutDir(5))
+		assert.NoError(err, context)
+		assert.Len(fis, 1, context)
+		fs.Close()
+	}
+	assert.Equal([]string{"rewrite-linked", "rewrite-moved-aside", "rewrite-renamed"}, steps)
+}
+
+// Waits for compaction to reach a state, for up to a few seconds.
+func waitForCompaction(t *testing.T, c *Compaction, done func(CompactionStats) bool) CompactionStats {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats := c.Stats()
+		if done(stats) {
+			return stats
+		}
+		require.True(t, time.Now().Before(deadline), "compaction never got there: %+v", stats)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCompactionPauseAndResume(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	for chunk := apis.ChunkNum(1); chunk <= 4; chunk++ {
+		require.NoError(t, mem.WriteVersion(chunk, 1, []byte("version one")))
+		require.NoError(t, mem.WriteVersion(chunk, 2, []byte("version two")))
+		require.NoError(t, mem.SetLatestVersion(chunk, 2))
+	}
+
+	// holding the lock keeps compaction from getting anywhere before it's paused
+	var mu sync.Mutex
+	mu.Lock()
+	c := StartCompaction(mem, &mu, CompactionOptions{Interval: time.Hour, KeepVersions: 1})
+	defer c.Stop()
+	c.Pause()
+	mu.Unlock()
+
+	stats := waitForCompaction(t, c, func(stats CompactionStats) bool {
+		return stats.PassTotal > 0
+	})
+	assert.True(stats.Paused)
+	assert.Equal(uint64(4), stats.PassTotal)
+	assert.Equal(uint64(0), stats.PassDone)
+	mu.Lock()
+	versions, err := mem.ListVersions(1)
+	mu.Unlock()
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1, 2}, versions)
+
+	c.Resume()
+	stats = waitForCompaction(t, c, func(stats CompactionStats) bool {
+		return stats.Passes > 0
+	})
+	assert.False(stats.Paused)
+	assert.Equal(uint64(4), stats.PassDone)
+	assert.Equal(uint64(4), stats.Totals.RemovedVersions)
+	mu.Lock()
+	for chunk := apis.ChunkNum(1); chunk <= 4; chunk++ {
+		versions, err := mem.ListVersions(chunk)
+		assert.NoError(err)
+		assert.Equal([]apis.Version{2}, versions)
+	}
+	mu.Unlock()
+}
+
+func TestCompactionRetention(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	for version := apis.Version(1); version <= 5; version++ {
+		require.NoError(t, mem.WriteVersion(1, version, []byte("data")))
+	}
+	require.NoError(t, mem.SetLatestVersion(1, 4))
+
+	now := time.Unix(1000, 0)
+	c := &Compaction{
+		storage:    mem,
+		options:    CompactionOptions{KeepVersions: 2, MinAge: time.Minute},
+		now:        func() time.Time { return now },
+		superseded: map[apis.ChunkNum]map[apis.Version]time.Time{},
+	}
+	versions := func() []apis.Version {
+		versions, err := mem.ListVersions(1)
+		require.NoError(t, err)
+		return versions
+	}
+
+	// versions 1 and 2 are outside of the newest two, but haven't been superseded for long enough yet
+	result, err := c.compactOne(1)
+	assert.NoError(err)
+	assert.Equal(uint64(0), result.RemovedVersions)
+	assert.Equal([]apis.Version{1, 2, 3, 4, 5}, versions())
+
+	now = now.Add(30 * time.Second)
+	require.NoError(t, mem.SetLatestVersion(1, 5))
+	_, err = c.compactOne(1)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1, 2, 3, 4, 5}, versions())
+
+	// once they have, they go, but version 3 was only found to be superseded just now
+	now = now.Add(30 * time.Second)
+	result, err = c.compactOne(1)
+	assert.NoError(err)
+	assert.Equal(uint64(2), result.RemovedVersions)
+	assert.Equal([]apis.Version{3, 4, 5}, versions())
+	assert.Len(c.superseded[1], 1)
+
+	now = now.Add(30 * time.Second)
+	_, err = c.compactOne(1)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{4, 5}, versions())
+	assert.Empty(c.superseded)
+
+	assert.Error(CompactionOptions{KeepVersions: -1}.Validate())
+	assert.Error(CompactionOptions{MinAge: -time.Second}.Validate())
+}
+
+func TestCompactionThrottled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compaction-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs := openCompactionTest(t, dir)
+	defer fs.Close()
+	require.NoError(t, fs.WriteVersion(5, 1, []byte("version one")))
+	require.NoError(t, fs.SetLatestVersion(5, 1))
+	fs.fragmented = func(size int64, entries int) bool {
+		return true
+	}
+
+	// however small directories are on this filesystem, rewriting one takes far longer than the test at this rate
+	var mu sync.Mutex
+	c := StartCompaction(fs, &mu, CompactionOptions{BytesPerSecond: 1, Interval: time.Hour})
+	stats := waitForCompaction(t, c, func(stats CompactionStats) bool {
+		return stats.PassDone > 0
+	})
+	assert := testifyAssert.New(t)
+	assert.Equal(uint64(1), stats.Totals.RewrittenDirectories)
+	assert.Equal(uint64(0), stats.Passes)
+
+	// stopping doesn't wait for the throttle
+	start := time.Now()
+	c.Stop()
+	assert.True(time.Since(start) < time.Second)
+	assert.Equal(uint64(0), c.Stats().Passes)
+}
@@ -0,0 +1,484 @@
+package storage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+	"zircon/apis"
+)
+
+// Compression at rest, layered on top of any other ChunkStorage.
+//
+// Each version is stored in the underlying storage either raw, or compressed with a Codec. As with copy-on-write, which
+// one it is gets encoded in the version number used for the underlying storage: version V is stored as 2V when raw, and
+// as 2V+1 when compressed.
+//
+// Compressed format, all little-endian:
+//   original length (4 bytes), compressed length (4 bytes), compressed data
+//
+// Every version is compressed as a single unit, so reading any part of it means decompressing all of it. A format made
+// of independently-compressed blocks would allow partial decompression, at the cost of a worse compression ratio.
+// That's not worth it here, because the storage interface only ever reads whole versions anyway.
+
+// Before compressing a whole version, try compressing this much of it, so that incompressible data (such as data that
+// was already compressed by the client) doesn't cost a full pass.
+const compressTrialSize = 64 * 1024
+
+const compressHeaderSize = 8
+
+// A compression algorithm for chunk data at rest. Storage written with one codec must always be read with the same one.
+type Codec interface {
+	Compress(data []byte) ([]byte, error)
+	// length is the length of the original data
+	Decompress(compressed []byte, length int) ([]byte, error)
+}
+
+// How much space is taken up by stored chunk data, before and after compression. Versions are counted separately even
+// if they share storage through LinkVersion.
+type StorageUsage struct {
+	LogicalBytes  uint64
+	PhysicalBytes uint64
+}
+
+// Implemented by storage layers that know how much space their data takes up once encoded.
+type UsageReporter interface {
+	// ok is false if this storage doesn't keep track of this information.
+	Usage() (usage StorageUsage, ok bool, err error)
+}
+
+type flateCodec struct {
+	level int
+}
+
+// A Codec based on DEFLATE, at a compression level tuned for speed.
+func FlateCodec() Codec {
+	return flateCodec{level: flate.BestSpeed}
+}
+
+func (f flateCodec) Compress(data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	writer, err := flate.NewWriter(&out, f.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (f flateCodec) Decompress(compressed []byte, length int) ([]byte, error) {
+	reader := flate.NewReader(bytes.NewReader(compressed))
+	defer reader.Close()
+	data := make([]byte, length)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+type compressed struct {
+	inner ChunkStorage
+	codec Codec
+	limit chunkSizeLimit
+
+	// only filled in once someone asks for it, because it requires reading every stored version
+	usageKnown bool
+	usage      StorageUsage
+}
+
+// Wrap a storage backend so that chunk data is compressed before being stored, whenever that actually saves space.
+// Storage written through this wrapper must always be opened through this wrapper, with the same codec.
+func WithCompression(inner ChunkStorage, codec Codec) ChunkStorage {
+	return &compressed{inner: inner, codec: codec}
+}
+
+func rawID(version apis.Version) apis.Version {
+	return version * 2
+}
+
+func compressedID(version apis.Version) apis.Version {
+	return version*2 + 1
+}
+
+func isCompressedID(id apis.Version) bool {
+	return id%2 == 1
+}
+
+// Find which underlying version holds a particular version. Returns (id, found, error)
+func (c *compressed) locate(chunk apis.ChunkNum, version apis.Version) (apis.Version, bool, error) {
+	ids, err := c.inner.ListVersions(chunk)
+	if err != nil {
+		return 0, false, err
+	}
+	for _, id := range ids {
+		if id == rawID(version) || id == compressedID(version) {
+			return id, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// Returns the encoded form of the data, or nil if it should be stored raw.
+func (c *compressed) encode(data []byte) ([]byte, error) {
+	if len(data) <= compressHeaderSize {
+		return nil, nil
+	}
+	if len(data) > compressTrialSize {
+		trial, err := c.codec.Compress(data[:compressTrialSize])
+		if err != nil {
+			return nil, err
+		}
+		// if the sample barely compresses, the rest of it probably won't either
+		if len(trial) > compressTrialSize*7/8 {
+			return nil, nil
+		}
+	}
+	payload, err := c.codec.Compress(data)
+	if err != nil {
+		return nil, err
+	}
+	if compressHeaderSize+len(payload) >= len(data) {
+		return nil, nil
+	}
+	encoded := make([]byte, compressHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(encoded[0:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(encoded[4:], uint32(len(payload)))
+	copy(encoded[compressHeaderSize:], payload)
+	return encoded, nil
+}
+
+// The underlying storage may pad the compressed data with zeroes, so anything after the payload is ignored.
+func decodeCompressedHeader(encoded []byte) (length int, payload []byte, err error) {
+	if len(encoded) < compressHeaderSize {
+		return 0, nil, fmt.Errorf("compressed data too short: %d bytes", len(encoded))
+	}
+	length = int(binary.LittleEndian.Uint32(encoded[0:]))
+	plen := int(binary.LittleEndian.Uint32(encoded[4:]))
+	if compressHeaderSize+plen > len(encoded) || length > apis.MaxChunkSize {
+		return 0, nil, fmt.Errorf("compressed data truncated or corrupt")
+	}
+	return length, encoded[compressHeaderSize : compressHeaderSize+plen], nil
+}
+
+// Work out how much space a stored version takes up.
+func (c *compressed) usageOf(chunk apis.ChunkNum, id apis.Version) (StorageUsage, error) {
+	encoded, err := c.inner.ReadVersion(chunk, id)
+	if err != nil {
+		return StorageUsage{}, err
+	}
+	if !isCompressedID(id) {
+		return StorageUsage{LogicalBytes: uint64(len(encoded)), PhysicalBytes: uint64(len(encoded))}, nil
+	}
+	length, payload, err := decodeCompressedHeader(encoded)
+	if err != nil {
+		return StorageUsage{}, fmt.Errorf("corrupt compressed data for %d/%d: %v", chunk, id/2, err)
+	}
+	return StorageUsage{LogicalBytes: uint64(length), PhysicalBytes: uint64(compressHeaderSize + len(payload))}, nil
+}
+
+func (c *compressed) Usage() (StorageUsage, bool, error) {
+	if !c.usageKnown {
+		var total StorageUsage
+		chunks, err := c.inner.ListChunksWithData()
+		if err != nil {
+			return StorageUsage{}, false, err
+		}
+		for _, chunk := range chunks {
+			ids, err := c.inner.ListVersions(chunk)
+			if err != nil {
+				return StorageUsage{}, false, err
+			}
+			for _, id := range ids {
+				usage, err := c.usageOf(chunk, id)
+				if err != nil {
+					return StorageUsage{}, false, err
+				}
+				total.LogicalBytes += usage.LogicalBytes
+				total.PhysicalBytes += usage.PhysicalBytes
+			}
+		}
+		c.usage = total
+		c.usageKnown = true
+	}
+	return c.usage, true, nil
+}
+
+func (c *compressed) ListChunksWithData() ([]apis.ChunkNum, error) {
+	return c.inner.ListChunksWithData()
+}
+
+func (c *compressed) ListVersions(chunk apis.ChunkNum) ([]apis.Version, error) {
+	ids, err := c.inner.ListVersions(chunk)
+	if err != nil {
+		return nil, err
+	}
+	var versions []apis.Version
+	for _, id := range ids {
+		versions = append(versions, id/2)
+	}
+	return versions, nil
+}
+
+func (c *compressed) ReadVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
+	id, found, err := c.locate(chunk, version)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no such chunk/version combination: %d/%d", chunk, version)
+	}
+	encoded, err := c.inner.ReadVersion(chunk, id)
+	if err != nil {
+		return nil, err
+	}
+	if !isCompressedID(id) {
+		return encoded, nil
+	}
+	length, payload, err := decodeCompressedHeader(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt compressed data for %d/%d: %v", chunk, version, err)
+	}
+	data, err := c.codec.Decompress(payload, length)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress %d/%d: %v", chunk, version, err)
+	}
+	return data, nil
+}
+
+func (c *compressed) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	if err := c.limit.check(chunk, version, data); err != nil {
+		return err
+	}
+	if _, exists, err := c.locate(chunk, version); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("chunk/version combination already exists: %d/%d", chunk, version)
+	}
+	encoded, err := c.encode(data)
+	if err != nil {
+		return err
+	}
+	id, stored := rawID(version), data
+	if encoded != nil {
+		id, stored = compressedID(version), encoded
+	}
+	if err := c.inner.WriteVersion(chunk, id, stored); err != nil {
+		return err
+	}
+	if c.usageKnown {
+		c.usage.LogicalBytes += uint64(len(data))
+		c.usage.PhysicalBytes += uint64(len(stored))
+	}
+	return nil
+}
+
+// Links whichever form the existing version is stored in.
+func (c *compressed) LinkVersion(chunk apis.ChunkNum, existing apis.Version, version apis.Version) error {
+	id, found, err := c.locate(chunk, existing)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, existing)
+	}
+	if _, exists, err := c.locate(chunk, version); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("chunk/version combination already exists: %d/%d", chunk, version)
+	}
+	newID := rawID(version)
+	if isCompressedID(id) {
+		newID = compressedID(version)
+	}
+	if c.usageKnown {
+		usage, err := c.usageOf(chunk, id)
+		if err != nil {
+			return err
+		}
+		c.usage.LogicalBytes += usage.LogicalBytes
+		c.usage.PhysicalBytes += usage.PhysicalBytes
+	}
+	return c.inner.LinkVersion(chunk, id, newID)
+}
+
+func (c *compressed) DeleteVersion(chunk apis.ChunkNum, version apis.Version) error {
+	id, found, err := c.locate(chunk, version)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, version)
+	}
+	var usage StorageUsage
+	if c.usageKnown {
+		if usage, err = c.usageOf(chunk, id); err != nil {
+			return err
+		}
+	}
+	if err := c.inner.DeleteVersion(chunk, id); err != nil {
+		return err
+	}
+	c.usage.LogicalBytes -= usage.LogicalBytes
+	c.usage.PhysicalBytes -= usage.PhysicalBytes
+	return nil
+}
+
+func (c *compressed) CompactChunk(chunk apis.ChunkNum, oldest apis.Version) (CompactionResult, error) {
+	// which versions go away is up to the underlying storage, so start over the next time someone asks
+	c.usageKnown = false
+	// a version is stored one way or the other, so both ids for oldest are kept
+	return CompactChunk(c.inner, chunk, rawID(oldest))
+}
+
+func (c *compressed) QuarantineVersion(chunk apis.ChunkNum, version apis.Version) error {
+	quarantiner, ok := c.inner.(Quarantiner)
+	if !ok {
+		return fmt.Errorf("underlying storage cannot quarantine %d/%d", chunk, version)
+	}
+	id, found, err := c.locate(chunk, version)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, version)
+	}
+	// the usage of a damaged version can't be known, so start over the next time someone asks
+	c.usageKnown = false
+	return quarantiner.QuarantineVersion(chunk, id)
+}
+
+func (c *compressed) PurgeQuarantine(cutoff time.Time) (int, error) {
+	if purger, ok := c.inner.(QuarantinePurger); ok {
+		return purger.PurgeQuarantine(cutoff)
+	}
+	return 0, nil
+}
+
+func (c *compressed) ListChunksWithLatest() ([]apis.ChunkNum, error) {
+	return c.inner.ListChunksWithLatest()
+}
+
+func (c *compressed) GetLatestVersion(chunk apis.ChunkNum) (apis.Version, error) {
+	id, err := c.inner.GetLatestVersion(chunk)
+	if err != nil {
+		return 0, err
+	}
+	return id / 2, nil
+}
+
+func (c *compressed) SetLatestVersion(chunk apis.ChunkNum, latest apis.Version) error {
+	return c.inner.SetLatestVersion(chunk, rawID(latest))
+}
+
+func (c *compressed) DeleteLatestVersion(chunk apis.ChunkNum) error {
+	return c.inner.DeleteLatestVersion(chunk)
+}
+
+func (c *compressed) StageData(bytes int) error {
+	return c.inner.StageData(bytes)
+}
+
+func (c *compressed) UnstageData(bytes int) {
+	c.inner.UnstageData(bytes)
+}
+
+// The byte counts come from the inner storage, so they reflect how the data is actually stored, but the versions are
+// counted as seen from outside.
+func (c *compressed) Stats() (StorageStats, error) {
+	stats, err := c.inner.Stats()
+	if err != nil {
+		return StorageStats{}, err
+	}
+	if err := countVersions(c, &stats); err != nil {
+		return StorageStats{}, err
+	}
+	return stats, nil
+}
+
+func (c *compressed) Durability() Durability {
+	return DurabilityOf(c.inner)
+}
+
+// Staged writes are short-lived, so they are kept uncompressed.
+func (c *compressed) KeepStaged(write StagedWrite) error {
+	if keeper, ok := c.inner.(StagedWriteKeeper); ok {
+		return keeper.KeepStaged(write)
+	}
+	return nil
+}
+
+func (c *compressed) ForgetStaged(hash apis.CommitHash) error {
+	if keeper, ok := c.inner.(StagedWriteKeeper); ok {
+		return keeper.ForgetStaged(hash)
+	}
+	return nil
+}
+
+func (c *compressed) ListStaged() ([]StagedWrite, error) {
+	if keeper, ok := c.inner.(StagedWriteKeeper); ok {
+		return keeper.ListStaged()
+	}
+	return nil, nil
+}
+
+func (c *compressed) KeepTombstone(tombstone apis.Tombstone) error {
+	if keeper, ok := c.inner.(TombstoneKeeper); ok {
+		return keeper.KeepTombstone(tombstone)
+	}
+	return nil
+}
+
+func (c *compressed) ForgetTombstone(chunk apis.ChunkNum) error {
+	if keeper, ok := c.inner.(TombstoneKeeper); ok {
+		return keeper.ForgetTombstone(chunk)
+	}
+	return nil
+}
+
+func (c *compressed) ListTombstones() ([]apis.Tombstone, error) {
+	if keeper, ok := c.inner.(TombstoneKeeper); ok {
+		return keeper.ListTombstones()
+	}
+	return nil, nil
+}
+
+// The inner storage holds the compressed data, so its view of how full it is already accounts for compression.
+func (c *compressed) Space() (StorageSpace, bool, error) {
+	if reporter, ok := c.inner.(SpaceReporter); ok {
+		return reporter.Space()
+	}
+	return StorageSpace{}, false, nil
+}
+
+func (c *compressed) IntegrityReport() (IntegrityReport, bool) {
+	if reporter, ok := c.inner.(IntegrityReporter); ok {
+		return reporter.IntegrityReport()
+	}
+	return IntegrityReport{}, false
+}
+
+// The wrapped storage is limited too, although it's only ever handed what this has already checked.
+func (c *compressed) SetMaxChunkSize(size uint32) bool {
+	c.limit.set(size)
+	SetMaxChunkSize(c.inner, size)
+	return true
+}
+
+func (c *compressed) SetMetricsSink(sink MetricsSink) bool {
+	return SetMetricsSink(c.inner, sink)
+}
+
+func (c *compressed) Flush() error {
+	return c.inner.Flush()
+}
+
+func (c *compressed) Close() {
+	c.inner.Close()
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"strings"
+	"testing"
+	"zircon/apis"
+)
+
+func TestCompressionSavesSpace(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	s := WithCompression(mem, FlateCodec())
+	defer s.Close()
+
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog; ", 10000))
+	random := make([]byte, 200*1024)
+	rand.New(rand.NewSource(646)).Read(random)
+
+	assert.NoError(s.WriteVersion(1, 1, text))
+	assert.NoError(s.WriteVersion(2, 1, random))
+
+	// text is stored compressed, but random data isn't worth it, so it's stored as-is
+	ids, err := mem.ListVersions(1)
+	assert.NoError(err)
+	assert.Equal(compressedID(1), ids[0])
+	ids, err = mem.ListVersions(2)
+	assert.NoError(err)
+	assert.Equal(rawID(1), ids[0])
+
+	read, err := s.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.Equal(text, read)
+	read, err = s.ReadVersion(2, 1)
+	assert.NoError(err)
+	assert.Equal(random, read)
+
+	usage, known, err := s.(UsageReporter).Usage()
+	assert.NoError(err)
+	assert.True(known)
+	assert.Equal(uint64(len(text)+len(random)), usage.LogicalBytes)
+	assert.Equal(uint64(storedBytes(mem.(*MemoryStorage))), usage.PhysicalBytes)
+	assert.True(usage.PhysicalBytes < uint64(len(random))+uint64(len(text))/3)
+
+	// once usage is known, it's kept up to date
+	assert.NoError(s.LinkVersion(1, 1, 2))
+	assert.NoError(s.DeleteVersion(2, 1))
+	usage, _, err = s.(UsageReporter).Usage()
+	assert.NoError(err)
+	assert.Equal(uint64(2*len(text)), usage.LogicalBytes)
+
+	assert.NoError(s.DeleteVersion(1, 1))
+	assert.NoError(s.DeleteVersion(1, 2))
+	usage, _, err = s.(UsageReporter).Usage()
+	assert.NoError(err)
+	assert.Equal(StorageUsage{}, usage)
+}
+
+func TestCompressionUnderCopyOnWrite(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	s := WithCopyOnWrite(WithCompression(mem, FlateCodec()))
+	defer s.Close()
+
+	expected := runUpdateHeavyWorkload(t, s, 10)
+	for i, data := range expected {
+		read, err := s.ReadVersion(1, apis.Version(i+1))
+		assert.NoError(err)
+		assert.Equal(data, read)
+	}
+
+	usage, known, err := s.(UsageReporter).Usage()
+	assert.NoError(err)
+	assert.True(known)
+	assert.Equal(uint64(storedBytes(mem.(*MemoryStorage))), usage.PhysicalBytes)
+}
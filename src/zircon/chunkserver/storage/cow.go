@@ -0,0 +1,587 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+	"zircon/apis"
+	"zircon/util"
+)
+
+// Copy-on-write version storage, layered on top of any other ChunkStorage.
+//
+// Each version is kept in the underlying storage either as a full copy, or as a delta: a reference to a parent version,
+// plus the byte ranges that differ from it. Which one it is gets encoded in the version number used for the underlying
+// storage: version V is stored as 2V when it is a full copy, and as 2V+1 when it is a delta. This means that no
+// separate index has to be kept consistent with the data, and that any backend (and its durability guarantees) can be
+// used unchanged.
+//
+// Delta format, all little-endian:
+//   parent version (8 bytes), total length (4 bytes), range count (4 bytes),
+//   then for each range: offset (4 bytes), length (4 bytes), data (length bytes)
+
+// Once a version would be this many deltas away from a full copy, it is written as a full copy instead, so that reads
+// never have to replay more than this many deltas.
+const cowMaxChainLength = 8
+
+// Runs of unchanged bytes shorter than this are folded into the surrounding changed ranges, because each separate
+// range costs 8 bytes of header.
+const cowMergeGap = 16
+
+const cowHeaderSize = 16
+const cowRangeHeaderSize = 8
+
+type copyOnWrite struct {
+	inner ChunkStorage
+	limit chunkSizeLimit
+}
+
+// Wrap a storage backend so that new versions only store the bytes that changed from an earlier version. Storage
+// written through this wrapper must always be opened through this wrapper.
+func WithCopyOnWrite(inner ChunkStorage) ChunkStorage {
+	return &copyOnWrite{inner: inner}
+}
+
+type byteRange struct {
+	offset uint32
+	data   []byte
+}
+
+func fullCopyID(version apis.Version) apis.Version {
+	return version * 2
+}
+
+func deltaID(version apis.Version) apis.Version {
+	return version*2 + 1
+}
+
+func isDeltaID(id apis.Version) bool {
+	return id%2 == 1
+}
+
+// Find which underlying version holds a particular version. A full copy is preferred if both exist, which can happen
+// if we crash partway through materializing a delta.
+func (c *copyOnWrite) locate(chunk apis.ChunkNum, version apis.Version) (apis.Version, bool, error) {
+	ids, err := c.inner.ListVersions(chunk)
+	if err != nil {
+		return 0, false, err
+	}
+	foundDelta := false
+	for _, id := range ids {
+		if id == fullCopyID(version) {
+			return id, true, nil
+		}
+		if id == deltaID(version) {
+			foundDelta = true
+		}
+	}
+	return deltaID(version), foundDelta, nil
+}
+
+func (c *copyOnWrite) ListChunksWithData() ([]apis.ChunkNum, error) {
+	return c.inner.ListChunksWithData()
+}
+
+func (c *copyOnWrite) ListVersions(chunk apis.ChunkNum) ([]apis.Version, error) {
+	ids, err := c.inner.ListVersions(chunk)
+	if err != nil {
+		return nil, err
+	}
+	var versions []apis.Version
+	for _, id := range ids {
+		// ids are in ascending order, so a version stored both ways will show up twice in a row
+		if len(versions) == 0 || versions[len(versions)-1] != id/2 {
+			versions = append(versions, id/2)
+		}
+	}
+	return versions, nil
+}
+
+func encodeDelta(parent apis.Version, length int, ranges []byteRange) []byte {
+	size := cowHeaderSize
+	for _, r := range ranges {
+		size += cowRangeHeaderSize + len(r.data)
+	}
+	encoded := make([]byte, size)
+	binary.LittleEndian.PutUint64(encoded[0:], uint64(parent))
+	binary.LittleEndian.PutUint32(encoded[8:], uint32(length))
+	binary.LittleEndian.PutUint32(encoded[12:], uint32(len(ranges)))
+	pos := cowHeaderSize
+	for _, r := range ranges {
+		binary.LittleEndian.PutUint32(encoded[pos:], r.offset)
+		binary.LittleEndian.PutUint32(encoded[pos+4:], uint32(len(r.data)))
+		pos += cowRangeHeaderSize
+		pos += copy(encoded[pos:], r.data)
+	}
+	return encoded
+}
+
+// The underlying storage may pad the delta with zeroes, so anything after the last range is ignored.
+func decodeDelta(encoded []byte) (apis.Version, int, []byteRange, error) {
+	if len(encoded) < cowHeaderSize {
+		return 0, 0, nil, fmt.Errorf("delta too short: %d bytes", len(encoded))
+	}
+	parent := apis.Version(binary.LittleEndian.Uint64(encoded[0:]))
+	length := int(binary.LittleEndian.Uint32(encoded[8:]))
+	ranges := make([]byteRange, binary.LittleEndian.Uint32(encoded[12:]))
+	pos := cowHeaderSize
+	for i := range ranges {
+		if pos+cowRangeHeaderSize > len(encoded) {
+			return 0, 0, nil, fmt.Errorf("delta truncated in range %d", i)
+		}
+		offset := binary.LittleEndian.Uint32(encoded[pos:])
+		rlen := int(binary.LittleEndian.Uint32(encoded[pos+4:]))
+		pos += cowRangeHeaderSize
+		if pos+rlen > len(encoded) || int(offset)+rlen > length {
+			return 0, 0, nil, fmt.Errorf("delta range %d out of bounds", i)
+		}
+		ranges[i] = byteRange{offset: offset, data: encoded[pos : pos+rlen]}
+		pos += rlen
+	}
+	return parent, length, ranges, nil
+}
+
+// Find the ranges of data that differ from base. Bytes past the end of base count as zero.
+func diffRanges(base []byte, data []byte) []byteRange {
+	var ranges []byteRange
+	start, lastChange := -1, -1
+	for i, b := range data {
+		var old byte
+		if i < len(base) {
+			old = base[i]
+		}
+		if b == old {
+			continue
+		}
+		if start >= 0 && i-lastChange > cowMergeGap {
+			ranges = append(ranges, byteRange{offset: uint32(start), data: data[start : lastChange+1]})
+			start = -1
+		}
+		if start < 0 {
+			start = i
+		}
+		lastChange = i
+	}
+	if start >= 0 {
+		ranges = append(ranges, byteRange{offset: uint32(start), data: data[start : lastChange+1]})
+	}
+	return ranges
+}
+
+func applyRanges(base []byte, length int, ranges []byteRange) []byte {
+	result := make([]byte, length)
+	copy(result, base)
+	for _, r := range ranges {
+		copy(result[r.offset:], r.data)
+	}
+	return result
+}
+
+// Read the delta header of a version, if it's stored as one. Returns (parent, isDelta, error)
+func (c *copyOnWrite) parentOf(chunk apis.ChunkNum, version apis.Version) (apis.Version, bool, error) {
+	id, found, err := c.locate(chunk, version)
+	if err != nil {
+		return 0, false, err
+	}
+	if !found {
+		return 0, false, fmt.Errorf("no such chunk/version combination: %d/%d", chunk, version)
+	}
+	if !isDeltaID(id) {
+		return 0, false, nil
+	}
+	encoded, err := c.inner.ReadVersion(chunk, id)
+	if err != nil {
+		return 0, false, err
+	}
+	parent, _, _, err := decodeDelta(encoded)
+	if err != nil {
+		return 0, false, fmt.Errorf("corrupt delta for %d/%d: %v", chunk, version, err)
+	}
+	return parent, true, nil
+}
+
+// Count how many deltas have to be applied to reconstruct a version.
+func (c *copyOnWrite) chainLength(chunk apis.ChunkNum, version apis.Version) (int, error) {
+	length := 0
+	for {
+		parent, isDelta, err := c.parentOf(chunk, version)
+		if err != nil {
+			return 0, err
+		}
+		if !isDelta {
+			return length, nil
+		}
+		length += 1
+		version = parent
+	}
+}
+
+func (c *copyOnWrite) ReadVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
+	id, found, err := c.locate(chunk, version)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("no such chunk/version combination: %d/%d", chunk, version)
+	}
+	encoded, err := c.inner.ReadVersion(chunk, id)
+	if err != nil {
+		return nil, err
+	}
+	if !isDeltaID(id) {
+		return encoded, nil
+	}
+	parent, length, ranges, err := decodeDelta(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("corrupt delta for %d/%d: %v", chunk, version, err)
+	}
+	base, err := c.ReadVersion(chunk, parent)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read parent of %d/%d: %v", chunk, version, err)
+	}
+	return applyRanges(base, length, ranges), nil
+}
+
+// Pick the version that a new version should be stored relative to: the latest version if it's older than the new
+// one, and otherwise the newest version that's older. Returns (parent, found, error)
+func (c *copyOnWrite) chooseParent(chunk apis.ChunkNum, version apis.Version, existing []apis.Version) (apis.Version, bool, error) {
+	if latest, err := c.GetLatestVersion(chunk); err == nil && latest < version {
+		for _, v := range existing {
+			if v == latest {
+				return latest, true, nil
+			}
+		}
+	}
+	for i := len(existing) - 1; i >= 0; i-- {
+		if existing[i] < version {
+			return existing[i], true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+func (c *copyOnWrite) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	if err := c.limit.check(chunk, version, data); err != nil {
+		return err
+	}
+	existing, err := c.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	for _, v := range existing {
+		if v == version {
+			return fmt.Errorf("chunk/version combination already exists: %d/%d", chunk, version)
+		}
+	}
+	parent, found, err := c.chooseParent(chunk, version, existing)
+	if err != nil {
+		return err
+	}
+	if found {
+		chain, err := c.chainLength(chunk, parent)
+		if err != nil {
+			return err
+		}
+		if chain+1 < cowMaxChainLength {
+			base, err := c.ReadVersion(chunk, parent)
+			if err != nil {
+				return err
+			}
+			encoded := encodeDelta(parent, len(data), diffRanges(base, data))
+			// a delta that doesn't save at least half of the space isn't worth the cost of reconstructing it
+			if len(encoded) < len(util.StripTrailingZeroes(data))/2 {
+				return c.inner.WriteVersion(chunk, deltaID(version), encoded)
+			}
+		}
+	}
+	return c.inner.WriteVersion(chunk, fullCopyID(version), data)
+}
+
+// Links whichever form the existing version is stored in. A linked delta has the same parent as the original, so it
+// is treated like any other child when that parent is deleted.
+func (c *copyOnWrite) LinkVersion(chunk apis.ChunkNum, existing apis.Version, version apis.Version) error {
+	id, found, err := c.locate(chunk, existing)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, existing)
+	}
+	if _, exists, err := c.locate(chunk, version); err != nil {
+		return err
+	} else if exists {
+		return fmt.Errorf("chunk/version combination already exists: %d/%d", chunk, version)
+	}
+	if isDeltaID(id) {
+		return c.inner.LinkVersion(chunk, id, deltaID(version))
+	}
+	return c.inner.LinkVersion(chunk, id, fullCopyID(version))
+}
+
+// Replace a delta with a full copy of the same version, so that its parent can be deleted. Returns the length of the
+// version.
+func (c *copyOnWrite) materialize(chunk apis.ChunkNum, version apis.Version) (int, error) {
+	data, err := c.ReadVersion(chunk, version)
+	if err != nil {
+		return 0, err
+	}
+	// write the full copy first, so that the version is never missing
+	if err := c.inner.WriteVersion(chunk, fullCopyID(version), data); err != nil {
+		return 0, err
+	}
+	return len(data), c.inner.DeleteVersion(chunk, deltaID(version))
+}
+
+func (c *copyOnWrite) DeleteVersion(chunk apis.ChunkNum, version apis.Version) error {
+	id, found, err := c.locate(chunk, version)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, version)
+	}
+	versions, err := c.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	// any delta based on this version must stop depending on it before it can go away
+	for _, v := range versions {
+		parent, isDelta, err := c.parentOf(chunk, v)
+		if err != nil {
+			return err
+		}
+		if isDelta && parent == version {
+			if _, err := c.materialize(chunk, v); err != nil {
+				return fmt.Errorf("cannot materialize %d/%d before deleting its parent: %v", chunk, v, err)
+			}
+		}
+	}
+	if err := c.inner.DeleteVersion(chunk, id); err != nil {
+		return err
+	}
+	if !isDeltaID(id) {
+		// clean up a leftover delta from an interrupted materialization, if any
+		if _, found, err := c.locate(chunk, version); err != nil {
+			return err
+		} else if found {
+			return c.inner.DeleteVersion(chunk, deltaID(version))
+		}
+	}
+	return nil
+}
+
+// Materializes every delta that's kept but depends on a version that isn't, or on another delta, and throws away deltas
+// left behind by interrupted materializations, before removing the old versions. Nothing that's kept depends on an old
+// version by then, so they can all be removed at once from the underlying storage, without materializing anything
+// else on their account.
+func (c *copyOnWrite) CompactChunk(chunk apis.ChunkNum, oldest apis.Version) (CompactionResult, error) {
+	var result CompactionResult
+	ids, err := c.inner.ListVersions(chunk)
+	if err != nil {
+		return result, err
+	}
+	stored := map[apis.Version]bool{}
+	for _, id := range ids {
+		stored[id] = true
+	}
+	for _, id := range ids {
+		version := id / 2
+		if !isDeltaID(id) {
+			continue
+		}
+		if stored[fullCopyID(version)] {
+			if err := c.inner.DeleteVersion(chunk, id); err != nil {
+				return result, err
+			}
+			continue
+		}
+		if version < oldest {
+			continue
+		}
+		parent, _, err := c.parentOf(chunk, version)
+		if err != nil {
+			return result, err
+		}
+		chain, err := c.chainLength(chunk, version)
+		if err != nil {
+			return result, err
+		}
+		// versions are gone through in ascending order, so a parent that's kept has already been dealt with
+		if parent >= oldest && chain <= 1 {
+			continue
+		}
+		length, err := c.materialize(chunk, version)
+		if err != nil {
+			return result, fmt.Errorf("cannot materialize %d/%d: %v", chunk, version, err)
+		}
+		result.MaterializedVersions += 1
+		// read through the chain, and then written out in full
+		result.IOBytes += 2 * uint64(length)
+	}
+	// every old version is only stored one way by now, so the underlying storage counts them correctly
+	removed, err := CompactChunk(c.inner, chunk, fullCopyID(oldest))
+	result.add(removed)
+	return result, err
+}
+
+// Quarantines whichever forms the version is stored in. Any deltas based on it will no longer be readable, and so will
+// be found to be damaged as well.
+func (c *copyOnWrite) QuarantineVersion(chunk apis.ChunkNum, version apis.Version) error {
+	quarantiner, ok := c.inner.(Quarantiner)
+	if !ok {
+		return fmt.Errorf("underlying storage cannot quarantine %d/%d", chunk, version)
+	}
+	ids, err := c.inner.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, id := range ids {
+		if id/2 == version {
+			if err := quarantiner.QuarantineVersion(chunk, id); err != nil {
+				return err
+			}
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, version)
+	}
+	return nil
+}
+
+func (c *copyOnWrite) PurgeQuarantine(cutoff time.Time) (int, error) {
+	if purger, ok := c.inner.(QuarantinePurger); ok {
+		return purger.PurgeQuarantine(cutoff)
+	}
+	return 0, nil
+}
+
+func (c *copyOnWrite) ListChunksWithLatest() ([]apis.ChunkNum, error) {
+	return c.inner.ListChunksWithLatest()
+}
+
+func (c *copyOnWrite) GetLatestVersion(chunk apis.ChunkNum) (apis.Version, error) {
+	id, err := c.inner.GetLatestVersion(chunk)
+	if err != nil {
+		return 0, err
+	}
+	return id / 2, nil
+}
+
+func (c *copyOnWrite) SetLatestVersion(chunk apis.ChunkNum, latest apis.Version) error {
+	return c.inner.SetLatestVersion(chunk, fullCopyID(latest))
+}
+
+func (c *copyOnWrite) DeleteLatestVersion(chunk apis.ChunkNum) error {
+	return c.inner.DeleteLatestVersion(chunk)
+}
+
+func (c *copyOnWrite) StageData(bytes int) error {
+	return c.inner.StageData(bytes)
+}
+
+func (c *copyOnWrite) UnstageData(bytes int) {
+	c.inner.UnstageData(bytes)
+}
+
+// The byte counts come from the inner storage, so they reflect how the data is actually stored, but the versions are
+// counted as seen from outside.
+func (c *copyOnWrite) Stats() (StorageStats, error) {
+	stats, err := c.inner.Stats()
+	if err != nil {
+		return StorageStats{}, err
+	}
+	if err := countVersions(c, &stats); err != nil {
+		return StorageStats{}, err
+	}
+	return stats, nil
+}
+
+func (c *copyOnWrite) Durability() Durability {
+	return DurabilityOf(c.inner)
+}
+
+// Staged writes are kept exactly as they were sent, since they only become deltas once committed.
+func (c *copyOnWrite) KeepStaged(write StagedWrite) error {
+	if keeper, ok := c.inner.(StagedWriteKeeper); ok {
+		return keeper.KeepStaged(write)
+	}
+	return nil
+}
+
+func (c *copyOnWrite) ForgetStaged(hash apis.CommitHash) error {
+	if keeper, ok := c.inner.(StagedWriteKeeper); ok {
+		return keeper.ForgetStaged(hash)
+	}
+	return nil
+}
+
+func (c *copyOnWrite) ListStaged() ([]StagedWrite, error) {
+	if keeper, ok := c.inner.(StagedWriteKeeper); ok {
+		return keeper.ListStaged()
+	}
+	return nil, nil
+}
+
+func (c *copyOnWrite) KeepTombstone(tombstone apis.Tombstone) error {
+	if keeper, ok := c.inner.(TombstoneKeeper); ok {
+		return keeper.KeepTombstone(tombstone)
+	}
+	return nil
+}
+
+func (c *copyOnWrite) ForgetTombstone(chunk apis.ChunkNum) error {
+	if keeper, ok := c.inner.(TombstoneKeeper); ok {
+		return keeper.ForgetTombstone(chunk)
+	}
+	return nil
+}
+
+func (c *copyOnWrite) ListTombstones() ([]apis.Tombstone, error) {
+	if keeper, ok := c.inner.(TombstoneKeeper); ok {
+		return keeper.ListTombstones()
+	}
+	return nil, nil
+}
+
+// Deltas are counted at their stored size, so this reports the underlying storage's view of usage, if it has one.
+func (c *copyOnWrite) Usage() (StorageUsage, bool, error) {
+	if reporter, ok := c.inner.(UsageReporter); ok {
+		return reporter.Usage()
+	}
+	return StorageUsage{}, false, nil
+}
+
+func (c *copyOnWrite) Space() (StorageSpace, bool, error) {
+	if reporter, ok := c.inner.(SpaceReporter); ok {
+		return reporter.Space()
+	}
+	return StorageSpace{}, false, nil
+}
+
+func (c *copyOnWrite) IntegrityReport() (IntegrityReport, bool) {
+	if reporter, ok := c.inner.(IntegrityReporter); ok {
+		return reporter.IntegrityReport()
+	}
+	return IntegrityReport{}, false
+}
+
+// The wrapped storage is limited too, although it's only ever handed what this has already checked.
+func (c *copyOnWrite) SetMaxChunkSize(size uint32) bool {
+	c.limit.set(size)
+	SetMaxChunkSize(c.inner, size)
+	return true
+}
+
+func (c *copyOnWrite) SetMetricsSink(sink MetricsSink) bool {
+	return SetMetricsSink(c.inner, sink)
+}
+
+func (c *copyOnWrite) Flush() error {
+	return c.inner.Flush()
+}
+
+func (c *copyOnWrite) Close() {
+	c.inner.Close()
+}
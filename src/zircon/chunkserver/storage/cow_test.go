@@ -0,0 +1,153 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"testing"
+	"zircon/apis"
+)
+
+// Count the bytes of chunk data actually held by a MemoryStorage.
+func storedBytes(m *MemoryStorage) int {
+	total := 0
+	for _, versions := range m.chunks {
+		for _, data := range versions {
+			total += len(data)
+		}
+	}
+	return total
+}
+
+// Write a large chunk, and then a long series of versions that each change a handful of bytes, keeping every version.
+// Returns the data expected for each version.
+func runUpdateHeavyWorkload(t testing.TB, s ChunkStorage, versions int) [][]byte {
+	rng := rand.New(rand.NewSource(644))
+	data := make([]byte, 1024*1024)
+	rng.Read(data)
+	require.NoError(t, s.WriteVersion(1, 1, data))
+	require.NoError(t, s.SetLatestVersion(1, 1))
+
+	expected := [][]byte{append([]byte(nil), data...)}
+	for v := 2; v <= versions; v++ {
+		offset := rng.Intn(len(data) - 32)
+		rng.Read(data[offset : offset+32])
+		require.NoError(t, s.WriteVersion(1, apis.Version(v), data))
+		require.NoError(t, s.SetLatestVersion(1, apis.Version(v)))
+		expected = append(expected, append([]byte(nil), data...))
+	}
+	return expected
+}
+
+func TestCopyOnWriteSavesSpace(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	plain, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer plain.Close()
+	runUpdateHeavyWorkload(t, plain, 50)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	cow := WithCopyOnWrite(mem)
+	defer cow.Close()
+	expected := runUpdateHeavyWorkload(t, cow, 50)
+
+	before, after := storedBytes(plain.(*MemoryStorage)), storedBytes(mem.(*MemoryStorage))
+	t.Logf("storage for 50 versions of a 1 MB chunk: %d bytes without copy-on-write, %d bytes with", before, after)
+	// a full copy is forced every cowMaxChainLength versions, so we can't do better than that
+	assert.True(after*cowMaxChainLength/2 < before)
+
+	for i, data := range expected {
+		read, err := cow.ReadVersion(1, apis.Version(i+1))
+		assert.NoError(err)
+		assert.Equal(data, read, "version %d", i+1)
+	}
+
+	for v := apis.Version(1); v <= 50; v++ {
+		chain, err := cow.(*copyOnWrite).chainLength(1, v)
+		assert.NoError(err)
+		assert.True(chain < cowMaxChainLength)
+	}
+}
+
+func TestCopyOnWriteDeleteParent(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	cow := WithCopyOnWrite(mem)
+	defer cow.Close()
+	expected := runUpdateHeavyWorkload(t, cow, 4)
+
+	// version 2 is a delta on version 1, and version 3 is a delta on version 2
+	parent, isDelta, err := cow.(*copyOnWrite).parentOf(1, 3)
+	assert.NoError(err)
+	assert.True(isDelta)
+	assert.Equal(apis.Version(2), parent)
+
+	assert.NoError(cow.DeleteVersion(1, 1))
+	assert.NoError(cow.DeleteVersion(1, 2))
+
+	versions, err := cow.ListVersions(1)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{3, 4}, versions)
+
+	for v := apis.Version(3); v <= 4; v++ {
+		read, err := cow.ReadVersion(1, v)
+		assert.NoError(err)
+		assert.Equal(expected[v-1], read)
+	}
+
+	// deleting the newest version never needs to touch anything else
+	assert.NoError(cow.DeleteVersion(1, 4))
+	read, err := cow.ReadVersion(1, 3)
+	assert.NoError(err)
+	assert.Equal(expected[2], read)
+}
+
+func TestCopyOnWriteInterruptedMaterialize(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	cow := WithCopyOnWrite(mem)
+	defer cow.Close()
+	expected := runUpdateHeavyWorkload(t, cow, 2)
+
+	// as if we crashed after writing the full copy of version 2, but before removing its delta
+	require.NoError(t, mem.WriteVersion(1, fullCopyID(2), expected[1]))
+
+	versions, err := cow.ListVersions(1)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1, 2}, versions)
+
+	assert.NoError(cow.DeleteVersion(1, 2))
+	versions, err = cow.ListVersions(1)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1}, versions)
+}
+
+func benchmarkUpdateHeavy(b *testing.B, copyOnWrite bool) {
+	for i := 0; i < b.N; i++ {
+		mem, err := ConfigureMemoryStorage()
+		require.NoError(b, err)
+		s := mem
+		if copyOnWrite {
+			s = WithCopyOnWrite(mem)
+		}
+		runUpdateHeavyWorkload(b, s, 20)
+		if i == 0 {
+			b.Logf("bytes stored for 20 versions of a 1 MB chunk: %d", storedBytes(mem.(*MemoryStorage)))
+		}
+		s.Close()
+	}
+}
+
+func BenchmarkUpdateHeavyFullCopies(b *testing.B) {
+	benchmarkUpdateHeavy(b, false)
+}
+
+func BenchmarkUpdateHeavyCopyOnWrite(b *testing.B) {
+	benchmarkUpdateHeavy(b, true)
+}
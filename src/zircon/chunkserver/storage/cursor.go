@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"zircon/apis"
+)
+
+// Where an iteration over stored versions left off, so that it can be picked up again later by another cursor. The
+// empty token is the start of an iteration. Tokens are only meaningful to the kind of backend that produced them.
+type CursorToken string
+
+// Iterates over every stored version of every chunk a batch at a time, so that scrubbing, repair, and export don't
+// need to list everything that's stored at once. Versions come in ascending order of chunk, and then of version.
+// Each batch reflects what's stored when it's fetched, so versions deleted before the cursor reaches them aren't
+// returned, and versions added behind the cursor's position aren't either. A cursor that lists its chunks up front may
+// miss chunks that are added after it's opened.
+// Like the storage it came from, a cursor is NOT threadsafe, and must be confined to the same thread as its storage.
+type Cursor interface {
+	// Returns up to max more versions, or an empty batch once every version has been returned. max must be positive.
+	Next(max int) ([]apis.ChunkVersion, error)
+	// A token from which OpenCursor resumes just after the last version returned by Next.
+	Token() CursorToken
+}
+
+// Implemented by storage backends that can iterate over their contents without listing all of their chunks up front.
+type CursorOpener interface {
+	// Opens a cursor that resumes from a token returned by an earlier cursor over the same storage, or that starts at
+	// the beginning if the token is empty.
+	OpenCursor(token CursorToken) (Cursor, error)
+}
+
+// Opens a cursor over any storage backend. Backends that aren't CursorOpeners are iterated by listing all of their
+// chunks when the cursor is opened, although their versions are still only listed as they're reached.
+func OpenCursor(storage ChunkStorage, token CursorToken) (Cursor, error) {
+	if opener, ok := storage.(CursorOpener); ok {
+		return opener.OpenCursor(token)
+	}
+	position, started, err := parsePositionToken(token)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := storage.ListChunksWithData()
+	if err != nil {
+		return nil, err
+	}
+	sortChunks(chunks)
+	if started {
+		first := sort.Search(len(chunks), func(i int) bool {
+			return chunks[i] >= position.Chunk
+		})
+		chunks = chunks[first:]
+	}
+	return &listingCursor{
+		storage:  storage,
+		chunks:   chunks,
+		position: position,
+		started:  started,
+	}, nil
+}
+
+// The position of a cursor that orders versions by chunk and then by version, as used by every backend here.
+func positionToken(position apis.ChunkVersion) CursorToken {
+	return CursorToken(fmt.Sprintf("%d/%d", position.Chunk, position.Version))
+}
+
+// Returns started=false for the empty token, which comes before every version.
+func parsePositionToken(token CursorToken) (position apis.ChunkVersion, started bool, err error) {
+	if token == "" {
+		return apis.ChunkVersion{}, false, nil
+	}
+	parts := strings.Split(string(token), "/")
+	if len(parts) != 2 {
+		return apis.ChunkVersion{}, false, fmt.Errorf("invalid cursor token: %q", token)
+	}
+	chunk, err1 := strconv.ParseUint(parts[0], 10, 64)
+	version, err2 := strconv.ParseUint(parts[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		return apis.ChunkVersion{}, false, fmt.Errorf("invalid cursor token: %q", token)
+	}
+	return apis.ChunkVersion{Chunk: apis.ChunkNum(chunk), Version: apis.Version(version)}, true, nil
+}
+
+func sortChunks(chunks []apis.ChunkNum) {
+	sort.Slice(chunks, func(i, j int) bool {
+		return chunks[i] < chunks[j]
+	})
+}
+
+// Appends the versions of a chunk that come after a cursor's position to batch, stopping once batch holds max versions.
+// versions must be in ascending order.
+func appendVersionsAfter(batch []apis.ChunkVersion, max int, chunk apis.ChunkNum, versions []apis.Version,
+	position apis.ChunkVersion, started bool) []apis.ChunkVersion {
+	for _, version := range versions {
+		if len(batch) >= max {
+			break
+		}
+		if started && chunk == position.Chunk && version <= position.Version {
+			continue
+		}
+		batch = append(batch, apis.ChunkVersion{Chunk: chunk, Version: version})
+	}
+	return batch
+}
+
+// A cursor for storage that can only list everything at once.
+type listingCursor struct {
+	storage ChunkStorage
+	// the chunks that haven't been finished yet, in ascending order
+	chunks   []apis.ChunkNum
+	position apis.ChunkVersion
+	started  bool
+}
+
+func (c *listingCursor) Next(max int) ([]apis.ChunkVersion, error) {
+	if max <= 0 {
+		return nil, fmt.Errorf("invalid cursor batch size: %d", max)
+	}
+	var batch []apis.ChunkVersion
+	for len(c.chunks) > 0 && len(batch) < max {
+		versions, err := c.storage.ListVersions(c.chunks[0])
+		if err != nil {
+			return nil, err
+		}
+		before := len(batch)
+		batch = appendVersionsAfter(batch, max, c.chunks[0], versions, c.position, c.started)
+		if len(batch) > before {
+			c.position, c.started = batch[len(batch)-1], true
+		}
+		if len(batch) < max {
+			// every remaining version of this chunk has been returned
+			c.chunks = c.chunks[1:]
+		}
+	}
+	return batch, nil
+}
+
+func (c *listingCursor) Token() CursorToken {
+	if !c.started {
+		return ""
+	}
+	return positionToken(c.position)
+}
@@ -0,0 +1,98 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+)
+
+// Hides whether the storage underneath can open cursors itself, so that OpenCursor has to fall back to listing.
+type listingOnlyStorage struct {
+	ChunkStorage
+}
+
+// Drains a cursor in batches of a certain size, reopening it from its token after every batch.
+func iterateWithResume(t *testing.T, s ChunkStorage, batchSize int) []apis.ChunkVersion {
+	var all []apis.ChunkVersion
+	token := CursorToken("")
+	for {
+		cursor, err := OpenCursor(s, token)
+		require.NoError(t, err)
+		batch, err := cursor.Next(batchSize)
+		require.NoError(t, err)
+		if len(batch) == 0 {
+			return all
+		}
+		testifyAssert.True(t, len(batch) <= batchSize)
+		all = append(all, batch...)
+		token = cursor.Token()
+	}
+}
+
+func testCursor(t *testing.T, s ChunkStorage) {
+	assert := testifyAssert.New(t)
+
+	var expected []apis.ChunkVersion
+	for chunk := apis.ChunkNum(1); chunk <= 40; chunk++ {
+		for version := apis.Version(1); version <= apis.Version(chunk%4); version++ {
+			require.NoError(t, s.WriteVersion(chunk, version, []byte("cursor")))
+			expected = append(expected, apis.ChunkVersion{Chunk: chunk, Version: version})
+		}
+	}
+
+	for _, batchSize := range []int{1, 2, 3, 7, 100} {
+		cursor, err := OpenCursor(s, "")
+		require.NoError(t, err)
+		var all []apis.ChunkVersion
+		for {
+			batch, err := cursor.Next(batchSize)
+			require.NoError(t, err)
+			if len(batch) == 0 {
+				break
+			}
+			all = append(all, batch...)
+		}
+		assert.Equal(expected, all, "batch size %d", batchSize)
+
+		assert.Equal(expected, iterateWithResume(t, s, batchSize), "batch size %d", batchSize)
+	}
+
+	// versions added behind the cursor aren't returned, and neither are versions deleted before the cursor gets to them
+	cursor, err := OpenCursor(s, "")
+	require.NoError(t, err)
+	batch, err := cursor.Next(3)
+	require.NoError(t, err)
+	assert.Equal(expected[:3], batch)
+	assert.NoError(s.WriteVersion(1, 10, []byte("behind")))
+	assert.NoError(s.DeleteVersion(expected[4].Chunk, expected[4].Version))
+	var rest []apis.ChunkVersion
+	for {
+		batch, err := cursor.Next(5)
+		require.NoError(t, err)
+		if len(batch) == 0 {
+			break
+		}
+		rest = append(rest, batch...)
+	}
+	assert.Equal(append([]apis.ChunkVersion{expected[3]}, expected[5:]...), rest)
+
+	_, err = OpenCursor(s, "not a token")
+	assert.Error(err)
+	_, err = cursor.Next(0)
+	assert.Error(err)
+}
+
+func TestMemoryCursor(t *testing.T) {
+	s, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer s.Close()
+	testCursor(t, s)
+}
+
+func TestListingCursor(t *testing.T) {
+	s, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer s.Close()
+	testCursor(t, listingOnlyStorage{s})
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"zircon/apis"
+)
+
+func TestParseDurability(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	for _, durability := range []Durability{DurabilityNone, DurabilityCommit, DurabilityStageAndCommit} {
+		parsed, err := ParseDurability(durability.String())
+		assert.NoError(err)
+		assert.Equal(durability, parsed)
+	}
+	parsed, err := ParseDurability("")
+	assert.NoError(err)
+	assert.Equal(DurabilityNone, parsed)
+	_, err = ParseDurability("always")
+	assert.Error(err)
+}
+
+func TestFilesystemDurability(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "durability-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	for _, durability := range []Durability{DurabilityNone, DurabilityCommit, DurabilityStageAndCommit} {
+		t.Logf("durability: %v", durability)
+		require.NoError(t, os.RemoveAll(dir))
+		require.NoError(t, os.Mkdir(dir, 0755))
+
+		s, err := ConfigureFilesystemStorageWithDurability(dir, false, durability)
+		require.NoError(t, err)
+		fs := s.(*FilesystemStorage)
+		assert.Equal(durability, DurabilityOf(WithCopyOnWrite(fs)))
+
+		assert.NoError(fs.WriteVersion(1, 1, []byte("version one")))
+		assert.NoError(fs.SetLatestVersion(1, 1))
+		assert.NoError(fs.LinkVersion(1, 1, 2))
+		assert.NoError(fs.SetLatestVersion(1, 2))
+		write := StagedWrite{Hash: apis.CalculateCommitHash(8, []byte("two")), Offset: 8, Data: []byte("two")}
+		assert.NoError(fs.KeepStaged(write))
+		fs.Close()
+
+		s, err = ConfigureFilesystemStorageWithDurability(dir, false, durability)
+		require.NoError(t, err)
+		fs = s.(*FilesystemStorage)
+		latest, err := fs.GetLatestVersion(1)
+		assert.NoError(err)
+		assert.Equal(apis.Version(2), latest)
+		chunks, err := fs.ListChunksWithLatest()
+		assert.NoError(err)
+		assert.Equal([]apis.ChunkNum{1}, chunks)
+
+		staged, err := fs.ListStaged()
+		assert.NoError(err)
+		if durability == DurabilityStageAndCommit {
+			assert.Equal([]StagedWrite{write}, staged)
+		} else {
+			assert.Empty(staged)
+		}
+		assert.NoError(fs.ForgetStaged(write.Hash))
+		staged, err = fs.ListStaged()
+		assert.NoError(err)
+		assert.Empty(staged)
+		fs.Close()
+	}
+}
+
+func TestTornStagedWriteDiscarded(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "durability-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := ConfigureFilesystemStorageWithDurability(dir, false, DurabilityStageAndCommit)
+	require.NoError(t, err)
+	defer s.Close()
+	fs := s.(*FilesystemStorage)
+
+	intact := StagedWrite{Hash: apis.CalculateCommitHash(0, []byte("intact")), Offset: 0, Data: []byte("intact")}
+	torn := StagedWrite{Hash: apis.CalculateCommitHash(0, []byte("torn")), Offset: 0, Data: []byte("torn")}
+	assert.NoError(fs.KeepStaged(intact))
+	assert.NoError(fs.KeepStaged(torn))
+	require.NoError(t, os.Truncate(fs.stagedFilename(torn.Hash), chunkFileHeaderSize+2))
+	require.NoError(t, ioutil.WriteFile(fs.stagedFilename("headerless"), []byte("abc"), 0644))
+
+	staged, err := fs.ListStaged()
+	assert.NoError(err)
+	assert.Equal([]StagedWrite{intact}, staged)
+	_, err = os.Stat(fs.stagedFilename(torn.Hash))
+	assert.True(os.IsNotExist(err))
+}
+
+// Measures the cost of each durability level on a typical write: staging 64 KB, committing it as a new version,
+// making that version the latest, and cleaning up the old version.
+func benchmarkDurability(b *testing.B, durability Durability) {
+	dir, err := ioutil.TempDir("", "durability-bench-")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	s, err := ConfigureFilesystemStorageWithDurability(dir, false, durability)
+	require.NoError(b, err)
+	defer s.Close()
+	fs := s.(*FilesystemStorage)
+
+	data := make([]byte, 64*1024)
+	require.NoError(b, fs.WriteVersion(1, 1, data))
+	require.NoError(b, fs.SetLatestVersion(1, 1))
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		version := apis.Version(i + 2)
+		data[0] = byte(i)
+		write := StagedWrite{Hash: apis.CommitHash(fmt.Sprintf("%064x", i)), Data: data}
+		require.NoError(b, fs.KeepStaged(write))
+		require.NoError(b, fs.WriteVersion(1, version, data))
+		require.NoError(b, fs.ForgetStaged(write.Hash))
+		require.NoError(b, fs.SetLatestVersion(1, version))
+		require.NoError(b, fs.DeleteVersion(1, version-1))
+	}
+}
+
+func BenchmarkDurabilityNone(b *testing.B) {
+	benchmarkDurability(b, DurabilityNone)
+}
+
+func BenchmarkDurabilityCommit(b *testing.B) {
+	benchmarkDurability(b, DurabilityCommit)
+}
+
+func BenchmarkDurabilityStageAndCommit(b *testing.B) {
+	benchmarkDurability(b, DurabilityStageAndCommit)
+}
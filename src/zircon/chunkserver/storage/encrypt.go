@@ -0,0 +1,692 @@
+package storage
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"zircon/apis"
+)
+
+// Encryption at rest, layered on top of any other ChunkStorage.
+//
+// Each version is encrypted with AES-GCM, under a data key derived from a master key and the chunk and version it was
+// first written as, with a fresh random nonce. The ciphertext is exactly as long as the data, so that a full-sized
+// chunk still fits in the underlying storage; everything else needed to decrypt it goes in a separate header, which is
+// stored as a version of its own. As with copy-on-write, this is encoded in the version number used for the underlying
+// storage: version V has its ciphertext stored as 2V, and its header as 2V+1. The header is always written before the
+// ciphertext and deleted after it, so a version exists exactly when its ciphertext does, and a header without any
+// ciphertext is only ever the leftover of an interrupted write, to be replaced the next time that version is written.
+//
+// Header format, all little-endian:
+//   magic (4 bytes), key ID (4 bytes), original version (8 bytes), length (4 bytes), nonce (12 bytes), tag (16 bytes)
+//
+// Everything but the tag is authenticated along with the chunk number, so a header can't be moved to another chunk
+// or paired with the wrong ciphertext without being noticed. The original version stays the same when a version is
+// linked, which is why it is recorded rather than taken from where the header is found.
+//
+// Everything above this layer, including the checksums the chunkserver takes and sends along with replicas, only ever
+// sees plaintext. The checksums kept by the underlying storage cover the ciphertext it holds, so damage on disk is
+// caught there just as it was before.
+//
+// Staged writes are encrypted the same way, with the header kept as a staged write of its own, under the write's hash
+// with encryptedStagedSuffix appended.
+
+const encryptMagic = 0x434e455a // "ZENC"
+
+const encryptHeaderSize = 48
+
+const encryptNonceSize = 12
+
+const encryptTagSize = 16
+
+// The shortest master key accepted, since anything shorter would be the weakest part of AES-256.
+const MinMasterKeySize = 16
+
+const encryptedStagedSuffix = "-key"
+
+// Supplies the master keys that chunk data is encrypted under. Keys are never stored by the encrypting storage, only
+// the IDs that they are known by, so a key must stay available for as long as anything encrypted under it is kept.
+type KeyProvider interface {
+	// The key that new data is encrypted under, and the ID it's known by.
+	CurrentKey() (id uint32, key []byte, err error)
+	// Look up a key by its ID, including keys that are no longer current.
+	Key(id uint32) ([]byte, error)
+}
+
+type staticKeys struct {
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// A KeyProvider for a fixed set of master keys, such as ones supplied in a file at startup. To rotate keys, add a new
+// key and make it current, while keeping the old ones around for as long as they're in use; see KeyUsageReporter.
+func StaticKeys(keys map[uint32][]byte, current uint32) (KeyProvider, error) {
+	copied := map[uint32][]byte{}
+	for id, key := range keys {
+		if len(key) < MinMasterKeySize {
+			return nil, fmt.Errorf("master key %d is too short: %d bytes", id, len(key))
+		}
+		copied[id] = append([]byte(nil), key...)
+	}
+	if _, found := copied[current]; !found {
+		return nil, fmt.Errorf("no such master key: %d", current)
+	}
+	return staticKeys{keys: copied, current: current}, nil
+}
+
+func (s staticKeys) CurrentKey() (uint32, []byte, error) {
+	return s.current, s.keys[s.current], nil
+}
+
+func (s staticKeys) Key(id uint32) ([]byte, error) {
+	key, found := s.keys[id]
+	if !found {
+		return nil, fmt.Errorf("no such master key: %d", id)
+	}
+	return key, nil
+}
+
+// Reads master keys from a file, with one key per line as a decimal ID followed by the key in hex. Blank lines and
+// lines starting with '#' are ignored. The last key in the file is the current one, so keys are rotated by appending
+// a new one.
+func ReadKeyFile(path string) (KeyProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	keys := map[uint32][]byte{}
+	var current uint32
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a key ID and a key", path, line)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad key ID: %v", path, line, err)
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: bad key: %v", path, line, err)
+		}
+		if _, found := keys[uint32(id)]; found {
+			return nil, fmt.Errorf("%s:%d: duplicate key ID: %d", path, line, id)
+		}
+		keys[uint32(id)] = key
+		current = uint32(id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s: no keys", path)
+	}
+	return StaticKeys(keys, current)
+}
+
+// Implemented by storage layers that encrypt data, to tell when a master key is no longer needed.
+type KeyUsageReporter interface {
+	// How many stored versions are encrypted under each key ID, counting linked versions separately.
+	KeyUsage() (map[uint32]uint64, error)
+}
+
+type encrypted struct {
+	inner ChunkStorage
+	keys  KeyProvider
+	limit chunkSizeLimit
+}
+
+// Wrap a storage backend so that chunk data is encrypted before being stored. Storage written through this wrapper
+// must always be opened through this wrapper, with a KeyProvider that still has every key that was used.
+func WithEncryption(inner ChunkStorage, keys KeyProvider) ChunkStorage {
+	return &encrypted{inner: inner, keys: keys}
+}
+
+func cipherID(version apis.Version) apis.Version {
+	return version * 2
+}
+
+func headerID(version apis.Version) apis.Version {
+	return version*2 + 1
+}
+
+func isHeaderID(id apis.Version) bool {
+	return id%2 == 1
+}
+
+type encryptHeader struct {
+	keyID    uint32
+	original apis.Version
+	length   int
+	nonce    []byte
+	tag      []byte
+}
+
+func (h encryptHeader) encode() []byte {
+	encoded := make([]byte, encryptHeaderSize)
+	binary.LittleEndian.PutUint32(encoded[0:], encryptMagic)
+	binary.LittleEndian.PutUint32(encoded[4:], h.keyID)
+	binary.LittleEndian.PutUint64(encoded[8:], uint64(h.original))
+	binary.LittleEndian.PutUint32(encoded[16:], uint32(h.length))
+	copy(encoded[20:], h.nonce)
+	copy(encoded[32:], h.tag)
+	return encoded
+}
+
+// The underlying storage may pad the header with zeroes, so anything after it is ignored.
+func decodeEncryptHeader(encoded []byte) (encryptHeader, error) {
+	if len(encoded) < encryptHeaderSize {
+		return encryptHeader{}, fmt.Errorf("encryption header too short: %d bytes", len(encoded))
+	}
+	if binary.LittleEndian.Uint32(encoded) != encryptMagic {
+		return encryptHeader{}, errors.New("not an encryption header")
+	}
+	header := encryptHeader{
+		keyID:    binary.LittleEndian.Uint32(encoded[4:]),
+		original: apis.Version(binary.LittleEndian.Uint64(encoded[8:])),
+		length:   int(binary.LittleEndian.Uint32(encoded[16:])),
+		nonce:    encoded[20:32],
+		tag:      encoded[32:encryptHeaderSize],
+	}
+	if header.length > apis.MaxChunkSize {
+		return encryptHeader{}, fmt.Errorf("encryption header is corrupt: length %d", header.length)
+	}
+	return header, nil
+}
+
+// The data authenticated along with the ciphertext: what the data belongs to, followed by everything in the header
+// except for the tag.
+func (h encryptHeader) additionalData(context []byte) []byte {
+	return append(append([]byte(nil), context...), h.encode()[:encryptHeaderSize-encryptTagSize]...)
+}
+
+// The context that data keys and authentication are tied to for a version of a chunk.
+func versionContext(chunk apis.ChunkNum, original apis.Version) []byte {
+	context := make([]byte, 16)
+	binary.LittleEndian.PutUint64(context[0:], uint64(chunk))
+	binary.LittleEndian.PutUint64(context[8:], uint64(original))
+	return append([]byte("version:"), context...)
+}
+
+func stagedContext(hash apis.CommitHash) []byte {
+	return append([]byte("staged:"), hash...)
+}
+
+// Every piece of data gets a key of its own, so no key ever encrypts enough data for its random nonces to collide.
+func deriveDataKey(master []byte, context []byte) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write(context)
+	return mac.Sum(nil)
+}
+
+func dataCipher(master []byte, context []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(deriveDataKey(master, context))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypts data under the current key, returning the header and a ciphertext of the same length as the data.
+func (e *encrypted) seal(context []byte, original apis.Version, data []byte) ([]byte, []byte, error) {
+	keyID, master, err := e.keys.CurrentKey()
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot get current master key: %v", err)
+	}
+	aead, err := dataCipher(master, context)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := encryptHeader{keyID: keyID, original: original, length: len(data), nonce: make([]byte, encryptNonceSize)}
+	if _, err := rand.Read(header.nonce); err != nil {
+		return nil, nil, err
+	}
+	sealed := aead.Seal(nil, header.nonce, data, header.additionalData(context))
+	header.tag = sealed[len(data):]
+	return header.encode(), sealed[:len(data)], nil
+}
+
+// Decrypts and authenticates the ciphertext described by a header. Any padding after the ciphertext is ignored.
+func (e *encrypted) open(context []byte, header encryptHeader, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < header.length {
+		return nil, fmt.Errorf("ciphertext truncated: %d bytes instead of %d", len(ciphertext), header.length)
+	}
+	master, err := e.keys.Key(header.keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := dataCipher(master, context)
+	if err != nil {
+		return nil, err
+	}
+	sealed := append(append(make([]byte, 0, header.length+encryptTagSize), ciphertext[:header.length]...), header.tag...)
+	data, err := aead.Open(sealed[:0], header.nonce, sealed, header.additionalData(context))
+	if err != nil {
+		return nil, errors.New("decryption failed; data is damaged or was encrypted under a different key")
+	}
+	return data, nil
+}
+
+// Whether a version exists, and whether there's a header for it, which may be left over from an interrupted write.
+func (e *encrypted) locate(chunk apis.ChunkNum, version apis.Version) (exists bool, hasHeader bool, err error) {
+	ids, err := e.inner.ListVersions(chunk)
+	if err != nil {
+		return false, false, err
+	}
+	for _, id := range ids {
+		if id == cipherID(version) {
+			exists = true
+		}
+		if id == headerID(version) {
+			hasHeader = true
+		}
+	}
+	return exists, hasHeader, nil
+}
+
+func (e *encrypted) readHeader(chunk apis.ChunkNum, version apis.Version) (encryptHeader, error) {
+	encoded, err := e.inner.ReadVersion(chunk, headerID(version))
+	if err != nil {
+		return encryptHeader{}, fmt.Errorf("cannot read encryption header for %d/%d: %v", chunk, version, err)
+	}
+	header, err := decodeEncryptHeader(encoded)
+	if err != nil {
+		return encryptHeader{}, fmt.Errorf("bad encryption header for %d/%d: %v", chunk, version, err)
+	}
+	return header, nil
+}
+
+// Removes a header left behind by an interrupted write, so that the version can be written afresh.
+func (e *encrypted) clearLeftoverHeader(chunk apis.ChunkNum, version apis.Version, hasHeader bool) error {
+	if hasHeader {
+		return e.inner.DeleteVersion(chunk, headerID(version))
+	}
+	return nil
+}
+
+func (e *encrypted) KeyUsage() (map[uint32]uint64, error) {
+	usage := map[uint32]uint64{}
+	chunks, err := e.inner.ListChunksWithData()
+	if err != nil {
+		return nil, err
+	}
+	for _, chunk := range chunks {
+		versions, err := e.ListVersions(chunk)
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			header, err := e.readHeader(chunk, version)
+			if err != nil {
+				return nil, err
+			}
+			usage[header.keyID] += 1
+		}
+	}
+	if keeper, ok := e.inner.(StagedWriteKeeper); ok {
+		staged, err := keeper.ListStaged()
+		if err != nil {
+			return nil, err
+		}
+		headers, _ := pairStagedHeaders(staged)
+		for _, encoded := range headers {
+			if header, err := decodeEncryptHeader(encoded); err == nil {
+				usage[header.keyID] += 1
+			}
+		}
+	}
+	return usage, nil
+}
+
+func (e *encrypted) ListChunksWithData() ([]apis.ChunkNum, error) {
+	return e.inner.ListChunksWithData()
+}
+
+// Headers are left out, along with any version that has only a header.
+func (e *encrypted) ListVersions(chunk apis.ChunkNum) ([]apis.Version, error) {
+	ids, err := e.inner.ListVersions(chunk)
+	if err != nil {
+		return nil, err
+	}
+	var versions []apis.Version
+	for _, id := range ids {
+		if !isHeaderID(id) {
+			versions = append(versions, id/2)
+		}
+	}
+	return versions, nil
+}
+
+func (e *encrypted) ReadVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
+	exists, _, err := e.locate(chunk, version)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("no such chunk/version combination: %d/%d", chunk, version)
+	}
+	header, err := e.readHeader(chunk, version)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := e.inner.ReadVersion(chunk, cipherID(version))
+	if err != nil {
+		return nil, err
+	}
+	data, err := e.open(versionContext(chunk, header.original), header, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decrypt %d/%d: %v", chunk, version, err)
+	}
+	return data, nil
+}
+
+func (e *encrypted) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	if err := e.limit.check(chunk, version, data); err != nil {
+		return err
+	}
+	exists, hasHeader, err := e.locate(chunk, version)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("chunk/version combination already exists: %d/%d", chunk, version)
+	}
+	header, ciphertext, err := e.seal(versionContext(chunk, version), version, data)
+	if err != nil {
+		return fmt.Errorf("cannot encrypt %d/%d: %v", chunk, version, err)
+	}
+	if err := e.clearLeftoverHeader(chunk, version, hasHeader); err != nil {
+		return err
+	}
+	if err := e.inner.WriteVersion(chunk, headerID(version), header); err != nil {
+		return err
+	}
+	return e.inner.WriteVersion(chunk, cipherID(version), ciphertext)
+}
+
+// Links both the header and the ciphertext, so the linked version keeps being decrypted as the version it was first
+// written as.
+func (e *encrypted) LinkVersion(chunk apis.ChunkNum, existing apis.Version, version apis.Version) error {
+	if found, _, err := e.locate(chunk, existing); err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, existing)
+	}
+	exists, hasHeader, err := e.locate(chunk, version)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("chunk/version combination already exists: %d/%d", chunk, version)
+	}
+	if err := e.clearLeftoverHeader(chunk, version, hasHeader); err != nil {
+		return err
+	}
+	if err := e.inner.LinkVersion(chunk, headerID(existing), headerID(version)); err != nil {
+		return err
+	}
+	return e.inner.LinkVersion(chunk, cipherID(existing), cipherID(version))
+}
+
+func (e *encrypted) DeleteVersion(chunk apis.ChunkNum, version apis.Version) error {
+	exists, hasHeader, err := e.locate(chunk, version)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, version)
+	}
+	if err := e.inner.DeleteVersion(chunk, cipherID(version)); err != nil {
+		return err
+	}
+	return e.clearLeftoverHeader(chunk, version, hasHeader)
+}
+
+// A version's header and ciphertext are either both kept or both removed, along with any leftover headers of old
+// versions.
+func (e *encrypted) CompactChunk(chunk apis.ChunkNum, oldest apis.Version) (CompactionResult, error) {
+	return CompactChunk(e.inner, chunk, cipherID(oldest))
+}
+
+// Both parts of the version are quarantined, since neither is any use without the other.
+func (e *encrypted) QuarantineVersion(chunk apis.ChunkNum, version apis.Version) error {
+	quarantiner, ok := e.inner.(Quarantiner)
+	if !ok {
+		return fmt.Errorf("underlying storage cannot quarantine %d/%d", chunk, version)
+	}
+	exists, hasHeader, err := e.locate(chunk, version)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, version)
+	}
+	if err := quarantiner.QuarantineVersion(chunk, cipherID(version)); err != nil {
+		return err
+	}
+	if hasHeader {
+		return quarantiner.QuarantineVersion(chunk, headerID(version))
+	}
+	return nil
+}
+
+func (e *encrypted) PurgeQuarantine(cutoff time.Time) (int, error) {
+	if purger, ok := e.inner.(QuarantinePurger); ok {
+		return purger.PurgeQuarantine(cutoff)
+	}
+	return 0, nil
+}
+
+func (e *encrypted) ListChunksWithLatest() ([]apis.ChunkNum, error) {
+	return e.inner.ListChunksWithLatest()
+}
+
+func (e *encrypted) GetLatestVersion(chunk apis.ChunkNum) (apis.Version, error) {
+	id, err := e.inner.GetLatestVersion(chunk)
+	if err != nil {
+		return 0, err
+	}
+	return id / 2, nil
+}
+
+func (e *encrypted) SetLatestVersion(chunk apis.ChunkNum, latest apis.Version) error {
+	return e.inner.SetLatestVersion(chunk, cipherID(latest))
+}
+
+func (e *encrypted) DeleteLatestVersion(chunk apis.ChunkNum) error {
+	return e.inner.DeleteLatestVersion(chunk)
+}
+
+func (e *encrypted) StageData(bytes int) error {
+	return e.inner.StageData(bytes)
+}
+
+func (e *encrypted) UnstageData(bytes int) {
+	e.inner.UnstageData(bytes)
+}
+
+// The byte counts come from the inner storage, so they include the headers, but the versions are counted as seen from
+// outside.
+func (e *encrypted) Stats() (StorageStats, error) {
+	stats, err := e.inner.Stats()
+	if err != nil {
+		return StorageStats{}, err
+	}
+	if err := countVersions(e, &stats); err != nil {
+		return StorageStats{}, err
+	}
+	return stats, nil
+}
+
+func (e *encrypted) Durability() Durability {
+	return DurabilityOf(e.inner)
+}
+
+// The header is kept first, so a kept write always has one.
+func (e *encrypted) KeepStaged(write StagedWrite) error {
+	keeper, ok := e.inner.(StagedWriteKeeper)
+	if !ok {
+		return nil
+	}
+	header, ciphertext, err := e.seal(stagedContext(write.Hash), 0, write.Data)
+	if err != nil {
+		return fmt.Errorf("cannot encrypt staged write %s: %v", write.Hash, err)
+	}
+	if err := keeper.KeepStaged(StagedWrite{Hash: write.Hash + encryptedStagedSuffix, Data: header}); err != nil {
+		return err
+	}
+	return keeper.KeepStaged(StagedWrite{Hash: write.Hash, Offset: write.Offset, Data: ciphertext})
+}
+
+func (e *encrypted) ForgetStaged(hash apis.CommitHash) error {
+	keeper, ok := e.inner.(StagedWriteKeeper)
+	if !ok {
+		return nil
+	}
+	if err := keeper.ForgetStaged(hash); err != nil {
+		return err
+	}
+	return keeper.ForgetStaged(hash + encryptedStagedSuffix)
+}
+
+// Finds the header kept for each staged write, keyed by the write's hash, along with the hashes of any headers whose
+// writes are gone.
+func pairStagedHeaders(stored []StagedWrite) (headers map[apis.CommitHash][]byte, orphans []apis.CommitHash) {
+	headers = map[apis.CommitHash][]byte{}
+	writes := map[apis.CommitHash]bool{}
+	for _, write := range stored {
+		if strings.HasSuffix(string(write.Hash), encryptedStagedSuffix) {
+			headers[write.Hash[:len(write.Hash)-len(encryptedStagedSuffix)]] = write.Data
+		} else {
+			writes[write.Hash] = true
+		}
+	}
+	for hash := range headers {
+		if !writes[hash] {
+			delete(headers, hash)
+			orphans = append(orphans, hash+encryptedStagedSuffix)
+		}
+	}
+	return headers, orphans
+}
+
+// Headers left behind by a write that was forgotten, because of a crash in between, are left out, and forgotten along
+// the way, so that they don't keep their master key in use forever.
+func (e *encrypted) ListStaged() ([]StagedWrite, error) {
+	keeper, ok := e.inner.(StagedWriteKeeper)
+	if !ok {
+		return nil, nil
+	}
+	stored, err := keeper.ListStaged()
+	if err != nil {
+		return nil, err
+	}
+	headers, orphans := pairStagedHeaders(stored)
+	for _, hash := range orphans {
+		if err := keeper.ForgetStaged(hash); err != nil {
+			return nil, fmt.Errorf("cannot forget orphaned encryption header %s: %v", hash, err)
+		}
+	}
+	var result []StagedWrite
+	for _, write := range stored {
+		encoded, found := headers[write.Hash]
+		if !found {
+			continue
+		}
+		header, err := decodeEncryptHeader(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("bad encryption header for staged write %s: %v", write.Hash, err)
+		}
+		data, err := e.open(stagedContext(write.Hash), header, write.Data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot decrypt staged write %s: %v", write.Hash, err)
+		}
+		result = append(result, StagedWrite{Hash: write.Hash, Offset: write.Offset, Data: data})
+	}
+	return result, nil
+}
+
+func (e *encrypted) KeepTombstone(tombstone apis.Tombstone) error {
+	if keeper, ok := e.inner.(TombstoneKeeper); ok {
+		return keeper.KeepTombstone(tombstone)
+	}
+	return nil
+}
+
+func (e *encrypted) ForgetTombstone(chunk apis.ChunkNum) error {
+	if keeper, ok := e.inner.(TombstoneKeeper); ok {
+		return keeper.ForgetTombstone(chunk)
+	}
+	return nil
+}
+
+func (e *encrypted) ListTombstones() ([]apis.Tombstone, error) {
+	if keeper, ok := e.inner.(TombstoneKeeper); ok {
+		return keeper.ListTombstones()
+	}
+	return nil, nil
+}
+
+func (e *encrypted) SetCommitHashes(chunk apis.ChunkNum, version apis.Version, hashes []apis.CommitHash) error {
+	if keeper, ok := e.inner.(CommitHashKeeper); ok {
+		return keeper.SetCommitHashes(chunk, cipherID(version), hashes)
+	}
+	return nil
+}
+
+func (e *encrypted) CommitHashes(chunk apis.ChunkNum, version apis.Version) ([]apis.CommitHash, error) {
+	if keeper, ok := e.inner.(CommitHashKeeper); ok {
+		return keeper.CommitHashes(chunk, cipherID(version))
+	}
+	return nil, nil
+}
+
+func (e *encrypted) Space() (StorageSpace, bool, error) {
+	if reporter, ok := e.inner.(SpaceReporter); ok {
+		return reporter.Space()
+	}
+	return StorageSpace{}, false, nil
+}
+
+func (e *encrypted) IntegrityReport() (IntegrityReport, bool) {
+	if reporter, ok := e.inner.(IntegrityReporter); ok {
+		return reporter.IntegrityReport()
+	}
+	return IntegrityReport{}, false
+}
+
+// The wrapped storage is limited too, although it's only ever handed what this has already checked.
+func (e *encrypted) SetMaxChunkSize(size uint32) bool {
+	e.limit.set(size)
+	SetMaxChunkSize(e.inner, size)
+	return true
+}
+
+func (e *encrypted) SetMetricsSink(sink MetricsSink) bool {
+	return SetMetricsSink(e.inner, sink)
+}
+
+func (e *encrypted) Flush() error {
+	return e.inner.Flush()
+}
+
+func (e *encrypted) Close() {
+	e.inner.Close()
+}
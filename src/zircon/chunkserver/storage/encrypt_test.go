@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"bytes"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"zircon/apis"
+)
+
+func testKeys(t *testing.T, current uint32, ids ...uint32) KeyProvider {
+	keys := map[uint32][]byte{}
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte{byte(id)}, 32)
+	}
+	provider, err := StaticKeys(keys, current)
+	require.NoError(t, err)
+	return provider
+}
+
+func TestEncryptionHidesData(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	s := WithEncryption(mem, testKeys(t, 1, 1))
+	defer s.Close()
+
+	secret := bytes.Repeat([]byte("attack at dawn; "), 1000)
+	require.NoError(t, s.WriteVersion(1, 1, secret))
+	require.NoError(t, s.WriteVersion(2, 1, secret))
+
+	ids, err := mem.ListVersions(1)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{cipherID(1), headerID(1)}, ids)
+	ciphertext, err := mem.ReadVersion(1, cipherID(1))
+	assert.NoError(err)
+	assert.Equal(len(secret), len(ciphertext))
+	assert.False(bytes.Contains(ciphertext, []byte("attack at dawn")))
+	// the same data comes out differently every time it's written
+	other, err := mem.ReadVersion(2, cipherID(1))
+	assert.NoError(err)
+	assert.NotEqual(ciphertext, other)
+
+	read, err := s.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.Equal(secret, read)
+
+	// a linked version is still decrypted as the version it was first written as
+	assert.NoError(s.LinkVersion(1, 1, 2))
+	assert.NoError(s.DeleteVersion(1, 1))
+	versions, err := s.ListVersions(1)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{2}, versions)
+	read, err = s.ReadVersion(1, 2)
+	assert.NoError(err)
+	assert.Equal(secret, read)
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	require.NoError(t, WithEncryption(mem, testKeys(t, 1, 1)).WriteVersion(1, 1, []byte("under the old key")))
+
+	rotated := WithEncryption(mem, testKeys(t, 2, 1, 2))
+	require.NoError(t, rotated.WriteVersion(1, 2, []byte("under the new key")))
+	require.NoError(t, rotated.LinkVersion(1, 1, 3))
+	for version, expected := range map[apis.Version]string{1: "under the old key", 2: "under the new key", 3: "under the old key"} {
+		read, err := rotated.ReadVersion(1, version)
+		assert.NoError(err)
+		assert.Equal(expected, string(read))
+	}
+	usage, err := rotated.(KeyUsageReporter).KeyUsage()
+	assert.NoError(err)
+	assert.Equal(map[uint32]uint64{1: 2, 2: 1}, usage)
+
+	// once the old key is gone, only what was written under the new one can be read
+	retired := WithEncryption(mem, testKeys(t, 2, 2))
+	_, err = retired.ReadVersion(1, 1)
+	assert.Error(err)
+	read, err := retired.ReadVersion(1, 2)
+	assert.NoError(err)
+	assert.Equal("under the new key", string(read))
+}
+
+func TestEncryptionDetectsTampering(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	s := WithEncryption(mem, testKeys(t, 1, 1))
+	defer s.Close()
+	require.NoError(t, s.WriteVersion(1, 1, []byte("original contents")))
+	require.NoError(t, s.WriteVersion(2, 1, []byte("contents of another chunk")))
+
+	ciphertext, err := mem.ReadVersion(1, cipherID(1))
+	require.NoError(t, err)
+	ciphertext[0] ^= 1
+	require.NoError(t, mem.DeleteVersion(1, cipherID(1)))
+	require.NoError(t, mem.WriteVersion(1, cipherID(1), ciphertext))
+	_, err = s.ReadVersion(1, 1)
+	assert.Error(err)
+
+	// a header from another chunk doesn't fit either, even with the ciphertext it came with
+	for _, id := range []apis.Version{cipherID(1), headerID(1)} {
+		data, err := mem.ReadVersion(2, id)
+		require.NoError(t, err)
+		require.NoError(t, mem.WriteVersion(3, id, data))
+	}
+	_, err = s.ReadVersion(3, 1)
+	assert.Error(err)
+}
+
+func TestEncryptionInterruptedWrite(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	s := WithEncryption(mem, testKeys(t, 1, 1))
+	defer s.Close()
+	require.NoError(t, s.WriteVersion(1, 1, []byte("first attempt")))
+	// as if we crashed right after writing the header
+	require.NoError(t, mem.DeleteVersion(1, cipherID(1)))
+
+	versions, err := s.ListVersions(1)
+	assert.NoError(err)
+	assert.Empty(versions)
+	_, err = s.ReadVersion(1, 1)
+	assert.Error(err)
+
+	assert.NoError(s.WriteVersion(1, 1, []byte("second attempt")))
+	read, err := s.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.Equal("second attempt", string(read))
+}
+
+func TestEncryptedStagedWrites(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "encrypt-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs, err := ConfigureFilesystemStorageWithOptions(dir, FilesystemOptions{Durability: DurabilityStageAndCommit})
+	require.NoError(t, err)
+	s := WithEncryption(fs, testKeys(t, 1, 1))
+	defer s.Close()
+
+	data := []byte("staged but not yet committed")
+	write := StagedWrite{Hash: apis.CalculateCommitHash(16, data), Offset: 16, Data: data}
+	require.NoError(t, s.(StagedWriteKeeper).KeepStaged(write))
+
+	raw, err := ioutil.ReadFile(path.Join(dir, "staged", string(write.Hash)))
+	assert.NoError(err)
+	assert.False(bytes.Contains(raw, data))
+
+	staged, err := s.(StagedWriteKeeper).ListStaged()
+	assert.NoError(err)
+	assert.Equal([]StagedWrite{write}, staged)
+
+	assert.NoError(s.(StagedWriteKeeper).ForgetStaged(write.Hash))
+	staged, err = fs.(StagedWriteKeeper).ListStaged()
+	assert.NoError(err)
+	assert.Empty(staged)
+}
+
+func TestEncryptedStagedOrphanedHeader(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "encrypt-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs, err := ConfigureFilesystemStorageWithOptions(dir, FilesystemOptions{Durability: DurabilityStageAndCommit})
+	require.NoError(t, err)
+	s := WithEncryption(fs, testKeys(t, 1, 1))
+	defer s.Close()
+
+	// a crash after the write itself was forgotten, but before its header was, leaves the header behind
+	data := []byte("staged but not yet committed")
+	write := StagedWrite{Hash: apis.CalculateCommitHash(16, data), Offset: 16, Data: data}
+	require.NoError(t, s.(StagedWriteKeeper).KeepStaged(write))
+	require.NoError(t, fs.(StagedWriteKeeper).ForgetStaged(write.Hash))
+
+	// it doesn't count as a use of its key
+	usage, err := s.(KeyUsageReporter).KeyUsage()
+	assert.NoError(err)
+	assert.Zero(usage[1])
+
+	// and recovery gets rid of it
+	staged, err := s.(StagedWriteKeeper).ListStaged()
+	assert.NoError(err)
+	assert.Empty(staged)
+	staged, err = fs.(StagedWriteKeeper).ListStaged()
+	assert.NoError(err)
+	assert.Empty(staged)
+}
+
+func TestReadKeyFile(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "encrypt-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	keyFile := path.Join(dir, "keys")
+
+	require.NoError(t, ioutil.WriteFile(keyFile, []byte(`# retired once nothing uses it
+1 000102030405060708090a0b0c0d0e0f
+
+7 f0f1f2f3f4f5f6f7f8f9fafbfcfdfeff
+`), 0600))
+	keys, err := ReadKeyFile(keyFile)
+	require.NoError(t, err)
+	id, key, err := keys.CurrentKey()
+	assert.NoError(err)
+	assert.Equal(uint32(7), id)
+	assert.Equal(byte(0xf0), key[0])
+	key, err = keys.Key(1)
+	assert.NoError(err)
+	assert.Equal(byte(0x0f), key[15])
+	_, err = keys.Key(2)
+	assert.Error(err)
+
+	for _, bad := range []string{"", "1 0001", "1 zz", "x 000102030405060708090a0b0c0d0e0f",
+		"1 000102030405060708090a0b0c0d0e0f\n1 000102030405060708090a0b0c0d0e0f"} {
+		require.NoError(t, ioutil.WriteFile(keyFile, []byte(bad), 0600))
+		_, err = ReadKeyFile(keyFile)
+		assert.Error(err, bad)
+	}
+}
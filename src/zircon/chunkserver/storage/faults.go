@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+// A ChunkStorage that can be told to misbehave, to test how the layers above it cope with failing disks. Wraps any
+// real backend, which does all of the actual work. The fault controls are threadsafe, so that tests can inject faults
+// while the storage is in use.
+type FaultyStorage struct {
+	ChunkStorage
+
+	mu          sync.Mutex
+	failWrites  []error
+	corrupted   map[apis.ChunkNum]map[apis.Version]bool
+	readLatency time.Duration
+	counts      FaultCounts
+}
+
+// How many times each kind of fault has actually been injected.
+type FaultCounts struct {
+	FailedWrites   int
+	CorruptedReads int
+	DelayedReads   int
+}
+
+var _ ChunkStorage = &FaultyStorage{}
+
+func WithFaults(inner ChunkStorage) *FaultyStorage {
+	return &FaultyStorage{
+		ChunkStorage: inner,
+		corrupted:    map[apis.ChunkNum]map[apis.Version]bool{},
+	}
+}
+
+// Cause the next write of a version's data, through either WriteVersion or LinkVersion, to fail with err, without
+// reaching the underlying storage. Calling this more than once queues up failures for the writes after that.
+func (f *FaultyStorage) FailNextWrite(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failWrites = append(f.failWrites, err)
+}
+
+// Cause every read of a particular version to return damaged data, as if it sat on a bad part of the disk, until the
+// version is deleted. This can be set up before the version is even written. The stored data itself is left alone.
+func (f *FaultyStorage) CorruptChunk(chunk apis.ChunkNum, version apis.Version) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.corrupted[chunk] == nil {
+		f.corrupted[chunk] = map[apis.Version]bool{}
+	}
+	f.corrupted[chunk][version] = true
+}
+
+// Make every ReadVersion take at least this much longer. Zero removes the delay.
+func (f *FaultyStorage) SetReadLatency(latency time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readLatency = latency
+}
+
+func (f *FaultyStorage) Faults() FaultCounts {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.counts
+}
+
+func (f *FaultyStorage) takeWriteFailure() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.failWrites) == 0 {
+		return nil
+	}
+	err := f.failWrites[0]
+	f.failWrites = f.failWrites[1:]
+	f.counts.FailedWrites += 1
+	return fmt.Errorf("injected fault: %v", err)
+}
+
+func (f *FaultyStorage) clearCorruption(chunk apis.ChunkNum, version apis.Version) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.corrupted[chunk], version)
+}
+
+func (f *FaultyStorage) ReadVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
+	return f.ReadVersionInto(chunk, version, nil)
+}
+
+func (f *FaultyStorage) ReadVersionInto(chunk apis.ChunkNum, version apis.Version, buf []byte) ([]byte, error) {
+	f.mu.Lock()
+	latency := f.readLatency
+	corrupt := f.corrupted[chunk][version]
+	if latency > 0 {
+		f.counts.DelayedReads += 1
+	}
+	f.mu.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	data, err := ReadVersionInto(f.ChunkStorage, chunk, version, buf)
+	if err != nil || !corrupt {
+		return data, err
+	}
+	damaged := make([]byte, len(data))
+	copy(damaged, data)
+	if len(damaged) == 0 {
+		damaged = []byte{0}
+	}
+	// flipping every bit of the first byte is enough for any checksum to notice
+	damaged[0] ^= 0xFF
+	f.mu.Lock()
+	f.counts.CorruptedReads += 1
+	f.mu.Unlock()
+	return damaged, nil
+}
+
+func (f *FaultyStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	if err := f.takeWriteFailure(); err != nil {
+		return err
+	}
+	return f.ChunkStorage.WriteVersion(chunk, version, data)
+}
+
+func (f *FaultyStorage) LinkVersion(chunk apis.ChunkNum, existing apis.Version, version apis.Version) error {
+	if err := f.takeWriteFailure(); err != nil {
+		return err
+	}
+	return f.ChunkStorage.LinkVersion(chunk, existing, version)
+}
+
+func (f *FaultyStorage) DeleteVersion(chunk apis.ChunkNum, version apis.Version) error {
+	if err := f.ChunkStorage.DeleteVersion(chunk, version); err != nil {
+		return err
+	}
+	f.clearCorruption(chunk, version)
+	return nil
+}
+
+func (f *FaultyStorage) CompactChunk(chunk apis.ChunkNum, oldest apis.Version) (CompactionResult, error) {
+	versions, err := f.ChunkStorage.ListVersions(chunk)
+	if err != nil {
+		return CompactionResult{}, err
+	}
+	result, err := CompactChunk(f.ChunkStorage, chunk, oldest)
+	if err != nil {
+		return result, err
+	}
+	for _, version := range versions {
+		if version < oldest {
+			f.clearCorruption(chunk, version)
+		}
+	}
+	return result, nil
+}
+
+func (f *FaultyStorage) QuarantineVersion(chunk apis.ChunkNum, version apis.Version) error {
+	quarantiner, ok := f.ChunkStorage.(Quarantiner)
+	if !ok {
+		return fmt.Errorf("underlying storage cannot quarantine %d/%d", chunk, version)
+	}
+	if err := quarantiner.QuarantineVersion(chunk, version); err != nil {
+		return err
+	}
+	f.clearCorruption(chunk, version)
+	return nil
+}
+
+func (f *FaultyStorage) PurgeQuarantine(cutoff time.Time) (int, error) {
+	if purger, ok := f.ChunkStorage.(QuarantinePurger); ok {
+		return purger.PurgeQuarantine(cutoff)
+	}
+	return 0, nil
+}
+
+func (f *FaultyStorage) Durability() Durability {
+	return DurabilityOf(f.ChunkStorage)
+}
+
+func (f *FaultyStorage) KeepStaged(write StagedWrite) error {
+	if keeper, ok := f.ChunkStorage.(StagedWriteKeeper); ok {
+		return keeper.KeepStaged(write)
+	}
+	return nil
+}
+
+func (f *FaultyStorage) ForgetStaged(hash apis.CommitHash) error {
+	if keeper, ok := f.ChunkStorage.(StagedWriteKeeper); ok {
+		return keeper.ForgetStaged(hash)
+	}
+	return nil
+}
+
+func (f *FaultyStorage) ListStaged() ([]StagedWrite, error) {
+	if keeper, ok := f.ChunkStorage.(StagedWriteKeeper); ok {
+		return keeper.ListStaged()
+	}
+	return nil, nil
+}
+
+func (f *FaultyStorage) SetCommitHashes(chunk apis.ChunkNum, version apis.Version, hashes []apis.CommitHash) error {
+	if keeper, ok := f.ChunkStorage.(CommitHashKeeper); ok {
+		return keeper.SetCommitHashes(chunk, version, hashes)
+	}
+	return nil
+}
+
+func (f *FaultyStorage) CommitHashes(chunk apis.ChunkNum, version apis.Version) ([]apis.CommitHash, error) {
+	if keeper, ok := f.ChunkStorage.(CommitHashKeeper); ok {
+		return keeper.CommitHashes(chunk, version)
+	}
+	return nil, nil
+}
+
+func (f *FaultyStorage) KeepTombstone(tombstone apis.Tombstone) error {
+	if keeper, ok := f.ChunkStorage.(TombstoneKeeper); ok {
+		return keeper.KeepTombstone(tombstone)
+	}
+	return nil
+}
+
+func (f *FaultyStorage) ForgetTombstone(chunk apis.ChunkNum) error {
+	if keeper, ok := f.ChunkStorage.(TombstoneKeeper); ok {
+		return keeper.ForgetTombstone(chunk)
+	}
+	return nil
+}
+
+func (f *FaultyStorage) ListTombstones() ([]apis.Tombstone, error) {
+	if keeper, ok := f.ChunkStorage.(TombstoneKeeper); ok {
+		return keeper.ListTombstones()
+	}
+	return nil, nil
+}
+
+func (f *FaultyStorage) Space() (StorageSpace, bool, error) {
+	if reporter, ok := f.ChunkStorage.(SpaceReporter); ok {
+		return reporter.Space()
+	}
+	return StorageSpace{}, false, nil
+}
+
+func (f *FaultyStorage) IntegrityReport() (IntegrityReport, bool) {
+	if reporter, ok := f.ChunkStorage.(IntegrityReporter); ok {
+		return reporter.IntegrityReport()
+	}
+	return IntegrityReport{}, false
+}
+
+func (f *FaultyStorage) SetMaxChunkSize(size uint32) bool {
+	return SetMaxChunkSize(f.ChunkStorage, size)
+}
+
+func (f *FaultyStorage) SetMetricsSink(sink MetricsSink) bool {
+	return SetMetricsSink(f.ChunkStorage, sink)
+}
+
+func (f *FaultyStorage) VerifyAll(ctx context.Context, options VerifyOptions, found func(apis.VerifyFinding)) (apis.VerifyReport, error) {
+	return VerifyAll(ctx, f.ChunkStorage, options, found)
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"errors"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/util"
+)
+
+func TestFaultyStorage(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	f := WithFaults(mem)
+
+	// without any faults injected, everything passes straight through
+	assert.NoError(f.WriteVersion(1, 1, []byte("hello")))
+	data, err := f.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.Equal("hello", string(util.StripTrailingZeroes(data)))
+
+	// an injected write failure only applies once, and never reaches the real storage
+	f.FailNextWrite(errors.New("disk on fire"))
+	err = f.WriteVersion(1, 2, []byte("world"))
+	assert.Error(err)
+	assert.Contains(err.Error(), "disk on fire")
+	versions, err := mem.ListVersions(1)
+	assert.NoError(err)
+	assert.Len(versions, 1)
+	assert.NoError(f.WriteVersion(1, 2, []byte("world")))
+
+	// links count as writes, too
+	f.FailNextWrite(errors.New("still on fire"))
+	assert.Error(f.LinkVersion(1, 2, 3))
+	assert.NoError(f.LinkVersion(1, 2, 3))
+
+	// corruption affects reads of one version, until it is deleted
+	f.CorruptChunk(1, 2)
+	data, err = f.ReadVersion(1, 2)
+	assert.NoError(err)
+	assert.NotEqual("world", string(util.StripTrailingZeroes(data)))
+	data, err = f.ReadVersion(1, 3)
+	assert.NoError(err)
+	assert.Equal("world", string(util.StripTrailingZeroes(data)))
+	data, err = mem.ReadVersion(1, 2)
+	assert.NoError(err)
+	assert.Equal("world", string(util.StripTrailingZeroes(data)), "stored data should not actually be damaged")
+	assert.NoError(f.DeleteVersion(1, 2))
+	assert.NoError(f.WriteVersion(1, 2, []byte("again")))
+	data, err = f.ReadVersion(1, 2)
+	assert.NoError(err)
+	assert.Equal("again", string(util.StripTrailingZeroes(data)))
+
+	f.SetReadLatency(20 * time.Millisecond)
+	start := time.Now()
+	_, err = f.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.True(time.Since(start) >= 20*time.Millisecond)
+	f.SetReadLatency(0)
+	_, err = f.ReadVersion(1, 1)
+	assert.NoError(err)
+
+	assert.Equal(FaultCounts{FailedWrites: 2, CorruptedReads: 1, DelayedReads: 1}, f.Faults())
+
+	// optional interfaces of the real storage remain available
+	space, _, err := f.Space()
+	assert.NoError(err)
+	expected, _, err := mem.(SpaceReporter).Space()
+	assert.NoError(err)
+	assert.Equal(expected, space)
+}
@@ -0,0 +1,35 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// Identifies the file behind a directory entry, so that hard links to the same file can be recognized.
+func fileInode(fi os.FileInfo) (uint64, bool) {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino), true
+	}
+	return 0, false
+}
+
+// How much of the disk a file takes up, which can be less than its size if it has holes. Falls back to its size if the
+// platform doesn't say.
+func allocatedSize(fi os.FileInfo) uint64 {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		// always counted in units of 512 bytes, whatever the block size of the filesystem
+		return uint64(stat.Blocks) * 512
+	}
+	return uint64(fi.Size())
+}
+
+// How many directory entries link to a file.
+func linkCount(fi os.FileInfo) (uint64, bool) {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Nlink), true
+	}
+	return 0, false
+}
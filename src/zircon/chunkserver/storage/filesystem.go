@@ -1,7 +1,10 @@
 package storage
 
 import (
+	"bytes"
+	"encoding/binary"
 	"errors"
+	"hash/crc32"
 	"zircon/apis"
 	"sort"
 	"fmt"
@@ -9,63 +12,236 @@ import (
 	"io/ioutil"
 	"strings"
 	"strconv"
+	"sync"
 	"io"
+	"path/filepath"
+	"time"
+	"zircon/util"
 )
 
 // TODO: caching?
 
+// Everything is kept under the base path:
+//   chunks/<fanout>/<chunk>/<version>   committed versions, in the chunk file format below, which carries each
+//                                       version's length and checksum; <fanout> is the chunk number modulo 256, as two
+//                                       hex digits, so that no directory grows too large
+//   tmp/<chunk>-<version>               versions being assembled, until they're complete and renamed into chunks/
+//   latest-<chunk>                      the latest version of each chunk, in decimal
+//   staged/, staged.log, tombstones/, hashes/, quarantine/, and wal, as described alongside the code that uses them
+// A committed version only ever appears by renaming a complete file into place, so whatever point a crash happens at,
+// a version is either entirely there or not there at all. Anything left in tmp/ was never committed, and is thrown
+// away when the storage is opened. Chunk directories from before the fanout (chunk-<chunk>) are moved into place then
+// too.
+
 type FilesystemStorage struct {
 	isClosed bool
 	path     string
+	// nil if the write-ahead log is disabled
+	log        *writeAheadLog
+	durability Durability
+	// only kept in memory, since staged writes are held by the chunkserver and don't survive a restart on their own
+	staged int
+	// nil unless staged writes are being kept in a log, or were left in one
+	stagingLog *stagingLog
+	// whether newly staged writes go into the log, rather than files in staged/
+	logStaged bool
+	// nil unless staged writes are buffered before they're kept; see StageBufferOptions
+	stageBuffer *stageBuffer
+	// held while staged writes are kept, forgotten, or listed, while the storage is flushed or closed, and while isClosed
+	// or the metrics sink is used or changed, since the stage buffer can be written out from its timer at any time
+	stageMu sync.Mutex
+	// nil unless versions are mapped into memory for reading
+	mapped *mappedVersions
+	// nil unless the files were checked when the storage was opened
+	integrity *IntegrityReport
+	// called at each step of committing a version, so that tests can simulate a crash there; nil otherwise
+	killPoint func(step string)
+	// whether a chunk directory of a given size, holding a given number of files, should be rewritten by compaction
+	fragmented func(size int64, entries int) bool
+	metrics    MetricsSink
+	limit      chunkSizeLimit
 }
 
 // Given a base path for storage of files in a modern filesystem, construct an interface by which a chunkserver can store
-// chunks.
-func ConfigureFilesystemStorage(basepath string) (ChunkStorage, error) {
+// chunks. If writeAheadLog is set, every mutation is logged before it is applied, so that a crash cannot leave a
+// mutation partially applied.
+// Regardless of writeAheadLog, any mutations left in the log by a previous crash are replayed before this returns.
+func ConfigureFilesystemStorage(basepath string, writeAheadLog bool) (ChunkStorage, error) {
+	return ConfigureFilesystemStorageWithDurability(basepath, writeAheadLog, DurabilityNone)
+}
+
+// Like ConfigureFilesystemStorage, but syncs changes to disk as required by the chosen durability level.
+func ConfigureFilesystemStorageWithDurability(basepath string, writeAheadLog bool, durability Durability) (ChunkStorage, error) {
+	return ConfigureFilesystemStorageWithOptions(basepath, FilesystemOptions{
+		WriteAheadLog: writeAheadLog,
+		Durability:    durability,
+	})
+}
+
+type FilesystemOptions struct {
+	// Log every mutation before it's applied, as for ConfigureFilesystemStorage.
+	WriteAheadLog bool
+	Durability    Durability
+	// Keep staged writes by appending them to a single log, which is synced before KeepStaged returns, instead of
+	// writing a file apiece. Staged writes are kept this way regardless of the durability level.
+	StagingLog bool
+	// Map up to this many bytes of version files into memory, so that reads of hot chunks are served from the page
+	// cache without being copied into a buffer first. Zero reads every version with a plain read.
+	MappedReadCapacity int
+	// How thoroughly to check the files before anything else uses them. Damaged versions are quarantined, and the
+	// storage refuses to open with an IntegrityError if it can't tell which chunks or versions it holds. Either way,
+	// what was found is available through IntegrityReport.
+	Integrity IntegrityCheck
+	// Hold newly staged writes in memory, and keep them in batches. Disabled by default.
+	StageBuffer StageBufferOptions
+}
+
+// Like ConfigureFilesystemStorage, but with every option available. Staged writes left in a staging log by a previous
+// run are picked up whether or not StagingLog is set.
+func ConfigureFilesystemStorageWithOptions(basepath string, options FilesystemOptions) (ChunkStorage, error) {
 	if fi, err := os.Stat(basepath); err != nil {
 		return nil, err
 	} else if !fi.IsDir() {
 		return nil, errors.New("not a directory")
 	}
-	return &FilesystemStorage{
-		path: basepath,
-	}, nil
+	m := &FilesystemStorage{
+		path:        basepath,
+		durability:  options.Durability,
+		logStaged:   options.StagingLog,
+		stageBuffer: newStageBuffer(options.StageBuffer),
+		fragmented:  isFragmented,
+		metrics:     NoMetrics,
+	}
+	if options.MappedReadCapacity > 0 {
+		m.mapped = newMappedVersions(options.MappedReadCapacity)
+	}
+	if err := m.cleanUp(); err != nil {
+		return nil, err
+	}
+	if err := m.recover(m.walFilename()); err != nil {
+		return nil, err
+	}
+	if options.WriteAheadLog {
+		log, err := openWriteAheadLog(m.walFilename())
+		if err != nil {
+			return nil, err
+		}
+		log.metrics = m.metrics
+		m.log = log
+	}
+	if options.Integrity != IntegrityCheckNone {
+		report, err := m.checkIntegrity(options.Integrity)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.integrity = &report
+	}
+	if err := m.openStagingLog(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *FilesystemStorage) walFilename() string {
+	return fmt.Sprintf("%s/wal", m.path)
 }
 
 func (m *FilesystemStorage) assertOpen() {
-	if m.isClosed {
+	m.stageMu.Lock()
+	closed := m.isClosed
+	m.stageMu.Unlock()
+	if closed {
 		panic("attempt to use closed FilesystemStorage")
 	}
 }
 
+func (m *FilesystemStorage) chunksDir() string {
+	return fmt.Sprintf("%s/chunks", m.path)
+}
+
+func (m *FilesystemStorage) fanoutDir(chunk apis.ChunkNum) string {
+	return fmt.Sprintf("%s/chunks/%02x", m.path, chunk%256)
+}
+
 func (m *FilesystemStorage) chunkDir(chunk apis.ChunkNum) string {
-	return fmt.Sprintf("%s/chunk-%d", m.path, chunk)
+	return fmt.Sprintf("%s/chunks/%02x/%d", m.path, chunk%256, chunk)
 }
 
 func (m *FilesystemStorage) chunkFilename(chunk apis.ChunkNum, version apis.Version) string {
-	return fmt.Sprintf("%s/chunk-%d/%d", m.path, chunk, version)
+	return fmt.Sprintf("%s/chunks/%02x/%d/%d", m.path, chunk%256, chunk, version)
+}
+
+func (m *FilesystemStorage) tempDir() string {
+	return fmt.Sprintf("%s/tmp", m.path)
+}
+
+func (m *FilesystemStorage) tempFilename(chunk apis.ChunkNum, version apis.Version) string {
+	return fmt.Sprintf("%s/tmp/%d-%d", m.path, chunk, version)
 }
 
 func (m *FilesystemStorage) latestFilename(chunk apis.ChunkNum) string {
 	return fmt.Sprintf("%s/latest-%d", m.path, chunk)
 }
 
+// Named so that it can't be mistaken for a latest file if it's left behind by a crash.
+func (m *FilesystemStorage) latestTempFilename(chunk apis.ChunkNum) string {
+	return fmt.Sprintf("%s/tmp-latest-%d", m.path, chunk)
+}
+
+func (m *FilesystemStorage) stagedDir() string {
+	return fmt.Sprintf("%s/staged", m.path)
+}
+
+func (m *FilesystemStorage) stagingLogFilename() string {
+	return fmt.Sprintf("%s/staged.log", m.path)
+}
+
+func (m *FilesystemStorage) stagedFilename(hash apis.CommitHash) string {
+	return fmt.Sprintf("%s/staged/%s", m.path, hash)
+}
+
+func (m *FilesystemStorage) tombstoneDir() string {
+	return fmt.Sprintf("%s/tombstones", m.path)
+}
+
+func (m *FilesystemStorage) tombstoneFilename(chunk apis.ChunkNum) string {
+	return fmt.Sprintf("%s/tombstones/%d", m.path, chunk)
+}
+
+func (m *FilesystemStorage) hashesDir() string {
+	return fmt.Sprintf("%s/hashes", m.path)
+}
+
+func (m *FilesystemStorage) hashesFilename(chunk apis.ChunkNum, version apis.Version) string {
+	return fmt.Sprintf("%s/hashes/%d-%d", m.path, chunk, version)
+}
+
 func (m *FilesystemStorage) ListChunksWithData() ([]apis.ChunkNum, error) {
 	m.assertOpen()
-	fis, err := ioutil.ReadDir(m.path)
+	fanouts, err := ioutil.ReadDir(m.chunksDir())
 	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
 		return nil, err
 	}
 	var result []apis.ChunkNum
-	for _, fi := range fis {
-		if strings.HasPrefix(fi.Name(), "chunk-") {
-			chunk, err := strconv.ParseUint(fi.Name()[6:], 10, 64)
+	for _, fanout := range fanouts {
+		fis, err := ioutil.ReadDir(filepath.Join(m.chunksDir(), fanout.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			chunk, err := strconv.ParseUint(fi.Name(), 10, 64)
 			if err != nil {
 				return nil, err
 			}
 			result = append(result, apis.ChunkNum(chunk))
 		}
 	}
+	sortChunks(result)
 	return result, nil
 }
 
@@ -92,20 +268,182 @@ func (m *FilesystemStorage) ListVersions(chunk apis.ChunkNum) ([]apis.Version, e
 	return result, nil
 }
 
+func (m *FilesystemStorage) quarantineDir() string {
+	return fmt.Sprintf("%s/quarantine", m.path)
+}
+
+// Chunk files start with a header, so that truncated or corrupted files can be detected:
+//   magic (4 bytes), data length (4 bytes), CRC-32 of data (4 bytes), all little-endian
+// Files without the magic number were written before the header was introduced, and can't be checked.
+const chunkFileMagic = 0x7a637631 // "zcv1"
+const chunkFileHeaderSize = 12
+
+// Chunk files are written a block at a time, and blocks that hold nothing but zeroes are skipped, leaving holes that the
+// filesystem doesn't allocate space for. A chunk written at a large offset, or otherwise mostly empty, then only takes
+// up as much disk as the blocks that hold its data. Holes read back as zeroes, so the checksum covers them as zeroes,
+// and nothing that reads a chunk file needs to know whether it has any. Filesystems without support for holes fill
+// them in with zeroes instead, which is no worse than writing them.
+const sparseBlockSize = 4096
+
+var zeroBlock [sparseBlockSize]byte
+
+// Buffers for encoding chunk files as they're written, which are only needed until the file has been written.
+var chunkFileBuffers = util.NewBufferPool(4096, ReadBufferSize)
+
+func encodeChunkFile(data []byte) []byte {
+	return encodeChunkFileInto(make([]byte, chunkFileHeaderSize+len(data)), data)
+}
+
+// Like encodeChunkFile, but encodes into a buffer of exactly the right length.
+func encodeChunkFileInto(encoded []byte, data []byte) []byte {
+	binary.LittleEndian.PutUint32(encoded[0:], chunkFileMagic)
+	binary.LittleEndian.PutUint32(encoded[4:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(encoded[8:], crc32.ChecksumIEEE(data))
+	copy(encoded[chunkFileHeaderSize:], data)
+	return encoded
+}
+
+func decodeChunkFile(encoded []byte) ([]byte, error) {
+	if len(encoded) < chunkFileHeaderSize || binary.LittleEndian.Uint32(encoded) != chunkFileMagic {
+		return encoded, nil
+	}
+	length := int(binary.LittleEndian.Uint32(encoded[4:]))
+	data := encoded[chunkFileHeaderSize:]
+	if len(data) != length {
+		return nil, fmt.Errorf("chunk file has %d bytes of data, but should have %d", len(data), length)
+	}
+	if crc32.ChecksumIEEE(data) != binary.LittleEndian.Uint32(encoded[8:]) {
+		return nil, errors.New("chunk file failed checksum validation")
+	}
+	return data, nil
+}
+
+// like ioutil.ReadFile, but reads into buf if it has enough capacity
+func readFileInto(filename string, buf []byte) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := int(info.Size())
+	if buf == nil || cap(buf) < size {
+		buf = make([]byte, size)
+	}
+	buf = buf[:size]
+	if _, err := io.ReadFull(f, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
 func (m *FilesystemStorage) ReadVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
+	return m.ReadVersionInto(chunk, version, nil)
+}
+
+func (m *FilesystemStorage) ReadVersionInto(chunk apis.ChunkNum, version apis.Version, buf []byte) ([]byte, error) {
+	m.assertOpen()
+	defer observeSince(m.metrics, LatencyRead, time.Now())
+	if m.mapped != nil {
+		data, release, ok, err := m.mapped.get(chunk, version, m.chunkFilename(chunk, version))
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			defer release()
+			if cap(buf) < len(data) {
+				buf = make([]byte, len(data))
+			}
+			return buf[:copy(buf[:cap(buf)], data)], nil
+		}
+	}
+	return m.readVersionFile(chunk, version, buf)
+}
+
+// Reads a version from its file, without going through its mapping.
+func (m *FilesystemStorage) readVersionFile(chunk apis.ChunkNum, version apis.Version, buf []byte) ([]byte, error) {
+	encoded, err := readFileInto(m.chunkFilename(chunk, version), buf)
+	if err != nil {
+		return nil, err
+	}
+	m.metrics.Add(CounterFileOpens, 1)
+	m.metrics.Add(CounterBytesRead, uint64(len(encoded)))
+	data, err := decodeChunkFile(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %d/%d: %v", chunk, version, err)
+	}
+	return data, nil
+}
+
+func (m *FilesystemStorage) MapsVersions() bool {
+	return m.mapped != nil && mappingSupported
+}
+
+// Serves the version from its mapping if it can be mapped, and otherwise reads it into a buffer of its own.
+func (m *FilesystemStorage) ReadVersionMapped(chunk apis.ChunkNum, version apis.Version) ([]byte, func(), error) {
+	m.assertOpen()
+	defer observeSince(m.metrics, LatencyRead, time.Now())
+	if m.mapped != nil {
+		data, release, ok, err := m.mapped.get(chunk, version, m.chunkFilename(chunk, version))
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			return data, release, nil
+		}
+	}
+	data, err := m.readVersionFile(chunk, version, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() {}, nil
+}
+
+func (m *FilesystemStorage) OpenVersion(chunk apis.ChunkNum, version apis.Version) (VersionFile, error) {
 	m.assertOpen()
-	return ioutil.ReadFile(m.chunkFilename(chunk, version))
+	f, err := os.Open(m.chunkFilename(chunk, version))
+	if err != nil {
+		return VersionFile{}, err
+	}
+	m.metrics.Add(CounterFileOpens, 1)
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return VersionFile{}, err
+	}
+	header := make([]byte, chunkFileHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil || binary.LittleEndian.Uint32(header) != chunkFileMagic {
+		// written before chunk files had headers, so there's no checksum to go along with it
+		f.Close()
+		return VersionFile{}, fmt.Errorf("cannot open %d/%d: chunk file has no header", chunk, version)
+	}
+	length := int64(binary.LittleEndian.Uint32(header[4:]))
+	if info.Size() != chunkFileHeaderSize+length {
+		f.Close()
+		return VersionFile{}, fmt.Errorf("cannot open %d/%d: chunk file has %d bytes of data, but should have %d",
+			chunk, version, info.Size()-chunkFileHeaderSize, length)
+	}
+	return VersionFile{
+		File:     f,
+		Offset:   chunkFileHeaderSize,
+		Length:   length,
+		Checksum: binary.LittleEndian.Uint32(header[8:]),
+	}, nil
 }
 
-// based on ioutil.WriteFile
-func writeFileNew(filename string, data []byte, perm os.FileMode) error {
+// based on ioutil.WriteFile, but leaves holes in place of blocks of zeroes; see sparseBlockSize
+func writeFileNew(filename string, data []byte, perm os.FileMode, sync bool, metrics MetricsSink) error {
 	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
 	if err != nil {
 		return err
 	}
-	n, err := f.Write(data)
-	if err == nil && n < len(data) {
-		err = io.ErrShortWrite
+	metrics.Add(CounterFileOpens, 1)
+	err = writeSparse(f, data, metrics)
+	if err == nil && sync {
+		err = syncFile(f, metrics)
 	}
 	if err1 := f.Close(); err == nil {
 		err = err1
@@ -113,28 +451,260 @@ func writeFileNew(filename string, data []byte, perm os.FileMode) error {
 	return err
 }
 
+// Writes data to the start of an empty file, skipping blocks of zeroes, and then extends the file to its full length,
+// which leaves a hole wherever a block was skipped.
+func writeSparse(f *os.File, data []byte, metrics MetricsSink) error {
+	for offset := 0; offset < len(data); offset += sparseBlockSize {
+		block := data[offset:]
+		if len(block) > sparseBlockSize {
+			block = block[:sparseBlockSize]
+		}
+		if bytes.Equal(block, zeroBlock[:len(block)]) {
+			continue
+		}
+		n, err := f.WriteAt(block, int64(offset))
+		metrics.Add(CounterBytesWritten, uint64(n))
+		if err != nil {
+			return err
+		}
+	}
+	// a no-op unless the data ended with a hole
+	return f.Truncate(int64(len(data)))
+}
+
 func (m *FilesystemStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
 	m.assertOpen()
-	if len(data) > apis.MaxChunkSize {
-		return fmt.Errorf("chunk is too large: %d/%s = data[%d]", chunk, version, len(data))
+	if err := m.limit.check(chunk, version, data); err != nil {
+		return err
 	}
-	err := os.Mkdir(m.chunkDir(chunk), os.FileMode(0755))
-	if err != nil && !os.IsExist(err) {
+	// the rename that commits a version replaces whatever is already there, and so would a replay of the log, so an
+	// existing version has to be caught before either happens
+	if _, err := os.Stat(m.chunkFilename(chunk, version)); err == nil {
+		return fmt.Errorf("version already exists: %d/%d", chunk, version)
+	}
+	defer observeSince(m.metrics, LatencyWrite, time.Now())
+	err := m.logged(walRecord{op: walWriteVersion, chunk: chunk, version: version, data: data}, func() error {
+		if err := m.forgetCommitHashes(chunk, version); err != nil {
+			return err
+		}
+		encoded := chunkFileBuffers.Get(chunkFileHeaderSize + len(data))
+		err := m.installVersion(chunk, version, encodeChunkFileInto(encoded, data), m.durability >= DurabilityCommit)
+		chunkFileBuffers.Put(encoded)
+		return err
+	})
+	if err == nil {
+		m.metrics.Add(CounterVersionsWritten, 1)
+	}
+	return err
+}
+
+// Reports that a commit has reached a step, for tests that simulate crashes.
+func (m *FilesystemStorage) reached(step string) {
+	if m.killPoint != nil {
+		m.killPoint(step)
+	}
+}
+
+// Assembles a chunk file in tmp/, and then renames it into place, replacing any existing file for the version. If
+// durable is set, the data is synced before the rename, and the directory entries that lead to it after.
+func (m *FilesystemStorage) installVersion(chunk apis.ChunkNum, version apis.Version, encoded []byte, durable bool) error {
+	if _, err := m.makeDir(m.tempDir()); err != nil {
+		return err
+	}
+	// only left behind by a write that failed partway through, since crashes are cleaned up when the storage is opened
+	temp := m.tempFilename(chunk, version)
+	if err := os.Remove(temp); err != nil && !os.IsNotExist(err) {
 		return err
 	}
-	return writeFileNew(m.chunkFilename(chunk, version), data, os.FileMode(0644))
+	if err := writeFileNew(temp, encoded, os.FileMode(0644), durable, m.metrics); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	m.reached("temp-written")
+	created, err := m.makeChunkDir(chunk)
+	if err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	if err := os.Rename(temp, m.chunkFilename(chunk, version)); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	m.reached("renamed")
+	if !durable {
+		return nil
+	}
+	// the rename has to be durable before anything depends on the version being there
+	if err := syncPath(m.chunkDir(chunk), m.metrics); err != nil {
+		return err
+	}
+	for _, dir := range created {
+		if err := syncPath(dir, m.metrics); err != nil {
+			return err
+		}
+	}
+	m.reached("synced")
+	return nil
+}
+
+// Creates a chunk's directory, along with any missing parents. Returns the parents of the directories that were
+// created, whose entries have to be synced for the new directories to be durable.
+func (m *FilesystemStorage) makeChunkDir(chunk apis.ChunkNum) ([]string, error) {
+	var changed []string
+	parent := m.path
+	for _, dir := range []string{m.chunksDir(), m.fanoutDir(chunk), m.chunkDir(chunk)} {
+		created, err := m.makeDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		if created {
+			changed = append(changed, parent)
+		}
+		parent = dir
+	}
+	return changed, nil
+}
+
+// Throws away versions left half-assembled by a crash, along with latest files that were never renamed into place,
+// finishes or undoes chunk directory rewrites that compaction didn't get to finish, and moves chunk directories from
+// before the fanout into the current layout.
+func (m *FilesystemStorage) cleanUp() error {
+	if err := os.RemoveAll(m.tempDir()); err != nil {
+		return fmt.Errorf("[filesystem.go/RTD] %v", err)
+	}
+	if err := m.cleanUpRewrites(); err != nil {
+		return fmt.Errorf("[filesystem.go/CUR] %v", err)
+	}
+	fis, err := ioutil.ReadDir(m.path)
+	if err != nil {
+		return fmt.Errorf("[filesystem.go/RBD] %v", err)
+	}
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), "tmp-latest-") {
+			if err := os.Remove(filepath.Join(m.path, fi.Name())); err != nil {
+				return fmt.Errorf("[filesystem.go/RTL] %v", err)
+			}
+		} else if strings.HasPrefix(fi.Name(), "chunk-") && fi.IsDir() {
+			chunk, err := strconv.ParseUint(fi.Name()[6:], 10, 64)
+			if err != nil {
+				return fmt.Errorf("[filesystem.go/PLD] %v", err)
+			}
+			for _, dir := range []string{m.chunksDir(), m.fanoutDir(apis.ChunkNum(chunk))} {
+				if _, err := m.makeDir(dir); err != nil {
+					return fmt.Errorf("[filesystem.go/MCD] %v", err)
+				}
+			}
+			// the whole directory moves in a single step
+			if err := os.Rename(filepath.Join(m.path, fi.Name()), m.chunkDir(apis.ChunkNum(chunk))); err != nil {
+				return fmt.Errorf("[filesystem.go/MLD] %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (m *FilesystemStorage) LinkVersion(chunk apis.ChunkNum, existing apis.Version, version apis.Version) error {
+	m.assertOpen()
+	if m.log != nil {
+		if _, err := os.Stat(m.chunkFilename(chunk, existing)); err != nil {
+			return err
+		}
+		if _, err := os.Stat(m.chunkFilename(chunk, version)); err == nil {
+			return fmt.Errorf("version already exists: %d/%d", chunk, version)
+		}
+	}
+	record := walRecord{op: walLinkVersion, chunk: chunk, version: version, data: encodeLinkSource(existing)}
+	return m.logged(record, func() error {
+		if err := m.forgetCommitHashes(chunk, version); err != nil {
+			return err
+		}
+		// a hard link shares the file's contents; nothing ever modifies a chunk file in place
+		err := os.Link(m.chunkFilename(chunk, existing), m.chunkFilename(chunk, version))
+		if err != nil || m.durability < DurabilityCommit {
+			return err
+		}
+		// the existing version's data was already synced when it was written
+		return syncPath(m.chunkDir(chunk), m.metrics)
+	})
 }
 
 func (m *FilesystemStorage) DeleteVersion(chunk apis.ChunkNum, version apis.Version) error {
 	m.assertOpen()
-	err := os.Remove(m.chunkFilename(chunk, version))
+	m.dropMapping(chunk, version)
+	if m.log != nil {
+		if _, err := os.Stat(m.chunkFilename(chunk, version)); err != nil {
+			return err
+		}
+	}
+	err := m.logged(walRecord{op: walDeleteVersion, chunk: chunk, version: version}, func() error {
+		err := os.Remove(m.chunkFilename(chunk, version))
+		if err == nil {
+			// we don't care if this succeeds
+			_ = os.Remove(m.chunkDir(chunk))
+			err = m.forgetCommitHashes(chunk, version)
+		}
+		return err
+	})
 	if err == nil {
-		// we don't care if this succeeds
-		_ = os.Remove(m.chunkDir(chunk))
+		m.metrics.Add(CounterVersionsDeleted, 1)
 	}
 	return err
 }
 
+// Must be called before a version file is removed or moved away, so that it's never read from a stale mapping.
+func (m *FilesystemStorage) dropMapping(chunk apis.ChunkNum, version apis.Version) {
+	if m.mapped != nil {
+		m.mapped.drop(chunk, version)
+	}
+}
+
+// Damaged files are moved to a separate directory, named after the chunk and version, where nothing else looks at them.
+func (m *FilesystemStorage) QuarantineVersion(chunk apis.ChunkNum, version apis.Version) error {
+	m.assertOpen()
+	m.dropMapping(chunk, version)
+	err := m.quarantineFile(m.chunkFilename(chunk, version), fmt.Sprintf("chunk-%d-%d", chunk, version))
+	if err != nil {
+		return err
+	}
+	// we don't care if this succeeds
+	_ = os.Remove(m.chunkDir(chunk))
+	return m.forgetCommitHashes(chunk, version)
+}
+
+func (m *FilesystemStorage) quarantineFile(filename string, name string) error {
+	err := os.Mkdir(m.quarantineDir(), os.FileMode(0755))
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	quarantined := filepath.Join(m.quarantineDir(), name)
+	if err := os.Rename(filename, quarantined); err != nil {
+		return err
+	}
+	// the modification time records when the file was quarantined, for PurgeQuarantine
+	now := time.Now()
+	return os.Chtimes(quarantined, now, now)
+}
+
+func (m *FilesystemStorage) PurgeQuarantine(cutoff time.Time) (int, error) {
+	m.assertOpen()
+	fis, err := ioutil.ReadDir(m.quarantineDir())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, fi := range fis {
+		if fi.ModTime().Before(cutoff) {
+			if err := os.Remove(filepath.Join(m.quarantineDir(), fi.Name())); err != nil {
+				return removed, err
+			}
+			removed += 1
+		}
+	}
+	return removed, nil
+}
+
 func (m *FilesystemStorage) ListChunksWithLatest() ([]apis.ChunkNum, error) {
 	m.assertOpen()
 	fis, err := ioutil.ReadDir(m.path)
@@ -169,14 +739,496 @@ func (m *FilesystemStorage) GetLatestVersion(chunk apis.ChunkNum) (apis.Version,
 
 func (m *FilesystemStorage) SetLatestVersion(chunk apis.ChunkNum, latest apis.Version) error {
 	m.assertOpen()
-	return ioutil.WriteFile(m.latestFilename(chunk), []byte(fmt.Sprintln(latest)), os.FileMode(0644))
+	return m.logged(walRecord{op: walSetLatest, chunk: chunk, version: latest}, func() error {
+		if m.durability < DurabilityCommit {
+			return ioutil.WriteFile(m.latestFilename(chunk), []byte(fmt.Sprintln(latest)), os.FileMode(0644))
+		}
+		// replace the file atomically, so that a crash can't leave it empty or half-written
+		err := writeFileSynced(m.latestTempFilename(chunk), []byte(fmt.Sprintln(latest)), os.FileMode(0644), m.metrics)
+		if err != nil {
+			return err
+		}
+		if err := os.Rename(m.latestTempFilename(chunk), m.latestFilename(chunk)); err != nil {
+			return err
+		}
+		return syncPath(m.path, m.metrics)
+	})
 }
 
 func (m *FilesystemStorage) DeleteLatestVersion(chunk apis.ChunkNum) error {
 	m.assertOpen()
-	return os.Remove(m.latestFilename(chunk))
+	if m.log != nil {
+		if _, err := os.Stat(m.latestFilename(chunk)); err != nil {
+			return err
+		}
+	}
+	return m.logged(walRecord{op: walDeleteLatest, chunk: chunk}, func() error {
+		return os.Remove(m.latestFilename(chunk))
+	})
+}
+
+// Creates a directory if it doesn't already exist, and reports whether it had to be created.
+func (m *FilesystemStorage) makeDir(path string) (bool, error) {
+	err := os.Mkdir(path, os.FileMode(0755))
+	if err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Syncs a file, counting and timing the sync.
+func syncFile(f *os.File, metrics MetricsSink) error {
+	defer observeSince(metrics, LatencyFsync, time.Now())
+	metrics.Add(CounterFsyncs, 1)
+	return f.Sync()
+}
+
+func syncPath(path string, metrics MetricsSink) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	metrics.Add(CounterFileOpens, 1)
+	err = syncFile(f, metrics)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// The filesystem is only limited by the size of the disk, so staged writes don't need to be tracked.
+func (m *FilesystemStorage) StageData(bytes int) error {
+	m.assertOpen()
+	m.staged += bytes
+	return nil
+}
+
+func (m *FilesystemStorage) UnstageData(bytes int) {
+	m.assertOpen()
+	if bytes > m.staged {
+		panic("attempt to unstage more data than was staged")
+	}
+	m.staged -= bytes
+}
+
+// Committed bytes are the sizes of the chunk files, headers included, with files that were hard-linked by LinkVersion
+// only counted once.
+func (m *FilesystemStorage) Stats() (StorageStats, error) {
+	m.assertOpen()
+	stats := StorageStats{StagedBytes: uint64(m.staged)}
+	if m.log != nil {
+		stats.OpenFiles += 1
+	}
+	if m.stagingLog != nil {
+		stats.OpenFiles += 1
+	}
+	if err := countVersions(m, &stats); err != nil {
+		return StorageStats{}, err
+	}
+	chunks, err := m.ListChunksWithData()
+	if err != nil {
+		return StorageStats{}, err
+	}
+	seen := map[uint64]bool{}
+	for _, chunk := range chunks {
+		fis, err := ioutil.ReadDir(m.chunkDir(chunk))
+		if err != nil {
+			return StorageStats{}, err
+		}
+		for _, fi := range fis {
+			if inode, ok := fileInode(fi); ok {
+				if seen[inode] {
+					continue
+				}
+				seen[inode] = true
+			}
+			stats.CommittedBytes += uint64(fi.Size())
+			stats.AllocatedBytes += allocatedSize(fi)
+		}
+	}
+	return stats, nil
+}
+
+func (m *FilesystemStorage) Durability() Durability {
+	return m.durability
+}
+
+// Reports on the filesystem that the storage directory lives on, which may be shared with other data.
+func (m *FilesystemStorage) Space() (StorageSpace, bool, error) {
+	m.assertOpen()
+	return filesystemSpace(m.path)
+}
+
+// Only opens the staging log if it's enabled, or if there's something left in it, so that storage that doesn't use it
+// doesn't have to hold it open.
+func (m *FilesystemStorage) openStagingLog() error {
+	if !m.logStaged {
+		fi, err := os.Stat(m.stagingLogFilename())
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil || fi.Size() == 0 {
+			return nil
+		}
+	}
+	log, err := openStagingLog(m.stagingLogFilename())
+	if err != nil {
+		return err
+	}
+	log.metrics = m.metrics
+	m.stagingLog = log
+	return nil
+}
+
+// Unless they go into the staging log, staged writes are stored in the same format as chunk files, with the write's
+// offset (4 bytes, little-endian) in front of its data, so that a write that was only partially synced is detected and
+// discarded.
+func (m *FilesystemStorage) KeepStaged(write StagedWrite) error {
+	m.assertOpen()
+	m.stageMu.Lock()
+	defer m.stageMu.Unlock()
+	if m.stageBuffer != nil && (m.logStaged || m.durability >= DurabilityStageAndCommit) {
+		m.stageBuffer.add(write)
+		if m.durability >= DurabilityStageAndCommit {
+			err := m.flushStaged()
+			if err != nil {
+				// the write is reported as failed, so it must not be kept later on behind the caller's back
+				m.stageBuffer.remove(write.Hash)
+			}
+			return err
+		}
+		if m.stageBuffer.full() {
+			return m.flushStaged()
+		}
+		m.stageBuffer.startTimer(m.flushStagedOnTimer)
+		return nil
+	}
+	return m.keepStaged(write)
+}
+
+func (m *FilesystemStorage) keepStaged(write StagedWrite) error {
+	if m.logStaged {
+		return m.stagingLog.keep(write)
+	}
+	if m.durability < DurabilityStageAndCommit {
+		return nil
+	}
+	created, err := m.makeDir(m.stagedDir())
+	if err != nil {
+		return err
+	}
+	contents := make([]byte, 4+len(write.Data))
+	binary.LittleEndian.PutUint32(contents, write.Offset)
+	copy(contents[4:], write.Data)
+	if err := writeFileSynced(m.stagedFilename(write.Hash), encodeChunkFile(contents), os.FileMode(0644), m.metrics); err != nil {
+		return err
+	}
+	if err := syncPath(m.stagedDir(), m.metrics); err != nil {
+		return err
+	}
+	if created {
+		return syncPath(m.path, m.metrics)
+	}
+	return nil
+}
+
+// Keeps everything in the stage buffer. Must be called with stageMu held. If this fails, the writes stay buffered.
+func (m *FilesystemStorage) flushStaged() error {
+	if m.stageBuffer == nil {
+		return nil
+	}
+	m.stageBuffer.stopTimer()
+	if len(m.stageBuffer.writes) == 0 {
+		return nil
+	}
+	if m.logStaged {
+		if err := m.stagingLog.keepAll(m.stageBuffer.writes); err != nil {
+			return err
+		}
+	} else {
+		for _, write := range m.stageBuffer.writes {
+			if err := m.keepStaged(write); err != nil {
+				return err
+			}
+		}
+	}
+	m.stageBuffer.clear()
+	return nil
+}
+
+func (m *FilesystemStorage) flushStagedOnTimer() {
+	m.stageMu.Lock()
+	defer m.stageMu.Unlock()
+	if m.isClosed {
+		return
+	}
+	// nothing can be done about an error here; the writes are tried again the next time the buffer is written out
+	_ = m.flushStaged()
+}
+
+// Nothing needs to be synced here: if the removal is lost, the write is just staged again after a restart. A commit is
+// also a good time to write out the rest of the stage buffer, so that it's written out at least that often.
+func (m *FilesystemStorage) ForgetStaged(hash apis.CommitHash) error {
+	m.assertOpen()
+	m.stageMu.Lock()
+	defer m.stageMu.Unlock()
+	if m.stageBuffer != nil && m.stageBuffer.remove(hash) {
+		// never written out, so there's nothing else to forget
+		return m.flushStaged()
+	}
+	if err := m.flushStaged(); err != nil {
+		return err
+	}
+	if m.stagingLog != nil {
+		if err := m.stagingLog.forget(hash); err != nil {
+			return err
+		}
+	}
+	err := os.Remove(m.stagedFilename(hash))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (m *FilesystemStorage) ListStaged() ([]StagedWrite, error) {
+	m.assertOpen()
+	m.stageMu.Lock()
+	defer m.stageMu.Unlock()
+	result, err := m.listKeptStaged()
+	if err != nil {
+		return nil, err
+	}
+	if m.stageBuffer != nil {
+		result = append(result, m.stageBuffer.writes...)
+	}
+	return result, nil
+}
+
+func (m *FilesystemStorage) listKeptStaged() ([]StagedWrite, error) {
+	var result []StagedWrite
+	if m.stagingLog != nil {
+		logged, err := m.stagingLog.list()
+		if err != nil {
+			return nil, err
+		}
+		result = logged
+	}
+	fis, err := ioutil.ReadDir(m.stagedDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
+		}
+		return nil, err
+	}
+	for _, fi := range fis {
+		hash := apis.CommitHash(fi.Name())
+		encoded, err := ioutil.ReadFile(m.stagedFilename(hash))
+		if err != nil {
+			return nil, err
+		}
+		contents, err := decodeChunkFile(encoded)
+		if err == nil && (len(encoded) < chunkFileHeaderSize || binary.LittleEndian.Uint32(encoded) != chunkFileMagic) {
+			// staged writes are always stored with a header, so this can only be left over from a write that never
+			// finished
+			err = errors.New("staged write has no header")
+		}
+		if err == nil && len(contents) < 4 {
+			err = errors.New("staged write is too short")
+		}
+		if err != nil {
+			// the write was never acknowledged, so it's safe to throw away
+			if err := os.Remove(m.stagedFilename(hash)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		result = append(result, StagedWrite{
+			Hash:   hash,
+			Offset: binary.LittleEndian.Uint32(contents),
+			Data:   contents[4:],
+		})
+	}
+	return result, nil
+}
+
+// Commit hashes are stored one per line, in the same format as chunk files. They aren't synced, since losing them only
+// means that they can't be listed; for the same reason, a damaged file is treated as if there were no hashes.
+func (m *FilesystemStorage) SetCommitHashes(chunk apis.ChunkNum, version apis.Version, hashes []apis.CommitHash) error {
+	m.assertOpen()
+	if _, err := os.Stat(m.chunkFilename(chunk, version)); err != nil {
+		return err
+	}
+	if _, err := m.makeDir(m.hashesDir()); err != nil {
+		return err
+	}
+	lines := make([]string, len(hashes))
+	for i, hash := range hashes {
+		lines[i] = string(hash)
+	}
+	contents := encodeChunkFile([]byte(strings.Join(lines, "\n")))
+	return ioutil.WriteFile(m.hashesFilename(chunk, version), contents, os.FileMode(0644))
+}
+
+func (m *FilesystemStorage) CommitHashes(chunk apis.ChunkNum, version apis.Version) ([]apis.CommitHash, error) {
+	m.assertOpen()
+	encoded, err := ioutil.ReadFile(m.hashesFilename(chunk, version))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	contents, err := decodeChunkFile(encoded)
+	if err != nil || len(contents) == 0 {
+		return nil, nil
+	}
+	var hashes []apis.CommitHash
+	for _, line := range strings.Split(string(contents), "\n") {
+		hashes = append(hashes, apis.CommitHash(line))
+	}
+	return hashes, nil
+}
+
+// Called whenever a version is deleted or written again, so that hashes are never reported for the wrong data.
+func (m *FilesystemStorage) forgetCommitHashes(chunk apis.ChunkNum, version apis.Version) error {
+	err := os.Remove(m.hashesFilename(chunk, version))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Tombstones are stored in the same format as chunk files, holding the deleted version (8 bytes) and the time of the
+// deletion (8 bytes, nanoseconds since the epoch), both little-endian. They are always synced, regardless of the
+// durability level, because a lost tombstone is what would let a deleted chunk come back.
+func (m *FilesystemStorage) KeepTombstone(tombstone apis.Tombstone) error {
+	m.assertOpen()
+	created, err := m.makeDir(m.tombstoneDir())
+	if err != nil {
+		return err
+	}
+	contents := make([]byte, 16)
+	binary.LittleEndian.PutUint64(contents, uint64(tombstone.Version))
+	binary.LittleEndian.PutUint64(contents[8:], uint64(tombstone.Deleted.UnixNano()))
+	if err := writeFileSynced(m.tombstoneFilename(tombstone.Chunk), encodeChunkFile(contents), os.FileMode(0644), m.metrics); err != nil {
+		return err
+	}
+	if err := syncPath(m.tombstoneDir(), m.metrics); err != nil {
+		return err
+	}
+	if created {
+		return syncPath(m.path, m.metrics)
+	}
+	return nil
+}
+
+// Nothing needs to be synced here: if the removal is lost, the tombstone just lingers until it expires.
+func (m *FilesystemStorage) ForgetTombstone(chunk apis.ChunkNum) error {
+	m.assertOpen()
+	err := os.Remove(m.tombstoneFilename(chunk))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (m *FilesystemStorage) ListTombstones() ([]apis.Tombstone, error) {
+	m.assertOpen()
+	fis, err := ioutil.ReadDir(m.tombstoneDir())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var result []apis.Tombstone
+	for _, fi := range fis {
+		chunk, err := strconv.ParseUint(fi.Name(), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := ioutil.ReadFile(m.tombstoneFilename(apis.ChunkNum(chunk)))
+		if err != nil {
+			return nil, err
+		}
+		contents, err := decodeChunkFile(encoded)
+		if err == nil && len(contents) != 16 {
+			err = errors.New("tombstone has the wrong length")
+		}
+		if err != nil {
+			// tombstones are written before the chunk is deleted, so the chunk's data is still here, and the delete
+			// was never acknowledged
+			if err := os.Remove(m.tombstoneFilename(apis.ChunkNum(chunk))); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		result = append(result, apis.Tombstone{
+			Chunk:   apis.ChunkNum(chunk),
+			Version: apis.Version(binary.LittleEndian.Uint64(contents)),
+			Deleted: time.Unix(0, int64(binary.LittleEndian.Uint64(contents[8:]))),
+		})
+	}
+	return result, nil
+}
+
+func (m *FilesystemStorage) Flush() error {
+	m.assertOpen()
+	m.stageMu.Lock()
+	defer m.stageMu.Unlock()
+	if err := m.flushStaged(); err != nil {
+		return err
+	}
+	// sync every file and directory, so that both contents and directory entries are durable
+	return filepath.Walk(m.path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return syncPath(path, m.metrics)
+	})
+}
+
+func (m *FilesystemStorage) SetMaxChunkSize(size uint32) bool {
+	m.limit.set(size)
+	return true
+}
+
+func (m *FilesystemStorage) SetMetricsSink(sink MetricsSink) bool {
+	m.stageMu.Lock()
+	defer m.stageMu.Unlock()
+	m.metrics = sinkOrDiscard(sink)
+	if m.log != nil {
+		m.log.metrics = m.metrics
+	}
+	if m.stagingLog != nil {
+		m.stagingLog.metrics = m.metrics
+	}
+	if m.mapped != nil {
+		m.mapped.setMetricsSink(m.metrics)
+	}
+	return true
 }
 
 func (m *FilesystemStorage) Close() {
+	m.stageMu.Lock()
+	defer m.stageMu.Unlock()
+	if !m.isClosed {
+		// as for the logs, nothing useful can be done about an error here; the writes are lost, as in a crash
+		_ = m.flushStaged()
+	}
+	if m.log != nil && !m.isClosed {
+		// nothing useful can be done about an error here; anything left in the log is replayed on the next open
+		_ = m.log.close()
+	}
+	if m.stagingLog != nil && !m.isClosed {
+		_ = m.stagingLog.close()
+	}
+	if m.mapped != nil {
+		m.mapped.dropAll()
+	}
 	m.isClosed = true
 }
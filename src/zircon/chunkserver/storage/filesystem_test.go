@@ -0,0 +1,234 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"testing"
+	"zircon/apis"
+)
+
+func TestFilesystemChecksums(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "checksum-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer s.Close()
+	fs := s.(*FilesystemStorage)
+
+	assert.NoError(fs.WriteVersion(1, 1, []byte("truncated")))
+	assert.NoError(fs.WriteVersion(1, 2, []byte("corrupted")))
+	assert.NoError(fs.WriteVersion(1, 3, []byte("intact")))
+	require.NoError(t, os.Truncate(fs.chunkFilename(1, 1), chunkFileHeaderSize+4))
+	encoded, err := ioutil.ReadFile(fs.chunkFilename(1, 2))
+	require.NoError(t, err)
+	encoded[chunkFileHeaderSize] ^= 0x20
+	require.NoError(t, ioutil.WriteFile(fs.chunkFilename(1, 2), encoded, 0644))
+	// files from before checksums were added can't be validated, but are still readable
+	require.NoError(t, ioutil.WriteFile(fs.chunkFilename(1, 4), []byte("legacy"), 0644))
+
+	_, err = fs.ReadVersion(1, 1)
+	assert.Error(err)
+	_, err = fs.ReadVersion(1, 2)
+	assert.Error(err)
+	data, err := fs.ReadVersion(1, 3)
+	assert.NoError(err)
+	assert.Equal("intact", string(data))
+	data, err = fs.ReadVersion(1, 4)
+	assert.NoError(err)
+	assert.Equal("legacy", string(data))
+
+	assert.NoError(fs.QuarantineVersion(1, 1))
+	assert.NoError(fs.QuarantineVersion(1, 2))
+	versions, err := fs.ListVersions(1)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{3, 4}, versions)
+	_, err = os.Stat(fs.quarantineDir() + "/chunk-1-2")
+	assert.NoError(err)
+
+	chunks, err := fs.ListChunksWithData()
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkNum{1}, chunks)
+}
+
+func TestFilesystemStats(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "stats-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := ConfigureFilesystemStorage(dir, true)
+	require.NoError(t, err)
+	defer s.Close()
+
+	assert.NoError(s.WriteVersion(1, 1, []byte("hello")))
+	assert.NoError(s.LinkVersion(1, 1, 2))
+	stats, err := s.Stats()
+	assert.NoError(err)
+	// the write-ahead log stays open, and a linked version shares its file with the original
+	assert.Equal(uint64(1), stats.OpenFiles)
+	assert.Equal(uint64(2), stats.Versions)
+	assert.Equal(uint64(chunkFileHeaderSize+len("hello")), stats.CommittedBytes)
+	s.Close()
+
+	s, err = ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	stats, err = s.Stats()
+	assert.NoError(err)
+	assert.Equal(uint64(0), stats.OpenFiles)
+	assert.Equal(uint64(2), stats.Versions)
+}
+
+// Whether the filesystem that dir lives on leaves holes unallocated, which not every filesystem does.
+func supportsHoles(t *testing.T, dir string) bool {
+	f, err := ioutil.TempFile(dir, "holes-")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+	require.NoError(t, f.Truncate(1024*1024))
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	return allocatedSize(fi) < 1024*1024
+}
+
+func TestFilesystemSparseVersions(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "sparse-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := ConfigureFilesystemStorageWithDurability(dir, true, DurabilityCommit)
+	require.NoError(t, err)
+	defer s.Close()
+	fs := s.(*FilesystemStorage)
+
+	// a few bytes near the end of a chunk, and a few in the middle of another, with zeroes everywhere else
+	far := make([]byte, apis.MaxChunkSize)
+	copy(far[apis.MaxChunkSize-5:], "hello")
+	middle := make([]byte, apis.MaxChunkSize)
+	copy(middle[apis.MaxChunkSize/2:], "world")
+	require.NoError(t, fs.WriteVersion(1, 1, far))
+	require.NoError(t, fs.WriteVersion(2, 1, middle))
+
+	// the holes read back as zeroes, and are covered by the checksum as zeroes
+	data, err := fs.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.Equal(far, data)
+	data, err = fs.ReadVersion(2, 1)
+	assert.NoError(err)
+	assert.Equal(middle, data)
+	info, err := fs.OpenVersion(2, 1)
+	require.NoError(t, err)
+	assert.Equal(crc32.ChecksumIEEE(middle), info.Checksum)
+	info.File.Close()
+
+	stats, err := fs.Stats()
+	assert.NoError(err)
+	assert.Equal(uint64(2*(chunkFileHeaderSize+apis.MaxChunkSize)), stats.CommittedBytes)
+	if !supportsHoles(t, dir) {
+		t.Log("filesystem does not support holes; skipping checks of allocated space")
+		return
+	}
+	// two blocks apiece, one for the header and one for the data, but filesystems may allocate in larger units than that
+	assert.True(stats.AllocatedBytes <= 4*64*1024, "allocated %d bytes", stats.AllocatedBytes)
+	assert.True(stats.AllocatedBytes > 0)
+
+	// a version with no holes takes up all of its space
+	full := make([]byte, 256*1024)
+	for i := range full {
+		full[i] = 1
+	}
+	require.NoError(t, fs.WriteVersion(3, 1, full))
+	withFull, err := fs.Stats()
+	assert.NoError(err)
+	assert.True(withFull.AllocatedBytes-stats.AllocatedBytes >= uint64(len(full)))
+}
+
+func TestFilesystemOpenVersion(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "open-version-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer s.Close()
+	fs := s.(*FilesystemStorage)
+
+	assert.NoError(fs.WriteVersion(1, 1, []byte("opened directly")))
+	require.NoError(t, ioutil.WriteFile(fs.chunkFilename(1, 2), []byte("legacy"), 0644))
+
+	file, err := fs.OpenVersion(1, 1)
+	require.NoError(t, err)
+	defer file.File.Close()
+	assert.Equal(int64(chunkFileHeaderSize), file.Offset)
+	assert.Equal(int64(len("opened directly")), file.Length)
+	assert.Equal(crc32.ChecksumIEEE([]byte("opened directly")), file.Checksum)
+
+	// the open file still has the data after the version is gone
+	assert.NoError(fs.DeleteVersion(1, 1))
+	data := make([]byte, file.Length)
+	_, err = file.File.ReadAt(data, file.Offset)
+	assert.NoError(err)
+	assert.Equal("opened directly", string(data))
+
+	// without a header, there's no checksum to send along with the data
+	_, err = fs.OpenVersion(1, 2)
+	assert.Error(err)
+	_, err = fs.OpenVersion(1, 3)
+	assert.Error(err)
+}
+
+func TestFilesystemLayoutCleanup(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "layout-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// chunk directories from before the fanout, and leftovers from a crash
+	require.NoError(t, os.Mkdir(dir+"/chunk-300", 0755))
+	require.NoError(t, ioutil.WriteFile(dir+"/chunk-300/3", encodeChunkFile([]byte("old layout")), 0644))
+	require.NoError(t, os.Mkdir(dir+"/tmp", 0755))
+	require.NoError(t, ioutil.WriteFile(dir+"/tmp/300-4", []byte("half"), 0644))
+	require.NoError(t, ioutil.WriteFile(dir+"/tmp-latest-300", []byte("4\n"), 0644))
+
+	s, err := ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer s.Close()
+	fs := s.(*FilesystemStorage)
+
+	chunks, err := fs.ListChunksWithData()
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkNum{300}, chunks)
+	versions, err := fs.ListVersions(300)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{3}, versions)
+	data, err := fs.ReadVersion(300, 3)
+	assert.NoError(err)
+	assert.Equal("old layout", string(data))
+	assert.Equal(dir+"/chunks/2c/300/3", fs.chunkFilename(300, 3))
+
+	for _, leftover := range []string{"/chunk-300", "/tmp", "/tmp-latest-300"} {
+		_, err = os.Stat(dir + leftover)
+		assert.True(os.IsNotExist(err), leftover)
+	}
+	chunks, err = fs.ListChunksWithLatest()
+	assert.NoError(err)
+	assert.Empty(chunks)
+
+	// new versions go alongside the old ones, and nothing is left in tmp/ once they're committed
+	assert.NoError(fs.WriteVersion(300, 4, []byte("new layout")))
+	assert.Error(fs.WriteVersion(300, 4, []byte("again")))
+	leftovers, err := ioutil.ReadDir(fs.tempDir())
+	assert.NoError(err)
+	assert.Empty(leftovers)
+	data, err = fs.ReadVersion(300, 4)
+	assert.NoError(err)
+	assert.Equal("new layout", string(data))
+}
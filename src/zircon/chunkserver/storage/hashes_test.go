@@ -0,0 +1,65 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"zircon/apis"
+)
+
+func checkCommitHashKeeper(t *testing.T, s ChunkStorage) {
+	assert := testifyAssert.New(t)
+
+	keeper := s.(CommitHashKeeper)
+	assert.Error(keeper.SetCommitHashes(1, 1, []apis.CommitHash{"abc"}))
+
+	require.NoError(t, s.WriteVersion(1, 1, []byte("one")))
+	hashes, err := keeper.CommitHashes(1, 1)
+	assert.NoError(err)
+	assert.Empty(hashes)
+	assert.NoError(keeper.SetCommitHashes(1, 1, []apis.CommitHash{"abc", "def"}))
+	hashes, err = keeper.CommitHashes(1, 1)
+	assert.NoError(err)
+	assert.Equal([]apis.CommitHash{"abc", "def"}, hashes)
+
+	// the hashes go away with the version, so a version written again later doesn't inherit them
+	require.NoError(t, s.LinkVersion(1, 1, 2))
+	hashes, err = keeper.CommitHashes(1, 2)
+	assert.NoError(err)
+	assert.Empty(hashes)
+	require.NoError(t, s.DeleteVersion(1, 1))
+	hashes, err = keeper.CommitHashes(1, 1)
+	assert.NoError(err)
+	assert.Empty(hashes)
+	require.NoError(t, s.WriteVersion(1, 1, []byte("one again")))
+	hashes, err = keeper.CommitHashes(1, 1)
+	assert.NoError(err)
+	assert.Empty(hashes)
+}
+
+func TestMemoryCommitHashes(t *testing.T) {
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	checkCommitHashKeeper(t, mem)
+}
+
+func TestFilesystemCommitHashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hashes-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := ConfigureFilesystemStorage(dir, true)
+	require.NoError(t, err)
+	defer s.Close()
+	checkCommitHashKeeper(t, s)
+
+	// hashes that can't be read back intact are treated as missing
+	fs := s.(*FilesystemStorage)
+	require.NoError(t, fs.SetCommitHashes(1, 2, []apis.CommitHash{"abc"}))
+	require.NoError(t, os.Truncate(fs.hashesFilename(1, 2), chunkFileHeaderSize+1))
+	hashes, err := fs.CommitHashes(1, 2)
+	testifyAssert.NoError(t, err)
+	testifyAssert.Empty(t, hashes)
+}
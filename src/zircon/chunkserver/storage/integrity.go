@@ -0,0 +1,320 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"zircon/apis"
+)
+
+// How thoroughly FilesystemStorage checks what's on disk when it's opened.
+type IntegrityCheck int
+
+const (
+	// Trust whatever is there; damage is only found when it's read.
+	IntegrityCheckNone IntegrityCheck = iota
+	// Check that the latest versions can be read, and that every version file is as long as its header says, which only
+	// takes a stat and a small read per version.
+	IntegrityCheckLengths
+	// Also check every version's checksum, which reads every version in full.
+	IntegrityCheckChecksums
+)
+
+var integrityCheckNames = []string{"none", "lengths", "checksums"}
+
+func (c IntegrityCheck) String() string {
+	if c < 0 || int(c) >= len(integrityCheckNames) {
+		return fmt.Sprintf("integrity-check(%d)", int(c))
+	}
+	return integrityCheckNames[c]
+}
+
+// Parses the name of an integrity check, as returned by String. An empty name means IntegrityCheckNone.
+func ParseIntegrityCheck(name string) (IntegrityCheck, error) {
+	if name == "" {
+		return IntegrityCheckNone, nil
+	}
+	for i, known := range integrityCheckNames {
+		if name == known {
+			return IntegrityCheck(i), nil
+		}
+	}
+	return IntegrityCheckNone, fmt.Errorf("no such integrity check: %s", name)
+}
+
+type IntegrityProblemKind int
+
+const (
+	// A version file is shorter or longer than its header says.
+	ProblemTruncated IntegrityProblemKind = iota
+	// A version file has the right length, but its data doesn't match its checksum.
+	ProblemChecksum
+	// A version file, or the record of a chunk's latest version, names version zero, which is never stored.
+	ProblemImpossibleVersion
+	// A file is where only versions or chunks should be, but isn't named like one.
+	ProblemStrayFile
+	// A file or directory couldn't be read at all.
+	ProblemUnreadable
+	// The record of a chunk's latest version doesn't hold a version number.
+	ProblemBadLatest
+)
+
+var problemKindNames = []string{"truncated", "checksum", "impossible version", "stray file", "unreadable", "bad latest"}
+
+func (k IntegrityProblemKind) String() string {
+	if k < 0 || int(k) >= len(problemKindNames) {
+		return fmt.Sprintf("problem(%d)", int(k))
+	}
+	return problemKindNames[k]
+}
+
+// Something wrong with the files of a FilesystemStorage, found when it was opened.
+type IntegrityProblem struct {
+	Kind IntegrityProblemKind
+	// The chunk and version that the problem affects, where known; zero otherwise.
+	Chunk   apis.ChunkNum
+	Version apis.Version
+	Path    string
+	Detail  string
+	// Whether the problem is beyond setting a single version aside, because it leaves the storage unable to say which
+	// chunks or versions it holds.
+	Fatal bool
+}
+
+func (p IntegrityProblem) String() string {
+	severity := "quarantinable"
+	if p.Fatal {
+		severity = "fatal"
+	}
+	return fmt.Sprintf("%s (%s) at %s: %s", p.Kind, severity, p.Path, p.Detail)
+}
+
+// What FilesystemStorage found and did when it checked its files on opening.
+type IntegrityReport struct {
+	Check IntegrityCheck
+	// How many version files were checked against their headers, and how many were written before there was a header,
+	// so that there was nothing to check them against.
+	Checked   int
+	Unchecked int
+	// Every problem found, in the order it was found.
+	Problems []IntegrityProblem
+	// How many files were set aside. Nothing is, if any problem is fatal.
+	Quarantined int
+}
+
+// Whether any problem found is fatal, in which case the storage refuses to open.
+func (r IntegrityReport) Fatal() bool {
+	for _, problem := range r.Problems {
+		if problem.Fatal {
+			return true
+		}
+	}
+	return false
+}
+
+func (r IntegrityReport) String() string {
+	fatal := 0
+	for _, problem := range r.Problems {
+		if problem.Fatal {
+			fatal += 1
+		}
+	}
+	return fmt.Sprintf("checked %d versions for %s (%d too old to check); found %d problems, %d of them fatal; "+
+		"quarantined %d files", r.Checked, r.Check, r.Unchecked, len(r.Problems), fatal, r.Quarantined)
+}
+
+// Returned when FilesystemStorage finds a fatal problem while checking its files. Nothing is quarantined in that case,
+// so that the files are left exactly as they were found for whoever looks into it.
+type IntegrityError struct {
+	Report IntegrityReport
+}
+
+func (e *IntegrityError) Error() string {
+	var fatal []string
+	for _, problem := range e.Report.Problems {
+		if problem.Fatal {
+			fatal = append(fatal, problem.String())
+		}
+	}
+	return fmt.Sprintf("storage is too damaged to open: %s", strings.Join(fatal, "; "))
+}
+
+// Checks every version file and every latest version, then sets aside whatever damaged files can be set aside, unless
+// something is damaged beyond that, in which case an IntegrityError is returned and nothing is touched.
+func (m *FilesystemStorage) checkIntegrity(check IntegrityCheck) (IntegrityReport, error) {
+	report := IntegrityReport{Check: check}
+
+	fanouts, err := ioutil.ReadDir(m.chunksDir())
+	if err != nil && !os.IsNotExist(err) {
+		report.Problems = append(report.Problems, IntegrityProblem{
+			Kind: ProblemUnreadable, Path: m.chunksDir(), Detail: err.Error(), Fatal: true,
+		})
+	}
+	for _, fanout := range fanouts {
+		fanoutDir := filepath.Join(m.chunksDir(), fanout.Name())
+		chunkDirs, err := ioutil.ReadDir(fanoutDir)
+		if err != nil {
+			report.Problems = append(report.Problems, IntegrityProblem{
+				Kind: ProblemUnreadable, Path: fanoutDir, Detail: err.Error(), Fatal: true,
+			})
+			continue
+		}
+		for _, chunkDir := range chunkDirs {
+			path := filepath.Join(fanoutDir, chunkDir.Name())
+			chunk, err := strconv.ParseUint(chunkDir.Name(), 10, 64)
+			if err != nil || !chunkDir.IsDir() {
+				report.Problems = append(report.Problems, IntegrityProblem{
+					Kind: ProblemStrayFile, Path: path, Detail: "not a chunk directory", Fatal: true,
+				})
+				continue
+			}
+			versions, err := ioutil.ReadDir(path)
+			if err != nil {
+				report.Problems = append(report.Problems, IntegrityProblem{
+					Kind: ProblemUnreadable, Chunk: apis.ChunkNum(chunk), Path: path, Detail: err.Error(), Fatal: true,
+				})
+				continue
+			}
+			for _, fi := range versions {
+				problem, checked, ok := m.checkVersionFile(apis.ChunkNum(chunk), fi, check)
+				if checked {
+					report.Checked += 1
+				} else if ok {
+					report.Unchecked += 1
+				}
+				if !ok {
+					report.Problems = append(report.Problems, problem)
+				}
+			}
+		}
+	}
+
+	m.checkLatestVersions(&report)
+
+	if report.Fatal() {
+		return report, &IntegrityError{Report: report}
+	}
+	// every problem left is with a single file in a chunk directory
+	for _, problem := range report.Problems {
+		var err error
+		if problem.Version != 0 {
+			err = m.QuarantineVersion(problem.Chunk, problem.Version)
+		} else {
+			err = m.quarantineFile(problem.Path, fmt.Sprintf("chunk-%d-%s", problem.Chunk, filepath.Base(problem.Path)))
+			// we don't care if this succeeds
+			_ = os.Remove(m.chunkDir(problem.Chunk))
+		}
+		if err != nil {
+			return report, fmt.Errorf("cannot quarantine %s: %v", problem.Path, err)
+		}
+		report.Quarantined += 1
+	}
+	return report, nil
+}
+
+// Checks a single file in a chunk directory. checked is true if the file could be checked against its header, and ok
+// is false if there's a problem with it, which is always one that can be dealt with by quarantining the file.
+func (m *FilesystemStorage) checkVersionFile(chunk apis.ChunkNum, fi os.FileInfo, check IntegrityCheck) (problem IntegrityProblem, checked bool, ok bool) {
+	path := filepath.Join(m.chunkDir(chunk), fi.Name())
+	problem = IntegrityProblem{Chunk: chunk, Path: path}
+	version, err := strconv.ParseUint(fi.Name(), 10, 64)
+	if err != nil || !fi.Mode().IsRegular() {
+		problem.Kind, problem.Detail = ProblemStrayFile, "not a version file"
+		return problem, false, false
+	}
+	problem.Version = apis.Version(version)
+	if version == 0 {
+		problem.Kind, problem.Detail = ProblemImpossibleVersion, "version zero is never stored"
+		return problem, false, false
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		problem.Kind, problem.Detail = ProblemUnreadable, err.Error()
+		return problem, false, false
+	}
+	defer f.Close()
+	if fi.Size() < chunkFileHeaderSize {
+		// too short to have a header, so written before there was one
+		return problem, false, true
+	}
+	header := make([]byte, chunkFileHeaderSize)
+	if _, err := io.ReadFull(f, header); err != nil {
+		problem.Kind, problem.Detail = ProblemUnreadable, err.Error()
+		return problem, false, false
+	}
+	if binary.LittleEndian.Uint32(header) != chunkFileMagic {
+		return problem, false, true
+	}
+	length := int64(binary.LittleEndian.Uint32(header[4:]))
+	if fi.Size()-chunkFileHeaderSize != length {
+		problem.Kind = ProblemTruncated
+		problem.Detail = fmt.Sprintf("has %d bytes of data, but should have %d", fi.Size()-chunkFileHeaderSize, length)
+		return problem, true, false
+	}
+	if check >= IntegrityCheckChecksums {
+		hash := crc32.NewIEEE()
+		if _, err := io.Copy(hash, f); err != nil {
+			problem.Kind, problem.Detail = ProblemUnreadable, err.Error()
+			return problem, true, false
+		}
+		if hash.Sum32() != binary.LittleEndian.Uint32(header[8:]) {
+			problem.Kind, problem.Detail = ProblemChecksum, "data does not match its checksum"
+			return problem, true, false
+		}
+	}
+	return problem, true, true
+}
+
+// Checks that every latest version can be read, and names a version that could exist. Any problem with one is fatal,
+// because there's no telling which version the chunk was meant to be at.
+func (m *FilesystemStorage) checkLatestVersions(report *IntegrityReport) {
+	fis, err := ioutil.ReadDir(m.path)
+	if err != nil {
+		report.Problems = append(report.Problems, IntegrityProblem{
+			Kind: ProblemUnreadable, Path: m.path, Detail: err.Error(), Fatal: true,
+		})
+		return
+	}
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), "latest-") {
+			continue
+		}
+		path := filepath.Join(m.path, fi.Name())
+		chunk, err := strconv.ParseUint(fi.Name()[7:], 10, 64)
+		if err != nil {
+			report.Problems = append(report.Problems, IntegrityProblem{
+				Kind: ProblemStrayFile, Path: path, Detail: "not named after a chunk", Fatal: true,
+			})
+			continue
+		}
+		latest, err := m.GetLatestVersion(apis.ChunkNum(chunk))
+		if err != nil {
+			kind := ProblemBadLatest
+			if _, ok := err.(*os.PathError); ok {
+				kind = ProblemUnreadable
+			}
+			report.Problems = append(report.Problems, IntegrityProblem{
+				Kind: kind, Chunk: apis.ChunkNum(chunk), Path: path, Detail: err.Error(), Fatal: true,
+			})
+		} else if latest == 0 {
+			report.Problems = append(report.Problems, IntegrityProblem{
+				Kind: ProblemImpossibleVersion, Chunk: apis.ChunkNum(chunk), Path: path,
+				Detail: "latest version is zero, which is never stored", Fatal: true,
+			})
+		}
+	}
+}
+
+func (m *FilesystemStorage) IntegrityReport() (IntegrityReport, bool) {
+	if m.integrity == nil {
+		return IntegrityReport{}, false
+	}
+	return *m.integrity, true
+}
@@ -0,0 +1,145 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"zircon/apis"
+)
+
+func openIntegrityTest(dir string, check IntegrityCheck) (*FilesystemStorage, error) {
+	s, err := ConfigureFilesystemStorageWithOptions(dir, FilesystemOptions{Integrity: check})
+	if err != nil {
+		return nil, err
+	}
+	return s.(*FilesystemStorage), nil
+}
+
+func problemsOf(report IntegrityReport) map[string]IntegrityProblemKind {
+	kinds := map[string]IntegrityProblemKind{}
+	for _, problem := range report.Problems {
+		kinds[problem.Path] = problem.Kind
+	}
+	return kinds
+}
+
+func TestIntegrityCheckQuarantines(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "integrity-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs, err := openIntegrityTest(dir, IntegrityCheckNone)
+	require.NoError(t, err)
+	for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+		require.NoError(t, fs.WriteVersion(chunk, 1, []byte("some chunk data")))
+		require.NoError(t, fs.SetLatestVersion(chunk, 1))
+	}
+	_, ok := fs.IntegrityReport()
+	assert.False(ok)
+	fs.Close()
+
+	require.NoError(t, os.Truncate(fs.chunkFilename(1, 1), chunkFileHeaderSize+4))
+	encoded, err := ioutil.ReadFile(fs.chunkFilename(2, 1))
+	require.NoError(t, err)
+	encoded[chunkFileHeaderSize] ^= 0x20
+	require.NoError(t, ioutil.WriteFile(fs.chunkFilename(2, 1), encoded, 0644))
+	require.NoError(t, ioutil.WriteFile(fs.chunkFilename(3, 0), encodeChunkFile([]byte("impossible")), 0644))
+	require.NoError(t, ioutil.WriteFile(fs.chunkDir(3)+"/junk", []byte("junk"), 0644))
+	require.NoError(t, ioutil.WriteFile(fs.chunkFilename(3, 2), []byte("legacy"), 0644))
+
+	// checking lengths doesn't notice the bad checksum
+	fs, err = openIntegrityTest(dir, IntegrityCheckLengths)
+	require.NoError(t, err)
+	report, ok := fs.IntegrityReport()
+	assert.True(ok)
+	assert.False(report.Fatal())
+	assert.Equal(3, report.Checked)
+	assert.Equal(1, report.Unchecked)
+	assert.Equal(map[string]IntegrityProblemKind{
+		fs.chunkFilename(1, 1):   ProblemTruncated,
+		fs.chunkFilename(3, 0):   ProblemImpossibleVersion,
+		fs.chunkDir(3) + "/junk": ProblemStrayFile,
+	}, problemsOf(report))
+	assert.Equal(3, report.Quarantined)
+	versions, err := fs.ListVersions(1)
+	assert.NoError(err)
+	assert.Empty(versions)
+	versions, err = fs.ListVersions(3)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1, 2}, versions)
+	for _, name := range []string{"chunk-1-1", "chunk-3-0", "chunk-3-junk"} {
+		_, err = os.Stat(fs.quarantineDir() + "/" + name)
+		assert.NoError(err)
+	}
+	fs.Close()
+
+	// checking checksums does
+	fs, err = openIntegrityTest(dir, IntegrityCheckChecksums)
+	require.NoError(t, err)
+	report, _ = fs.IntegrityReport()
+	assert.Equal(map[string]IntegrityProblemKind{fs.chunkFilename(2, 1): ProblemChecksum}, problemsOf(report))
+	assert.Equal(apis.ChunkNum(2), report.Problems[0].Chunk)
+	assert.Equal(apis.Version(1), report.Problems[0].Version)
+	assert.Equal(1, report.Quarantined)
+	fs.Close()
+
+	// and then everything that's left is intact
+	fs, err = openIntegrityTest(dir, IntegrityCheckChecksums)
+	require.NoError(t, err)
+	defer fs.Close()
+	report, _ = fs.IntegrityReport()
+	assert.Empty(report.Problems)
+	assert.Equal(1, report.Checked)
+	data, err := fs.ReadVersion(3, 1)
+	assert.NoError(err)
+	assert.Equal("some chunk data", string(data))
+}
+
+func TestIntegrityCheckFatal(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "integrity-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs, err := openIntegrityTest(dir, IntegrityCheckNone)
+	require.NoError(t, err)
+	require.NoError(t, fs.WriteVersion(1, 1, []byte("some chunk data")))
+	require.NoError(t, fs.SetLatestVersion(1, 1))
+	require.NoError(t, fs.WriteVersion(2, 1, []byte("some chunk data")))
+	require.NoError(t, fs.SetLatestVersion(2, 1))
+	fs.Close()
+
+	require.NoError(t, os.Truncate(fs.chunkFilename(1, 1), chunkFileHeaderSize+4))
+	require.NoError(t, ioutil.WriteFile(fs.latestFilename(2), []byte("garbage\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(fs.latestFilename(3), []byte("0\n"), 0644))
+	require.NoError(t, ioutil.WriteFile(fs.fanoutDir(1)+"/junk", []byte("junk"), 0644))
+
+	_, err = openIntegrityTest(dir, IntegrityCheckLengths)
+	require.Error(t, err)
+	integrityErr, ok := err.(*IntegrityError)
+	require.True(t, ok)
+	report := integrityErr.Report
+	assert.True(report.Fatal())
+	assert.Equal(map[string]IntegrityProblemKind{
+		fs.chunkFilename(1, 1):    ProblemTruncated,
+		fs.latestFilename(2):      ProblemBadLatest,
+		fs.latestFilename(3):      ProblemImpossibleVersion,
+		fs.fanoutDir(1) + "/junk": ProblemStrayFile,
+	}, problemsOf(report))
+	for _, problem := range report.Problems {
+		assert.Equal(problem.Path != fs.chunkFilename(1, 1), problem.Fatal, "%v", problem)
+	}
+
+	// nothing was touched, not even what could have been quarantined
+	assert.Equal(0, report.Quarantined)
+	_, err = os.Stat(fs.chunkFilename(1, 1))
+	assert.NoError(err)
+
+	// without a check, the storage still opens, and the damage is left for whatever reads it
+	fs, err = openIntegrityTest(dir, IntegrityCheckNone)
+	require.NoError(t, err)
+	fs.Close()
+}
@@ -0,0 +1,138 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"zircon/apis"
+)
+
+// Raised at a kill point to stop a commit in its tracks, as if the process had died there.
+type simulatedCrash struct {
+	step string
+}
+
+// Commits a version, crashing at the kill point with the given index, if the commit gets that far. Returns the step
+// that it crashed at, or the empty string if it finished. Like a real crash, nothing gets cleaned up afterwards.
+func commitUntilKillPoint(t *testing.T, fs *FilesystemStorage, index int, data []byte) (step string) {
+	reached := 0
+	fs.killPoint = func(step string) {
+		if reached == index {
+			if step == "temp-written" {
+				// a crash this early may not have let all of the data reach the disk
+				temp := fs.tempFilename(71, 2)
+				require.NoError(t, os.Truncate(temp, int64(chunkFileHeaderSize+len(data)/2)))
+			}
+			panic(simulatedCrash{step: step})
+		}
+		reached += 1
+	}
+	defer func() {
+		fs.killPoint = nil
+		if r := recover(); r != nil {
+			crashed, ok := r.(simulatedCrash)
+			if !ok {
+				panic(r)
+			}
+			step = crashed.step
+			if fs.log != nil {
+				_ = fs.log.file.Close()
+			}
+			fs.isClosed = true
+		}
+	}()
+	require.NoError(t, fs.WriteVersion(71, 2, data))
+	return ""
+}
+
+// Checks that a reopened storage has an intact version 1, and either an intact version 2 or none at all, with nothing
+// left over from the commit that was cut short. Returns whether version 2 is there.
+func checkCommitAtomic(t *testing.T, fs *FilesystemStorage, data []byte, context string) bool {
+	assert := testifyAssert.New(t)
+
+	original, err := fs.ReadVersion(71, 1)
+	assert.NoError(err, context)
+	assert.Equal("version one", string(original), context)
+
+	versions, err := fs.ListVersions(71)
+	require.NoError(t, err, context)
+	committed := len(versions) == 2
+	if committed {
+		assert.Equal([]apis.Version{1, 2}, versions, context)
+		contents, err := fs.ReadVersion(71, 2)
+		assert.NoError(err, context)
+		assert.True(bytes.Equal(data, contents), context)
+	} else {
+		assert.Equal([]apis.Version{1}, versions, context)
+	}
+
+	leftovers, err := ioutil.ReadDir(fs.tempDir())
+	if !os.IsNotExist(err) {
+		assert.NoError(err, context)
+		assert.Empty(leftovers, context)
+	}
+	return committed
+}
+
+func TestCommitKillPoints(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "killpoint-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("version two "), 8192)
+	for _, logged := range []bool{false, true} {
+		for _, durability := range []Durability{DurabilityNone, DurabilityCommit} {
+			open := func() *FilesystemStorage {
+				s, err := ConfigureFilesystemStorageWithDurability(dir, logged, durability)
+				require.NoError(t, err)
+				return s.(*FilesystemStorage)
+			}
+
+			var steps []string
+			for index := 0; ; index++ {
+				context := fmt.Sprintf("logged: %v, durability: %v, kill point %d", logged, durability, index)
+				require.NoError(t, os.RemoveAll(dir))
+				require.NoError(t, os.Mkdir(dir, 0755))
+
+				fs := open()
+				require.NoError(t, fs.WriteVersion(71, 1, []byte("version one")))
+				require.NoError(t, fs.SetLatestVersion(71, 1))
+				step := commitUntilKillPoint(t, fs, index, data)
+				if step == "" {
+					assert.True(checkCommitAtomic(t, fs, data, context), context)
+					fs.Close()
+					break
+				}
+				steps = append(steps, step)
+
+				fs = open()
+				committed := checkCommitAtomic(t, fs, data, context+" ("+step+")")
+				if logged {
+					// the log has the whole version, so the commit is finished when it's replayed
+					assert.True(committed, context)
+				}
+				if !committed {
+					// a commit that never happened can simply be tried again
+					assert.NoError(fs.WriteVersion(71, 2, data), context)
+					assert.True(checkCommitAtomic(t, fs, data, context), context)
+				}
+				latest, err := fs.GetLatestVersion(71)
+				assert.NoError(err, context)
+				assert.Equal(apis.Version(1), latest, context)
+				fs.Close()
+			}
+
+			if durability >= DurabilityCommit {
+				assert.Equal([]string{"temp-written", "renamed", "synced"}, steps)
+			} else {
+				assert.Equal([]string{"temp-written", "renamed"}, steps)
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"sync"
+	"zircon/apis"
+)
+
+// Committed versions of chunks that FilesystemStorage has mapped into memory, so that reads of hot chunks can be served
+// straight from the page cache, without a system call or a copy into a heap buffer, and without checking the checksum
+// again every time; a version file never changes once it's committed, so it's checked once, when it's mapped.
+// Bounded in the total size of the mapped files, with the least recently read versions unmapped first.
+//
+// A mapping can still be in use by a reader when its version is deleted, or when it would otherwise be unmapped to make
+// room. Rather than pull it out from under the reader, it's only taken out of the cache, and is unmapped once the last
+// reader releases it. That's safe even if the file was unlinked in the meantime, because POSIX keeps an unlinked file's
+// pages around for as long as they're mapped. Versions are never replaced without being deleted first, so dropping the
+// mapping on delete is enough to make sure that a stale one is never read.
+type mappedVersions struct {
+	mu       sync.Mutex
+	capacity int
+	used     int
+	versions map[mappedKey]*list.Element
+	// most recently read at the front
+	lru     *list.List
+	metrics MetricsSink
+}
+
+type mappedKey struct {
+	chunk   apis.ChunkNum
+	version apis.Version
+}
+
+type mappedVersion struct {
+	key mappedKey
+	// the whole file, as returned by mapFile
+	mapping []byte
+	// the chunk data within the mapping
+	data []byte
+	// how many readers are holding the mapping
+	refs int
+	// false once the mapping has been taken out of the cache, after which it's unmapped as soon as refs reaches zero
+	cached bool
+}
+
+func newMappedVersions(capacity int) *mappedVersions {
+	return &mappedVersions{
+		capacity: capacity,
+		versions: map[mappedKey]*list.Element{},
+		lru:      list.New(),
+		metrics:  NoMetrics,
+	}
+}
+
+func (c *mappedVersions) setMetricsSink(sink MetricsSink) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.metrics = sink
+}
+
+// Gets the data of a version from its mapping, mapping the file first if it isn't yet. ok is false if the version can't
+// be mapped, because mapping isn't supported on this platform, or the file is empty, or it's larger than what's left of
+// the capacity once every mapping that isn't in use has been unmapped; the caller should read it the usual way instead.
+// Otherwise, the data may not be modified, and may not be used once release has been called.
+func (c *mappedVersions) get(chunk apis.ChunkNum, version apis.Version, filename string) (data []byte, release func(), ok bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := mappedKey{chunk: chunk, version: version}
+	if element, found := c.versions[key]; found {
+		c.lru.MoveToFront(element)
+		mapped := element.Value.(*mappedVersion)
+		mapped.refs += 1
+		c.metrics.Add(CounterCacheHits, 1)
+		return mapped.data, c.releaser(mapped), true, nil
+	}
+	c.metrics.Add(CounterCacheMisses, 1)
+	if !mappingSupported {
+		return nil, nil, false, nil
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	c.metrics.Add(CounterFileOpens, 1)
+	// the mapping stays valid after the file is closed
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	size := int(info.Size())
+	if size == 0 || size > c.capacity {
+		return nil, nil, false, nil
+	}
+	for c.used+size > c.capacity {
+		if !c.evictOne() {
+			return nil, nil, false, nil
+		}
+	}
+	mapping, err := mapFile(f, size)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	decoded, err := decodeChunkFile(mapping)
+	if err != nil {
+		_ = unmapFile(mapping)
+		return nil, nil, false, fmt.Errorf("cannot read %d/%d: %v", chunk, version, err)
+	}
+	mapped := &mappedVersion{key: key, mapping: mapping, data: decoded, refs: 1, cached: true}
+	c.versions[key] = c.lru.PushFront(mapped)
+	c.used += len(mapping)
+	return decoded, c.releaser(mapped), true, nil
+}
+
+// Must be called with the lock held.
+func (c *mappedVersions) releaser(mapped *mappedVersion) func() {
+	released := false
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if released {
+			panic("mapped version released twice")
+		}
+		released = true
+		mapped.refs -= 1
+		if mapped.refs == 0 && !mapped.cached {
+			// nothing useful can be done about an error here; the worst case is that the address space is held on to
+			_ = unmapFile(mapped.mapping)
+		}
+	}
+}
+
+// Unmaps the least recently read mapping that isn't in use. Returns false if every mapping is in use. Must be called
+// with the lock held.
+func (c *mappedVersions) evictOne() bool {
+	for element := c.lru.Back(); element != nil; element = element.Prev() {
+		if element.Value.(*mappedVersion).refs == 0 {
+			c.remove(element)
+			return true
+		}
+	}
+	return false
+}
+
+// Takes a mapping out of the cache, and unmaps it unless it's in use. Must be called with the lock held.
+func (c *mappedVersions) remove(element *list.Element) {
+	mapped := element.Value.(*mappedVersion)
+	delete(c.versions, mapped.key)
+	c.lru.Remove(element)
+	c.used -= len(mapped.mapping)
+	mapped.cached = false
+	if mapped.refs == 0 {
+		_ = unmapFile(mapped.mapping)
+	}
+}
+
+// Drops the mapping of a version, if there is one, before the version is deleted.
+func (c *mappedVersions) drop(chunk apis.ChunkNum, version apis.Version) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, found := c.versions[mappedKey{chunk: chunk, version: version}]; found {
+		c.remove(element)
+	}
+}
+
+// Drops every mapping, when the storage is closed. Mappings still in use are unmapped once they're released.
+func (c *mappedVersions) dropAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// How many bytes of version files are currently mapped by the cache, and how many versions that is.
+func (c *mappedVersions) size() (bytes int, versions int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.used, c.lru.Len()
+}
@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"zircon/apis"
+)
+
+func openMappedTest(t testing.TB, dir string, capacity int) *FilesystemStorage {
+	s, err := ConfigureFilesystemStorageWithOptions(dir, FilesystemOptions{MappedReadCapacity: capacity})
+	require.NoError(t, err)
+	return s.(*FilesystemStorage)
+}
+
+func TestMappedReads(t *testing.T) {
+	if !mappingSupported {
+		t.Skip("mapped reads are not supported on this platform")
+	}
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "mapped-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs := openMappedTest(t, dir, 1024*1024)
+	defer fs.Close()
+	assert.True(fs.MapsVersions())
+
+	require.NoError(t, fs.WriteVersion(1, 1, []byte("hello world")))
+	data, release, err := fs.ReadVersionMapped(1, 1)
+	assert.NoError(err)
+	assert.Equal("hello world", string(data))
+	used, versions := fs.mapped.size()
+	assert.Equal(chunkFileHeaderSize+11, used)
+	assert.Equal(1, versions)
+
+	// plain reads are served from the same mapping, but copied out of it
+	copied, err := fs.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.Equal("hello world", string(copied))
+	buf := make([]byte, 64)
+	copied, err = fs.ReadVersionInto(1, 1, buf)
+	assert.NoError(err)
+	assert.Equal("hello world", string(copied))
+	assert.Equal(&buf[0], &copied[0])
+
+	// a version that's deleted, and written again, while a reader still holds the old mapping, is read afresh, while
+	// the reader can keep using the old contents until it's done with them
+	assert.NoError(fs.DeleteVersion(1, 1))
+	_, versions = fs.mapped.size()
+	assert.Equal(0, versions)
+	require.NoError(t, fs.WriteVersion(1, 1, []byte("HELLO WORLD")))
+	assert.Equal("hello world", string(data))
+	replaced, releaseReplaced, err := fs.ReadVersionMapped(1, 1)
+	assert.NoError(err)
+	assert.Equal("HELLO WORLD", string(replaced))
+	release()
+	releaseReplaced()
+
+	// damage is caught when the file is mapped
+	require.NoError(t, fs.WriteVersion(2, 1, []byte("soon to be damaged")))
+	filename := fs.chunkFilename(2, 1)
+	contents, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	contents[len(contents)-1] ^= 0xFF
+	require.NoError(t, ioutil.WriteFile(filename, contents, 0644))
+	_, _, err = fs.ReadVersionMapped(2, 1)
+	assert.Error(err)
+	_, err = fs.ReadVersion(2, 1)
+	assert.Error(err)
+	_, err = fs.ReadVersion(3, 1)
+	assert.Error(err)
+}
+
+func TestMappedReadsBounded(t *testing.T) {
+	if !mappingSupported {
+		t.Skip("mapped reads are not supported on this platform")
+	}
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "mapped-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fileSize := chunkFileHeaderSize + 1000
+	fs := openMappedTest(t, dir, 3*fileSize)
+	defer fs.Close()
+
+	for chunk := apis.ChunkNum(1); chunk <= 5; chunk++ {
+		require.NoError(t, fs.WriteVersion(chunk, 1, bytes.Repeat([]byte{byte(chunk)}, 1000)))
+	}
+	held, release, err := fs.ReadVersionMapped(1, 1)
+	assert.NoError(err)
+	for chunk := apis.ChunkNum(2); chunk <= 5; chunk++ {
+		data, err := fs.ReadVersion(chunk, 1)
+		assert.NoError(err)
+		assert.Equal(bytes.Repeat([]byte{byte(chunk)}, 1000), data)
+		used, _ := fs.mapped.size()
+		assert.True(used <= 3*fileSize)
+	}
+	// the least recently read mappings go first, except for the one still in use
+	_, versions := fs.mapped.size()
+	assert.Equal(3, versions)
+	for chunk := apis.ChunkNum(1); chunk <= 5; chunk++ {
+		_, found := fs.mapped.versions[mappedKey{chunk: chunk, version: 1}]
+		assert.Equal(chunk == 1 || chunk >= 4, found, "chunk %d", chunk)
+	}
+	assert.Equal(bytes.Repeat([]byte{1}, 1000), held)
+
+	// once every mapping is in use, or a file is too large to ever fit, reads fall back to copying
+	var releases []func()
+	for chunk := apis.ChunkNum(4); chunk <= 5; chunk++ {
+		_, release, err := fs.ReadVersionMapped(chunk, 1)
+		assert.NoError(err)
+		releases = append(releases, release)
+	}
+	data, releaseCopy, err := fs.ReadVersionMapped(2, 1)
+	assert.NoError(err)
+	assert.Equal(bytes.Repeat([]byte{2}, 1000), data)
+	releaseCopy()
+	require.NoError(t, fs.WriteVersion(6, 1, make([]byte, 4*fileSize)))
+	data, err = fs.ReadVersion(6, 1)
+	assert.NoError(err)
+	assert.Equal(4*fileSize, len(data))
+	_, versions = fs.mapped.size()
+	assert.Equal(3, versions)
+
+	// closing unmaps whatever isn't in use, and the rest once it's released
+	release()
+	fs.Close()
+	_, versions = fs.mapped.size()
+	assert.Equal(0, versions)
+	for _, release := range releases {
+		release()
+	}
+}
+
+// Compares reading a small part of a hot chunk by reading the whole version into a reused buffer, as the chunkserver
+// does without mapping, with slicing it out of the version's mapping.
+func BenchmarkHotReads(b *testing.B) {
+	dir, err := ioutil.TempDir("", "mapped-bench-")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	for _, size := range []int{64 * 1024, 1024 * 1024, apis.MaxChunkSize} {
+		fs := openMappedTest(b, dir, 64*1024*1024)
+		require.NoError(b, fs.WriteVersion(1, apis.Version(size), make([]byte, size)))
+		result := make([]byte, 4096)
+
+		b.Run(fmt.Sprintf("read/%d", size), func(b *testing.B) {
+			buf := make([]byte, ReadBufferSize)
+			fs.mapped = nil
+			for i := 0; i < b.N; i++ {
+				data, err := fs.ReadVersionInto(1, apis.Version(size), buf)
+				if err != nil {
+					b.Fatal(err)
+				}
+				copy(result, data[size/2:])
+			}
+		})
+		b.Run(fmt.Sprintf("mapped/%d", size), func(b *testing.B) {
+			fs.mapped = newMappedVersions(64 * 1024 * 1024)
+			for i := 0; i < b.N; i++ {
+				data, release, err := fs.ReadVersionMapped(1, apis.Version(size))
+				if err != nil {
+					b.Fatal(err)
+				}
+				copy(result, data[size/2:])
+				release()
+			}
+		})
+		fs.Close()
+	}
+}
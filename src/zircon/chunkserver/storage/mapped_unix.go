@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+const mappingSupported = true
+
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func unmapFile(mapping []byte) error {
+	return syscall.Munmap(mapping)
+}
@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package storage
+
+import (
+	"errors"
+	"os"
+)
+
+// Mapped reads aren't implemented here, so versions are always read the usual way.
+const mappingSupported = false
+
+func mapFile(f *os.File, size int) ([]byte, error) {
+	return nil, errors.New("mapping files is not supported on this platform")
+}
+
+func unmapFile(mapping []byte) error {
+	return nil
+}
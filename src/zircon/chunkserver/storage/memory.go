@@ -3,6 +3,7 @@ package storage
 import (
 	"fmt"
 	"sort"
+	"time"
 	"zircon/apis"
 )
 
@@ -10,29 +11,151 @@ type MemoryStorage struct {
 	isClosed bool
 	chunks   map[apis.ChunkNum]map[apis.Version][]byte
 	latest   map[apis.ChunkNum]apis.Version
+	// kept apart from the chunks themselves, since a chunk's tombstone outlives its data
+	tombstones map[apis.ChunkNum]apis.Tombstone
+	hashes     map[apis.ChunkVersion][]apis.CommitHash
+	// versions set aside by QuarantineVersion, along with when that happened; not counted towards the capacity
+	quarantined map[apis.ChunkVersion]quarantinedVersion
+
+	// zero if there is no limit
+	capacity  int
+	committed int
+	staged    int
+	// kept up to date by every operation that changes what they count; see MemoryUsage
+	overhead        int
+	quarantineBytes int
+
+	metrics MetricsSink
+	limit   chunkSizeLimit
+}
+
+type quarantinedVersion struct {
+	data []byte
+	when time.Time
+}
+
+// Bytes of data held by a MemoryStorage, as reported by StatsForTesting. See MemoryUsage for the full breakdown.
+type MemoryStats struct {
+	// Number of distinct buffers of chunk data; versions that share data through LinkVersion only count once
+	Buffers int
+	// Bytes of chunk data across all stored versions, again only counting shared data once
+	Committed int
+	// Bytes of writes that have been staged but not yet committed or discarded
+	Staged int
+}
+
+// Everything a MemoryStorage holds, broken down exactly.
+type MemoryUsage struct {
+	// Bytes of chunk data in each stored version; versions that share data through LinkVersion each count all of it
+	Versions map[apis.ChunkVersion]int
+	// Number of distinct buffers of chunk data, and the bytes they hold, so that shared data is only counted once
+	Buffers   int
+	Committed int
+	// Bytes of writes that have been staged but not yet committed or discarded
+	Staged int
+	// Bytes of bookkeeping besides chunk data: which versions are stored, latest versions, commit hashes, tombstones,
+	// and quarantined versions; see memoryFieldOverhead
+	Overhead int
+	// Bytes of chunk data in quarantined versions
+	Quarantined int
+}
+
+// Everything counted, which is more than the capacity applies to: only Committed and Staged count towards that.
+func (u MemoryUsage) Total() int {
+	return u.Committed + u.Staged + u.Overhead + u.Quarantined
+}
+
+// Every chunk number, version, and time that MemoryStorage keeps track of is counted as this many bytes of overhead,
+// and every commit hash as its length. This is how much space the same bookkeeping would take if it were stored
+// compactly, rather than what the Go runtime actually allocates for it, so that it's the same on every platform.
+const memoryFieldOverhead = 8
+
+// which versions are stored, and which version is the latest, each take a chunk number and a version
+const memoryVersionOverhead = 2 * memoryFieldOverhead
+
+// tombstones and quarantined versions each take a chunk number, a version, and a time
+const memoryTimedOverhead = 3 * memoryFieldOverhead
+
+// recorded commit hashes take the chunk number and version they're for, and then the hashes themselves
+func commitHashesOverhead(hashes []apis.CommitHash) int {
+	overhead := memoryVersionOverhead
+	for _, hash := range hashes {
+		overhead += len(hash)
+	}
+	return overhead
 }
 
 // Creates an in-memory-only location to store data, and construct an interface by which a chunkserver can store chunks
 func ConfigureMemoryStorage() (ChunkStorage, error) {
+	return ConfigureMemoryStorageWithCap(0)
+}
+
+// Like ConfigureMemoryStorage, but refuses to hold more than capacity bytes of chunk data, counting both stored
+// versions and staged writes. Writes that would exceed the cap fail with ErrOutOfSpace. A capacity of zero means that
+// there is no limit.
+func ConfigureMemoryStorageWithCap(capacity int) (ChunkStorage, error) {
+	if capacity < 0 {
+		return nil, fmt.Errorf("invalid memory storage capacity: %d", capacity)
+	}
 	return &MemoryStorage{
-		chunks: map[apis.ChunkNum]map[apis.Version][]byte{},
-		latest: map[apis.ChunkNum]apis.Version{},
+		chunks:      map[apis.ChunkNum]map[apis.Version][]byte{},
+		latest:      map[apis.ChunkNum]apis.Version{},
+		tombstones:  map[apis.ChunkNum]apis.Tombstone{},
+		hashes:      map[apis.ChunkVersion][]apis.CommitHash{},
+		quarantined: map[apis.ChunkVersion]quarantinedVersion{},
+		capacity:    capacity,
+		metrics:     NoMetrics,
 	}, nil
 }
 
-// returns semi-fake storage usage stats for testing
-func (m *MemoryStorage) StatsForTesting() int {
-	if m.isClosed {
-		panic("attempt to use closed MemoryStorage")
+// returns storage usage stats for testing; the totals of Usage, without the overhead
+func (m *MemoryStorage) StatsForTesting() MemoryStats {
+	usage := m.Usage()
+	return MemoryStats{
+		Buffers:   usage.Buffers,
+		Committed: usage.Committed,
+		Staged:    usage.Staged,
 	}
-	chunkCount := 0
-	for _, v := range m.chunks {
-		chunkCount += len(v)
+}
+
+func (m *MemoryStorage) Usage() MemoryUsage {
+	m.assertOpen()
+	usage := MemoryUsage{
+		Versions:    map[apis.ChunkVersion]int{},
+		Committed:   m.committed,
+		Staged:      m.staged,
+		Overhead:    m.overhead,
+		Quarantined: m.quarantineBytes,
+	}
+	// versions created by LinkVersion share their data, so it only gets counted once
+	distinctData := map[*byte]bool{}
+	for chunk, v := range m.chunks {
+		for version, data := range v {
+			usage.Versions[apis.ChunkVersion{Chunk: chunk, Version: version}] = len(data)
+			if len(data) > 0 {
+				distinctData[&data[0]] = true
+			}
+		}
+	}
+	usage.Buffers = len(distinctData)
+	return usage
+}
+
+// Fails with ErrOutOfSpace if holding this many more bytes would exceed the cap.
+func (m *MemoryStorage) checkSpace(bytes int) error {
+	if m.capacity != 0 && m.committed+m.staged+bytes > m.capacity {
+		return apis.NewError(apis.ErrOutOfSpace, 0, "memory storage is full: %d committed + %d staged + %d new > %d",
+			m.committed, m.staged, bytes, m.capacity)
+	}
+	return nil
+}
+
+func (m *MemoryStorage) Space() (StorageSpace, bool, error) {
+	m.assertOpen()
+	if m.capacity == 0 {
+		return StorageSpace{}, false, nil
 	}
-	entryCount := len(m.chunks) + len(m.latest) + chunkCount
-	// let's approximate 32 bytes per hash table entry
-	// and 8 MB per chunk of data
-	return entryCount*32 + chunkCount*int(apis.MaxChunkSize)
+	return StorageSpace{UsedBytes: uint64(m.committed + m.staged), TotalBytes: uint64(m.capacity)}, true, nil
 }
 
 func (m *MemoryStorage) assertOpen() {
@@ -68,12 +191,85 @@ func (m *MemoryStorage) ListVersions(chunk apis.ChunkNum) ([]apis.Version, error
 	return result, nil
 }
 
+func (m *MemoryStorage) OpenCursor(token CursorToken) (Cursor, error) {
+	m.assertOpen()
+	position, started, err := parsePositionToken(token)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryCursor{storage: m, position: position, started: started}, nil
+}
+
+// Keeps nothing but its position, and finds the next batch by scanning every chunk, so that no more than a batch's
+// worth of chunk numbers is ever held at once.
+type memoryCursor struct {
+	storage  *MemoryStorage
+	position apis.ChunkVersion
+	started  bool
+}
+
+func (c *memoryCursor) Next(max int) ([]apis.ChunkVersion, error) {
+	c.storage.assertOpen()
+	if max <= 0 {
+		return nil, fmt.Errorf("invalid cursor batch size: %d", max)
+	}
+	// every chunk has at least one version, so the first max chunks after the position are enough to fill a batch,
+	// along with the chunk at the position, which may have nothing left
+	limit := max + 1
+	var chunks []apis.ChunkNum
+	for chunk, versions := range c.storage.chunks {
+		if len(versions) == 0 || (c.started && chunk < c.position.Chunk) {
+			continue
+		}
+		chunks = append(chunks, chunk)
+		if len(chunks) >= 2*limit {
+			sortChunks(chunks)
+			chunks = chunks[:limit]
+		}
+	}
+	sortChunks(chunks)
+	var batch []apis.ChunkVersion
+	for _, chunk := range chunks {
+		if len(batch) >= max {
+			break
+		}
+		versions, err := c.storage.ListVersions(chunk)
+		if err != nil {
+			return nil, err
+		}
+		batch = appendVersionsAfter(batch, max, chunk, versions, c.position, c.started)
+	}
+	if len(batch) > 0 {
+		c.position, c.started = batch[len(batch)-1], true
+	}
+	return batch, nil
+}
+
+func (c *memoryCursor) Token() CursorToken {
+	if !c.started {
+		return ""
+	}
+	return positionToken(c.position)
+}
+
 func (m *MemoryStorage) ReadVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
+	return m.ReadVersionInto(chunk, version, nil)
+}
+
+func (m *MemoryStorage) ReadVersionInto(chunk apis.ChunkNum, version apis.Version, buf []byte) ([]byte, error) {
 	m.assertOpen()
 	if versionMap := m.chunks[chunk]; versionMap != nil {
 		if data, found := versionMap[version]; found {
-			ndata := make([]byte, len(data))
+			start := time.Now()
+			var ndata []byte
+			if buf != nil && cap(buf) >= len(data) {
+				ndata = buf[:len(data)]
+			} else {
+				ndata = make([]byte, len(data))
+			}
 			copy(ndata, data)
+			m.metrics.Add(CounterBytesRead, uint64(len(ndata)))
+			m.metrics.Observe(LatencyRead, time.Since(start))
 			return ndata, nil
 		}
 	}
@@ -82,21 +278,50 @@ func (m *MemoryStorage) ReadVersion(chunk apis.ChunkNum, version apis.Version) (
 
 func (m *MemoryStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
 	m.assertOpen()
-	if len(data) > apis.MaxChunkSize {
-		return fmt.Errorf("chunk is too large: %d/%s = data[%d]", chunk, version, len(data))
+	if err := m.limit.check(chunk, version, data); err != nil {
+		return err
 	}
 	versionMap := m.chunks[chunk]
-	if versionMap == nil {
-		versionMap = map[apis.Version][]byte{}
-		m.chunks[chunk] = versionMap
-	}
 	existing, exists := versionMap[version]
 	if exists {
 		return fmt.Errorf("chunk/version combination already exists: %d/%d = data[%d]", chunk, version, len(existing))
 	}
+	if err := m.checkSpace(len(data)); err != nil {
+		return err
+	}
+	// only once nothing can fail, so that a failed write leaves nothing behind, not even an empty chunk
+	if versionMap == nil {
+		versionMap = map[apis.Version][]byte{}
+		m.chunks[chunk] = versionMap
+	}
+	start := time.Now()
 	ndata := make([]byte, len(data))
 	copy(ndata, data)
 	versionMap[version] = ndata
+	m.committed += len(ndata)
+	m.overhead += memoryVersionOverhead
+	m.metrics.Add(CounterVersionsWritten, 1)
+	m.metrics.Add(CounterBytesWritten, uint64(len(ndata)))
+	m.metrics.Observe(LatencyWrite, time.Since(start))
+	return nil
+}
+
+func (m *MemoryStorage) LinkVersion(chunk apis.ChunkNum, existing apis.Version, version apis.Version) error {
+	m.assertOpen()
+	versionMap := m.chunks[chunk]
+	if versionMap == nil {
+		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, existing)
+	}
+	data, found := versionMap[existing]
+	if !found {
+		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, existing)
+	}
+	if _, exists := versionMap[version]; exists {
+		return fmt.Errorf("chunk/version combination already exists: %d/%d", chunk, version)
+	}
+	// stored data is never modified in place, so it's safe to share
+	versionMap[version] = data
+	m.overhead += memoryVersionOverhead
 	return nil
 }
 
@@ -106,17 +331,73 @@ func (m *MemoryStorage) DeleteVersion(chunk apis.ChunkNum, version apis.Version)
 	if versionMap == nil {
 		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, version)
 	}
-	_, exists := versionMap[version]
+	data, exists := versionMap[version]
 	if !exists {
 		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, version)
 	}
 	delete(versionMap, version)
+	m.overhead -= memoryVersionOverhead
+	if hashes, found := m.hashes[apis.ChunkVersion{Chunk: chunk, Version: version}]; found {
+		delete(m.hashes, apis.ChunkVersion{Chunk: chunk, Version: version})
+		m.overhead -= commitHashesOverhead(hashes)
+	}
+	if !isShared(versionMap, data) {
+		m.committed -= len(data)
+	}
 	if len(versionMap) == 0 {
 		delete(m.chunks, chunk)
 	}
+	m.metrics.Add(CounterVersionsDeleted, 1)
+	return nil
+}
+
+func (m *MemoryStorage) QuarantineVersion(chunk apis.ChunkNum, version apis.Version) error {
+	m.assertOpen()
+	data, err := m.ReadVersion(chunk, version)
+	if err != nil {
+		return err
+	}
+	if err := m.DeleteVersion(chunk, version); err != nil {
+		return err
+	}
+	cv := apis.ChunkVersion{Chunk: chunk, Version: version}
+	if earlier, found := m.quarantined[cv]; found {
+		m.quarantineBytes -= len(earlier.data)
+		m.overhead -= memoryTimedOverhead
+	}
+	m.quarantined[cv] = quarantinedVersion{data: data, when: time.Now()}
+	m.quarantineBytes += len(data)
+	m.overhead += memoryTimedOverhead
 	return nil
 }
 
+func (m *MemoryStorage) PurgeQuarantine(cutoff time.Time) (int, error) {
+	m.assertOpen()
+	removed := 0
+	for cv, quarantined := range m.quarantined {
+		if quarantined.when.Before(cutoff) {
+			delete(m.quarantined, cv)
+			m.quarantineBytes -= len(quarantined.data)
+			m.overhead -= memoryTimedOverhead
+			removed += 1
+		}
+	}
+	return removed, nil
+}
+
+// Checks whether any remaining version is still using this data. Only LinkVersion shares data, and only within a chunk.
+func isShared(versionMap map[apis.Version][]byte, data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	for _, other := range versionMap {
+		if len(other) > 0 && &other[0] == &data[0] {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *MemoryStorage) ListChunksWithLatest() ([]apis.ChunkNum, error) {
 	m.assertOpen()
 	result := make([]apis.ChunkNum, 0, len(m.latest))
@@ -136,6 +417,9 @@ func (m *MemoryStorage) GetLatestVersion(chunk apis.ChunkNum) (apis.Version, err
 
 func (m *MemoryStorage) SetLatestVersion(chunk apis.ChunkNum, latest apis.Version) error {
 	m.assertOpen()
+	if _, found := m.latest[chunk]; !found {
+		m.overhead += memoryVersionOverhead
+	}
 	m.latest[chunk] = latest
 	return nil
 }
@@ -145,14 +429,201 @@ func (m *MemoryStorage) DeleteLatestVersion(chunk apis.ChunkNum) error {
 	_, found := m.latest[chunk]
 	if found {
 		delete(m.latest, chunk)
+		m.overhead -= memoryVersionOverhead
 		return nil
 	} else {
 		return fmt.Errorf("cannot delete nonexistent latest version for chunk: %d", chunk)
 	}
 }
 
+func (m *MemoryStorage) StageData(bytes int) error {
+	m.assertOpen()
+	if err := m.checkSpace(bytes); err != nil {
+		return err
+	}
+	m.staged += bytes
+	return nil
+}
+
+func (m *MemoryStorage) UnstageData(bytes int) {
+	m.assertOpen()
+	if bytes > m.staged {
+		panic("attempt to unstage more data than was staged")
+	}
+	m.staged -= bytes
+}
+
+func (m *MemoryStorage) Stats() (StorageStats, error) {
+	m.assertOpen()
+	stats := StorageStats{
+		CommittedBytes: uint64(m.committed),
+		StagedBytes:    uint64(m.staged),
+		OverheadBytes:  uint64(m.overhead),
+	}
+	if err := countVersions(m, &stats); err != nil {
+		return StorageStats{}, err
+	}
+	return stats, nil
+}
+
+func (m *MemoryStorage) SetCommitHashes(chunk apis.ChunkNum, version apis.Version, hashes []apis.CommitHash) error {
+	m.assertOpen()
+	if _, found := m.chunks[chunk][version]; !found {
+		return fmt.Errorf("chunk/version combination does not exist: %d/%d", chunk, version)
+	}
+	cv := apis.ChunkVersion{Chunk: chunk, Version: version}
+	if earlier, found := m.hashes[cv]; found {
+		m.overhead -= commitHashesOverhead(earlier)
+	}
+	m.hashes[cv] = append([]apis.CommitHash(nil), hashes...)
+	m.overhead += commitHashesOverhead(hashes)
+	return nil
+}
+
+func (m *MemoryStorage) CommitHashes(chunk apis.ChunkNum, version apis.Version) ([]apis.CommitHash, error) {
+	m.assertOpen()
+	return m.hashes[apis.ChunkVersion{Chunk: chunk, Version: version}], nil
+}
+
+func (m *MemoryStorage) KeepTombstone(tombstone apis.Tombstone) error {
+	m.assertOpen()
+	if _, found := m.tombstones[tombstone.Chunk]; !found {
+		m.overhead += memoryTimedOverhead
+	}
+	m.tombstones[tombstone.Chunk] = tombstone
+	return nil
+}
+
+func (m *MemoryStorage) ForgetTombstone(chunk apis.ChunkNum) error {
+	m.assertOpen()
+	if _, found := m.tombstones[chunk]; found {
+		delete(m.tombstones, chunk)
+		m.overhead -= memoryTimedOverhead
+	}
+	return nil
+}
+
+func (m *MemoryStorage) ListTombstones() ([]apis.Tombstone, error) {
+	m.assertOpen()
+	result := make([]apis.Tombstone, 0, len(m.tombstones))
+	for _, tombstone := range m.tombstones {
+		result = append(result, tombstone)
+	}
+	return result, nil
+}
+
+func (m *MemoryStorage) SetMaxChunkSize(size uint32) bool {
+	m.limit.set(size)
+	return true
+}
+
+func (m *MemoryStorage) SetMetricsSink(sink MetricsSink) bool {
+	m.metrics = sinkOrDiscard(sink)
+	return true
+}
+
+func (m *MemoryStorage) Flush() error {
+	m.assertOpen()
+	// nothing to flush
+	return nil
+}
+
 func (m *MemoryStorage) Close() {
 	m.chunks = nil
 	m.latest = nil
+	m.tombstones = nil
+	m.hashes = nil
+	m.quarantined = nil
+	m.committed = 0
+	m.staged = 0
+	m.overhead = 0
+	m.quarantineBytes = 0
 	m.isClosed = true
 }
+
+// A deep copy of the contents of a MemoryStorage, taken by Snapshot. Nothing in a snapshot is shared with the storage
+// it came from, or with any storage restored or cloned from it, so the same snapshot can be used any number of times.
+type MemorySnapshot struct {
+	contents *MemoryStorage
+}
+
+// What a snapshot captures beyond the stored versions and their metadata.
+type SnapshotOptions struct {
+	// Whether to count staged data in the snapshot. Staged data belongs to writes in progress in whatever chunkserver is
+	// using the storage, and only makes sense to restore into that same chunkserver; otherwise, leave this unset, so
+	// that the restored storage starts with nothing staged.
+	IncludeStaged bool
+}
+
+// Captures everything the storage holds, so that it can later be put back with Restore, or copied with CloneStorage.
+func (m *MemoryStorage) Snapshot(options SnapshotOptions) *MemorySnapshot {
+	m.assertOpen()
+	contents := m.deepCopy()
+	if !options.IncludeStaged {
+		contents.staged = 0
+	}
+	return &MemorySnapshot{contents: contents}
+}
+
+// Replaces everything the storage holds with the contents of a snapshot, which may have come from any MemoryStorage.
+// The storage keeps its own capacity, even if the snapshot holds more than that, and its own metrics sink.
+func (m *MemoryStorage) Restore(snapshot *MemorySnapshot) {
+	m.assertOpen()
+	capacity, metrics := m.capacity, m.metrics
+	*m = *snapshot.contents.deepCopy()
+	m.capacity, m.metrics = capacity, metrics
+}
+
+// Creates an independent MemoryStorage holding the contents of a snapshot, with the same capacity as the storage that
+// the snapshot was taken from.
+func CloneStorage(snapshot *MemorySnapshot) *MemoryStorage {
+	return snapshot.contents.deepCopy()
+}
+
+func (m *MemoryStorage) deepCopy() *MemoryStorage {
+	c := &MemoryStorage{
+		chunks:          make(map[apis.ChunkNum]map[apis.Version][]byte, len(m.chunks)),
+		latest:          make(map[apis.ChunkNum]apis.Version, len(m.latest)),
+		tombstones:      make(map[apis.ChunkNum]apis.Tombstone, len(m.tombstones)),
+		hashes:          make(map[apis.ChunkVersion][]apis.CommitHash, len(m.hashes)),
+		quarantined:     make(map[apis.ChunkVersion]quarantinedVersion, len(m.quarantined)),
+		capacity:        m.capacity,
+		committed:       m.committed,
+		staged:          m.staged,
+		overhead:        m.overhead,
+		quarantineBytes: m.quarantineBytes,
+		metrics:         NoMetrics,
+	}
+	for chunk, versionMap := range m.chunks {
+		// versions that share their data through LinkVersion must still share it in the copy, or else deleting one of
+		// them would be accounted for incorrectly
+		copies := map[*byte][]byte{}
+		nversionMap := make(map[apis.Version][]byte, len(versionMap))
+		for version, data := range versionMap {
+			if len(data) == 0 {
+				nversionMap[version] = []byte{}
+				continue
+			}
+			ndata, found := copies[&data[0]]
+			if !found {
+				ndata = append([]byte(nil), data...)
+				copies[&data[0]] = ndata
+			}
+			nversionMap[version] = ndata
+		}
+		c.chunks[chunk] = nversionMap
+	}
+	for chunk, version := range m.latest {
+		c.latest[chunk] = version
+	}
+	for chunk, tombstone := range m.tombstones {
+		c.tombstones[chunk] = tombstone
+	}
+	for cv, hashes := range m.hashes {
+		c.hashes[cv] = append([]apis.CommitHash(nil), hashes...)
+	}
+	for cv, quarantined := range m.quarantined {
+		c.quarantined[cv] = quarantinedVersion{data: append([]byte(nil), quarantined.data...), when: quarantined.when}
+	}
+	return c
+}
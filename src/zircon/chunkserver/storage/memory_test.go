@@ -0,0 +1,191 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+func TestMemoryStorageCap(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	s, err := ConfigureMemoryStorageWithCap(100)
+	require.NoError(t, err)
+	defer s.Close()
+	mem := s.(*MemoryStorage)
+
+	assert.NoError(s.WriteVersion(1, 1, make([]byte, 60)))
+	err = s.WriteVersion(1, 2, make([]byte, 60))
+	assert.Equal(apis.ErrOutOfSpace, apis.ErrorCodeOf(err))
+
+	// linked versions don't take any more space, and only free it once the last of them is gone
+	assert.NoError(s.LinkVersion(1, 1, 2))
+	assert.Equal(MemoryStats{Buffers: 1, Committed: 60}, mem.StatsForTesting())
+	assert.NoError(s.DeleteVersion(1, 1))
+	assert.Equal(MemoryStats{Buffers: 1, Committed: 60}, mem.StatsForTesting())
+
+	assert.Equal(apis.ErrOutOfSpace, apis.ErrorCodeOf(s.StageData(41)))
+	assert.NoError(s.StageData(40))
+	assert.Equal(MemoryStats{Buffers: 1, Committed: 60, Staged: 40}, mem.StatsForTesting())
+	space, known, err := mem.Space()
+	assert.NoError(err)
+	assert.True(known)
+	assert.Equal(StorageSpace{UsedBytes: 100, TotalBytes: 100}, space)
+
+	assert.NoError(s.DeleteVersion(1, 2))
+	assert.NoError(s.WriteVersion(1, 3, make([]byte, 60)))
+	s.UnstageData(40)
+	assert.Equal(MemoryStats{Buffers: 1, Committed: 60}, mem.StatsForTesting())
+
+	_, err = ConfigureMemoryStorageWithCap(-1)
+	assert.Error(err)
+}
+
+func TestMemoryStorageSnapshot(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	s, err := ConfigureMemoryStorageWithCap(1000)
+	require.NoError(t, err)
+	defer s.Close()
+	mem := s.(*MemoryStorage)
+	require.NoError(t, s.WriteVersion(1, 1, []byte("original")))
+	require.NoError(t, s.LinkVersion(1, 1, 2))
+	require.NoError(t, s.SetLatestVersion(1, 2))
+	require.NoError(t, mem.SetCommitHashes(1, 2, []apis.CommitHash{"abc"}))
+	require.NoError(t, mem.KeepTombstone(apis.Tombstone{Chunk: 2, Version: 5}))
+	require.NoError(t, s.StageData(10))
+
+	snapshot := mem.Snapshot(SnapshotOptions{})
+	withStaged := mem.Snapshot(SnapshotOptions{IncludeStaged: true})
+
+	// changing the storage afterwards doesn't change the snapshot
+	require.NoError(t, s.DeleteVersion(1, 1))
+	require.NoError(t, s.WriteVersion(3, 1, []byte("later")))
+	require.NoError(t, s.SetLatestVersion(1, 7))
+	require.NoError(t, mem.ForgetTombstone(2))
+
+	mem.Restore(withStaged)
+	assert.Equal(MemoryStats{Buffers: 1, Committed: 8, Staged: 10}, mem.StatsForTesting())
+	chunks, err := s.ListChunksWithData()
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkNum{1}, chunks)
+	latest, err := s.GetLatestVersion(1)
+	assert.NoError(err)
+	assert.Equal(apis.Version(2), latest)
+	hashes, err := mem.CommitHashes(1, 2)
+	assert.NoError(err)
+	assert.Equal([]apis.CommitHash{"abc"}, hashes)
+	tombstones, err := mem.ListTombstones()
+	assert.NoError(err)
+	assert.Len(tombstones, 1)
+	s.UnstageData(10)
+
+	// clones are independent of each other, and of the original
+	first, second := CloneStorage(snapshot), CloneStorage(snapshot)
+	defer first.Close()
+	defer second.Close()
+	assert.Equal(MemoryStats{Buffers: 1, Committed: 8}, first.StatsForTesting())
+	require.NoError(t, first.DeleteVersion(1, 1))
+	// versions that shared their data still do, so deleting just one of them frees nothing
+	assert.Equal(MemoryStats{Buffers: 1, Committed: 8}, first.StatsForTesting())
+	require.NoError(t, first.WriteVersion(4, 1, []byte("first")))
+	data, err := second.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.Equal("original", string(data))
+	_, err = second.ReadVersion(4, 1)
+	assert.Error(err)
+	data, err = s.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.Equal("original", string(data))
+
+	// and the capacity carries over
+	assert.Equal(apis.ErrOutOfSpace, apis.ErrorCodeOf(second.WriteVersion(5, 1, make([]byte, 993))))
+}
+
+func TestMemoryStorageUsage(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	s, err := ConfigureMemoryStorageWithCap(1000)
+	require.NoError(t, err)
+	defer s.Close()
+	mem := s.(*MemoryStorage)
+	assert.Equal(MemoryUsage{Versions: map[apis.ChunkVersion]int{}}, mem.Usage())
+
+	// a write is staged, committed into a new version, and made latest, as a chunkserver would do it
+	require.NoError(t, s.WriteVersion(1, 1, make([]byte, 100)))
+	require.NoError(t, s.SetLatestVersion(1, 1))
+	require.NoError(t, s.StageData(30))
+	require.NoError(t, s.WriteVersion(1, 2, make([]byte, 130)))
+	require.NoError(t, mem.SetCommitHashes(1, 2, []apis.CommitHash{"0123456789"}))
+	s.UnstageData(30)
+	require.NoError(t, s.SetLatestVersion(1, 2))
+	usage := mem.Usage()
+	assert.Equal(MemoryUsage{
+		Versions:  map[apis.ChunkVersion]int{{Chunk: 1, Version: 1}: 100, {Chunk: 1, Version: 2}: 130},
+		Buffers:   2,
+		Committed: 230,
+		// two versions stored, one latest version, and one set of commit hashes
+		Overhead: 2*16 + 16 + (16 + 10),
+	}, usage)
+	assert.Equal(230+74, usage.Total())
+	stats, err := s.Stats()
+	require.NoError(t, err)
+	assert.Equal(uint64(230), stats.CommittedBytes)
+	assert.Equal(uint64(74), stats.OverheadBytes)
+
+	// failures change nothing at all
+	assert.Error(s.WriteVersion(1, 2, make([]byte, 10)))
+	assert.Error(s.WriteVersion(2, 1, make([]byte, 800)))
+	assert.Error(s.DeleteVersion(2, 1))
+	assert.Error(s.DeleteLatestVersion(2))
+	assert.Equal(usage, mem.Usage())
+
+	// replacing the commit hashes and the latest version only counts what changed
+	require.NoError(t, mem.SetCommitHashes(1, 2, []apis.CommitHash{"01234", "56789"}))
+	require.NoError(t, s.SetLatestVersion(1, 1))
+	require.NoError(t, s.SetLatestVersion(1, 2))
+	assert.Equal(usage, mem.Usage())
+
+	// linked versions share their data, but each is its own version
+	require.NoError(t, s.LinkVersion(1, 2, 3))
+	usage = mem.Usage()
+	assert.Equal(130, usage.Versions[apis.ChunkVersion{Chunk: 1, Version: 3}])
+	assert.Equal(2, usage.Buffers)
+	assert.Equal(230, usage.Committed)
+	assert.Equal(74+16, usage.Overhead)
+
+	// deleting a version takes its commit hashes with it
+	require.NoError(t, s.DeleteVersion(1, 2))
+	require.NoError(t, s.DeleteVersion(1, 1))
+	usage = mem.Usage()
+	assert.Equal(map[apis.ChunkVersion]int{{Chunk: 1, Version: 3}: 130}, usage.Versions)
+	assert.Equal(130, usage.Committed)
+	assert.Equal(16+16, usage.Overhead)
+
+	// tombstones and quarantined versions are bookkeeping too, and quarantined data is counted apart
+	require.NoError(t, mem.KeepTombstone(apis.Tombstone{Chunk: 4, Version: 1}))
+	require.NoError(t, mem.KeepTombstone(apis.Tombstone{Chunk: 4, Version: 2}))
+	require.NoError(t, mem.QuarantineVersion(1, 3))
+	require.NoError(t, s.DeleteLatestVersion(1))
+	usage = mem.Usage()
+	assert.Equal(MemoryUsage{
+		Versions:    map[apis.ChunkVersion]int{},
+		Overhead:    24 + 24,
+		Quarantined: 130,
+	}, usage)
+	assert.Equal(MemoryStats{}, mem.StatsForTesting())
+
+	// and all of it survives a snapshot
+	clone := CloneStorage(mem.Snapshot(SnapshotOptions{}))
+	defer clone.Close()
+	assert.Equal(usage, clone.Usage())
+
+	require.NoError(t, mem.ForgetTombstone(4))
+	require.NoError(t, mem.ForgetTombstone(4))
+	removed, err := mem.PurgeQuarantine(time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(1, removed)
+	assert.Equal(MemoryUsage{Versions: map[apis.ChunkVersion]int{}}, mem.Usage())
+}
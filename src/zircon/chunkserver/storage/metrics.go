@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"sync/atomic"
+	"time"
+	"zircon/apis"
+)
+
+// Something that a storage backend counts as it works.
+type StorageCounter int
+
+const (
+	// Files opened, for reading or for writing
+	CounterFileOpens StorageCounter = iota
+	// Files and directories synced to disk, including the write-ahead log
+	CounterFsyncs
+	// Bytes read from and written to files, including headers
+	CounterBytesRead
+	CounterBytesWritten
+	// Versions written and deleted
+	CounterVersionsWritten
+	CounterVersionsDeleted
+	// Bytes given back by compaction
+	CounterCompactedBytes
+	// Reads served from memory the storage keeps for that purpose, such as mapped versions, and reads that had to go
+	// to the files instead
+	CounterCacheHits
+	CounterCacheMisses
+
+	storageCounterCount
+)
+
+var storageCounterNames = [storageCounterCount]string{
+	"file-opens", "fsyncs", "bytes-read", "bytes-written", "versions-written", "versions-deleted", "compacted-bytes",
+	"cache-hits", "cache-misses",
+}
+
+func (c StorageCounter) String() string {
+	return storageCounterNames[c]
+}
+
+// Something that a storage backend times as it works.
+type StorageLatency int
+
+const (
+	// Reading a version, from start to finish
+	LatencyRead StorageLatency = iota
+	// Writing a version, from start to finish, including any syncing
+	LatencyWrite
+	// A single sync of a file or directory
+	LatencyFsync
+	// Compacting a single chunk
+	LatencyCompaction
+
+	storageLatencyCount
+)
+
+var storageLatencyNames = [storageLatencyCount]string{"read", "write", "fsync", "compaction"}
+
+func (l StorageLatency) String() string {
+	return storageLatencyNames[l]
+}
+
+// Receives measurements from a storage backend. Backends call it from their hot paths, so implementations must be
+// threadsafe, and should be no more expensive than an atomic add; in particular, they mustn't allocate.
+type MetricsSink interface {
+	Add(counter StorageCounter, delta uint64)
+	Observe(latency StorageLatency, duration time.Duration)
+}
+
+// Sets the sink of any storage that reports measurements. Returns false if the storage doesn't.
+func SetMetricsSink(storage ChunkStorage, sink MetricsSink) bool {
+	if reporter, ok := storage.(MetricsReporter); ok {
+		return reporter.SetMetricsSink(sink)
+	}
+	return false
+}
+
+type noMetrics struct{}
+
+// A MetricsSink that discards everything, which every backend starts out with.
+var NoMetrics MetricsSink = noMetrics{}
+
+func (noMetrics) Add(counter StorageCounter, delta uint64) {}
+
+func (noMetrics) Observe(latency StorageLatency, duration time.Duration) {}
+
+// Meant to be deferred, as in defer observeSince(sink, LatencyRead, time.Now()), to time the rest of a function.
+func observeSince(sink MetricsSink, latency StorageLatency, start time.Time) {
+	sink.Observe(latency, time.Since(start))
+}
+
+func sinkOrDiscard(sink MetricsSink) MetricsSink {
+	if sink == nil {
+		return NoMetrics
+	}
+	return sink
+}
+
+// A MetricsSink that keeps running totals of everything it receives, using nothing but atomic operations, so that it's
+// cheap enough to leave enabled.
+type StorageMetrics struct {
+	counters  [storageCounterCount]uint64
+	latencies [storageLatencyCount]latencyTotals
+}
+
+type latencyTotals struct {
+	count     uint64
+	total     int64
+	histogram [apis.LatencyBucketCount]uint64
+}
+
+func (s *StorageMetrics) Add(counter StorageCounter, delta uint64) {
+	atomic.AddUint64(&s.counters[counter], delta)
+}
+
+func (s *StorageMetrics) Observe(latency StorageLatency, duration time.Duration) {
+	totals := &s.latencies[latency]
+	atomic.AddUint64(&totals.count, 1)
+	atomic.AddInt64(&totals.total, int64(duration))
+	atomic.AddUint64(&totals.histogram[apis.LatencyBucket(duration)], 1)
+}
+
+// The current value of a single counter.
+func (s *StorageMetrics) Counter(counter StorageCounter) uint64 {
+	return atomic.LoadUint64(&s.counters[counter])
+}
+
+// Every counter, keyed by name, and every latency, keyed by name, in the form that ChunkserverStats reports them.
+// Latencies are reported as OperationStats with only the call count, total latency, and histogram filled in.
+func (s *StorageMetrics) Snapshot() (map[string]uint64, map[string]apis.OperationStats) {
+	counters := map[string]uint64{}
+	for counter := StorageCounter(0); counter < storageCounterCount; counter++ {
+		counters[counter.String()] = s.Counter(counter)
+	}
+	latencies := map[string]apis.OperationStats{}
+	for latency := StorageLatency(0); latency < storageLatencyCount; latency++ {
+		totals := &s.latencies[latency]
+		stats := apis.OperationStats{
+			Calls:        atomic.LoadUint64(&totals.count),
+			TotalLatency: time.Duration(atomic.LoadInt64(&totals.total)),
+		}
+		for i := range totals.histogram {
+			stats.LatencyHistogram[i] = atomic.LoadUint64(&totals.histogram[i])
+		}
+		latencies[latency.String()] = stats
+	}
+	return counters, latencies
+}
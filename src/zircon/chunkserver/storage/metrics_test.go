@@ -0,0 +1,135 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+func TestMemoryStorageMetrics(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	s, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer s.Close()
+	metrics := &StorageMetrics{}
+	assert.True(SetMetricsSink(s, metrics))
+
+	require.NoError(t, s.WriteVersion(1, 1, []byte("hello")))
+	require.NoError(t, s.WriteVersion(1, 2, []byte("hello world")))
+	_, err = s.ReadVersion(1, 2)
+	require.NoError(t, err)
+	require.NoError(t, s.DeleteVersion(1, 1))
+
+	assert.Equal(uint64(2), metrics.Counter(CounterVersionsWritten))
+	assert.Equal(uint64(16), metrics.Counter(CounterBytesWritten))
+	assert.Equal(uint64(11), metrics.Counter(CounterBytesRead))
+	assert.Equal(uint64(1), metrics.Counter(CounterVersionsDeleted))
+	// nothing is ever opened or synced
+	assert.Equal(uint64(0), metrics.Counter(CounterFileOpens))
+	assert.Equal(uint64(0), metrics.Counter(CounterFsyncs))
+
+	counters, latencies := metrics.Snapshot()
+	assert.Equal(uint64(2), counters["versions-written"])
+	assert.Equal(uint64(2), latencies["write"].Calls)
+	assert.Equal(uint64(1), latencies["read"].Calls)
+	assert.Equal(uint64(0), latencies["fsync"].Calls)
+
+	// failed operations change nothing
+	_, err = s.ReadVersion(1, 7)
+	assert.Error(err)
+	assert.Error(s.DeleteVersion(1, 7))
+	assert.Equal(uint64(11), metrics.Counter(CounterBytesRead))
+	assert.Equal(uint64(1), metrics.Counter(CounterVersionsDeleted))
+
+	// and a nil sink stops the counting
+	assert.True(SetMetricsSink(s, nil))
+	require.NoError(t, s.WriteVersion(1, 3, []byte("more")))
+	assert.Equal(uint64(2), metrics.Counter(CounterVersionsWritten))
+}
+
+func TestFilesystemStorageMetrics(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "metrics-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := ConfigureFilesystemStorageWithOptions(dir, FilesystemOptions{
+		WriteAheadLog:      true,
+		Durability:         DurabilityCommit,
+		StagingLog:         true,
+		MappedReadCapacity: 1024 * 1024,
+	})
+	require.NoError(t, err)
+	defer s.Close()
+	metrics := &StorageMetrics{}
+	assert.True(SetMetricsSink(s, metrics))
+
+	require.NoError(t, s.WriteVersion(1, 1, []byte("hello world")))
+	assert.Equal(uint64(1), metrics.Counter(CounterVersionsWritten))
+	// the write-ahead log record and the version file itself
+	assert.True(metrics.Counter(CounterBytesWritten) > uint64(2*11))
+	assert.True(metrics.Counter(CounterFsyncs) >= 2)
+	assert.True(metrics.Counter(CounterFileOpens) >= 1)
+
+	data := []byte("staged")
+	require.NoError(t, s.(StagedWriteKeeper).KeepStaged(StagedWrite{Hash: apis.CalculateCommitHash(0, data), Offset: 0, Data: data}))
+
+	for i := 0; i < 2; i++ {
+		read, err := s.ReadVersion(1, 1)
+		require.NoError(t, err)
+		assert.Equal("hello world", string(read))
+	}
+	if mappingSupported {
+		// mapped the first time, and read from the mapping the second
+		assert.Equal(uint64(1), metrics.Counter(CounterCacheMisses))
+		assert.Equal(uint64(1), metrics.Counter(CounterCacheHits))
+	} else {
+		assert.Equal(uint64(2*(chunkFileHeaderSize+11)), metrics.Counter(CounterBytesRead))
+	}
+
+	require.NoError(t, s.WriteVersion(1, 2, []byte("goodbye")))
+	require.NoError(t, s.SetLatestVersion(1, 2))
+	result, err := s.(ChunkCompactor).CompactChunk(1, 2)
+	require.NoError(t, err)
+	assert.Equal(uint64(1), result.RemovedVersions)
+	assert.Equal(uint64(1), metrics.Counter(CounterVersionsDeleted))
+	assert.Equal(result.ReclaimedBytes, metrics.Counter(CounterCompactedBytes))
+
+	_, latencies := metrics.Snapshot()
+	assert.Equal(uint64(2), latencies["read"].Calls)
+	assert.Equal(uint64(2), latencies["write"].Calls)
+	assert.Equal(uint64(1), latencies["compaction"].Calls)
+	assert.Equal(metrics.Counter(CounterFsyncs), latencies["fsync"].Calls)
+}
+
+func TestMetricsSinkWrappers(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	s := WithFaults(mem)
+	defer s.Close()
+	metrics := &StorageMetrics{}
+	assert.True(SetMetricsSink(s, metrics))
+	require.NoError(t, s.WriteVersion(1, 1, []byte("hello")))
+	assert.Equal(uint64(1), metrics.Counter(CounterVersionsWritten))
+
+	assert.False(SetMetricsSink(struct{ ChunkStorage }{mem}, metrics))
+}
+
+func TestStorageMetricsAllocations(t *testing.T) {
+	metrics := &StorageMetrics{}
+	var sink MetricsSink = metrics
+	allocs := testing.AllocsPerRun(100, func() {
+		sink.Add(CounterBytesRead, 4096)
+		sink.Observe(LatencyRead, time.Millisecond)
+		observeSince(sink, LatencyFsync, time.Now())
+	})
+	testifyAssert.Equal(t, 0.0, allocs)
+	testifyAssert.Equal(t, uint64(101*4096), metrics.Counter(CounterBytesRead))
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"zircon/apis"
+)
+
+// Copies of versions read from an object store, kept in a local directory so that they can be read again without
+// waiting on the network. Each version is a file named <chunk>-<version>, holding the object exactly as it was read,
+// so that its checksum is checked again whenever it's read from the cache. Bounded in the total size of the files, with
+// the least recently read versions removed first.
+//
+// New files are written under a temporary name and renamed into place, so that a crash never leaves a partial copy
+// where it could be read. Everything is rediscovered when the cache is opened, in order of modification time, which is
+// when each copy was made; that's close enough to the order they were last read in.
+type objectCache struct {
+	dir      string
+	capacity int64
+	used     int64
+	entries  map[apis.ChunkVersion]*list.Element
+	// most recently read at the front
+	lru *list.List
+}
+
+type cachedObject struct {
+	key  apis.ChunkVersion
+	size int64
+}
+
+func openObjectCache(dir string, capacity int64) (*objectCache, error) {
+	if capacity <= 0 {
+		return nil, fmt.Errorf("invalid cache capacity: %d", capacity)
+	}
+	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
+		return nil, err
+	}
+	c := &objectCache{
+		dir:      dir,
+		capacity: capacity,
+		entries:  map[apis.ChunkVersion]*list.Element{},
+		lru:      list.New(),
+	}
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(fis, func(i, j int) bool {
+		return fis[i].ModTime().After(fis[j].ModTime())
+	})
+	for _, fi := range fis {
+		var chunk, version uint64
+		if _, err := fmt.Sscanf(fi.Name(), "%d-%d", &chunk, &version); err != nil || fi.Name() != cacheFilename(apis.ChunkNum(chunk), apis.Version(version)) {
+			// anything else is a temporary file left by a crash, or doesn't belong to us
+			if err := os.Remove(filepath.Join(dir, fi.Name())); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		key := apis.ChunkVersion{Chunk: apis.ChunkNum(chunk), Version: apis.Version(version)}
+		c.entries[key] = c.lru.PushBack(&cachedObject{key: key, size: fi.Size()})
+		c.used += fi.Size()
+	}
+	// in case the capacity shrank since the last time
+	if err := c.evict(0); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func cacheFilename(chunk apis.ChunkNum, version apis.Version) string {
+	return fmt.Sprintf("%d-%d", chunk, version)
+}
+
+func (c *objectCache) path(key apis.ChunkVersion) string {
+	return filepath.Join(c.dir, cacheFilename(key.Chunk, key.Version))
+}
+
+// Reads a cached copy into buf if it has enough capacity. ok is false if there's no copy, or it can't be read.
+func (c *objectCache) get(chunk apis.ChunkNum, version apis.Version, buf []byte) (encoded []byte, ok bool) {
+	key := apis.ChunkVersion{Chunk: chunk, Version: version}
+	element, found := c.entries[key]
+	if !found {
+		return nil, false
+	}
+	encoded, err := readFileInto(c.path(key), buf)
+	if err != nil {
+		_ = c.drop(chunk, version)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return encoded, true
+}
+
+// Keeps a copy of a version, removing the least recently read copies to make room. Versions too large to ever fit
+// aren't kept at all.
+func (c *objectCache) put(chunk apis.ChunkNum, version apis.Version, encoded []byte) error {
+	key := apis.ChunkVersion{Chunk: chunk, Version: version}
+	size := int64(len(encoded))
+	if size > c.capacity {
+		return errors.New("too large to cache")
+	}
+	if err := c.drop(chunk, version); err != nil {
+		return err
+	}
+	if err := c.evict(size); err != nil {
+		return err
+	}
+	temp := c.path(key) + ".tmp"
+	if err := ioutil.WriteFile(temp, encoded, os.FileMode(0644)); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	if err := os.Rename(temp, c.path(key)); err != nil {
+		_ = os.Remove(temp)
+		return err
+	}
+	c.entries[key] = c.lru.PushFront(&cachedObject{key: key, size: size})
+	c.used += size
+	return nil
+}
+
+// Removes a copy, if there is one. Fails if the file can't be removed, since it would be found again the next time the
+// cache is opened; the caller mustn't go on to change the version in the object store if that happens.
+func (c *objectCache) drop(chunk apis.ChunkNum, version apis.Version) error {
+	key := apis.ChunkVersion{Chunk: chunk, Version: version}
+	element, found := c.entries[key]
+	if !found {
+		return nil
+	}
+	return c.remove(element)
+}
+
+func (c *objectCache) remove(element *list.Element) error {
+	object := element.Value.(*cachedObject)
+	if err := os.Remove(c.path(object.key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	c.lru.Remove(element)
+	delete(c.entries, object.key)
+	c.used -= object.size
+	return nil
+}
+
+// Removes the least recently read copies until there's room for this many more bytes.
+func (c *objectCache) evict(room int64) error {
+	for c.used+room > c.capacity {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			return errors.New("cache accounting is inconsistent")
+		}
+		if err := c.remove(oldest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *objectCache) size() (entries int, bytes int64) {
+	return len(c.entries), c.used
+}
@@ -0,0 +1,266 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The kinds of request an ObjectClient makes, for injecting faults into a FakeObjectStore and counting requests.
+type ObjectOperation string
+
+const (
+	ObjectPut    ObjectOperation = "put"
+	ObjectGet    ObjectOperation = "get"
+	ObjectHead   ObjectOperation = "head"
+	ObjectCopy   ObjectOperation = "copy"
+	ObjectDelete ObjectOperation = "delete"
+	ObjectList   ObjectOperation = "list"
+)
+
+// An ObjectClient that keeps its buckets in memory, for testing ObjectStorage without a network. Like FaultyStorage, it
+// can be told to misbehave: requests can fail before they reach the store, or after they've taken effect but before the
+// response makes it back, which is the harder case for a client to get right. Threadsafe, so that faults can be
+// injected while the store is in use.
+type FakeObjectStore struct {
+	mu       sync.Mutex
+	buckets  map[string]map[string][]byte
+	pageSize int
+	failures map[ObjectOperation][]objectFault
+	requests map[ObjectOperation]int
+}
+
+type objectFault struct {
+	err error
+	// whether the request takes effect anyway
+	applied bool
+}
+
+var _ ObjectClient = &FakeObjectStore{}
+
+// Creates a fake object store with a set of empty buckets. Requests to any other bucket fail.
+func NewFakeObjectStore(buckets ...string) *FakeObjectStore {
+	f := &FakeObjectStore{
+		buckets:  map[string]map[string][]byte{},
+		pageSize: 1000,
+		failures: map[ObjectOperation][]objectFault{},
+		requests: map[ObjectOperation]int{},
+	}
+	for _, bucket := range buckets {
+		f.buckets[bucket] = map[string][]byte{}
+	}
+	return f
+}
+
+// Limit how many keys and common prefixes a single listing returns, so that continuations get exercised. The default is
+// 1000, the same as S3.
+func (f *FakeObjectStore) SetListPageSize(size int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if size < 1 {
+		panic("listings must return at least one result per page")
+	}
+	f.pageSize = size
+}
+
+// Cause the next request of a kind to fail with err, without taking effect. Calling this more than once queues up
+// failures for the requests after that.
+func (f *FakeObjectStore) FailNext(op ObjectOperation, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = append(f.failures[op], objectFault{err: err})
+}
+
+// Cause the next request of a kind to take effect, but then fail with err, as if the response had been lost.
+func (f *FakeObjectStore) LoseNextResponse(op ObjectOperation, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = append(f.failures[op], objectFault{err: err, applied: true})
+}
+
+// How many requests of a kind have been made, including ones that failed.
+func (f *FakeObjectStore) Requests(op ObjectOperation) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[op]
+}
+
+// Lists every key in a bucket, in order, for tests that want to look at what was stored.
+func (f *FakeObjectStore) Keys(bucket string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.buckets[bucket] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Replaces an object's contents behind the client's back, as if it were damaged in storage.
+func (f *FakeObjectStore) Tamper(bucket string, key string, modify func(data []byte) []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, found := f.buckets[bucket][key]
+	if !found {
+		return ErrNoSuchObject
+	}
+	f.buckets[bucket][key] = modify(append([]byte(nil), data...))
+	return nil
+}
+
+// Counts the request, and runs it unless a fault says otherwise. Must be called with the lock held.
+func (f *FakeObjectStore) request(op ObjectOperation, bucket string, apply func(objects map[string][]byte) error) error {
+	f.requests[op] += 1
+	var fault *objectFault
+	if queued := f.failures[op]; len(queued) > 0 {
+		fault = &queued[0]
+		f.failures[op] = queued[1:]
+	}
+	if fault != nil && !fault.applied {
+		return fmt.Errorf("injected fault: %v", fault.err)
+	}
+	objects, found := f.buckets[bucket]
+	if !found {
+		return fmt.Errorf("no such bucket: %s", bucket)
+	}
+	if err := apply(objects); err != nil {
+		return err
+	}
+	if fault != nil {
+		return fmt.Errorf("injected fault after applying: %v", fault.err)
+	}
+	return nil
+}
+
+func (f *FakeObjectStore) PutObject(bucket string, key string, data []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.request(ObjectPut, bucket, func(objects map[string][]byte) error {
+		objects[key] = append([]byte(nil), data...)
+		return nil
+	})
+}
+
+func (f *FakeObjectStore) GetObjectRange(bucket string, key string, offset int64, length int64) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var result []byte
+	err := f.request(ObjectGet, bucket, func(objects map[string][]byte) error {
+		data, found := objects[key]
+		if !found {
+			return ErrNoSuchObject
+		}
+		if offset < 0 || length <= 0 || offset > int64(len(data)) {
+			return errors.New("invalid range")
+		}
+		end := offset + length
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		result = append([]byte(nil), data[offset:end]...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (f *FakeObjectStore) HeadObject(bucket string, key string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var size int64
+	err := f.request(ObjectHead, bucket, func(objects map[string][]byte) error {
+		data, found := objects[key]
+		if !found {
+			return ErrNoSuchObject
+		}
+		size = int64(len(data))
+		return nil
+	})
+	return size, err
+}
+
+func (f *FakeObjectStore) CopyObject(bucket string, source string, destination string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.request(ObjectCopy, bucket, func(objects map[string][]byte) error {
+		data, found := objects[source]
+		if !found {
+			return ErrNoSuchObject
+		}
+		objects[destination] = append([]byte(nil), data...)
+		return nil
+	})
+}
+
+func (f *FakeObjectStore) DeleteObject(bucket string, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.request(ObjectDelete, bucket, func(objects map[string][]byte) error {
+		delete(objects, key)
+		return nil
+	})
+}
+
+// The continuation token is simply the last key or common prefix returned, which the next page starts after.
+func (f *FakeObjectStore) ListObjects(bucket string, prefix string, delimiter string, continuation string) (ObjectListing, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var listing ObjectListing
+	err := f.request(ObjectList, bucket, func(objects map[string][]byte) error {
+		var keys []string
+		for key := range objects {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		count := 0
+		for _, key := range keys {
+			entry, isPrefix := key, false
+			if delimiter != "" {
+				if index := strings.Index(key[len(prefix):], delimiter); index >= 0 {
+					entry, isPrefix = key[:len(prefix)+index+len(delimiter)], true
+				}
+			}
+			// every key under a common prefix sorts right after it, so comparing against the token skips both
+			if continuation != "" && entry <= continuation {
+				continue
+			}
+			if n := len(listing.CommonPrefixes); isPrefix && n > 0 && listing.CommonPrefixes[n-1] == entry {
+				continue
+			}
+			if count == f.pageSize {
+				listing.NextContinuation = listing.lastEntry()
+				return nil
+			}
+			if isPrefix {
+				listing.CommonPrefixes = append(listing.CommonPrefixes, entry)
+			} else {
+				listing.Objects = append(listing.Objects, ObjectInfo{Key: key, Size: int64(len(objects[key]))})
+			}
+			count += 1
+		}
+		return nil
+	})
+	if err != nil {
+		return ObjectListing{}, err
+	}
+	return listing, nil
+}
+
+// The greater of the last key and the last common prefix in a listing.
+func (l ObjectListing) lastEntry() string {
+	last := ""
+	if n := len(l.Objects); n > 0 {
+		last = l.Objects[n-1].Key
+	}
+	if n := len(l.CommonPrefixes); n > 0 && l.CommonPrefixes[n-1] > last {
+		last = l.CommonPrefixes[n-1]
+	}
+	return last
+}
@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"zircon/apis"
+)
+
+func openTestObjectStorage(t *testing.T, fake *FakeObjectStore, options ObjectStorageOptions) *ObjectStorage {
+	options.Bucket = "zircon"
+	s, err := ConfigureObjectStorage(fake, options)
+	require.NoError(t, err)
+	o := s.(*ObjectStorage)
+	// no point in actually waiting between retries against a fake
+	o.retryDelay = 0
+	return o
+}
+
+func TestObjectStorageLayout(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	fake := NewFakeObjectStore("zircon")
+	fake.SetListPageSize(2)
+	s := openTestObjectStorage(t, fake, ObjectStorageOptions{Prefix: "cold/"})
+	defer s.Close()
+
+	for chunk := apis.ChunkNum(1); chunk <= 5; chunk++ {
+		for version := apis.Version(1); version <= 3; version++ {
+			assert.NoError(s.WriteVersion(chunk, version, []byte("data")))
+		}
+		assert.NoError(s.SetLatestVersion(chunk, 3))
+	}
+	assert.NoError(s.LinkVersion(5, 3, 300))
+	assert.Contains(fake.Keys("zircon"), "cold/chunks/0000000000000005/000000000000012c")
+	assert.Contains(fake.Keys("zircon"), "cold/latest/0000000000000005")
+
+	// listings that need several pages are followed to the end
+	chunks, err := s.ListChunksWithData()
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkNum{1, 2, 3, 4, 5}, chunks)
+	versions, err := s.ListVersions(5)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1, 2, 3, 300}, versions)
+	chunks, err = s.ListChunksWithLatest()
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkNum{1, 2, 3, 4, 5}, chunks)
+
+	stats, err := s.Stats()
+	assert.NoError(err)
+	assert.Equal(uint64(5), stats.Chunks)
+	assert.Equal(uint64(16), stats.Versions)
+	assert.Equal(uint64(16*(chunkFileHeaderSize+4)), stats.CommittedBytes)
+
+	// a second storage with a different prefix doesn't see any of this
+	other := openTestObjectStorage(t, fake, ObjectStorageOptions{Prefix: "hot/"})
+	defer other.Close()
+	chunks, err = other.ListChunksWithData()
+	assert.NoError(err)
+	assert.Empty(chunks)
+}
+
+func TestObjectStorageRangedReads(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	fake := NewFakeObjectStore("zircon")
+	s := openTestObjectStorage(t, fake, ObjectStorageOptions{ReadPartSize: 1000})
+	defer s.Close()
+
+	data := bytes.Repeat([]byte("0123456789"), 450)
+	require.NoError(t, s.WriteVersion(1, 1, data))
+	before := fake.Requests(ObjectGet)
+	read, err := s.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.Equal(data, read)
+	// 4512 bytes, headers included, in parts of 1000
+	assert.Equal(5, fake.Requests(ObjectGet)-before)
+
+	// a part that fails is retried on its own
+	fake.FailNext(ObjectGet, errors.New("connection reset"))
+	before = fake.Requests(ObjectGet)
+	read, err = s.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.Equal(data, read)
+	assert.Equal(6, fake.Requests(ObjectGet)-before)
+
+	// the checksum catches damage, however the parts were put together
+	require.NoError(t, fake.Tamper("zircon", s.versionKey(1, 1), func(data []byte) []byte {
+		data[2000] ^= 1
+		return data
+	}))
+	_, err = s.ReadVersion(1, 1)
+	assert.Error(err)
+	// as does the header, if the object's length doesn't match
+	require.NoError(t, fake.Tamper("zircon", s.versionKey(1, 1), func(data []byte) []byte {
+		return data[:3000]
+	}))
+	_, err = s.ReadVersion(1, 1)
+	assert.Error(err)
+}
+
+func TestObjectStorageFailures(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	fake := NewFakeObjectStore("zircon")
+	s := openTestObjectStorage(t, fake, ObjectStorageOptions{Retries: 2})
+	defer s.Close()
+
+	// transient failures are retried, including ones that happened after the request took effect
+	fake.FailNext(ObjectHead, errors.New("timeout"))
+	fake.FailNext(ObjectPut, errors.New("503 slow down"))
+	fake.LoseNextResponse(ObjectPut, errors.New("connection reset"))
+	assert.NoError(s.WriteVersion(1, 1, []byte("first")))
+	fake.LoseNextResponse(ObjectCopy, errors.New("connection reset"))
+	assert.NoError(s.LinkVersion(1, 1, 2))
+	fake.LoseNextResponse(ObjectDelete, errors.New("connection reset"))
+	assert.NoError(s.DeleteVersion(1, 2))
+	fake.FailNext(ObjectList, errors.New("timeout"))
+	versions, err := s.ListVersions(1)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1}, versions)
+
+	// but a request that keeps failing is given up on, and a write that never made it leaves nothing behind
+	for i := 0; i < 3; i++ {
+		fake.FailNext(ObjectPut, errors.New("bucket on fire"))
+	}
+	err = s.WriteVersion(1, 3, []byte("second"))
+	assert.Error(err)
+	assert.Contains(err.Error(), "bucket on fire")
+	versions, err = s.ListVersions(1)
+	assert.NoError(err)
+	assert.Equal([]apis.Version{1}, versions)
+	assert.NoError(s.WriteVersion(1, 3, []byte("second")))
+
+	for i := 0; i < 3; i++ {
+		fake.FailNext(ObjectPut, errors.New("bucket on fire"))
+	}
+	assert.Error(s.SetLatestVersion(1, 3))
+	_, err = s.GetLatestVersion(1)
+	assert.Error(err)
+
+	// a missing object isn't retried, since asking again won't make it appear
+	before := fake.Requests(ObjectGet)
+	_, err = s.ReadVersion(1, 7)
+	assert.Error(err)
+	assert.Equal(1, fake.Requests(ObjectGet)-before)
+	assert.Error(s.DeleteVersion(1, 7))
+	assert.Error(s.LinkVersion(1, 7, 8))
+	assert.Error(s.WriteVersion(1, 1, []byte("again")))
+
+	read, err := s.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.Equal("first", string(read))
+}
+
+func TestObjectStorageCache(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "objectstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fake := NewFakeObjectStore("zircon")
+	options := ObjectStorageOptions{CacheDir: path.Join(dir, "cache"), CacheCapacity: 2 * (chunkFileHeaderSize + 100)}
+	s := openTestObjectStorage(t, fake, options)
+
+	for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+		require.NoError(t, s.WriteVersion(chunk, 1, bytes.Repeat([]byte{byte(chunk)}, 100)))
+	}
+	read := func(chunk apis.ChunkNum) (gets int) {
+		before := fake.Requests(ObjectGet)
+		data, err := s.ReadVersion(chunk, 1)
+		assert.NoError(err)
+		assert.Equal(bytes.Repeat([]byte{byte(chunk)}, 100), data)
+		return fake.Requests(ObjectGet) - before
+	}
+	assert.Equal(1, read(1))
+	assert.Equal(0, read(1))
+	assert.Equal(1, read(2))
+	// once chunk 1 has been read again, chunk 2 is the one pushed out to make room for chunk 3
+	assert.Equal(0, read(1))
+	assert.Equal(1, read(3))
+	assert.Equal(1, read(2))
+	entries, used := s.cache.size()
+	assert.Equal(2, entries)
+	assert.Equal(options.CacheCapacity, used)
+
+	// a stale copy is never read after the version changes
+	require.NoError(t, s.DeleteVersion(2, 1))
+	require.NoError(t, s.WriteVersion(2, 1, bytes.Repeat([]byte{9}, 100)))
+	data, err := s.ReadVersion(2, 1)
+	assert.NoError(err)
+	assert.Equal(bytes.Repeat([]byte{9}, 100), data)
+
+	// and a damaged copy is fetched again
+	require.NoError(t, ioutil.WriteFile(path.Join(options.CacheDir, "2-1"), []byte("garbage that's long enough"), 0644))
+	data, err = s.ReadVersion(2, 1)
+	assert.NoError(err)
+	assert.Equal(bytes.Repeat([]byte{9}, 100), data)
+
+	// the cache outlives the storage, and temporary files left by a crash are cleaned up
+	s.Close()
+	require.NoError(t, ioutil.WriteFile(path.Join(options.CacheDir, "3-1.tmp"), []byte("partial"), 0644))
+	s = openTestObjectStorage(t, fake, options)
+	defer s.Close()
+	entries, _ = s.cache.size()
+	assert.Equal(2, entries)
+	assert.Equal(0, read(3))
+	_, err = os.Stat(path.Join(options.CacheDir, "3-1.tmp"))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestObjectStorageStagedWrites(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "objectstore-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fake := NewFakeObjectStore("zircon")
+	options := ObjectStorageOptions{StagingDir: path.Join(dir, "staged")}
+	s := openTestObjectStorage(t, fake, options)
+	assert.Equal(DurabilityStageAndCommit, DurabilityOf(s))
+
+	data := []byte("staged but not yet committed")
+	write := StagedWrite{Hash: apis.CalculateCommitHash(16, data), Offset: 16, Data: data}
+	require.NoError(t, s.KeepStaged(write))
+	// kept locally, and nothing is uploaded until the write is committed
+	assert.Empty(fake.Keys("zircon"))
+	s.Close()
+
+	s = openTestObjectStorage(t, fake, options)
+	defer s.Close()
+	staged, err := s.ListStaged()
+	assert.NoError(err)
+	assert.Equal([]StagedWrite{write}, staged)
+	assert.NoError(s.WriteVersion(1, 1, append(make([]byte, 16), data...)))
+	assert.NoError(s.ForgetStaged(write.Hash))
+	staged, err = s.ListStaged()
+	assert.NoError(err)
+	assert.Empty(staged)
+
+	assert.Equal(DurabilityCommit, DurabilityOf(openTestObjectStorage(t, fake, ObjectStorageOptions{})))
+}
@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Opens a storage backend from a set of named settings, whose meanings are up to the backend.
+type BackendFactory func(config map[string]string) (ChunkStorage, error)
+
+var backendsMu sync.Mutex
+var backends = map[string]BackendFactory{}
+
+// Makes a storage backend available to ConfigureStorage under a name, so that backends defined outside this package can
+// be chosen by configuration. Meant to be called from an init function; panics if the name is already taken, as that
+// can only be a programming error.
+func RegisterBackend(name string, factory func(config map[string]string) (ChunkStorage, error)) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	if name == "" || factory == nil {
+		panic("storage backends need a name and a factory")
+	}
+	if _, found := backends[name]; found {
+		panic(fmt.Sprintf("storage backend registered twice: %s", name))
+	}
+	backends[name] = factory
+}
+
+// Lists the names of every registered storage backend, in order.
+func Backends() []string {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Opens the storage backend registered under a name. A nil config is treated the same as an empty one.
+func ConfigureStorage(name string, config map[string]string) (ChunkStorage, error) {
+	backendsMu.Lock()
+	factory, found := backends[name]
+	backendsMu.Unlock()
+	if !found {
+		return nil, fmt.Errorf("no such storage backend: %q (known backends: %s)", name, strings.Join(Backends(), ", "))
+	}
+	if config == nil {
+		config = map[string]string{}
+	}
+	store, err := factory(config)
+	if err != nil {
+		return nil, fmt.Errorf("[registry.go/CFG] %s storage: %v", name, err)
+	}
+	return store, nil
+}
+
+// Reads settings out of a backend's config, and notices any that nothing read, since those are most likely typos.
+type backendConfig struct {
+	config map[string]string
+	used   map[string]bool
+	err    error
+}
+
+func (b *backendConfig) get(key string) string {
+	if b.used == nil {
+		b.used = map[string]bool{}
+	}
+	b.used[key] = true
+	return b.config[key]
+}
+
+func (b *backendConfig) getBool(key string) bool {
+	value := b.get(key)
+	if value == "" {
+		return false
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil && b.err == nil {
+		b.err = fmt.Errorf("bad value for %s: %q", key, value)
+	}
+	return parsed
+}
+
+func (b *backendConfig) getInt(key string) int {
+	value := b.get(key)
+	if value == "" {
+		return 0
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil && b.err == nil {
+		b.err = fmt.Errorf("bad value for %s: %q", key, value)
+	}
+	return parsed
+}
+
+func (b *backendConfig) getDuration(key string) time.Duration {
+	value := b.get(key)
+	if value == "" {
+		return 0
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil && b.err == nil {
+		b.err = fmt.Errorf("bad value for %s: %q", key, value)
+	}
+	return parsed
+}
+
+// The first problem found with the config, if any.
+func (b *backendConfig) check() error {
+	if b.err != nil {
+		return b.err
+	}
+	var unknown []string
+	for key := range b.config {
+		if !b.used[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown settings: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// Settings: "capacity", as for ConfigureMemoryStorageWithCap.
+func configureMemoryBackend(config map[string]string) (ChunkStorage, error) {
+	settings := &backendConfig{config: config}
+	capacity := settings.getInt("capacity")
+	if err := settings.check(); err != nil {
+		return nil, err
+	}
+	return ConfigureMemoryStorageWithCap(capacity)
+}
+
+// Settings: "path", which is required, plus "log", "durability", "staging-log", "mapped-read-capacity", and
+// "integrity-check", which correspond to the fields of FilesystemOptions, and "stage-buffer-bytes" and
+// "stage-buffer-interval", which correspond to the fields of StageBufferOptions.
+func configureFilesystemBackend(config map[string]string) (ChunkStorage, error) {
+	settings := &backendConfig{config: config}
+	path := settings.get("path")
+	options := FilesystemOptions{
+		WriteAheadLog:      settings.getBool("log"),
+		StagingLog:         settings.getBool("staging-log"),
+		MappedReadCapacity: settings.getInt("mapped-read-capacity"),
+		StageBuffer: StageBufferOptions{
+			MaxBytes:      settings.getInt("stage-buffer-bytes"),
+			FlushInterval: settings.getDuration("stage-buffer-interval"),
+		},
+	}
+	durability, err := ParseDurability(settings.get("durability"))
+	if err != nil {
+		return nil, err
+	}
+	integrity, err := ParseIntegrityCheck(settings.get("integrity-check"))
+	if err != nil {
+		return nil, err
+	}
+	options.Durability, options.Integrity = durability, integrity
+	if err := settings.check(); err != nil {
+		return nil, err
+	}
+	if path == "" {
+		return nil, fmt.Errorf("no path specified")
+	}
+	return ConfigureFilesystemStorageWithOptions(path, options)
+}
+
+// Settings: "path", the block device to use.
+func configureBlockBackend(config map[string]string) (ChunkStorage, error) {
+	settings := &backendConfig{config: config}
+	path := settings.get("path")
+	if err := settings.check(); err != nil {
+		return nil, err
+	}
+	return ConfigureBlockStorage(path)
+}
+
+// Makes a storage backend out of an object store client, to be registered by whatever sets up the client, since this
+// package doesn't include one. Settings: "bucket", which is required, plus "prefix", "read-part-size", "retries",
+// "cache-dir", "cache-capacity", and "staging-dir", which correspond to the fields of ObjectStorageOptions.
+func ObjectBackend(client ObjectClient) BackendFactory {
+	return func(config map[string]string) (ChunkStorage, error) {
+		settings := &backendConfig{config: config}
+		options := ObjectStorageOptions{
+			Bucket:        settings.get("bucket"),
+			Prefix:        settings.get("prefix"),
+			ReadPartSize:  settings.getInt("read-part-size"),
+			Retries:       settings.getInt("retries"),
+			CacheDir:      settings.get("cache-dir"),
+			CacheCapacity: int64(settings.getInt("cache-capacity")),
+			StagingDir:    settings.get("staging-dir"),
+		}
+		if err := settings.check(); err != nil {
+			return nil, err
+		}
+		return ConfigureObjectStorage(client, options)
+	}
+}
+
+func init() {
+	RegisterBackend("memory", configureMemoryBackend)
+	RegisterBackend("filesystem", configureFilesystemBackend)
+	RegisterBackend("block", configureBlockBackend)
+}
@@ -0,0 +1,48 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestConfigureStorage(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	assert.Equal([]string{"block", "filesystem", "memory"}, Backends())
+
+	mem, err := ConfigureStorage("memory", map[string]string{"capacity": "1024"})
+	require.NoError(t, err)
+	assert.Equal(1024, mem.(*MemoryStorage).capacity)
+	mem.Close()
+	mem, err = ConfigureStorage("memory", nil)
+	require.NoError(t, err)
+	mem.Close()
+
+	dir, err := ioutil.TempDir("", "registry-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fs, err := ConfigureStorage("filesystem", map[string]string{"path": dir, "durability": "commit", "log": "true"})
+	require.NoError(t, err)
+	assert.Equal(DurabilityCommit, DurabilityOf(fs))
+	assert.NotNil(fs.(*FilesystemStorage).log)
+	fs.Close()
+
+	for name, config := range map[string]map[string]string{
+		"nonexistent": nil,
+		"memory":      {"capacity": "lots"},
+		"filesystem":  {"path": dir, "durabilty": "commit"},
+		"block":       {"path": "/dev/null"},
+	} {
+		_, err := ConfigureStorage(name, config)
+		assert.Error(err, name)
+	}
+	_, err = ConfigureStorage("filesystem", nil)
+	assert.Error(err)
+
+	assert.Panics(func() {
+		RegisterBackend("memory", configureMemoryBackend)
+	})
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package storage
+
+import "syscall"
+
+func filesystemSpace(path string) (StorageSpace, bool, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return StorageSpace{}, false, err
+	}
+	// blocks reserved for the superuser aren't available to us, so they count as used
+	return StorageSpace{
+		UsedBytes:  (stat.Blocks - stat.Bavail) * uint64(stat.Bsize),
+		TotalBytes: stat.Blocks * uint64(stat.Bsize),
+	}, true, nil
+}
@@ -0,0 +1,26 @@
+//go:build windows
+// +build windows
+
+package storage
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+func filesystemSpace(path string) (StorageSpace, bool, error) {
+	name, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return StorageSpace{}, false, err
+	}
+	// space held back by quotas isn't available to us, so it counts as used, just like reserved blocks elsewhere
+	var available, total, free uint64
+	ok, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(name)), uintptr(unsafe.Pointer(&available)),
+		uintptr(unsafe.Pointer(&total)), uintptr(unsafe.Pointer(&free)))
+	if ok == 0 {
+		return StorageSpace{}, false, err
+	}
+	return StorageSpace{UsedBytes: total - available, TotalBytes: total}, true, nil
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"time"
+	"zircon/apis"
+)
+
+// Staged writes are often only a few bytes apiece, as when a metadata block is updated in place, and keeping each of
+// them as it arrives costs at least one sync apiece. With a stage buffer, FilesystemStorage holds newly staged writes in
+// memory instead, and writes them out together, with as few syncs as it can, once they add up to MaxBytes, once the
+// oldest of them has waited for FlushInterval, or once a write is committed. A write that's committed while it's still
+// buffered is never written out at all. Flush and Close write out whatever is buffered too.
+//
+// Whether a staged write can be acknowledged before it's written out depends on the durability level. At
+// DurabilityStageAndCommit, a staged write must be durable before KeepStaged returns, so every KeepStaged writes out the
+// buffer, and buffering gains nothing; a write that can't be written out is taken out of the buffer again, since
+// KeepStaged reports that it failed. Below that, a write is acknowledged as soon as it's buffered, and a crash loses
+// every write that hadn't been written out yet, even if the write-ahead log is enabled: the log only covers changes to
+// committed versions, which the buffer never holds, and replaying it never brings back a staged write. Since the
+// writes that were lost were never committed, the chunkserver simply doesn't know about them after the restart, and
+// their clients have to start them again, as they would if the storage didn't keep staged writes at all.
+//
+// Buffering only applies where staged writes would be kept otherwise: with StagingLog, or at DurabilityStageAndCommit.
+type StageBufferOptions struct {
+	// Write out the buffer once the data it holds adds up to at least this many bytes. Zero disables buffering.
+	MaxBytes int
+	// Write out the buffer once its oldest write has been waiting this long, however little it holds. Zero leaves it
+	// until the buffer is full or a write is committed. If writing out the buffer fails from here, the writes stay
+	// buffered, and are tried again the next time it's written out; Flush reports the failure.
+	FlushInterval time.Duration
+}
+
+type stageBuffer struct {
+	options StageBufferOptions
+	// in the order they were kept
+	writes []StagedWrite
+	bytes  int
+	// running while anything is buffered, if FlushInterval is set
+	timer *time.Timer
+}
+
+func newStageBuffer(options StageBufferOptions) *stageBuffer {
+	if options.MaxBytes <= 0 {
+		return nil
+	}
+	return &stageBuffer{options: options}
+}
+
+func (b *stageBuffer) add(write StagedWrite) {
+	// the caller may reuse the data once KeepStaged returns, and it's held on to for longer than that here
+	write.Data = append([]byte(nil), write.Data...)
+	b.writes = append(b.writes, write)
+	b.bytes += len(write.Data)
+}
+
+func (b *stageBuffer) full() bool {
+	return b.bytes >= b.options.MaxBytes
+}
+
+// Takes a write out of the buffer. Returns false if it wasn't there.
+func (b *stageBuffer) remove(hash apis.CommitHash) bool {
+	for i, write := range b.writes {
+		if write.Hash == hash {
+			b.writes = append(b.writes[:i], b.writes[i+1:]...)
+			b.bytes -= len(write.Data)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *stageBuffer) clear() {
+	b.writes, b.bytes = nil, 0
+}
+
+// Arranges for flush to be called once FlushInterval has passed, unless it's already arranged, or there's no interval.
+func (b *stageBuffer) startTimer(flush func()) {
+	if b.options.FlushInterval > 0 && b.timer == nil {
+		b.timer = time.AfterFunc(b.options.FlushInterval, flush)
+	}
+}
+
+func (b *stageBuffer) stopTimer() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
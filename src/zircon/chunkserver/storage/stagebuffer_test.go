@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+func openStageBufferTest(t testing.TB, dir string, durability Durability, options StageBufferOptions) (*FilesystemStorage, *StorageMetrics) {
+	s, err := ConfigureFilesystemStorageWithOptions(dir, FilesystemOptions{
+		Durability:  durability,
+		StagingLog:  true,
+		StageBuffer: options,
+	})
+	require.NoError(t, err)
+	metrics := &StorageMetrics{}
+	SetMetricsSink(s, metrics)
+	return s.(*FilesystemStorage), metrics
+}
+
+func tinyStagedWrite(i int) StagedWrite {
+	data := []byte(fmt.Sprintf("%04d", i))
+	return StagedWrite{Hash: apis.CalculateCommitHash(uint32(i), data), Offset: uint32(i), Data: data}
+}
+
+func listStagedHashes(t *testing.T, s ChunkStorage) map[apis.CommitHash]bool {
+	staged, err := s.(StagedWriteKeeper).ListStaged()
+	require.NoError(t, err)
+	hashes := map[apis.CommitHash]bool{}
+	for _, write := range staged {
+		hashes[write.Hash] = true
+	}
+	return hashes
+}
+
+func TestStageBuffer(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "stagebuffer-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, metrics := openStageBufferTest(t, dir, DurabilityCommit, StageBufferOptions{MaxBytes: 16})
+
+	// buffered, and listed, without going anywhere near the disk
+	for i := 0; i < 3; i++ {
+		assert.NoError(s.KeepStaged(tinyStagedWrite(i)))
+	}
+	assert.Equal(uint64(0), metrics.Counter(CounterFsyncs))
+	assert.Len(listStagedHashes(t, s), 3)
+
+	// a write committed while it's buffered never reaches the disk, but the rest of the buffer goes out with the commit
+	assert.NoError(s.ForgetStaged(tinyStagedWrite(1).Hash))
+	assert.Equal(uint64(1), metrics.Counter(CounterFsyncs))
+	hashes := listStagedHashes(t, s)
+	assert.Len(hashes, 2)
+	assert.False(hashes[tinyStagedWrite(1).Hash])
+
+	// filling the buffer writes out all of it, with a single sync
+	for i := 3; i < 7; i++ {
+		assert.NoError(s.KeepStaged(tinyStagedWrite(i)))
+	}
+	assert.Equal(uint64(2), metrics.Counter(CounterFsyncs))
+	assert.Empty(s.stageBuffer.writes)
+
+	// anything still buffered at a crash is lost; what was written out survives
+	assert.NoError(s.KeepStaged(tinyStagedWrite(7)))
+	reopened, _ := openStageBufferTest(t, dir, DurabilityCommit, StageBufferOptions{MaxBytes: 16})
+	hashes = listStagedHashes(t, reopened)
+	assert.Len(hashes, 6)
+	assert.True(hashes[tinyStagedWrite(6).Hash])
+	assert.False(hashes[tinyStagedWrite(7).Hash])
+	reopened.Close()
+
+	// but a clean close writes it out first
+	s.Close()
+	reopened, _ = openStageBufferTest(t, dir, DurabilityCommit, StageBufferOptions{MaxBytes: 16})
+	defer reopened.Close()
+	assert.True(listStagedHashes(t, reopened)[tinyStagedWrite(7).Hash])
+}
+
+func TestStageBufferInterval(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "stagebuffer-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, metrics := openStageBufferTest(t, dir, DurabilityCommit, StageBufferOptions{
+		MaxBytes:      1024 * 1024,
+		FlushInterval: 10 * time.Millisecond,
+	})
+	defer s.Close()
+
+	assert.NoError(s.KeepStaged(tinyStagedWrite(1)))
+	deadline := time.Now().Add(5 * time.Second)
+	for metrics.Counter(CounterFsyncs) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(uint64(1), metrics.Counter(CounterFsyncs))
+
+	// the timer only runs while something is buffered
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(uint64(1), metrics.Counter(CounterFsyncs))
+	reopened, _ := openStageBufferTest(t, dir, DurabilityCommit, StageBufferOptions{})
+	defer reopened.Close()
+	assert.True(listStagedHashes(t, reopened)[tinyStagedWrite(1).Hash])
+}
+
+func TestStageBufferWritesThroughWhenDurable(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "stagebuffer-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, _ := openStageBufferTest(t, dir, DurabilityStageAndCommit, StageBufferOptions{MaxBytes: 1024 * 1024})
+	defer s.Close()
+
+	// acknowledged, so it must survive a crash straight afterwards
+	assert.NoError(s.KeepStaged(tinyStagedWrite(1)))
+	assert.Empty(s.stageBuffer.writes)
+	reopened, _ := openStageBufferTest(t, dir, DurabilityStageAndCommit, StageBufferOptions{})
+	defer reopened.Close()
+	assert.True(listStagedHashes(t, reopened)[tinyStagedWrite(1).Hash])
+}
+
+func TestStageBufferDropsFailedDurableWrite(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "stagebuffer-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, _ := openStageBufferTest(t, dir, DurabilityStageAndCommit, StageBufferOptions{MaxBytes: 1024 * 1024})
+	defer s.Close()
+
+	// the write fails, so it mustn't linger in the buffer to be kept later, or listed as if it had been kept
+	require.NoError(t, s.stagingLog.close())
+	assert.Error(s.KeepStaged(tinyStagedWrite(1)))
+	assert.Empty(s.stageBuffer.writes)
+	assert.Empty(listStagedHashes(t, s))
+}
+
+// Keeps a tiny staged write over and over, as StartWrite does for every write to a metadata block.
+func benchmarkKeepStaged(b *testing.B, options StageBufferOptions) {
+	dir, err := ioutil.TempDir("", "stagebuffer-bench-")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+	s, _ := openStageBufferTest(b, dir, DurabilityCommit, options)
+	defer s.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := s.KeepStaged(tinyStagedWrite(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkKeepStagedUnbuffered(b *testing.B) {
+	benchmarkKeepStaged(b, StageBufferOptions{})
+}
+
+func BenchmarkKeepStagedBuffered(b *testing.B) {
+	benchmarkKeepStaged(b, StageBufferOptions{MaxBytes: 64 * 1024, FlushInterval: 10 * time.Millisecond})
+}
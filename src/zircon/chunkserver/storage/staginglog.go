@@ -0,0 +1,253 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"zircon/apis"
+)
+
+// An append-only log of staged writes for FilesystemStorage, for keeping them across a restart without a file apiece.
+// Keeping a write appends a record of it and syncs the log, which is a single sync, rather than the file and then its
+// directory. Forgetting a write appends a record too, but without a sync: if that record is lost, the write is just
+// staged again after a restart, as with the files. Once nothing is staged anymore, the log is truncated, and once most
+// of a large log is taken up by writes that have since been forgotten, it's rewritten with only the live ones.
+// The log is replayed when it's opened. A record that was only partially written when the process died, along with
+// anything after it, is discarded, since the write it describes was never acknowledged.
+type stagingLog struct {
+	path string
+	file *os.File
+	// where the next record goes
+	size int64
+	// where the record of each write that's still staged is, and how much of the log those records take up
+	live      map[apis.CommitHash]stagingExtent
+	liveBytes int64
+	metrics   MetricsSink
+}
+
+type stagingExtent struct {
+	offset int64
+	length int64
+}
+
+type stagingOp uint8
+
+const (
+	stagingKeep stagingOp = iota + 1
+	stagingForget
+)
+
+// Marks the start of each record, to help catch garbage in the log.
+const stagingMagic = 0x53
+
+// magic(1) op(1) hash length(2) offset(4) data length(4), followed by the hash, the data, and a CRC-32 of everything
+// before it
+const stagingHeaderSize = 12
+
+// A log is only rewritten once it's at least this large, so that small logs aren't rewritten over and over.
+const stagingCompactionThreshold = 4 * 1024 * 1024
+
+func encodeStagingRecord(op stagingOp, write StagedWrite) []byte {
+	length := stagingHeaderSize + len(write.Hash) + len(write.Data)
+	buf := make([]byte, length+4)
+	buf[0] = stagingMagic
+	buf[1] = byte(op)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(write.Hash)))
+	binary.LittleEndian.PutUint32(buf[4:], write.Offset)
+	binary.LittleEndian.PutUint32(buf[8:], uint32(len(write.Data)))
+	copy(buf[stagingHeaderSize:], write.Hash)
+	copy(buf[stagingHeaderSize+len(write.Hash):], write.Data)
+	binary.LittleEndian.PutUint32(buf[length:], crc32.ChecksumIEEE(buf[:length]))
+	return buf
+}
+
+// Replays a log, calling apply for each intact record along with where it is in the log. Returns how much of the log is
+// intact; anything after the first torn or damaged record is ignored.
+func replayStagingLog(data []byte, apply func(op stagingOp, write StagedWrite, extent stagingExtent)) int64 {
+	var offset int64
+	for len(data) >= stagingHeaderSize+4 && data[0] == stagingMagic {
+		hashLength := int(binary.LittleEndian.Uint16(data[2:]))
+		dataLength := int(binary.LittleEndian.Uint32(data[8:]))
+		if dataLength > apis.MaxChunkSize || len(data) < stagingHeaderSize+hashLength+dataLength+4 {
+			break
+		}
+		length := stagingHeaderSize + hashLength + dataLength
+		if crc32.ChecksumIEEE(data[:length]) != binary.LittleEndian.Uint32(data[length:]) {
+			break
+		}
+		op := stagingOp(data[1])
+		if op != stagingKeep && op != stagingForget {
+			break
+		}
+		apply(op, StagedWrite{
+			Hash:   apis.CommitHash(data[stagingHeaderSize : stagingHeaderSize+hashLength]),
+			Offset: binary.LittleEndian.Uint32(data[4:]),
+			Data:   data[stagingHeaderSize+hashLength : length],
+		}, stagingExtent{offset: offset, length: int64(length + 4)})
+		data = data[length+4:]
+		offset += int64(length + 4)
+	}
+	return offset
+}
+
+// Opens a log, creating it if it doesn't exist yet, and cuts off any torn tail so that new records follow the last
+// intact one.
+func openStagingLog(path string) (*stagingLog, error) {
+	// left behind by a crash partway through rewriting the log, which leaves the old log in place
+	if err := os.Remove(path + ".tmp"); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("[staginglog.go/RMT] %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("[staginglog.go/RDL] %v", err)
+	}
+	l := &stagingLog{path: path, live: map[apis.CommitHash]stagingExtent{}, metrics: NoMetrics}
+	l.size = replayStagingLog(data, func(op stagingOp, write StagedWrite, extent stagingExtent) {
+		l.apply(op, write.Hash, extent)
+	})
+	l.file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		return nil, fmt.Errorf("[staginglog.go/OPN] %v", err)
+	}
+	if l.size < int64(len(data)) {
+		if err := l.file.Truncate(l.size); err != nil {
+			l.file.Close()
+			return nil, fmt.Errorf("[staginglog.go/TRT] %v", err)
+		}
+	}
+	return l, nil
+}
+
+func (l *stagingLog) apply(op stagingOp, hash apis.CommitHash, extent stagingExtent) {
+	if old, found := l.live[hash]; found {
+		delete(l.live, hash)
+		l.liveBytes -= old.length
+	}
+	if op == stagingKeep {
+		l.live[hash] = extent
+		l.liveBytes += extent.length
+	}
+}
+
+func (l *stagingLog) append(op stagingOp, write StagedWrite, sync bool) error {
+	record := encodeStagingRecord(op, write)
+	n, err := l.file.WriteAt(record, l.size)
+	l.metrics.Add(CounterBytesWritten, uint64(n))
+	if err != nil {
+		return err
+	}
+	if sync {
+		if err := syncFile(l.file, l.metrics); err != nil {
+			return err
+		}
+	}
+	l.apply(op, write.Hash, stagingExtent{offset: l.size, length: int64(len(record))})
+	l.size += int64(len(record))
+	return nil
+}
+
+// Durably records a staged write.
+func (l *stagingLog) keep(write StagedWrite) error {
+	if err := l.append(stagingKeep, write, true); err != nil {
+		return fmt.Errorf("[staginglog.go/KEP] %v", err)
+	}
+	return nil
+}
+
+// Durably records several staged writes, with a single sync.
+func (l *stagingLog) keepAll(writes []StagedWrite) error {
+	for _, write := range writes {
+		if err := l.append(stagingKeep, write, false); err != nil {
+			return fmt.Errorf("[staginglog.go/KPA] %v", err)
+		}
+	}
+	if err := syncFile(l.file, l.metrics); err != nil {
+		return fmt.Errorf("[staginglog.go/SYA] %v", err)
+	}
+	return nil
+}
+
+// Records that a staged write is no longer needed. Does nothing if it isn't in the log.
+func (l *stagingLog) forget(hash apis.CommitHash) error {
+	if _, found := l.live[hash]; !found {
+		return nil
+	}
+	if len(l.live) == 1 {
+		// nothing else is staged, so there's nothing left worth keeping
+		if err := l.file.Truncate(0); err != nil {
+			return fmt.Errorf("[staginglog.go/TRN] %v", err)
+		}
+		l.size, l.live, l.liveBytes = 0, map[apis.CommitHash]stagingExtent{}, 0
+		return nil
+	}
+	if err := l.append(stagingForget, StagedWrite{Hash: hash}, false); err != nil {
+		return fmt.Errorf("[staginglog.go/FGT] %v", err)
+	}
+	if l.size >= stagingCompactionThreshold && l.size > 2*l.liveBytes {
+		if err := l.compact(); err != nil {
+			return fmt.Errorf("[staginglog.go/CMP] %v", err)
+		}
+	}
+	return nil
+}
+
+// Rewrites the log with only the records of writes that are still staged. The new log is only swapped in once it's
+// durable, so a crash partway through leaves the old log, which still describes the same writes.
+func (l *stagingLog) compact() error {
+	temp, err := os.OpenFile(l.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	live := map[apis.CommitHash]stagingExtent{}
+	var size int64
+	for hash, extent := range l.live {
+		record := make([]byte, extent.length)
+		if _, err := l.file.ReadAt(record, extent.offset); err == nil {
+			_, err = temp.WriteAt(record, size)
+		}
+		if err != nil {
+			temp.Close()
+			return err
+		}
+		live[hash] = stagingExtent{offset: size, length: extent.length}
+		size += extent.length
+	}
+	l.metrics.Add(CounterBytesWritten, uint64(size))
+	if err := syncFile(temp, l.metrics); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := os.Rename(l.path+".tmp", l.path); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := syncPath(filepath.Dir(l.path), l.metrics); err != nil {
+		temp.Close()
+		return err
+	}
+	l.file.Close()
+	l.file, l.size, l.live = temp, size, live
+	return nil
+}
+
+// Reads back every write that's still staged.
+func (l *stagingLog) list() ([]StagedWrite, error) {
+	var result []StagedWrite
+	for _, extent := range l.live {
+		record := make([]byte, extent.length)
+		if _, err := l.file.ReadAt(record, extent.offset); err != nil {
+			return nil, fmt.Errorf("[staginglog.go/RDR] %v", err)
+		}
+		replayStagingLog(record, func(op stagingOp, write StagedWrite, _ stagingExtent) {
+			result = append(result, write)
+		})
+	}
+	return result, nil
+}
+
+func (l *stagingLog) close() error {
+	return l.file.Close()
+}
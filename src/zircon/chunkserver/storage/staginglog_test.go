@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"zircon/apis"
+)
+
+func openStagingLogTest(t *testing.T, dir string) *FilesystemStorage {
+	s, err := ConfigureFilesystemStorageWithOptions(dir, FilesystemOptions{StagingLog: true})
+	require.NoError(t, err)
+	return s.(*FilesystemStorage)
+}
+
+func listStagedSorted(t *testing.T, fs *FilesystemStorage) []StagedWrite {
+	staged, err := fs.ListStaged()
+	require.NoError(t, err)
+	sort.Slice(staged, func(i, j int) bool {
+		return staged[i].Hash < staged[j].Hash
+	})
+	return staged
+}
+
+func stagingTestWrite(n int, data string) StagedWrite {
+	return StagedWrite{Hash: apis.CommitHash(fmt.Sprintf("hash-%d", n)), Offset: uint32(n * 10), Data: []byte(data)}
+}
+
+func TestStagingLogSurvivesReopen(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "staging-log-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs := openStagingLogTest(t, dir)
+	for i := 1; i <= 3; i++ {
+		assert.NoError(fs.KeepStaged(stagingTestWrite(i, fmt.Sprintf("data %d", i))))
+	}
+	assert.NoError(fs.ForgetStaged(stagingTestWrite(2, "").Hash))
+	assert.NoError(fs.ForgetStaged("never staged"))
+	stats, err := fs.Stats()
+	assert.NoError(err)
+	assert.Equal(uint64(1), stats.OpenFiles)
+	// and nothing is written to staged/
+	_, err = os.Stat(fs.stagedDir())
+	assert.True(os.IsNotExist(err))
+	fs.Close()
+
+	fs = openStagingLogTest(t, dir)
+	assert.Equal([]StagedWrite{stagingTestWrite(1, "data 1"), stagingTestWrite(3, "data 3")}, listStagedSorted(t, fs))
+	fs.Close()
+
+	// staged writes left in the log are still found once the log is turned off, and can still be forgotten
+	s, err := ConfigureFilesystemStorageWithDurability(dir, false, DurabilityStageAndCommit)
+	require.NoError(t, err)
+	fs = s.(*FilesystemStorage)
+	assert.NoError(fs.KeepStaged(stagingTestWrite(4, "data 4")))
+	assert.Equal([]StagedWrite{
+		stagingTestWrite(1, "data 1"), stagingTestWrite(3, "data 3"), stagingTestWrite(4, "data 4"),
+	}, listStagedSorted(t, fs))
+	for _, n := range []int{1, 3, 4} {
+		assert.NoError(fs.ForgetStaged(stagingTestWrite(n, "").Hash))
+	}
+	assert.Empty(listStagedSorted(t, fs))
+	fs.Close()
+
+	// once it's empty, there's no need to open it
+	s, err = ConfigureFilesystemStorageWithDurability(dir, false, DurabilityStageAndCommit)
+	require.NoError(t, err)
+	stats, err = s.Stats()
+	assert.NoError(err)
+	assert.Equal(uint64(0), stats.OpenFiles)
+	s.Close()
+}
+
+func TestStagingLogTornTail(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "staging-log-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs := openStagingLogTest(t, dir)
+	assert.NoError(fs.KeepStaged(stagingTestWrite(1, "intact")))
+	assert.NoError(fs.KeepStaged(stagingTestWrite(2, "torn apart")))
+	fs.Close()
+	original, err := ioutil.ReadFile(fs.stagingLogFilename())
+	require.NoError(t, err)
+
+	for _, damage := range []string{"truncated", "garbled", "appended"} {
+		// the second write was never acknowledged, so losing it is fine, but the first must not be lost with it
+		contents := append([]byte{}, original...)
+		switch damage {
+		case "truncated":
+			contents = contents[:len(contents)-3]
+		case "garbled":
+			contents[len(contents)-8] ^= 0xFF
+		case "appended":
+			contents = append(contents, []byte("garbage from a record cut short")...)
+		}
+		require.NoError(t, ioutil.WriteFile(fs.stagingLogFilename(), contents, 0644))
+
+		fs = openStagingLogTest(t, dir)
+		expected := []StagedWrite{stagingTestWrite(1, "intact")}
+		if damage == "appended" {
+			expected = append(expected, stagingTestWrite(2, "torn apart"))
+		}
+		assert.Equal(expected, listStagedSorted(t, fs), damage)
+
+		// new records go after the last intact one, rather than after the damage, where they'd be lost
+		assert.NoError(fs.KeepStaged(stagingTestWrite(3, "later")))
+		fs.Close()
+		fs = openStagingLogTest(t, dir)
+		assert.Equal(append(expected, stagingTestWrite(3, "later")), listStagedSorted(t, fs), damage)
+		fs.Close()
+	}
+}
+
+func TestStagingLogTruncatedWhenEmpty(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "staging-log-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs := openStagingLogTest(t, dir)
+	defer fs.Close()
+	for round := 0; round < 3; round++ {
+		assert.NoError(fs.KeepStaged(stagingTestWrite(1, "one")))
+		assert.NoError(fs.KeepStaged(stagingTestWrite(2, "two")))
+		assert.NoError(fs.ForgetStaged(stagingTestWrite(1, "").Hash))
+		assert.NoError(fs.ForgetStaged(stagingTestWrite(2, "").Hash))
+		info, err := os.Stat(fs.stagingLogFilename())
+		assert.NoError(err)
+		assert.Equal(int64(0), info.Size())
+	}
+	assert.Empty(listStagedSorted(t, fs))
+}
+
+func TestStagingLogCompaction(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "staging-log-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fs := openStagingLogTest(t, dir)
+	// one write stays staged throughout, so the log is never simply truncated
+	assert.NoError(fs.KeepStaged(stagingTestWrite(0, "long-lived")))
+	data := string(bytes.Repeat([]byte("x"), 64*1024))
+	var largest int64
+	for i := 1; i <= 200; i++ {
+		assert.NoError(fs.KeepStaged(stagingTestWrite(i, data)))
+		assert.NoError(fs.ForgetStaged(stagingTestWrite(i, "").Hash))
+		info, err := os.Stat(fs.stagingLogFilename())
+		require.NoError(t, err)
+		if info.Size() > largest {
+			largest = info.Size()
+		}
+	}
+	// 200 writes of 64 KiB would have taken up 12.5 MiB
+	assert.True(largest < 2*stagingCompactionThreshold, "log grew to %d bytes", largest)
+	_, err = os.Stat(fs.stagingLogFilename() + ".tmp")
+	assert.True(os.IsNotExist(err))
+
+	assert.NoError(fs.KeepStaged(stagingTestWrite(201, "after")))
+	fs.Close()
+	fs = openStagingLogTest(t, dir)
+	defer fs.Close()
+	assert.Equal([]StagedWrite{
+		stagingTestWrite(0, "long-lived"), stagingTestWrite(201, "after"),
+	}, listStagedSorted(t, fs))
+}
@@ -19,8 +19,20 @@ func sortChunkNums(chunks []apis.ChunkNum) {
 // just for the chunk part, not for the version part
 func TestChunkStorage(openStorage func() storage.ChunkStorage, closeStorage func(storage.ChunkStorage),
 	resetStorage func(), t *testing.T) {
+	TestChunkStorageWithSize(openStorage, closeStorage, resetStorage, apis.MaxChunkSize, t)
+}
+
+// Like TestChunkStorage, but with the storage limited to chunks of chunkSize bytes, as for a chunkserver configured
+// with a smaller maximum chunk size.
+func TestChunkStorageWithSize(openLimited func() storage.ChunkStorage, closeStorage func(storage.ChunkStorage),
+	resetStorage func(), chunkSize uint32, t *testing.T) {
 	assert := testifyAssert.New(t)
 
+	openStorage := func() storage.ChunkStorage {
+		s := openLimited()
+		require.True(t, storage.SetMaxChunkSize(s, chunkSize))
+		return s
+	}
 	var s storage.ChunkStorage = nil
 
 	test := func(name string, run func()) {
@@ -99,6 +111,17 @@ func TestChunkStorage(openStorage func() storage.ChunkStorage, closeStorage func
 		assert.Error(err)
 	})
 
+	test("write single chunk with flush", func() {
+		assert.NoError(s.WriteVersion(71, 3, []byte("hello, world!\000\000\000")))
+		assert.NoError(s.Flush())
+
+		reopen()
+
+		data, err := s.ReadVersion(71, 3)
+		assert.NoError(err)
+		assert.Equal([]byte("hello, world!"), util.StripTrailingZeroes(data))
+	})
+
 	test("write single chunk durability", func() {
 		err := s.WriteVersion(71, 3, []byte("hello, world!\000\000\000"))
 		assert.NoError(err)
@@ -217,8 +240,34 @@ func TestChunkStorage(openStorage func() storage.ChunkStorage, closeStorage func
 		assert.Equal([]byte("71-3"), util.StripTrailingZeroes(data))
 	})
 
+	test("list versions in numeric order", func() {
+		// written out of order, with differing numbers of digits, so that neither the order of writing nor sorting by
+		// name gets the right answer
+		for _, version := range []apis.Version{10, 2, 100, 9, 1 << 40} {
+			assert.NoError(s.WriteVersion(71, version, []byte("data")))
+		}
+		expected := []apis.Version{2, 9, 10, 100, 1 << 40}
+
+		versions, err := s.ListVersions(71)
+		assert.NoError(err)
+		assert.Equal(expected, versions)
+
+		reopen()
+
+		versions, err = s.ListVersions(71)
+		assert.NoError(err)
+		assert.Equal(expected, versions)
+
+		// a version that's linked or deleted keeps the rest in order
+		assert.NoError(s.LinkVersion(71, 9, 50))
+		assert.NoError(s.DeleteVersion(71, 10))
+		versions, err = s.ListVersions(71)
+		assert.NoError(err)
+		assert.Equal([]apis.Version{2, 9, 50, 100, 1 << 40}, versions)
+	})
+
 	test("write maximum length chunk of zeroes", func() {
-		data := make([]byte, apis.MaxChunkSize)
+		data := make([]byte, chunkSize)
 		assert.NoError(s.WriteVersion(70, 100, data))
 
 		data, err := s.ReadVersion(70, 100)
@@ -227,13 +276,13 @@ func TestChunkStorage(openStorage func() storage.ChunkStorage, closeStorage func
 	})
 
 	test("write maximum length chunk with nonzero element", func() {
-		write := make([]byte, apis.MaxChunkSize)
+		write := make([]byte, chunkSize)
 		write[len(write)-1] = 152
 		assert.NoError(s.WriteVersion(70, 100, write))
 
 		data, err := s.ReadVersion(70, 100)
 		assert.NoError(err)
-		require.Equal(t, apis.MaxChunkSize, len(data))
+		require.Equal(t, int(chunkSize), len(data))
 		assert.Equal(uint8(152), data[len(data)-1])
 		data[len(data)-1] = 0
 		assert.Equal(uint8(152), write[len(write)-1])
@@ -241,7 +290,7 @@ func TestChunkStorage(openStorage func() storage.ChunkStorage, closeStorage func
 	})
 
 	test("write too large chunk", func() {
-		data := make([]byte, apis.MaxChunkSize+1)
+		data := make([]byte, chunkSize+1)
 		assert.Error(s.WriteVersion(70, 100, data))
 
 		versions, err := s.ListVersions(70)
@@ -289,6 +338,43 @@ func TestChunkStorage(openStorage func() storage.ChunkStorage, closeStorage func
 		assert.Error(s.DeleteVersion(71, 2))
 	})
 
+	test("link version", func() {
+		assert.NoError(s.WriteVersion(71, 1, []byte("71-1")))
+		assert.NoError(s.LinkVersion(71, 1, 2))
+
+		// neither side of the link can be clobbered
+		assert.Error(s.LinkVersion(71, 1, 2))
+		assert.Error(s.WriteVersion(71, 2, []byte("71-2")))
+		assert.Error(s.LinkVersion(71, 3, 4))
+
+		versions, err := s.ListVersions(71)
+		assert.NoError(err)
+		assert.Equal([]apis.Version{1, 2}, versions)
+
+		data, err := s.ReadVersion(71, 2)
+		assert.NoError(err)
+		assert.Equal([]byte("71-1"), util.StripTrailingZeroes(data))
+	})
+
+	test("link version with durability", func() {
+		assert.NoError(s.WriteVersion(71, 1, []byte("71-1")))
+		assert.NoError(s.LinkVersion(71, 1, 2))
+
+		reopen()
+
+		assert.NoError(s.DeleteVersion(71, 1))
+
+		reopen()
+
+		versions, err := s.ListVersions(71)
+		assert.NoError(err)
+		assert.Equal([]apis.Version{2}, versions)
+
+		data, err := s.ReadVersion(71, 2)
+		assert.NoError(err)
+		assert.Equal([]byte("71-1"), util.StripTrailingZeroes(data))
+	})
+
 	test("delete all versions", func() {
 		assert.NoError(s.WriteVersion(71, 1, []byte("71-1")))
 		assert.NoError(s.WriteVersion(71, 2, []byte("71-2")))
@@ -304,4 +390,39 @@ func TestChunkStorage(openStorage func() storage.ChunkStorage, closeStorage func
 		assert.NoError(err)
 		assert.Empty(versions)
 	})
+
+	test("stats start out empty", func() {
+		stats, err := s.Stats()
+		assert.NoError(err)
+		assert.Equal(uint64(0), stats.Chunks)
+		assert.Equal(uint64(0), stats.Versions)
+		assert.Equal(storage.VersionSpread{}, stats.VersionsPerChunk)
+		assert.Equal(uint64(0), stats.CommittedBytes)
+		assert.Equal(uint64(0), stats.StagedBytes)
+	})
+
+	test("stats count chunks and versions", func() {
+		assert.NoError(s.WriteVersion(71, 1, []byte("71-1")))
+		assert.NoError(s.WriteVersion(71, 2, []byte("71-2")))
+		assert.NoError(s.LinkVersion(71, 2, 3))
+		assert.NoError(s.WriteVersion(72, 1, []byte("72-1")))
+		assert.NoError(s.StageData(30))
+
+		stats, err := s.Stats()
+		assert.NoError(err)
+		assert.Equal(uint64(2), stats.Chunks)
+		assert.Equal(uint64(4), stats.Versions)
+		assert.Equal(storage.VersionSpread{Min: 1, Max: 3, Mean: 2}, stats.VersionsPerChunk)
+		assert.True(stats.CommittedBytes > 0)
+		assert.Equal(uint64(30), stats.StagedBytes)
+
+		s.UnstageData(30)
+		assert.NoError(s.DeleteVersion(72, 1))
+		stats, err = s.Stats()
+		assert.NoError(err)
+		assert.Equal(uint64(1), stats.Chunks)
+		assert.Equal(uint64(3), stats.Versions)
+		assert.Equal(storage.VersionSpread{Min: 3, Max: 3, Mean: 3}, stats.VersionsPerChunk)
+		assert.Equal(uint64(0), stats.StagedBytes)
+	})
 }
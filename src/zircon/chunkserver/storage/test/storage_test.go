@@ -6,8 +6,20 @@ import (
 	"zircon/chunkserver/storage"
 	"os"
 	"io/ioutil"
+	"time"
 )
 
+// A maximum chunk size well below apis.MaxChunkSize, as a chunkserver might be configured with.
+const smallChunkSize = 64 * 1024
+
+// Runs the conformance suites, with the chunk part run at both the default maximum chunk size and a smaller one.
+func testStorage(openStorage func() storage.ChunkStorage, closeStorage func(storage.ChunkStorage),
+	resetStorage func(), t *testing.T) {
+	TestChunkStorage(openStorage, closeStorage, resetStorage, t)
+	TestChunkStorageWithSize(openStorage, closeStorage, resetStorage, smallChunkSize, t)
+	TestVersionStorage(openStorage, closeStorage, resetStorage, t)
+}
+
 func TestMemoryStorage(t *testing.T) {
 	mem, err := storage.ConfigureMemoryStorage()
 	require.NoError(t, err)
@@ -21,11 +33,71 @@ func TestMemoryStorage(t *testing.T) {
 		require.NoError(t, err)
 		mem = newmem
 	}
-	TestChunkStorage(openStorage, closeStorage, resetStorage, t)
-	TestVersionStorage(openStorage, closeStorage, resetStorage, t)
+	testStorage(openStorage, closeStorage, resetStorage, t)
 }
 
-func TestFilesystemStorage(t *testing.T) {
+func TestCopyOnWriteMemoryStorage(t *testing.T) {
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	cow := storage.WithCopyOnWrite(mem)
+	openStorage := func() storage.ChunkStorage {
+		return cow
+	}
+	closeStorage := func(_ storage.ChunkStorage) {} // do nothing; memory would be wiped.
+	resetStorage := func() {
+		cow.Close()
+		newmem, err := storage.ConfigureMemoryStorage()
+		require.NoError(t, err)
+		cow = storage.WithCopyOnWrite(newmem)
+	}
+	testStorage(openStorage, closeStorage, resetStorage, t)
+}
+
+func TestCompressedMemoryStorage(t *testing.T) {
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	compressed := storage.WithCompression(mem, storage.FlateCodec())
+	openStorage := func() storage.ChunkStorage {
+		return compressed
+	}
+	closeStorage := func(_ storage.ChunkStorage) {} // do nothing; memory would be wiped.
+	resetStorage := func() {
+		compressed.Close()
+		newmem, err := storage.ConfigureMemoryStorage()
+		require.NoError(t, err)
+		compressed = storage.WithCompression(newmem, storage.FlateCodec())
+	}
+	testStorage(openStorage, closeStorage, resetStorage, t)
+}
+
+func encryptionKeys(t *testing.T) storage.KeyProvider {
+	keys, err := storage.StaticKeys(map[uint32][]byte{1: []byte("0123456789abcdef0123456789abcdef")}, 1)
+	require.NoError(t, err)
+	return keys
+}
+
+func TestEncryptedMemoryStorage(t *testing.T) {
+	mem, err := storage.ConfigureMemoryStorage()
+	require.NoError(t, err)
+	encrypted := storage.WithEncryption(mem, encryptionKeys(t))
+	openStorage := func() storage.ChunkStorage {
+		return encrypted
+	}
+	closeStorage := func(_ storage.ChunkStorage) {} // do nothing; memory would be wiped.
+	resetStorage := func() {
+		encrypted.Close()
+		newmem, err := storage.ConfigureMemoryStorage()
+		require.NoError(t, err)
+		encrypted = storage.WithEncryption(newmem, encryptionKeys(t))
+	}
+	testStorage(openStorage, closeStorage, resetStorage, t)
+}
+
+func testFilesystemStorage(t *testing.T, writeAheadLog bool, copyOnWrite bool, encrypt bool) {
+	testFilesystemStorageWithOptions(t, storage.FilesystemOptions{WriteAheadLog: writeAheadLog}, copyOnWrite, encrypt)
+}
+
+func testFilesystemStorageWithOptions(t *testing.T, options storage.FilesystemOptions, copyOnWrite bool, encrypt bool) {
 	dir, err := ioutil.TempDir("", "filesystem-test-")
 	require.NoError(t, err)
 	defer func() {
@@ -37,8 +109,14 @@ func TestFilesystemStorage(t *testing.T) {
 	working := dir + "/test"
 	require.NoError(t, os.Mkdir(working, 0755))
 	openStorage := func() storage.ChunkStorage {
-		cs, err := storage.ConfigureFilesystemStorage(working)
+		cs, err := storage.ConfigureFilesystemStorageWithOptions(working, options)
 		require.NoError(t, err)
+		if encrypt {
+			cs = storage.WithEncryption(cs, encryptionKeys(t))
+		}
+		if copyOnWrite {
+			return storage.WithCopyOnWrite(cs)
+		}
 		return cs
 	}
 	closeStorage := func(storage storage.ChunkStorage) {
@@ -48,8 +126,70 @@ func TestFilesystemStorage(t *testing.T) {
 		require.NoError(t, os.RemoveAll(working))
 		require.NoError(t, os.Mkdir(working, 0755))
 	}
-	TestChunkStorage(openStorage, closeStorage, resetStorage, t)
-	TestVersionStorage(openStorage, closeStorage, resetStorage, t)
+	testStorage(openStorage, closeStorage, resetStorage, t)
+}
+
+func TestFilesystemStorage(t *testing.T) {
+	testFilesystemStorage(t, false, false, false)
+}
+
+func TestFilesystemStorageWithLog(t *testing.T) {
+	testFilesystemStorage(t, true, false, false)
+}
+
+func TestFilesystemStorageWithCopyOnWrite(t *testing.T) {
+	testFilesystemStorage(t, false, true, false)
+}
+
+func TestEncryptedFilesystemStorage(t *testing.T) {
+	testFilesystemStorage(t, false, false, true)
+}
+
+func TestFilesystemStorageWithStageBuffer(t *testing.T) {
+	testFilesystemStorageWithOptions(t, storage.FilesystemOptions{
+		WriteAheadLog: true,
+		StagingLog:    true,
+		StageBuffer:   storage.StageBufferOptions{MaxBytes: 64, FlushInterval: time.Millisecond},
+	}, false, false)
+}
+
+func testObjectStorage(t *testing.T, cache bool) {
+	dir, err := ioutil.TempDir("", "objectstore-test-")
+	require.NoError(t, err)
+	defer func() {
+		err := os.RemoveAll(dir)
+		if err != nil {
+			t.Log("failed to clean up:", err)
+		}
+	}()
+	options := storage.ObjectStorageOptions{Bucket: "zircon", Prefix: "test/", ReadPartSize: 4096}
+	if cache {
+		options.CacheDir = dir + "/cache"
+		options.CacheCapacity = 8 * storage.ReadBufferSize
+	}
+	// the bucket outlives any one storage, just like a real one would
+	fake := storage.NewFakeObjectStore("zircon")
+	openStorage := func() storage.ChunkStorage {
+		cs, err := storage.ConfigureObjectStorage(fake, options)
+		require.NoError(t, err)
+		return cs
+	}
+	closeStorage := func(storage storage.ChunkStorage) {
+		storage.Close()
+	}
+	resetStorage := func() {
+		fake = storage.NewFakeObjectStore("zircon")
+		require.NoError(t, os.RemoveAll(dir+"/cache"))
+	}
+	testStorage(openStorage, closeStorage, resetStorage, t)
+}
+
+func TestObjectStorage(t *testing.T) {
+	testObjectStorage(t, false)
+}
+
+func TestObjectStorageWithCache(t *testing.T) {
+	testObjectStorage(t, true)
 }
 
 /*
@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"zircon/apis"
+)
+
+// A named storage backend, as one of the tiers of a TieredStorage.
+type Tier struct {
+	Name    string
+	Storage ChunkStorage
+}
+
+// Spreads chunks across several storage backends, such as a small fast tier and a large slow one. Each chunk lives
+// entirely in a single tier, which is tracked in an in-memory index; new chunks go into the first tier. Moving a chunk
+// to another tier is done by copying its versions directly into that tier's backend, and then calling SwitchTier.
+//
+// The index is rebuilt by scanning every tier on startup. If a chunk turns up in more than one tier, because a move was
+// interrupted, the copy that has a latest version wins, since a latest version is only ever set on a complete copy. If
+// several copies have one, they are all complete, and the one in the earliest tier is kept.
+type TieredStorage struct {
+	tiers []Tier
+	// index into tiers; chunks that aren't listed don't exist, and will be created in the first tier
+	location map[apis.ChunkNum]int
+}
+
+// Combine several storage backends into a single one. The first tier is where new chunks are placed.
+func WithTiers(tiers []Tier) (*TieredStorage, error) {
+	if len(tiers) == 0 {
+		return nil, errors.New("[tiered.go/NOT] at least one tier is required")
+	}
+	names := map[string]bool{}
+	for _, tier := range tiers {
+		if names[tier.Name] {
+			return nil, fmt.Errorf("[tiered.go/DUP] duplicate tier name: %s", tier.Name)
+		}
+		names[tier.Name] = true
+	}
+	t := &TieredStorage{
+		tiers:    tiers,
+		location: map[apis.ChunkNum]int{},
+	}
+	if err := t.buildIndex(); err != nil {
+		return nil, fmt.Errorf("[tiered.go/BLD] %v", err)
+	}
+	return t, nil
+}
+
+// Lists which tiers have any trace of each chunk, and which of those have a latest version for it.
+func (t *TieredStorage) buildIndex() error {
+	present := map[apis.ChunkNum][]int{}
+	withLatest := map[apis.ChunkNum][]int{}
+	for i, tier := range t.tiers {
+		withData, err := tier.Storage.ListChunksWithData()
+		if err != nil {
+			return err
+		}
+		latest, err := tier.Storage.ListChunksWithLatest()
+		if err != nil {
+			return err
+		}
+		seen := map[apis.ChunkNum]bool{}
+		for _, chunk := range latest {
+			withLatest[chunk] = append(withLatest[chunk], i)
+			seen[chunk] = true
+			present[chunk] = append(present[chunk], i)
+		}
+		for _, chunk := range withData {
+			if !seen[chunk] {
+				present[chunk] = append(present[chunk], i)
+			}
+		}
+	}
+	for chunk, tiers := range present {
+		owner := tiers[0]
+		if len(withLatest[chunk]) > 0 {
+			owner = withLatest[chunk][0]
+		}
+		t.location[chunk] = owner
+		for _, tier := range tiers {
+			if tier != owner {
+				if err := removeChunk(t.tiers[tier].Storage, chunk); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Deletes every trace of a chunk from a single backend.
+func removeChunk(storage ChunkStorage, chunk apis.ChunkNum) error {
+	if _, err := storage.GetLatestVersion(chunk); err == nil {
+		if err := storage.DeleteLatestVersion(chunk); err != nil {
+			return err
+		}
+	}
+	versions, err := storage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if err := storage.DeleteVersion(chunk, version); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the backend of a tier by name.
+func (t *TieredStorage) Tier(name string) (ChunkStorage, bool) {
+	for _, tier := range t.tiers {
+		if tier.Name == name {
+			return tier.Storage, true
+		}
+	}
+	return nil, false
+}
+
+// Get the name of the tier that a chunk is currently stored in. Chunks that don't exist yet are reported as being in
+// the first tier, since that's where they will be created.
+func (t *TieredStorage) TierOf(chunk apis.ChunkNum) string {
+	return t.tiers[t.location[chunk]].Name
+}
+
+// Point the index at a different tier for a chunk. The caller must already have placed a complete copy of the chunk,
+// including its latest version, in that tier; the copy in the old tier is no longer visible afterwards, and it is up
+// to the caller to remove it, with RemoveFromTier.
+func (t *TieredStorage) SwitchTier(chunk apis.ChunkNum, name string) error {
+	for i, tier := range t.tiers {
+		if tier.Name == name {
+			t.location[chunk] = i
+			return nil
+		}
+	}
+	return fmt.Errorf("no such tier: %s", name)
+}
+
+// Deletes every trace of a chunk from a tier that it is not stored in, such as the leftovers of a move.
+func (t *TieredStorage) RemoveFromTier(chunk apis.ChunkNum, name string) error {
+	for i, tier := range t.tiers {
+		if tier.Name == name {
+			if t.isCurrent(chunk, i) {
+				return fmt.Errorf("chunk %d is stored in tier %s", chunk, name)
+			}
+			return removeChunk(tier.Storage, chunk)
+		}
+	}
+	return fmt.Errorf("no such tier: %s", name)
+}
+
+func (t *TieredStorage) storageFor(chunk apis.ChunkNum) ChunkStorage {
+	return t.tiers[t.location[chunk]].Storage
+}
+
+// Used before anything is added to a chunk, to make sure it has an index entry.
+func (t *TieredStorage) placeChunk(chunk apis.ChunkNum) ChunkStorage {
+	if _, found := t.location[chunk]; !found {
+		t.location[chunk] = 0
+	}
+	return t.storageFor(chunk)
+}
+
+// Whether a chunk found in a tier is the copy that the index points to. Anything else is the leftover of a move.
+func (t *TieredStorage) isCurrent(chunk apis.ChunkNum, tier int) bool {
+	index, found := t.location[chunk]
+	return found && index == tier
+}
+
+// Once nothing of a chunk remains, it no longer needs an index entry; if it comes back, it'll be placed afresh. Any
+// partial copy left in another tier by an unfinished move stays hidden.
+func (t *TieredStorage) forgetIfGone(chunk apis.ChunkNum) error {
+	storage := t.storageFor(chunk)
+	versions, err := storage.ListVersions(chunk)
+	if err != nil {
+		return err
+	}
+	if _, err := storage.GetLatestVersion(chunk); err != nil && len(versions) == 0 {
+		delete(t.location, chunk)
+	}
+	return nil
+}
+
+func (t *TieredStorage) ListChunksWithData() ([]apis.ChunkNum, error) {
+	var result []apis.ChunkNum
+	for i, tier := range t.tiers {
+		chunks, err := tier.Storage.ListChunksWithData()
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			if t.isCurrent(chunk, i) {
+				result = append(result, chunk)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (t *TieredStorage) ListVersions(chunk apis.ChunkNum) ([]apis.Version, error) {
+	return t.storageFor(chunk).ListVersions(chunk)
+}
+
+func (t *TieredStorage) ReadVersion(chunk apis.ChunkNum, version apis.Version) ([]byte, error) {
+	return t.storageFor(chunk).ReadVersion(chunk, version)
+}
+
+func (t *TieredStorage) ReadVersionInto(chunk apis.ChunkNum, version apis.Version, buf []byte) ([]byte, error) {
+	return ReadVersionInto(t.storageFor(chunk), chunk, version, buf)
+}
+
+func (t *TieredStorage) WriteVersion(chunk apis.ChunkNum, version apis.Version, data []byte) error {
+	return t.placeChunk(chunk).WriteVersion(chunk, version, data)
+}
+
+func (t *TieredStorage) LinkVersion(chunk apis.ChunkNum, existing apis.Version, version apis.Version) error {
+	return t.placeChunk(chunk).LinkVersion(chunk, existing, version)
+}
+
+func (t *TieredStorage) DeleteVersion(chunk apis.ChunkNum, version apis.Version) error {
+	if err := t.storageFor(chunk).DeleteVersion(chunk, version); err != nil {
+		return err
+	}
+	return t.forgetIfGone(chunk)
+}
+
+// Compacts the copy of the chunk that the index points to. A partial copy left by an unfinished move is cleared out by
+// the next move instead.
+func (t *TieredStorage) CompactChunk(chunk apis.ChunkNum, oldest apis.Version) (CompactionResult, error) {
+	result, err := CompactChunk(t.storageFor(chunk), chunk, oldest)
+	if err != nil {
+		return result, err
+	}
+	return result, t.forgetIfGone(chunk)
+}
+
+func (t *TieredStorage) QuarantineVersion(chunk apis.ChunkNum, version apis.Version) error {
+	quarantiner, ok := t.storageFor(chunk).(Quarantiner)
+	if !ok {
+		return fmt.Errorf("tier %s cannot quarantine %d/%d", t.TierOf(chunk), chunk, version)
+	}
+	if err := quarantiner.QuarantineVersion(chunk, version); err != nil {
+		return err
+	}
+	return t.forgetIfGone(chunk)
+}
+
+// Purges every tier that can be purged.
+func (t *TieredStorage) PurgeQuarantine(cutoff time.Time) (int, error) {
+	removed := 0
+	for _, tier := range t.tiers {
+		if purger, ok := tier.Storage.(QuarantinePurger); ok {
+			count, err := purger.PurgeQuarantine(cutoff)
+			removed += count
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+func (t *TieredStorage) ListChunksWithLatest() ([]apis.ChunkNum, error) {
+	var result []apis.ChunkNum
+	for i, tier := range t.tiers {
+		chunks, err := tier.Storage.ListChunksWithLatest()
+		if err != nil {
+			return nil, err
+		}
+		for _, chunk := range chunks {
+			if t.isCurrent(chunk, i) {
+				result = append(result, chunk)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (t *TieredStorage) GetLatestVersion(chunk apis.ChunkNum) (apis.Version, error) {
+	return t.storageFor(chunk).GetLatestVersion(chunk)
+}
+
+func (t *TieredStorage) SetLatestVersion(chunk apis.ChunkNum, latest apis.Version) error {
+	return t.placeChunk(chunk).SetLatestVersion(chunk, latest)
+}
+
+func (t *TieredStorage) DeleteLatestVersion(chunk apis.ChunkNum) error {
+	if err := t.storageFor(chunk).DeleteLatestVersion(chunk); err != nil {
+		return err
+	}
+	return t.forgetIfGone(chunk)
+}
+
+// Staged writes aren't part of any chunk yet, so they are accounted for in the first tier, where new data lands.
+func (t *TieredStorage) StageData(bytes int) error {
+	return t.tiers[0].Storage.StageData(bytes)
+}
+
+func (t *TieredStorage) UnstageData(bytes int) {
+	t.tiers[0].Storage.UnstageData(bytes)
+}
+
+// Bytes and open files are added up across every tier, including copies left partway through a move, since those take
+// up space too. Chunks and versions are only counted in the tier each chunk currently lives in.
+func (t *TieredStorage) Stats() (StorageStats, error) {
+	var stats StorageStats
+	for _, tier := range t.tiers {
+		tierStats, err := tier.Storage.Stats()
+		if err != nil {
+			return StorageStats{}, fmt.Errorf("[tiered.go/STS] tier %s: %v", tier.Name, err)
+		}
+		stats.CommittedBytes += tierStats.CommittedBytes
+		stats.AllocatedBytes += tierStats.AllocatedBytes
+		stats.StagedBytes += tierStats.StagedBytes
+		stats.OverheadBytes += tierStats.OverheadBytes
+		stats.OpenFiles += tierStats.OpenFiles
+	}
+	if err := countVersions(t, &stats); err != nil {
+		return StorageStats{}, err
+	}
+	return stats, nil
+}
+
+// A tiered storage is only as durable as its least durable tier. Staged writes are kept by the first tier, as below,
+// so they are as durable as that tier makes them.
+func (t *TieredStorage) Durability() Durability {
+	durability := DurabilityStageAndCommit
+	for _, tier := range t.tiers {
+		if tierDurability := DurabilityOf(tier.Storage); tierDurability < durability {
+			durability = tierDurability
+		}
+	}
+	return durability
+}
+
+// Like the staged data they stand for, staged writes are kept by the first tier.
+func (t *TieredStorage) KeepStaged(write StagedWrite) error {
+	if keeper, ok := t.tiers[0].Storage.(StagedWriteKeeper); ok {
+		return keeper.KeepStaged(write)
+	}
+	return nil
+}
+
+func (t *TieredStorage) ForgetStaged(hash apis.CommitHash) error {
+	if keeper, ok := t.tiers[0].Storage.(StagedWriteKeeper); ok {
+		return keeper.ForgetStaged(hash)
+	}
+	return nil
+}
+
+func (t *TieredStorage) ListStaged() ([]StagedWrite, error) {
+	if keeper, ok := t.tiers[0].Storage.(StagedWriteKeeper); ok {
+		return keeper.ListStaged()
+	}
+	return nil, nil
+}
+
+// New data always lands in the first tier, so that is the one whose free space matters.
+func (t *TieredStorage) Space() (StorageSpace, bool, error) {
+	if reporter, ok := t.tiers[0].Storage.(SpaceReporter); ok {
+		return reporter.Space()
+	}
+	return StorageSpace{}, false, nil
+}
+
+// Every tier reports to the same sink, so the measurements are totals across all of them.
+// Only true if every tier checks sizes, since a version could end up in any of them.
+func (t *TieredStorage) SetMaxChunkSize(size uint32) bool {
+	limited := true
+	for _, tier := range t.tiers {
+		if !SetMaxChunkSize(tier.Storage, size) {
+			limited = false
+		}
+	}
+	return limited
+}
+
+func (t *TieredStorage) SetMetricsSink(sink MetricsSink) bool {
+	reporting := false
+	for _, tier := range t.tiers {
+		if SetMetricsSink(tier.Storage, sink) {
+			reporting = true
+		}
+	}
+	return reporting
+}
+
+func (t *TieredStorage) Flush() error {
+	for _, tier := range t.tiers {
+		if err := tier.Storage.Flush(); err != nil {
+			return fmt.Errorf("[tiered.go/FLS] tier %s: %v", tier.Name, err)
+		}
+	}
+	return nil
+}
+
+func (t *TieredStorage) Close() {
+	for _, tier := range t.tiers {
+		tier.Storage.Close()
+	}
+}
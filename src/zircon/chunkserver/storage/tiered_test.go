@@ -0,0 +1,125 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"zircon/apis"
+)
+
+func TestTieredPlacement(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	fast, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	slow, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	tiered, err := WithTiers([]Tier{{Name: "fast", Storage: fast}, {Name: "slow", Storage: slow}})
+	require.NoError(t, err)
+	defer tiered.Close()
+
+	assert.NoError(tiered.WriteVersion(1, 1, []byte("one")))
+	assert.NoError(tiered.SetLatestVersion(1, 1))
+	assert.Equal("fast", tiered.TierOf(1))
+
+	// a partial copy in another tier stays hidden until the switch
+	assert.NoError(slow.WriteVersion(1, 1, []byte("one")))
+	chunks, err := tiered.ListChunksWithData()
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkNum{1}, chunks)
+	assert.Error(tiered.RemoveFromTier(1, "fast"))
+	assert.NoError(slow.SetLatestVersion(1, 1))
+	assert.NoError(tiered.SwitchTier(1, "slow"))
+	assert.NoError(tiered.RemoveFromTier(1, "fast"))
+	assert.Equal("slow", tiered.TierOf(1))
+	data, err := tiered.ReadVersion(1, 1)
+	assert.NoError(err)
+	assert.Equal("one", string(data))
+	versions, err := fast.ListVersions(1)
+	assert.NoError(err)
+	assert.Empty(versions)
+
+	// once deleted, a chunk is created afresh in the first tier
+	assert.NoError(tiered.DeleteLatestVersion(1))
+	assert.NoError(tiered.DeleteVersion(1, 1))
+	assert.NoError(tiered.WriteVersion(1, 2, []byte("two")))
+	assert.Equal("fast", tiered.TierOf(1))
+
+	_, err = WithTiers(nil)
+	assert.Error(err)
+	_, err = WithTiers([]Tier{{Name: "fast", Storage: fast}, {Name: "fast", Storage: slow}})
+	assert.Error(err)
+}
+
+func TestTieredInterruptedMove(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	fast, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	slow, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+
+	// chunk 1 was partway through being copied into the slow tier
+	assert.NoError(fast.WriteVersion(1, 1, []byte("one")))
+	assert.NoError(fast.SetLatestVersion(1, 1))
+	assert.NoError(slow.WriteVersion(1, 1, []byte("one")))
+	// chunk 2 had been fully copied, but the old copy was never removed
+	assert.NoError(fast.WriteVersion(2, 1, []byte("two")))
+	assert.NoError(fast.SetLatestVersion(2, 1))
+	assert.NoError(slow.WriteVersion(2, 1, []byte("two")))
+	assert.NoError(slow.SetLatestVersion(2, 1))
+	// chunk 3 only exists in the slow tier
+	assert.NoError(slow.WriteVersion(3, 1, []byte("three")))
+	assert.NoError(slow.SetLatestVersion(3, 1))
+
+	tiered, err := WithTiers([]Tier{{Name: "fast", Storage: fast}, {Name: "slow", Storage: slow}})
+	require.NoError(t, err)
+	defer tiered.Close()
+
+	assert.Equal("fast", tiered.TierOf(1))
+	assert.Equal("fast", tiered.TierOf(2))
+	assert.Equal("slow", tiered.TierOf(3))
+	chunks, err := slow.ListChunksWithData()
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkNum{3}, chunks)
+	latest, err := tiered.ListChunksWithLatest()
+	assert.NoError(err)
+	assert.ElementsMatch([]apis.ChunkNum{1, 2, 3}, latest)
+}
+
+func TestTieredKeepsStagedWritesInFirstTier(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	var tiers []Tier
+	for _, name := range []string{"hot", "cold"} {
+		dir, err := ioutil.TempDir("", "tiered-test-")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		storage, err := ConfigureFilesystemStorageWithOptions(dir, FilesystemOptions{Durability: DurabilityStageAndCommit})
+		require.NoError(t, err)
+		tiers = append(tiers, Tier{Name: name, Storage: storage})
+	}
+	hot := tiers[0].Storage
+	tiered, err := WithTiers(tiers)
+	require.NoError(t, err)
+	defer tiered.Close()
+
+	// reporting stage-and-commit durability means staged writes have to be kept somewhere
+	assert.Equal(DurabilityStageAndCommit, DurabilityOf(tiered))
+	var keeper StagedWriteKeeper = tiered
+	write := StagedWrite{Hash: apis.CalculateCommitHash(0, []byte("staged")), Data: []byte("staged")}
+	assert.NoError(keeper.KeepStaged(write))
+	staged, err := hot.(StagedWriteKeeper).ListStaged()
+	assert.NoError(err)
+	assert.Len(staged, 1)
+	staged, err = keeper.ListStaged()
+	assert.NoError(err)
+	require.Len(t, staged, 1)
+	assert.Equal(write.Hash, staged[0].Hash)
+	assert.NoError(keeper.ForgetStaged(write.Hash))
+	staged, err = keeper.ListStaged()
+	assert.NoError(err)
+	assert.Empty(staged)
+}
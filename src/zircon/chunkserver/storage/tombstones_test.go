@@ -0,0 +1,97 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"sort"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+func sortedTombstones(t *testing.T, keeper TombstoneKeeper) []apis.Tombstone {
+	tombstones, err := keeper.ListTombstones()
+	require.NoError(t, err)
+	sort.Slice(tombstones, func(i, j int) bool {
+		return tombstones[i].Chunk < tombstones[j].Chunk
+	})
+	return tombstones
+}
+
+func checkTombstoneKeeper(t *testing.T, s ChunkStorage) {
+	assert := testifyAssert.New(t)
+
+	keeper := s.(TombstoneKeeper)
+	assert.Empty(sortedTombstones(t, keeper))
+
+	deleted := time.Unix(0, 1234567890)
+	assert.NoError(keeper.KeepTombstone(apis.Tombstone{Chunk: 2, Version: 5, Deleted: deleted}))
+	assert.NoError(keeper.KeepTombstone(apis.Tombstone{Chunk: 1, Version: 3, Deleted: deleted}))
+	// a later deletion of the same chunk replaces the earlier one
+	assert.NoError(keeper.KeepTombstone(apis.Tombstone{Chunk: 2, Version: 8, Deleted: deleted.Add(time.Second)}))
+	tombstones := sortedTombstones(t, keeper)
+	require.Len(t, tombstones, 2)
+	assert.Equal(apis.Tombstone{Chunk: 1, Version: 3, Deleted: deleted}, tombstones[0])
+	assert.Equal(apis.ChunkNum(2), tombstones[1].Chunk)
+	assert.Equal(apis.Version(8), tombstones[1].Version)
+	assert.True(deleted.Add(time.Second).Equal(tombstones[1].Deleted))
+
+	// tombstones don't count as chunks
+	chunks, err := s.ListChunksWithData()
+	assert.NoError(err)
+	assert.Empty(chunks)
+
+	assert.NoError(keeper.ForgetTombstone(1))
+	assert.NoError(keeper.ForgetTombstone(1))
+	assert.NoError(keeper.ForgetTombstone(3))
+	tombstones = sortedTombstones(t, keeper)
+	require.Len(t, tombstones, 1)
+	assert.Equal(apis.ChunkNum(2), tombstones[0].Chunk)
+}
+
+func TestMemoryTombstones(t *testing.T) {
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer mem.Close()
+	checkTombstoneKeeper(t, mem)
+}
+
+func TestCopyOnWriteTombstones(t *testing.T) {
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	cow := WithCopyOnWrite(mem)
+	defer cow.Close()
+	checkTombstoneKeeper(t, cow)
+}
+
+func TestFilesystemTombstones(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "tombstone-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	checkTombstoneKeeper(t, s)
+	s.Close()
+
+	// tombstones survive a restart
+	s, err = ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	defer s.Close()
+	fs := s.(*FilesystemStorage)
+	tombstones := sortedTombstones(t, fs)
+	require.Len(t, tombstones, 1)
+	assert.Equal(apis.Version(8), tombstones[0].Version)
+
+	// one that was only partly written when we crashed is thrown away
+	assert.NoError(fs.KeepTombstone(apis.Tombstone{Chunk: 4, Version: 1, Deleted: time.Now()}))
+	require.NoError(t, os.Truncate(fs.tombstoneFilename(4), chunkFileHeaderSize+3))
+	tombstones = sortedTombstones(t, fs)
+	require.Len(t, tombstones, 1)
+	assert.Equal(apis.ChunkNum(2), tombstones[0].Chunk)
+	_, err = os.Stat(fs.tombstoneFilename(4))
+	assert.True(os.IsNotExist(err))
+}
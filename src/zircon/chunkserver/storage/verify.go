@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+type VerifyOptions struct {
+	// Most bytes per second to read, on average. Zero means no limit.
+	BytesPerSecond int64
+	// Held around every use of the storage, one chunk at a time, if anything else uses the storage at the same time.
+	// Nil if nothing does.
+	Lock sync.Locker
+}
+
+type noLock struct{}
+
+func (noLock) Lock() {}
+
+func (noLock) Unlock() {}
+
+// Verifies every version of every chunk by reading it, for storage that isn't an IntegrityVerifier, and with the
+// storage's own VerifyAll otherwise.
+func VerifyAll(ctx context.Context, storage ChunkStorage, options VerifyOptions, found func(apis.VerifyFinding)) (apis.VerifyReport, error) {
+	if verifier, ok := storage.(IntegrityVerifier); ok {
+		return verifier.VerifyAll(ctx, options, found)
+	}
+	return verifyEach(ctx, storage, options, found, func(chunk apis.ChunkNum, version apis.Version) (uint64, error) {
+		data, err := storage.ReadVersion(chunk, version)
+		return uint64(len(data)), err
+	})
+}
+
+// Goes over every chunk that has either versions or a latest version, in order, and checks each of its versions with
+// check, which returns how many bytes it read, and why the version is corrupt, if it is. A chunk whose latest version
+// isn't stored has that version reported missing. The findings for a chunk are handed to found once the lock is given
+// up again.
+func verifyEach(ctx context.Context, storage ChunkStorage, options VerifyOptions, found func(apis.VerifyFinding),
+	check func(chunk apis.ChunkNum, version apis.Version) (uint64, error)) (apis.VerifyReport, error) {
+	var report apis.VerifyReport
+	lock := options.Lock
+	if lock == nil {
+		lock = noLock{}
+	}
+
+	lock.Lock()
+	chunks, err := listChunksToVerify(storage)
+	lock.Unlock()
+	if err != nil {
+		return report, fmt.Errorf("[verify.go/LST] %v", err)
+	}
+
+	for _, chunk := range chunks {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		lock.Lock()
+		findings, bytes := verifyChunk(storage, chunk, check)
+		lock.Unlock()
+		report.Bytes += bytes
+		for _, finding := range findings {
+			switch finding.Status {
+			case apis.VerifyOK:
+				report.OK += 1
+			case apis.VerifyCorrupt:
+				report.Corrupt += 1
+			case apis.VerifyMissing:
+				report.Missing += 1
+			}
+			found(finding)
+		}
+		if !throttleVerify(ctx, options.BytesPerSecond, bytes) {
+			return report, ctx.Err()
+		}
+	}
+	return report, nil
+}
+
+func listChunksToVerify(storage ChunkStorage) ([]apis.ChunkNum, error) {
+	withData, err := storage.ListChunksWithData()
+	if err != nil {
+		return nil, err
+	}
+	withLatest, err := storage.ListChunksWithLatest()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[apis.ChunkNum]bool{}
+	var chunks []apis.ChunkNum
+	for _, list := range [][]apis.ChunkNum{withData, withLatest} {
+		for _, chunk := range list {
+			if !seen[chunk] {
+				seen[chunk] = true
+				chunks = append(chunks, chunk)
+			}
+		}
+	}
+	sortChunks(chunks)
+	return chunks, nil
+}
+
+// Must be called with the lock held. A chunk deleted since it was listed just has nothing to report.
+func verifyChunk(storage ChunkStorage, chunk apis.ChunkNum,
+	check func(chunk apis.ChunkNum, version apis.Version) (uint64, error)) ([]apis.VerifyFinding, uint64) {
+	versions, err := storage.ListVersions(chunk)
+	if err != nil {
+		// no telling which versions are affected, but the rest of the chunks can still be checked
+		return []apis.VerifyFinding{{
+			Chunk: chunk, Status: apis.VerifyCorrupt, Detail: fmt.Sprintf("cannot list versions: %v", err),
+		}}, 0
+	}
+	var findings []apis.VerifyFinding
+	var bytes uint64
+	stored := map[apis.Version]bool{}
+	for _, version := range versions {
+		stored[version] = true
+		read, err := check(chunk, version)
+		bytes += read
+		finding := apis.VerifyFinding{Chunk: chunk, Version: version, Status: apis.VerifyOK}
+		if err != nil {
+			finding.Status, finding.Detail = apis.VerifyCorrupt, err.Error()
+		}
+		findings = append(findings, finding)
+	}
+	// an error here just means that there's no latest version, which is left for recovery on startup to deal with
+	if latest, err := storage.GetLatestVersion(chunk); err == nil && !stored[latest] {
+		findings = append(findings, apis.VerifyFinding{
+			Chunk: chunk, Version: latest, Status: apis.VerifyMissing, Detail: "latest version is not stored",
+		})
+	}
+	return findings, bytes
+}
+
+// Waits long enough that the bytes just read stay within the budget, on average. Returns false if ctx was cancelled
+// in the meantime.
+func throttleVerify(ctx context.Context, bytesPerSecond int64, bytes uint64) bool {
+	if bytesPerSecond > 0 && bytes > 0 {
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(float64(bytes) / float64(bytesPerSecond) * float64(time.Second))):
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// Checks each version file against its header, without going through the mapped read cache, which could be serving a
+// copy read before the file was damaged.
+func (m *FilesystemStorage) VerifyAll(ctx context.Context, options VerifyOptions, found func(apis.VerifyFinding)) (apis.VerifyReport, error) {
+	m.assertOpen()
+	return verifyEach(ctx, m, options, found, m.verifyVersionFile)
+}
+
+func (m *FilesystemStorage) verifyVersionFile(chunk apis.ChunkNum, version apis.Version) (uint64, error) {
+	fi, err := os.Lstat(m.chunkFilename(chunk, version))
+	if err != nil {
+		return 0, err
+	}
+	problem, _, ok := m.checkVersionFile(chunk, fi, IntegrityCheckChecksums)
+	m.metrics.Add(CounterFileOpens, 1)
+	m.metrics.Add(CounterBytesRead, uint64(fi.Size()))
+	if !ok {
+		return uint64(fi.Size()), fmt.Errorf("%s: %s", problem.Kind, problem.Detail)
+	}
+	return uint64(fi.Size()), nil
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+func collectFindings(findings *[]apis.VerifyFinding) func(apis.VerifyFinding) {
+	return func(finding apis.VerifyFinding) {
+		*findings = append(*findings, finding)
+	}
+}
+
+func problemFindings(findings []apis.VerifyFinding) map[apis.ChunkVersion]apis.VerifyStatus {
+	problems := map[apis.ChunkVersion]apis.VerifyStatus{}
+	for _, finding := range findings {
+		if finding.Status != apis.VerifyOK {
+			problems[apis.ChunkVersion{Chunk: finding.Chunk, Version: finding.Version}] = finding.Status
+		}
+	}
+	return problems
+}
+
+func TestFilesystemVerifyAll(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "verify-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := ConfigureFilesystemStorageWithOptions(dir, FilesystemOptions{MappedReadCapacity: 1024 * 1024})
+	require.NoError(t, err)
+	defer s.Close()
+	fs := s.(*FilesystemStorage)
+	for chunk := apis.ChunkNum(1); chunk <= 4; chunk++ {
+		for version := apis.Version(1); version <= 2; version++ {
+			require.NoError(t, fs.WriteVersion(chunk, version, []byte("some chunk data")))
+		}
+		require.NoError(t, fs.SetLatestVersion(chunk, 2))
+		// mapped before it's damaged, so that reading it back would still see the intact data
+		_, err := fs.ReadVersion(chunk, 2)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, os.Truncate(fs.chunkFilename(1, 2), chunkFileHeaderSize+4))
+	encoded, err := ioutil.ReadFile(fs.chunkFilename(3, 1))
+	require.NoError(t, err)
+	encoded[chunkFileHeaderSize] ^= 0x20
+	require.NoError(t, ioutil.WriteFile(fs.chunkFilename(3, 1), encoded, 0644))
+	require.NoError(t, os.Remove(fs.chunkFilename(4, 2)))
+
+	var findings []apis.VerifyFinding
+	report, err := VerifyAll(context.Background(), s, VerifyOptions{}, collectFindings(&findings))
+	require.NoError(t, err)
+	assert.Equal(map[apis.ChunkVersion]apis.VerifyStatus{
+		{Chunk: 1, Version: 2}: apis.VerifyCorrupt,
+		{Chunk: 3, Version: 1}: apis.VerifyCorrupt,
+		{Chunk: 4, Version: 2}: apis.VerifyMissing,
+	}, problemFindings(findings))
+	assert.Equal(uint64(5), report.OK)
+	assert.Equal(uint64(2), report.Corrupt)
+	assert.Equal(uint64(1), report.Missing)
+	assert.True(report.Bytes > 0)
+	assert.Len(findings, 8)
+	for i := 1; i < len(findings); i++ {
+		assert.True(findings[i-1].Chunk <= findings[i].Chunk)
+	}
+	for _, finding := range findings {
+		if finding.Status == apis.VerifyCorrupt {
+			assert.NotEmpty(finding.Detail)
+		}
+	}
+}
+
+func TestVerifyAllByReading(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mem, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	s := WithFaults(mem)
+	defer s.Close()
+	require.NoError(t, s.WriteVersion(1, 1, []byte("hello")))
+	require.NoError(t, s.SetLatestVersion(1, 1))
+	require.NoError(t, s.SetLatestVersion(2, 3))
+
+	var findings []apis.VerifyFinding
+	var mu sync.Mutex
+	report, err := VerifyAll(context.Background(), s, VerifyOptions{Lock: &mu}, collectFindings(&findings))
+	require.NoError(t, err)
+	assert.Equal([]apis.VerifyFinding{
+		{Chunk: 1, Version: 1, Status: apis.VerifyOK},
+		{Chunk: 2, Version: 3, Status: apis.VerifyMissing, Detail: "latest version is not stored"},
+	}, findings)
+	assert.Equal(uint64(5), report.Bytes)
+}
+
+func TestVerifyAllCancelled(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	s, err := ConfigureMemoryStorage()
+	require.NoError(t, err)
+	defer s.Close()
+	for chunk := apis.ChunkNum(1); chunk <= 3; chunk++ {
+		require.NoError(t, s.WriteVersion(chunk, 1, make([]byte, 1000)))
+	}
+
+	// at a thousand bytes a second, the first chunk alone would take a second
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	var findings []apis.VerifyFinding
+	report, err := VerifyAll(ctx, s, VerifyOptions{BytesPerSecond: 1000}, collectFindings(&findings))
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < 500*time.Millisecond)
+	assert.Equal(uint64(1), report.OK)
+	assert.Len(findings, 1)
+}
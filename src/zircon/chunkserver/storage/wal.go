@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"zircon/apis"
+)
+
+// A write-ahead log for FilesystemStorage. Before each mutation, a record of the intended change (including any data to
+// be written) is durably appended to the log; once the change has been applied, the log is truncated. On startup, any
+// records still in the log are replayed, so that a crash partway through a mutation deterministically leaves storage in
+// the state from after that mutation. A record that was itself only partially written is discarded, which leaves
+// storage in the state from before the mutation.
+type writeAheadLog struct {
+	file    *os.File
+	metrics MetricsSink
+}
+
+type walOp uint8
+
+const (
+	walWriteVersion walOp = iota + 1
+	walDeleteVersion
+	walSetLatest
+	walDeleteLatest
+	walLinkVersion
+)
+
+// Marks the start of each record, to help catch garbage in the log.
+const walMagic = 0x5A
+
+type walRecord struct {
+	op      walOp
+	chunk   apis.ChunkNum
+	version apis.Version
+	data    []byte
+}
+
+// magic(1) op(1) chunk(8) version(8) length(4)
+const walHeaderSize = 22
+
+func (r walRecord) encode() []byte {
+	buf := make([]byte, walHeaderSize+len(r.data)+4)
+	buf[0] = walMagic
+	buf[1] = byte(r.op)
+	binary.LittleEndian.PutUint64(buf[2:], uint64(r.chunk))
+	binary.LittleEndian.PutUint64(buf[10:], uint64(r.version))
+	binary.LittleEndian.PutUint32(buf[18:], uint32(len(r.data)))
+	copy(buf[walHeaderSize:], r.data)
+	checksum := crc32.ChecksumIEEE(buf[:walHeaderSize+len(r.data)])
+	binary.LittleEndian.PutUint32(buf[walHeaderSize+len(r.data):], checksum)
+	return buf
+}
+
+// Decodes as many complete and valid records as possible. Anything after the first torn or corrupted record is ignored,
+// because nothing after it can have been applied.
+func decodeWalRecords(data []byte) []walRecord {
+	var records []walRecord
+	for len(data) >= walHeaderSize+4 && data[0] == walMagic {
+		length := int(binary.LittleEndian.Uint32(data[18:]))
+		if length > apis.MaxChunkSize || len(data) < walHeaderSize+length+4 {
+			break
+		}
+		expected := binary.LittleEndian.Uint32(data[walHeaderSize+length:])
+		if crc32.ChecksumIEEE(data[:walHeaderSize+length]) != expected {
+			break
+		}
+		recordData := make([]byte, length)
+		copy(recordData, data[walHeaderSize:])
+		records = append(records, walRecord{
+			op:      walOp(data[1]),
+			chunk:   apis.ChunkNum(binary.LittleEndian.Uint64(data[2:])),
+			version: apis.Version(binary.LittleEndian.Uint64(data[10:])),
+			data:    recordData,
+		})
+		data = data[walHeaderSize+length+4:]
+	}
+	return records
+}
+
+// Reads any records left over from a previous run, without opening the log for writing.
+func readWalRecords(path string) ([]walRecord, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return decodeWalRecords(data), nil
+}
+
+func openWriteAheadLog(path string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, os.FileMode(0644))
+	if err != nil {
+		return nil, err
+	}
+	return &writeAheadLog{file: file, metrics: NoMetrics}, nil
+}
+
+// Durably record an intended mutation. Must only be called once the mutation's preconditions have been checked, so that
+// replaying it is always valid.
+func (l *writeAheadLog) begin(record walRecord) error {
+	n, err := l.file.Write(record.encode())
+	l.metrics.Add(CounterBytesWritten, uint64(n))
+	if err != nil {
+		return fmt.Errorf("[wal.go/WRT] %v", err)
+	}
+	if err := syncFile(l.file, l.metrics); err != nil {
+		return fmt.Errorf("[wal.go/SYN] %v", err)
+	}
+	return nil
+}
+
+// Mark every recorded mutation as fully applied.
+func (l *writeAheadLog) finish() error {
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("[wal.go/TRN] %v", err)
+	}
+	if _, err := l.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("[wal.go/SEK] %v", err)
+	}
+	return syncFile(l.file, l.metrics)
+}
+
+func (l *writeAheadLog) close() error {
+	return l.file.Close()
+}
+
+// Re-apply a logged mutation. Every operation here must be idempotent, because the mutation may have already been
+// partially or completely applied before the crash.
+func (m *FilesystemStorage) replay(record walRecord) error {
+	switch record.op {
+	case walWriteVersion:
+		// whatever the crash left of the version is replaced in one step, as it would have been the first time
+		return m.installVersion(record.chunk, record.version, encodeChunkFile(record.data), true)
+	case walDeleteVersion:
+		err := os.Remove(m.chunkFilename(record.chunk, record.version))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		_ = os.Remove(m.chunkDir(record.chunk))
+		return nil
+	case walLinkVersion:
+		existing, err := decodeLinkSource(record.data)
+		if err != nil {
+			return err
+		}
+		err = os.Link(m.chunkFilename(record.chunk, existing), m.chunkFilename(record.chunk, record.version))
+		if err != nil && !os.IsExist(err) {
+			return err
+		}
+		return nil
+	case walSetLatest:
+		return writeFileSynced(m.latestFilename(record.chunk), []byte(fmt.Sprintln(record.version)), os.FileMode(0644), m.metrics)
+	case walDeleteLatest:
+		err := os.Remove(m.latestFilename(record.chunk))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown write-ahead log operation: %d", record.op)
+	}
+}
+
+// A link record carries the version being linked to in place of data.
+func encodeLinkSource(existing apis.Version) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(existing))
+	return data
+}
+
+func decodeLinkSource(data []byte) (apis.Version, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("malformed link record: %d bytes", len(data))
+	}
+	return apis.Version(binary.LittleEndian.Uint64(data)), nil
+}
+
+// Replays anything left in the log at this path, and then empties it.
+func (m *FilesystemStorage) recover(path string) error {
+	records, err := readWalRecords(path)
+	if err != nil {
+		return fmt.Errorf("[wal.go/RWR] %v", err)
+	}
+	for _, record := range records {
+		if err := m.replay(record); err != nil {
+			return fmt.Errorf("[wal.go/RPL] %v", err)
+		}
+	}
+	if len(records) > 0 {
+		if err := syncPath(m.path, m.metrics); err != nil {
+			return fmt.Errorf("[wal.go/SYP] %v", err)
+		}
+	}
+	err = os.Truncate(path, 0)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("[wal.go/TRN] %v", err)
+	}
+	return nil
+}
+
+// Run a mutation, logging it first if the write-ahead log is enabled.
+func (m *FilesystemStorage) logged(record walRecord, apply func() error) error {
+	if m.log == nil {
+		return apply()
+	}
+	if err := m.log.begin(record); err != nil {
+		return err
+	}
+	err := apply()
+	if err2 := m.log.finish(); err2 != nil {
+		if err == nil {
+			return err2
+		}
+		return fmt.Errorf("multiple errors: { %v } and { %v }", err, err2)
+	}
+	return err
+}
+
+// like ioutil.WriteFile, but also makes sure the data is durable before returning
+func writeFileSynced(filename string, data []byte, perm os.FileMode, metrics MetricsSink) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	metrics.Add(CounterFileOpens, 1)
+	n, err := f.Write(data)
+	metrics.Add(CounterBytesWritten, uint64(n))
+	if err == nil && n < len(data) {
+		err = io.ErrShortWrite
+	}
+	if err == nil {
+		err = syncFile(f, metrics)
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"testing"
+	"zircon/apis"
+)
+
+func openLogged(t *testing.T, dir string) *FilesystemStorage {
+	fs, err := ConfigureFilesystemStorage(dir, true)
+	require.NoError(t, err)
+	return fs.(*FilesystemStorage)
+}
+
+// Abandon a storage instance without any cleanup, as if the process had died.
+func crash(fs *FilesystemStorage) {
+	_ = fs.log.file.Close()
+	fs.isClosed = true
+}
+
+func TestWriteAheadLogRecovery(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	dir, err := ioutil.TempDir("", "wal-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	test := func(name string, run func()) {
+		t.Logf("subtest: %s", name)
+		require.NoError(t, os.RemoveAll(dir))
+		require.NoError(t, os.Mkdir(dir, 0755))
+		run()
+	}
+
+	test("crash after staging a new version, before it is written", func() {
+		fs := openLogged(t, dir)
+		assert.NoError(fs.WriteVersion(71, 1, []byte("version one")))
+		assert.NoError(fs.SetLatestVersion(71, 1))
+
+		assert.NoError(fs.log.begin(walRecord{op: walWriteVersion, chunk: 71, version: 2, data: []byte("version two")}))
+		crash(fs)
+
+		fs = openLogged(t, dir)
+		defer fs.Close()
+		versions, err := fs.ListVersions(71)
+		assert.NoError(err)
+		assert.Equal([]apis.Version{1, 2}, versions)
+		data, err := fs.ReadVersion(71, 2)
+		assert.NoError(err)
+		assert.Equal("version two", string(data))
+		latest, err := fs.GetLatestVersion(71)
+		assert.NoError(err)
+		assert.Equal(apis.Version(1), latest)
+	})
+
+	test("crash partway through writing a version", func() {
+		fs := openLogged(t, dir)
+		assert.NoError(fs.log.begin(walRecord{op: walWriteVersion, chunk: 71, version: 1, data: []byte("complete data")}))
+		require.NoError(t, os.MkdirAll(fs.chunkDir(71), 0755))
+		require.NoError(t, ioutil.WriteFile(fs.chunkFilename(71, 1), []byte("compl"), 0644))
+		crash(fs)
+
+		fs = openLogged(t, dir)
+		defer fs.Close()
+		data, err := fs.ReadVersion(71, 1)
+		assert.NoError(err)
+		assert.Equal("complete data", string(data))
+	})
+
+	test("crash before linking a version", func() {
+		fs := openLogged(t, dir)
+		assert.NoError(fs.WriteVersion(71, 1, []byte("version one")))
+		assert.NoError(fs.log.begin(walRecord{op: walLinkVersion, chunk: 71, version: 2, data: encodeLinkSource(1)}))
+		crash(fs)
+
+		fs = openLogged(t, dir)
+		defer fs.Close()
+		data, err := fs.ReadVersion(71, 2)
+		assert.NoError(err)
+		assert.Equal("version one", string(data))
+	})
+
+	test("crash before committing a new latest version", func() {
+		fs := openLogged(t, dir)
+		assert.NoError(fs.WriteVersion(71, 1, []byte("version one")))
+		assert.NoError(fs.SetLatestVersion(71, 1))
+		assert.NoError(fs.WriteVersion(71, 2, []byte("version two")))
+
+		assert.NoError(fs.log.begin(walRecord{op: walSetLatest, chunk: 71, version: 2}))
+		assert.NoError(fs.log.begin(walRecord{op: walDeleteVersion, chunk: 71, version: 1}))
+		crash(fs)
+
+		fs = openLogged(t, dir)
+		defer fs.Close()
+		latest, err := fs.GetLatestVersion(71)
+		assert.NoError(err)
+		assert.Equal(apis.Version(2), latest)
+		versions, err := fs.ListVersions(71)
+		assert.NoError(err)
+		assert.Equal([]apis.Version{2}, versions)
+	})
+
+	test("torn log record is rolled back", func() {
+		fs := openLogged(t, dir)
+		assert.NoError(fs.WriteVersion(71, 1, []byte("version one")))
+		assert.NoError(fs.SetLatestVersion(71, 1))
+
+		encoded := walRecord{op: walSetLatest, chunk: 71, version: 2}.encode()
+		_, err := fs.log.file.Write(encoded[:len(encoded)-3])
+		assert.NoError(err)
+		crash(fs)
+
+		fs = openLogged(t, dir)
+		defer fs.Close()
+		latest, err := fs.GetLatestVersion(71)
+		assert.NoError(err)
+		assert.Equal(apis.Version(1), latest)
+	})
+
+	test("log is empty after recovery", func() {
+		fs := openLogged(t, dir)
+		assert.NoError(fs.log.begin(walRecord{op: walSetLatest, chunk: 71, version: 2}))
+		crash(fs)
+
+		fs = openLogged(t, dir)
+		fs.Close()
+		records, err := readWalRecords(fs.walFilename())
+		assert.NoError(err)
+		assert.Empty(records)
+	})
+
+	test("existing versions are never overwritten", func() {
+		fs := openLogged(t, dir)
+		defer fs.Close()
+		assert.NoError(fs.WriteVersion(71, 1, []byte("version one")))
+		assert.Error(fs.WriteVersion(71, 1, []byte("imposter")))
+		records, err := readWalRecords(fs.walFilename())
+		assert.NoError(err)
+		assert.Empty(records)
+	})
+}
@@ -2,28 +2,110 @@ package chunkserver
 
 import (
 	"github.com/stretchr/testify/require"
+	"log"
 	"testing"
+	"time"
 	"zircon/apis"
 	"zircon/chunkserver/control"
 	"zircon/chunkserver/storage"
 	"zircon/rpc"
 )
 
+// Reports what a test chunkserver's storage currently holds.
+type TestStats func() storage.StorageStats
+
 // returns number of bytes of storage used, at a rough approximation
+// Deprecated: use TestStats, which can tell chunks, versions, and staged data apart.
 type StorageStats func() int
 
-func NewTestChunkserver(t *testing.T, cache rpc.ConnectionCache) (apis.Chunkserver, StorageStats, control.Teardown) {
-	mem, err := storage.ConfigureMemoryStorage()
+// Reduces the stats to the rough byte count of a StorageStats, for tests that haven't moved over yet. chunkSize is the
+// maximum chunk size the chunkserver was configured with, as reported by control.MaxChunkSizeOf.
+func (s TestStats) Approximate(chunkSize uint32) StorageStats {
+	return func() int {
+		stats := s()
+		// count every version as a full chunk, so that growing a chunk in place doesn't look like a leak
+		return int(stats.Versions)*int(chunkSize) + int(stats.StagedBytes)
+	}
+}
+
+func NewTestChunkserver(t *testing.T, cache rpc.ConnectionCache) (apis.Chunkserver, TestStats, control.Teardown) {
+	return NewTestChunkserverWithOptions(t, cache, control.ChunkserverOptions{}, ChatterOptions{})
+}
+
+// Like NewTestChunkserver, but with non-default options, so that tests can exercise other configurations. The storage is
+// opened from options.Backend, if it names one, and is in memory otherwise.
+func NewTestChunkserverWithOptions(t *testing.T, cache rpc.ConnectionCache, options control.ChunkserverOptions, chatter ChatterOptions) (apis.Chunkserver, TestStats, control.Teardown) {
+	if options.Backend == "" {
+		options.Backend = "memory"
+	}
+	single, store, shutdown, err := control.OpenChunkserver(options)
+	require.NoError(t, err)
+	teardown := func() {
+		if err := shutdown(time.Now().Add(control.TeardownGracePeriod)); err != nil {
+			log.Printf("chunkserver did not shut down cleanly: %v", err)
+		}
+	}
+	server, err := WithChatterOptions(single, cache, chatter)
+	require.NoError(t, err)
+
+	stats := func() storage.StorageStats {
+		stats, err := store.Stats()
+		require.NoError(t, err)
+		return stats
+	}
+
+	return server, stats, teardown
+}
+
+// The state of a test chunkserver that is slow to build, captured once so that each subtest can start from its own
+// copy of it, rather than building it again or sharing one chunkserver between subtests.
+type TestFixture struct {
+	snapshot *storage.MemorySnapshot
+}
+
+// Builds a fixture by running populate against a new in-memory test chunkserver, which is shut down afterwards. Writes
+// that populate leaves uncommitted are not part of the fixture.
+func BuildTestFixture(t *testing.T, cache rpc.ConnectionCache, populate func(server apis.Chunkserver)) TestFixture {
+	store, err := storage.ConfigureMemoryStorage()
 	require.NoError(t, err)
-	single, teardown, err := control.ExposeChunkserver(mem)
+	defer store.Close()
+	single, shutdown, err := control.ExposeChunkserverWithOptions(store, control.ChunkserverOptions{})
 	require.NoError(t, err)
 	server, err := WithChatter(single, cache)
 	require.NoError(t, err)
+	populate(server)
+	require.NoError(t, shutdown(time.Now().Add(control.TeardownGracePeriod)))
+	return TestFixture{snapshot: store.(*storage.MemoryStorage).Snapshot(storage.SnapshotOptions{})}
+}
 
-	stats := mem.(*storage.MemoryStorage).StatsForTesting
+// Like NewTestChunkserver, but starts out holding everything in the fixture. Every chunkserver started from a fixture
+// has its own copy of its storage, so they can be changed independently, and used from parallel subtests.
+func (f TestFixture) NewChunkserver(t *testing.T, cache rpc.ConnectionCache) (apis.Chunkserver, TestStats, control.Teardown) {
+	store := storage.CloneStorage(f.snapshot)
+	single, shutdown, err := control.ExposeChunkserverWithOptions(store, control.ChunkserverOptions{})
+	require.NoError(t, err)
+	teardown := func() {
+		if err := shutdown(time.Now().Add(control.TeardownGracePeriod)); err != nil {
+			log.Printf("chunkserver did not shut down cleanly: %v", err)
+		}
+		store.Close()
+	}
+	server, err := WithChatter(single, cache)
+	require.NoError(t, err)
 
-	return server, stats, func() {
-		teardown()
-		mem.Close()
+	stats := func() storage.StorageStats {
+		stats, err := store.Stats()
+		require.NoError(t, err)
+		return stats
 	}
+
+	return server, stats, teardown
+}
+
+// Registers a test chunkserver in etcd as live, the same way that a real one registers itself. The returned teardown
+// only stops the heartbeats, so that it can safely be called after the etcd server has been shut down.
+func RegisterTestChunkserver(t *testing.T, etcd apis.EtcdInterface, address apis.ServerAddress) func() {
+	registration, err := Register(etcd, address, DefaultRegistrationTTL)
+	require.NoError(t, err)
+	return registration.abandon
 }
@@ -0,0 +1,143 @@
+package chunkserver
+
+import (
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+// Limits the average rate of a series of transfers, by making each one wait until the transfers before it, and then
+// itself, would have taken at the configured rate. Threadsafe. A nil throttle never waits.
+type throttle struct {
+	mu          sync.Mutex
+	bytesPerSec int64
+	// when the transfers reserved so far will all have had their time
+	next time.Time
+}
+
+func newThrottle(bytesPerSec int64) *throttle {
+	if bytesPerSec == 0 {
+		return nil
+	}
+	return &throttle{bytesPerSec: bytesPerSec}
+}
+
+// Blocks until a transfer of this many bytes can go ahead without exceeding the rate.
+func (t *throttle) wait(bytes int) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	t.next = t.next.Add(time.Duration(int64(bytes) * int64(time.Second) / t.bytesPerSec))
+	until := t.next
+	t.mu.Unlock()
+	time.Sleep(until.Sub(now))
+}
+
+// Limits how many transfers to other chunkservers can be underway at once, both in total and to any one peer, so that
+// a server that many others are repairing from still has disk and network left over for its clients. Transfers past
+// the limits wait their turn for up to a fixed time, and are then turned away. Threadsafe. A nil limiter lets every
+// transfer through immediately.
+type transferLimiter struct {
+	// nil if there is no limit on the total
+	total   chan struct{}
+	perPeer int
+	timeout time.Duration
+
+	mu    sync.Mutex
+	peers map[apis.ServerAddress]chan struct{}
+	// transfers that had to wait for a turn, and transfers that gave up waiting
+	throttled uint64
+	rejected  uint64
+}
+
+func newTransferLimiter(total int, perPeer int, timeout time.Duration) *transferLimiter {
+	if total == 0 && perPeer == 0 {
+		return nil
+	}
+	l := &transferLimiter{
+		perPeer: perPeer,
+		timeout: timeout,
+		peers:   map[apis.ServerAddress]chan struct{}{},
+	}
+	if total > 0 {
+		l.total = make(chan struct{}, total)
+	}
+	return l
+}
+
+// Waits for a turn to transfer to a peer, and returns a function to call once the transfer is over. Fails with
+// ErrSourceBusy if no turn comes up in time.
+func (l *transferLimiter) acquire(peer apis.ServerAddress) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	slots := []chan struct{}{l.peerSlots(peer), l.total}
+	var taken []chan struct{}
+	release := func() {
+		for _, slot := range taken {
+			<-slot
+		}
+	}
+	var timer *time.Timer
+	for _, slot := range slots {
+		if slot == nil {
+			continue
+		}
+		select {
+		case slot <- struct{}{}:
+			taken = append(taken, slot)
+			continue
+		default:
+		}
+		if timer == nil {
+			l.count(&l.throttled)
+			timer = time.NewTimer(l.timeout)
+			defer timer.Stop()
+		}
+		select {
+		case slot <- struct{}{}:
+			taken = append(taken, slot)
+		case <-timer.C:
+			release()
+			l.count(&l.rejected)
+			return nil, apis.NewRetryableError(apis.ErrSourceBusy, l.timeout,
+				"too many transfers already underway to send chunk to %s", peer)
+		}
+	}
+	return release, nil
+}
+
+func (l *transferLimiter) peerSlots(peer apis.ServerAddress) chan struct{} {
+	if l.perPeer == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	slots, found := l.peers[peer]
+	if !found {
+		slots = make(chan struct{}, l.perPeer)
+		l.peers[peer] = slots
+	}
+	return slots
+}
+
+func (l *transferLimiter) count(counter *uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	*counter += 1
+}
+
+// Returns how many transfers have had to wait for a turn, and how many gave up waiting.
+func (l *transferLimiter) counts() (throttled uint64, rejected uint64) {
+	if l == nil {
+		return 0, 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.throttled, l.rejected
+}
@@ -2,6 +2,7 @@ package chunkupdate
 
 import (
 	"zircon/apis"
+	"zircon/rpc"
 )
 
 func ListChunkservers(etcd apis.EtcdInterface) ([]apis.ServerID, error) {
@@ -9,6 +10,20 @@ func ListChunkservers(etcd apis.EtcdInterface) ([]apis.ServerID, error) {
 	if err != nil {
 		return nil, err
 	}
+	return idsForNames(etcd, names)
+}
+
+// Lists only the chunkservers that currently hold a live registration, as kept up by a running chunkserver's
+// heartbeats. A chunkserver that crashes drops out of this list once its registration's lease expires.
+func ListLiveChunkservers(etcd apis.EtcdInterface) ([]apis.ServerID, error) {
+	names, err := etcd.ListLiveServers(apis.CHUNKSERVER)
+	if err != nil {
+		return nil, err
+	}
+	return idsForNames(etcd, names)
+}
+
+func idsForNames(etcd apis.EtcdInterface, names []apis.ServerName) ([]apis.ServerID, error) {
 	ids := make([]apis.ServerID, len(names))
 	for i, name := range names {
 		id, err := etcd.GetIDByName(name)
@@ -27,3 +42,28 @@ func AddressForChunkserver(etcd apis.EtcdInterface, chunkserver apis.ServerID) (
 	}
 	return etcd.GetAddress(name, apis.CHUNKSERVER)
 }
+
+// Connects to a chunkserver by its ID. Its address is looked up afresh every time, so that a chunkserver that has
+// restarted somewhere else is followed to its new address.
+func SubscribeChunkserverByID(etcd apis.EtcdInterface, cache rpc.ConnectionCache, chunkserver apis.ServerID) (apis.Chunkserver, error) {
+	_, cs, err := ResolveChunkserver(etcd, cache, chunkserver)
+	return cs, err
+}
+
+// Like SubscribeChunkserverByID, but also returns the address that was connected to. The address is only looked up
+// once, so it always agrees with the connection, even if the chunkserver moves in between.
+func ResolveChunkserver(etcd apis.EtcdInterface, cache rpc.ConnectionCache, chunkserver apis.ServerID) (apis.ServerAddress, apis.Chunkserver, error) {
+	name, err := etcd.GetNameByID(chunkserver)
+	if err != nil {
+		return "", nil, err
+	}
+	address, err := etcd.GetAddress(name, apis.CHUNKSERVER)
+	if err != nil {
+		return "", nil, err
+	}
+	cs, err := cache.SubscribeChunkserverByName(name, rpc.ResolvedAddress(address))
+	if err != nil {
+		return "", nil, err
+	}
+	return address, cs, nil
+}
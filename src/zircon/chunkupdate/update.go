@@ -14,6 +14,16 @@ type Reference struct {
 	Chunk    apis.ChunkNum
 	Version  apis.Version
 	Replicas []apis.ServerAddress
+	// The maximum chunk size of the cluster, or zero for the default of apis.MaxChunkSize.
+	ChunkSize uint32
+}
+
+// The most that can be read from or written to the chunk, which is the configured chunk size.
+func (ref *Reference) MaxSize() uint32 {
+	if ref.ChunkSize == 0 {
+		return apis.MaxChunkSize
+	}
+	return ref.ChunkSize
 }
 
 type Updater interface {
@@ -21,17 +31,18 @@ type Updater interface {
 	ReadMeta(chunk apis.ChunkNum) (*Reference, error)
 	CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (apis.Version, error)
 	Delete(chunk apis.ChunkNum, version apis.Version) error
+	ChunkSize() (uint32, error)
 }
 
 // Performs a read.
 // Preconditions:
-//   offset + length <= apis.MaxChunkSize
+//   offset + length <= ref.MaxSize()
 //   ref is fully populated
 // Postconditions:
 //   Either returns data and its valid version (of at least this ref's version) read from a chunkserver
 //   Or fails, if all chunkservers failed to respond
 func (ref *Reference) PerformRead(cache rpc.ConnectionCache, offset uint32, length uint32) ([]byte, apis.Version, error) {
-	if offset + length > apis.MaxChunkSize {
+	if offset + length > ref.MaxSize() {
 		return nil, 0, errors.New("read too long")
 	}
 	if len(ref.Replicas) == 0 {
@@ -68,14 +79,14 @@ func (ref *Reference) PerformRead(cache rpc.ConnectionCache, offset uint32, leng
 
 // Prepares a write.
 // Preconditions:
-//   offset + length <= apis.MaxChunkSize
+//   offset + length <= ref.MaxSize()
 //   ref is populated
 // Postconditions:
 //   If possible, all chunkservers have a copy of the data, directly or indirectly.
 //   On success, Returns the valid commit hash for this data.
 //   Fails if any server fails to connect, directly or indirectly.
 func (ref *Reference) PrepareWrite(cache rpc.ConnectionCache, offset uint32, data []byte) (apis.CommitHash, error) {
-	if offset + uint32(len(data)) > apis.MaxChunkSize {
+	if offset + uint32(len(data)) > ref.MaxSize() {
 		return "", errors.New("write too long")
 	}
 	if len(ref.Replicas) == 0 {
@@ -96,6 +107,83 @@ func (ref *Reference) PrepareWrite(cache rpc.ConnectionCache, offset uint32, dat
 	return apis.CalculateCommitHash(offset, data), nil
 }
 
+// Anything that can commit a prepared write to every replica of a chunk, such as an Updater or a Frontend.
+type WriteCommitter interface {
+	CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (apis.Version, error)
+}
+
+// Performs a complete write: prepares it on every replica, and then commits it through the committer, which must not
+// leave the new version behind on any replica if the commit fails.
+// Preconditions:
+//   offset + length <= ref.MaxSize()
+//   ref is fully populated
+// Postconditions:
+//   On success, every replica serves the written data, and the new version is returned.
+//   On failure, no replica serves the written data. If the failure was due to staleness, the most recent version may
+//   be returned; otherwise, the version is zero.
+func (ref *Reference) PerformWrite(cache rpc.ConnectionCache, committer WriteCommitter, offset uint32, data []byte) (apis.Version, error) {
+	hash, err := ref.PrepareWrite(cache, offset, data)
+	if err != nil {
+		return 0, fmt.Errorf("[update.go/RPW] %v", err)
+	}
+	version, err := committer.CommitWrite(ref.Chunk, ref.Version, hash)
+	if err != nil {
+		return version, fmt.Errorf("[update.go/CCW] %v", err)
+	}
+	return version, nil
+}
+
+// Commits a prepared write on all replicas concurrently. If any replica fails to commit, the replicas that did commit
+// have the new version rolled back, so that it never ends up stored on only part of the replica set.
+func commitAll(replicas []apis.Chunkserver, chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version, newVersion apis.Version) error {
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for i, replica := range replicas {
+		wg.Add(1)
+		go func(i int, replica apis.Chunkserver) {
+			defer wg.Done()
+			errs[i] = replica.CommitWrite(chunk, hash, oldVersion, newVersion)
+		}(i, replica)
+	}
+	wg.Wait()
+
+	var firstErr error
+	for _, err := range errs {
+		if err != nil {
+			firstErr = err
+			break
+		}
+	}
+	if firstErr == nil {
+		return nil
+	}
+
+	rollbackErrs := make([]error, len(replicas))
+	for i, replica := range replicas {
+		if errs[i] != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, replica apis.Chunkserver) {
+			defer wg.Done()
+			// newVersion was never made latest, so this only removes the version we just committed
+			err := replica.Delete(chunk, newVersion)
+			if apis.ErrorCodeOf(err) == apis.ErrAlreadyDeleted {
+				err = nil
+			}
+			rollbackErrs[i] = err
+		}(i, replica)
+	}
+	wg.Wait()
+
+	for _, err := range rollbackErrs {
+		if err != nil {
+			return fmt.Errorf("%v (and could not roll back other replicas: %v)", firstErr, err)
+		}
+	}
+	return firstErr
+}
+
 type UpdaterMetadata interface {
 	NewEntry() (apis.ChunkNum, error)
 	ReadEntry(chunk apis.ChunkNum) (apis.MetadataEntry, error)
@@ -108,6 +196,8 @@ type updater struct {
 	cache    rpc.ConnectionCache
 	metadata UpdaterMetadata
 	etcd     apis.EtcdInterface
+	// the chunk size recorded for the cluster, once it's been looked up
+	chunkSize uint32
 }
 
 func NewUpdater(cache rpc.ConnectionCache, etcd apis.EtcdInterface, metadata UpdaterMetadata) Updater {
@@ -122,7 +212,8 @@ func (f *updater) selectInitialChunkservers(replicas int) ([]apis.ServerID, erro
 	if replicas <= 0 {
 		return nil, errors.New("must request at least one replica")
 	}
-	chunkservers, err := ListChunkservers(f.etcd)
+	// only place new chunks on chunkservers that are known to be up
+	chunkservers, err := ListLiveChunkservers(f.etcd)
 	if err != nil {
 		return nil, err
 	}
@@ -163,14 +254,11 @@ func (f *updater) New(replicaNum int) (apis.ChunkNum, error) {
 	}
 	// now that we've established the replicas for this chunk, we need to go and tell the chunkservers to store this data
 	for _, replica := range replicas {
-		address, err := AddressForChunkserver(f.etcd, replica)
-		if err != nil {
-			return 0, fmt.Errorf("[update.go/AFC] %v", err)
-		}
-		cs, err := f.cache.SubscribeChunkserver(address)
+		cs, err := SubscribeChunkserverByID(f.etcd, f.cache, replica)
 		if err != nil {
 			return 0, fmt.Errorf("[update.go/CSC] %v", err)
 		}
+		// the chunk number was only just allocated, so an existing copy would mean something has gone badly wrong
 		err = cs.Add(chunk, []byte{}, 0)
 		if err != nil {
 			return 0, fmt.Errorf("[update.go/CSA] %v", err)
@@ -192,13 +280,9 @@ func (f *updater) getReplicaAddresses(entry apis.MetadataEntry) ([]apis.ServerAd
 }
 
 func (f *updater) subscribeReplicas(entry apis.MetadataEntry) ([]apis.Chunkserver, error) {
-	replicaAddresses, err := f.getReplicaAddresses(entry)
-	if err != nil {
-		return nil, err
-	}
-	replicas := make([]apis.Chunkserver, len(replicaAddresses))
-	for i, addr := range replicaAddresses {
-		cs, err := f.cache.SubscribeChunkserver(addr)
+	replicas := make([]apis.Chunkserver, len(entry.Replicas))
+	for i, id := range entry.Replicas {
+		cs, err := SubscribeChunkserverByID(f.etcd, f.cache, id)
 		if err != nil {
 			return nil, err
 		}
@@ -228,13 +312,36 @@ func (f *updater) ReadMeta(chunk apis.ChunkNum) (*Reference, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failure while getting metadata addresses: %v", err)
 	}
+	chunkSize, err := f.ChunkSize()
+	if err != nil {
+		return nil, fmt.Errorf("failure while getting chunk size: %v", err)
+	}
 	return &Reference{
 		Chunk: chunk,
 		Version: entry.MostRecentVersion,
 		Replicas: addresses,
+		ChunkSize: chunkSize,
 	}, nil
 }
 
+// Returns the maximum chunk size recorded for the cluster. Until the first chunkserver has recorded one, the default of
+// apis.MaxChunkSize is assumed, and the lookup is tried again next time.
+func (f *updater) ChunkSize() (uint32, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.chunkSize == 0 {
+		size, err := f.etcd.GetChunkSize()
+		if err != nil {
+			return 0, err
+		}
+		if size == 0 {
+			return apis.MaxChunkSize, nil
+		}
+		f.chunkSize = size
+	}
+	return f.chunkSize, nil
+}
+
 // Writes metadata for a particular chunk, after each chunkserver has received a preparation message for this write.
 // Only performs the write if the version matches.
 func (f *updater) CommitWrite(chunk apis.ChunkNum, version apis.Version, hash apis.CommitHash) (apis.Version, error) {
@@ -265,11 +372,10 @@ func (f *updater) CommitWrite(chunk apis.ChunkNum, version apis.Version, hash ap
 		return 0, fmt.Errorf("while updating metadata entry: %v", err)
 	}
 	// Commit the write to the chunkservers
-	for _, replica := range replicas {
-		// TODO: accept imperfect durability for the sake of availability
-		if err := replica.CommitWrite(chunk, hash, entry.MostRecentVersion, entry.LastConsumedVersion); err != nil {
-			return 0, fmt.Errorf("while commiting writes: %v", err)
-		}
+	// TODO: accept imperfect durability for the sake of availability
+	if err := commitAll(replicas, chunk, hash, entry.MostRecentVersion, entry.LastConsumedVersion); err != nil {
+		// the reserved version is simply left consumed; the next write will reserve a fresh one
+		return 0, fmt.Errorf("while commiting writes: %v", err)
 	}
 	// Update the latest stored metadata version
 	oldEntry = entry
@@ -317,7 +423,7 @@ func (f *updater) Delete(chunk apis.ChunkNum, version apis.Version) error {
 	// TODO: think through all of the failure cases if a service simultaneously deletes the same chunk
 	for _, replica := range replicas {
 		// TODO: optimize this to not need to list all chunks
-		chunks, err := replica.ListAllChunks()
+		chunks, err := replica.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		if err != nil {
 			return err
 		}
@@ -325,6 +431,10 @@ func (f *updater) Delete(chunk apis.ChunkNum, version apis.Version) error {
 		for _, cv := range chunks {
 			if cv.Chunk == chunk {
 				err := replica.Delete(chunk, cv.Version)
+				if apis.ErrorCodeOf(err) == apis.ErrAlreadyDeleted {
+					// someone else got there first, which is just as good
+					err = nil
+				}
 				if err != nil && firstDeleteError == nil {
 					// ignore the immediate errors from these, just in case they're caused by a service doing the
 					// deletion; instead, we'll check later to make sure everything's gone.
@@ -333,7 +443,7 @@ func (f *updater) Delete(chunk apis.ChunkNum, version apis.Version) error {
 			}
 		}
 		// instead of checking each delete, we just check to make sure everything's gone now
-		chunks, err = replica.ListAllChunks()
+		chunks, err = replica.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		if err != nil {
 			return err
 		}
@@ -348,6 +458,13 @@ func (f *updater) Delete(chunk apis.ChunkNum, version apis.Version) error {
 			}
 		}
 	}
+	// Every replica has confirmed the deletion, so their tombstones have nothing left to guard against, and must not be
+	// left to get in the way if the chunk number is reused
+	for _, replica := range replicas {
+		if err := replica.ForgetTombstone(chunk); err != nil {
+			return err
+		}
+	}
 	// Now that all of the replica data is gone, we can get rid of the metadata
 	err = f.metadata.DeleteEntry(chunk, entry)
 	if err != nil {
@@ -133,6 +133,27 @@ func TestPerformRead_OneReplica_Pass_OverFull(t *testing.T) {
 	GenericTestPerformRead(t, 8, apis.MaxChunkSize-7, []bool{false})
 }
 
+// the configured chunk size is the limit, rather than apis.MaxChunkSize, without any replica being asked
+func TestReference_ConfiguredChunkSize(t *testing.T) {
+	chunkMock := &mocks.Chunkserver{}
+	cache := &rpc.MockCache{
+		Chunkservers: map[apis.ServerAddress]apis.Chunkserver{"chunk-address-0": chunkMock},
+	}
+	ref := &Reference{
+		Chunk:     1,
+		Version:   1,
+		Replicas:  []apis.ServerAddress{"chunk-address-0"},
+		ChunkSize: 4096,
+	}
+	assert.Equal(t, uint32(4096), ref.MaxSize())
+	_, _, err := ref.PerformRead(cache, 1, 4096)
+	assert.Error(t, err)
+	_, err = ref.PrepareWrite(cache, 4000, make([]byte, 97))
+	assert.Error(t, err)
+	chunkMock.AssertExpectations(t)
+	assert.Equal(t, uint32(apis.MaxChunkSize), (&Reference{}).MaxSize())
+}
+
 // test case covers: 0<x<apis.MaxChunkSize, 1, doesn't fail, 0, yes
 func TestPerformRead_OneReplica_Pass(t *testing.T) {
 	GenericTestPerformRead(t, 0, 128, []bool{false})
@@ -355,6 +376,10 @@ func GenericTestReadMeta(t *testing.T, exists bool, mrv apis.Version, lcv apis.V
 		}
 	}
 
+	if expectSuccess {
+		etcdMock.On("GetChunkSize").Return(uint32(4096), nil)
+	}
+
 	if exists {
 		metadataMock.On("ReadEntry", chunk).Return(apis.MetadataEntry{
 			Replicas:            replicaIDs,
@@ -373,6 +398,7 @@ func GenericTestReadMeta(t *testing.T, exists bool, mrv apis.Version, lcv apis.V
 		assert.NoError(t, err)
 		assert.Equal(t, chunk, ref.Chunk)
 		assert.Equal(t, mrv, ref.Version)
+		assert.Equal(t, uint32(4096), ref.ChunkSize)
 		if len(replicaAddresses) == 0 {
 			assert.Empty(t, ref.Replicas)
 		} else {
@@ -477,7 +503,7 @@ func GenericTestNew(t *testing.T, replicas int, chunkservers int) {
 	}
 
 	if replicas != 0 {
-		etcdMock.On("ListServers", apis.CHUNKSERVER).Return(chunkNames, nil)
+		etcdMock.On("ListLiveServers", apis.CHUNKSERVER).Return(chunkNames, nil)
 	}
 
 	if expectSuccess {
@@ -519,7 +545,7 @@ func GenericTestNew(t *testing.T, replicas int, chunkservers int) {
 
 	// can't check chunk mocks, because only a subset will be triggered!
 	if replicas != 0 {
-		etcdMock.AssertCalled(t, "ListServers", apis.CHUNKSERVER)
+		etcdMock.AssertCalled(t, "ListLiveServers", apis.CHUNKSERVER)
 		for _, name := range chunkNames {
 			etcdMock.AssertCalled(t, "GetIDByName", name)
 		}
@@ -609,6 +635,8 @@ func GenericTestCommitWrite(t *testing.T, exists bool, deleting bool, replicaFai
 		} else {
 			chunkMock.On("CommitWrite", chunk, expectedHash, version, lcv+1).Return(nil)
 			chunkMock.On("UpdateLatestVersion", chunk, version, lcv+1).Return(nil)
+			// only used if another replica fails
+			chunkMock.On("Delete", chunk, lcv+1).Return(nil)
 		}
 	}
 
@@ -746,25 +774,25 @@ func GenericTestDelete(t *testing.T, exists bool, deleting bool, replicaFailsLis
 		etcdMock.On("GetAddress", name, apis.CHUNKSERVER).Return(address, nil)
 
 		if fail {
-			chunkMock.On("ListAllChunks").Return(nil, errors.New("sample error for update_test"))
+			chunkMock.On("ListAllChunks", apis.AnyVersion, apis.AnyVersion).Return(nil, errors.New("sample error for update_test"))
 		} else {
 			// afterwards
 			if failDelete {
-				chunkMock.On("ListAllChunks").Return([]apis.ChunkVersion{
+				chunkMock.On("ListAllChunks", apis.AnyVersion, apis.AnyVersion).Return([]apis.ChunkVersion{
 					{chunk, version + 1},
 					{otherChunk, version},
 					{otherChunk, 3},
 					{otherChunk, version + 1},
 				}, nil)
 			} else {
-				chunkMock.On("ListAllChunks").Return([]apis.ChunkVersion{
+				chunkMock.On("ListAllChunks", apis.AnyVersion, apis.AnyVersion).Return([]apis.ChunkVersion{
 					{otherChunk, version},
 					{otherChunk, 3},
 					{otherChunk, version + 1},
 				}, nil)
 			}
 			// beforehand
-			chunkMock.On("ListAllChunks").Return([]apis.ChunkVersion{
+			chunkMock.On("ListAllChunks", apis.AnyVersion, apis.AnyVersion).Return([]apis.ChunkVersion{
 				{chunk, version},
 				{chunk, version + 1},
 				{otherChunk, version},
@@ -772,6 +800,7 @@ func GenericTestDelete(t *testing.T, exists bool, deleting bool, replicaFailsLis
 				{otherChunk, version + 1},
 			}, nil)
 			chunkMock.On("Delete", chunk, version).Return(nil)
+			chunkMock.On("ForgetTombstone", chunk).Return(nil)
 			if failDelete {
 				chunkMock.On("Delete", chunk, version+1).Return(errors.New("sample deletion error"))
 			} else {
@@ -866,3 +895,96 @@ func TestDelete_OneReplica_FailDelete(t *testing.T) {
 func TestDelete_CurrentlyDeleting(t *testing.T) {
 	GenericTestDelete(t, true, true, []bool{false}, false, 0)
 }
+
+//   PerformWrite partitions:
+//     number of replicas failing to commit: 0, 1
+//     success: yes, no
+
+// a chunkserver that accepts everything except commits
+type commitlessChunkserver struct {
+	apis.Chunkserver
+}
+
+func (c commitlessChunkserver) CommitWrite(chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version, newVersion apis.Version) error {
+	return errors.New("sample commit failure for update_test")
+}
+
+func GenericTestPerformWrite(t *testing.T, replicaFails []bool) {
+	cache := &rpc.MockCache{
+		Chunkservers: map[apis.ServerAddress]apis.Chunkserver{},
+	}
+	etcdMock := &mocks.EtcdInterface{}
+	metadataMock := &mocks2.UpdaterMetadata{}
+	updater := NewUpdater(cache, etcdMock, metadataMock)
+
+	chunk := apis.ChunkNum(rand.Uint64())
+	expectSuccess := true
+
+	var servers []apis.Chunkserver
+	var chunkserverIDs []apis.ServerID
+	var chunkserverAddresses []apis.ServerAddress
+	for csI, fail := range replicaFails {
+		expectSuccess = expectSuccess && !fail
+		replicaID := apis.ServerID(csI + 1)
+		name := apis.ServerName(fmt.Sprintf("chunkserver-%d", csI))
+		address := apis.ServerAddress(fmt.Sprintf("address-%d", csI))
+
+		server, _, teardown := chunkserver.NewTestChunkserver(t, cache)
+		defer teardown()
+		assert.NoError(t, server.Add(chunk, []byte("hello world"), 1))
+		servers = append(servers, server)
+		if fail {
+			cache.Chunkservers[address] = commitlessChunkserver{server}
+		} else {
+			cache.Chunkservers[address] = server
+		}
+
+		chunkserverIDs = append(chunkserverIDs, replicaID)
+		chunkserverAddresses = append(chunkserverAddresses, address)
+		etcdMock.On("GetNameByID", replicaID).Return(name, nil)
+		etcdMock.On("GetAddress", name, apis.CHUNKSERVER).Return(address, nil)
+	}
+
+	metadataMock.On("ReadEntry", chunk).Return(apis.MetadataEntry{
+		MostRecentVersion:   1,
+		LastConsumedVersion: 1,
+		Replicas:            chunkserverIDs,
+	}, nil)
+	metadataMock.On("UpdateEntry", chunk, mock.Anything, mock.Anything).Return(nil)
+
+	version, err := (&Reference{
+		Chunk:    chunk,
+		Version:  1,
+		Replicas: chunkserverAddresses,
+	}).PerformWrite(cache, updater, 6, []byte("WORLD"))
+
+	expected := "hello world"
+	if expectSuccess {
+		assert.NoError(t, err)
+		assert.Equal(t, apis.Version(2), version)
+		expected = "hello WORLD"
+	} else {
+		assert.Error(t, err)
+		assert.Equal(t, apis.Version(0), version)
+	}
+
+	for _, server := range servers {
+		data, readVersion, err := server.Read(chunk, 0, 11, apis.AnyVersion)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+		// if the write was rolled back, only the original version should be left anywhere
+		chunks, err := server.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
+		assert.NoError(t, err)
+		assert.Equal(t, []apis.ChunkVersion{{chunk, readVersion}}, chunks)
+	}
+}
+
+// test case covers: 0, yes
+func TestPerformWrite_ThreeReplicas(t *testing.T) {
+	GenericTestPerformWrite(t, []bool{false, false, false})
+}
+
+// test case covers: 1, no
+func TestPerformWrite_ThreeReplicas_OneCommitFails(t *testing.T) {
+	GenericTestPerformWrite(t, []bool{false, true, false})
+}
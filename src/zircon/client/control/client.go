@@ -5,11 +5,16 @@ import (
 	"zircon/rpc"
 	"zircon/chunkupdate"
 	"fmt"
+	"sync"
 )
 
 type client struct {
 	fe    apis.Frontend
 	cache rpc.ConnectionCache
+
+	mu sync.Mutex
+	// the maximum chunk size of the cluster, once it's been asked for
+	chunkSize uint32
 }
 
 // Construct a client handler that can provide the apis.Client interface based on a single frontend and a way to connect
@@ -29,7 +34,7 @@ func (c *client) New() (apis.ChunkNum, error) {
 	return c.fe.New()
 }
 
-// Read part or all of the contents of a chunk. offset + length cannot exceed MaxChunkSize.
+// Read part or all of the contents of a chunk. offset + length cannot exceed GetChunkSize().
 // Returns the data read and the version of the data read. The version can be used with Write.
 // If the chunk does not exist, returns an error.
 func (c *client) Read(ref apis.ChunkNum, offset uint32, length uint32) ([]byte, apis.Version, error) {
@@ -37,15 +42,20 @@ func (c *client) Read(ref apis.ChunkNum, offset uint32, length uint32) ([]byte,
 	if err != nil {
 		return nil, 0, err
 	}
+	chunkSize, err := c.GetChunkSize()
+	if err != nil {
+		return nil, 0, err
+	}
 	reference := &chunkupdate.Reference{
-		Chunk:    ref,
-		Version:  version,
-		Replicas: addresses,
+		Chunk:     ref,
+		Version:   version,
+		Replicas:  addresses,
+		ChunkSize: chunkSize,
 	}
 	return reference.PerformRead(c.cache, offset, length)
 }
 
-// Write part or all of the contents of a chunk. offset + len(data) cannot exceed MaxChunkSize.
+// Write part or all of the contents of a chunk. offset + len(data) cannot exceed GetChunkSize().
 // Takes a version; if the version is not AnyVersion and doesn't match the latest version of the chunk, the write is
 // rejected.
 // Returns the new version, if the request succeeds, or the most recent version number, if the request fails due to
@@ -63,18 +73,19 @@ func (c *client) Write(ref apis.ChunkNum, offset uint32, version apis.Version, d
 	if rversion != version {
 		return rversion, fmt.Errorf("version mismatch: found %d instead of %d", rversion, version)
 	}
-	reference := &chunkupdate.Reference{
-		Chunk:    ref,
-		Version:  rversion,
-		Replicas: addresses,
-	}
-	hash, err := reference.PrepareWrite(c.cache, offset, data)
+	chunkSize, err := c.GetChunkSize()
 	if err != nil {
-		return 0, fmt.Errorf("[client.go/RPW] %v", err)
+		return 0, fmt.Errorf("[client.go/GCS] %v", err)
 	}
-	ver, err := c.fe.CommitWrite(ref, version, hash)
+	reference := &chunkupdate.Reference{
+		Chunk:     ref,
+		Version:   rversion,
+		Replicas:  addresses,
+		ChunkSize: chunkSize,
+	}
+	ver, err := reference.PerformWrite(c.cache, c.fe, offset, data)
 	if err != nil {
-		return ver, fmt.Errorf("[client.go/FCW] %v", err)
+		return ver, fmt.Errorf("[client.go/RPW] %v", err)
 	}
 	return ver, nil
 }
@@ -85,6 +96,20 @@ func (c *client) Delete(ref apis.ChunkNum, version apis.Version) error {
 	return c.fe.Delete(ref, version)
 }
 
+// Reports the maximum chunk size of the cluster, which is only asked of the frontend once, since it never changes.
+func (c *client) GetChunkSize() (uint32, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.chunkSize == 0 {
+		size, err := c.fe.GetChunkSize()
+		if err != nil {
+			return 0, err
+		}
+		c.chunkSize = size
+	}
+	return c.chunkSize, nil
+}
+
 // Close all connections used by this client.
 func (c *client) Close() error {
 	// nothing to do here... just when wrapped
@@ -31,8 +31,7 @@ func PrepareNetworkedCluster(t *testing.T) (cliConfig Configuration, newEtcd fun
 		teardowns.Add(func() { teardown4(true) })
 
 		etcdif, teardown := etcds(name)
-		teardowns.Add(teardown)
-		etcdif.UpdateAddress(csaddr, apis.CHUNKSERVER)
+		teardowns.Add(chunkserver.RegisterTestChunkserver(t, etcdif, csaddr), teardown)
 	}
 
 	config := Configuration{}
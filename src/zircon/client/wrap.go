@@ -65,6 +65,10 @@ func (c *clientWithCloseCallback) Delete(ref apis.ChunkNum, version apis.Version
 	return c.base.Delete(ref, version)
 }
 
+func (c *clientWithCloseCallback) GetChunkSize() (uint32, error) {
+	return c.base.GetChunkSize()
+}
+
 func (c *clientWithCloseCallback) Close() error {
 	err := c.base.Close()
 	c.close()
@@ -20,6 +20,8 @@ type etcdinterface struct {
 
 	LeaseMutex sync.Mutex
 	Lease      clientv3.LeaseID // TODO: ensure that Lease is still the same after each transaction
+	// separate from Lease, so that a server's liveness doesn't depend on whether it holds any metadata
+	LiveLease clientv3.LeaseID
 }
 
 // Connects to etcd and provides our specific etcd interface based on that connection.
@@ -257,22 +259,43 @@ func (e *etcdinterface) BeginMetadataLease() error {
 	return nil
 }
 
+func (e *etcdinterface) currentLease() (clientv3.LeaseID, error) {
+	e.LeaseMutex.Lock()
+	defer e.LeaseMutex.Unlock()
+	if e.Lease == clientv3.NoLease {
+		return clientv3.NoLease, errors.New("no configured lease")
+	}
+	return e.Lease, nil
+}
+
+// Shared claims on a block are kept under this prefix, one key per server, so that any number of servers can hold one.
+func sharedClaimsPrefix(blockid apis.MetadataID) string {
+	return fmt.Sprintf("/metadata/shared/%d/", blockid)
+}
+
+func (e *etcdinterface) sharedClaimKey(blockid apis.MetadataID) string {
+	return sharedClaimsPrefix(blockid) + string(e.LocalName)
+}
+
 func (e *etcdinterface) TryClaimingMetadata(blockid apis.MetadataID) (apis.ServerName, error) {
-	lease := func() clientv3.LeaseID {
-		e.LeaseMutex.Lock()
-		defer e.LeaseMutex.Unlock()
-		return e.Lease
-	}()
-	if lease == clientv3.NoLease {
-		return "", errors.New("no configured lease")
+	lease, err := e.currentLease()
+	if err != nil {
+		return "", err
 	}
 
 	key := fmt.Sprintf("/metadata/claims/%d", blockid)
+	shared := sharedClaimsPrefix(blockid)
+	ownShared := e.sharedClaimKey(blockid)
 
+	// nobody may hold a shared claim other than us, so check the ranges before and after our own shared claim
 	txn, err := e.Client.Txn(context.Background()).
-		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
-		Then(clientv3.OpPut(key, string(e.LocalName), clientv3.WithLease(lease))).
-		Else(clientv3.OpGet(key)).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0),
+			clientv3.Compare(clientv3.CreateRevision(shared), "=", 0).WithRange(ownShared),
+			clientv3.Compare(clientv3.CreateRevision(ownShared+"\x00"), "=", 0).WithRange(clientv3.GetPrefixRangeEnd(shared))).
+		Then(clientv3.OpPut(key, string(e.LocalName), clientv3.WithLease(lease)),
+			clientv3.OpDelete(ownShared)).
+		Else(clientv3.OpGet(key),
+			clientv3.OpGet(shared, clientv3.WithPrefix(), clientv3.WithKeysOnly())).
 		Commit()
 	if err != nil {
 		return "", err
@@ -284,15 +307,96 @@ func (e *etcdinterface) TryClaimingMetadata(blockid apis.MetadataID) (apis.Serve
 	if txn.Succeeded {
 		// We've got it!
 		return e.LocalName, nil
-	} else {
-		// We didn't get it. (Or maybe we already had it -- who knows?)
-		// But in either case, we should just return who DOES have it.
-		kv := txn.Responses[0].GetResponseRange().Kvs[0]
-		if string(kv.Key) != key {
-			panic("mismatched internal result")
-		}
-		return apis.ServerName(kv.Value), nil
 	}
+	// We didn't get it. (Or maybe we already had it -- who knows?)
+	// But in either case, we should just return who DOES have it.
+	kvs := txn.Responses[0].GetResponseRange().Kvs
+	if len(kvs) == 0 {
+		readers := len(txn.Responses[1].GetResponseRange().Kvs)
+		return "", apis.NewError(apis.ErrLeaseShared, 0, "metadata block %d is shared by %d readers", blockid, readers)
+	}
+	if string(kvs[0].Key) != key {
+		panic("mismatched internal result")
+	}
+	return apis.ServerName(kvs[0].Value), nil
+}
+
+func (e *etcdinterface) TryClaimingMetadataShared(blockid apis.MetadataID) (apis.ServerName, error) {
+	lease, err := e.currentLease()
+	if err != nil {
+		return "", err
+	}
+
+	key := fmt.Sprintf("/metadata/claims/%d", blockid)
+
+	txn, err := e.Client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(e.sharedClaimKey(blockid), string(e.LocalName), clientv3.WithLease(lease))).
+		Else(clientv3.OpGet(key)).
+		Commit()
+	if err != nil {
+		return "", err
+	}
+	if err := e.RenewMetadataClaims(); err != nil {
+		return "", err
+	}
+	if txn.Succeeded {
+		return e.LocalName, nil
+	}
+	kv := txn.Responses[0].GetResponseRange().Kvs[0]
+	if string(kv.Key) != key {
+		panic("mismatched internal result")
+	}
+	return apis.ServerName(kv.Value), nil
+}
+
+func (e *etcdinterface) GetMetadataOwner(blockid apis.MetadataID) (apis.ServerName, bool, error) {
+	response, err := e.Client.Get(context.Background(), fmt.Sprintf("/metadata/claims/%d", blockid))
+	if err != nil {
+		return "", false, err
+	}
+	if len(response.Kvs) == 0 {
+		return "", false, nil
+	}
+	return apis.ServerName(response.Kvs[0].Value), true, nil
+}
+
+func (e *etcdinterface) DowngradeMetadata(blockid apis.MetadataID) error {
+	lease, err := e.currentLease()
+	if err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("/metadata/claims/%d", blockid)
+
+	txn, err := e.Client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.Value(key), "=", string(e.LocalName))).
+		Then(clientv3.OpPut(e.sharedClaimKey(blockid), string(e.LocalName), clientv3.WithLease(lease)),
+			clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txn.Succeeded {
+		return errors.New("metadata was not claimed in the first place!")
+	}
+	return nil
+}
+
+func (e *etcdinterface) DisclaimMetadataShared(blockid apis.MetadataID) error {
+	key := e.sharedClaimKey(blockid)
+
+	txn, err := e.Client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.CreateRevision(key), ">", 0)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !txn.Succeeded {
+		return errors.New("metadata was not shared with us in the first place!")
+	}
+	return nil
 }
 
 // Lists the MetadataIDs of every metadata block that exists
@@ -339,7 +443,7 @@ func (e *etcdinterface) LeaseAnyMetametadata() (apis.MetadataID, error) {
 			all[apis.MetadataID(metaID)] = true
 		}
 	}
-	// scan through to eliminate everything already claimed
+	// scan through to eliminate everything already claimed, whether exclusively or shared
 	for _, kv := range resp.Kvs {
 		if strings.HasPrefix(string(kv.Key), "/metadata/claims/") {
 			metaID, err := strconv.ParseUint(string(kv.Key[len("/metadata/claims/"):]), 10, 64)
@@ -348,11 +452,23 @@ func (e *etcdinterface) LeaseAnyMetametadata() (apis.MetadataID, error) {
 			}
 			all[apis.MetadataID(metaID)] = false
 		}
+		if strings.HasPrefix(string(kv.Key), "/metadata/shared/") {
+			parts := strings.SplitN(string(kv.Key[len("/metadata/shared/"):]), "/", 2)
+			metaID, err := strconv.ParseUint(parts[0], 10, 64)
+			if err != nil {
+				return 0, err
+			}
+			all[apis.MetadataID(metaID)] = false
+		}
 	}
 
 	for k, v := range all {
 		if v {
 			owner, err := e.TryClaimingMetadata(k)
+			if apis.ErrorCodeOf(err) == apis.ErrLeaseShared {
+				// someone started reading it since we looked
+				continue
+			}
 			if err != nil {
 				return 0, err
 			}
@@ -397,6 +513,16 @@ func (e *etcdinterface) getMetametadataRaw(blockid apis.MetadataID) ([]byte, api
 	if err != nil {
 		return nil, apis.MetadataEntry{}, err
 	}
+	if !txn.Succeeded {
+		// a shared claim is enough for reading
+		txn, err = e.Client.Txn(context.Background()).
+			If(clientv3.Compare(clientv3.CreateRevision(e.sharedClaimKey(blockid)), ">", 0)).
+			Then(clientv3.OpGet(readKey)).
+			Commit()
+		if err != nil {
+			return nil, apis.MetadataEntry{}, err
+		}
+	}
 	if !txn.Succeeded {
 		return nil, apis.MetadataEntry{}, errors.New("cannot get metadata; claim not held by us")
 	}
@@ -224,6 +224,64 @@ func TestLeaseAnyMetametadata(t *testing.T) {
 	assert.Equal(t, apis.MetadataID(0), metadata)
 }
 
+func TestSharedMetadataClaims(t *testing.T) {
+	iface1, iface2, teardown := PrepareTwoClients(t)
+	defer teardown()
+
+	assert.NoError(t, iface1.BeginMetadataLease())
+	assert.NoError(t, iface2.BeginMetadataLease())
+
+	// can't downgrade a claim that isn't held, or be shared into a block that's exclusively claimed
+	assert.Error(t, iface1.DowngradeMetadata(3))
+	owner, err := iface1.TryClaimingMetadata(3)
+	assert.NoError(t, err)
+	assert.Equal(t, iface1.GetName(), owner)
+	assert.NoError(t, iface1.UpdateMetametadata(3, apis.MetadataEntry{}, apis.MetadataEntry{MostRecentVersion: 3}))
+	owner, err = iface2.TryClaimingMetadataShared(3)
+	assert.NoError(t, err)
+	assert.Equal(t, iface1.GetName(), owner)
+
+	owner, held, err := iface2.GetMetadataOwner(3)
+	assert.NoError(t, err)
+	assert.True(t, held)
+	assert.Equal(t, iface1.GetName(), owner)
+
+	assert.NoError(t, iface1.DowngradeMetadata(3))
+	owner, err = iface2.TryClaimingMetadataShared(3)
+	assert.NoError(t, err)
+	assert.Equal(t, iface2.GetName(), owner)
+	// shared claims don't make anyone the owner
+	_, held, err = iface1.GetMetadataOwner(3)
+	assert.NoError(t, err)
+	assert.False(t, held)
+
+	// both can read, but neither can claim it exclusively, nor can it be leased by anyone
+	for _, iface := range []apis.EtcdInterface{iface1, iface2} {
+		data, err := iface.GetMetametadata(3)
+		assert.NoError(t, err)
+		assert.Equal(t, apis.Version(3), data.MostRecentVersion)
+	}
+	assert.Error(t, iface1.UpdateMetametadata(3, apis.MetadataEntry{MostRecentVersion: 3}, apis.MetadataEntry{MostRecentVersion: 4}))
+	_, err = iface1.TryClaimingMetadata(3)
+	assert.Equal(t, apis.ErrLeaseShared, apis.ErrorCodeOf(err))
+	_, err = iface2.TryClaimingMetadata(3)
+	assert.Equal(t, apis.ErrLeaseShared, apis.ErrorCodeOf(err))
+	metadata, err := iface1.LeaseAnyMetametadata()
+	assert.NoError(t, err)
+	assert.Equal(t, apis.MetadataID(0), metadata)
+
+	// once only one reader is left, it can upgrade
+	assert.NoError(t, iface1.DisclaimMetadataShared(3))
+	assert.Error(t, iface1.DisclaimMetadataShared(3))
+	_, err = iface1.GetMetametadata(3)
+	assert.Error(t, err)
+	owner, err = iface2.TryClaimingMetadata(3)
+	assert.NoError(t, err)
+	assert.Equal(t, iface2.GetName(), owner)
+	assert.NoError(t, iface2.UpdateMetametadata(3, apis.MetadataEntry{MostRecentVersion: 3}, apis.MetadataEntry{MostRecentVersion: 4}))
+	assert.Error(t, iface2.DisclaimMetadataShared(3))
+}
+
 func TestReadWriteMetadata(t *testing.T) {
 	iface1, iface2, teardown := PrepareTwoClients(t)
 	defer teardown()
@@ -0,0 +1,90 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"strings"
+	"time"
+	"zircon/apis"
+)
+
+func liveKey(kind apis.ServerType, name apis.ServerName) string {
+	return "/server/live/" + typeToString(kind) + "/" + string(name)
+}
+
+func (e *etcdinterface) RegisterLive(address apis.ServerAddress, kind apis.ServerType, ttl time.Duration) error {
+	e.LeaseMutex.Lock()
+	defer e.LeaseMutex.Unlock()
+	if e.LiveLease != clientv3.NoLease {
+		return errors.New("attempt to register as live when already registered")
+	}
+	// etcd leases are measured in whole seconds
+	seconds := int64((ttl + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	resp, err := e.Client.Grant(context.Background(), seconds)
+	if err != nil {
+		return err
+	}
+	_, err = e.Client.Put(context.Background(), liveKey(kind, e.LocalName), string(address), clientv3.WithLease(resp.ID))
+	if err != nil {
+		// we don't care if this succeeds; the lease will expire on its own
+		_, _ = e.Client.Revoke(context.Background(), resp.ID)
+		return err
+	}
+	e.LiveLease = resp.ID
+	return nil
+}
+
+func (e *etcdinterface) RenewLiveRegistration() error {
+	e.LeaseMutex.Lock()
+	defer e.LeaseMutex.Unlock()
+	if e.LiveLease == clientv3.NoLease {
+		return errors.New("no live registration exists (or already lost)")
+	}
+	resp, err := e.Client.KeepAliveOnce(context.Background(), e.LiveLease)
+	if err != nil {
+		e.LiveLease = clientv3.NoLease
+		return err
+	}
+	if resp.TTL < 1 {
+		e.LiveLease = clientv3.NoLease
+		return errors.New("live registration expired")
+	}
+	return nil
+}
+
+func (e *etcdinterface) UnregisterLive() error {
+	e.LeaseMutex.Lock()
+	defer e.LeaseMutex.Unlock()
+	if e.LiveLease == clientv3.NoLease {
+		return errors.New("no live registration exists (or already lost)")
+	}
+	// revoking the lease deletes the registration along with it
+	_, err := e.Client.Revoke(context.Background(), e.LiveLease)
+	e.LiveLease = clientv3.NoLease
+	return err
+}
+
+func (e *etcdinterface) ListLiveServers(kind apis.ServerType) ([]apis.ServerName, error) {
+	start := "/server/live/" + typeToString(kind) + "/"
+	end := "/server/live/" + typeToString(kind) + "0" // because '0' is the character directly after '/'
+	response, err := e.Client.Get(context.Background(), start, clientv3.WithRange(end), clientv3.WithLimit(0), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	if response.More {
+		return nil, errors.New("etcd refused to return all results at once")
+	}
+	var results []apis.ServerName
+	for _, kv := range response.Kvs {
+		if !strings.HasPrefix(string(kv.Key), start) {
+			return nil, fmt.Errorf("unexpected key in result: '%s' when prefix was '%s'", string(kv.Key), start)
+		}
+		results = append(results, apis.ServerName(kv.Key[len(start):]))
+	}
+	return results, nil
+}
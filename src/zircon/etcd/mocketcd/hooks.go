@@ -0,0 +1,110 @@
+package mocketcd
+
+import (
+	"time"
+	"zircon/apis"
+)
+
+// Something that happens to an EtcdInterface operation before it runs, for tests that need etcd to be slow or to fail.
+type Fault struct {
+	// How long the operation waits, in real time, before going ahead or failing.
+	Delay time.Duration
+	// If not nil, the operation fails with this error rather than running.
+	Err error
+	// How many operations the fault applies to before it's used up. Zero means every one, until ClearFaults is called.
+	Times int
+}
+
+type faultRule struct {
+	server    apis.ServerName
+	method    string
+	fault     Fault
+	remaining int
+}
+
+type call struct {
+	server apis.ServerName
+	method string
+}
+
+// Injects a fault into calls to the named EtcdInterface method, such as "RenewMetadataClaims", made through interfaces
+// subscribed as server, or through any interface if server is empty. Faults are checked in the order they were
+// injected, and only the first one that matches applies. Calls that an interface makes to its own methods, such as the
+// renewal that follows each claim, count too, just as they would go to etcd with the real thing.
+func (s *Store) InjectFault(server apis.ServerName, method string, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &faultRule{server: server, method: method, fault: fault, remaining: fault.Times})
+}
+
+// Removes every fault injected so far, whether or not it has been used up.
+func (s *Store) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// How many times the named EtcdInterface method has been called through interfaces subscribed as server, including
+// calls that failed or had faults injected into them.
+func (s *Store) Calls(server apis.ServerName, method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls[call{server: server, method: method}]
+}
+
+// Expires every lease held by interfaces subscribed as server right away, as if the server had stopped renewing them:
+// its metadata claims and live registration disappear, and its next attempt to renew either of them fails.
+func (s *Store) ExpireServer(server apis.ServerName) {
+	s.mu.Lock()
+	subscribers := append([]*mockinterface(nil), s.subscribers...)
+	s.mu.Unlock()
+	for _, e := range subscribers {
+		if e.localName != server {
+			continue
+		}
+		e.mu.Lock()
+		leases := []LeaseID{e.lease, e.liveLease}
+		e.mu.Unlock()
+		for _, lease := range leases {
+			if lease != NoLease {
+				// it may already have run out on its own, which is just as good
+				_ = s.Revoke(lease)
+			}
+		}
+	}
+}
+
+// Counts the call, and finds the fault to apply to it, if any.
+func (s *Store) enter(server apis.ServerName, method string) (Fault, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls[call{server: server, method: method}] += 1
+	for i, rule := range s.faults {
+		if (rule.server != "" && rule.server != server) || rule.method != method {
+			continue
+		}
+		if rule.fault.Times > 0 {
+			rule.remaining -= 1
+			if rule.remaining == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return rule.fault, true
+	}
+	return Fault{}, false
+}
+
+// Starts an operation: fails if the interface has been closed, and otherwise applies any fault injected into it.
+func (e *mockinterface) enter(method string) error {
+	if err := e.checkOpen(); err != nil {
+		return err
+	}
+	fault, found := e.store.enter(e.localName, method)
+	if !found {
+		return nil
+	}
+	if fault.Delay > 0 {
+		time.Sleep(fault.Delay)
+	}
+	return fault.Err
+}
@@ -0,0 +1,86 @@
+package mocketcd
+
+import (
+	"errors"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+func TestInjectFault(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	store, subscribe := PrepareSubscribeForTesting(t)
+	iface1, teardown1 := subscribe("server-1")
+	defer teardown1()
+	iface2, teardown2 := subscribe("server-2")
+	defer teardown2()
+
+	unreachable := errors.New("etcd unreachable")
+	store.InjectFault("server-1", "UpdateAddress", Fault{Err: unreachable, Times: 2})
+	assert.Equal(unreachable, iface1.UpdateAddress("address-1", apis.CHUNKSERVER))
+	// only the named server is affected
+	assert.NoError(iface2.UpdateAddress("address-2", apis.CHUNKSERVER))
+	assert.Equal(unreachable, iface1.UpdateAddress("address-1", apis.CHUNKSERVER))
+	// and the fault is used up after two calls
+	assert.NoError(iface1.UpdateAddress("address-1", apis.CHUNKSERVER))
+	assert.Equal(3, store.Calls("server-1", "UpdateAddress"))
+	assert.Equal(1, store.Calls("server-2", "UpdateAddress"))
+
+	// faults without a server apply to everyone, until cleared
+	store.InjectFault("", "GetAddress", Fault{Delay: 20 * time.Millisecond})
+	start := time.Now()
+	address, err := iface2.GetAddress("server-1", apis.CHUNKSERVER)
+	assert.NoError(err)
+	assert.Equal(apis.ServerAddress("address-1"), address)
+	_, err = iface1.GetAddress("server-2", apis.CHUNKSERVER)
+	assert.NoError(err)
+	assert.True(time.Since(start) >= 40*time.Millisecond)
+	store.ClearFaults()
+	start = time.Now()
+	_, err = iface1.GetAddress("server-2", apis.CHUNKSERVER)
+	assert.NoError(err)
+	assert.True(time.Since(start) < 20*time.Millisecond)
+
+	// the renewal that follows a claim counts as a call of its own
+	require.NoError(t, iface1.BeginMetadataLease())
+	store.InjectFault("server-1", "RenewMetadataClaims", Fault{Err: unreachable, Times: 1})
+	_, err = iface1.TryClaimingMetadata(7)
+	assert.Equal(unreachable, err)
+}
+
+func TestExpireServer(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	store, subscribe := PrepareSubscribeForTesting(t)
+	iface1, teardown1 := subscribe("server-1")
+	defer teardown1()
+	iface2, teardown2 := subscribe("server-2")
+	defer teardown2()
+
+	for _, iface := range []apis.EtcdInterface{iface1, iface2} {
+		require.NoError(t, iface.BeginMetadataLease())
+		require.NoError(t, iface.RegisterLive("address", apis.METADATACACHE, time.Minute))
+	}
+	owner, err := iface1.TryClaimingMetadata(7)
+	require.NoError(t, err)
+	require.Equal(t, apis.ServerName("server-1"), owner)
+
+	store.ExpireServer("server-1")
+
+	// server 1's claims and registration are gone, without the clock having moved
+	_, held, err := iface2.GetMetadataOwner(7)
+	assert.NoError(err)
+	assert.False(held)
+	live, err := iface2.ListLiveServers(apis.METADATACACHE)
+	assert.NoError(err)
+	assert.Equal([]apis.ServerName{"server-2"}, live)
+	assert.Error(iface1.RenewMetadataClaims())
+	assert.Error(iface1.RenewLiveRegistration())
+
+	// but server 2 is unaffected
+	assert.NoError(iface2.RenewMetadataClaims())
+	assert.NoError(iface2.RenewLiveRegistration())
+}
@@ -0,0 +1,748 @@
+package mocketcd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+// How long metadata claims last without being renewed, the same as for the real etcd interface.
+const MetadataLeaseTimeout = time.Second
+
+// An EtcdInterface for a single server, backed by a Store rather than a real etcd cluster. Keys are laid out the same
+// way as in the etcd package, and every operation follows the same protocol, so code that works against this should
+// work against the real thing, except that time only passes when the store's clock is advanced.
+type mockinterface struct {
+	store     *Store
+	localName apis.ServerName
+
+	mu        sync.Mutex
+	lease     LeaseID
+	liveLease LeaseID
+	closed    bool
+}
+
+// Provides an EtcdInterface for a server named localName, sharing this store with every other server subscribed to it.
+func (s *Store) Subscribe(localName apis.ServerName) apis.EtcdInterface {
+	e := &mockinterface{store: s, localName: localName}
+	s.mu.Lock()
+	s.subscribers = append(s.subscribers, e)
+	s.mu.Unlock()
+	return e
+}
+
+// Works like etcd.PrepareSubscribeForTesting, but without launching a real etcd server, and with access to the store
+// so that the test can move its clock along.
+func PrepareSubscribeForTesting(t *testing.T) (store *Store, subscribe func(local apis.ServerName) (apis.EtcdInterface, func())) {
+	store = NewStore()
+	return store, func(local apis.ServerName) (apis.EtcdInterface, func()) {
+		iface := store.Subscribe(local)
+		return iface, func() {
+			require.NoError(t, iface.Close())
+		}
+	}
+}
+
+func (e *mockinterface) checkOpen() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return errors.New("etcd interface already closed")
+	}
+	return nil
+}
+
+// Runs a transaction, as long as the interface hasn't been closed.
+func (e *mockinterface) txn(compares []Compare, then []Op, otherwise []Op) (TxnResponse, error) {
+	if err := e.checkOpen(); err != nil {
+		return TxnResponse{}, err
+	}
+	return e.store.Txn(compares, then, otherwise)
+}
+
+// Gets a single key, as long as the interface hasn't been closed.
+func (e *mockinterface) get(key string) (KeyValue, bool, error) {
+	response, err := e.txn(nil, []Op{OpGet(key)}, nil)
+	if err != nil || len(response.Results[0]) == 0 {
+		return KeyValue{}, false, err
+	}
+	return response.Results[0][0], true, nil
+}
+
+func (e *mockinterface) getPrefix(prefix string) ([]KeyValue, error) {
+	response, err := e.txn(nil, []Op{OpGetPrefix(prefix)}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return response.Results[0], nil
+}
+
+func (e *mockinterface) put(key string, value string) error {
+	_, err := e.txn(nil, []Op{OpPut(key, value, NoLease)}, nil)
+	return err
+}
+
+func (e *mockinterface) GetName() apis.ServerName {
+	return e.localName
+}
+
+func typeToString(kind apis.ServerType) string {
+	switch kind {
+	case apis.FRONTEND:
+		return "frontend"
+	case apis.CHUNKSERVER:
+		return "chunkserver"
+	case apis.METADATACACHE:
+		return "metadatacache"
+	default:
+		panic("invalid server type")
+	}
+}
+
+// *** server names, addresses, and IDs ***
+
+func (e *mockinterface) GetAddress(name apis.ServerName, kind apis.ServerType) (apis.ServerAddress, error) {
+	if err := e.enter("GetAddress"); err != nil {
+		return "", err
+	}
+	kv, found, err := e.get("/server/addresses/" + typeToString(kind) + "/" + string(name))
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("no address for server %s with type %s", name, typeToString(kind))
+	}
+	return apis.ServerAddress(kv.Value), nil
+}
+
+func (e *mockinterface) listNames(prefix string) ([]apis.ServerName, error) {
+	kvs, err := e.getPrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var results []apis.ServerName
+	for _, kv := range kvs {
+		results = append(results, apis.ServerName(kv.Key[len(prefix):]))
+	}
+	return results, nil
+}
+
+func (e *mockinterface) ListServers(kind apis.ServerType) ([]apis.ServerName, error) {
+	if err := e.enter("ListServers"); err != nil {
+		return nil, err
+	}
+	return e.listNames("/server/addresses/" + typeToString(kind) + "/")
+}
+
+func (e *mockinterface) nextServerID() (apis.ServerID, error) {
+	for {
+		kv, found, err := e.get("/server/next-id")
+		if err != nil {
+			return 0, err
+		}
+		check, next := Missing("/server/next-id"), uint64(1)
+		if found {
+			last, err := strconv.ParseUint(kv.Value, 10, 32)
+			if err != nil {
+				return 0, err
+			}
+			check, next = ValueIs("/server/next-id", kv.Value), last+1
+		}
+		response, err := e.txn([]Compare{check}, []Op{OpPut("/server/next-id", strconv.FormatUint(next, 10), NoLease)}, nil)
+		if err != nil {
+			return 0, err
+		}
+		if response.Succeeded {
+			return apis.ServerID(next), nil
+		}
+		// changed... try again
+	}
+}
+
+func (e *mockinterface) UpdateAddress(address apis.ServerAddress, kind apis.ServerType) error {
+	if err := e.enter("UpdateAddress"); err != nil {
+		return err
+	}
+	if err := e.put("/server/addresses/"+typeToString(kind)+"/"+string(e.localName), string(address)); err != nil {
+		return err
+	}
+	byName := fmt.Sprintf("/server/by-name/%s", e.localName)
+	kv, found, err := e.get(byName)
+	if err != nil {
+		return err
+	}
+	if found {
+		// repopulate the by-id mapping, in case it went missing
+		_, err = e.txn([]Compare{Missing("/server/by-id/" + kv.Value)},
+			[]Op{OpPut("/server/by-id/"+kv.Value, string(e.localName), NoLease)}, nil)
+		return err
+	}
+	id, err := e.nextServerID()
+	if err != nil {
+		return err
+	}
+	_, err = e.txn(nil, []Op{
+		OpPut(byName, strconv.FormatUint(uint64(id), 10), NoLease),
+		OpPut(fmt.Sprintf("/server/by-id/%d", id), string(e.localName), NoLease),
+	}, nil)
+	return err
+}
+
+func (e *mockinterface) GetNameByID(id apis.ServerID) (apis.ServerName, error) {
+	if err := e.enter("GetNameByID"); err != nil {
+		return "", err
+	}
+	kv, found, err := e.get(fmt.Sprintf("/server/by-id/%d", id))
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("no such server ID: %d", id)
+	}
+	return apis.ServerName(kv.Value), nil
+}
+
+func (e *mockinterface) GetIDByName(name apis.ServerName) (apis.ServerID, error) {
+	if err := e.enter("GetIDByName"); err != nil {
+		return 0, err
+	}
+	kv, found, err := e.get(fmt.Sprintf("/server/by-name/%s", name))
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("no such server name: %s", name)
+	}
+	id, err := strconv.ParseUint(kv.Value, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return apis.ServerID(id), nil
+}
+
+// *** live registrations ***
+
+func liveKey(kind apis.ServerType, name apis.ServerName) string {
+	return "/server/live/" + typeToString(kind) + "/" + string(name)
+}
+
+// Unlike real etcd, the lease lasts for exactly ttl, rather than being rounded up to whole seconds.
+func (e *mockinterface) RegisterLive(address apis.ServerAddress, kind apis.ServerType, ttl time.Duration) error {
+	if err := e.enter("RegisterLive"); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.liveLease != NoLease {
+		return errors.New("attempt to register as live when already registered")
+	}
+	lease, err := e.store.Grant(ttl)
+	if err != nil {
+		return err
+	}
+	if err := e.store.Put(liveKey(kind, e.localName), string(address), lease); err != nil {
+		_ = e.store.Revoke(lease)
+		return err
+	}
+	e.liveLease = lease
+	return nil
+}
+
+func (e *mockinterface) RenewLiveRegistration() error {
+	if err := e.enter("RenewLiveRegistration"); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.liveLease == NoLease {
+		return errors.New("no live registration exists (or already lost)")
+	}
+	if err := e.store.KeepAlive(e.liveLease); err != nil {
+		e.liveLease = NoLease
+		return fmt.Errorf("live registration expired: %v", err)
+	}
+	return nil
+}
+
+func (e *mockinterface) UnregisterLive() error {
+	if err := e.enter("UnregisterLive"); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.liveLease == NoLease {
+		return errors.New("no live registration exists (or already lost)")
+	}
+	// revoking the lease deletes the registration along with it
+	err := e.store.Revoke(e.liveLease)
+	e.liveLease = NoLease
+	return err
+}
+
+func (e *mockinterface) ListLiveServers(kind apis.ServerType) ([]apis.ServerName, error) {
+	if err := e.enter("ListLiveServers"); err != nil {
+		return nil, err
+	}
+	return e.listNames("/server/live/" + typeToString(kind) + "/")
+}
+
+// *** metadata claims ***
+
+func (e *mockinterface) GetMetadataLeaseTimeout() time.Duration {
+	return MetadataLeaseTimeout
+}
+
+func (e *mockinterface) BeginMetadataLease() error {
+	if err := e.enter("BeginMetadataLease"); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lease != NoLease {
+		return errors.New("attempt to begin metadata lease when lease already exists!")
+	}
+	lease, err := e.store.Grant(MetadataLeaseTimeout)
+	if err != nil {
+		return err
+	}
+	e.lease = lease
+	return nil
+}
+
+func (e *mockinterface) RenewMetadataClaims() error {
+	if err := e.enter("RenewMetadataClaims"); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lease == NoLease {
+		return errors.New("no lease exists (or already lost)")
+	}
+	if err := e.store.KeepAlive(e.lease); err != nil {
+		e.lease = NoLease
+		return err
+	}
+	return nil
+}
+
+func (e *mockinterface) currentLease() (LeaseID, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.lease == NoLease {
+		return NoLease, errors.New("no configured lease")
+	}
+	return e.lease, nil
+}
+
+func claimKey(blockid apis.MetadataID) string {
+	return fmt.Sprintf("/metadata/claims/%d", blockid)
+}
+
+func dataKey(blockid apis.MetadataID) string {
+	return fmt.Sprintf("/metadata/data/%d", blockid)
+}
+
+func sharedClaimsPrefix(blockid apis.MetadataID) string {
+	return fmt.Sprintf("/metadata/shared/%d/", blockid)
+}
+
+func (e *mockinterface) sharedClaimKey(blockid apis.MetadataID) string {
+	return sharedClaimsPrefix(blockid) + string(e.localName)
+}
+
+func (e *mockinterface) TryClaimingMetadata(blockid apis.MetadataID) (apis.ServerName, error) {
+	if err := e.enter("TryClaimingMetadata"); err != nil {
+		return "", err
+	}
+	lease, err := e.currentLease()
+	if err != nil {
+		return "", err
+	}
+	key, ownShared := claimKey(blockid), e.sharedClaimKey(blockid)
+	response, err := e.txn(
+		[]Compare{Missing(key), NoOthersWithPrefix(sharedClaimsPrefix(blockid), ownShared)},
+		[]Op{OpPut(key, string(e.localName), lease), OpDelete(ownShared)},
+		[]Op{OpGet(key), OpGetPrefix(sharedClaimsPrefix(blockid))})
+	if err != nil {
+		return "", err
+	}
+	// like the real thing, make sure our lease is still active before returning anything
+	if err := e.RenewMetadataClaims(); err != nil {
+		return "", err
+	}
+	if response.Succeeded {
+		return e.localName, nil
+	}
+	if len(response.Results[0]) == 0 {
+		readers := len(response.Results[1])
+		return "", apis.NewError(apis.ErrLeaseShared, 0, "metadata block %d is shared by %d readers", blockid, readers)
+	}
+	return apis.ServerName(response.Results[0][0].Value), nil
+}
+
+func (e *mockinterface) TryClaimingMetadataShared(blockid apis.MetadataID) (apis.ServerName, error) {
+	if err := e.enter("TryClaimingMetadataShared"); err != nil {
+		return "", err
+	}
+	lease, err := e.currentLease()
+	if err != nil {
+		return "", err
+	}
+	key := claimKey(blockid)
+	response, err := e.txn([]Compare{Missing(key)},
+		[]Op{OpPut(e.sharedClaimKey(blockid), string(e.localName), lease)},
+		[]Op{OpGet(key)})
+	if err != nil {
+		return "", err
+	}
+	if err := e.RenewMetadataClaims(); err != nil {
+		return "", err
+	}
+	if response.Succeeded {
+		return e.localName, nil
+	}
+	return apis.ServerName(response.Results[0][0].Value), nil
+}
+
+func (e *mockinterface) GetMetadataOwner(blockid apis.MetadataID) (apis.ServerName, bool, error) {
+	if err := e.enter("GetMetadataOwner"); err != nil {
+		return "", false, err
+	}
+	kv, found, err := e.get(claimKey(blockid))
+	if err != nil || !found {
+		return "", false, err
+	}
+	return apis.ServerName(kv.Value), true, nil
+}
+
+func (e *mockinterface) DowngradeMetadata(blockid apis.MetadataID) error {
+	if err := e.enter("DowngradeMetadata"); err != nil {
+		return err
+	}
+	lease, err := e.currentLease()
+	if err != nil {
+		return err
+	}
+	key := claimKey(blockid)
+	response, err := e.txn([]Compare{ValueIs(key, string(e.localName))},
+		[]Op{OpPut(e.sharedClaimKey(blockid), string(e.localName), lease), OpDelete(key)}, nil)
+	if err != nil {
+		return err
+	}
+	if !response.Succeeded {
+		return errors.New("metadata was not claimed in the first place!")
+	}
+	return nil
+}
+
+func (e *mockinterface) DisclaimMetadata(blockid apis.MetadataID) error {
+	if err := e.enter("DisclaimMetadata"); err != nil {
+		return err
+	}
+	key := claimKey(blockid)
+	response, err := e.txn([]Compare{ValueIs(key, string(e.localName))}, []Op{OpDelete(key)}, nil)
+	if err != nil {
+		return err
+	}
+	if !response.Succeeded {
+		return errors.New("metadata was not claimed in the first place!")
+	}
+	return nil
+}
+
+func (e *mockinterface) DisclaimMetadataShared(blockid apis.MetadataID) error {
+	if err := e.enter("DisclaimMetadataShared"); err != nil {
+		return err
+	}
+	key := e.sharedClaimKey(blockid)
+	response, err := e.txn([]Compare{Present(key)}, []Op{OpDelete(key)}, nil)
+	if err != nil {
+		return err
+	}
+	if !response.Succeeded {
+		return errors.New("metadata was not shared with us in the first place!")
+	}
+	return nil
+}
+
+// Parses the metadata ID that comes right after prefix in key, ignoring anything after a further slash.
+func parseMetadataID(key string, prefix string) (apis.MetadataID, error) {
+	rest := strings.SplitN(key[len(prefix):], "/", 2)[0]
+	id, err := strconv.ParseUint(rest, 10, 64)
+	return apis.MetadataID(id), err
+}
+
+func (e *mockinterface) ListAllMetaIDs() ([]apis.MetadataID, error) {
+	if err := e.enter("ListAllMetaIDs"); err != nil {
+		return []apis.MetadataID{}, err
+	}
+	kvs, err := e.getPrefix("/metadata/data/")
+	if err != nil {
+		return []apis.MetadataID{}, err
+	}
+	all := []apis.MetadataID{}
+	for _, kv := range kvs {
+		id, err := parseMetadataID(kv.Key, "/metadata/data/")
+		if err != nil {
+			return []apis.MetadataID{}, err
+		}
+		all = append(all, id)
+	}
+	return all, nil
+}
+
+func (e *mockinterface) LeaseAnyMetametadata() (apis.MetadataID, error) {
+	if err := e.enter("LeaseAnyMetametadata"); err != nil {
+		return 0, err
+	}
+	kvs, err := e.getPrefix("/metadata/")
+	if err != nil {
+		return 0, err
+	}
+	available := map[apis.MetadataID]bool{}
+	var candidates []apis.MetadataID
+	for _, kv := range kvs {
+		if strings.HasPrefix(kv.Key, "/metadata/data/") {
+			id, err := parseMetadataID(kv.Key, "/metadata/data/")
+			if err != nil {
+				return 0, err
+			}
+			available[id] = true
+			candidates = append(candidates, id)
+		}
+	}
+	// eliminate everything already claimed, whether exclusively or shared
+	for _, kv := range kvs {
+		for _, prefix := range []string{"/metadata/claims/", "/metadata/shared/"} {
+			if strings.HasPrefix(kv.Key, prefix) {
+				id, err := parseMetadataID(kv.Key, prefix)
+				if err != nil {
+					return 0, err
+				}
+				available[id] = false
+			}
+		}
+	}
+	for _, id := range candidates {
+		if !available[id] {
+			continue
+		}
+		owner, err := e.TryClaimingMetadata(id)
+		if apis.ErrorCodeOf(err) == apis.ErrLeaseShared {
+			// someone started reading it since we looked
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		if owner == e.localName {
+			return id, nil
+		}
+	}
+	// nothing left to claim
+	return 0, nil
+}
+
+func (e *mockinterface) getMetametadataRaw(blockid apis.MetadataID) (*string, apis.MetadataEntry, error) {
+	response, err := e.txn([]Compare{ValueIs(claimKey(blockid), string(e.localName))}, []Op{OpGet(dataKey(blockid))}, nil)
+	if err != nil {
+		return nil, apis.MetadataEntry{}, err
+	}
+	if !response.Succeeded {
+		// a shared claim is enough for reading
+		response, err = e.txn([]Compare{Present(e.sharedClaimKey(blockid))}, []Op{OpGet(dataKey(blockid))}, nil)
+		if err != nil {
+			return nil, apis.MetadataEntry{}, err
+		}
+	}
+	if !response.Succeeded {
+		return nil, apis.MetadataEntry{}, errors.New("cannot get metadata; claim not held by us")
+	}
+	if len(response.Results[0]) == 0 {
+		// just return an empty block by default
+		return nil, apis.MetadataEntry{}, nil
+	}
+	raw := response.Results[0][0].Value
+	entry := apis.MetadataEntry{}
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		return nil, apis.MetadataEntry{}, err
+	}
+	return &raw, entry, nil
+}
+
+func (e *mockinterface) GetMetametadata(blockid apis.MetadataID) (apis.MetadataEntry, error) {
+	if err := e.enter("GetMetametadata"); err != nil {
+		return apis.MetadataEntry{}, err
+	}
+	_, entry, err := e.getMetametadataRaw(blockid)
+	return entry, err
+}
+
+func (e *mockinterface) UpdateMetametadata(blockid apis.MetadataID, previous apis.MetadataEntry, data apis.MetadataEntry) error {
+	if err := e.enter("UpdateMetametadata"); err != nil {
+		return err
+	}
+	originalRaw, originalEntry, err := e.getMetametadataRaw(blockid)
+	if err != nil {
+		return err
+	}
+	if !originalEntry.Equals(previous) {
+		return fmt.Errorf("cannot update metadata; mismatch on previous value: %v instead of %v", originalEntry, previous)
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	checkPrevious := Missing(dataKey(blockid))
+	if originalRaw != nil {
+		checkPrevious = ValueIs(dataKey(blockid), *originalRaw)
+	}
+	response, err := e.txn([]Compare{ValueIs(claimKey(blockid), string(e.localName)), checkPrevious},
+		[]Op{OpPut(dataKey(blockid), string(encoded), NoLease)},
+		[]Op{OpGet(claimKey(blockid))})
+	if err != nil {
+		return err
+	}
+	if !response.Succeeded {
+		if len(response.Results[0]) == 0 {
+			return errors.New("cannot update metadata; claim not held")
+		}
+		if response.Results[0][0].Value != string(e.localName) {
+			return errors.New("cannot update metadata; claim held by someone else")
+		}
+		return errors.New("cannot update metadata; data-level mismatch")
+	}
+	return nil
+}
+
+// *** filesystem root and cluster settings ***
+
+const FilesystemRootKey = "/fs/root"
+
+func (e *mockinterface) ReadFSRoot() (apis.ChunkNum, error) {
+	if err := e.enter("ReadFSRoot"); err != nil {
+		return 0, err
+	}
+	kv, found, err := e.get(FilesystemRootKey)
+	if err != nil || !found {
+		return 0, err
+	}
+	return apis.ChunkNum(binary.LittleEndian.Uint64([]byte(kv.Value))), nil
+}
+
+func (e *mockinterface) WriteFSRoot(chunk apis.ChunkNum) error {
+	if err := e.enter("WriteFSRoot"); err != nil {
+		return err
+	}
+	encoded := make([]byte, 8)
+	binary.LittleEndian.PutUint64(encoded, uint64(chunk))
+	response, err := e.txn([]Compare{Missing(FilesystemRootKey)}, []Op{OpPut(FilesystemRootKey, string(encoded), NoLease)}, nil)
+	if err != nil {
+		return err
+	}
+	if !response.Succeeded {
+		return errors.New("found existing filesystem root")
+	}
+	return nil
+}
+
+const ChunkSizeKey = "/cluster/chunk-size"
+
+func (e *mockinterface) RecordChunkSize(size uint32) (uint32, error) {
+	if err := e.enter("RecordChunkSize"); err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		return 0, errors.New("chunk size cannot be zero")
+	}
+	encoded := make([]byte, 4)
+	binary.LittleEndian.PutUint32(encoded, size)
+	response, err := e.txn([]Compare{Missing(ChunkSizeKey)},
+		[]Op{OpPut(ChunkSizeKey, string(encoded), NoLease)},
+		[]Op{OpGet(ChunkSizeKey)})
+	if err != nil {
+		return 0, err
+	}
+	if response.Succeeded {
+		return size, nil
+	}
+	kvs := response.Results[0]
+	if len(kvs) == 0 || len(kvs[0].Value) != 4 {
+		return 0, errors.New("malformed chunk size recorded for cluster")
+	}
+	return binary.LittleEndian.Uint32([]byte(kvs[0].Value)), nil
+}
+
+func (e *mockinterface) GetChunkSize() (uint32, error) {
+	if err := e.enter("GetChunkSize"); err != nil {
+		return 0, err
+	}
+	kv, found, err := e.get(ChunkSizeKey)
+	if err != nil || !found {
+		return 0, err
+	}
+	if len(kv.Value) != 4 {
+		return 0, errors.New("malformed chunk size recorded for cluster")
+	}
+	return binary.LittleEndian.Uint32([]byte(kv.Value)), nil
+}
+
+// Like the real thing, closing doesn't give up any leases; they run out on their own once the clock moves past them.
+func (e *mockinterface) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.closed {
+		return errors.New("etcd interface already closed")
+	}
+	e.closed = true
+	return nil
+}
+
+// *** watches ***
+
+func (e *mockinterface) Watch(prefix string, fromRevision int64) (<-chan apis.WatchEvent, func(), error) {
+	if err := e.enter("Watch"); err != nil {
+		return nil, nil, err
+	}
+	if fromRevision < 0 {
+		return nil, nil, fmt.Errorf("cannot watch from negative revision %d", fromRevision)
+	}
+	raw, stop, err := e.store.WatchFrom(prefix, fromRevision)
+	if err != nil {
+		return nil, nil, err
+	}
+	events := make(chan apis.WatchEvent)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		defer close(events)
+		for event := range raw {
+			converted := apis.WatchEvent{Type: apis.WatchPut, Key: event.Key, Value: event.Value, Revision: event.Revision}
+			if event.Deleted {
+				converted.Type = apis.WatchDelete
+			}
+			select {
+			case events <- converted:
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			close(done)
+			stop()
+			<-finished
+		})
+	}, nil
+}
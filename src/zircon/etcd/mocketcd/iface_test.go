@@ -0,0 +1,279 @@
+package mocketcd
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+func TestMockMetadataClaims(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	store, subscribe := PrepareSubscribeForTesting(t)
+	iface1, teardown1 := subscribe("server-1")
+	defer teardown1()
+	iface2, teardown2 := subscribe("server-2")
+	defer teardown2()
+
+	require.NoError(t, iface1.BeginMetadataLease())
+	require.NoError(t, iface2.BeginMetadataLease())
+
+	owner, err := iface1.TryClaimingMetadata(7)
+	assert.NoError(err)
+	assert.Equal(apis.ServerName("server-1"), owner)
+	owner, err = iface2.TryClaimingMetadata(7)
+	assert.NoError(err)
+	assert.Equal(apis.ServerName("server-1"), owner)
+
+	entry := apis.MetadataEntry{MostRecentVersion: 1, Replicas: []apis.ServerID{1, 2}}
+	assert.NoError(iface1.UpdateMetametadata(7, apis.MetadataEntry{}, entry))
+	assert.Error(iface2.UpdateMetametadata(7, apis.MetadataEntry{}, entry))
+
+	// shared claims keep out exclusive claims, and the other way around
+	assert.NoError(iface1.DowngradeMetadata(7))
+	owner, err = iface2.TryClaimingMetadataShared(7)
+	assert.NoError(err)
+	assert.Equal(apis.ServerName("server-2"), owner)
+	_, err = iface2.TryClaimingMetadata(7)
+	assert.Equal(apis.ErrLeaseShared, apis.ErrorCodeOf(err))
+	read, err := iface2.GetMetametadata(7)
+	assert.NoError(err)
+	assert.True(read.Equals(entry))
+	assert.NoError(iface1.DisclaimMetadataShared(7))
+
+	// server 1 stops renewing; its claims and shared claims go away once the lease runs out, but server 2 keeps its own
+	owner, err = iface1.TryClaimingMetadata(8)
+	assert.NoError(err)
+	assert.Equal(apis.ServerName("server-1"), owner)
+	store.Advance(iface1.GetMetadataLeaseTimeout() / 2)
+	assert.NoError(iface2.RenewMetadataClaims())
+	store.Advance(iface1.GetMetadataLeaseTimeout() / 2)
+	assert.Error(iface1.RenewMetadataClaims())
+	_, held, err := iface2.GetMetadataOwner(8)
+	assert.NoError(err)
+	assert.False(held)
+	owner, err = iface2.TryClaimingMetadata(8)
+	assert.NoError(err)
+	assert.Equal(apis.ServerName("server-2"), owner)
+	_, err = iface2.GetMetametadata(7)
+	assert.NoError(err)
+
+	// server 1 can start over with a new lease
+	assert.NoError(iface1.BeginMetadataLease())
+	id, err := iface1.LeaseAnyMetametadata()
+	assert.NoError(err)
+	assert.Equal(apis.MetadataID(0), id)
+}
+
+func TestMockLiveRegistrationExpiry(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	store, subscribe := PrepareSubscribeForTesting(t)
+	iface, teardown := subscribe("server-1")
+	defer teardown()
+	observer, teardownObserver := subscribe("observer")
+	defer teardownObserver()
+
+	require.NoError(t, iface.RegisterLive("127.0.0.1:1234", apis.CHUNKSERVER, 3*time.Second))
+	live, err := observer.ListLiveServers(apis.CHUNKSERVER)
+	assert.NoError(err)
+	assert.Equal([]apis.ServerName{"server-1"}, live)
+
+	store.Advance(2 * time.Second)
+	assert.NoError(iface.RenewLiveRegistration())
+	store.Advance(2 * time.Second)
+	live, err = observer.ListLiveServers(apis.CHUNKSERVER)
+	assert.NoError(err)
+	assert.Equal([]apis.ServerName{"server-1"}, live)
+
+	store.Advance(time.Second)
+	live, err = observer.ListLiveServers(apis.CHUNKSERVER)
+	assert.NoError(err)
+	assert.Empty(live)
+	assert.Error(iface.RenewLiveRegistration())
+
+	// and it can register again afterwards
+	assert.NoError(iface.RegisterLive("127.0.0.1:1234", apis.CHUNKSERVER, time.Second))
+	assert.NoError(iface.UnregisterLive())
+	live, err = observer.ListLiveServers(apis.CHUNKSERVER)
+	assert.NoError(err)
+	assert.Empty(live)
+}
+
+func TestMockServerIDs(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	_, subscribe := PrepareSubscribeForTesting(t)
+	iface1, teardown1 := subscribe("server-1")
+	defer teardown1()
+	iface2, teardown2 := subscribe("server-2")
+	defer teardown2()
+
+	assert.NoError(iface1.UpdateAddress("127.0.0.1:1", apis.CHUNKSERVER))
+	assert.NoError(iface2.UpdateAddress("127.0.0.1:2", apis.FRONTEND))
+	assert.NoError(iface1.UpdateAddress("127.0.0.1:3", apis.CHUNKSERVER))
+
+	id1, err := iface2.GetIDByName("server-1")
+	assert.NoError(err)
+	id2, err := iface1.GetIDByName("server-2")
+	assert.NoError(err)
+	assert.Equal([]apis.ServerID{1, 2}, []apis.ServerID{id1, id2})
+	name, err := iface2.GetNameByID(id1)
+	assert.NoError(err)
+	assert.Equal(apis.ServerName("server-1"), name)
+	address, err := iface2.GetAddress("server-1", apis.CHUNKSERVER)
+	assert.NoError(err)
+	assert.Equal(apis.ServerAddress("127.0.0.1:3"), address)
+	servers, err := iface1.ListServers(apis.FRONTEND)
+	assert.NoError(err)
+	assert.Equal([]apis.ServerName{"server-2"}, servers)
+}
+
+func TestMockChunkSize(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	_, subscribe := PrepareSubscribeForTesting(t)
+	iface1, teardown1 := subscribe("server-1")
+	defer teardown1()
+	iface2, teardown2 := subscribe("server-2")
+	defer teardown2()
+
+	size, err := iface2.GetChunkSize()
+	assert.NoError(err)
+	assert.Equal(uint32(0), size)
+	size, err = iface1.RecordChunkSize(4096)
+	assert.NoError(err)
+	assert.Equal(uint32(4096), size)
+	size, err = iface2.RecordChunkSize(8192)
+	assert.NoError(err)
+	assert.Equal(uint32(4096), size)
+	size, err = iface2.GetChunkSize()
+	assert.NoError(err)
+	assert.Equal(uint32(4096), size)
+}
+
+func TestMockSyncBlocking(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	_, subscribe := PrepareSubscribeForTesting(t)
+	iface1, teardown1 := subscribe("server-1")
+	defer teardown1()
+	iface2, teardown2 := subscribe("server-2")
+	defer teardown2()
+
+	reader1, err := iface1.StartSync(5)
+	require.NoError(t, err)
+	reader2, err := iface2.StartSync(5)
+	require.NoError(t, err)
+
+	upgraded := make(chan apis.SyncID)
+	go func() {
+		writer, err := iface1.UpgradeSync(reader1)
+		assert.NoError(err)
+		upgraded <- writer
+	}()
+	// the upgrade has to wait for the other reader to leave
+	select {
+	case <-upgraded:
+		t.Fatal("upgraded while another reader still held the chunk")
+	case <-time.After(50 * time.Millisecond):
+	}
+	_, err = iface2.UpgradeSync(reader2)
+	assert.Error(err)
+	assert.NoError(iface2.ReleaseSync(reader2))
+	writer := <-upgraded
+	isWriter, err := iface1.ConfirmSync(writer)
+	assert.NoError(err)
+	assert.True(isWriter)
+
+	// and new readers have to wait for the writer to finish
+	started := make(chan apis.SyncID)
+	go func() {
+		reader, err := iface2.StartSync(5)
+		assert.NoError(err)
+		started <- reader
+	}()
+	select {
+	case <-started:
+		t.Fatal("started reading while a writer held the chunk")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.NoError(iface1.ReleaseSync(writer))
+	assert.NoError(iface1.ReleaseSync(reader1))
+	reader3 := <-started
+	isWriter, err = iface2.ConfirmSync(reader3)
+	assert.NoError(err)
+	assert.False(isWriter)
+	assert.NoError(iface2.ReleaseSync(reader3))
+	assert.Error(iface2.ReleaseSync(reader3))
+}
+
+func nextWatchEvent(t *testing.T, events <-chan apis.WatchEvent) apis.WatchEvent {
+	select {
+	case event, ok := <-events:
+		require.True(t, ok, "watch ended early")
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no event delivered")
+		return apis.WatchEvent{}
+	}
+}
+
+func TestMockWatch(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	store, subscribe := PrepareSubscribeForTesting(t)
+	iface1, teardown1 := subscribe("server-1")
+	defer teardown1()
+	iface2, teardown2 := subscribe("server-2")
+	defer teardown2()
+
+	require.NoError(t, iface1.UpdateAddress("address-1", apis.CHUNKSERVER))
+	start := store.Revision() + 1
+	require.NoError(t, iface2.UpdateAddress("address-2", apis.CHUNKSERVER))
+	require.NoError(t, iface1.UpdateAddress("address-3", apis.CHUNKSERVER))
+
+	// starting from a past revision replays what happened since, in order, before anything new
+	events, cancel, err := iface1.Watch("/server/addresses/", start)
+	require.NoError(t, err)
+	first := nextWatchEvent(t, events)
+	assert.Equal(apis.WatchEvent{Type: apis.WatchPut, Key: "/server/addresses/chunkserver/server-2", Value: "address-2",
+		Revision: start}, first)
+	second := nextWatchEvent(t, events)
+	assert.Equal("address-3", second.Value)
+	assert.True(second.Revision > first.Revision)
+
+	require.NoError(t, iface2.RegisterLive("address-2", apis.CHUNKSERVER, time.Second))
+	require.NoError(t, iface2.UpdateAddress("address-4", apis.CHUNKSERVER))
+	// the live registration is outside the prefix, so it isn't seen
+	third := nextWatchEvent(t, events)
+	assert.Equal("address-4", third.Value)
+	assert.True(third.Revision > second.Revision+1)
+
+	// a watch from now on only sees new changes, including deletions
+	live, cancelLive, err := iface2.Watch("/server/live/", 0)
+	require.NoError(t, err)
+	defer cancelLive()
+	store.Advance(time.Second)
+	expired := nextWatchEvent(t, live)
+	assert.Equal(apis.WatchDelete, expired.Type)
+	assert.Equal("/server/live/chunkserver/server-2", expired.Key)
+	assert.Equal("", expired.Value)
+
+	// cancelling closes the channel, and may be done more than once
+	cancel()
+	_, ok := <-events
+	assert.False(ok)
+	cancel()
+
+	// history that has been compacted away can't be watched anymore
+	require.NoError(t, store.Compact(start))
+	_, _, err = iface1.Watch("/server/addresses/", start)
+	assert.Error(err)
+	events, cancel, err = iface1.Watch("/server/addresses/", start+1)
+	require.NoError(t, err)
+	defer cancel()
+	assert.Equal("address-3", nextWatchEvent(t, events).Value)
+}
@@ -0,0 +1,528 @@
+package mocketcd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An in-memory stand-in for an etcd cluster, for tests that don't need a real one. It keeps the parts of etcd's model
+// that EtcdInterface relies on: keys with create and mod revisions, transactions that compare any number of keys and
+// then apply any number of operations atomically, leases that delete their keys when they expire, and watches.
+//
+// Time only moves when Advance is called, so tests decide exactly when leases run out, rather than sleeping and hoping
+// for the best.
+type Store struct {
+	mu       sync.Mutex
+	now      time.Time
+	revision int64
+	keys     map[string]KeyValue
+	leases   map[LeaseID]*lease
+	nextID   LeaseID
+	watchers map[*watcher]bool
+	// every change since the last compaction, in order, so that watches can start from past revisions
+	history   []Event
+	compacted int64
+
+	// see hooks.go
+	faults      []*faultRule
+	calls       map[call]int
+	subscribers []*mockinterface
+}
+
+type LeaseID int64
+
+// The lease ID for keys that aren't attached to any lease.
+const NoLease LeaseID = 0
+
+type lease struct {
+	ttl      time.Duration
+	deadline time.Time
+	keys     map[string]bool
+}
+
+type KeyValue struct {
+	Key   string
+	Value string
+	// The revision at which the key was created, and at which it was last modified. Both are zero for a key that
+	// doesn't exist.
+	CreateRevision int64
+	ModRevision    int64
+	Lease          LeaseID
+}
+
+// A change to a key, as seen by a watch. Deleted keys have an empty value.
+type Event struct {
+	Key      string
+	Value    string
+	Deleted  bool
+	Revision int64
+}
+
+func NewStore() *Store {
+	return &Store{
+		// an arbitrary but fixed starting point, so that tests come out the same every time
+		now:      time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		keys:     map[string]KeyValue{},
+		leases:   map[LeaseID]*lease{},
+		nextID:   1,
+		watchers: map[*watcher]bool{},
+		calls:    map[call]int{},
+	}
+}
+
+// The current time, as far as leases are concerned.
+func (s *Store) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// Moves the clock forward, expiring every lease whose time has run out, along with the keys attached to it.
+func (s *Store) Advance(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.now = s.now.Add(d)
+	var expired []LeaseID
+	for id, l := range s.leases {
+		if !s.now.Before(l.deadline) {
+			expired = append(expired, id)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+	// in order, so that the events come out the same every time
+	sort.Slice(expired, func(i, j int) bool {
+		return expired[i] < expired[j]
+	})
+	s.revision += 1
+	for _, id := range expired {
+		s.revokeLocked(id)
+	}
+}
+
+// The revision of the most recent change to any key.
+func (s *Store) Revision() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revision
+}
+
+// *** leases ***
+
+// Grants a lease that expires once ttl has passed without it being kept alive.
+func (s *Store) Grant(ttl time.Duration) (LeaseID, error) {
+	if ttl <= 0 {
+		return NoLease, fmt.Errorf("lease TTL must be positive: %v", ttl)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.nextID
+	s.nextID += 1
+	s.leases[id] = &lease{ttl: ttl, deadline: s.now.Add(ttl), keys: map[string]bool{}}
+	return id, nil
+}
+
+// Restarts a lease's countdown from its full TTL. Fails if the lease has already expired or been revoked.
+func (s *Store) KeepAlive(id LeaseID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, found := s.leases[id]
+	if !found {
+		return fmt.Errorf("lease %d not found", id)
+	}
+	l.deadline = s.now.Add(l.ttl)
+	return nil
+}
+
+// Ends a lease immediately, deleting every key attached to it.
+func (s *Store) Revoke(id LeaseID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.leases[id]; !found {
+		return fmt.Errorf("lease %d not found", id)
+	}
+	s.revision += 1
+	s.revokeLocked(id)
+	return nil
+}
+
+// How long a lease has left, or false if it's gone.
+func (s *Store) TimeToLive(id LeaseID) (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, found := s.leases[id]
+	if !found {
+		return 0, false
+	}
+	return l.deadline.Sub(s.now), true
+}
+
+func (s *Store) revokeLocked(id LeaseID) {
+	var keys []string
+	for key := range s.leases[id].keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s.deleteLocked(key)
+	}
+	delete(s.leases, id)
+}
+
+// *** transactions ***
+
+type compareKind int
+
+const (
+	compareValue compareKind = iota
+	compareMissing
+	comparePresent
+	compareNoOthers
+)
+
+// A condition on the state of the store, checked as part of a transaction.
+type Compare struct {
+	kind  compareKind
+	key   string
+	value string
+	// for compareNoOthers, the one key under the prefix that's allowed to exist
+	except string
+}
+
+// Holds if the key exists and has exactly this value.
+func ValueIs(key string, value string) Compare {
+	return Compare{kind: compareValue, key: key, value: value}
+}
+
+// Holds if the key doesn't exist; the same as comparing its create revision to zero in etcd.
+func Missing(key string) Compare {
+	return Compare{kind: compareMissing, key: key}
+}
+
+// Holds if the key exists.
+func Present(key string) Compare {
+	return Compare{kind: comparePresent, key: key}
+}
+
+// Holds if no key starts with prefix, other than except, which may be empty if no exception is wanted.
+func NoOthersWithPrefix(prefix string, except string) Compare {
+	return Compare{kind: compareNoOthers, key: prefix, except: except}
+}
+
+func (s *Store) holds(c Compare) bool {
+	kv, found := s.keys[c.key]
+	switch c.kind {
+	case compareValue:
+		return found && kv.Value == c.value
+	case compareMissing:
+		return !found
+	case comparePresent:
+		return found
+	case compareNoOthers:
+		for key := range s.keys {
+			if strings.HasPrefix(key, c.key) && key != c.except {
+				return false
+			}
+		}
+		return true
+	default:
+		panic("unknown kind of comparison")
+	}
+}
+
+type opKind int
+
+const (
+	opGet opKind = iota
+	opPut
+	opDelete
+)
+
+// An operation carried out as part of a transaction.
+type Op struct {
+	kind   opKind
+	key    string
+	value  string
+	lease  LeaseID
+	prefix bool
+}
+
+func OpGet(key string) Op {
+	return Op{kind: opGet, key: key}
+}
+
+// Gets every key that starts with prefix, in order.
+func OpGetPrefix(prefix string) Op {
+	return Op{kind: opGet, key: prefix, prefix: true}
+}
+
+// Sets a key, attaching it to a lease unless the lease is NoLease.
+func OpPut(key string, value string, lease LeaseID) Op {
+	return Op{kind: opPut, key: key, value: value, lease: lease}
+}
+
+// Deletes a key, if it exists.
+func OpDelete(key string) Op {
+	return Op{kind: opDelete, key: key}
+}
+
+func OpDeletePrefix(prefix string) Op {
+	return Op{kind: opDelete, key: prefix, prefix: true}
+}
+
+type TxnResponse struct {
+	Succeeded bool
+	// What each get operation found, in the order the operations were given; nil for other operations.
+	Results [][]KeyValue
+}
+
+// Checks every comparison, and applies all of then if they all hold, and all of otherwise if not, as a single atomic
+// step, which takes up a single revision if anything changed. Fails without changing anything if a put names a lease
+// that doesn't exist.
+func (s *Store) Txn(compares []Compare, then []Op, otherwise []Op) (TxnResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	succeeded := true
+	for _, c := range compares {
+		if !s.holds(c) {
+			succeeded = false
+			break
+		}
+	}
+	ops := then
+	if !succeeded {
+		ops = otherwise
+	}
+	writes := false
+	for _, op := range ops {
+		if op.kind == opPut && op.lease != NoLease {
+			if _, found := s.leases[op.lease]; !found {
+				return TxnResponse{}, fmt.Errorf("lease %d not found", op.lease)
+			}
+		}
+		if op.kind != opGet {
+			writes = true
+		}
+	}
+	if writes {
+		s.revision += 1
+	}
+	response := TxnResponse{Succeeded: succeeded, Results: make([][]KeyValue, len(ops))}
+	for i, op := range ops {
+		switch op.kind {
+		case opGet:
+			response.Results[i] = s.rangeLocked(op.key, op.prefix)
+		case opPut:
+			s.putLocked(op.key, op.value, op.lease)
+		case opDelete:
+			for _, kv := range s.rangeLocked(op.key, op.prefix) {
+				s.deleteLocked(kv.Key)
+			}
+		}
+	}
+	return response, nil
+}
+
+func (s *Store) rangeLocked(key string, prefix bool) []KeyValue {
+	if !prefix {
+		if kv, found := s.keys[key]; found {
+			return []KeyValue{kv}
+		}
+		return nil
+	}
+	var result []KeyValue
+	for k, kv := range s.keys {
+		if strings.HasPrefix(k, key) {
+			result = append(result, kv)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// Expects the revision to have been bumped already.
+func (s *Store) putLocked(key string, value string, leaseID LeaseID) {
+	kv, found := s.keys[key]
+	if !found {
+		kv = KeyValue{Key: key, CreateRevision: s.revision}
+	}
+	if kv.Lease != NoLease {
+		if old, found := s.leases[kv.Lease]; found {
+			delete(old.keys, key)
+		}
+	}
+	kv.Value, kv.ModRevision, kv.Lease = value, s.revision, leaseID
+	if leaseID != NoLease {
+		s.leases[leaseID].keys[key] = true
+	}
+	s.keys[key] = kv
+	s.notifyLocked(Event{Key: key, Value: value, Revision: s.revision})
+}
+
+// Expects the revision to have been bumped already.
+func (s *Store) deleteLocked(key string) {
+	kv, found := s.keys[key]
+	if !found {
+		return
+	}
+	if kv.Lease != NoLease {
+		if l, found := s.leases[kv.Lease]; found {
+			delete(l.keys, key)
+		}
+	}
+	delete(s.keys, key)
+	s.notifyLocked(Event{Key: key, Deleted: true, Revision: s.revision})
+}
+
+// *** shortcuts for single operations ***
+
+func (s *Store) Get(key string) (KeyValue, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kv, found := s.keys[key]
+	return kv, found
+}
+
+func (s *Store) GetPrefix(prefix string) []KeyValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rangeLocked(prefix, true)
+}
+
+func (s *Store) Put(key string, value string, lease LeaseID) error {
+	_, err := s.Txn(nil, []Op{OpPut(key, value, lease)}, nil)
+	return err
+}
+
+func (s *Store) Delete(key string) error {
+	_, err := s.Txn(nil, []Op{OpDelete(key)}, nil)
+	return err
+}
+
+// Sets a key only if it still has the expected value, or, if expected is nil, only if it doesn't exist yet. Reports
+// whether it did.
+func (s *Store) CompareAndSwap(key string, expected *string, value string) (bool, error) {
+	check := Missing(key)
+	if expected != nil {
+		check = ValueIs(key, *expected)
+	}
+	response, err := s.Txn([]Compare{check}, []Op{OpPut(key, value, NoLease)}, nil)
+	return response.Succeeded, err
+}
+
+// *** watches ***
+
+type watcher struct {
+	prefix  string
+	events  chan Event
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []Event
+	stopped bool
+	// closed once stopped, so that a delivery that nobody is waiting for anymore doesn't block forever
+	done chan struct{}
+}
+
+// Watches every key that starts with prefix, which may be a whole key. Every change made after Watch returns is
+// delivered, in order, until cancel is called, after which the channel is closed. Events are queued rather than
+// dropped, so a slow reader never misses any.
+func (s *Store) Watch(prefix string) (events <-chan Event, cancel func()) {
+	events, cancel, _ = s.WatchFrom(prefix, 0)
+	return events, cancel
+}
+
+// Like Watch, but also delivers every change already made at or after fromRevision, before any made afterwards. A
+// fromRevision of zero means only changes made after WatchFrom returns. Like etcd, fails if the changes from
+// fromRevision onwards are no longer all available because of Compact.
+func (s *Store) WatchFrom(prefix string, fromRevision int64) (events <-chan Event, cancel func(), err error) {
+	w := &watcher{prefix: prefix, events: make(chan Event), done: make(chan struct{})}
+	w.cond = sync.NewCond(&w.mu)
+	s.mu.Lock()
+	if fromRevision != 0 && fromRevision <= s.compacted {
+		compacted := s.compacted
+		s.mu.Unlock()
+		return nil, nil, fmt.Errorf("required revision %d has been compacted (up to %d)", fromRevision, compacted)
+	}
+	if fromRevision != 0 {
+		for _, event := range s.history {
+			if event.Revision >= fromRevision && strings.HasPrefix(event.Key, prefix) {
+				w.pending = append(w.pending, event)
+			}
+		}
+	}
+	s.watchers[w] = true
+	s.mu.Unlock()
+	go w.deliver()
+	var once sync.Once
+	return w.events, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.watchers, w)
+			s.mu.Unlock()
+			w.mu.Lock()
+			w.stopped = true
+			w.cond.Broadcast()
+			w.mu.Unlock()
+			close(w.done)
+		})
+	}, nil
+}
+
+// Discards the history of changes up to and including revision, as etcd's compaction does, so that watches can no
+// longer start from those revisions.
+func (s *Store) Compact(revision int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if revision <= s.compacted || revision > s.revision {
+		return fmt.Errorf("cannot compact to revision %d: already compacted to %d, and currently at %d",
+			revision, s.compacted, s.revision)
+	}
+	kept := 0
+	for kept < len(s.history) && s.history[kept].Revision <= revision {
+		kept += 1
+	}
+	s.history = append([]Event(nil), s.history[kept:]...)
+	s.compacted = revision
+	return nil
+}
+
+func (s *Store) notifyLocked(event Event) {
+	s.history = append(s.history, event)
+	for w := range s.watchers {
+		if strings.HasPrefix(event.Key, w.prefix) {
+			w.mu.Lock()
+			w.pending = append(w.pending, event)
+			w.cond.Broadcast()
+			w.mu.Unlock()
+		}
+	}
+}
+
+func (w *watcher) deliver() {
+	defer close(w.events)
+	for {
+		w.mu.Lock()
+		for len(w.pending) == 0 && !w.stopped {
+			w.cond.Wait()
+		}
+		if w.stopped {
+			w.mu.Unlock()
+			return
+		}
+		event := w.pending[0]
+		w.pending = w.pending[1:]
+		w.mu.Unlock()
+		// sent without holding the lock, so that new events can still be queued while the reader takes its time
+		select {
+		case w.events <- event:
+		case <-w.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package mocketcd
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCompareAndSwapContention(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	s := NewStore()
+	const workers, increments = 8, 200
+	var wg sync.WaitGroup
+	var conflictsMu sync.Mutex
+	conflicts := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for done := 0; done < increments; {
+				kv, found := s.Get("counter")
+				var expected *string
+				next := 1
+				if found {
+					value, err := strconv.Atoi(kv.Value)
+					assert.NoError(err)
+					expected, next = &kv.Value, value+1
+				}
+				// give the others a chance to get in between the read and the swap
+				runtime.Gosched()
+				swapped, err := s.CompareAndSwap("counter", expected, strconv.Itoa(next))
+				assert.NoError(err)
+				if swapped {
+					done++
+				} else {
+					conflictsMu.Lock()
+					conflicts++
+					conflictsMu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	kv, found := s.Get("counter")
+	assert.True(found)
+	// every increment took effect exactly once, however many attempts lost out along the way
+	assert.Equal(strconv.Itoa(workers*increments), kv.Value)
+	assert.Equal(int64(workers*increments), kv.ModRevision)
+	assert.Equal(int64(1), kv.CreateRevision)
+	t.Logf("%d conflicts", conflicts)
+}
+
+func TestTxnMultipleKeys(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	s := NewStore()
+	require.NoError(t, s.Put("/a", "1", NoLease))
+	require.NoError(t, s.Put("/b", "2", NoLease))
+
+	// a transaction whose comparisons don't all hold changes nothing, but can still read
+	response, err := s.Txn([]Compare{ValueIs("/a", "1"), ValueIs("/b", "3")},
+		[]Op{OpPut("/a", "10", NoLease), OpDelete("/b")},
+		[]Op{OpGetPrefix("/")})
+	assert.NoError(err)
+	assert.False(response.Succeeded)
+	assert.Len(response.Results[0], 2)
+	assert.Equal(int64(2), s.Revision())
+
+	response, err = s.Txn([]Compare{ValueIs("/a", "1"), Present("/b"), Missing("/c")},
+		[]Op{OpPut("/a", "10", NoLease), OpDelete("/b"), OpPut("/c", "30", NoLease)}, nil)
+	assert.NoError(err)
+	assert.True(response.Succeeded)
+	// the whole transaction is a single revision
+	assert.Equal(int64(3), s.Revision())
+	kvs := s.GetPrefix("/")
+	assert.Equal([]string{"/a", "/c"}, []string{kvs[0].Key, kvs[1].Key})
+	assert.Equal("10", kvs[0].Value)
+	assert.Equal(int64(1), kvs[0].CreateRevision)
+	assert.Equal(int64(3), kvs[0].ModRevision)
+
+	// NoOthersWithPrefix allows exactly one exception
+	require.NoError(t, s.Put("/p/mine", "x", NoLease))
+	response, err = s.Txn([]Compare{NoOthersWithPrefix("/p/", "/p/mine")}, nil, nil)
+	assert.NoError(err)
+	assert.True(response.Succeeded)
+	require.NoError(t, s.Put("/p/theirs", "y", NoLease))
+	response, err = s.Txn([]Compare{NoOthersWithPrefix("/p/", "/p/mine")}, nil, nil)
+	assert.NoError(err)
+	assert.False(response.Succeeded)
+
+	// a put attached to a lease that doesn't exist fails without applying the rest of the transaction
+	_, err = s.Txn(nil, []Op{OpDelete("/a"), OpPut("/d", "40", LeaseID(99))}, nil)
+	assert.Error(err)
+	_, found := s.Get("/a")
+	assert.True(found)
+}
+
+func TestLeaseExpiry(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	s := NewStore()
+	short, err := s.Grant(time.Second)
+	require.NoError(t, err)
+	long, err := s.Grant(3 * time.Second)
+	require.NoError(t, err)
+	require.NoError(t, s.Put("/short", "a", short))
+	require.NoError(t, s.Put("/long", "b", long))
+	require.NoError(t, s.Put("/forever", "c", NoLease))
+
+	s.Advance(999 * time.Millisecond)
+	_, found := s.Get("/short")
+	assert.True(found)
+	remaining, alive := s.TimeToLive(short)
+	assert.True(alive)
+	assert.Equal(time.Millisecond, remaining)
+
+	s.Advance(time.Millisecond)
+	_, found = s.Get("/short")
+	assert.False(found)
+	_, alive = s.TimeToLive(short)
+	assert.False(alive)
+	// once expired, a lease can't be brought back or used again
+	assert.Error(s.KeepAlive(short))
+	assert.Error(s.Put("/short", "a", short))
+
+	// keeping a lease alive restarts its full TTL
+	s.Advance(time.Second)
+	assert.NoError(s.KeepAlive(long))
+	s.Advance(2 * time.Second)
+	_, found = s.Get("/long")
+	assert.True(found)
+	s.Advance(time.Second)
+	_, found = s.Get("/long")
+	assert.False(found)
+
+	_, found = s.Get("/forever")
+	assert.True(found)
+
+	// revoking ends a lease right away
+	revoked, err := s.Grant(time.Hour)
+	require.NoError(t, err)
+	require.NoError(t, s.Put("/revoked", "d", revoked))
+	assert.NoError(s.Revoke(revoked))
+	_, found = s.Get("/revoked")
+	assert.False(found)
+	assert.Error(s.Revoke(revoked))
+}
+
+func TestWatch(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	s := NewStore()
+	lease, err := s.Grant(time.Second)
+	require.NoError(t, err)
+	events, cancel := s.Watch("/watched/")
+	require.NoError(t, s.Put("/watched/a", "1", lease))
+	require.NoError(t, s.Put("/elsewhere", "2", NoLease))
+	require.NoError(t, s.Put("/watched/b", "3", NoLease))
+	s.Advance(time.Second)
+
+	assert.Equal(Event{Key: "/watched/a", Value: "1", Revision: 1}, <-events)
+	assert.Equal(Event{Key: "/watched/b", Value: "3", Revision: 3}, <-events)
+	// expiry shows up as a deletion, like any other
+	assert.Equal(Event{Key: "/watched/a", Deleted: true, Revision: 4}, <-events)
+
+	cancel()
+	for range events {
+		// anything still queued may or may not be delivered, but the channel is closed either way
+	}
+	cancel()
+}
@@ -0,0 +1,316 @@
+package mocketcd
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"zircon/apis"
+)
+
+// The same states as in the etcd package, with the same transitions, though stored as JSON rather than in a packed
+// binary form, so that a test poking around the store can read it.
+type syncLock struct {
+	Writer         apis.SyncID
+	IsWritePending bool
+	Readers        []apis.SyncID
+}
+
+const noSync apis.SyncID = 0
+
+func (s syncLock) isWriter() bool {
+	return s.Writer != noSync && !s.IsWritePending
+}
+
+func (s syncLock) isReaders() bool {
+	return s.Writer == noSync && !s.IsWritePending && len(s.Readers) != 0
+}
+
+func (s syncLock) isUnlocked() bool {
+	return s.Writer == noSync && !s.IsWritePending && len(s.Readers) == 0
+}
+
+func (s syncLock) hasReader(sync apis.SyncID) bool {
+	for _, reader := range s.Readers {
+		if reader == sync {
+			return true
+		}
+	}
+	return false
+}
+
+func (s syncLock) withoutReader(sync apis.SyncID) syncLock {
+	var readers []apis.SyncID
+	for _, reader := range s.Readers {
+		if reader != sync {
+			readers = append(readers, reader)
+		}
+	}
+	s.Readers = readers
+	return s
+}
+
+func lockKey(chunk apis.ChunkNum) string {
+	return fmt.Sprintf("/fs/lock/%d", chunk)
+}
+
+func syncKey(sync apis.SyncID) string {
+	return fmt.Sprintf("/fs/sync/%d", sync)
+}
+
+func encodeUint64(value uint64) string {
+	bin := make([]byte, 8)
+	binary.LittleEndian.PutUint64(bin, value)
+	return string(bin)
+}
+
+func decodeUint64(value string) (uint64, error) {
+	if len(value) != 8 {
+		return 0, fmt.Errorf("malformed number of length %d", len(value))
+	}
+	return binary.LittleEndian.Uint64([]byte(value)), nil
+}
+
+// Looks up the state of a chunk's lock, along with a comparison that holds only as long as the state stays the same.
+func (e *mockinterface) lookupLock(chunk apis.ChunkNum) (syncLock, Compare, error) {
+	kv, found, err := e.get(lockKey(chunk))
+	if err != nil {
+		return syncLock{}, Compare{}, err
+	}
+	if !found {
+		return syncLock{}, Missing(lockKey(chunk)), nil
+	}
+	var sl syncLock
+	if err := json.Unmarshal([]byte(kv.Value), &sl); err != nil {
+		return syncLock{}, Compare{}, err
+	}
+	return sl, ValueIs(lockKey(chunk), kv.Value), nil
+}
+
+// Replaces the state of a chunk's lock, along with any extra operations, as long as it hasn't changed since it was
+// looked up. Returns whether it went through.
+func (e *mockinterface) rewriteLock(chunk apis.ChunkNum, unchanged Compare, next syncLock, extra ...Op) (bool, error) {
+	update := OpDelete(lockKey(chunk))
+	if !next.isUnlocked() {
+		encoded, err := json.Marshal(next)
+		if err != nil {
+			return false, err
+		}
+		update = OpPut(lockKey(chunk), string(encoded), NoLease)
+	}
+	response, err := e.txn([]Compare{unchanged}, append([]Op{update}, extra...), nil)
+	if err != nil {
+		return false, err
+	}
+	return response.Succeeded, nil
+}
+
+// Calls f repeatedly until it returns true, waiting for the chunk's lock to change between calls.
+func (e *mockinterface) watchLoop(chunk apis.ChunkNum, f func() (bool, error)) error {
+	// watching before the first call, so that no change can slip by between the call and the wait
+	events, cancel := e.store.Watch(lockKey(chunk))
+	defer cancel()
+	for {
+		pass, err := f()
+		if pass || err != nil {
+			return err
+		}
+		if _, ok := <-events; !ok {
+			return errors.New("watch ended unexpectedly")
+		}
+	}
+}
+
+func (e *mockinterface) nextSyncID() (apis.SyncID, error) {
+	for {
+		kv, found, err := e.get("/fs/nextsync")
+		if err != nil {
+			return 0, err
+		}
+		check, last := Missing("/fs/nextsync"), uint64(0)
+		if found {
+			last, err = decodeUint64(kv.Value)
+			if err != nil {
+				return 0, err
+			}
+			check = ValueIs("/fs/nextsync", kv.Value)
+		}
+		response, err := e.txn([]Compare{check}, []Op{OpPut("/fs/nextsync", encodeUint64(last+1), NoLease)}, nil)
+		if err != nil {
+			return 0, err
+		}
+		if response.Succeeded {
+			return apis.SyncID(last + 1), nil
+		}
+		// try again!
+	}
+}
+
+func (e *mockinterface) getSyncChunk(sync apis.SyncID) (apis.ChunkNum, error) {
+	kv, found, err := e.get(syncKey(sync))
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, errors.New("no such syncid")
+	}
+	chunk, err := decodeUint64(kv.Value)
+	return apis.ChunkNum(chunk), err
+}
+
+// Waits until nobody is writing or trying to write, and then joins the readers.
+func (e *mockinterface) StartSync(chunk apis.ChunkNum) (apis.SyncID, error) {
+	if err := e.enter("StartSync"); err != nil {
+		return noSync, err
+	}
+	sync, err := e.nextSyncID()
+	if err != nil {
+		return noSync, err
+	}
+	return sync, e.watchLoop(chunk, func() (bool, error) {
+		for {
+			sl, unchanged, err := e.lookupLock(chunk)
+			if err != nil {
+				return false, err
+			}
+			if !sl.isUnlocked() && !sl.isReaders() {
+				return false, nil
+			}
+			sl.Readers = append(append([]apis.SyncID(nil), sl.Readers...), sync)
+			success, err := e.rewriteLock(chunk, unchanged, sl, OpPut(syncKey(sync), encodeUint64(uint64(chunk)), NoLease))
+			if err != nil || success {
+				return success, err
+			}
+			// not added due to conflict; let's try again
+		}
+	})
+}
+
+// Marks the lock as elevating, which keeps new readers out, and then waits for the remaining readers to leave before
+// becoming the writer. Fails right away if someone else is already elevating.
+func (e *mockinterface) UpgradeSync(s apis.SyncID) (apis.SyncID, error) {
+	if err := e.enter("UpgradeSync"); err != nil {
+		return 0, err
+	}
+	newsync, err := e.nextSyncID()
+	if err != nil {
+		return 0, err
+	}
+	chunk, err := e.getSyncChunk(s)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		sl, unchanged, err := e.lookupLock(chunk)
+		if err != nil {
+			return 0, err
+		}
+		if !sl.isReaders() && !sl.isUnlocked() {
+			return 0, errors.New("lock access contended")
+		}
+		if !sl.hasReader(s) {
+			return 0, errors.New("should already hold a read lock when trying to upgrade")
+		}
+		elevating := sl.withoutReader(s)
+		elevating.Writer, elevating.IsWritePending = s, true
+		success, err := e.rewriteLock(chunk, unchanged, elevating)
+		if err != nil {
+			return 0, err
+		}
+		if success {
+			break
+		}
+		// not added due to conflict; let's go around again
+	}
+
+	err = e.watchLoop(chunk, func() (bool, error) {
+		for {
+			sl, unchanged, err := e.lookupLock(chunk)
+			if err != nil {
+				return false, err
+			}
+			if !sl.IsWritePending || sl.Writer != s {
+				return false, errors.New("elevation aborted")
+			}
+			if len(sl.Readers) != 0 {
+				return false, nil
+			}
+			// the old sync stays on as a reader, so that it still has to be released
+			writer := syncLock{Writer: newsync, Readers: []apis.SyncID{s}}
+			success, err := e.rewriteLock(chunk, unchanged, writer, OpPut(syncKey(newsync), encodeUint64(uint64(chunk)), NoLease))
+			if err != nil || success {
+				return success, err
+			}
+			// not added due to conflict; let's try again
+		}
+	})
+	if err != nil {
+		// ensure our elevation has been dropped
+		for {
+			sl, unchanged, err2 := e.lookupLock(chunk)
+			if err2 != nil {
+				return 0, fmt.Errorf("encountered %v while cleaning up after %v", err2, err)
+			}
+			if !sl.IsWritePending || sl.Writer != s {
+				break
+			}
+			sl.Writer, sl.IsWritePending = noSync, false
+			success, err2 := e.rewriteLock(chunk, unchanged, sl)
+			if err2 != nil {
+				return 0, fmt.Errorf("encountered %v while cleaning up after %v", err2, err)
+			}
+			if success {
+				break
+			}
+		}
+		return 0, err
+	}
+	return newsync, nil
+}
+
+func (e *mockinterface) ReleaseSync(s apis.SyncID) error {
+	if err := e.enter("ReleaseSync"); err != nil {
+		return err
+	}
+	chunk, err := e.getSyncChunk(s)
+	if err != nil {
+		return err
+	}
+	for {
+		sl, unchanged, err := e.lookupLock(chunk)
+		if err != nil {
+			return err
+		}
+		if sl.hasReader(s) {
+			sl = sl.withoutReader(s)
+		} else if (sl.isWriter() || sl.IsWritePending) && sl.Writer == s {
+			sl.Writer, sl.IsWritePending = noSync, false
+		} else {
+			// the real implementation panics here; a mock is more useful if it reports the problem instead
+			return fmt.Errorf("sync %d does not hold a lock on chunk %d", s, chunk)
+		}
+		success, err := e.rewriteLock(chunk, unchanged, sl, OpDelete(syncKey(s)))
+		if err != nil || success {
+			return err
+		}
+		// not removed due to conflict; let's go around again
+	}
+}
+
+func (e *mockinterface) ConfirmSync(s apis.SyncID) (write bool, err error) {
+	if err := e.enter("ConfirmSync"); err != nil {
+		return false, err
+	}
+	chunk, err := e.getSyncChunk(s)
+	if err != nil {
+		return false, err
+	}
+	sl, _, err := e.lookupLock(chunk)
+	if err != nil {
+		return false, err
+	}
+	if !sl.hasReader(s) && sl.Writer != s {
+		return false, errors.New("could not find sync")
+	}
+	return sl.Writer == s, nil
+}
@@ -461,6 +461,46 @@ func (e *etcdinterface) ReadFSRoot() (apis.ChunkNum, error) {
 	}
 }
 
+const ChunkSizeKey = "/cluster/chunk-size"
+
+func (e *etcdinterface) RecordChunkSize(size uint32) (uint32, error) {
+	if size == 0 {
+		return 0, errors.New("chunk size cannot be zero")
+	}
+	nsize := make([]byte, 4)
+	binary.LittleEndian.PutUint32(nsize, size)
+	resp, err := e.Client.Txn(context.Background()).
+		If(clientv3.Compare(clientv3.CreateRevision(ChunkSizeKey), "=", 0)).
+		Then(clientv3.OpPut(ChunkSizeKey, string(nsize))).
+		Else(clientv3.OpGet(ChunkSizeKey)).
+		Commit()
+	if err != nil {
+		return 0, err
+	}
+	if resp.Succeeded {
+		return size, nil
+	}
+	kvs := resp.Responses[0].GetResponseRange().Kvs
+	if len(kvs) == 0 || len(kvs[0].Value) != 4 {
+		return 0, errors.New("malformed chunk size recorded for cluster")
+	}
+	return binary.LittleEndian.Uint32(kvs[0].Value), nil
+}
+
+func (e *etcdinterface) GetChunkSize() (uint32, error) {
+	resp, err := e.Client.Get(context.Background(), ChunkSizeKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return 0, nil
+	}
+	if len(resp.Kvs[0].Value) != 4 {
+		return 0, errors.New("malformed chunk size recorded for cluster")
+	}
+	return binary.LittleEndian.Uint32(resp.Kvs[0].Value), nil
+}
+
 func (e *etcdinterface) WriteFSRoot(chunk apis.ChunkNum) (error) {
 	nchunk := make([]byte, 8)
 	binary.LittleEndian.PutUint64(nchunk, uint64(chunk))
@@ -0,0 +1,146 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"log"
+	"sync"
+	"time"
+	"zircon/apis"
+	"zircon/util"
+)
+
+// How long to wait before re-establishing a watch that etcd dropped, so that a cluster that keeps dropping it isn't
+// hammered with requests. The wait grows each time a new stream ends without delivering anything.
+func watchRetryBackoff() util.Backoff {
+	return util.ExponentialBackoff(100*time.Millisecond, 5*time.Second)
+}
+
+// Starts a single stream of watch responses for every key under a prefix, beginning at a revision. Stands in for the
+// etcd client in tests, which need to be able to drop streams on demand.
+type watchStarter func(ctx context.Context, prefix string, revision int64) clientv3.WatchChan
+
+// Keeps track of how far a watch has got, so that it can be resumed after a disconnect without missing or repeating
+// anything. Several events can share a revision, when a transaction changed several keys at once, so the position is
+// a revision along with how many of its events have been delivered.
+type watchCursor struct {
+	revision  int64
+	delivered int
+	// how many events at revision the current stream has gone past, delivered or not
+	seen int
+}
+
+// Starts counting afresh for a new stream, which begins again at the cursor's revision.
+func (c *watchCursor) restart() {
+	c.seen = 0
+}
+
+// Reports whether an event at a revision should be delivered, and counts it as delivered if so. Anything the cursor has
+// already gone past, whether it was delivered by an earlier stream or arrived out of order, is skipped.
+func (c *watchCursor) admit(revision int64) bool {
+	if revision < c.revision {
+		return false
+	}
+	if revision == c.revision {
+		c.seen += 1
+		if c.seen <= c.delivered {
+			return false
+		}
+		c.delivered += 1
+		return true
+	}
+	c.revision, c.delivered, c.seen = revision, 1, 1
+	return true
+}
+
+func (e *etcdinterface) Watch(prefix string, fromRevision int64) (<-chan apis.WatchEvent, func(), error) {
+	if fromRevision < 0 {
+		return nil, nil, fmt.Errorf("[watch.go/REV] cannot watch from negative revision %d", fromRevision)
+	}
+	if fromRevision == 0 {
+		// settle on the starting point now, so that nothing changed between Watch returning and the stream being
+		// established is missed
+		response, err := e.Client.Get(context.Background(), prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+		if err != nil {
+			return nil, nil, fmt.Errorf("[watch.go/GET] %v", err)
+		}
+		fromRevision = response.Header.Revision + 1
+	}
+	events, cancel := runWatch(func(ctx context.Context, prefix string, revision int64) clientv3.WatchChan {
+		// requiring a leader means that a member cut off from the rest of the cluster closes the stream, rather than
+		// leaving it silently hanging, so that it gets re-established against a member that can still serve it
+		return e.Client.Watch(clientv3.WithRequireLeader(ctx), prefix, clientv3.WithPrefix(), clientv3.WithRev(revision))
+	}, prefix, fromRevision, watchRetryBackoff())
+	return events, cancel, nil
+}
+
+// Delivers the changes from one stream after another, each picking up where the last one left off, until cancelled.
+// Cancelling waits for delivery to stop, so that nothing more is sent once it returns.
+func runWatch(start watchStarter, prefix string, fromRevision int64, backoff util.Backoff) (<-chan apis.WatchEvent, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan apis.WatchEvent)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(events)
+		cursor := &watchCursor{revision: fromRevision}
+		backoff.Reset()
+		for {
+			cursor.restart()
+			before := *cursor
+			if !deliverStream(ctx, start(ctx, prefix, cursor.revision), cursor, events) {
+				return
+			}
+			if cursor.revision != before.revision || cursor.delivered != before.delivered {
+				// the stream was working for a while, so this is a fresh failure rather than more of the same
+				backoff.Reset()
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff.Next()):
+			}
+		}
+	}()
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+}
+
+// Delivers events from a single stream until it ends. Reports whether it is worth starting another one.
+func deliverStream(ctx context.Context, stream clientv3.WatchChan, cursor *watchCursor, events chan<- apis.WatchEvent) bool {
+	for response := range stream {
+		if response.CompactRevision != 0 {
+			log.Printf("watch cannot resume from revision %d, which was compacted away (up to %d)",
+				cursor.revision, response.CompactRevision)
+			return false
+		}
+		if err := response.Err(); err != nil {
+			// the stream is about to be closed; the next one picks up from the same place
+			break
+		}
+		for _, ev := range response.Events {
+			if !cursor.admit(ev.Kv.ModRevision) {
+				continue
+			}
+			event := apis.WatchEvent{Type: apis.WatchPut, Key: string(ev.Kv.Key), Revision: ev.Kv.ModRevision}
+			if ev.Type == mvccpb.DELETE {
+				event.Type = apis.WatchDelete
+			} else {
+				event.Value = string(ev.Kv.Value)
+			}
+			select {
+			case events <- event:
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+	return ctx.Err() == nil
+}
@@ -0,0 +1,156 @@
+package etcd
+
+import (
+	"context"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/util"
+)
+
+func putEvent(key string, value string, revision int64) *clientv3.Event {
+	return &clientv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(key), Value: []byte(value), ModRevision: revision}}
+}
+
+// Stands in for etcd, handing out a scripted stream each time a watch is started, and recording the revision that each
+// was started from. A stream ends after its responses, as if etcd had dropped it.
+type scriptedStreams struct {
+	streams   [][]clientv3.WatchResponse
+	revisions chan int64
+}
+
+func (s *scriptedStreams) start(ctx context.Context, prefix string, revision int64) clientv3.WatchChan {
+	s.revisions <- revision
+	stream := make(chan clientv3.WatchResponse)
+	var responses []clientv3.WatchResponse
+	if len(s.streams) > 0 {
+		responses, s.streams = s.streams[0], s.streams[1:]
+	}
+	go func() {
+		defer close(stream)
+		for _, response := range responses {
+			select {
+			case stream <- response:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if len(responses) == 0 {
+			// nothing more to say, so hold the stream open until the watch is cancelled
+			<-ctx.Done()
+		}
+	}()
+	return stream
+}
+
+func receiveEvents(t *testing.T, events <-chan apis.WatchEvent, n int) []apis.WatchEvent {
+	var received []apis.WatchEvent
+	for len(received) < n {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatalf("watch ended after %d events", len(received))
+			}
+			received = append(received, event)
+		case <-time.After(time.Second):
+			t.Fatalf("only received %d events", len(received))
+		}
+	}
+	return received
+}
+
+func TestWatchResumesAfterDisconnect(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	scripted := &scriptedStreams{
+		streams: [][]clientv3.WatchResponse{
+			// dropped partway through a transaction that changed two keys at revision 6
+			{
+				{Events: []*clientv3.Event{putEvent("/a/1", "one", 5)}},
+				{Events: []*clientv3.Event{putEvent("/a/2", "two", 6)}},
+			},
+			// resumed from revision 6, so etcd sends all of it again
+			{
+				{Events: []*clientv3.Event{putEvent("/a/2", "two", 6), putEvent("/a/3", "three", 6)}},
+				{Events: []*clientv3.Event{
+					{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte("/a/1"), ModRevision: 7}},
+				}},
+			},
+		},
+		revisions: make(chan int64, 10),
+	}
+	events, cancel := runWatch(scripted.start, "/a/", 5, util.ConstantBackoff(time.Millisecond))
+
+	assert.Equal([]apis.WatchEvent{
+		{Type: apis.WatchPut, Key: "/a/1", Value: "one", Revision: 5},
+		{Type: apis.WatchPut, Key: "/a/2", Value: "two", Revision: 6},
+		{Type: apis.WatchPut, Key: "/a/3", Value: "three", Revision: 6},
+		{Type: apis.WatchDelete, Key: "/a/1", Revision: 7},
+	}, receiveEvents(t, events, 4))
+	assert.Equal(int64(5), <-scripted.revisions)
+	assert.Equal(int64(6), <-scripted.revisions)
+	// and the third stream picks up right after the deletion
+	assert.Equal(int64(7), <-scripted.revisions)
+
+	cancel()
+	_, ok := <-events
+	assert.False(ok)
+	// cancelling twice is harmless
+	cancel()
+}
+
+func TestWatchSkipsOutOfOrderEvents(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	scripted := &scriptedStreams{
+		streams: [][]clientv3.WatchResponse{
+			{
+				{Events: []*clientv3.Event{putEvent("/a/1", "one", 8), putEvent("/a/2", "stale", 7)}},
+				{Events: []*clientv3.Event{putEvent("/a/3", "early", 3), putEvent("/a/4", "four", 9)}},
+			},
+		},
+		revisions: make(chan int64, 10),
+	}
+	events, cancel := runWatch(scripted.start, "/a/", 8, util.ConstantBackoff(time.Millisecond))
+	defer cancel()
+
+	assert.Equal([]apis.WatchEvent{
+		{Type: apis.WatchPut, Key: "/a/1", Value: "one", Revision: 8},
+		{Type: apis.WatchPut, Key: "/a/4", Value: "four", Revision: 9},
+	}, receiveEvents(t, events, 2))
+}
+
+func TestWatchEndsWhenCompacted(t *testing.T) {
+	scripted := &scriptedStreams{
+		streams:   [][]clientv3.WatchResponse{{{CompactRevision: 10}}},
+		revisions: make(chan int64, 10),
+	}
+	events, cancel := runWatch(scripted.start, "/a/", 5, util.ConstantBackoff(time.Millisecond))
+	defer cancel()
+
+	select {
+	case _, ok := <-events:
+		testifyAssert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("watch did not end")
+	}
+}
+
+func TestWatchCursor(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	cursor := &watchCursor{revision: 4}
+	assert.True(cursor.admit(4))
+	assert.True(cursor.admit(4))
+	assert.True(cursor.admit(5))
+	assert.False(cursor.admit(4))
+
+	// a new stream starting from 5 again only delivers what the last one didn't get to
+	cursor.restart()
+	assert.False(cursor.admit(5))
+	assert.True(cursor.admit(5))
+	assert.True(cursor.admit(6))
+}
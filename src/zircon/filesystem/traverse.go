@@ -99,9 +99,13 @@ func (t Traverser) PathDir(path string) (*Reference, error) {
 
 const EntrySize = 32
 const MaxName = EntrySize - 8 - 1
-const EntryCount = apis.MaxChunkSize / EntrySize
 const MaxSymLinkSize = 1024
 
+// The number of entries that fit in a directory, which takes up a whole chunk.
+func entryCount(chunkSize uint32) int {
+	return int(chunkSize / EntrySize)
+}
+
 type Entry struct {
 	Index int        // not stored in encoding; broadly optional
 	Type  NodeType
@@ -138,12 +142,16 @@ func (r *Reference) listEntries() ([]Entry, apis.Version, error) {
 	if err := r.unlocker.Ensure(); err != nil {
 		return nil, 0, err
 	}
-	data, ver, err := r.t.client.Read(r.chunk, 0, apis.MaxChunkSize)
+	chunkSize, err := r.t.client.GetChunkSize()
+	if err != nil {
+		return nil, 0, err
+	}
+	data, ver, err := r.t.client.Read(r.chunk, 0, chunkSize)
 	if err != nil {
 		return nil, 0, err
 	}
 	var result []Entry
-	for i := 0; i < EntryCount; i++ {
+	for i := 0; i < entryCount(chunkSize); i++ {
 		entry := decode(data[i *EntrySize:i *EntrySize+EntrySize], i)
 		if !entry.IsOk() {
 			return nil, 0, errors.New("found invalid entry in folder!")
@@ -286,6 +294,10 @@ func (r *Reference) scanNewEntry(name string) (int, apis.Version, error) {
 	if err != nil {
 		return 0, 0, err
 	}
+	chunkSize, err := r.t.client.GetChunkSize()
+	if err != nil {
+		return 0, 0, err
+	}
 	firstFree := 0
 	for _, entry := range entries {
 		if entry.Name == name {
@@ -295,7 +307,7 @@ func (r *Reference) scanNewEntry(name string) (int, apis.Version, error) {
 			firstFree++ // lets firstFree land on the first empty entry
 		}
 	}
-	if firstFree >= EntryCount {
+	if firstFree >= entryCount(chunkSize) {
 		return 0, 0, errors.New("no room in directory for another file")
 	}
 	return firstFree, ver, nil
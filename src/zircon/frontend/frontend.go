@@ -54,3 +54,8 @@ func (f *frontend) CommitWrite(chunk apis.ChunkNum, version apis.Version, hash a
 func (f *frontend) Delete(chunk apis.ChunkNum, version apis.Version) error {
 	return f.updater.Delete(chunk, version)
 }
+
+// Reports the maximum chunk size of the cluster.
+func (f *frontend) GetChunkSize() (uint32, error) {
+	return f.updater.ChunkSize()
+}
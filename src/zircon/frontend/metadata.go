@@ -1,6 +1,7 @@
 package frontend
 
 import (
+	"context"
 	"zircon/apis"
 	"zircon/rpc"
 	"zircon/chunkupdate"
@@ -14,6 +15,11 @@ type reselectingMetadataUpdater struct {
 
 var _ chunkupdate.UpdaterMetadata = &reselectingMetadataUpdater{}
 
+// Attributes the changes we make to this frontend in the metadata caches' audit logs.
+func (r *reselectingMetadataUpdater) callerContext() context.Context {
+	return apis.WithCaller(context.Background(), string(r.etcd.GetName()))
+}
+
 // TODO: avoid inefficiently rerequesting access to the same metadata caches...
 // (though these *are* cached by the RPC connectionCache, so it shouldn't be completely horrible)
 func (r *reselectingMetadataUpdater) getMetadataCache() (apis.MetadataCache, error) {
@@ -75,7 +81,7 @@ func (r *reselectingMetadataUpdater) NewEntry() (apis.ChunkNum, error) {
 	if err != nil {
 		return 0, fmt.Errorf("[metadata.go/GMC] %v", err)
 	}
-	chunk, err := cache.NewEntry()
+	chunk, err := cache.NewEntryWithContext(r.callerContext())
 	if err != nil {
 		return 0, fmt.Errorf("[metadata.go/CNE] %v", err)
 	}
@@ -85,7 +91,7 @@ func (r *reselectingMetadataUpdater) NewEntry() (apis.ChunkNum, error) {
 func (r *reselectingMetadataUpdater) ReadEntry(chunk apis.ChunkNum) (apis.MetadataEntry, error) {
 	var entry apis.MetadataEntry
 	err := r.runRedirectionLoop(func(cache apis.MetadataCache) (redirect apis.ServerName, err error) {
-		entry, redirect, err = cache.ReadEntry(chunk)
+		entry, redirect, err = cache.ReadEntry(chunk, apis.Fresh)
 		return
 	})
 	if err == nil && len(entry.Replicas) == 0 {
@@ -96,12 +102,12 @@ func (r *reselectingMetadataUpdater) ReadEntry(chunk apis.ChunkNum) (apis.Metada
 
 func (r *reselectingMetadataUpdater) UpdateEntry(chunk apis.ChunkNum, previous apis.MetadataEntry, next apis.MetadataEntry) error {
 	return r.runRedirectionLoop(func(cache apis.MetadataCache) (apis.ServerName, error) {
-		return cache.UpdateEntry(chunk, previous, next)
+		return cache.UpdateEntryWithContext(r.callerContext(), chunk, previous, next)
 	})
 }
 
 func (r *reselectingMetadataUpdater) DeleteEntry(chunk apis.ChunkNum, previous apis.MetadataEntry) error {
 	return r.runRedirectionLoop(func(cache apis.MetadataCache) (apis.ServerName, error) {
-		return cache.DeleteEntry(chunk, previous)
+		return cache.DeleteEntryWithContext(r.callerContext(), chunk, previous)
 	})
 }
@@ -42,3 +42,7 @@ func (r *roundrobin) New() (apis.ChunkNum, error) {
 func (r *roundrobin) Delete(chunk apis.ChunkNum, version apis.Version) error {
 	return r.next().Delete(chunk, version)
 }
+
+func (r *roundrobin) GetChunkSize() (uint32, error) {
+	return r.next().GetChunkSize()
+}
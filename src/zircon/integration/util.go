@@ -33,8 +33,7 @@ func PrepareNetworkedCluster(t *testing.T) (fe apis.Client, teardown func()) {
 		teardowns.Add(func() { teardown4(true) })
 
 		etcdif, teardown := etcds(name)
-		teardowns.Add(teardown)
-		etcdif.UpdateAddress(csaddr, apis.CHUNKSERVER)
+		teardowns.Add(chunkserver.RegisterTestChunkserver(t, etcdif, csaddr), teardown)
 	}
 
 	config := client.Configuration{}
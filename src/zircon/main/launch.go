@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"gopkg.in/yaml.v2"
+	"io"
 	"log"
 	"os"
+	"strconv"
+	"time"
 	"zircon/apis"
 	"zircon/chunkserver"
 	"zircon/chunkserver/control"
@@ -24,8 +27,64 @@ type Config struct {
 	ServerName apis.ServerName `yaml:"server-name"`
 	Address    apis.ServerAddress
 
+	// the name of any backend registered with storage.RegisterBackend; "memory", "filesystem", and "block" are built in
 	StorageType string `yaml:"storage-type"`
 	StoragePath string `yaml:"storage-path"`
+	// settings for the storage backend, passed along as they are; the built-in backends can take the settings below
+	// from here too, under the names listed by their factories in the storage package
+	StorageConfig map[string]string `yaml:"storage-config"`
+	// only applies to filesystem storage
+	StorageLog bool `yaml:"storage-log"`
+	// only applies to filesystem storage; one of "none" (the default), "commit", or "stage-and-commit"
+	StorageDurability string `yaml:"storage-durability"`
+	// only applies to filesystem storage; keep staged writes in a single log, synced before each write is acknowledged
+	StorageStagingLog bool `yaml:"storage-staging-log"`
+	// only applies to filesystem storage; bytes of version files to map into memory for reads; zero disables mapping
+	StorageMappedReadCapacity int `yaml:"storage-mapped-read-capacity"`
+	// only applies to filesystem storage; how thoroughly to check files on startup: one of "none" (the default),
+	// "lengths", or "checksums", which reads every version in full
+	StorageIntegrityCheck string `yaml:"storage-integrity-check"`
+	// only applies to memory storage; the most bytes of chunk data to hold, or zero for no limit
+	StorageCapacity int `yaml:"storage-capacity"`
+	// compress chunk data at rest; must stay the same for the lifetime of the storage
+	StorageCompression bool `yaml:"storage-compression"`
+	// store new versions as deltas against older ones; must stay the same for the lifetime of the storage
+	StorageCopyOnWrite bool `yaml:"storage-copy-on-write"`
+	// encrypt chunk data at rest under the master keys in this file, one "<id> <hex key>" per line, with the last one
+	// used for new data; keys that are still in use must stay in the file, and the setting must stay for the lifetime
+	// of the storage
+	StorageEncryptionKeys string `yaml:"storage-encryption-keys"`
+	// share storage between versions when a commit doesn't change a chunk's contents
+	Deduplicate bool `yaml:"deduplicate"`
+	// bytes of memory to use for prefetching chunks that are read sequentially; zero disables read-ahead
+	ReadAheadCapacity int `yaml:"read-ahead-capacity"`
+	// bytes of storage to keep free for commits and repairs; new chunks and writes that would use it are refused
+	StorageReserve uint64 `yaml:"storage-reserve"`
+	// refuse to serve if more than this many damaged versions are found on startup; zero for no limit
+	StorageDamageLimit int `yaml:"storage-damage-limit"`
+	// compact storage in the background, removing leftover versions and tidying up the rest, using at most
+	// storage-compaction-bandwidth bytes per second (zero for no limit), and waiting storage-compaction-interval, such
+	// as "1h", between passes over every chunk (zero means the default of an hour)
+	StorageCompaction          bool          `yaml:"storage-compaction"`
+	StorageCompactionBandwidth int64         `yaml:"storage-compaction-bandwidth"`
+	StorageCompactionInterval  time.Duration `yaml:"storage-compaction-interval"`
+	// the most bytes per second a chunkserver sends when repairing other chunkservers; zero for no limit
+	ReplicationBandwidth int64 `yaml:"replication-bandwidth"`
+	// the longest a metadata cache spends retrying a single entry update, such as "5s"; zero for no limit
+	MetadataUpdateBudget time.Duration `yaml:"metadata-update-budget"`
+	// set allocation bits that were lost in a crash when a metadata cache reads the entries they belong to
+	MetadataRepairOnRead bool `yaml:"metadata-repair-on-read"`
+	// how long a metadata cache waits for etcd to grant its lease on startup, such as "10s"; zero means the default
+	MetadataStartTimeout time.Duration `yaml:"metadata-start-timeout"`
+	// the largest a chunk can be, in bytes; must be the same across the cluster, and zero means the default of 8 MiB
+	ChunkSize uint32 `yaml:"chunk-size"`
+	// how long chunkserver operations that read or write chunk data, and all other chunkserver operations, can take
+	// before they're logged as slow, such as "500ms"; zero never logs them
+	SlowDataThreshold    time.Duration `yaml:"slow-data-threshold"`
+	SlowControlThreshold time.Duration `yaml:"slow-control-threshold"`
+	// how many commits a chunkserver checks staged data against its hash for: "all" (the default), "none", or a
+	// fraction such as "0.1"; anything short of all risks storing writes that were damaged after they were staged
+	CommitHashVerification string `yaml:"commit-hash-verification"`
 
 	EtcdServers         []apis.ServerAddress `yaml:"etcd-servers"`
 	ClientConfig        client.Configuration `yaml:"client-config"`
@@ -46,22 +105,119 @@ func LoadConfig(path string) (*Config, error) {
 	return config, err
 }
 
-func ConfigureChunkserverStorage(config *Config) (store storage.ChunkStorage, err error) {
+// The settings for the storage backend, from storage-config, along with those of the dedicated fields that apply to the
+// chosen backend, for the backends that are built in.
+func storageBackendConfig(config *Config) map[string]string {
+	settings := map[string]string{}
+	for key, value := range config.StorageConfig {
+		settings[key] = value
+	}
+	set := func(key string, value string, isSet bool) {
+		if isSet {
+			settings[key] = value
+		}
+	}
 	switch config.StorageType {
-	case "":
-		err = fmt.Errorf("no specified kind of storage for chunkserver")
 	case "memory":
-		store, err = storage.ConfigureMemoryStorage()
+		set("capacity", strconv.Itoa(config.StorageCapacity), config.StorageCapacity != 0)
 	case "filesystem":
-		store, err = storage.ConfigureFilesystemStorage(config.StoragePath)
+		set("path", config.StoragePath, config.StoragePath != "")
+		set("log", "true", config.StorageLog)
+		set("durability", config.StorageDurability, config.StorageDurability != "")
+		set("staging-log", "true", config.StorageStagingLog)
+		set("mapped-read-capacity", strconv.Itoa(config.StorageMappedReadCapacity), config.StorageMappedReadCapacity != 0)
+		set("integrity-check", config.StorageIntegrityCheck, config.StorageIntegrityCheck != "")
 	case "block":
-		store, err = storage.ConfigureBlockStorage(config.StoragePath)
-	default:
-		err = fmt.Errorf("no such storage type: %s\n", config.StorageType)
+		set("path", config.StoragePath, config.StoragePath != "")
+	}
+	return settings
+}
+
+func ConfigureChunkserverStorage(config *Config) (store storage.ChunkStorage, err error) {
+	if config.StorageType == "" {
+		err = fmt.Errorf("no specified kind of storage for chunkserver")
+	} else {
+		store, err = storage.ConfigureStorage(config.StorageType, storageBackendConfig(config))
+	}
+	// encryption goes underneath everything else, since encrypted data can't be compressed or diffed
+	if err == nil && config.StorageEncryptionKeys != "" {
+		var keys storage.KeyProvider
+		keys, err = storage.ReadKeyFile(config.StorageEncryptionKeys)
+		if err == nil {
+			store = storage.WithEncryption(store, keys)
+		} else {
+			store.Close()
+		}
+	}
+	// compression goes underneath copy-on-write, so that deltas get compressed too
+	if err == nil && config.StorageCompression {
+		store = storage.WithCompression(store, storage.FlateCodec())
+	}
+	if err == nil && config.StorageCopyOnWrite {
+		store = storage.WithCopyOnWrite(store)
 	}
 	return store, err
 }
 
+// Parses the commit-hash-verification setting: "all" or nothing, "none", or the fraction of commits to verify.
+func parseCommitHashVerification(setting string) (control.CommitHashVerification, float64, error) {
+	switch setting {
+	case "", "all":
+		return control.VerifyEveryCommit, 0, nil
+	case "none":
+		return control.VerifyNoCommits, 0, nil
+	}
+	rate, err := strconv.ParseFloat(setting, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("commit-hash-verification must be \"all\", \"none\", or a fraction: %q", setting)
+	}
+	return control.VerifySampledCommits, rate, nil
+}
+
+// Builds the chunkserver that LaunchChunkserver serves over the given storage: a single chunkserver that talks to the
+// others, with its calls counted for GetStats. Returns the single chunkserver too, for what only it can report.
+func buildChunkserver(config *Config, store storage.ChunkStorage, conncache rpc.ConnectionCache) (apis.Chunkserver, apis.ChunkserverSingle, control.Shutdown, error) {
+	var compaction *storage.CompactionOptions
+	if config.StorageCompaction {
+		compaction = &storage.CompactionOptions{
+			BytesPerSecond: config.StorageCompactionBandwidth,
+			Interval:       config.StorageCompactionInterval,
+		}
+	}
+
+	verification, sampleRate, err := parseCommitHashVerification(config.CommitHashVerification)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	singleserver, shutdown, err := control.ExposeChunkserverWithOptions(store, control.ChunkserverOptions{
+		Deduplicate:       config.Deduplicate,
+		ReadAheadCapacity: config.ReadAheadCapacity,
+		ReservedSpace:     config.StorageReserve,
+		MaxChunkSize:      config.ChunkSize,
+		MaxStartupDamage:  config.StorageDamageLimit,
+		SlowOperationThresholds: apis.SlowOperationThresholds{
+			Data:    config.SlowDataThreshold,
+			Control: config.SlowControlThreshold,
+		},
+		Compaction:             compaction,
+		CommitHashVerification: verification,
+		CommitHashSampleRate:   sampleRate,
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	server, err := chunkserver.WithChatterOptions(singleserver, conncache, chunkserver.ChatterOptions{
+		ReplicationBandwidth: config.ReplicationBandwidth,
+	})
+	if err != nil {
+		shutdown(time.Now())
+		return nil, nil, nil, err
+	}
+	return chunkserver.WithMetrics(server), singleserver, shutdown, nil
+}
+
 func LaunchChunkserver(config *Config) error {
 	conncache := rpc.NewConnectionCache()
 	defer conncache.CloseAll()
@@ -74,16 +230,15 @@ func LaunchChunkserver(config *Config) error {
 	}
 	defer store.Close()
 
-	singleserver, teardown, err := control.ExposeChunkserver(store)
-	if err != nil {
-		return err
-	}
-	defer teardown()
-
-	server, err := chunkserver.WithChatter(singleserver, conncache)
+	server, singleserver, shutdown, err := buildChunkserver(config, store, conncache)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err := shutdown(time.Now().Add(control.TeardownGracePeriod)); err != nil {
+			log.Printf("chunkserver did not shut down cleanly: %v", err)
+		}
+	}()
 
 	log.Printf("subscribing to etcd for %s\n", config.ServerName)
 
@@ -92,6 +247,11 @@ func LaunchChunkserver(config *Config) error {
 		return err
 	}
 
+	// before serving anything, make sure that we agree with the rest of the cluster on how large chunks can be
+	if err := chunkserver.AgreeOnChunkSize(cli, control.MaxChunkSizeOf(singleserver)); err != nil {
+		return err
+	}
+
 	finish, address, err := rpc.PublishChunkserver(server, config.Address)
 	if err != nil {
 		return err
@@ -99,10 +259,16 @@ func LaunchChunkserver(config *Config) error {
 
 	log.Printf("finalizing launch for %s\n", config.ServerName)
 
-	err = cli.UpdateAddress(address, apis.CHUNKSERVER)
+	registration, err := chunkserver.Register(cli, address, chunkserver.DefaultRegistrationTTL)
 	if err != nil {
 		return err
 	}
+	// stop being offered for new chunks before the rest of the chunkserver shuts down
+	defer func() {
+		if err := registration.Unregister(); err != nil {
+			log.Printf("could not remove live registration: %v", err)
+		}
+	}()
 
 	log.Printf("launched chunkserver %s at address %s (backing store %s)\n", cli.GetName(), address, config.StorageType)
 
@@ -151,10 +317,18 @@ func LaunchMetadataCache(config *Config) error {
 		return err
 	}
 
-	mc, err := metadatacache.NewCache(conncache, cli)
+	mc, err := metadatacache.NewCacheWithOptions(conncache, cli, metadatacache.Options{
+		UpdateBudget: config.MetadataUpdateBudget,
+		RepairOnRead: config.MetadataRepairOnRead,
+		StartTimeout: config.MetadataStartTimeout,
+	})
 	if err != nil {
 		return err
 	}
+	if closer, ok := mc.(io.Closer); ok {
+		// delivers whatever the audit log still holds once the server stops
+		defer closer.Close()
+	}
 
 	finish, address, err := rpc.PublishMetadataCache(mc, config.Address)
 	if err != nil {
@@ -0,0 +1,64 @@
+package main
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/chunkserver/control"
+	"zircon/rpc"
+)
+
+func TestLaunchedChunkserverCountsOperations(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	config := &Config{StorageType: "memory"}
+	store, err := ConfigureChunkserverStorage(config)
+	require.NoError(t, err)
+	defer store.Close()
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+
+	server, _, shutdown, err := buildChunkserver(config, store, cache)
+	require.NoError(t, err)
+	defer shutdown(time.Now())
+	teardown, address, err := rpc.PublishChunkserver(server, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer teardown(true)
+
+	// as a client of the launched chunkserver would see it
+	client, err := cache.SubscribeChunkserver(address)
+	require.NoError(t, err)
+	require.NoError(t, client.Add(73, []byte("hello world"), 1))
+	data, _, err := client.Read(73, 0, 5, apis.AnyVersion)
+	require.NoError(t, err)
+	assert.Equal("hello", string(data))
+
+	stats, err := client.GetStats()
+	assert.NoError(err)
+	assert.Equal(uint64(1), stats.Operations["Add"].Calls)
+	assert.Equal(uint64(1), stats.Operations["Read"].Calls)
+	assert.Equal(uint64(5), stats.Operations["Read"].Bytes)
+	assert.Equal(uint64(0), stats.Operations["Read"].Errors)
+}
+
+func TestParseCommitHashVerification(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	for setting, expected := range map[string]control.CommitHashVerification{
+		"":     control.VerifyEveryCommit,
+		"all":  control.VerifyEveryCommit,
+		"none": control.VerifyNoCommits,
+		"0.25": control.VerifySampledCommits,
+	} {
+		verification, _, err := parseCommitHashVerification(setting)
+		assert.NoError(err)
+		assert.Equal(expected, verification, setting)
+	}
+	_, rate, err := parseCommitHashVerification("0.25")
+	assert.NoError(err)
+	assert.Equal(0.25, rate)
+	_, _, err = parseCommitHashVerification("some")
+	assert.Error(err)
+}
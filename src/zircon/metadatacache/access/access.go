@@ -45,7 +45,7 @@ func (f *Access) Read(chunk apis.MetadataID) ([]byte, apis.Version, error) {
 	if err != nil {
 		return nil, 0, err
 	}
-	return ref.PerformRead(f.cache, 0, apis.MaxChunkSize)
+	return ref.PerformRead(f.cache, 0, ref.MaxSize())
 }
 
 // Writes part of a metadata chunk. Only performs the write if the version matches.
@@ -25,6 +25,9 @@ func (r *etcdMetadataUpdater) NewEntry() (apis.ChunkNum, error) {
 			continue
 		}
 		owner, err := r.etcd.TryClaimingMetadata(i)
+		if apis.ErrorCodeOf(err) == apis.ErrLeaseShared {
+			continue // being read by others, so not ours to allocate from
+		}
 		if err != nil {
 			return 0, fmt.Errorf("while scanning claims for NewEntry: %v", err)
 		}
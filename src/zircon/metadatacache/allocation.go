@@ -0,0 +1,36 @@
+package metadatacache
+
+import (
+	"sync"
+	"zircon/apis"
+)
+
+// Produces the chunk numbers that NewEntry should try to allocate, in order, in place of the usual search for free
+// entries. Chunk numbers whose entries turn out to be taken already are skipped over.
+type AllocationSource func() (apis.ChunkNum, error)
+
+// An AllocationSource that counts upwards through every entry of a block, and then on into the blocks after it, so
+// that tests can predict which chunk numbers they will be given. The first block cannot be zero.
+func SequentialAllocation(first apis.MetadataID) AllocationSource {
+	var mu sync.Mutex
+	next := EntryAndBlockToChunkNum(first, 0)
+	return func() (apis.ChunkNum, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		chunk := next
+		next += 1
+		return chunk, nil
+	}
+}
+
+// Picks the next entry for NewEntry to try to claim, from the configured AllocationSource if there is one.
+func (mc *metadatacache) nextAllocation() (apis.MetadataID, uint32, error) {
+	if mc.options.Allocation == nil {
+		return mc.findAnyFreeChunk()
+	}
+	chunk, err := mc.options.Allocation()
+	if err != nil {
+		return 0, 0, err
+	}
+	return BlockForChunk(chunk), ChunkToEntryNumber(chunk), nil
+}
@@ -0,0 +1,72 @@
+package metadatacache
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"testing"
+	"zircon/apis"
+)
+
+func TestSequentialAllocation(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+	mc.options = Options{Allocation: SequentialAllocation(1)}
+	// entries that are already in use get skipped
+	fake.overwrite(EntryAndBlockToChunkNum(1, 2), apis.MetadataEntry{MostRecentVersion: 1})
+
+	var allocated []apis.ChunkNum
+	for i := 0; i < 4; i++ {
+		chunk, err := mc.NewEntry()
+		assert.NoError(err)
+		allocated = append(allocated, chunk)
+	}
+	assert.Equal([]apis.ChunkNum{
+		EntryAndBlockToChunkNum(1, 0),
+		EntryAndBlockToChunkNum(1, 1),
+		EntryAndBlockToChunkNum(1, 3),
+		EntryAndBlockToChunkNum(1, 4),
+	}, allocated)
+
+	// the sequence continues from one block into the next
+	source := SequentialAllocation(1)
+	var last apis.ChunkNum
+	for i := 0; i < 1<<apis.EntriesPerBlock; i++ {
+		var err error
+		last, err = source()
+		assert.NoError(err)
+	}
+	assert.Equal(EntryAndBlockToChunkNum(1, 1<<apis.EntriesPerBlock-1), last)
+	next, err := source()
+	assert.NoError(err)
+	assert.Equal(EntryAndBlockToChunkNum(2, 0), next)
+}
+
+func TestBlockForChunkBoundaries(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	const perBlock = 1 << apis.EntriesPerBlock
+	blockSize := uint32(apis.BitsetSize + apis.EntrySize*perBlock)
+
+	// the first and last entries of neighboring blocks sit right next to each other in chunk number order
+	for _, block := range []apis.MetadataID{1, 2, 1000} {
+		first := EntryAndBlockToChunkNum(block, 0)
+		last := EntryAndBlockToChunkNum(block, perBlock-1)
+		assert.Equal(first+perBlock-1, last)
+		assert.Equal(block, BlockForChunk(first))
+		assert.Equal(block, BlockForChunk(last))
+		assert.Equal(block+1, BlockForChunk(last+1))
+		assert.Equal(block-1, BlockForChunk(first-1))
+
+		assert.Equal(uint32(apis.BitsetSize), OffsetForChunk(first))
+		assert.Equal(blockSize-apis.EntrySize, OffsetForChunk(last))
+		assert.Equal(uint32(apis.BitsetSize), OffsetForChunk(last+1))
+
+		metachunk, offset := ChunkToBlockAndOffset(last)
+		assert.Equal(block, metachunk)
+		assert.Equal(OffsetForChunk(last), offset)
+	}
+
+	// chunks below the first block have no metadata block of their own
+	assert.Equal(apis.MetadataID(0), BlockForChunk(0))
+	assert.Equal(apis.MetadataID(0), BlockForChunk(perBlock-1))
+}
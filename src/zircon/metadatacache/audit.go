@@ -0,0 +1,157 @@
+package metadatacache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+	"zircon/apis"
+)
+
+// Which change to a metadata entry an AuditRecord describes.
+type AuditOperation string
+
+const (
+	AuditNew    AuditOperation = "new"
+	AuditUpdate AuditOperation = "update"
+	AuditDelete AuditOperation = "delete"
+	AuditSwap   AuditOperation = "swap"
+	// Made by the repair paths, which set or clear allocation bits rather than writing the entry itself.
+	AuditRepair AuditOperation = "repair"
+	AuditImport AuditOperation = "import"
+)
+
+// Describes a single change to a metadata entry, once it has been made.
+type AuditRecord struct {
+	Time      time.Time
+	Chunk     apis.ChunkNum
+	Operation AuditOperation
+	// Summaries of the entry before and after the change. Empty if the entry did not exist at that point.
+	Before string
+	After  string
+	// Whoever asked for the change, as attached with WithCaller, or an empty string if nobody said.
+	Caller string
+}
+
+// Receives a record of every change made through a metadata cache, including repairs and imports. Records are delivered
+// one at a time, in the order the changes were made, from a goroutine of their own. A sink that falls more than a
+// buffer behind holds up further changes, unless Options.AuditDropWhenFull allows records to be dropped instead.
+type AuditSink interface {
+	Record(record AuditRecord)
+}
+
+// How many records can be waiting for the sink, unless Options.AuditBuffer says otherwise.
+const DefaultAuditBuffer = 1024
+
+// Attaches the identity of a caller to a context; see apis.WithCaller.
+func WithCaller(ctx context.Context, caller string) context.Context {
+	return apis.WithCaller(ctx, caller)
+}
+
+// Gets the caller identity attached to a context; see apis.CallerFrom.
+func CallerFrom(ctx context.Context) string {
+	return apis.CallerFrom(ctx)
+}
+
+// Hands records to an AuditSink in the background. A nil *auditLog discards everything, so that caches constructed
+// without a sink don't need to check.
+type auditLog struct {
+	records      chan AuditRecord
+	dropWhenFull bool
+	dropped      uint64
+	// held for reading while handing over a record, and for writing to close records
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+}
+
+func newAuditLog(sink AuditSink, buffer int, dropWhenFull bool) *auditLog {
+	if sink == nil {
+		return nil
+	}
+	if buffer <= 0 {
+		buffer = DefaultAuditBuffer
+	}
+	a := &auditLog{
+		records:      make(chan AuditRecord, buffer),
+		dropWhenFull: dropWhenFull,
+		done:         make(chan struct{}),
+	}
+	go func() {
+		defer close(a.done)
+		for record := range a.records {
+			sink.Record(record)
+		}
+	}()
+	return a
+}
+
+// Waits for a place in the buffer, unless the log was set up to drop records when full, in which case the record is
+// dropped and counted instead. Records made after the log is closed are always dropped and counted.
+func (a *auditLog) record(ctx context.Context, chunk apis.ChunkNum, operation AuditOperation, before string, after string) {
+	if a == nil {
+		return
+	}
+	record := AuditRecord{
+		Time:      time.Now(),
+		Chunk:     chunk,
+		Operation: operation,
+		Before:    before,
+		After:     after,
+		Caller:    CallerFrom(ctx),
+	}
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		atomic.AddUint64(&a.dropped, 1)
+		return
+	}
+	if !a.dropWhenFull {
+		a.records <- record
+		return
+	}
+	select {
+	case a.records <- record:
+	default:
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+// Stops accepting records, and waits for every record already accepted to reach the sink.
+func (a *auditLog) close() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	if !a.closed {
+		a.closed = true
+		close(a.records)
+	}
+	a.mu.Unlock()
+	<-a.done
+}
+
+func (a *auditLog) droppedRecords() uint64 {
+	if a == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&a.dropped)
+}
+
+func summarizeEntry(entry apis.MetadataEntry) string {
+	return fmt.Sprintf("version %d (consumed %d) on %v", entry.MostRecentVersion, entry.LastConsumedVersion, entry.Replicas)
+}
+
+// Reports how many audit records have been dropped, either because the sink could not keep up and
+// Options.AuditDropWhenFull was set, or because the cache had already been closed. Always zero without a sink.
+func (mc *metadatacache) AuditDropped() uint64 {
+	return mc.audit.droppedRecords()
+}
+
+// Delivers every audit record still waiting to the sink, and stops the goroutine that delivers them. Changes made
+// afterwards are no longer audited.
+func (mc *metadatacache) Close() error {
+	mc.audit.close()
+	return nil
+}
@@ -0,0 +1,167 @@
+package metadatacache
+
+import (
+	"context"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+// An audit sink that passes every record along to a channel.
+type channelSink chan AuditRecord
+
+func (c channelSink) Record(record AuditRecord) {
+	c <- record
+}
+
+func TestAuditUpdate(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+	sink := make(channelSink)
+	mc.audit = newAuditLog(sink, 0, false)
+	chunk := EntryAndBlockToChunkNum(1, 7)
+	original := apis.MetadataEntry{MostRecentVersion: 3, LastConsumedVersion: 3, Replicas: []apis.ServerID{1, 2}}
+	fake.overwrite(chunk, original)
+
+	updated := apis.MetadataEntry{MostRecentVersion: 4, LastConsumedVersion: 4, Replicas: []apis.ServerID{1, 2}}
+	_, err := mc.UpdateEntryWithContext(WithCaller(context.Background(), "frontend-1"), chunk, original, updated)
+	require.NoError(t, err)
+
+	select {
+	case record := <-sink:
+		assert.Equal(chunk, record.Chunk)
+		assert.Equal(AuditUpdate, record.Operation)
+		assert.Equal(summarizeEntry(original), record.Before)
+		assert.Equal(summarizeEntry(updated), record.After)
+		assert.Equal("frontend-1", record.Caller)
+		assert.False(record.Time.IsZero())
+	case <-time.After(time.Second):
+		t.Fatal("no audit record for update")
+	}
+
+	// a failed update leaves nothing behind in the log
+	_, err = mc.UpdateEntry(chunk, original, updated)
+	assert.Error(err)
+	select {
+	case record := <-sink:
+		t.Errorf("unexpected audit record: %v", record)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestAuditDropsWhenFull(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	// a sink that never keeps up, so that the log only has its buffer to work with
+	stuck := make(chan struct{})
+	defer close(stuck)
+	sink := make(channelSink)
+	go func() {
+		<-sink
+		<-stuck
+	}()
+	audit := newAuditLog(sink, 2, true)
+	mc := &metadatacache{audit: audit}
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		audit.record(context.Background(), apis.ChunkNum(i), AuditNew, "", "")
+	}
+	assert.True(time.Since(start) < time.Second)
+	// one taken by the sink, two in the buffer, and possibly one more held by the delivery goroutine
+	assert.True(mc.AuditDropped() >= 6)
+	assert.Equal(uint64(0), (&metadatacache{}).AuditDropped())
+}
+
+func TestAuditWaitsWhenFull(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	sink := make(channelSink)
+	audit := newAuditLog(sink, 2, false)
+	mc := &metadatacache{audit: audit}
+
+	recorded := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			audit.record(context.Background(), apis.ChunkNum(i), AuditNew, "", "")
+		}
+		close(recorded)
+	}()
+	// nothing is dropped while the sink is stuck; the changes wait instead
+	select {
+	case <-recorded:
+		t.Fatal("recorded everything while the sink was stuck")
+	case <-time.After(50 * time.Millisecond):
+	}
+	for i := 0; i < 10; i++ {
+		assert.Equal(apis.ChunkNum(i), (<-sink).Chunk)
+	}
+	<-recorded
+	assert.Equal(uint64(0), mc.AuditDropped())
+	assert.NoError(mc.Close())
+}
+
+func TestAuditClose(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	var records []AuditRecord
+	sink := make(channelSink, 10)
+	mc := &metadatacache{audit: newAuditLog(sink, 10, false)}
+	for i := 0; i < 5; i++ {
+		mc.audit.record(context.Background(), apis.ChunkNum(i), AuditNew, "", "")
+	}
+	// everything recorded before closing reaches the sink by the time Close returns
+	assert.NoError(mc.Close())
+	assert.Len(sink, 5)
+	for len(sink) > 0 {
+		records = append(records, <-sink)
+	}
+	assert.Equal(apis.ChunkNum(4), records[4].Chunk)
+
+	// and anything afterwards is counted as dropped, even if closed more than once
+	mc.audit.record(context.Background(), 5, AuditNew, "", "")
+	assert.NoError(mc.Close())
+	assert.Equal(uint64(1), mc.AuditDropped())
+	assert.Len(sink, 0)
+	assert.NoError((&metadatacache{}).Close())
+}
+
+func TestAuditSwapAndRepair(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+	sink := make(channelSink, 10)
+	mc.audit = newAuditLog(sink, 0, false)
+	chunk := EntryAndBlockToChunkNum(1, 7)
+	original := apis.MetadataEntry{MostRecentVersion: 3, LastConsumedVersion: 3, Replicas: []apis.ServerID{1, 2}}
+	fake.overwrite(chunk, original)
+
+	swapped := original
+	swapped.Replicas = []apis.ServerID{1, 3}
+	_, err := mc.SwapReplicasWithContext(WithCaller(context.Background(), "balancer"), chunk, original, swapped.Replicas)
+	require.NoError(t, err)
+
+	// an entry whose allocation bit was lost comes back through the repair path
+	orphan := EntryAndBlockToChunkNum(1, 9)
+	fake.overwrite(orphan, original)
+	fake.loseBit(orphan)
+	repaired, err := mc.RepairBitsetIn(1)
+	require.NoError(t, err)
+	assert.Equal(1, repaired)
+
+	require.NoError(t, mc.Close())
+	require.Len(t, sink, 2)
+	record := <-sink
+	assert.Equal(AuditSwap, record.Operation)
+	assert.Equal(summarizeEntry(original), record.Before)
+	assert.Equal(summarizeEntry(swapped), record.After)
+	assert.Equal("balancer", record.Caller)
+	record = <-sink
+	assert.Equal(AuditRepair, record.Operation)
+	assert.Equal(orphan, record.Chunk)
+	assert.Equal("", record.Before)
+	assert.Equal(summarizeEntry(original), record.After)
+}
@@ -0,0 +1,59 @@
+package metadatacache
+
+import (
+	"sync"
+	"zircon/apis"
+)
+
+// A local copy of recently-read metadata blocks, used to serve reads that can tolerate staleness without going through
+// the leasing layer.
+type blockCache struct {
+	mu     sync.Mutex
+	blocks map[apis.MetadataID]cachedBlock
+}
+
+type cachedBlock struct {
+	data    []byte
+	version apis.Version
+}
+
+func newBlockCache() *blockCache {
+	return &blockCache{
+		blocks: map[apis.MetadataID]cachedBlock{},
+	}
+}
+
+func (c *blockCache) get(metachunk apis.MetadataID) ([]byte, apis.Version, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	block, found := c.blocks[metachunk]
+	return block.data, block.version, found
+}
+
+// Remember a copy of a block, unless a newer version is already cached.
+func (c *blockCache) put(metachunk apis.MetadataID, data []byte, version apis.Version) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, found := c.blocks[metachunk]; found && existing.version > version {
+		return
+	}
+	// the leasing layer may reuse its buffer, so we need our own copy
+	copied := make([]byte, len(data))
+	copy(copied, data)
+	c.blocks[metachunk] = cachedBlock{data: copied, version: version}
+}
+
+func (c *blockCache) invalidate(metachunk apis.MetadataID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.blocks, metachunk)
+}
+
+// Forget every block whose lease was lost, since another server may change them from now on without us hearing about it.
+func (c *blockCache) invalidateAll(metachunks []apis.MetadataID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, metachunk := range metachunks {
+		delete(c.blocks, metachunk)
+	}
+}
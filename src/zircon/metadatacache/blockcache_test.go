@@ -0,0 +1,142 @@
+package metadatacache
+
+import (
+	"errors"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+)
+
+// A leasing layer that only holds a single block, and counts how many times it has been read.
+type fakeLeaser struct {
+	data    []byte
+	version apis.Version
+	reads   int
+}
+
+func (f *fakeLeaser) Read(metachunk apis.MetadataID) ([]byte, apis.Version, apis.ServerName, error) {
+	f.reads += 1
+	return f.data, f.version, apis.NoRedirect, nil
+}
+
+func (f *fakeLeaser) Write(metachunk apis.MetadataID, version apis.Version, offset uint32, data []byte) (apis.Version, apis.ServerName, error) {
+	if version != f.version {
+		return f.version, apis.NoRedirect, apis.NewError(apis.ErrWrongVersion, f.version, "version mismatch")
+	}
+	copy(f.data[offset:], data)
+	f.version += 1
+	return f.version, apis.NoRedirect, nil
+}
+
+func (f *fakeLeaser) ListLeases() ([]apis.MetadataID, error) {
+	return []apis.MetadataID{1}, nil
+}
+
+func (f *fakeLeaser) ListAllBlocks() ([]apis.MetadataID, error) {
+	return []apis.MetadataID{1}, nil
+}
+
+func (f *fakeLeaser) GetOrCreateAnyUnleased() (apis.MetadataID, error) {
+	return 0, errors.New("no unleased blocks in fake")
+}
+
+// Change an entry behind the metadata cache's back, as another server might
+func (f *fakeLeaser) overwrite(chunk apis.ChunkNum, entry apis.MetadataEntry) {
+	_, offset := ChunkToBlockAndOffset(chunk)
+	_, updated := updateBitsetInData(f.data, ChunkToEntryNumber(chunk), true)
+	f.data[ChunkToEntryNumber(chunk)/8] = updated[0]
+	serialized, err := serializeEntry(entry)
+	if err != nil {
+		panic(err)
+	}
+	copy(f.data[offset:], serialized)
+	f.version += 1
+}
+
+// A metadata cache over a single fake block with room for every entry, none of them allocated yet. Tests that need a
+// different leasing layer, such as one wrapping the fake, swap it in afterwards.
+func newFakeCache(t *testing.T) (*metadatacache, *fakeLeaser) {
+	fake := &fakeLeaser{
+		data:    make([]byte, apis.BitsetSize+apis.EntrySize*(1<<apis.EntriesPerBlock)),
+		version: 1,
+	}
+	mc := &metadatacache{
+		leasing: fake,
+		blocks:  newBlockCache(),
+	}
+	return mc, fake
+}
+
+func TestReadEntryConsistency(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+	chunk := EntryAndBlockToChunkNum(1, 7)
+
+	original := apis.MetadataEntry{MostRecentVersion: 3, LastConsumedVersion: 3, Replicas: []apis.ServerID{1, 2}}
+	fake.overwrite(chunk, original)
+
+	entry, _, err := mc.ReadEntry(chunk, apis.Cached)
+	assert.NoError(err)
+	assert.True(original.Equals(entry))
+	assert.Equal(1, fake.reads)
+
+	updated := apis.MetadataEntry{MostRecentVersion: 4, LastConsumedVersion: 4, Replicas: []apis.ServerID{1, 2}}
+	fake.overwrite(chunk, updated)
+
+	// a cached read can return the stale value, without consulting the leasing layer
+	entry, _, err = mc.ReadEntry(chunk, apis.Cached)
+	assert.NoError(err)
+	assert.True(original.Equals(entry))
+	assert.Equal(1, fake.reads)
+
+	// but a fresh read always goes back to the leasing layer
+	entry, _, err = mc.ReadEntry(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.True(updated.Equals(entry))
+	assert.Equal(2, fake.reads)
+
+	// and writes through this cache invalidate the cached copy
+	newest := apis.MetadataEntry{MostRecentVersion: 5, LastConsumedVersion: 5, Replicas: []apis.ServerID{2, 3}}
+	_, err = mc.UpdateEntry(chunk, updated, newest)
+	assert.NoError(err)
+	entry, _, err = mc.ReadEntry(chunk, apis.Cached)
+	assert.NoError(err)
+	assert.True(newest.Equals(entry))
+}
+
+func TestBlockCacheInvalidatedOnMismatch(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+	chunk := EntryAndBlockToChunkNum(1, 7)
+	original := apis.MetadataEntry{MostRecentVersion: 3, LastConsumedVersion: 3, Replicas: []apis.ServerID{1, 2}}
+	fake.overwrite(chunk, original)
+	entry, _, err := mc.ReadEntry(chunk, apis.Cached)
+	require.NoError(t, err)
+
+	// another server changes the entry; an update based on the stale cached copy fails, and takes the copy with it
+	updated := apis.MetadataEntry{MostRecentVersion: 4, LastConsumedVersion: 4, Replicas: []apis.ServerID{1, 2}}
+	fake.overwrite(chunk, updated)
+	_, err = mc.UpdateEntry(chunk, entry, apis.MetadataEntry{MostRecentVersion: 5, Replicas: []apis.ServerID{1}})
+	assert.Error(err)
+	entry, _, err = mc.ReadEntry(chunk, apis.Cached)
+	assert.NoError(err)
+	assert.True(updated.Equals(entry))
+
+	// as does swapping replicas
+	fake.overwrite(chunk, original)
+	_, err = mc.SwapReplicas(chunk, entry, []apis.ServerID{3})
+	assert.Error(err)
+	entry, _, err = mc.ReadEntry(chunk, apis.Cached)
+	assert.NoError(err)
+	assert.True(original.Equals(entry))
+
+	// and losing the lease drops the block entirely
+	reads := fake.reads
+	mc.blocks.invalidateAll([]apis.MetadataID{1})
+	_, _, err = mc.ReadEntry(chunk, apis.Cached)
+	assert.NoError(err)
+	assert.Equal(reads+1, fake.reads)
+}
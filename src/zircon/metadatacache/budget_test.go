@@ -0,0 +1,58 @@
+package metadatacache
+
+import (
+	"context"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+)
+
+// A leasing layer where another server always gets its write in first, so every write fails with a version mismatch.
+type contendedLeaser struct {
+	*fakeLeaser
+	writes int
+}
+
+func (c *contendedLeaser) Write(metachunk apis.MetadataID, version apis.Version, offset uint32, data []byte) (apis.Version, apis.ServerName, error) {
+	c.writes += 1
+	c.version += 1
+	return c.version, apis.NoRedirect, apis.NewError(apis.ErrWrongVersion, c.version, "version mismatch")
+}
+
+func TestUpdateEntryBudget(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+	chunk := EntryAndBlockToChunkNum(1, 7)
+	fake.overwrite(chunk, apis.MetadataEntry{})
+	contended := &contendedLeaser{fakeLeaser: fake}
+	mc.leasing = contended
+	mc.options = Options{UpdateBudget: 50 * time.Millisecond}
+
+	entry := apis.MetadataEntry{MostRecentVersion: 1, LastConsumedVersion: 1, Replicas: []apis.ServerID{3}}
+	start := time.Now()
+	_, err := mc.UpdateEntry(chunk, apis.MetadataEntry{}, entry)
+	elapsed := time.Since(start)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(contended.writes > 1, "should have retried before running out of time")
+	assert.True(elapsed >= 50*time.Millisecond)
+	assert.True(elapsed < time.Second, "took %v to give up", elapsed)
+
+	// the budget applies on top of an explicit context, which can still end the update sooner
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	writes := contended.writes
+	_, err = mc.UpdateEntryWithContext(ctx, chunk, apis.MetadataEntry{}, entry)
+	assert.Equal(context.Canceled, err)
+	assert.Equal(writes, contended.writes)
+
+	// without contention, the update goes through within the budget
+	mc.leasing = fake
+	_, err = mc.UpdateEntry(chunk, apis.MetadataEntry{}, entry)
+	require.NoError(t, err)
+	found, _, err := mc.ReadEntry(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.True(entry.Equals(found))
+}
@@ -0,0 +1,94 @@
+package metadatacache
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+)
+
+func TestEntryExists(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+	chunk := EntryAndBlockToChunkNum(1, 9)
+	neighbor := EntryAndBlockToChunkNum(1, 10)
+
+	exists, _, err := mc.EntryExists(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.False(exists)
+
+	fake.overwrite(chunk, apis.MetadataEntry{MostRecentVersion: 2, LastConsumedVersion: 2, Replicas: []apis.ServerID{1}})
+	exists, _, err = mc.EntryExists(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.True(exists)
+	exists, _, err = mc.EntryExists(neighbor, apis.Fresh)
+	assert.NoError(err)
+	assert.False(exists)
+
+	// claim more replicas than fit in an entry, so that decoding it would run off the end; an existence check never
+	// gets that far
+	_, offset := ChunkToBlockAndOffset(chunk)
+	fake.data[offset+16] = 0xFF
+	require.Panics(t, func() {
+		_, _ = deserializeEntry(fake.data[offset : offset+apis.EntrySize])
+	})
+	exists, _, err = mc.EntryExists(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.True(exists)
+}
+
+func TestEntryExistsConsistency(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+	chunk := EntryAndBlockToChunkNum(1, 9)
+
+	exists, _, err := mc.EntryExists(chunk, apis.Cached)
+	assert.NoError(err)
+	assert.False(exists)
+	assert.Equal(1, fake.reads)
+
+	// a cached check shares the block cache with ReadEntry, so it can miss a change made behind its back
+	fake.overwrite(chunk, apis.MetadataEntry{MostRecentVersion: 2, LastConsumedVersion: 2})
+	exists, _, err = mc.EntryExists(chunk, apis.Cached)
+	assert.NoError(err)
+	assert.False(exists)
+	assert.Equal(1, fake.reads)
+
+	exists, _, err = mc.EntryExists(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.True(exists)
+	assert.Equal(2, fake.reads)
+}
+
+func TestEntryExistsRepairsMissingBit(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+	entry := apis.MetadataEntry{MostRecentVersion: 3, LastConsumedVersion: 3, Replicas: []apis.ServerID{1}}
+	chunk, unmarked := EntryAndBlockToChunkNum(1, 9), EntryAndBlockToChunkNum(1, 10)
+	fake.overwrite(chunk, entry)
+	fake.loseBit(chunk)
+	fake.overwrite(unmarked, entry)
+	fake.data[OffsetForChunk(unmarked)+entryFormatOffset] = 0
+	fake.loseBit(unmarked)
+
+	// without the flag, the check leaves the inconsistency alone, just as ReadEntry does
+	exists, _, err := mc.EntryExists(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.False(exists)
+	assert.False(getBitsetInData(fake.data, ChunkToEntryNumber(chunk)))
+
+	mc.options.RepairOnRead = true
+	exists, _, err = mc.EntryExists(chunk, apis.Cached)
+	assert.NoError(err)
+	assert.True(exists)
+	assert.True(getBitsetInData(fake.data, ChunkToEntryNumber(chunk)))
+
+	// an entry that might have been deleted is never brought back
+	exists, _, err = mc.EntryExists(unmarked, apis.Fresh)
+	assert.NoError(err)
+	assert.False(exists)
+	assert.False(getBitsetInData(fake.data, ChunkToEntryNumber(unmarked)))
+}
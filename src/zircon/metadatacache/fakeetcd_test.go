@@ -0,0 +1,124 @@
+package metadatacache
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+	"zircon/chunkserver"
+	"zircon/etcd/mocketcd"
+	"zircon/rpc"
+	"zircon/util"
+)
+
+// Starts a metadata cache for each name, along with the chunkservers they keep their blocks on, all backed by an
+// in-memory etcd, so that the test runs in milliseconds and controls etcd's clock and failures through the store.
+func prepareFakeCaches(t *testing.T, names ...apis.ServerName) ([]apis.MetadataCache, *mocketcd.Store, func()) {
+	store, etcds := mocketcd.PrepareSubscribeForTesting(t)
+	caches, teardown := prepareCachesWith(t, etcds, func() {}, names...)
+	return caches, store, teardown
+}
+
+// Starts a metadata cache for each name, along with three chunkservers for them to keep their blocks on, all talking to
+// the etcd that etcds connects to.
+func prepareCachesWith(t *testing.T, etcds func(apis.ServerName) (apis.EtcdInterface, func()), teardownEtcd func(), names ...apis.ServerName) ([]apis.MetadataCache, func()) {
+	cache := rpc.NewConnectionCache()
+	teardowns := &util.MultiTeardown{}
+
+	for _, name := range []apis.ServerName{"cs0", "cs1", "cs2"} {
+		cs, _, teardownCS := chunkserver.NewTestChunkserver(t, cache)
+		teardowns.Add(teardownCS)
+		teardownPublish, address, err := rpc.PublishChunkserver(cs, "127.0.0.1:0")
+		require.NoError(t, err)
+		teardowns.Add(func() { teardownPublish(true) })
+
+		iface, teardownIface := etcds(name)
+		teardowns.Add(teardownIface)
+		require.NoError(t, iface.UpdateAddress(address, apis.CHUNKSERVER))
+	}
+
+	var caches []apis.MetadataCache
+	for _, name := range names {
+		iface, teardownIface := etcds(name)
+		teardowns.Add(teardownIface)
+		mc, err := NewCache(cache, iface)
+		require.NoError(t, err)
+		caches = append(caches, mc)
+	}
+
+	// MultiTeardown runs in order, so shut down the shared infrastructure last
+	teardowns.Add(cache.CloseAll, teardownEtcd)
+	return caches, teardowns.Teardown
+}
+
+// Like TestSingleCache, but against an in-memory etcd.
+func TestSingleCacheFake(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	caches, _, teardown := prepareFakeCaches(t, "mc0")
+	defer teardown()
+	cache := caches[0]
+
+	_, _, err := cache.ReadEntry(0, apis.Fresh)
+	assert.Error(err)
+
+	chunk1, err := cache.NewEntry()
+	require.NoError(t, err)
+	chunk2, err := cache.NewEntry()
+	require.NoError(t, err)
+	assert.NotEqual(chunk1, chunk2)
+	assert.Equal(BlockForChunk(chunk1), BlockForChunk(chunk2))
+
+	entry1 := apis.MetadataEntry{MostRecentVersion: 1, LastConsumedVersion: 1, Replicas: []apis.ServerID{1}}
+	_, err = cache.UpdateEntry(chunk1, apis.MetadataEntry{}, entry1)
+	assert.NoError(err)
+	entry2 := apis.MetadataEntry{MostRecentVersion: 2, LastConsumedVersion: 2, Replicas: []apis.ServerID{2}}
+	_, err = cache.UpdateEntry(chunk2, apis.MetadataEntry{}, entry2)
+	assert.NoError(err)
+	// updates based on a stale entry are refused
+	_, err = cache.UpdateEntry(chunk2, apis.MetadataEntry{}, entry1)
+	assert.Error(err)
+
+	read, _, err := cache.ReadEntry(chunk1, apis.Fresh)
+	assert.NoError(err)
+	assert.True(entry1.Equals(read))
+
+	_, err = cache.DeleteEntry(chunk1, entry1)
+	assert.NoError(err)
+	_, _, err = cache.ReadEntry(chunk1, apis.Fresh)
+	assert.Error(err)
+	read, _, err = cache.ReadEntry(chunk2, apis.Fresh)
+	assert.NoError(err)
+	assert.True(entry2.Equals(read))
+}
+
+// Like TestTwoCaches, but against an in-memory etcd, which can take the second cache's leases away on demand rather than
+// after a wait.
+func TestTwoCachesFake(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	caches, store, teardown := prepareFakeCaches(t, "mc0", "mc1")
+	defer teardown()
+
+	chunk0, err := caches[0].NewEntry()
+	require.NoError(t, err)
+	chunk1, err := caches[1].NewEntry()
+	require.NoError(t, err)
+	assert.NotEqual(BlockForChunk(chunk0), BlockForChunk(chunk1))
+
+	entry := apis.MetadataEntry{MostRecentVersion: 1, LastConsumedVersion: 1, Replicas: []apis.ServerID{1}}
+	_, err = caches[1].UpdateEntry(chunk1, apis.MetadataEntry{}, entry)
+	require.NoError(t, err)
+
+	// mc0 is sent to mc1 for mc1's entry
+	_, owner, err := caches[0].ReadEntry(chunk1, apis.Fresh)
+	assert.Error(err)
+	assert.Equal(apis.ServerName("mc1"), owner)
+
+	// until mc1's leases run out, after which mc0 can take over the block, entry and all
+	store.ExpireServer("mc1")
+	read, owner, err := caches[0].ReadEntry(chunk1, apis.Fresh)
+	assert.NoError(err)
+	assert.Equal(apis.NoRedirect, owner)
+	assert.True(entry.Equals(read))
+}
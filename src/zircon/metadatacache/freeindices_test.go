@@ -0,0 +1,92 @@
+package metadatacache
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+	"zircon/apis"
+)
+
+func TestFreeIndicesIn(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+
+	// nothing allocated yet
+	free, err := mc.FreeIndicesIn(1)
+	assert.NoError(err)
+	assert.Equal(1<<apis.EntriesPerBlock, len(free))
+
+	allocated := map[uint32]bool{}
+	// fill in a run of entirely full cells, as well as scattered bits elsewhere
+	for i := uint32(0); i < 64; i++ {
+		allocated[i] = true
+	}
+	for i := 0; i < 5000; i++ {
+		allocated[uint32(rand.Intn(1<<apis.EntriesPerBlock))] = true
+	}
+	allocated[1<<apis.EntriesPerBlock-1] = true
+	for index := range allocated {
+		_, updated := updateBitsetInData(fake.data, index, true)
+		fake.data[index/8] = updated[0]
+	}
+
+	free, err = mc.FreeIndicesIn(1)
+	assert.NoError(err)
+
+	var expected []uint32
+	for i := uint32(0); i < 1<<apis.EntriesPerBlock; i++ {
+		if !allocated[i] {
+			expected = append(expected, i)
+		}
+	}
+	assert.Equal(expected, free)
+
+	// the first free index should agree with the single-cell search
+	first, found := findAvailableCell(fake.data[0:apis.BitsetSize])
+	assert.True(found)
+	assert.Equal(expected[0], first)
+}
+
+func TestFreeIndicesInFullBlock(t *testing.T) {
+	bitset := make([]byte, apis.BitsetSize)
+	for i := range bitset {
+		bitset[i] = 0xFF
+	}
+	testifyAssert.Empty(t, findAvailableCells(bitset))
+}
+
+func TestBlockFull(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+
+	// every entry but the last one
+	for i := 0; i < apis.BitsetSize-1; i++ {
+		fake.data[i] = 0xFF
+	}
+	fake.data[apis.BitsetSize-1] = 0x7F
+	full, err := mc.BlockFull(1)
+	assert.NoError(err)
+	assert.False(full)
+	index, found, err := mc.findFreeChunkIn(1)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(uint32(1<<apis.EntriesPerBlock-1), index)
+
+	fake.data[apis.BitsetSize-1] = 0xFF
+	full, err = mc.BlockFull(1)
+	assert.NoError(err)
+	assert.True(full)
+	_, found, err = mc.findFreeChunkIn(1)
+	assert.NoError(err)
+	assert.False(found)
+
+	// a block that's too small to hold a bitset is an error, not a full block
+	fake.data = make([]byte, apis.BitsetSize/2)
+	_, err = mc.BlockFull(1)
+	assert.Equal(apis.ErrBlockGeometry, apis.ErrorCodeOf(err))
+	_, found, err = mc.findFreeChunkIn(1)
+	assert.Equal(apis.ErrBlockGeometry, apis.ErrorCodeOf(err))
+	assert.False(found)
+}
@@ -0,0 +1,46 @@
+package metadatacache
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"testing"
+	"zircon/apis"
+)
+
+func TestBlockGeometry(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	// room for the bitset and the first few entries, but nowhere near all of them
+	mc, fake := newFakeCache(t)
+	fake.data = make([]byte, apis.BitsetSize+apis.EntrySize*4)
+	inside := EntryAndBlockToChunkNum(1, 3)
+	outside := EntryAndBlockToChunkNum(1, 4)
+	entry := apis.MetadataEntry{MostRecentVersion: 1, LastConsumedVersion: 1, Replicas: []apis.ServerID{1}}
+	fake.overwrite(inside, entry)
+	_, updated := updateBitsetInData(fake.data, ChunkToEntryNumber(outside), true)
+	fake.data[ChunkToEntryNumber(outside)/8] = updated[0]
+
+	read, _, err := mc.ReadEntry(inside, apis.Fresh)
+	assert.NoError(err)
+	assert.True(entry.Equals(read))
+
+	// an entry past the end of the block is a clean error, not a panic
+	_, _, err = mc.ReadEntry(outside, apis.Fresh)
+	assert.Equal(apis.ErrBlockGeometry, apis.ErrorCodeOf(err))
+	_, err = mc.UpdateEntry(outside, apis.MetadataEntry{}, entry)
+	assert.Equal(apis.ErrBlockGeometry, apis.ErrorCodeOf(err))
+	_, err = mc.SwapReplicas(outside, apis.MetadataEntry{}, nil)
+	assert.Equal(apis.ErrBlockGeometry, apis.ErrorCodeOf(err))
+	_, err = mc.DeleteEntry(outside, apis.MetadataEntry{})
+	assert.Equal(apis.ErrBlockGeometry, apis.ErrorCodeOf(err))
+	_, err = mc.RepairBitsetIn(1)
+	assert.Equal(apis.ErrBlockGeometry, apis.ErrorCodeOf(err))
+
+	// and so is a block too small to even hold the bitset
+	fake.data = make([]byte, apis.BitsetSize-1)
+	_, _, err = mc.ReadEntry(inside, apis.Fresh)
+	assert.Equal(apis.ErrBlockGeometry, apis.ErrorCodeOf(err))
+	_, _, err = mc.EntryExists(inside, apis.Fresh)
+	assert.Equal(apis.ErrBlockGeometry, apis.ErrorCodeOf(err))
+	_, err = mc.FreeIndicesIn(1)
+	assert.Equal(apis.ErrBlockGeometry, apis.ErrorCodeOf(err))
+}
@@ -1,6 +1,8 @@
 package leasing
 
 import (
+	"io"
+	"sort"
 	"zircon/metadatacache/access"
 	"zircon/apis"
 	"zircon/rpc"
@@ -13,8 +15,15 @@ import (
 type Lease struct {
 	// TODO: lease-level locking
 	Version         apis.Version
+	// Never modified in place once set: a write builds a new slice and swaps it in, so that a slice handed out by Read
+	// stays valid and unchanging no matter what gets written afterwards.
 	Contents        []byte
 	WriteCompletion chan struct{}
+	// Whether this is only a shared claim, held alongside other readers. Writing requires upgrading it to an exclusive
+	// claim first, which can only happen once every other reader has let go.
+	Shared          bool
+	// When the block was claimed and populated, for DumpState.
+	Acquired        time.Time
 }
 
 type Leasing struct {
@@ -28,6 +37,25 @@ type Leasing struct {
 	validUntil time.Time
 	leases     map[apis.MetadataID]*Lease
 	populating map[apis.MetadataID]chan struct{}
+	// for Status: whether the main loop is running, and how its most recent renewal went
+	running     bool
+	lastRenewal time.Time
+	lastError   error
+	// called with the blocks whose leases were lost or given up, or nil if nobody is interested
+	onLost func(blocks []apis.MetadataID)
+}
+
+// A snapshot of how well a leasing agent is keeping hold of its leases.
+type LeaseAgentStatus struct {
+	// Whether the agent is renewing its claims in the background. This stops once the agent is stopped, or once a
+	// renewal fails, after which none of its leases can be trusted.
+	Started bool
+	// The number of metadata blocks that the agent currently holds leases on.
+	HeldLeases int
+	// How long it has been since the claims were last renewed, or first established. Zero if they never were.
+	SinceLastRenewal time.Duration
+	// Why the most recent renewal failed, or nil if it succeeded.
+	LastError error
 }
 
 func ConstructLeasing(etcd apis.EtcdInterface, cache rpc.ConnectionCache) (*Leasing, error) {
@@ -43,7 +71,14 @@ func ConstructLeasing(etcd apis.EtcdInterface, cache rpc.ConnectionCache) (*Leas
 	}, nil
 }
 
+// Begins the metadata lease and starts renewing it in the background, waiting as long as etcd takes to answer.
 func (l *Leasing) Start() error {
+	return l.StartWithTimeout(0)
+}
+
+// Like Start, but gives up with ErrUnreachable if etcd hasn't granted the metadata lease within the timeout, so that an
+// unreachable etcd can't hang whoever is starting the agent. Zero means waiting for as long as it takes.
+func (l *Leasing) StartWithTimeout(timeout time.Duration) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
@@ -55,7 +90,7 @@ func (l *Leasing) Start() error {
 	}
 
 	start := time.Now()
-	err := l.etcd.BeginMetadataLease()
+	err := beginLeaseWithin(l.etcd, timeout)
 	if err != nil {
 		return err
 	}
@@ -64,12 +99,33 @@ func (l *Leasing) Start() error {
 	l.done = make(chan struct{})
 	l.safe = true
 	l.validUntil = start.Add(l.etcd.GetMetadataLeaseTimeout())
+	l.running = true
+	l.lastRenewal = start
+	l.lastError = nil
 
 	go l.mainloop()
 
 	return l.ensureRenewed_LK()
 }
 
+// A request to etcd can't be called back once it's been sent, so a lease that etcd only grants after we've stopped
+// waiting for it is left to expire, since nothing will ever renew it.
+func beginLeaseWithin(etcd apis.EtcdInterface, timeout time.Duration) error {
+	if timeout == 0 {
+		return etcd.BeginMetadataLease()
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- etcd.BeginMetadataLease()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return apis.NewError(apis.ErrUnreachable, 0, "etcd did not grant a metadata lease within %v", timeout)
+	}
+}
+
 func (l *Leasing) Stop() error {
 	done := func() chan struct{} {
 		l.mu.Lock()
@@ -89,13 +145,19 @@ func (l *Leasing) Stop() error {
 	}
 	<-done
 	l.mu.Lock()
-	defer l.mu.Unlock()
 	l.done = nil
+	// nothing renews them anymore, so they're as good as lost
+	stopped := l.heldBlocks_LK()
+	l.mu.Unlock()
+	l.reportLost(stopped)
 	return nil
 }
 
 func (l *Leasing) mainloop() {
 	defer func() {
+		l.mu.Lock()
+		l.running = false
+		l.mu.Unlock()
 		close(l.done)
 	}()
 	for {
@@ -105,26 +167,164 @@ func (l *Leasing) mainloop() {
 		case <-time.After(l.etcd.GetMetadataLeaseTimeout() / 3):
 			start := time.Now()
 			err := l.etcd.RenewMetadataClaims()
+			l.mu.Lock()
 			if !time.Now().Before(l.validUntil) {
 				// took too long, and we may have been considered to have lost leases
 				// so now we just terminate.
+				l.lastError = errors.New("renewal did not complete before the claims expired")
+				expired := l.heldBlocks_LK()
+				l.mu.Unlock()
+				l.reportLost(expired)
 				return
 			}
 			if err != nil {
+				l.lastError = err
+				l.mu.Unlock()
 				l.notifyUnsafe()
 				return
 			} else {
 				l.validUntil = start.Add(l.etcd.GetMetadataLeaseTimeout())
+				l.lastRenewal = start
+				l.lastError = nil
+				l.mu.Unlock()
 			}
 		}
 	}
 }
 
-func (l *Leasing) notifyUnsafe() {
+// Arranges for hook to be called with the blocks whose leases this agent no longer holds, whenever any are released or
+// lost, including when every lease is lost at once because renewal failed or the agent was stopped. Anything that was
+// read under those leases may have been changed by another agent since. Replaces any hook set before.
+func (l *Leasing) OnLeaseLost(hook func(blocks []apis.MetadataID)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.onLost = hook
+}
+
+// Must be called without the lock held.
+func (l *Leasing) reportLost(blocks []apis.MetadataID) {
+	l.mu.Lock()
+	hook := l.onLost
+	l.mu.Unlock()
+	if hook != nil && len(blocks) > 0 {
+		hook(blocks)
+	}
+}
+
+// Must be called with the lock held.
+func (l *Leasing) heldBlocks_LK() []apis.MetadataID {
+	var blocks []apis.MetadataID
+	for id := range l.leases {
+		blocks = append(blocks, id)
+	}
+	return blocks
+}
+
+// Reports whether the agent is keeping its leases renewed, for health checks.
+func (l *Leasing) Status() LeaseAgentStatus {
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	status := LeaseAgentStatus{
+		Started:    l.running,
+		HeldLeases: len(l.leases),
+		LastError:  l.lastError,
+	}
+	if !l.lastRenewal.IsZero() {
+		status.SinceLastRenewal = time.Since(l.lastRenewal)
+	}
+	return status
+}
+
+type leaseDump struct {
+	block    apis.MetadataID
+	version  apis.Version
+	shared   bool
+	acquired time.Time
+	writing  bool
+}
+
+// Writes a human-readable report of everything the agent knows about its leases, for debugging: whether its claims are
+// still being renewed and until when they're good, every lease it holds, and every block whose claim, release, or
+// downgrade is still underway. Not meant to be parsed; the format may change at any time.
+func (l *Leasing) DumpState(w io.Writer) error {
+	now := time.Now()
+	l.mu.Lock()
+	running, safe, validUntil, lastRenewal, lastError := l.running, l.safe, l.validUntil, l.lastRenewal, l.lastError
+	var leases []leaseDump
+	for block, lease := range l.leases {
+		leases = append(leases, leaseDump{
+			block:    block,
+			version:  lease.Version,
+			shared:   lease.Shared,
+			acquired: lease.Acquired,
+			writing:  lease.writeInProgress(),
+		})
+	}
+	var pending []apis.MetadataID
+	for block, c := range l.populating {
+		if c != nil {
+			pending = append(pending, block)
+		}
+	}
+	l.mu.Unlock()
+
+	// the report is written after letting go of the lock, so that a slow writer can't hold up the agent
+	sort.Slice(leases, func(i, j int) bool {
+		return leases[i].block < leases[j].block
+	})
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i] < pending[j]
+	})
+	state := "stopped"
+	if running {
+		state = "running"
+	}
+	if !safe {
+		state += ", claims not trusted"
+	}
+	report := fmt.Sprintf("leasing agent %s: %s\n", l.etcd.GetName(), state)
+	if !lastRenewal.IsZero() {
+		report += fmt.Sprintf("  last renewed %v ago, at %v\n",
+			now.Sub(lastRenewal), lastRenewal.Format(time.RFC3339Nano))
+	}
+	if !validUntil.IsZero() {
+		report += fmt.Sprintf("  claims valid until %v (%v from now)\n",
+			validUntil.Format(time.RFC3339Nano), validUntil.Sub(now))
+	}
+	if lastError != nil {
+		report += fmt.Sprintf("  last renewal failed: %v\n", lastError)
+	}
+	report += fmt.Sprintf("%d leases held\n", len(leases))
+	for _, lease := range leases {
+		kind := "exclusive"
+		if lease.shared {
+			kind = "shared"
+		}
+		report += fmt.Sprintf("  block %d: version %d, %s, acquired %v ago",
+			lease.block, lease.version, kind, now.Sub(lease.acquired))
+		if lease.writing {
+			report += ", write in progress"
+		}
+		report += "\n"
+	}
+	if len(pending) > 0 {
+		report += fmt.Sprintf("%d blocks being claimed, released, or downgraded:", len(pending))
+		for _, block := range pending {
+			report += fmt.Sprintf(" %d", block)
+		}
+		report += "\n"
+	}
+	_, err := io.WriteString(w, report)
+	return err
+}
+
+func (l *Leasing) notifyUnsafe() {
+	l.mu.Lock()
+	lost := l.heldBlocks_LK()
 	l.safe = false
 	l.leases = make(map[apis.MetadataID]*Lease)
+	l.mu.Unlock()
+	l.reportLost(lost)
 }
 
 func (l *Leasing) ensureRenewed_LK() error {
@@ -135,19 +335,63 @@ func (l *Leasing) ensureRenewed_LK() error {
 	}
 }
 
-func (l *Leasing) ensureClaimed(id apis.MetadataID) (apis.ServerName, error) {
+// Claims a block that isn't already held. If exclusive access isn't needed, and other agents are only reading the block,
+// settles for a shared claim, and reports that it did so.
+func (l *Leasing) ensureClaimed(id apis.MetadataID, exclusive bool) (apis.ServerName, bool, error) {
 	l.mu.Lock()
 	_, foundLease := l.leases[id]
 	_, foundPopulate := l.populating[id]
 	l.mu.Unlock()
 	if !foundLease && !foundPopulate {
-		return l.etcd.TryClaimingMetadata(id)
+		owner, err := l.etcd.TryClaimingMetadata(id)
+		if !exclusive && apis.ErrorCodeOf(err) == apis.ErrLeaseShared {
+			owner, err = l.etcd.TryClaimingMetadataShared(id)
+			return owner, true, err
+		}
+		return owner, false, err
 	} else {
-		return l.etcd.GetName(), nil
+		return l.etcd.GetName(), false, nil
+	}
+}
+
+// Upgrades a shared lease to an exclusive one, which fails with ErrLeaseShared while any other agent still holds a
+// shared claim.
+func (l *Leasing) ensureExclusive(id apis.MetadataID) (apis.ServerName, error) {
+	l.mu.Lock()
+	// wait out any downgrade in progress, so that we see where it left the lease
+	for l.populating[id] != nil {
+		c := l.populating[id]
+		l.mu.Unlock()
+		<-c
+		l.mu.Lock()
+		if l.populating[id] == c {
+			l.populating[id] = nil
+		}
+	}
+	lease := l.leases[id]
+	if lease == nil {
+		l.mu.Unlock()
+		return apis.NoRedirect, errors.New("lease lost before it could be upgraded")
 	}
+	shared := lease.Shared
+	l.mu.Unlock()
+	if !shared {
+		return apis.NoRedirect, nil
+	}
+	owner, err := l.etcd.TryClaimingMetadata(id)
+	if err != nil {
+		return apis.NoRedirect, err
+	}
+	if owner != l.etcd.GetName() {
+		return owner, fmt.Errorf("owned by someone else: %s", owner)
+	}
+	l.mu.Lock()
+	lease.Shared = false
+	l.mu.Unlock()
+	return apis.NoRedirect, nil
 }
 
-func (l *Leasing) requestPopulation(id apis.MetadataID) error {
+func (l *Leasing) requestPopulation(id apis.MetadataID, shared bool) error {
 	// ATTEMPT TO REGISTER OURSELVES AS POPULATING
 	l.mu.Lock()
 	for l.populating[id] != nil {
@@ -182,6 +426,8 @@ func (l *Leasing) requestPopulation(id apis.MetadataID) error {
 		l.leases[id] = &Lease{
 			Contents: data,
 			Version: version,
+			Shared: shared,
+			Acquired: time.Now(),
 		}
 		l.mu.Unlock()
 		// we notify everyone at this point by closing the channel
@@ -208,7 +454,7 @@ func (l *Leasing) GetOrCreateAnyUnleased() (apis.MetadataID, error) {
 		if err != nil {
 			return 0, fmt.Errorf("[leasing.go/ACW] %v", err)
 		}
-		owner, err := l.ensureClaimed(id)
+		owner, _, err := l.ensureClaimed(id, true)
 		if err != nil {
 			return 0, err
 		}
@@ -216,7 +462,7 @@ func (l *Leasing) GetOrCreateAnyUnleased() (apis.MetadataID, error) {
 			return 0, errors.New("should not have been able to be claimed by someone else immediately after New()")
 		}
 	}
-	if err := l.requestPopulation(id); err != nil {
+	if err := l.requestPopulation(id, false); err != nil {
 		return 0, err
 	}
 	l.mu.Lock()
@@ -228,18 +474,21 @@ func (l *Leasing) GetOrCreateAnyUnleased() (apis.MetadataID, error) {
 	return id, nil
 }
 
-func (l *Leasing) populateCache(id apis.MetadataID) (apis.ServerName, error) {
+func (l *Leasing) populateCache(id apis.MetadataID, exclusive bool) (apis.ServerName, error) {
 	// try to claim the chunk
-	owner, err := l.ensureClaimed(id)
+	owner, shared, err := l.ensureClaimed(id, exclusive)
 	if err != nil {
 		return apis.NoRedirect, err
 	}
 	if owner != l.etcd.GetName() {
 		return owner, fmt.Errorf("owned by someone else: %s", owner)
 	}
-	if err := l.requestPopulation(id); err != nil {
+	if err := l.requestPopulation(id, shared); err != nil {
 		return apis.NoRedirect, err
 	}
+	if exclusive {
+		return l.ensureExclusive(id)
+	}
 	return apis.NoRedirect, nil
 }
 
@@ -253,9 +502,24 @@ func (l *Leasing) ListLeases() ([]apis.MetadataID, error) {
 	return result, l.ensureRenewed_LK()
 }
 
-// Reads a complete chunk.
+// Reports which server holds the exclusive lease on a block, as recorded in etcd, without reading or claiming the block.
+// Reports false if no server does, including when the block is only held through shared leases, which any server can
+// join in on. Useful for routing requests to the right server before sending them.
+func (l *Leasing) OwnerOf(block apis.MetadataID) (apis.ServerName, bool, error) {
+	return l.etcd.GetMetadataOwner(block)
+}
+
+// Lists every metadata block that exists, whether or not this server holds a lease on it.
+func (l *Leasing) ListAllBlocks() ([]apis.MetadataID, error) {
+	return l.etcd.ListAllMetaIDs()
+}
+
+// Reads a complete chunk. The returned data is shared with the cache and with every other reader, so it must be treated
+// as read-only; it is safe to keep reading it while another goroutine writes to the same block, because writes replace
+// the cached contents instead of modifying them.
+// Blocks that other agents hold shared leases on are read under a shared lease of our own, rather than redirecting.
 func (l *Leasing) Read(metachunk apis.MetadataID) ([]byte, apis.Version, apis.ServerName, error) {
-	owner, err := l.populateCache(metachunk)
+	owner, err := l.populateCache(metachunk, false)
 	if err != nil {
 		return nil, 0, owner, err
 	}
@@ -269,17 +533,18 @@ func (l *Leasing) Read(metachunk apis.MetadataID) ([]byte, apis.Version, apis.Se
 	return lease.Contents, lease.Version, apis.NoRedirect, nil
 }
 
-// Writes part of a chunk. Only performs the write if the version matches. Returns the new version on success, or the
-// old version on failure, if the problem was that the version was a mismatch. The returned version is zero on failure
-// iff the problem was something else.
+// Writes part of a chunk. Only performs the write if the version matches. Returns the new version on success. If the
+// problem was that the version was a mismatch, fails with ErrWrongVersion, and returns the block's current version,
+// which is also carried by the error; any other failure returns zero, and is not worth retrying. Zero is a real version,
+// that of a block that has never been written, so a mismatch is told apart by its error code rather than by the
+// returned version.
+// A shared lease is upgraded to an exclusive one first, which fails with ErrLeaseShared while other agents are still
+// reading the block.
 func (l *Leasing) Write(metachunk apis.MetadataID, version apis.Version, offset uint32, data []byte) (apis.Version, apis.ServerName, error) {
 	if offset + uint32(len(data)) > apis.MaxChunkSize {
 		return 0, apis.NoRedirect, errors.New("write is too large")
 	}
-	if version == 0 {
-		return 0, apis.NoRedirect, errors.New("version cannot be zero to Leasing.Write")
-	}
-	owner, err := l.populateCache(metachunk)
+	owner, err := l.populateCache(metachunk, true)
 	if err != nil {
 		return 0, owner, err
 	}
@@ -287,7 +552,8 @@ func (l *Leasing) Write(metachunk apis.MetadataID, version apis.Version, offset
 	lease := l.leases[metachunk]
 	if lease.Version != version {
 		l.mu.Unlock()
-		return lease.Version, apis.NoRedirect, errors.New("version mismatch during lease write")
+		return lease.Version, apis.NoRedirect, apis.NewError(apis.ErrWrongVersion, lease.Version,
+			"version mismatch during lease write: expected %d, but block %d is at %d", version, metachunk, lease.Version)
 	}
 	for lease.WriteCompletion != nil {
 		waitOn := lease.WriteCompletion
@@ -300,9 +566,15 @@ func (l *Leasing) Write(metachunk apis.MetadataID, version apis.Version, offset
 		}
 		if lease.Version != version {
 			l.mu.Unlock()
-			return lease.Version, apis.NoRedirect, errors.New("version mismatch during lease write")
+			return lease.Version, apis.NoRedirect, apis.NewError(apis.ErrWrongVersion, lease.Version,
+			"version mismatch during lease write: expected %d, but block %d is at %d", version, metachunk, lease.Version)
 		}
 	}
+	if lease.Shared {
+		// downgraded since we upgraded it
+		l.mu.Unlock()
+		return 0, apis.NoRedirect, apis.NewError(apis.ErrLeaseShared, 0, "metadata block %d was downgraded during write", metachunk)
+	}
 	writeChan := make(chan struct{})
 	defer close(writeChan)
 	lease.WriteCompletion = writeChan
@@ -311,12 +583,12 @@ func (l *Leasing) Write(metachunk apis.MetadataID, version apis.Version, offset
 	newVersion, err := l.access.Write(metachunk, version, offset, data)
 	if err != nil {
 		// note: we don't pass through checking about the version, because there should not have been any contention for
-		// the latest version!
-		return 0, apis.NoRedirect, err
+		// the latest version! so the error is wrapped, to keep its code from being mistaken for a mismatch here
+		return 0, apis.NoRedirect, fmt.Errorf("[leasing.go/AWR] %v", err)
 	}
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	// update cache
+	// update cache, without touching the old contents, which earlier readers may still be looking at
 	updated := make([]byte, apis.MaxChunkSize)
 	copy(updated, lease.Contents)
 	copy(updated[offset:], data)
@@ -328,3 +600,109 @@ func (l *Leasing) Write(metachunk apis.MetadataID, version apis.Version, offset
 	}
 	return newVersion, apis.NoRedirect, nil
 }
+
+// Checks whether a write to this lease has started but not yet completed.
+func (lease *Lease) writeInProgress() bool {
+	if lease.WriteCompletion == nil {
+		return false
+	}
+	select {
+	case <-lease.WriteCompletion:
+		return false
+	default:
+		return true
+	}
+}
+
+// Gives up this agent's lease on a single metadata block, so that another agent can claim it, without disturbing any
+// other leases. Writes go straight through to the chunkservers, so once no write is in progress there is nothing left
+// to flush. Refuses to release a block while a write to it is still in progress, because that write might not have
+// been committed yet.
+func (l *Leasing) ReleaseLease(block apis.MetadataID) error {
+	l.mu.Lock()
+	lease, found := l.leases[block]
+	if !found {
+		l.mu.Unlock()
+		return fmt.Errorf("no lease held on metadata block %d", block)
+	}
+	if lease.writeInProgress() {
+		l.mu.Unlock()
+		return fmt.Errorf("cannot release metadata block %d while a write to it is in progress", block)
+	}
+	if l.populating[block] != nil {
+		l.mu.Unlock()
+		return fmt.Errorf("cannot release metadata block %d while it is being populated", block)
+	}
+	delete(l.leases, block)
+	// by pretending to be populating this block, we keep anyone else from re-populating it until the claim is gone
+	releaseChan := make(chan struct{})
+	l.populating[block] = releaseChan
+	l.mu.Unlock()
+
+	var err error
+	if lease.Shared {
+		err = l.etcd.DisclaimMetadataShared(block)
+	} else {
+		err = l.etcd.DisclaimMetadata(block)
+	}
+
+	l.mu.Lock()
+	if l.populating[block] == releaseChan {
+		delete(l.populating, block)
+	}
+	l.mu.Unlock()
+	close(releaseChan)
+	l.reportLost([]apis.MetadataID{block})
+
+	if err != nil {
+		return fmt.Errorf("[leasing.go/DSC] %v", err)
+	}
+	return nil
+}
+
+// Downgrades this agent's exclusive lease on a metadata block to a shared one, so that other agents can read the block
+// directly instead of being redirected here. Nobody can write to the block until every agent but one has released its
+// shared lease, at which point the remaining agent's next write upgrades its lease back to exclusive. Refuses to
+// downgrade while a write is in progress, for the same reasons as ReleaseLease.
+func (l *Leasing) Downgrade(block apis.MetadataID) error {
+	l.mu.Lock()
+	lease, found := l.leases[block]
+	if !found {
+		l.mu.Unlock()
+		return fmt.Errorf("no lease held on metadata block %d", block)
+	}
+	if lease.Shared {
+		l.mu.Unlock()
+		return fmt.Errorf("lease on metadata block %d is already shared", block)
+	}
+	if lease.writeInProgress() {
+		l.mu.Unlock()
+		return fmt.Errorf("cannot downgrade metadata block %d while a write to it is in progress", block)
+	}
+	if l.populating[block] != nil {
+		l.mu.Unlock()
+		return fmt.Errorf("cannot downgrade metadata block %d while it is being populated", block)
+	}
+	// no new writes can start once the lease is marked shared, and upgrades wait until the downgrade is done
+	lease.Shared = true
+	downgradeChan := make(chan struct{})
+	l.populating[block] = downgradeChan
+	l.mu.Unlock()
+
+	err := l.etcd.DowngradeMetadata(block)
+
+	l.mu.Lock()
+	if err != nil {
+		lease.Shared = false
+	}
+	if l.populating[block] == downgradeChan {
+		delete(l.populating, block)
+	}
+	l.mu.Unlock()
+	close(downgradeChan)
+
+	if err != nil {
+		return fmt.Errorf("[leasing.go/DGM] %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,405 @@
+package leasing
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/apis/mocks"
+	"zircon/chunkserver"
+	"zircon/etcd"
+	"zircon/etcd/mocketcd"
+	"zircon/rpc"
+	"zircon/util"
+)
+
+func prepareLeasingAgents(t *testing.T) (*Leasing, *Leasing, func()) {
+	etcds, teardownEtcd := etcd.PrepareSubscribeForTesting(t)
+	return prepareLeasingAgentsWith(t, etcds, teardownEtcd)
+}
+
+// Like prepareLeasingAgents, but backed by an in-memory etcd rather than a real one, which is much faster to start, and
+// lets the test control etcd's clock and failures through the store.
+func prepareFakeLeasingAgents(t *testing.T) (*Leasing, *Leasing, *mocketcd.Store, func()) {
+	store, etcds := mocketcd.PrepareSubscribeForTesting(t)
+	agent0, agent1, teardown := prepareLeasingAgentsWith(t, etcds, func() {})
+	return agent0, agent1, store, teardown
+}
+
+func prepareLeasingAgentsWith(t *testing.T, etcds func(apis.ServerName) (apis.EtcdInterface, func()), teardownEtcd func()) (*Leasing, *Leasing, func()) {
+	cache := rpc.NewConnectionCache()
+	teardowns := &util.MultiTeardown{}
+
+	for _, name := range []apis.ServerName{"cs0", "cs1", "cs2"} {
+		cs, _, teardownCS := chunkserver.NewTestChunkserver(t, cache)
+		teardowns.Add(teardownCS)
+		teardownPublish, address, err := rpc.PublishChunkserver(cs, "127.0.0.1:0")
+		require.NoError(t, err)
+		teardowns.Add(func() { teardownPublish(true) })
+
+		iface, teardownIface := etcds(name)
+		teardowns.Add(teardownIface)
+		require.NoError(t, iface.UpdateAddress(address, apis.CHUNKSERVER))
+	}
+
+	var agents []*Leasing
+	for _, name := range []apis.ServerName{"mc0", "mc1"} {
+		iface, teardownIface := etcds(name)
+		agent, err := ConstructLeasing(iface, cache)
+		require.NoError(t, err)
+		require.NoError(t, agent.Start())
+		teardowns.Add(func() {
+			agent.Stop()
+			teardownIface()
+		})
+		agents = append(agents, agent)
+	}
+
+	// MultiTeardown runs in order, so shut down the shared infrastructure last
+	teardowns.Add(cache.CloseAll, teardownEtcd)
+
+	return agents[0], agents[1], teardowns.Teardown
+}
+
+func TestReleaseLease(t *testing.T) {
+	agent0, agent1, teardown := prepareLeasingAgents(t)
+	defer teardown()
+	testReleaseLease(t, agent0, agent1)
+}
+
+func TestReleaseLeaseFake(t *testing.T) {
+	agent0, agent1, _, teardown := prepareFakeLeasingAgents(t)
+	defer teardown()
+	testReleaseLease(t, agent0, agent1)
+}
+
+func testReleaseLease(t *testing.T, agent0 *Leasing, agent1 *Leasing) {
+	assert := testifyAssert.New(t)
+
+	block, err := agent0.GetOrCreateAnyUnleased()
+	require.NoError(t, err)
+
+	_, version, _, err := agent0.Read(block)
+	require.NoError(t, err)
+	_, _, err = agent0.Write(block, version, 16, []byte("released data"))
+	require.NoError(t, err)
+
+	// while agent0 holds the lease, agent1 is redirected
+	_, _, owner, err := agent1.Read(block)
+	assert.Error(err)
+	assert.Equal(apis.ServerName("mc0"), owner)
+
+	var released []apis.MetadataID
+	agent0.OnLeaseLost(func(blocks []apis.MetadataID) {
+		released = append(released, blocks...)
+	})
+	assert.NoError(agent0.ReleaseLease(block))
+	assert.Equal([]apis.MetadataID{block}, released)
+	leases, err := agent0.ListLeases()
+	assert.NoError(err)
+	assert.NotContains(leases, block)
+
+	// now agent1 can claim it, and sees the data written before the release
+	data, _, owner, err := agent1.Read(block)
+	assert.NoError(err)
+	assert.Equal(apis.NoRedirect, owner)
+	assert.Equal("released data", string(data[16:16+len("released data")]))
+
+	leases, err = agent1.ListLeases()
+	assert.NoError(err)
+	assert.Contains(leases, block)
+
+	// agent0 no longer holds anything to release
+	assert.Error(agent0.ReleaseLease(block))
+}
+
+func TestOwnerOf(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	agent0, agent1, teardown := prepareLeasingAgents(t)
+	defer teardown()
+
+	block, err := agent0.GetOrCreateAnyUnleased()
+	require.NoError(t, err)
+	_, _, _, err = agent0.Read(block)
+	require.NoError(t, err)
+
+	// both agents see the same owner, whether or not they hold the lease themselves
+	for _, agent := range []*Leasing{agent0, agent1} {
+		owner, held, err := agent.OwnerOf(block)
+		assert.NoError(err)
+		assert.True(held)
+		assert.Equal(apis.ServerName("mc0"), owner)
+	}
+
+	// and nobody owns it once it's released, until it's claimed again
+	assert.NoError(agent0.ReleaseLease(block))
+	owner, held, err := agent1.OwnerOf(block)
+	assert.NoError(err)
+	assert.False(held)
+	assert.Equal(apis.ServerName(""), owner)
+
+	_, _, _, err = agent1.Read(block)
+	require.NoError(t, err)
+	owner, held, err = agent0.OwnerOf(block)
+	assert.NoError(err)
+	assert.True(held)
+	assert.Equal(apis.ServerName("mc1"), owner)
+}
+
+func TestDumpState(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	agent0, agent1, teardown := prepareLeasingAgents(t)
+	defer teardown()
+
+	block, err := agent0.GetOrCreateAnyUnleased()
+	require.NoError(t, err)
+	_, version, _, err := agent0.Read(block)
+	require.NoError(t, err)
+	version, _, err = agent0.Write(block, version, 0, []byte("dumped"))
+	require.NoError(t, err)
+
+	var dump bytes.Buffer
+	assert.NoError(agent0.DumpState(&dump))
+	report := dump.String()
+	assert.Contains(report, "leasing agent mc0: running")
+	assert.Contains(report, "1 leases held")
+	assert.Contains(report, fmt.Sprintf("block %d: version %d, exclusive, acquired", block, version))
+	assert.Contains(report, "claims valid until")
+	assert.NotContains(report, "write in progress")
+
+	// the other agent holds nothing
+	dump.Reset()
+	assert.NoError(agent1.DumpState(&dump))
+	assert.Contains(dump.String(), "0 leases held")
+	assert.NotContains(dump.String(), fmt.Sprintf("block %d:", block))
+}
+
+func TestReleaseLeaseRefusedDuringWrite(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	agent0, _, teardown := prepareLeasingAgents(t)
+	defer teardown()
+
+	block, err := agent0.GetOrCreateAnyUnleased()
+	require.NoError(t, err)
+
+	// simulate a write that has started but not finished
+	agent0.mu.Lock()
+	pending := make(chan struct{})
+	agent0.leases[block].WriteCompletion = pending
+	agent0.mu.Unlock()
+
+	assert.Error(agent0.ReleaseLease(block))
+
+	close(pending)
+	assert.NoError(agent0.ReleaseLease(block))
+}
+
+func TestStatusReflectsRenewalFailure(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	etcdMock := &mocks.EtcdInterface{}
+	etcdMock.On("BeginMetadataLease").Return(nil)
+	etcdMock.On("GetMetadataLeaseTimeout").Return(60 * time.Millisecond)
+	etcdMock.On("RenewMetadataClaims").Return(nil).Once()
+	etcdMock.On("RenewMetadataClaims").Return(errors.New("etcd unreachable"))
+	cache := rpc.NewConnectionCache()
+	defer cache.CloseAll()
+	agent, err := ConstructLeasing(etcdMock, cache)
+	require.NoError(t, err)
+
+	assert.Equal(LeaseAgentStatus{}, agent.Status())
+
+	require.NoError(t, agent.Start())
+	status := agent.Status()
+	assert.True(status.Started)
+	assert.NoError(status.LastError)
+	assert.Equal(0, status.HeldLeases)
+
+	// the first renewal succeeds, and the second one fails, which ends the renewal loop
+	deadline := time.Now().Add(time.Second)
+	for agent.Status().Started && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	status = agent.Status()
+	assert.False(status.Started)
+	if assert.Error(status.LastError) {
+		assert.Contains(status.LastError.Error(), "etcd unreachable")
+	}
+	assert.True(status.SinceLastRenewal > 0)
+	etcdMock.AssertNumberOfCalls(t, "RenewMetadataClaims", 2)
+
+	assert.NoError(agent.Stop())
+}
+
+// Run with -race: a slice returned by Read must not be modified by later writes to the same block.
+func TestReadWhileWriting(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	agent0, _, teardown := prepareLeasingAgents(t)
+	defer teardown()
+
+	block, err := agent0.GetOrCreateAnyUnleased()
+	require.NoError(t, err)
+	data, version, _, err := agent0.Read(block)
+	require.NoError(t, err)
+
+	const writes = 20
+	done := make(chan error, 1)
+	go func() {
+		version := version
+		for i := 0; i < writes; i++ {
+			var err error
+			version, _, err = agent0.Write(block, version, 0, []byte{byte(i + 1), byte(i + 1)})
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	finished := false
+	for !finished {
+		select {
+		case err := <-done:
+			assert.NoError(err)
+			finished = true
+		default:
+		}
+		snapshot, _, _, err := agent0.Read(block)
+		require.NoError(t, err)
+		// both bytes come from the same write, so seeing them disagree would mean a torn read
+		assert.Equal(snapshot[0], snapshot[1])
+		assert.Equal(byte(0), data[0], "data returned by an earlier read should never change")
+	}
+
+	latest, _, _, err := agent0.Read(block)
+	assert.NoError(err)
+	assert.Equal([]byte{writes, writes}, latest[:2])
+}
+
+func TestSharedReadLeases(t *testing.T) {
+	agent0, agent1, teardown := prepareLeasingAgents(t)
+	defer teardown()
+	testSharedReadLeases(t, agent0, agent1)
+}
+
+func TestSharedReadLeasesFake(t *testing.T) {
+	agent0, agent1, _, teardown := prepareFakeLeasingAgents(t)
+	defer teardown()
+	testSharedReadLeases(t, agent0, agent1)
+}
+
+func testSharedReadLeases(t *testing.T, agent0 *Leasing, agent1 *Leasing) {
+	assert := testifyAssert.New(t)
+
+	block, err := agent0.GetOrCreateAnyUnleased()
+	require.NoError(t, err)
+	_, version, _, err := agent0.Read(block)
+	require.NoError(t, err)
+	version, _, err = agent0.Write(block, version, 16, []byte("shared data"))
+	require.NoError(t, err)
+
+	assert.NoError(agent0.Downgrade(block))
+	assert.Error(agent0.Downgrade(block))
+
+	// both agents can now read the block without being redirected
+	for _, agent := range []*Leasing{agent0, agent1} {
+		data, readVersion, owner, err := agent.Read(block)
+		assert.NoError(err)
+		assert.Equal(apis.NoRedirect, owner)
+		assert.Equal(version, readVersion)
+		assert.Equal("shared data", string(data[16:16+len("shared data")]))
+	}
+	leases, err := agent1.ListLeases()
+	assert.NoError(err)
+	assert.Contains(leases, block)
+
+	// but neither can write while the other is still reading
+	_, _, err = agent1.Write(block, version, 0, []byte("nope"))
+	assert.Equal(apis.ErrLeaseShared, apis.ErrorCodeOf(err))
+	_, _, err = agent0.Write(block, version, 0, []byte("nope"))
+	assert.Equal(apis.ErrLeaseShared, apis.ErrorCodeOf(err))
+
+	// once agent0 lets go, agent1's lease can be upgraded
+	assert.NoError(agent0.ReleaseLease(block))
+	newVersion, _, err := agent1.Write(block, version, 0, []byte("mine"))
+	assert.NoError(err)
+	assert.True(newVersion > version)
+
+	// and agent0 gets redirected again
+	_, _, owner, err := agent0.Read(block)
+	assert.Error(err)
+	assert.Equal(apis.ServerName("mc1"), owner)
+}
+
+func TestLeaseLostWhenExpiredFake(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	agent0, agent1, store, teardown := prepareFakeLeasingAgents(t)
+	defer teardown()
+	lost := make(chan []apis.MetadataID, 1)
+	agent0.OnLeaseLost(func(blocks []apis.MetadataID) {
+		lost <- blocks
+	})
+
+	block, err := agent0.GetOrCreateAnyUnleased()
+	require.NoError(t, err)
+	_, _, owner, err := agent1.Read(block)
+	assert.Error(err)
+	assert.Equal(apis.ServerName("mc0"), owner)
+
+	// etcd gives up on mc0, as it would if mc0 were cut off for longer than the lease timeout
+	store.ExpireServer("mc0")
+	deadline := time.Now().Add(time.Second)
+	for agent0.Status().Started && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	status := agent0.Status()
+	assert.False(status.Started)
+	assert.Error(status.LastError)
+	select {
+	case blocks := <-lost:
+		assert.Equal([]apis.MetadataID{block}, blocks)
+	case <-time.After(time.Second):
+		t.Error("lease loss never reported")
+	}
+
+	// and the block can be claimed by someone else
+	_, _, owner, err = agent1.Read(block)
+	assert.NoError(err)
+	assert.Equal(apis.NoRedirect, owner)
+}
+
+func TestClaimFailureFake(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	agent0, agent1, store, teardown := prepareFakeLeasingAgents(t)
+	defer teardown()
+
+	block, err := agent0.GetOrCreateAnyUnleased()
+	require.NoError(t, err)
+	assert.NoError(agent0.ReleaseLease(block))
+
+	store.InjectFault("mc1", "TryClaimingMetadata", mocketcd.Fault{Err: errors.New("etcd unreachable"), Times: 1})
+	_, _, _, err = agent1.Read(block)
+	if assert.Error(err) {
+		assert.Contains(err.Error(), "etcd unreachable")
+	}
+	leases, err := agent1.ListLeases()
+	assert.NoError(err)
+	assert.NotContains(leases, block)
+
+	// once etcd is reachable again, the claim goes through
+	_, _, owner, err := agent1.Read(block)
+	assert.NoError(err)
+	assert.Equal(apis.NoRedirect, owner)
+	assert.True(store.Calls("mc1", "TryClaimingMetadata") >= 2)
+}
@@ -0,0 +1,159 @@
+package leasing
+
+import (
+	"fmt"
+	"sort"
+	"zircon/apis"
+)
+
+// What a single leasing agent holds, as gathered for PlanRebalance, such as by GatherLeases.
+type AgentLeases struct {
+	Server apis.ServerName
+	// The blocks the agent holds exclusive leases on, as listed by its ListLeases, or as recorded in etcd.
+	Blocks []apis.MetadataID
+	// How busy each block has been lately, in whatever unit the caller likes, such as requests served, as long as it's
+	// the same for every agent. Blocks that aren't listed count as idle.
+	Activity map[apis.MetadataID]uint64
+}
+
+// A recommendation to move the lease on a block from one agent to another. Agents can't hand a lease directly to each
+// other, so it's carried out by having From release the block with ReleaseLease, as ShedLeases does, after which To
+// can claim it. Until To next touches the block, any agent that needs it may claim it first instead.
+type Transfer struct {
+	Block apis.MetadataID
+	From  apis.ServerName
+	To    apis.ServerName
+}
+
+// The load a block puts on its agent. Even an idle block counts for something, so that an agent holding many idle
+// blocks is still seen as holding more than one holding none.
+func blockLoad(agent AgentLeases, block apis.MetadataID) uint64 {
+	return 1 + agent.Activity[block]
+}
+
+// Recommends lease transfers that even out the load across agents, moving at most maxTransfers blocks, or as many as
+// it takes if maxTransfers is zero. This only plans; nothing is changed.
+//
+// Transfers are picked one at a time, each moving a block from the busiest agent to the least busy one. The block
+// chosen is the one that brings the two closest together, and a block is only moved if that actually narrows the gap
+// between them, so the plan never moves load back and forth, and stops once no single move would help. Each block is
+// moved at most once. Ties are broken by server name and block ID, so the same state always gets the same plan.
+func PlanRebalance(agents []AgentLeases, maxTransfers int) []Transfer {
+	if len(agents) < 2 {
+		return nil
+	}
+	sorted := append([]AgentLeases(nil), agents...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Server < sorted[j].Server
+	})
+	loads := make([]uint64, len(sorted))
+	held := make([][]apis.MetadataID, len(sorted))
+	for i, agent := range sorted {
+		held[i] = append([]apis.MetadataID(nil), agent.Blocks...)
+		sort.Slice(held[i], func(a, b int) bool {
+			return held[i][a] < held[i][b]
+		})
+		for _, block := range held[i] {
+			loads[i] += blockLoad(agent, block)
+		}
+	}
+
+	var transfers []Transfer
+	for maxTransfers == 0 || len(transfers) < maxTransfers {
+		busiest, idlest := 0, 0
+		for i := range sorted {
+			if loads[i] > loads[busiest] {
+				busiest = i
+			}
+			if loads[i] < loads[idlest] {
+				idlest = i
+			}
+		}
+		gap := loads[busiest] - loads[idlest]
+		best, bestLoad := -1, uint64(0)
+		for index, block := range held[busiest] {
+			load := blockLoad(sorted[busiest], block)
+			// moving a block narrows the gap only if it's smaller than the gap; the closer it is to half the gap, the
+			// closer the two agents end up
+			if load >= gap {
+				continue
+			}
+			// when it's a tie, moving less is less disruptive
+			offBy, bestOffBy := distance(2*load, gap), distance(2*bestLoad, gap)
+			if best < 0 || offBy < bestOffBy || (offBy == bestOffBy && load < bestLoad) {
+				best, bestLoad = index, load
+			}
+		}
+		if best < 0 {
+			break
+		}
+		block := held[busiest][best]
+		held[busiest] = append(held[busiest][:best], held[busiest][best+1:]...)
+		loads[busiest] -= bestLoad
+		// the block isn't added to the destination's list, so that it's never chosen to be moved again
+		loads[idlest] += bestLoad
+		transfers = append(transfers, Transfer{Block: block, From: sorted[busiest].Server, To: sorted[idlest].Server})
+	}
+	return transfers
+}
+
+func distance(a uint64, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+// Gathers how the exclusive leases on metadata blocks are spread across the metadata caches, as recorded in etcd,
+// since agents can't be asked for their leases directly. Blocks held only through shared leases have no single owner,
+// so they're left out. Every metadata cache with an address in etcd is included, even one that holds nothing, so that
+// it can be given something. Nothing is known about how busy each block is, so every block counts as idle.
+func (l *Leasing) GatherLeases() ([]AgentLeases, error) {
+	servers, err := l.etcd.ListServers(apis.METADATACACHE)
+	if err != nil {
+		return nil, fmt.Errorf("[rebalance.go/LSV] %v", err)
+	}
+	blocks, err := l.etcd.ListAllMetaIDs()
+	if err != nil {
+		return nil, fmt.Errorf("[rebalance.go/LMI] %v", err)
+	}
+	held := map[apis.ServerName][]apis.MetadataID{}
+	for _, server := range append(servers, l.etcd.GetName()) {
+		held[server] = nil
+	}
+	for _, block := range blocks {
+		owner, found, err := l.etcd.GetMetadataOwner(block)
+		if err != nil {
+			return nil, fmt.Errorf("[rebalance.go/OWN] %v", err)
+		}
+		if found {
+			held[owner] = append(held[owner], block)
+		}
+	}
+	var agents []AgentLeases
+	for server, blocks := range held {
+		agents = append(agents, AgentLeases{Server: server, Blocks: blocks})
+	}
+	return agents, nil
+}
+
+// Plans a rebalance across every metadata cache, as gathered by GatherLeases, and carries out this agent's part of it,
+// by releasing each block that the plan moves away from this agent. Each agent is expected to do this for itself, since
+// only the holder of a lease can release it. Returns the transfers that were carried out.
+func (l *Leasing) ShedLeases(maxTransfers int) ([]Transfer, error) {
+	agents, err := l.GatherLeases()
+	if err != nil {
+		return nil, err
+	}
+	var shed []Transfer
+	for _, transfer := range PlanRebalance(agents, maxTransfers) {
+		if transfer.From != l.etcd.GetName() {
+			continue
+		}
+		if err := l.ReleaseLease(transfer.Block); err != nil {
+			return shed, fmt.Errorf("[rebalance.go/REL] %v", err)
+		}
+		shed = append(shed, transfer)
+	}
+	return shed, nil
+}
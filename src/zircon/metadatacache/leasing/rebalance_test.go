@@ -0,0 +1,118 @@
+package leasing
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+)
+
+func blockRange(first apis.MetadataID, count int) []apis.MetadataID {
+	var blocks []apis.MetadataID
+	for i := 0; i < count; i++ {
+		blocks = append(blocks, first+apis.MetadataID(i))
+	}
+	return blocks
+}
+
+func TestPlanRebalanceSkewed(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	agents := []AgentLeases{
+		{Server: "mc0", Blocks: blockRange(1, 10)},
+		{Server: "mc1", Blocks: blockRange(11, 2)},
+		{Server: "mc2"},
+	}
+	transfers := PlanRebalance(agents, 0)
+	held := map[apis.ServerName]int{"mc0": 10, "mc1": 2, "mc2": 0}
+	for _, transfer := range transfers {
+		// everything comes off the agent that has too much
+		assert.Equal(apis.ServerName("mc0"), transfer.From)
+		held[transfer.From] -= 1
+		held[transfer.To] += 1
+	}
+	assert.Len(transfers, 6)
+	assert.Equal(map[apis.ServerName]int{"mc0": 4, "mc1": 4, "mc2": 4}, held)
+	// and the same state gets the same plan
+	assert.Equal(transfers, PlanRebalance(agents, 0))
+
+	limited := PlanRebalance(agents, 2)
+	assert.Equal(transfers[:2], limited)
+}
+
+func TestPlanRebalanceHotBlock(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	// the hot block is busier than everything else put together, so the idle ones move away from it instead
+	agents := []AgentLeases{
+		{Server: "mc0", Blocks: []apis.MetadataID{1, 2, 3}, Activity: map[apis.MetadataID]uint64{1: 99}},
+		{Server: "mc1", Blocks: []apis.MetadataID{4}},
+	}
+	assert.Equal([]Transfer{
+		{Block: 2, From: "mc0", To: "mc1"},
+		{Block: 3, From: "mc0", To: "mc1"},
+	}, PlanRebalance(agents, 0))
+
+	// two busy blocks on one agent get split up
+	agents = []AgentLeases{
+		{Server: "mc0", Blocks: []apis.MetadataID{1, 2}, Activity: map[apis.MetadataID]uint64{1: 50, 2: 50}},
+		{Server: "mc1", Blocks: []apis.MetadataID{3}, Activity: map[apis.MetadataID]uint64{3: 10}},
+	}
+	assert.Equal([]Transfer{{Block: 1, From: "mc0", To: "mc1"}}, PlanRebalance(agents, 0))
+}
+
+func TestPlanRebalanceBalanced(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	assert.Empty(PlanRebalance(nil, 0))
+	assert.Empty(PlanRebalance([]AgentLeases{{Server: "mc0", Blocks: blockRange(1, 5)}}, 0))
+	assert.Empty(PlanRebalance([]AgentLeases{
+		{Server: "mc0", Blocks: blockRange(1, 3)},
+		{Server: "mc1", Blocks: blockRange(4, 2)},
+	}, 0))
+}
+
+func TestShedLeasesFake(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	agent0, agent1, _, teardown := prepareFakeLeasingAgents(t)
+	defer teardown()
+	// only registered metadata caches are found, so that one holding nothing can still be given something
+	require.NoError(t, agent0.etcd.UpdateAddress("127.0.0.1:1", apis.METADATACACHE))
+	require.NoError(t, agent1.etcd.UpdateAddress("127.0.0.1:2", apis.METADATACACHE))
+
+	var blocks []apis.MetadataID
+	for i := 0; i < 4; i++ {
+		block, err := agent0.GetOrCreateAnyUnleased()
+		require.NoError(t, err)
+		blocks = append(blocks, block)
+	}
+
+	agents, err := agent1.GatherLeases()
+	assert.NoError(err)
+	held := map[apis.ServerName]int{}
+	for _, agent := range agents {
+		held[agent.Server] = len(agent.Blocks)
+	}
+	assert.Equal(map[apis.ServerName]int{"mc0": 4, "mc1": 0}, held)
+
+	// an agent with nothing to give up doesn't release anything
+	shed, err := agent1.ShedLeases(0)
+	assert.NoError(err)
+	assert.Empty(shed)
+
+	shed, err = agent0.ShedLeases(0)
+	assert.NoError(err)
+	assert.Len(shed, 2)
+	leases, err := agent0.ListLeases()
+	assert.NoError(err)
+	assert.Len(leases, 2)
+	for _, transfer := range shed {
+		assert.Equal(apis.ServerName("mc1"), transfer.To)
+		assert.NotContains(leases, transfer.Block)
+		// and the destination can now claim it
+		_, _, owner, err := agent1.Read(transfer.Block)
+		assert.NoError(err)
+		assert.Equal(apis.NoRedirect, owner)
+	}
+}
@@ -1,52 +1,165 @@
 package metadatacache
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math/bits"
+	"time"
 	"zircon/apis"
 	"zircon/metadatacache/leasing"
 	"zircon/rpc"
 	"zircon/util"
 )
 
+// The parts of leasing.Leasing that the metadata cache depends upon.
+// Write fails with ErrWrongVersion if the block isn't at the given version anymore, in which case it's worth reading
+// the block again and retrying; see isVersionMismatch. Any other failure is final.
+type leaser interface {
+	Read(metachunk apis.MetadataID) ([]byte, apis.Version, apis.ServerName, error)
+	Write(metachunk apis.MetadataID, version apis.Version, offset uint32, data []byte) (apis.Version, apis.ServerName, error)
+	ListLeases() ([]apis.MetadataID, error)
+	GetOrCreateAnyUnleased() (apis.MetadataID, error)
+	ListAllBlocks() ([]apis.MetadataID, error)
+}
+
+// Optional behaviors for a metadata cache. The zero value gives the default behavior.
+type Options struct {
+	// The longest that UpdateEntry may spend on a single call, counting every retry after a version mismatch. Zero
+	// means that there is no limit.
+	UpdateBudget time.Duration
+	// When ReadEntry finds a restorable entry whose allocation bit is not set, as a crash partway through restoring an
+	// entry can leave behind, set the bit again so that NewEntry can't hand the entry out to someone else. This makes
+	// reads mutate the block, so it is only done when asked for.
+	RepairOnRead bool
+	// How long to wait for etcd to grant the metadata lease when the cache is constructed, before giving up with
+	// ErrUnreachable. Zero means DefaultStartTimeout.
+	StartTimeout time.Duration
+	// Where NewEntry allocates new entries. Nil means searching for free entries in the blocks this server holds
+	// leases on, and then in unleased blocks; anything else is meant for tests that need predictable chunk numbers.
+	Allocation AllocationSource
+	// Where to record every change made to an entry. Nil means not keeping any record.
+	Audit AuditSink
+	// How many records can be waiting for Audit before changes have to wait for it. Zero means DefaultAuditBuffer.
+	AuditBuffer int
+	// Drop records once AuditBuffer is full, rather than holding up changes until Audit catches up. Dropped records
+	// are counted by AuditDropped, but are otherwise lost.
+	AuditDropWhenFull bool
+}
+
+// How long NewCache waits for etcd before giving up, unless Options.StartTimeout says otherwise.
+const DefaultStartTimeout = 10 * time.Second
+
+func (o Options) startTimeout() time.Duration {
+	if o.StartTimeout == 0 {
+		return DefaultStartTimeout
+	}
+	return o.StartTimeout
+}
+
 type metadatacache struct {
-	leasing *leasing.Leasing
+	leasing leaser
+	blocks  *blockCache
+	options Options
+	audit   *auditLog
 }
 
 // Construct a new metadata cache.
 func NewCache(connCache rpc.ConnectionCache, etcd apis.EtcdInterface) (apis.MetadataCache, error) {
+	return NewCacheWithOptions(connCache, etcd, Options{})
+}
+
+// Like NewCache, but with non-default options.
+func NewCacheWithOptions(connCache rpc.ConnectionCache, etcd apis.EtcdInterface, options Options) (apis.MetadataCache, error) {
 	agent, err := leasing.ConstructLeasing(etcd, connCache)
 	if err != nil {
 		return nil, err
 	}
 	// TODO: figure out a good time to run Stop()
 	// TODO: be able to automatically re-establish a lease by Stop()/Start() sequence
-	err = agent.Start()
+	err = agent.StartWithTimeout(options.startTimeout())
 	if err != nil {
 		return nil, err
 	}
 
+	blocks := newBlockCache()
+	agent.OnLeaseLost(blocks.invalidateAll)
 	return &metadatacache{
 		leasing: agent,
+		blocks:  blocks,
+		options: options,
+		audit:   newAuditLog(options.Audit, options.AuditBuffer, options.AuditDropWhenFull),
 	}, nil
 }
 
-// Reads the metadata entry of a particular chunk.
+// Reads a metadata block. Fresh reads always go through the leasing layer; cached reads are served from the local block
+// cache when possible, and populate it otherwise.
+func (mc *metadatacache) readBlock(metachunk apis.MetadataID, consistency apis.Consistency) ([]byte, apis.Version, apis.ServerName, error) {
+	if consistency != apis.Cached {
+		return mc.leasing.Read(metachunk)
+	}
+	if data, version, found := mc.blocks.get(metachunk); found {
+		return data, version, apis.NoRedirect, nil
+	}
+	data, version, owner, err := mc.leasing.Read(metachunk)
+	if err != nil {
+		// either the block moved to another server, or something went wrong; either way, our copy can't be trusted
+		mc.blocks.invalidate(metachunk)
+		return nil, 0, owner, err
+	}
+	mc.blocks.put(metachunk, data, version)
+	return data, version, apis.NoRedirect, nil
+}
+
+// Whether a failed write only lost a race with another write to the same block, so that it's worth reading the block
+// again and retrying. Anything else, including the block being held by another server, is final. This goes by the
+// error code, because the version returned alongside the error could be zero either way.
+func isVersionMismatch(err error) bool {
+	return apis.ErrorCodeOf(err) == apis.ErrWrongVersion
+}
+
+// Performs a write through the leasing layer, making sure that the block cache does not keep serving the old contents,
+// whether the write went through or failed, such as on a version mismatch, which means our copy was out of date.
+func (mc *metadatacache) writeBlock(metachunk apis.MetadataID, version apis.Version, offset uint32, data []byte) (apis.Version, apis.ServerName, error) {
+	nver, owner, err := mc.leasing.Write(metachunk, version, offset, data)
+	mc.blocks.invalidate(metachunk)
+	return nver, owner, err
+}
+
+// Reads the metadata entry of a particular chunk, at the requested level of consistency.
 // Return the entry and if another server holds the block containing that entry, that server's name
-func (mc *metadatacache) ReadEntry(chunk apis.ChunkNum) (apis.MetadataEntry, apis.ServerName, error) {
+func (mc *metadatacache) ReadEntry(chunk apis.ChunkNum, consistency apis.Consistency) (apis.MetadataEntry, apis.ServerName, error) {
 	metachunk, offset := ChunkToBlockAndOffset(chunk)
-	data, _, owner, err := mc.leasing.Read(metachunk)
+	data, _, owner, err := mc.readBlock(metachunk, consistency)
 	if err != nil {
 		return apis.MetadataEntry{}, owner, err
 	}
+	raw, err := entryInBlock(data, offset)
+	if err != nil {
+		return apis.MetadataEntry{}, apis.NoRedirect, err
+	}
 
 	found := getBitsetInData(data, ChunkToEntryNumber(chunk))
+	if !found && mc.options.RepairOnRead && isRestorableEntry(raw) {
+		if _, err := mc.repairBit(chunk); err != nil {
+			return apis.MetadataEntry{}, apis.NoRedirect, fmt.Errorf("[metadata.go/RPB] %v", err)
+		}
+		// whether or not the repair was needed by the time it happened, go by the block's latest contents
+		data, _, owner, err = mc.readBlock(metachunk, apis.Fresh)
+		if err != nil {
+			return apis.MetadataEntry{}, owner, err
+		}
+		if raw, err = entryInBlock(data, offset); err != nil {
+			return apis.MetadataEntry{}, apis.NoRedirect, err
+		}
+		found = getBitsetInData(data, ChunkToEntryNumber(chunk))
+	}
 	if !found {
 		return apis.MetadataEntry{}, apis.NoRedirect, fmt.Errorf("entry doesn't exist to be able to be read: %d", chunk)
 	}
 
-	entry, err := deserializeEntry(data[offset : offset+apis.EntrySize])
+	entry, err := deserializeEntry(raw)
 	if err != nil {
 		return apis.MetadataEntry{}, apis.NoRedirect, err
 	}
@@ -54,27 +167,91 @@ func (mc *metadatacache) ReadEntry(chunk apis.ChunkNum) (apis.MetadataEntry, api
 	return entry, apis.NoRedirect, nil
 }
 
+// Checks whether a chunk has an entry, at the requested level of consistency, without decoding the entry itself: only
+// the block's allocation bitset is looked at, so this is cheaper than ReadEntry for callers that don't need the
+// contents, and works even if the entry couldn't be decoded. Unlike ReadEntry, a missing entry is not an error. Like
+// ReadEntry, a restorable entry whose bit is missing is repaired first if RepairOnRead is set, so that both agree on
+// whether the entry exists.
+// If another server holds the block containing that entry, returns that server's name
+func (mc *metadatacache) EntryExists(chunk apis.ChunkNum, consistency apis.Consistency) (bool, apis.ServerName, error) {
+	metachunk, offset := ChunkToBlockAndOffset(chunk)
+	data, _, owner, err := mc.readBlock(metachunk, consistency)
+	if err != nil {
+		return false, owner, fmt.Errorf("[metadata.go/EXR] %v", err)
+	}
+	bitset, err := bitsetInBlock(data)
+	if err != nil {
+		return false, apis.NoRedirect, err
+	}
+	found := getBitsetInData(bitset, ChunkToEntryNumber(chunk))
+	if !found && mc.options.RepairOnRead {
+		raw, err := entryInBlock(data, offset)
+		if err != nil {
+			return false, apis.NoRedirect, err
+		}
+		if !isRestorableEntry(raw) {
+			return false, apis.NoRedirect, nil
+		}
+		if _, err := mc.repairBit(chunk); err != nil {
+			return false, apis.NoRedirect, fmt.Errorf("[metadata.go/EXP] %v", err)
+		}
+		// whether or not the repair was needed by the time it happened, go by the block's latest contents
+		data, _, owner, err = mc.readBlock(metachunk, apis.Fresh)
+		if err != nil {
+			return false, owner, fmt.Errorf("[metadata.go/EXR] %v", err)
+		}
+		if bitset, err = bitsetInBlock(data); err != nil {
+			return false, apis.NoRedirect, err
+		}
+		found = getBitsetInData(bitset, ChunkToEntryNumber(chunk))
+	}
+	return found, apis.NoRedirect, nil
+}
+
 // Update the metadata entry of a particular chunk.
 // If another server holds the block containing that entry, returns that server's name
 func (mc *metadatacache) UpdateEntry(chunk apis.ChunkNum, previous apis.MetadataEntry, newEntry apis.MetadataEntry) (apis.ServerName, error) {
+	return mc.UpdateEntryWithContext(context.Background(), chunk, previous, newEntry)
+}
+
+// Like UpdateEntry, but gives up once ctx is done, even if that happens partway through retrying after version
+// mismatches, and attributes the update to the caller attached to ctx. In that case, returns ctx.Err() unwrapped, so
+// that callers can compare it against context.DeadlineExceeded. The configured UpdateBudget still applies, so that
+// an update made over RPC can't go on for longer than it allows either.
+func (mc *metadatacache) UpdateEntryWithContext(ctx context.Context, chunk apis.ChunkNum, previous apis.MetadataEntry, newEntry apis.MetadataEntry) (apis.ServerName, error) {
+	if mc.options.UpdateBudget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, mc.options.UpdateBudget)
+		defer cancel()
+	}
 	metachunk, offset := ChunkToBlockAndOffset(chunk)
 
 	for {
+		if err := ctx.Err(); err != nil {
+			return apis.NoRedirect, err
+		}
+
 		data, version, owner, err := mc.leasing.Read(metachunk)
 		if err != nil {
 			return owner, fmt.Errorf("[metadata.go/MLR] %v", err)
 		}
 
+		raw, err := entryInBlock(data, offset)
+		if err != nil {
+			return apis.NoRedirect, err
+		}
 		found := getBitsetInData(data, ChunkToEntryNumber(chunk))
 		if !found {
 			return apis.NoRedirect, errors.New("entry doesn't exist to be able to be updated")
 		}
 
-		entry, err := deserializeEntry(data[offset : offset+apis.EntrySize])
+		entry, err := deserializeEntry(raw)
 		if err != nil {
 			return apis.NoRedirect, fmt.Errorf("[metadata.go/DSE] %v", err)
 		}
 		if !entry.Equals(previous) {
+			// the caller probably got previous from a cached read, so don't let anyone else be misled by the same copy
+			mc.blocks.invalidate(metachunk)
 			return apis.NoRedirect, errors.New("entry does not match previous expected entry")
 		}
 
@@ -86,53 +263,144 @@ func (mc *metadatacache) UpdateEntry(chunk apis.ChunkNum, previous apis.Metadata
 			panic("postcondition on serializeEntry failed")
 		}
 
-		_, owner, err = mc.leasing.Write(metachunk, version, offset, updated)
+		_, owner, err = mc.writeBlock(metachunk, version, offset, updated)
 		if err == nil {
 			// success!
+			mc.audit.record(ctx, chunk, AuditUpdate, summarizeEntry(entry), summarizeEntry(newEntry))
 			return apis.NoRedirect, nil
-		} else if version == 0 {
+		} else if !isVersionMismatch(err) {
 			return owner, fmt.Errorf("[metadata.go/MLW] %v", err)
 		}
 		// version mismatch; go around again and re-attempt changes
 	}
 }
 
+// Replace the replica list of a chunk's entry in a single write, as long as the entry still matches expected.
+// Concurrent writes to other entries in the same block are retried around; a concurrent change to this entry fails
+// the swap rather than being overwritten.
+// If another server holds the block containing that entry, returns that server's name
+func (mc *metadatacache) SwapReplicas(chunk apis.ChunkNum, expected apis.MetadataEntry, newReplicas []apis.ServerID) (apis.ServerName, error) {
+	return mc.SwapReplicasWithContext(context.Background(), chunk, expected, newReplicas)
+}
+
+// Like SwapReplicas, but gives up once ctx is done, and attributes the swap to the caller attached to ctx.
+func (mc *metadatacache) SwapReplicasWithContext(ctx context.Context, chunk apis.ChunkNum, expected apis.MetadataEntry, newReplicas []apis.ServerID) (apis.ServerName, error) {
+	metachunk, offset := ChunkToBlockAndOffset(chunk)
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return apis.NoRedirect, err
+		}
+
+		data, version, owner, err := mc.leasing.Read(metachunk)
+		if err != nil {
+			return owner, fmt.Errorf("[metadata.go/SLR] %v", err)
+		}
+
+		raw, err := entryInBlock(data, offset)
+		if err != nil {
+			return apis.NoRedirect, err
+		}
+		found := getBitsetInData(data, ChunkToEntryNumber(chunk))
+		if !found {
+			return apis.NoRedirect, errors.New("entry doesn't exist to be able to swap replicas")
+		}
+
+		entry, err := deserializeEntry(raw)
+		if err != nil {
+			return apis.NoRedirect, fmt.Errorf("[metadata.go/SDE] %v", err)
+		}
+		if !entry.Equals(expected) {
+			mc.blocks.invalidate(metachunk)
+			return apis.NoRedirect, errors.New("entry does not match expected entry; replicas not swapped")
+		}
+
+		swapped := entry
+		swapped.Replicas = newReplicas
+		updated, err := serializeEntry(swapped)
+		if err != nil {
+			return apis.NoRedirect, fmt.Errorf("[metadata.go/SSE] %v", err)
+		}
+
+		_, owner, err = mc.writeBlock(metachunk, version, offset, updated)
+		if err == nil {
+			mc.audit.record(ctx, chunk, AuditSwap, summarizeEntry(entry), summarizeEntry(swapped))
+			return apis.NoRedirect, nil
+		} else if !isVersionMismatch(err) {
+			return owner, fmt.Errorf("[metadata.go/SLW] %v", err)
+		}
+		// version mismatch; check again whether the entry itself changed before retrying
+	}
+}
+
 // Delete a metadata entry and allow the garbage collection of the underlying chunks
 // If another server holds the block containing that entry, returns that server's name
 func (mc *metadatacache) DeleteEntry(chunk apis.ChunkNum, previous apis.MetadataEntry) (apis.ServerName, error) {
+	return mc.DeleteEntryWithContext(context.Background(), chunk, previous)
+}
+
+// Like DeleteEntry, but gives up once ctx is done, and attributes the deletion to the caller attached to ctx.
+func (mc *metadatacache) DeleteEntryWithContext(ctx context.Context, chunk apis.ChunkNum, previous apis.MetadataEntry) (apis.ServerName, error) {
 	metachunk, offset := ChunkToBlockAndOffset(chunk)
 
+	var entry apis.MetadataEntry
 	for {
+		if err := ctx.Err(); err != nil {
+			return apis.NoRedirect, err
+		}
+
 		data, version, owner, err := mc.leasing.Read(metachunk)
 		if err != nil {
 			return owner, err
 		}
 
+		raw, err := entryInBlock(data, offset)
+		if err != nil {
+			return apis.NoRedirect, err
+		}
 		found := getBitsetInData(data, ChunkToEntryNumber(chunk))
 		if !found {
 			return apis.NoRedirect, errors.New("entry doesn't exist to be able to be deleted")
 		}
 
-		entry, err := deserializeEntry(data[offset : offset+apis.EntrySize])
+		entry, err = deserializeEntry(raw)
 		if err != nil {
 			return apis.NoRedirect, err
 		}
 		if !entry.Equals(previous) {
+			// the caller probably got previous from a cached read, so don't let anyone else be misled by the same copy
+			mc.blocks.invalidate(metachunk)
 			return apis.NoRedirect, errors.New("entry does not match previous expected entry")
 		}
 
-		updateOffset, newData := updateBitsetInData(data, ChunkToEntryNumber(chunk), false)
-
-		_, owner, err = mc.leasing.Write(metachunk, version, updateOffset, newData)
+		// clear out the entry before releasing it, so that what's left behind can't be mistaken for an entry whose
+		// allocation bit was lost
+		_, owner, err = mc.writeBlock(metachunk, version, offset, make([]byte, apis.EntrySize))
 		if err == nil {
-			return apis.NoRedirect, nil
-		} else if version == 0 {
+			break
+		} else if !isVersionMismatch(err) {
 			return owner, err
 		}
 		// version mismatch; go around again and re-attempt changes
 	}
+
+	if _, err := mc.updateBitset(metachunk, ChunkToEntryNumber(chunk), false); err != nil {
+		return apis.NoRedirect, err
+	}
+	mc.audit.record(ctx, chunk, AuditDelete, summarizeEntry(entry), "")
+	return apis.NoRedirect, nil
 }
 
+// The layout of an encoded entry: two versions, then the replica count, then the replicas, four bytes each. The marker
+// sits in what was once padding after the replica count. Entries written before it existed have zero there, and are
+// still read the same way; the marker only tells repair which entries it can trust. See isRestorableEntry.
+const (
+	entryReplicaCountOffset = 16
+	entryFormatOffset       = 17
+	entryReplicasOffset     = 20
+	entryFormatMarker       = 0xE1
+)
+
 // Deserialize a metadate entry using gob
 func deserializeEntry(data []byte) (apis.MetadataEntry, error) {
 	if len(util.StripTrailingZeroes(data)) == 0 {
@@ -143,9 +411,9 @@ func deserializeEntry(data []byte) (apis.MetadataEntry, error) {
 	var entry apis.MetadataEntry
 	entry.MostRecentVersion = apis.Version(binary.LittleEndian.Uint64(data))
 	entry.LastConsumedVersion = apis.Version(binary.LittleEndian.Uint64(data[8:]))
-	entry.Replicas = make([]apis.ServerID, data[16])
+	entry.Replicas = make([]apis.ServerID, data[entryReplicaCountOffset])
 	for i := 0; i < len(entry.Replicas); i++ {
-		entry.Replicas[i] = apis.ServerID(binary.LittleEndian.Uint32(data[20+4*i:]))
+		entry.Replicas[i] = apis.ServerID(binary.LittleEndian.Uint32(data[entryReplicasOffset+4*i:]))
 	}
 
 	return entry, nil
@@ -153,16 +421,21 @@ func deserializeEntry(data []byte) (apis.MetadataEntry, error) {
 
 // Serialize a metadata entry using gob
 // Caps to a size that should be large enough, unless a ton of replicas are included
+// An empty entry is left as all zeroes, just like one that has been allocated but never written.
 func serializeEntry(entry apis.MetadataEntry) ([]byte, error) {
 	data := make([]byte, apis.EntrySize)
+	if entry.Equals(apis.MetadataEntry{}) {
+		return data, nil
+	}
 	binary.LittleEndian.PutUint64(data, uint64(entry.MostRecentVersion))
 	binary.LittleEndian.PutUint64(data[8:], uint64(entry.LastConsumedVersion))
-	if len(entry.Replicas) >= 256 || len(entry.Replicas) > (apis.EntrySize-20)/4 {
+	if len(entry.Replicas) >= 256 || len(entry.Replicas) > (apis.EntrySize-entryReplicasOffset)/4 {
 		return nil, fmt.Errorf("too many replicas: %d", len(entry.Replicas))
 	}
-	data[16] = uint8(len(entry.Replicas))
+	data[entryReplicaCountOffset] = uint8(len(entry.Replicas))
+	data[entryFormatOffset] = entryFormatMarker
 	for i := 0; i < len(entry.Replicas); i++ {
-		binary.LittleEndian.PutUint32(data[20+4*i:], uint32(entry.Replicas[i]))
+		binary.LittleEndian.PutUint32(data[entryReplicasOffset+4*i:], uint32(entry.Replicas[i]))
 	}
 
 	return data, nil
@@ -170,14 +443,24 @@ func serializeEntry(entry apis.MetadataEntry) ([]byte, error) {
 
 // Compute the metadata block, and offset within the block, that a certain chunk belongs to
 func ChunkToBlockAndOffset(chunk apis.ChunkNum) (apis.MetadataID, uint32) {
-	return ChunkToBlockID(chunk), EntryNumberToOffset(ChunkToEntryNumber(chunk))
+	return BlockForChunk(chunk), OffsetForChunk(chunk)
 }
 
-// Compute which metadata block the chunk belongs to
-func ChunkToBlockID(chunk apis.ChunkNum) apis.MetadataID {
+// Compute which metadata block holds the entry for a chunk, and therefore which metadata lease governs it. This is
+// the inverse of EntryAndBlockToChunkNum: each block holds the entries for 2^EntriesPerBlock consecutive chunk numbers,
+// so the block is just the chunk number with the index bits shifted off. Chunk numbers below 2^EntriesPerBlock map to
+// block 0, which doesn't exist, so no valid chunk has one.
+func BlockForChunk(chunk apis.ChunkNum) apis.MetadataID {
 	return apis.MetadataID(chunk >> apis.EntriesPerBlock)
 }
 
+// Compute the offset in bytes of a chunk's entry within its metadata block, as returned by BlockForChunk. Entries come
+// after the block's allocation bitset, so the offset is always at least BitsetSize, and the whole entry always fits
+// within the block.
+func OffsetForChunk(chunk apis.ChunkNum) uint32 {
+	return EntryNumberToOffset(ChunkToEntryNumber(chunk))
+}
+
 // Compute the index within its metadata block where a chunk should be able to be found
 func ChunkToEntryNumber(chunk apis.ChunkNum) uint32 {
 	// Extract just the lower bits
@@ -189,6 +472,26 @@ func EntryNumberToOffset(entryN uint32) uint32 {
 	return uint32(entryN)*apis.EntrySize + apis.BitsetSize
 }
 
+// Slices out the allocation bitset at the start of a metadata block. Fails with ErrBlockGeometry, rather than panicking,
+// if the block is too small to hold it.
+func bitsetInBlock(data []byte) ([]byte, error) {
+	if len(data) < apis.BitsetSize {
+		return nil, apis.NewError(apis.ErrBlockGeometry, 0, "metadata block of %d bytes cannot hold a bitset of %d bytes",
+			len(data), apis.BitsetSize)
+	}
+	return data[0:apis.BitsetSize], nil
+}
+
+// Slices out the entry at an offset within a metadata block, as computed by EntryNumberToOffset. Fails with
+// ErrBlockGeometry, rather than panicking, if the block is too small to hold the entry.
+func entryInBlock(data []byte, offset uint32) ([]byte, error) {
+	if offset < apis.BitsetSize || uint64(offset)+apis.EntrySize > uint64(len(data)) {
+		return nil, apis.NewError(apis.ErrBlockGeometry, 0, "metadata block of %d bytes cannot hold an entry at offset %d",
+			len(data), offset)
+	}
+	return data[offset : offset+apis.EntrySize], nil
+}
+
 func EntryAndBlockToChunkNum(metachunk apis.MetadataID, index uint32) apis.ChunkNum {
 	if metachunk == 0 || index >= (1<<apis.EntriesPerBlock) {
 		panic("broken invariant for chunk location")
@@ -198,8 +501,16 @@ func EntryAndBlockToChunkNum(metachunk apis.MetadataID, index uint32) apis.Chunk
 
 // Allocate a new metadata entry and corresponding chunk number
 func (mc *metadatacache) NewEntry() (apis.ChunkNum, error) {
+	return mc.NewEntryWithContext(context.Background())
+}
+
+// Like NewEntry, but gives up once ctx is done, and attributes the new entry to the caller attached to ctx.
+func (mc *metadatacache) NewEntryWithContext(ctx context.Context) (apis.ChunkNum, error) {
 	for {
-		metachunk, index, err := mc.findAnyFreeChunk()
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		metachunk, index, err := mc.nextAllocation()
 		if err != nil {
 			return 0, fmt.Errorf("[metadata.go/FFC] %v", err)
 		}
@@ -218,10 +529,11 @@ func (mc *metadatacache) NewEntry() (apis.ChunkNum, error) {
 					// TODO: what now? how do we recover this storage space?
 					return 0, fmt.Errorf("[metadata.go/MLR] %v", err)
 				}
-				nver, _, err := mc.leasing.Write(metachunk, version, EntryNumberToOffset(index), make([]byte, apis.EntrySize))
+				_, _, err = mc.writeBlock(metachunk, version, EntryNumberToOffset(index), make([]byte, apis.EntrySize))
 				if err == nil {
+					mc.audit.record(ctx, chunk, AuditNew, "", summarizeEntry(apis.MetadataEntry{}))
 					return chunk, nil
-				} else if nver == 0 {
+				} else if !isVersionMismatch(err) {
 					// TODO: what now? how do we recover this storage space?
 					return 0, fmt.Errorf("[metadata.go/MLW] %v", err)
 				}
@@ -238,8 +550,12 @@ func (mc *metadatacache) getBitset(metachunk apis.MetadataID, index uint32) (boo
 	if err != nil {
 		return false, err
 	}
+	bitset, err := bitsetInBlock(data)
+	if err != nil {
+		return false, err
+	}
 
-	return getBitsetInData(data[0:apis.BitsetSize], index), nil
+	return getBitsetInData(bitset, index), nil
 }
 
 // Checks whether a chunk has been allocated or not in a bitset.
@@ -270,20 +586,23 @@ func (mc *metadatacache) updateBitset(metachunk apis.MetadataID, index uint32, v
 			return false, err
 		}
 
-		bitset := data[0:apis.BitsetSize]
+		bitset, err := bitsetInBlock(data)
+		if err != nil {
+			return false, err
+		}
 
-		existingValue := getBitsetInData(data[0:apis.BitsetSize], index)
+		existingValue := getBitsetInData(bitset, index)
 		if existingValue == value {
 			return false, nil
 		}
 
 		offset, newData := updateBitsetInData(bitset, index, value)
 
-		retver, _, err := mc.leasing.Write(metachunk, version, offset, newData)
+		_, _, err = mc.writeBlock(metachunk, version, offset, newData)
 		if err == nil {
 			// success!
 			return true, nil
-		} else if retver == 0 {
+		} else if !isVersionMismatch(err) {
 			// actual error; not version contention
 			return false, err
 		}
@@ -326,17 +645,24 @@ func (mc *metadatacache) findAnyFreeChunk() (apis.MetadataID, uint32, error) {
 }
 
 // Tries to find a free chunk in a specific chunk. Returns (index, found, error)
+// found is false only when every entry in the block is allocated. A block that couldn't be read, or that is too small to
+// hold a bitset, is an error instead, so that callers never mistake a block they couldn't look at for a full one.
 func (mc *metadatacache) findFreeChunkIn(metachunk apis.MetadataID) (uint32, bool, error) {
 	data, _, _, err := mc.leasing.Read(metachunk)
+	if err != nil {
+		return 0, false, fmt.Errorf("[metadata.go/FMR] %v", err)
+	}
+	bitset, err := bitsetInBlock(data)
 	if err != nil {
 		return 0, false, err
 	}
 
-	cellIndex, found := findAvailableCell(data[0:apis.BitsetSize])
+	cellIndex, found := findAvailableCell(bitset)
 	if found {
 		return cellIndex, true, nil
 	}
 
+	// the block is full
 	return 0, false, nil
 }
 
@@ -369,6 +695,61 @@ func findAvailableCell(bitset []byte) (uint32, bool) {
 	return 0, false
 }
 
+// Lists every unallocated index in a particular metadata block, in ascending order.
+func (mc *metadatacache) FreeIndicesIn(block apis.MetadataID) ([]uint32, error) {
+	data, _, _, err := mc.leasing.Read(block)
+	if err != nil {
+		return nil, fmt.Errorf("[metadata.go/MLR] %v", err)
+	}
+	bitset, err := bitsetInBlock(data)
+	if err != nil {
+		return nil, err
+	}
+	return findAvailableCells(bitset), nil
+}
+
+// Reports whether every entry in a particular metadata block is allocated, by counting the allocated entries against the
+// block's capacity, for diagnostics. Fails, rather than reporting the block as full, if the block can't be read.
+func (mc *metadatacache) BlockFull(block apis.MetadataID) (bool, error) {
+	data, _, _, err := mc.leasing.Read(block)
+	if err != nil {
+		return false, fmt.Errorf("[metadata.go/BFR] %v", err)
+	}
+	bitset, err := bitsetInBlock(data)
+	if err != nil {
+		return false, err
+	}
+	return countAllocated(bitset) == 1<<apis.EntriesPerBlock, nil
+}
+
+// Counts how many entries a bitset has allocated.
+func countAllocated(bitset []byte) int {
+	count := 0
+	for _, cell := range bitset {
+		count += bits.OnesCount8(cell)
+	}
+	return count
+}
+
+// Finds every cell in a bitset that has a chunkNum available, and returns their indices in ascending order
+func findAvailableCells(bitset []byte) []uint32 {
+	var result []uint32
+	for i, cell := range bitset {
+		// skip full cells without looking at individual bits, since most cells in a busy block will be full
+		if cell == 0xFF {
+			continue
+		}
+		free := ^cell
+		for bit := uint32(0); free != 0; bit++ {
+			if free&1 != 0 {
+				result = append(result, uint32(i)*8+bit)
+			}
+			free >>= 1
+		}
+	}
+	return result
+}
+
 func findFirstZero(x byte) uint32 {
 	for i := uint32(0); i < 8; i++ {
 		if x&1 == 0 {
@@ -1,143 +1,164 @@
 package metadatacache
 
 import (
+	"errors"
 	"github.com/stretchr/testify/assert"
 	//	"math/rand"
 	"testing"
+	"time"
 	"zircon/apis"
-	"zircon/chunkserver"
 	"zircon/etcd"
+	"zircon/metadatacache/leasing"
 	"zircon/rpc"
 )
 
 func TestSingleCache(t *testing.T) {
-	// Start etcd
-	etcds, _ := etcd.PrepareSubscribeForTesting(t)
-	etcd1, _ := etcds("mc1")
-
-	conn := rpc.NewConnectionCache()
-
-	cs, _, csT := chunkserver.NewTestChunkserver(t, conn)
-	defer csT()
-
-	teardown, _, err := rpc.PublishChunkserver(cs, ":0")
-	assert.NoError(t, err)
-	defer teardown(true)
-
-	cache, err := NewCache(conn, etcd1)
-	assert.NoError(t, err)
+	// Start etcd, and a cache with chunkservers to keep its blocks on
+	etcds, teardownEtcd := etcd.PrepareSubscribeForTesting(t)
+	caches, teardown := prepareCachesWith(t, etcds, teardownEtcd, "mc1")
+	defer teardown()
+	cache := caches[0]
 
 	// Try reading an entry that doesn't exist
-	_, _, err = cache.ReadEntry(0)
+	_, _, err := cache.ReadEntry(0, apis.Fresh)
 	assert.Error(t, err)
 
 	// Now create an entry and read it unitialized
 	chunk1, err := cache.NewEntry()
 	assert.NoError(t, err)
-	_, _, err = cache.ReadEntry(chunk1)
+	entry, _, err := cache.ReadEntry(chunk1, apis.Fresh)
 	assert.NoError(t, err)
-	// assert.Equal(t, entry, defaultEntry())
+	assert.True(t, apis.MetadataEntry{}.Equals(entry))
 
 	// Create another entry and check that it comes from the same block
 	chunk2, err := cache.NewEntry()
+	assert.NoError(t, err)
 	assert.NotEqual(t, chunk1, chunk2)
-	assert.Equal(t, chunkToBlockID(chunk1), chunkToBlockID(chunk2))
+	assert.Equal(t, BlockForChunk(chunk1), BlockForChunk(chunk2))
 
 	// Update the first entry
 	entry1 := apis.MetadataEntry{
-		Version:  1,
-		Replicas: []apis.ServerID{0},
+		MostRecentVersion:   1,
+		LastConsumedVersion: 1,
+		Replicas:            []apis.ServerID{0},
 	}
 
-	_, err = cache.UpdateEntry(chunk1, entry1)
+	_, err = cache.UpdateEntry(chunk1, apis.MetadataEntry{}, entry1)
 	assert.NoError(t, err)
-	readEntry1, _, err := cache.ReadEntry(chunk1)
-	assert.Equal(t, entry1, readEntry1)
+	readEntry1, _, err := cache.ReadEntry(chunk1, apis.Fresh)
+	assert.NoError(t, err)
+	assert.True(t, entry1.Equals(readEntry1))
 
 	// Update the second entry
 	entry2 := apis.MetadataEntry{
-		Version:  2,
-		Replicas: []apis.ServerID{1},
+		MostRecentVersion:   2,
+		LastConsumedVersion: 2,
+		Replicas:            []apis.ServerID{1},
 	}
 
-	_, err = cache.UpdateEntry(chunk2, entry2)
+	_, err = cache.UpdateEntry(chunk2, apis.MetadataEntry{}, entry2)
+	assert.NoError(t, err)
+	readEntry2, _, err := cache.ReadEntry(chunk2, apis.Fresh)
 	assert.NoError(t, err)
-	readEntry2, _, err := cache.ReadEntry(chunk2)
-	assert.Equal(t, entry2, readEntry2)
+	assert.True(t, entry2.Equals(readEntry2))
+
+	// Updates fail if previousEntry doesn't match
+	_, err = cache.UpdateEntry(chunk2, entry1, entry1)
+	assert.Error(t, err)
 
 	// Delete this entry and check that it is deleted
-	_, err = cache.DeleteEntry(chunk1)
+	_, err = cache.DeleteEntry(chunk1, entry1)
 	assert.NoError(t, err)
-	_, _, err = cache.ReadEntry(chunk1)
+	_, _, err = cache.ReadEntry(chunk1, apis.Fresh)
 	assert.Error(t, err)
 
 	// Check that entry 2 still exists
-	readEntry2, _, err = cache.ReadEntry(chunk2)
-	assert.Equal(t, entry2, readEntry2)
-
-	// Clear the cache, check that entry 2 can still be read
-	// cache.reset()
-	readEntry2, _, err = cache.ReadEntry(chunk2)
-	assert.Equal(t, entry2, readEntry2)
+	readEntry2, _, err = cache.ReadEntry(chunk2, apis.Fresh)
+	assert.NoError(t, err)
+	assert.True(t, entry2.Equals(readEntry2))
 
-	// TODO Test for failure if previousEntry doesn't match
+	// Check that entry 2 can still be read from the block cache
+	readEntry2, _, err = cache.ReadEntry(chunk2, apis.Cached)
+	assert.NoError(t, err)
+	assert.True(t, entry2.Equals(readEntry2))
 }
 
 func TestMultipleClients(t *testing.T) {
 }
 
 func TestTwoCaches(t *testing.T) {
-	etcds, _ := etcd.PrepareSubscribeForTesting(t)
-	etcd1, _ := etcds("mc1")
-	etcd2, _ := etcds("mc2")
-	conn1 := rpc.NewConnectionCache()
-	conn2 := rpc.NewConnectionCache()
-
-	cache1, err := NewCache(conn1, etcd1)
-	assert.NoError(t, err)
-	cache2, err := NewCache(conn2, etcd2)
-	assert.NoError(t, err)
+	etcds, teardownEtcd := etcd.PrepareSubscribeForTesting(t)
+	caches, teardown := prepareCachesWith(t, etcds, teardownEtcd, "mc1", "mc2")
+	defer teardown()
+	cache1, cache2 := caches[0], caches[1]
 
 	chunk1, err := cache1.NewEntry()
 	assert.NoError(t, err)
 	chunk2, err := cache2.NewEntry()
 	assert.NoError(t, err)
 	assert.NotEqual(t, chunk1, chunk2)
-	assert.NotEqual(t, chunkToBlockID(chunk1), chunkToBlockID(chunk2))
+	assert.NotEqual(t, BlockForChunk(chunk1), BlockForChunk(chunk2))
 
 	// Update the first entry
 	entry1 := apis.MetadataEntry{
-		Version:  1,
-		Replicas: []apis.ServerID{0},
+		MostRecentVersion:   1,
+		LastConsumedVersion: 1,
+		Replicas:            []apis.ServerID{0},
 	}
 
-	_, err = cache1.UpdateEntry(chunk1, entry1)
+	_, err = cache1.UpdateEntry(chunk1, apis.MetadataEntry{}, entry1)
 	assert.NoError(t, err)
-	readEntry1, _, err := cache1.ReadEntry(chunk1)
-	assert.Equal(t, entry1, readEntry1)
+	readEntry1, _, err := cache1.ReadEntry(chunk1, apis.Fresh)
+	assert.NoError(t, err)
+	assert.True(t, entry1.Equals(readEntry1))
 
 	// Update the second entry
 	entry2 := apis.MetadataEntry{
-		Version:  2,
-		Replicas: []apis.ServerID{1},
+		MostRecentVersion:   2,
+		LastConsumedVersion: 2,
+		Replicas:            []apis.ServerID{1},
 	}
 
-	_, err = cache2.UpdateEntry(chunk2, entry2)
+	_, err = cache2.UpdateEntry(chunk2, apis.MetadataEntry{}, entry2)
+	assert.NoError(t, err)
+	readEntry2, _, err := cache2.ReadEntry(chunk2, apis.Fresh)
 	assert.NoError(t, err)
-	readEntry2, _, err := cache2.ReadEntry(chunk2)
-	assert.Equal(t, entry2, readEntry2)
+	assert.True(t, entry2.Equals(readEntry2))
 
 	// Cache1 reading Chunk2 should error and direct it to Cache2
-	readEntry2, _, err = cache1.ReadEntry(chunk2)
+	_, owner, err := cache1.ReadEntry(chunk2, apis.Fresh)
 	assert.Error(t, err)
-	// assert.Equal(t, owner, server2)
+	assert.Equal(t, apis.ServerName("mc2"), owner)
 
-	// Clearing the cache and waiting should free up the lease
-	// cache2.reset()
-	// wait
-	readEntry2, _, err = cache1.ReadEntry(chunk2)
+	// Once Cache2 gives up its lease, Cache1 can take over the block, entry and all
+	assert.NoError(t, cache2.(*metadatacache).leasing.(*leasing.Leasing).ReleaseLease(BlockForChunk(chunk2)))
+	readEntry2, owner, err = cache1.ReadEntry(chunk2, apis.Fresh)
 	assert.NoError(t, err)
-	assert.Equal(t, entry2, readEntry2)
+	assert.Equal(t, apis.NoRedirect, owner)
+	assert.True(t, entry2.Equals(readEntry2))
+}
+
+// An etcd that never answers when asked for a metadata lease, until it's released.
+type unreachableEtcd struct {
+	apis.EtcdInterface
+	release chan struct{}
+}
+
+func (e unreachableEtcd) BeginMetadataLease() error {
+	<-e.release
+	return errors.New("etcd unreachable")
+}
+
+func TestNewCacheUnreachableEtcd(t *testing.T) {
+	stub := unreachableEtcd{release: make(chan struct{})}
+	defer close(stub.release)
+	conn := rpc.NewConnectionCache()
+	defer conn.CloseAll()
+
+	start := time.Now()
+	_, err := NewCacheWithOptions(conn, stub, Options{StartTimeout: 50 * time.Millisecond})
+	assert.Equal(t, apis.ErrUnreachable, apis.ErrorCodeOf(err))
+	assert.True(t, time.Since(start) < time.Second)
 }
 
 /*
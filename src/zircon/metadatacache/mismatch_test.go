@@ -0,0 +1,82 @@
+package metadatacache
+
+import (
+	"errors"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+)
+
+// A leasing layer whose first read reports an out-of-date version, as if another write had landed in between, so that
+// the first write is rejected as a mismatch.
+type staleLeaser struct {
+	*fakeLeaser
+	stale bool
+}
+
+func (s *staleLeaser) Read(metachunk apis.MetadataID) ([]byte, apis.Version, apis.ServerName, error) {
+	data, version, owner, err := s.fakeLeaser.Read(metachunk)
+	if !s.stale {
+		s.stale = true
+		version += 5
+	}
+	return data, version, owner, err
+}
+
+// A leasing layer where another server holds the block, so every write is redirected.
+type redirectingLeaser struct {
+	*fakeLeaser
+	writes int
+}
+
+func (r *redirectingLeaser) Write(metachunk apis.MetadataID, version apis.Version, offset uint32, data []byte) (apis.Version, apis.ServerName, error) {
+	r.writes += 1
+	return r.version, "mc1", errors.New("owned by someone else: mc1")
+}
+
+func TestUpdateEntryAtVersionZero(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	// a block that has never been written through the leasing layer is at version zero
+	mc, fake := newFakeCache(t)
+	chunk := EntryAndBlockToChunkNum(1, 7)
+	original := apis.MetadataEntry{MostRecentVersion: 3, LastConsumedVersion: 4, Replicas: []apis.ServerID{1, 2}}
+	fake.overwrite(chunk, original)
+	fake.version = 0
+
+	// the write against the stale version is turned down with the block's real version, zero, which must be taken as a
+	// reason to try again rather than as a failure
+	mc.leasing = &staleLeaser{fakeLeaser: fake}
+	updated := apis.MetadataEntry{MostRecentVersion: 5, LastConsumedVersion: 5, Replicas: []apis.ServerID{1, 2}}
+	owner, err := mc.UpdateEntry(chunk, original, updated)
+	require.NoError(t, err)
+	assert.Equal(apis.ServerName(apis.NoRedirect), owner)
+	assert.Equal(apis.Version(1), fake.version)
+
+	entry, _, err := mc.ReadEntry(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.True(updated.Equals(entry))
+}
+
+func TestRedirectedWriteNotRetried(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+	chunk := EntryAndBlockToChunkNum(1, 7)
+	original := apis.MetadataEntry{MostRecentVersion: 3, LastConsumedVersion: 4, Replicas: []apis.ServerID{1, 2}}
+	fake.overwrite(chunk, original)
+
+	// the failed write comes back with a nonzero version, which doesn't make it a mismatch
+	redirecting := &redirectingLeaser{fakeLeaser: fake}
+	mc.leasing = redirecting
+	owner, err := mc.UpdateEntry(chunk, original, apis.MetadataEntry{MostRecentVersion: 5})
+	assert.Error(err)
+	assert.Equal(apis.ServerName("mc1"), owner)
+	assert.Equal(1, redirecting.writes)
+
+	owner, err = mc.DeleteEntry(chunk, original)
+	assert.Error(err)
+	assert.Equal(apis.ServerName("mc1"), owner)
+	assert.Equal(2, redirecting.writes)
+}
@@ -0,0 +1,38 @@
+package metadatacache
+
+import (
+	"context"
+	"fmt"
+)
+
+// Prewarm gives up once it has leased this many blocks for every block it was asked for, in case every unleased block
+// it comes across is already full.
+const prewarmAttemptsPerBlock = 2
+
+// Leases up to n more metadata blocks that have free entries, so that the NewEntry calls that follow find room in blocks
+// this server already holds, rather than waiting to acquire a lease first. Returns how many such blocks were leased.
+func (mc *metadatacache) Prewarm(n int) (int, error) {
+	return mc.PrewarmWithContext(context.Background(), n)
+}
+
+// Like Prewarm, but stops early with the context's error once ctx is done. Blocks leased before then stay leased.
+func (mc *metadatacache) PrewarmWithContext(ctx context.Context, n int) (int, error) {
+	leased := 0
+	for attempt := 0; leased < n && attempt < n*prewarmAttemptsPerBlock; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return leased, err
+		}
+		metachunk, err := mc.leasing.GetOrCreateAnyUnleased()
+		if err != nil {
+			return leased, fmt.Errorf("[prewarm.go/GCU] %v", err)
+		}
+		_, found, err := mc.findFreeChunkIn(metachunk)
+		if err != nil {
+			return leased, fmt.Errorf("[prewarm.go/FCI] %v", err)
+		}
+		if found {
+			leased += 1
+		}
+	}
+	return leased, nil
+}
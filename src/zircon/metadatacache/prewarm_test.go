@@ -0,0 +1,128 @@
+package metadatacache
+
+import (
+	"context"
+	"errors"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"testing"
+	"zircon/apis"
+)
+
+// A leasing layer with any number of blocks, which hands out new blocks with only a few free entries, so that tests can
+// run out of room quickly.
+type multiBlockLeaser struct {
+	blocks       map[apis.MetadataID][]byte
+	versions     map[apis.MetadataID]apis.Version
+	leased       []apis.MetadataID
+	freeEntries  uint32
+	acquisitions int
+}
+
+func newMultiBlockLeaser(freeEntries uint32) *multiBlockLeaser {
+	return &multiBlockLeaser{
+		blocks:      map[apis.MetadataID][]byte{},
+		versions:    map[apis.MetadataID]apis.Version{},
+		freeEntries: freeEntries,
+	}
+}
+
+func (m *multiBlockLeaser) Read(metachunk apis.MetadataID) ([]byte, apis.Version, apis.ServerName, error) {
+	data, found := m.blocks[metachunk]
+	if !found {
+		return nil, 0, apis.NoRedirect, errors.New("no such block")
+	}
+	return data, m.versions[metachunk], apis.NoRedirect, nil
+}
+
+func (m *multiBlockLeaser) Write(metachunk apis.MetadataID, version apis.Version, offset uint32, data []byte) (apis.Version, apis.ServerName, error) {
+	if version != m.versions[metachunk] {
+		return m.versions[metachunk], apis.NoRedirect, apis.NewError(apis.ErrWrongVersion, m.versions[metachunk], "version mismatch")
+	}
+	copy(m.blocks[metachunk][offset:], data)
+	m.versions[metachunk] += 1
+	return m.versions[metachunk], apis.NoRedirect, nil
+}
+
+func (m *multiBlockLeaser) ListLeases() ([]apis.MetadataID, error) {
+	return m.leased, nil
+}
+
+func (m *multiBlockLeaser) ListAllBlocks() ([]apis.MetadataID, error) {
+	var blocks []apis.MetadataID
+	for block := range m.blocks {
+		blocks = append(blocks, block)
+	}
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i] < blocks[j]
+	})
+	return blocks, nil
+}
+
+func (m *multiBlockLeaser) GetOrCreateAnyUnleased() (apis.MetadataID, error) {
+	m.acquisitions += 1
+	block := apis.MetadataID(len(m.blocks) + 1)
+	data := make([]byte, apis.BitsetSize+apis.EntrySize*(1<<apis.EntriesPerBlock))
+	for index := uint32(0); index < 1<<apis.EntriesPerBlock-m.freeEntries; index++ {
+		_, updated := updateBitsetInData(data, index, true)
+		data[index/8] = updated[0]
+	}
+	m.blocks[block] = data
+	m.versions[block] = 1
+	m.leased = append(m.leased, block)
+	return block, nil
+}
+
+func TestPrewarm(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	leaser := newMultiBlockLeaser(3)
+	mc := &metadatacache{
+		leasing: leaser,
+		blocks:  newBlockCache(),
+	}
+
+	leased, err := mc.Prewarm(2)
+	require.NoError(t, err)
+	assert.Equal(2, leased)
+	assert.Equal(2, leaser.acquisitions)
+
+	// the prewarmed blocks have room for six entries, which need no more leases
+	for i := 0; i < 6; i++ {
+		chunk, err := mc.NewEntry()
+		assert.NoError(err)
+		assert.True(BlockForChunk(chunk) == 1 || BlockForChunk(chunk) == 2)
+	}
+	assert.Equal(2, leaser.acquisitions)
+
+	// but once they're full, the next allocation has to lease another
+	chunk, err := mc.NewEntry()
+	assert.NoError(err)
+	assert.Equal(apis.MetadataID(3), BlockForChunk(chunk))
+	assert.Equal(3, leaser.acquisitions)
+}
+
+func TestPrewarmBounded(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	// blocks that are already full are no use, and prewarming gives up rather than leasing blocks forever
+	leaser := newMultiBlockLeaser(0)
+	mc := &metadatacache{
+		leasing: leaser,
+		blocks:  newBlockCache(),
+	}
+	leased, err := mc.Prewarm(3)
+	assert.NoError(err)
+	assert.Equal(0, leased)
+	assert.Equal(3*prewarmAttemptsPerBlock, leaser.acquisitions)
+
+	// and a cancelled prewarm leases nothing more
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	leaser.freeEntries = 3
+	leased, err = mc.PrewarmWithContext(ctx, 3)
+	assert.Equal(context.Canceled, err)
+	assert.Equal(0, leased)
+	assert.Equal(3*prewarmAttemptsPerBlock, leaser.acquisitions)
+}
@@ -0,0 +1,29 @@
+package metadatacache
+
+import (
+	"errors"
+	"fmt"
+	"zircon/metadatacache/leasing"
+)
+
+// Implemented by leasing agents that can report on their health.
+type statusReporter interface {
+	Status() leasing.LeaseAgentStatus
+}
+
+// Reports whether this cache can serve requests, which depends on its leasing agent keeping its leases renewed. Served
+// at /readyz by rpc.PublishMetadataCache.
+func (mc *metadatacache) Ready() error {
+	reporter, ok := mc.leasing.(statusReporter)
+	if !ok {
+		return nil
+	}
+	status := reporter.Status()
+	if status.LastError != nil {
+		return fmt.Errorf("leasing agent could not renew its claims: %v", status.LastError)
+	}
+	if !status.Started {
+		return errors.New("leasing agent is not running")
+	}
+	return nil
+}
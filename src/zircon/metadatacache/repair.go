@@ -0,0 +1,228 @@
+package metadatacache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"zircon/apis"
+	"zircon/util"
+)
+
+// Checks whether the bytes of an entry could have been produced by serializeEntry for a real entry, either as it is now
+// or before it started marking entries. An empty entry doesn't count, because that is also what unallocated space looks
+// like.
+func isWellFormedEntry(data []byte) bool {
+	if len(util.StripTrailingZeroes(data)) == 0 {
+		return false
+	}
+	if data[entryFormatOffset] != 0 && data[entryFormatOffset] != entryFormatMarker {
+		return false
+	}
+	replicas := int(data[entryReplicaCountOffset])
+	if entryReplicasOffset+4*replicas > apis.EntrySize {
+		return false
+	}
+	// serializeEntry leaves the rest of the padding after the replica count, and everything after the replicas, zeroed
+	for _, b := range data[entryFormatOffset+1 : entryReplicasOffset] {
+		if b != 0 {
+			return false
+		}
+	}
+	return len(util.StripTrailingZeroes(data[entryReplicasOffset+4*replicas:])) == 0
+}
+
+// Checks whether an entry that isn't marked as allocated can safely be marked as allocated again: it must be
+// well-formed, and carry the marker that serializeEntry now writes. An entry deleted before the marker existed was left
+// behind in full, so unmarked entries are never restored, lest they be brought back to life.
+func isRestorableEntry(data []byte) bool {
+	return isWellFormedEntry(data) && data[entryFormatOffset] == entryFormatMarker
+}
+
+// Sets the allocation bit of a chunk whose entry is restorable but not marked as allocated. The check and the update
+// are made against the same version of the block, so that the bit is never set for an entry that changed in between.
+// Like any other write, this only succeeds if we hold the lease on the block. Returns whether the bit was set.
+func (mc *metadatacache) repairBit(chunk apis.ChunkNum) (bool, error) {
+	metachunk, offset := ChunkToBlockAndOffset(chunk)
+	index := ChunkToEntryNumber(chunk)
+	for {
+		data, version, owner, err := mc.leasing.Read(metachunk)
+		if err != nil {
+			if owner != apis.NoRedirect {
+				return false, fmt.Errorf("metadata block %d is leased by %s: %v", metachunk, owner, err)
+			}
+			return false, err
+		}
+		raw, err := entryInBlock(data, offset)
+		if err != nil {
+			return false, err
+		}
+		if getBitsetInData(data, index) || !isRestorableEntry(raw) {
+			return false, nil
+		}
+		bitOffset, newData := updateBitsetInData(data, index, true)
+		_, _, err = mc.writeBlock(metachunk, version, bitOffset, newData)
+		if err == nil {
+			log.Printf("repaired missing allocation bit for metadata entry %d", chunk)
+			mc.auditRestored(chunk, raw)
+			return true, nil
+		} else if !isVersionMismatch(err) {
+			return false, err
+		}
+		// version mismatch; go around again
+	}
+}
+
+// Records that the entry with the given contents was marked as allocated again by a repair.
+func (mc *metadatacache) auditRestored(chunk apis.ChunkNum, raw []byte) {
+	entry, err := deserializeEntry(raw)
+	if err != nil {
+		// only restorable entries are ever restored, so this can't happen
+		panic(fmt.Sprintf("restored metadata entry %d cannot be decoded: %v", chunk, err))
+	}
+	mc.audit.record(context.Background(), chunk, AuditRepair, "", summarizeEntry(entry))
+}
+
+// Finds every entry in a metadata block that is restorable but not marked as allocated, and marks it as allocated.
+// Returns the number of entries repaired.
+func (mc *metadatacache) RepairBitsetIn(block apis.MetadataID) (int, error) {
+	if block == 0 {
+		return 0, errors.New("[repair.go/BLK] metadata block zero is never used")
+	}
+	data, _, _, err := mc.leasing.Read(block)
+	if err != nil {
+		return 0, fmt.Errorf("[repair.go/MLR] %v", err)
+	}
+	bitset, err := bitsetInBlock(data)
+	if err != nil {
+		return 0, err
+	}
+	repaired := 0
+	for _, index := range findAvailableCells(bitset) {
+		raw, err := entryInBlock(data, EntryNumberToOffset(index))
+		if err != nil {
+			return repaired, err
+		}
+		if !isRestorableEntry(raw) {
+			continue
+		}
+		fixed, err := mc.repairBit(EntryAndBlockToChunkNum(block, index))
+		if err != nil {
+			return repaired, fmt.Errorf("[repair.go/RPB] %v", err)
+		}
+		if fixed {
+			repaired += 1
+		}
+	}
+	return repaired, nil
+}
+
+// Which corrections ReconcileBlock should make, beyond reporting what it finds.
+type ReconcileOptions struct {
+	// Mark restorable entries that aren't marked as allocated as allocated, as RepairBitsetIn does.
+	SetOrphaned bool
+	// Mark allocated entries that are still empty as free again. An entry that NewEntry has just handed out looks
+	// exactly the same until its first update, so this is only safe while nothing can be allocating from the block, such
+	// as right after this server acquired its lease.
+	ClearEmpty bool
+}
+
+// What ReconcileBlock found in a metadata block, and what it did about it.
+type ReconcileReport struct {
+	// Chunks with restorable entries that aren't marked as allocated
+	Orphaned []apis.ChunkNum
+	// Chunks marked as allocated whose entries are empty
+	Empty []apis.ChunkNum
+	// Chunks marked as allocated whose entries couldn't have been written by serializeEntry. These are never corrected,
+	// since there's no telling what they should hold.
+	Malformed []apis.ChunkNum
+	// Whether the bitset was rewritten to correct any of the above
+	Corrected bool
+}
+
+// Cross-checks every bit of a metadata block's bitset against the entry it covers, and reports each place where they
+// disagree, correcting them as requested. Every correction is made in a single write of the bitset, against the same
+// version of the block that was checked, so the block is never left partly corrected, and nothing is corrected on the
+// strength of an entry that changed in between. Like any other write, this only succeeds if we hold the lease on the
+// block.
+func (mc *metadatacache) ReconcileBlock(block apis.MetadataID, options ReconcileOptions) (ReconcileReport, error) {
+	if block == 0 {
+		return ReconcileReport{}, errors.New("[repair.go/BLK] metadata block zero is never used")
+	}
+	for {
+		data, version, owner, err := mc.leasing.Read(block)
+		if err != nil {
+			if owner != apis.NoRedirect {
+				return ReconcileReport{}, fmt.Errorf("[repair.go/RLS] metadata block %d is leased by %s: %v", block, owner, err)
+			}
+			return ReconcileReport{}, fmt.Errorf("[repair.go/RMR] %v", err)
+		}
+		report, corrected, err := reconcileBlockData(block, data, options)
+		if err != nil {
+			return ReconcileReport{}, err
+		}
+		if corrected == nil {
+			return report, nil
+		}
+		_, _, err = mc.writeBlock(block, version, 0, corrected)
+		if err == nil {
+			log.Printf("corrected bitset of metadata block %d, with %d orphaned entries and %d empty entries", block,
+				len(report.Orphaned), len(report.Empty))
+			if options.SetOrphaned {
+				for _, chunk := range report.Orphaned {
+					raw, _ := entryInBlock(data, OffsetForChunk(chunk))
+					mc.auditRestored(chunk, raw)
+				}
+			}
+			if options.ClearEmpty {
+				for _, chunk := range report.Empty {
+					mc.audit.record(context.Background(), chunk, AuditRepair, summarizeEntry(apis.MetadataEntry{}), "")
+				}
+			}
+			report.Corrected = true
+			return report, nil
+		} else if !isVersionMismatch(err) {
+			return ReconcileReport{}, fmt.Errorf("[repair.go/RMW] %v", err)
+		}
+		// version mismatch; check the new contents from the start
+	}
+}
+
+// Builds the report for ReconcileBlock, along with the corrected bitset, or nil if there's nothing to correct.
+func reconcileBlockData(block apis.MetadataID, data []byte, options ReconcileOptions) (ReconcileReport, []byte, error) {
+	bitset, err := bitsetInBlock(data)
+	if err != nil {
+		return ReconcileReport{}, nil, err
+	}
+	var report ReconcileReport
+	corrected := append([]byte(nil), bitset...)
+	changed := false
+	for index := uint32(0); index < 1<<apis.EntriesPerBlock; index++ {
+		raw, err := entryInBlock(data, EntryNumberToOffset(index))
+		if err != nil {
+			return ReconcileReport{}, nil, err
+		}
+		chunk := EntryAndBlockToChunkNum(block, index)
+		allocated, wellFormed := getBitsetInData(bitset, index), isWellFormedEntry(raw)
+		switch {
+		case !allocated && isRestorableEntry(raw):
+			report.Orphaned = append(report.Orphaned, chunk)
+			if options.SetOrphaned {
+				_, cell := updateBitsetInData(corrected, index, true)
+				corrected[index/8], changed = cell[0], true
+			}
+		case allocated && len(util.StripTrailingZeroes(raw)) == 0:
+			report.Empty = append(report.Empty, chunk)
+			if options.ClearEmpty {
+				_, cell := updateBitsetInData(corrected, index, false)
+				corrected[index/8], changed = cell[0], true
+			}
+		case allocated && !wellFormed:
+			report.Malformed = append(report.Malformed, chunk)
+		}
+	}
+	if !changed {
+		return report, nil, nil
+	}
+	return report, corrected, nil
+}
@@ -0,0 +1,180 @@
+package metadatacache
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+)
+
+// Clear an allocation bit behind the metadata cache's back, as a crash could
+func (f *fakeLeaser) loseBit(chunk apis.ChunkNum) {
+	_, updated := updateBitsetInData(f.data, ChunkToEntryNumber(chunk), false)
+	f.data[ChunkToEntryNumber(chunk)/8] = updated[0]
+	f.version += 1
+}
+
+func TestRepairMissingBit(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+
+	entry := apis.MetadataEntry{MostRecentVersion: 3, LastConsumedVersion: 4, Replicas: []apis.ServerID{1, 2, 3}}
+	chunk, err := mc.NewEntry()
+	require.NoError(t, err)
+	_, err = mc.UpdateEntry(chunk, apis.MetadataEntry{}, entry)
+	require.NoError(t, err)
+	fake.loseBit(chunk)
+
+	// without the flag, reads leave the inconsistency alone
+	_, _, err = mc.ReadEntry(chunk, apis.Fresh)
+	assert.Error(err)
+	assert.False(getBitsetInData(fake.data, ChunkToEntryNumber(chunk)))
+
+	mc.options.RepairOnRead = true
+	found, _, err := mc.ReadEntry(chunk, apis.Cached)
+	assert.NoError(err)
+	assert.True(entry.Equals(found))
+	assert.True(getBitsetInData(fake.data, ChunkToEntryNumber(chunk)))
+
+	// so the entry can no longer be handed out again
+	other, err := mc.NewEntry()
+	assert.NoError(err)
+	assert.NotEqual(chunk, other)
+
+	// deleted entries must stay deleted
+	_, err = mc.DeleteEntry(chunk, entry)
+	assert.NoError(err)
+	_, _, err = mc.ReadEntry(chunk, apis.Fresh)
+	assert.Error(err)
+	assert.False(getBitsetInData(fake.data, ChunkToEntryNumber(chunk)))
+}
+
+func TestRepairBitsetIn(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+
+	var chunks []apis.ChunkNum
+	for i := 0; i < 5; i++ {
+		chunk, err := mc.NewEntry()
+		require.NoError(t, err)
+		_, err = mc.UpdateEntry(chunk, apis.MetadataEntry{}, apis.MetadataEntry{Replicas: []apis.ServerID{apis.ServerID(i)}})
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+	fake.loseBit(chunks[1])
+	fake.loseBit(chunks[3])
+	// garbage in an unallocated entry doesn't count as an entry
+	_, offset := ChunkToBlockAndOffset(EntryAndBlockToChunkNum(1, 100))
+	fake.data[offset+entryFormatOffset] = 0xFF
+
+	repaired, err := mc.RepairBitsetIn(1)
+	assert.NoError(err)
+	assert.Equal(2, repaired)
+	for _, chunk := range chunks {
+		assert.True(getBitsetInData(fake.data, ChunkToEntryNumber(chunk)))
+	}
+	assert.False(getBitsetInData(fake.data, 100))
+
+	repaired, err = mc.RepairBitsetIn(1)
+	assert.NoError(err)
+	assert.Equal(0, repaired)
+}
+
+// An entry deleted before serializeEntry marked its entries was left behind in full, so one that isn't marked is never
+// restored, although one that is still allocated reads just as it always did.
+func TestRepairSkipsUnmarkedEntries(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+	mc.options.RepairOnRead = true
+	entry := apis.MetadataEntry{MostRecentVersion: 3, LastConsumedVersion: 4, Replicas: []apis.ServerID{1, 2}}
+	allocated, deleted := EntryAndBlockToChunkNum(1, 5), EntryAndBlockToChunkNum(1, 6)
+	for _, chunk := range []apis.ChunkNum{allocated, deleted} {
+		fake.overwrite(chunk, entry)
+		fake.data[OffsetForChunk(chunk)+entryFormatOffset] = 0
+	}
+	fake.loseBit(deleted)
+
+	read, _, err := mc.ReadEntry(allocated, apis.Fresh)
+	assert.NoError(err)
+	assert.True(entry.Equals(read))
+
+	_, _, err = mc.ReadEntry(deleted, apis.Fresh)
+	assert.Error(err)
+	repaired, err := mc.RepairBitsetIn(1)
+	assert.NoError(err)
+	assert.Equal(0, repaired)
+	report, err := mc.ReconcileBlock(1, ReconcileOptions{SetOrphaned: true})
+	assert.NoError(err)
+	assert.Empty(report.Orphaned)
+	assert.Empty(report.Malformed)
+	assert.False(getBitsetInData(fake.data, ChunkToEntryNumber(deleted)))
+
+	// once it's been written again, it carries the marker
+	_, err = mc.UpdateEntry(allocated, entry, apis.MetadataEntry{MostRecentVersion: 5, LastConsumedVersion: 5})
+	assert.NoError(err)
+	assert.Equal(byte(entryFormatMarker), fake.data[OffsetForChunk(allocated)+entryFormatOffset])
+}
+
+func TestReconcileBlock(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+
+	var chunks []apis.ChunkNum
+	for i := 0; i < 4; i++ {
+		chunk, err := mc.NewEntry()
+		require.NoError(t, err)
+		_, err = mc.UpdateEntry(chunk, apis.MetadataEntry{}, apis.MetadataEntry{Replicas: []apis.ServerID{apis.ServerID(i + 1)}})
+		require.NoError(t, err)
+		chunks = append(chunks, chunk)
+	}
+	// an entry whose bit was lost, a bit whose entry was never written, and a bit over garbage
+	fake.loseBit(chunks[2])
+	setBit := func(index uint32) {
+		_, updated := updateBitsetInData(fake.data, index, true)
+		fake.data[index/8] = updated[0]
+	}
+	setBit(50)
+	setBit(60)
+	_, offset := ChunkToBlockAndOffset(EntryAndBlockToChunkNum(1, 60))
+	fake.data[offset+entryFormatOffset] = 0xFF
+
+	// without any corrections requested, nothing changes
+	before := append([]byte(nil), fake.data...)
+	report, err := mc.ReconcileBlock(1, ReconcileOptions{})
+	assert.NoError(err)
+	assert.Equal([]apis.ChunkNum{chunks[2]}, report.Orphaned)
+	assert.Equal([]apis.ChunkNum{EntryAndBlockToChunkNum(1, 50)}, report.Empty)
+	assert.Equal([]apis.ChunkNum{EntryAndBlockToChunkNum(1, 60)}, report.Malformed)
+	assert.False(report.Corrected)
+	assert.Equal(before, fake.data)
+
+	version := fake.version
+	report, err = mc.ReconcileBlock(1, ReconcileOptions{SetOrphaned: true, ClearEmpty: true})
+	assert.NoError(err)
+	assert.True(report.Corrected)
+	// in a single write
+	assert.Equal(version+1, fake.version)
+	for _, chunk := range chunks {
+		assert.True(getBitsetInData(fake.data, ChunkToEntryNumber(chunk)))
+	}
+	assert.False(getBitsetInData(fake.data, 50))
+	// garbage is left for someone to look at
+	assert.True(getBitsetInData(fake.data, 60))
+	found, _, err := mc.ReadEntry(chunks[2], apis.Fresh)
+	assert.NoError(err)
+	assert.Equal([]apis.ServerID{3}, found.Replicas)
+
+	report, err = mc.ReconcileBlock(1, ReconcileOptions{SetOrphaned: true, ClearEmpty: true})
+	assert.NoError(err)
+	assert.Empty(report.Orphaned)
+	assert.Empty(report.Empty)
+	assert.Len(report.Malformed, 1)
+	assert.False(report.Corrected)
+
+	_, err = mc.ReconcileBlock(0, ReconcileOptions{})
+	assert.Error(err)
+}
@@ -0,0 +1,184 @@
+package metadatacache
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"zircon/apis"
+)
+
+// Export format, all little-endian:
+//   magic (8 bytes)
+//   for each allocated entry: chunk number (8 bytes), encoded entry (EntrySize bytes)
+//   terminator: chunk number zero (8 bytes), followed by the number of entries exported (8 bytes)
+// Chunk number zero is never allocated, because metadata block zero is never used. The trailing count means that a
+// truncated export is detected on import, rather than silently restoring only part of the namespace.
+
+var exportMagic = []byte("ZMETA001")
+
+// What ImportMetadata should do about an entry that is already allocated.
+type ImportConflict int
+
+const (
+	// Leave existing entries alone, and only recreate the ones that are missing.
+	SkipExisting ImportConflict = iota
+	// Replace existing entries with the exported version.
+	OverwriteExisting
+)
+
+// Streams every allocated metadata entry in the namespace, for disaster recovery. Fails if any metadata block is leased
+// by another server, because its contents can only be read consistently through that server.
+func (mc *metadatacache) ExportMetadata(w io.Writer) error {
+	blocks, err := mc.leasing.ListAllBlocks()
+	if err != nil {
+		return fmt.Errorf("[snapshot.go/LAB] %v", err)
+	}
+	out := bufio.NewWriter(w)
+	if _, err := out.Write(exportMagic); err != nil {
+		return err
+	}
+	header := make([]byte, 8)
+	count := uint64(0)
+	for _, block := range blocks {
+		data, _, owner, err := mc.leasing.Read(block)
+		if err != nil {
+			if owner != apis.NoRedirect {
+				return fmt.Errorf("[snapshot.go/RED] metadata block %d is leased by %s: %v", block, owner, err)
+			}
+			return fmt.Errorf("[snapshot.go/MLR] %v", err)
+		}
+		if _, err := bitsetInBlock(data); err != nil {
+			return err
+		}
+		for index := uint32(0); index < 1<<apis.EntriesPerBlock; index++ {
+			if !getBitsetInData(data, index) {
+				continue
+			}
+			raw, err := entryInBlock(data, EntryNumberToOffset(index))
+			if err != nil {
+				return err
+			}
+			binary.LittleEndian.PutUint64(header, uint64(EntryAndBlockToChunkNum(block, index)))
+			if _, err := out.Write(header); err != nil {
+				return err
+			}
+			if _, err := out.Write(raw); err != nil {
+				return err
+			}
+			count += 1
+		}
+	}
+	binary.LittleEndian.PutUint64(header, 0)
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	binary.LittleEndian.PutUint64(header, count)
+	if _, err := out.Write(header); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// Recreates the metadata entries produced by ExportMetadata. The metadata blocks themselves must already exist.
+// Returns the number of entries that were written.
+func (mc *metadatacache) ImportMetadata(r io.Reader, onConflict ImportConflict) (int, error) {
+	in := bufio.NewReader(r)
+	magic := make([]byte, len(exportMagic))
+	if _, err := io.ReadFull(in, magic); err != nil {
+		return 0, fmt.Errorf("[snapshot.go/MAG] %v", err)
+	}
+	if !bytes.Equal(magic, exportMagic) {
+		return 0, errors.New("[snapshot.go/MAG] not a metadata export")
+	}
+	header := make([]byte, 8)
+	entry := make([]byte, apis.EntrySize)
+	seen, written := uint64(0), 0
+	for {
+		if _, err := io.ReadFull(in, header); err != nil {
+			return written, fmt.Errorf("[snapshot.go/TRN] export truncated after %d entries: %v", seen, err)
+		}
+		chunk := apis.ChunkNum(binary.LittleEndian.Uint64(header))
+		if chunk == 0 {
+			break
+		}
+		if _, err := io.ReadFull(in, entry); err != nil {
+			return written, fmt.Errorf("[snapshot.go/TRN] export truncated after %d entries: %v", seen, err)
+		}
+		parsed, err := deserializeEntry(entry)
+		if err != nil {
+			return written, fmt.Errorf("[snapshot.go/DSE] entry for chunk %d: %v", chunk, err)
+		}
+		// encoded afresh, so that entries from an export made before they were marked are marked like any other
+		encoded, err := serializeEntry(parsed)
+		if err != nil {
+			return written, fmt.Errorf("[snapshot.go/SRE] entry for chunk %d: %v", chunk, err)
+		}
+		seen += 1
+		imported, err := mc.importEntry(chunk, encoded, onConflict)
+		if err != nil {
+			return written, fmt.Errorf("[snapshot.go/IMP] chunk %d: %v", chunk, err)
+		}
+		if imported {
+			written += 1
+		}
+	}
+	if _, err := io.ReadFull(in, header); err != nil {
+		return written, fmt.Errorf("[snapshot.go/TRN] export missing entry count: %v", err)
+	}
+	if expected := binary.LittleEndian.Uint64(header); expected != seen {
+		return written, fmt.Errorf("[snapshot.go/CNT] export claims %d entries, but contained %d", expected, seen)
+	}
+	return written, nil
+}
+
+// Writes a single encoded entry, and then marks it as allocated, so that an allocated entry never has garbage contents.
+// Returns whether anything was written.
+func (mc *metadatacache) importEntry(chunk apis.ChunkNum, entry []byte, onConflict ImportConflict) (bool, error) {
+	metachunk, offset := ChunkToBlockAndOffset(chunk)
+	index := ChunkToEntryNumber(chunk)
+	before := ""
+	for {
+		data, version, owner, err := mc.leasing.Read(metachunk)
+		if err != nil {
+			if owner != apis.NoRedirect {
+				return false, fmt.Errorf("metadata block %d is leased by %s: %v", metachunk, owner, err)
+			}
+			return false, err
+		}
+		if getBitsetInData(data, index) {
+			if onConflict == SkipExisting {
+				return false, nil
+			}
+			raw, err := entryInBlock(data, offset)
+			if err != nil {
+				return false, err
+			}
+			if existing, err := deserializeEntry(raw); err == nil {
+				before = summarizeEntry(existing)
+			}
+		}
+		_, _, err = mc.writeBlock(metachunk, version, offset, entry)
+		if err == nil {
+			break
+		} else if !isVersionMismatch(err) {
+			return false, err
+		}
+		// version mismatch; go around again
+	}
+	set, err := mc.updateBitset(metachunk, index, true)
+	if err != nil {
+		return false, err
+	}
+	if !set && onConflict == SkipExisting {
+		// someone else allocated this entry while we were writing it, and theirs takes precedence
+		return false, nil
+	}
+	if imported, err := deserializeEntry(entry); err == nil {
+		mc.audit.record(context.Background(), chunk, AuditImport, before, summarizeEntry(imported))
+	}
+	return true, nil
+}
@@ -0,0 +1,97 @@
+package metadatacache
+
+import (
+	"bytes"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, _ := newFakeCache(t)
+
+	entries := map[apis.ChunkNum]apis.MetadataEntry{}
+	for i := 0; i < 50; i++ {
+		chunk, err := mc.NewEntry()
+		require.NoError(t, err)
+		entry := apis.MetadataEntry{
+			MostRecentVersion:   apis.Version(i + 1),
+			LastConsumedVersion: apis.Version(i + 2),
+			Replicas:            []apis.ServerID{apis.ServerID(i), apis.ServerID(i + 1)},
+		}
+		_, err = mc.UpdateEntry(chunk, apis.MetadataEntry{}, entry)
+		require.NoError(t, err)
+		entries[chunk] = entry
+	}
+
+	var export bytes.Buffer
+	assert.NoError(mc.ExportMetadata(&export))
+
+	// clear out the namespace entirely
+	for chunk, entry := range entries {
+		_, err := mc.DeleteEntry(chunk, entry)
+		require.NoError(t, err)
+	}
+	free, err := mc.FreeIndicesIn(1)
+	assert.NoError(err)
+	assert.Equal(1<<apis.EntriesPerBlock, len(free))
+
+	written, err := mc.ImportMetadata(bytes.NewReader(export.Bytes()), SkipExisting)
+	assert.NoError(err)
+	assert.Equal(len(entries), written)
+	for chunk, entry := range entries {
+		found, _, err := mc.ReadEntry(chunk, apis.Fresh)
+		assert.NoError(err)
+		assert.True(entry.Equals(found))
+	}
+	free, err = mc.FreeIndicesIn(1)
+	assert.NoError(err)
+	assert.Equal(1<<apis.EntriesPerBlock-len(entries), len(free))
+
+	// a re-export of the restored namespace is identical
+	var again bytes.Buffer
+	assert.NoError(mc.ExportMetadata(&again))
+	assert.Equal(export.Bytes(), again.Bytes())
+}
+
+func TestImportConflicts(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, _ := newFakeCache(t)
+
+	chunk, err := mc.NewEntry()
+	require.NoError(t, err)
+	original := apis.MetadataEntry{MostRecentVersion: 3, LastConsumedVersion: 3, Replicas: []apis.ServerID{1, 2}}
+	_, err = mc.UpdateEntry(chunk, apis.MetadataEntry{}, original)
+	require.NoError(t, err)
+
+	var export bytes.Buffer
+	assert.NoError(mc.ExportMetadata(&export))
+
+	changed := apis.MetadataEntry{MostRecentVersion: 4, LastConsumedVersion: 4, Replicas: []apis.ServerID{3}}
+	_, err = mc.UpdateEntry(chunk, original, changed)
+	require.NoError(t, err)
+
+	written, err := mc.ImportMetadata(bytes.NewReader(export.Bytes()), SkipExisting)
+	assert.NoError(err)
+	assert.Equal(0, written)
+	entry, _, err := mc.ReadEntry(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.True(changed.Equals(entry))
+
+	written, err = mc.ImportMetadata(bytes.NewReader(export.Bytes()), OverwriteExisting)
+	assert.NoError(err)
+	assert.Equal(1, written)
+	entry, _, err = mc.ReadEntry(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.True(original.Equals(entry))
+
+	// a truncated export is rejected, rather than being taken as the whole namespace
+	_, err = mc.ImportMetadata(bytes.NewReader(export.Bytes()[:export.Len()-4]), OverwriteExisting)
+	assert.Error(err)
+	_, err = mc.ImportMetadata(bytes.NewReader([]byte("not an export")), OverwriteExisting)
+	assert.Error(err)
+}
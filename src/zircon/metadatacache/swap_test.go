@@ -0,0 +1,69 @@
+package metadatacache
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+)
+
+// A leasing layer where another server changes an entry just before the next write lands, as if it had won a race
+// between our read and our write.
+type racingLeaser struct {
+	*fakeLeaser
+	chunk apis.ChunkNum
+	entry apis.MetadataEntry
+	raced bool
+}
+
+func (r *racingLeaser) Write(metachunk apis.MetadataID, version apis.Version, offset uint32, data []byte) (apis.Version, apis.ServerName, error) {
+	if !r.raced {
+		r.raced = true
+		r.overwrite(r.chunk, r.entry)
+	}
+	return r.fakeLeaser.Write(metachunk, version, offset, data)
+}
+
+func TestSwapReplicas(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	mc, fake := newFakeCache(t)
+	chunk := EntryAndBlockToChunkNum(1, 7)
+	neighbor := EntryAndBlockToChunkNum(1, 8)
+	original := apis.MetadataEntry{MostRecentVersion: 3, LastConsumedVersion: 4, Replicas: []apis.ServerID{1, 2}}
+	fake.overwrite(chunk, original)
+	fake.overwrite(neighbor, original)
+
+	_, err := mc.SwapReplicas(chunk, original, []apis.ServerID{2, 3})
+	require.NoError(t, err)
+	swapped := apis.MetadataEntry{MostRecentVersion: 3, LastConsumedVersion: 4, Replicas: []apis.ServerID{2, 3}}
+	entry, _, err := mc.ReadEntry(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.True(swapped.Equals(entry))
+
+	// a swap against an out-of-date entry doesn't go through
+	_, err = mc.SwapReplicas(chunk, original, []apis.ServerID{4, 5})
+	assert.Error(err)
+
+	// a concurrent change to a different entry in the same block just means trying again
+	mc.leasing = &racingLeaser{
+		fakeLeaser: fake,
+		chunk:      neighbor,
+		entry:      apis.MetadataEntry{MostRecentVersion: 9, LastConsumedVersion: 9, Replicas: []apis.ServerID{7}},
+	}
+	_, err = mc.SwapReplicas(chunk, swapped, []apis.ServerID{3, 4})
+	assert.NoError(err)
+	swapped.Replicas = []apis.ServerID{3, 4}
+	entry, _, err = mc.ReadEntry(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.True(swapped.Equals(entry))
+
+	// but a concurrent change to the entry itself, between the read and the swap, makes the swap fail
+	concurrent := apis.MetadataEntry{MostRecentVersion: 5, LastConsumedVersion: 5, Replicas: []apis.ServerID{3, 4}}
+	mc.leasing = &racingLeaser{fakeLeaser: fake, chunk: chunk, entry: concurrent}
+	_, err = mc.SwapReplicas(chunk, swapped, []apis.ServerID{6})
+	assert.Error(err)
+	entry, _, err = mc.ReadEntry(chunk, apis.Fresh)
+	assert.NoError(err)
+	assert.True(concurrent.Equals(entry), "concurrent update should not have been overwritten: %v", entry)
+}
@@ -0,0 +1,200 @@
+package rpc
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"zircon/apis"
+)
+
+// Large reads from a chunkserver skip twirp, and go through an endpoint of their own instead, so that the data can be
+// sent straight from a storage file to the connection rather than being copied into a protobuf message on the way. The
+// version, and the checksum of the data as stored, are sent in headers.
+
+// Reads of at least this many bytes go through the bulk endpoint, if the server has one.
+const BulkReadThreshold = 1024 * 1024
+
+const bulkReadPath = "/zircon/BulkRead"
+
+const (
+	bulkVersionHeader   = "Zircon-Version"
+	bulkErrorHeader     = "Zircon-Error"
+	bulkErrorCodeHeader = "Zircon-Error-Code"
+	// Set only when the data was sent straight from storage: the first Zircon-Stored-Length bytes of the body are the
+	// data as stored, and Zircon-Checksum is their checksum, so that the client can verify them end to end.
+	bulkStoredLengthHeader = "Zircon-Stored-Length"
+	bulkChecksumHeader     = "Zircon-Checksum"
+)
+
+// Wraps the twirp handler for a chunkserver so that bulk reads are served alongside it.
+func withBulkReads(handler http.Handler, server apis.Chunkserver) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.Handle(bulkReadPath, &bulkReadHandler{server: server})
+	return mux
+}
+
+type bulkReadHandler struct {
+	server apis.Chunkserver
+}
+
+func (h *bulkReadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	chunk, err1 := strconv.ParseUint(query.Get("chunk"), 10, 64)
+	offset, err2 := strconv.ParseUint(query.Get("offset"), 10, 32)
+	length, err3 := strconv.ParseUint(query.Get("length"), 10, 32)
+	minimum, err4 := strconv.ParseUint(query.Get("minimum"), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		http.Error(w, "malformed bulk read", http.StatusBadRequest)
+		return
+	}
+	// as with the twirp handlers, a panic in the chunkserver shouldn't kill the whole server
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			log.Printf("panic in BulkRead: %v", recovered)
+			writeBulkError(w, apis.NewError(apis.ErrInternal, 0, "internal error in BulkRead: %v", recovered), 0)
+		}
+	}()
+
+	if reader, ok := h.server.(apis.BulkReader); ok {
+		read, ok, err := reader.OpenRead(apis.ChunkNum(chunk), uint32(offset), uint32(length), apis.Version(minimum))
+		if err != nil {
+			writeBulkError(w, err, 0)
+			return
+		}
+		if ok {
+			// the open file keeps the data readable until it's sent, even if the version is deleted in the meantime
+			defer read.File.Close()
+			sendBulkRead(w, read, int64(length))
+			return
+		}
+	}
+
+	data, version, err := h.server.Read(apis.ChunkNum(chunk), uint32(offset), uint32(length), apis.Version(minimum))
+	if err != nil {
+		writeBulkError(w, err, version)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set(bulkVersionHeader, strconv.FormatUint(uint64(version), 10))
+	if _, err := w.Write(data); err != nil {
+		log.Printf("[bulk.go/BRW] could not send bulk read of chunk %d: %v", chunk, err)
+	}
+}
+
+func writeBulkError(w http.ResponseWriter, err error, version apis.Version) {
+	message, code := readErrorFields(err)
+	if coded, ok := err.(*apis.Error); ok && version == 0 {
+		version = coded.Version
+	}
+	w.Header().Set(bulkErrorHeader, message)
+	w.Header().Set(bulkErrorCodeHeader, code)
+	w.Header().Set(bulkVersionHeader, strconv.FormatUint(uint64(version), 10))
+	w.WriteHeader(http.StatusInternalServerError)
+}
+
+func sendBulkRead(w http.ResponseWriter, read *apis.BulkRead, length int64) {
+	if _, err := read.File.Seek(read.Offset, io.SeekStart); err != nil {
+		writeBulkError(w, apis.NewError(apis.ErrInternal, read.Version, "could not seek in storage file: %v", err), 0)
+		return
+	}
+	// with a content type, the server doesn't need to buffer the start of the data to sniff one
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.Header().Set(bulkVersionHeader, strconv.FormatUint(uint64(read.Version), 10))
+	w.Header().Set(bulkStoredLengthHeader, strconv.FormatInt(read.Length, 10))
+	w.Header().Set(bulkChecksumHeader, strconv.FormatUint(uint64(read.Checksum), 10))
+	w.WriteHeader(http.StatusOK)
+	// the response passes a file through to the connection's ReadFrom, which sends it with sendfile(2) where available
+	if _, err := io.Copy(w, io.LimitReader(read.File, read.Length)); err != nil {
+		// too late to report an error; the client will see the body cut short
+		log.Printf("[bulk.go/BRS] could not send bulk read: %v", err)
+		return
+	}
+	if err := writeZeroes(w, length-read.Length); err != nil {
+		log.Printf("[bulk.go/BRZ] could not send bulk read: %v", err)
+	}
+}
+
+var zeroes [32 * 1024]byte
+
+func writeZeroes(w io.Writer, count int64) error {
+	for count > 0 {
+		n := int64(len(zeroes))
+		if count < n {
+			n = count
+		}
+		if _, err := w.Write(zeroes[:n]); err != nil {
+			return err
+		}
+		count -= n
+	}
+	return nil
+}
+
+// Makes bulk reads from a single chunkserver, remembering if it turns out not to serve them.
+type bulkReadClient struct {
+	client httpDoer
+	base   string
+	// set once the server is found not to have a bulk endpoint, after which all reads go through twirp
+	unsupported int32
+}
+
+// Returned by bulkReadClient.read when the server has no bulk endpoint.
+var errBulkUnsupported = fmt.Errorf("server does not support bulk reads")
+
+func (b *bulkReadClient) supported() bool {
+	return atomic.LoadInt32(&b.unsupported) == 0
+}
+
+func (b *bulkReadClient) read(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, error) {
+	query := url.Values{}
+	query.Set("chunk", strconv.FormatUint(uint64(chunk), 10))
+	query.Set("offset", strconv.FormatUint(uint64(offset), 10))
+	query.Set("length", strconv.FormatUint(uint64(length), 10))
+	query.Set("minimum", strconv.FormatUint(uint64(minimum), 10))
+	request, err := http.NewRequest("GET", b.base+bulkReadPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	response, err := b.client.Do(request)
+	if err != nil {
+		return nil, 0, apis.NewError(apis.ErrUnreachable, 0, "bulk read failed: %v", err)
+	}
+	defer response.Body.Close()
+
+	version, _ := strconv.ParseUint(response.Header.Get(bulkVersionHeader), 10, 64)
+	if message := response.Header.Get(bulkErrorHeader); message != "" {
+		return nil, apis.Version(version), readErrorFromFields(message, response.Header.Get(bulkErrorCodeHeader), apis.Version(version))
+	}
+	if response.StatusCode == http.StatusNotFound {
+		atomic.StoreInt32(&b.unsupported, 1)
+		return nil, 0, errBulkUnsupported
+	}
+	if response.StatusCode != http.StatusOK || response.Header.Get(bulkVersionHeader) == "" {
+		return nil, 0, apis.NewError(apis.ErrUnreachable, 0, "unexpected response to bulk read: %s", response.Status)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(response.Body, data); err != nil {
+		return nil, 0, apis.NewError(apis.ErrUnreachable, 0, "bulk read cut short: %v", err)
+	}
+	if stored := response.Header.Get(bulkStoredLengthHeader); stored != "" {
+		storedLength, err1 := strconv.ParseUint(stored, 10, 32)
+		checksum, err2 := strconv.ParseUint(response.Header.Get(bulkChecksumHeader), 10, 32)
+		if err1 != nil || err2 != nil || storedLength > uint64(length) {
+			return nil, 0, apis.NewError(apis.ErrUnreachable, 0, "malformed bulk read response")
+		}
+		if crc32.ChecksumIEEE(data[:storedLength]) != uint32(checksum) {
+			return nil, apis.Version(version), apis.NewError(apis.ErrChecksumMismatch, apis.Version(version),
+				"bulk read of chunk %d did not match its stored checksum", chunk)
+		}
+	}
+	return data, apis.Version(version), nil
+}
@@ -0,0 +1,193 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/apis/mocks"
+	"zircon/chunkserver/control"
+	"zircon/chunkserver/storage"
+	"zircon/rpc/twirp"
+)
+
+// Serves a real ChunkserverSingle without any of the calls that involve other chunkservers, which bulk reads don't
+// need.
+type standaloneChunkserver struct {
+	apis.ChunkserverSingle
+}
+
+var errStandalone = errors.New("standalone chunkserver cannot reach other chunkservers")
+
+func (s standaloneChunkserver) StartWriteReplicated(chunk apis.ChunkNum, offset uint32, data []byte, replicas []apis.ServerAddress) error {
+	return errStandalone
+}
+
+func (s standaloneChunkserver) Replicate(chunk apis.ChunkNum, serverAddress apis.ServerAddress, version apis.Version) error {
+	return errStandalone
+}
+
+func (s standaloneChunkserver) Push(chunk apis.ChunkNum, serverAddress apis.ServerAddress) (apis.Version, error) {
+	return 0, errStandalone
+}
+
+func (s standaloneChunkserver) RepairChunk(chunk apis.ChunkNum, version apis.Version, checksum uint32, sources []apis.ServerAddress) (apis.ServerAddress, error) {
+	return "", errStandalone
+}
+
+func (s standaloneChunkserver) StartWriteReplicatedWithContext(ctx context.Context, chunk apis.ChunkNum, offset uint32, data []byte, replicas []apis.ServerAddress) error {
+	return errStandalone
+}
+
+func (s standaloneChunkserver) ReplicateWithContext(ctx context.Context, chunk apis.ChunkNum, serverAddress apis.ServerAddress, version apis.Version) error {
+	return errStandalone
+}
+
+func (s standaloneChunkserver) PushWithContext(ctx context.Context, chunk apis.ChunkNum, serverAddress apis.ServerAddress) (apis.Version, error) {
+	return 0, errStandalone
+}
+
+func (s standaloneChunkserver) RepairChunkWithContext(ctx context.Context, chunk apis.ChunkNum, version apis.Version, checksum uint32, sources []apis.ServerAddress) (apis.ServerAddress, error) {
+	return "", errStandalone
+}
+
+func (s standaloneChunkserver) OpenRead(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) (*apis.BulkRead, bool, error) {
+	return s.ChunkserverSingle.(apis.BulkReader).OpenRead(chunk, offset, length, minimum)
+}
+
+// Publishes a chunkserver backed by filesystem storage, which can send reads straight from its files.
+func beginBulkReadTest(t testing.TB) (string, func(), apis.Chunkserver, apis.ChunkserverSingle) {
+	dir, err := ioutil.TempDir("", "bulk-read-test-")
+	require.NoError(t, err)
+	fs, err := storage.ConfigureFilesystemStorage(dir, false)
+	require.NoError(t, err)
+	single, shutdown, err := control.ExposeChunkserverWithShutdown(fs)
+	require.NoError(t, err)
+
+	teardown, address, err := PublishChunkserver(standaloneChunkserver{single}, ":0")
+	require.NoError(t, err)
+	server, err := UncachedSubscribeChunkserver(address, http.DefaultClient)
+	require.NoError(t, err)
+
+	return dir, func() {
+		teardown(true)
+		shutdown(time.Now().Add(time.Second))
+		fs.Close()
+		os.RemoveAll(dir)
+	}, server, single
+}
+
+func TestChunkserver_BulkRead(t *testing.T) {
+	dir, teardown, server, single := beginBulkReadTest(t)
+	defer teardown()
+
+	data := bytes.Repeat([]byte("sent straight from the file "), 100000)
+	require.NoError(t, single.Add(7, data, 3))
+
+	read, version, err := server.Read(7, 0, BulkReadThreshold*4, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, apis.Version(3), version)
+	assert.Equal(t, BulkReadThreshold*4, len(read))
+	assert.Equal(t, data, read[:len(data)])
+	assert.Equal(t, make([]byte, BulkReadThreshold*4-len(data)), read[len(data):])
+
+	// reads that don't start at the beginning go through the bulk endpoint, but not straight from the file
+	read, version, err = server.Read(7, 28, BulkReadThreshold, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, apis.Version(3), version)
+	assert.Equal(t, data[28:28+BulkReadThreshold], read)
+
+	_, version, err = server.Read(7, 0, BulkReadThreshold, 4)
+	assert.Equal(t, apis.ErrWrongVersion, apis.ErrorCodeOf(err))
+	assert.Equal(t, apis.Version(3), version)
+	_, _, err = server.Read(8, 0, BulkReadThreshold, 1)
+	assert.Error(t, err)
+
+	// damage on disk is caught by the client, since the checksum is sent along with the data
+	filename := fmt.Sprintf("%s/chunks/07/7/3", dir)
+	encoded, err := ioutil.ReadFile(filename)
+	require.NoError(t, err)
+	encoded[len(encoded)-1] ^= 0x20
+	require.NoError(t, ioutil.WriteFile(filename, encoded, 0644))
+	_, _, err = server.Read(7, 0, BulkReadThreshold*4, 3)
+	assert.Equal(t, apis.ErrChecksumMismatch, apis.ErrorCodeOf(err))
+}
+
+func TestChunkserver_BulkReadWithoutOpenRead(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	data := bytes.Repeat([]byte("hello world 35"), BulkReadThreshold/10)
+	mocked.On("Read", apis.ChunkNum(73), uint32(5), uint32(len(data)), apis.Version(2)).Return(data, apis.Version(4), nil)
+	mocked.On("Read", apis.ChunkNum(74), uint32(0), uint32(BulkReadThreshold), apis.Version(6)).
+		Return(nil, apis.Version(5), apis.NewError(apis.ErrWrongVersion, 5, "hello world 36"))
+
+	read, version, err := server.Read(73, 5, uint32(len(data)), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, apis.Version(4), version)
+	assert.Equal(t, data, read)
+
+	_, version, err = server.Read(74, 0, BulkReadThreshold, 6)
+	assert.Equal(t, apis.ErrWrongVersion, apis.ErrorCodeOf(err))
+	assert.Equal(t, "hello world 36", err.Error())
+	assert.Equal(t, apis.Version(5), version)
+}
+
+func TestChunkserver_BulkReadUnsupported(t *testing.T) {
+	mocked := new(mocks.Chunkserver)
+	defer mocked.AssertExpectations(t)
+
+	// a server from before bulk reads were added only serves twirp
+	tserve := twirp.NewChunkserverServer(&proxyChunkserverAsTwirp{server: mocked}, nil)
+	teardown, address, err := LaunchEmbeddedHTTP(tserve, ":0")
+	require.NoError(t, err)
+	defer teardown(true)
+
+	data := bytes.Repeat([]byte("hello world 37"), BulkReadThreshold/10)
+	mocked.On("Read", apis.ChunkNum(73), uint32(0), uint32(len(data)), apis.Version(1)).Return(data, apis.Version(1), nil).Twice()
+
+	server, err := UncachedSubscribeChunkserver(address, http.DefaultClient)
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		read, _, err := server.Read(73, 0, uint32(len(data)), 1)
+		assert.NoError(t, err)
+		assert.Equal(t, data, read)
+	}
+	assert.False(t, server.(*proxyTwirpAsChunkserver).bulk.supported())
+}
+
+func benchmarkReadLarge(b *testing.B, bulk bool) {
+	_, teardown, server, single := beginBulkReadTest(b)
+	defer teardown()
+	require.NoError(b, single.Add(1, bytes.Repeat([]byte{0xA5}, apis.MaxChunkSize), 1))
+	if !bulk {
+		server.(*proxyTwirpAsChunkserver).bulk = nil
+	}
+
+	b.SetBytes(apis.MaxChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := server.Read(1, 0, apis.MaxChunkSize, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Whole-chunk reads, with the data inside a protobuf message.
+func BenchmarkReadLargeProtobuf(b *testing.B) {
+	benchmarkReadLarge(b, false)
+}
+
+// Whole-chunk reads, sent straight from the chunk's file.
+func BenchmarkReadLargeBulk(b *testing.B) {
+	benchmarkReadLarge(b, true)
+}
@@ -2,8 +2,9 @@ package rpc
 
 import (
 	"context"
-	"errors"
+	"fmt"
 	"net/http"
+	"time"
 	"zircon/apis"
 	"zircon/rpc/twirp"
 )
@@ -11,75 +12,190 @@ import (
 // Connects to an RPC handler for a Chunkserver on a certain address.
 func UncachedSubscribeChunkserver(address apis.ServerAddress, client *http.Client) (apis.Chunkserver, error) {
 	saddr := "http://" + string(address)
-	tserve := twirp.NewChunkserverProtobufClient(saddr, client)
+	doer := withRequestIDClient(client)
+	tserve := twirp.NewChunkserverProtobufClient(saddr, doer)
 
-	return &proxyTwirpAsChunkserver{server: tserve}, nil
+	return &proxyTwirpAsChunkserver{server: tserve, bulk: &bulkReadClient{client: doer, base: saddr}}, nil
 }
 
 // Starts serving an RPC handler for a Chunkserver on a certain address. Runs forever.
 func PublishChunkserver(server apis.Chunkserver, address apis.ServerAddress) (func(kill bool) error, apis.ServerAddress, error) {
 	tserve := twirp.NewChunkserverServer(&proxyChunkserverAsTwirp{server: server}, nil)
-	return LaunchEmbeddedHTTP(tserve, address)
+	return LaunchEmbeddedHTTP(withBulkReads(tserve, server), address)
 }
 
 type proxyChunkserverAsTwirp struct {
 	server apis.Chunkserver
 }
 
-func (p *proxyChunkserverAsTwirp) StartWriteReplicated(context context.Context, input *twirp.Chunkserver_StartWriteReplicated) (*twirp.Nothing, error) {
-	err := p.server.StartWriteReplicated(apis.ChunkNum(input.Chunk), input.Offset, input.Data, StringArrayToAddressArray(input.Addresses))
-	return &twirp.Nothing{}, err
+// Each handler recovers from panics in the underlying chunkserver, so that a bug affecting one request (such as in a
+// storage backend) is reported as ErrInternal rather than killing the whole server.
+
+func (p *proxyChunkserverAsTwirp) StartWriteReplicated(context context.Context, input *twirp.Chunkserver_StartWriteReplicated) (result *twirp.Nothing, err error) {
+	defer recoverAsInternalError("StartWriteReplicated", &err)
+	err = p.server.StartWriteReplicatedWithContext(context, apis.ChunkNum(input.Chunk), input.Offset, input.Data, StringArrayToAddressArray(input.Addresses))
+	return &twirp.Nothing{}, exportError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) Replicate(context context.Context, input *twirp.Chunkserver_Replicate) (result *twirp.Nothing, err error) {
+	defer recoverAsInternalError("Replicate", &err)
+	err = p.server.ReplicateWithContext(context, apis.ChunkNum(input.Chunk), apis.ServerAddress(input.ServerAddress), apis.Version(input.Version))
+	return &twirp.Nothing{}, exportError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) Replicate(context context.Context, input *twirp.Chunkserver_Replicate) (*twirp.Nothing, error) {
-	err := p.server.Replicate(apis.ChunkNum(input.Chunk), apis.ServerAddress(input.ServerAddress), apis.Version(input.Version))
-	return &twirp.Nothing{}, err
+func (p *proxyChunkserverAsTwirp) Push(context context.Context, input *twirp.Chunkserver_Push) (result *twirp.Chunkserver_Push_Result, err error) {
+	defer recoverAsInternalError("Push", &err)
+	version, err := p.server.PushWithContext(context, apis.ChunkNum(input.Chunk), apis.ServerAddress(input.ServerAddress))
+	return &twirp.Chunkserver_Push_Result{
+		Version: uint64(version),
+	}, exportError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) Read(context context.Context, input *twirp.Chunkserver_Read) (*twirp.Chunkserver_Read_Result, error) {
+func (p *proxyChunkserverAsTwirp) RepairChunk(context context.Context, input *twirp.Chunkserver_RepairChunk) (result *twirp.Chunkserver_RepairChunk_Result, err error) {
+	defer recoverAsInternalError("RepairChunk", &err)
+	source, err := p.server.RepairChunkWithContext(context, apis.ChunkNum(input.Chunk), apis.Version(input.Version), input.Checksum,
+		StringArrayToAddressArray(input.Sources))
+	return &twirp.Chunkserver_RepairChunk_Result{
+		Source: string(source),
+	}, exportError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) Read(context context.Context, input *twirp.Chunkserver_Read) (result *twirp.Chunkserver_Read_Result, err error) {
+	defer recoverAsInternalError("Read", &err)
 	data, version, err := p.server.Read(apis.ChunkNum(input.Chunk), input.Offset, input.Length, apis.Version(input.Version))
-	message := ""
+	message, code := readErrorFields(err)
+	return &twirp.Chunkserver_Read_Result{
+		Data:      data,
+		Version:   uint64(version),
+		Error:     message,
+		ErrorCode: code,
+	}, nil
+}
+
+func (p *proxyChunkserverAsTwirp) StartWrite(context context.Context, input *twirp.Chunkserver_StartWrite) (result *twirp.Nothing, err error) {
+	defer recoverAsInternalError("StartWrite", &err)
+	err = p.server.StartWrite(apis.ChunkNum(input.Chunk), input.Offset, input.Data)
+	return &twirp.Nothing{}, exportError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) CommitWrite(context context.Context, input *twirp.Chunkserver_CommitWrite) (result *twirp.Nothing, err error) {
+	defer recoverAsInternalError("CommitWrite", &err)
+	err = p.server.CommitWrite(apis.ChunkNum(input.Chunk), apis.CommitHash(input.Hash), apis.Version(input.OldVersion), apis.Version(input.NewVersion))
+	return &twirp.Nothing{}, exportError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) CommitWriteBatch(context context.Context, input *twirp.Chunkserver_CommitWriteBatch) (result *twirp.Chunkserver_CommitWriteBatch_Result, err error) {
+	defer recoverAsInternalError("CommitWriteBatch", &err)
+	commits := make([]apis.CommitWriteRequest, len(input.Commits))
+	for i, c := range input.Commits {
+		commits[i] = apis.CommitWriteRequest{
+			Chunk:      apis.ChunkNum(c.Chunk),
+			Hash:       apis.CommitHash(c.Hash),
+			OldVersion: apis.Version(c.OldVersion),
+			NewVersion: apis.Version(c.NewVersion),
+		}
+	}
+	results, err := p.server.CommitWriteBatch(commits)
 	if err != nil {
-		message = err.Error()
-		if message == "" {
-			panic("expected nonempty error code")
+		return nil, exportError(err)
+	}
+	outcomes := make([]*twirp.Chunkserver_CommitWriteBatch_Outcome, len(results))
+	for i, result := range results {
+		message, code := readErrorFields(result)
+		outcome := &twirp.Chunkserver_CommitWriteBatch_Outcome{
+			Error:     message,
+			ErrorCode: code,
+		}
+		if coded, ok := result.(*apis.Error); ok && coded != nil {
+			outcome.Version = uint64(coded.Version)
 		}
+		outcomes[i] = outcome
 	}
-	return &twirp.Chunkserver_Read_Result{
-		Data:    data,
-		Version: uint64(version),
-		Error:   message,
+	return &twirp.Chunkserver_CommitWriteBatch_Result{
+		Outcomes: outcomes,
 	}, nil
 }
 
-func (p *proxyChunkserverAsTwirp) StartWrite(context context.Context, input *twirp.Chunkserver_StartWrite) (*twirp.Nothing, error) {
-	err := p.server.StartWrite(apis.ChunkNum(input.Chunk), input.Offset, input.Data)
-	return &twirp.Nothing{}, err
+func (p *proxyChunkserverAsTwirp) UpdateLatestVersion(context context.Context, input *twirp.Chunkserver_UpdateLatestVersion) (result *twirp.Nothing, err error) {
+	defer recoverAsInternalError("UpdateLatestVersion", &err)
+	if input.Override {
+		err = p.server.OverrideLatestVersion(apis.ChunkNum(input.Chunk), apis.Version(input.NewVersion))
+	} else {
+		err = p.server.UpdateLatestVersion(apis.ChunkNum(input.Chunk), apis.Version(input.OldVersion), apis.Version(input.NewVersion))
+	}
+	return &twirp.Nothing{}, exportError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) CommitWrite(context context.Context, input *twirp.Chunkserver_CommitWrite) (*twirp.Nothing, error) {
-	err := p.server.CommitWrite(apis.ChunkNum(input.Chunk), apis.CommitHash(input.Hash), apis.Version(input.OldVersion), apis.Version(input.NewVersion))
-	return &twirp.Nothing{}, err
+func (p *proxyChunkserverAsTwirp) Add(context context.Context, input *twirp.Chunkserver_Add) (result *twirp.Nothing, err error) {
+	defer recoverAsInternalError("Add", &err)
+	if input.Checked {
+		err = p.server.ForceAddChecked(apis.ChunkNum(input.Chunk), input.InitialData, apis.Version(input.Version), input.Checksum)
+	} else if input.Overwrite {
+		err = p.server.ForceAdd(apis.ChunkNum(input.Chunk), input.InitialData, apis.Version(input.Version))
+	} else if input.Mode != int32(apis.AddFailIfExists) {
+		err = p.server.AddWithMode(apis.ChunkNum(input.Chunk), input.InitialData, apis.Version(input.Version), apis.AddMode(input.Mode))
+	} else {
+		err = p.server.Add(apis.ChunkNum(input.Chunk), input.InitialData, apis.Version(input.Version))
+	}
+	return &twirp.Nothing{}, exportError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) UpdateLatestVersion(context context.Context, input *twirp.Chunkserver_UpdateLatestVersion) (*twirp.Nothing, error) {
-	err := p.server.UpdateLatestVersion(apis.ChunkNum(input.Chunk), apis.Version(input.OldVersion), apis.Version(input.NewVersion))
-	return &twirp.Nothing{}, err
+func (p *proxyChunkserverAsTwirp) Delete(context context.Context, input *twirp.Chunkserver_Delete) (result *twirp.Nothing, err error) {
+	defer recoverAsInternalError("Delete", &err)
+	err = p.server.Delete(apis.ChunkNum(input.Chunk), apis.Version(input.Version))
+	return &twirp.Nothing{}, exportError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) Add(context context.Context, input *twirp.Chunkserver_Add) (*twirp.Nothing, error) {
-	err := p.server.Add(apis.ChunkNum(input.Chunk), input.InitialData, apis.Version(input.Version))
-	return &twirp.Nothing{}, err
+func (p *proxyChunkserverAsTwirp) ListAllChunks(context context.Context,
+	input *twirp.Chunkserver_ListAllChunks) (result *twirp.Chunkserver_ListAllChunks_Result, err error) {
+	defer recoverAsInternalError("ListAllChunks", &err)
+	chunks, err := p.server.ListAllChunks(apis.Version(input.MinVersion), apis.Version(input.MaxVersion))
+
+	chunkVersions := make([]*twirp.ChunkVersion, len(chunks))
+	for i, chunk := range chunks {
+		chunkVersions[i] = &twirp.ChunkVersion{
+			Chunk:   uint64(chunk.Chunk),
+			Version: uint64(chunk.Version),
+		}
+	}
+
+	return &twirp.Chunkserver_ListAllChunks_Result{
+		Chunks: chunkVersions,
+	}, exportError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) Delete(context context.Context, input *twirp.Chunkserver_Delete) (*twirp.Nothing, error) {
-	err := p.server.Delete(apis.ChunkNum(input.Chunk), apis.Version(input.Version))
-	return &twirp.Nothing{}, err
+func (p *proxyChunkserverAsTwirp) ListAllChunksWithHashes(context context.Context,
+	input *twirp.Chunkserver_ListAllChunks) (result *twirp.Chunkserver_ListAllChunksWithHashes_Result, err error) {
+	defer recoverAsInternalError("ListAllChunksWithHashes", &err)
+	chunks, err := p.server.ListAllChunksWithHashes(apis.Version(input.MinVersion), apis.Version(input.MaxVersion))
+
+	encoded := make([]*twirp.ChunkVersionHashes, len(chunks))
+	for i, chunk := range chunks {
+		hashes := make([]string, len(chunk.Hashes))
+		for j, hash := range chunk.Hashes {
+			hashes[j] = string(hash)
+		}
+		encoded[i] = &twirp.ChunkVersionHashes{
+			Chunk:   uint64(chunk.Chunk),
+			Version: uint64(chunk.Version),
+			Hashes:  hashes,
+		}
+	}
+
+	return &twirp.Chunkserver_ListAllChunksWithHashes_Result{
+		Chunks: encoded,
+	}, exportError(err)
 }
 
-func (p *proxyChunkserverAsTwirp) ListAllChunks(context.Context,
-	*twirp.Nothing) (*twirp.Chunkserver_ListAllChunks_Result, error) {
-	chunks, err := p.server.ListAllChunks()
+func (p *proxyChunkserverAsTwirp) ListChunks(context context.Context,
+	input *twirp.Chunkserver_ListChunks) (result *twirp.Chunkserver_ListAllChunks_Result, err error) {
+	defer recoverAsInternalError("ListChunks", &err)
+	chunks, err := p.server.ListChunks(apis.ChunkFilter{
+		FirstChunk: apis.ChunkNum(input.FirstChunk),
+		LastChunk:  apis.ChunkNum(input.LastChunk),
+		MinVersion: apis.Version(input.MinVersion),
+		MaxVersion: apis.Version(input.MaxVersion),
+	})
 
 	chunkVersions := make([]*twirp.ChunkVersion, len(chunks))
 	for i, chunk := range chunks {
@@ -91,100 +207,433 @@ func (p *proxyChunkserverAsTwirp) ListAllChunks(context.Context,
 
 	return &twirp.Chunkserver_ListAllChunks_Result{
 		Chunks: chunkVersions,
-	}, err
+	}, exportError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) ListTombstones(context context.Context,
+	input *twirp.Nothing) (result *twirp.Chunkserver_ListTombstones_Result, err error) {
+	defer recoverAsInternalError("ListTombstones", &err)
+	tombstones, err := p.server.ListTombstones()
+
+	encoded := make([]*twirp.Tombstone, len(tombstones))
+	for i, tombstone := range tombstones {
+		encoded[i] = &twirp.Tombstone{
+			Chunk:   uint64(tombstone.Chunk),
+			Version: uint64(tombstone.Version),
+			Deleted: tombstone.Deleted.UnixNano(),
+		}
+	}
+
+	return &twirp.Chunkserver_ListTombstones_Result{
+		Tombstones: encoded,
+	}, exportError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) ForgetTombstone(context context.Context, input *twirp.Chunkserver_ForgetTombstone) (result *twirp.Nothing, err error) {
+	defer recoverAsInternalError("ForgetTombstone", &err)
+	err = p.server.ForgetTombstone(apis.ChunkNum(input.Chunk))
+	return &twirp.Nothing{}, exportError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) GetStats(context context.Context,
+	input *twirp.Nothing) (result *twirp.Chunkserver_GetStats_Result, err error) {
+	defer recoverAsInternalError("GetStats", &err)
+	stats, err := p.server.GetStats()
+	if err != nil {
+		return nil, exportError(err)
+	}
+
+	return &twirp.Chunkserver_GetStats_Result{
+		UsedBytes:            stats.UsedBytes,
+		Quota:                stats.Quota,
+		Chunks:               stats.Chunks,
+		Versions:             stats.Versions,
+		MinVersionsPerChunk:  stats.MinVersionsPerChunk,
+		MaxVersionsPerChunk:  stats.MaxVersionsPerChunk,
+		MeanVersionsPerChunk: stats.MeanVersionsPerChunk,
+		StagedWrites:         stats.StagedWrites,
+		StagedBytes:          stats.StagedBytes,
+		LogicalBytes:         stats.LogicalBytes,
+		PhysicalBytes:        stats.PhysicalBytes,
+		StoredBytes:          stats.StoredBytes,
+		AllocatedBytes:       stats.AllocatedBytes,
+		OpenFiles:            stats.OpenFiles,
+		Durability:           stats.Durability,
+		ReadAheadHits:        stats.ReadAheadHits,
+		ReadAheadMisses:      stats.ReadAheadMisses,
+		ThrottledTransfers:   stats.ThrottledTransfers,
+		RejectedTransfers:    stats.RejectedTransfers,
+		Uptime:               int64(stats.Uptime),
+		Operations:           exportOperationStats(stats.Operations),
+		SlowOperationThresholds: &twirp.SlowOperationThresholds{
+			Data:    int64(stats.SlowOperationThresholds.Data),
+			Control: int64(stats.SlowOperationThresholds.Control),
+		},
+		SlowOperations:           stats.SlowOperations,
+		CompactionPaused:         stats.CompactionPaused,
+		CompactionProgress:       stats.CompactionProgress,
+		CompactionPasses:         stats.CompactionPasses,
+		CompactionReclaimedBytes: stats.CompactionReclaimedBytes,
+		StorageCounters:          stats.StorageCounters,
+		StorageLatencies:         exportOperationStats(stats.StorageLatencies),
+		VerifyRuns:               stats.VerifyRuns,
+		VerifyOK:                 stats.VerifyOK,
+		VerifyCorrupt:            stats.VerifyCorrupt,
+		VerifyMissing:            stats.VerifyMissing,
+	}, nil
+}
+
+func exportOperationStats(stats map[string]apis.OperationStats) map[string]*twirp.OperationStats {
+	exported := map[string]*twirp.OperationStats{}
+	for name, op := range stats {
+		errorsByCode := map[string]uint64{}
+		for code, count := range op.ErrorsByCode {
+			errorsByCode[string(code)] = count
+		}
+		exported[name] = &twirp.OperationStats{
+			Calls:            op.Calls,
+			Errors:           op.Errors,
+			Bytes:            op.Bytes,
+			TotalLatency:     int64(op.TotalLatency),
+			LatencyHistogram: op.LatencyHistogram[:],
+			ErrorsByCode:     errorsByCode,
+		}
+	}
+	return exported
+}
+
+func (p *proxyChunkserverAsTwirp) SetSlowOperationThresholds(context context.Context,
+	input *twirp.SlowOperationThresholds) (result *twirp.Nothing, err error) {
+	defer recoverAsInternalError("SetSlowOperationThresholds", &err)
+	err = p.server.SetSlowOperationThresholds(apis.SlowOperationThresholds{
+		Data:    time.Duration(input.Data),
+		Control: time.Duration(input.Control),
+	})
+	return &twirp.Nothing{}, exportError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) SetCompactionPaused(context context.Context,
+	input *twirp.Chunkserver_SetCompactionPaused) (result *twirp.Nothing, err error) {
+	defer recoverAsInternalError("SetCompactionPaused", &err)
+	err = p.server.SetCompactionPaused(input.Paused)
+	return &twirp.Nothing{}, exportError(err)
+}
+
+func (p *proxyChunkserverAsTwirp) VerifyAll(context context.Context,
+	input *twirp.Chunkserver_VerifyAll) (result *twirp.Chunkserver_VerifyAll_Result, err error) {
+	defer recoverAsInternalError("VerifyAll", &err)
+	var findings []*twirp.VerifyFinding
+	// the check stops if the client gives up on the request
+	report, err := p.server.VerifyAll(context, apis.VerifyOptions{
+		BytesPerSecond: input.BytesPerSecond,
+		IncludeOK:      input.IncludeOK,
+	}, func(finding apis.VerifyFinding) {
+		findings = append(findings, &twirp.VerifyFinding{
+			Chunk:   uint64(finding.Chunk),
+			Version: uint64(finding.Version),
+			Status:  int32(finding.Status),
+			Detail:  finding.Detail,
+		})
+	})
+	if err != nil {
+		return nil, exportError(err)
+	}
+	return &twirp.Chunkserver_VerifyAll_Result{
+		Ok:       report.OK,
+		Corrupt:  report.Corrupt,
+		Missing:  report.Missing,
+		Bytes:    report.Bytes,
+		Findings: findings,
+	}, nil
 }
 
 type proxyTwirpAsChunkserver struct {
 	server twirp.Chunkserver
+	// used for reads of at least BulkReadThreshold bytes, unless nil
+	bulk *bulkReadClient
+	// what every request is made with, unless a method is given a context of its own; nil means context.Background()
+	ctx context.Context
+}
+
+func (p *proxyTwirpAsChunkserver) requestContext() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
+// Returns a version of a chunkserver that makes every request with ctx, so that a server passing a request along to
+// another chunkserver can pass along the request's deadline, cancellation, and caller too. A chunkserver that isn't
+// reached through this package is returned as it is.
+func ChunkserverWithContext(ctx context.Context, server apis.Chunkserver) apis.Chunkserver {
+	switch server := server.(type) {
+	case *proxyTwirpAsChunkserver:
+		bound := *server
+		bound.ctx = ctx
+		return &bound
+	case *faultyChunkserver:
+		bound := *server
+		bound.server = ChunkserverWithContext(ctx, server.server)
+		return &bound
+	}
+	return server
 }
 
 func (p *proxyTwirpAsChunkserver) StartWriteReplicated(chunk apis.ChunkNum, offset uint32, data []byte,
 	replicas []apis.ServerAddress) error {
+	return p.StartWriteReplicatedWithContext(p.requestContext(), chunk, offset, data, replicas)
+}
 
-	_, err := p.server.StartWriteReplicated(context.Background(), &twirp.Chunkserver_StartWriteReplicated{
+func (p *proxyTwirpAsChunkserver) StartWriteReplicatedWithContext(ctx context.Context, chunk apis.ChunkNum, offset uint32,
+	data []byte, replicas []apis.ServerAddress) error {
+	_, err := p.server.StartWriteReplicated(ctx, &twirp.Chunkserver_StartWriteReplicated{
 		Chunk:     uint64(chunk),
 		Offset:    offset,
 		Data:      data,
 		Addresses: AddressArrayToStringArray(replicas),
 	})
-	return err
+	return importError(err)
 }
 
 func (p *proxyTwirpAsChunkserver) Replicate(chunk apis.ChunkNum, serverAddress apis.ServerAddress,
 	version apis.Version) error {
-	_, err := p.server.Replicate(context.Background(), &twirp.Chunkserver_Replicate{
+	return p.ReplicateWithContext(p.requestContext(), chunk, serverAddress, version)
+}
+
+func (p *proxyTwirpAsChunkserver) ReplicateWithContext(ctx context.Context, chunk apis.ChunkNum,
+	serverAddress apis.ServerAddress, version apis.Version) error {
+	_, err := p.server.Replicate(ctx, &twirp.Chunkserver_Replicate{
 		Chunk:         uint64(chunk),
 		ServerAddress: string(serverAddress),
 		Version:       uint64(version),
 	})
-	return err
+	return importError(err)
+}
+
+func (p *proxyTwirpAsChunkserver) Push(chunk apis.ChunkNum, serverAddress apis.ServerAddress) (apis.Version, error) {
+	return p.PushWithContext(p.requestContext(), chunk, serverAddress)
+}
+
+func (p *proxyTwirpAsChunkserver) PushWithContext(ctx context.Context, chunk apis.ChunkNum,
+	serverAddress apis.ServerAddress) (apis.Version, error) {
+	result, err := p.server.Push(ctx, &twirp.Chunkserver_Push{
+		Chunk:         uint64(chunk),
+		ServerAddress: string(serverAddress),
+	})
+	if err != nil {
+		return 0, importError(err)
+	}
+	return apis.Version(result.Version), nil
+}
+
+func (p *proxyTwirpAsChunkserver) RepairChunk(chunk apis.ChunkNum, version apis.Version, checksum uint32,
+	sources []apis.ServerAddress) (apis.ServerAddress, error) {
+	return p.RepairChunkWithContext(p.requestContext(), chunk, version, checksum, sources)
+}
+
+func (p *proxyTwirpAsChunkserver) RepairChunkWithContext(ctx context.Context, chunk apis.ChunkNum, version apis.Version,
+	checksum uint32, sources []apis.ServerAddress) (apis.ServerAddress, error) {
+	result, err := p.server.RepairChunk(ctx, &twirp.Chunkserver_RepairChunk{
+		Chunk:    uint64(chunk),
+		Version:  uint64(version),
+		Checksum: checksum,
+		Sources:  AddressArrayToStringArray(sources),
+	})
+	if err != nil {
+		return "", importError(err)
+	}
+	return apis.ServerAddress(result.Source), nil
 }
 
 func (p *proxyTwirpAsChunkserver) Read(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, error) {
-	result, err := p.server.Read(context.Background(), &twirp.Chunkserver_Read{
+	if length >= BulkReadThreshold && p.bulk != nil && p.bulk.supported() {
+		data, version, err := p.bulk.read(chunk, offset, length, minimum)
+		if err != errBulkUnsupported {
+			return data, version, err
+		}
+	}
+	result, err := p.server.Read(p.requestContext(), &twirp.Chunkserver_Read{
 		Chunk:   uint64(chunk),
 		Offset:  offset,
 		Length:  length,
 		Version: uint64(minimum),
 	})
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, importError(err)
 	}
 	if result.Error != "" {
-		return nil, apis.Version(result.Version), errors.New(result.Error)
+		return nil, apis.Version(result.Version), readErrorFromFields(result.Error, result.ErrorCode, apis.Version(result.Version))
 	}
 	return result.Data, apis.Version(result.Version), nil
 }
 
 func (p *proxyTwirpAsChunkserver) StartWrite(chunk apis.ChunkNum, offset uint32, data []byte) error {
-	_, err := p.server.StartWrite(context.Background(), &twirp.Chunkserver_StartWrite{
+	_, err := p.server.StartWrite(p.requestContext(), &twirp.Chunkserver_StartWrite{
 		Chunk:  uint64(chunk),
 		Offset: offset,
 		Data:   data,
 	})
-	return err
+	return importError(err)
 }
 
 func (p *proxyTwirpAsChunkserver) CommitWrite(chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version,
 	newVersion apis.Version) error {
-	_, err := p.server.CommitWrite(context.Background(), &twirp.Chunkserver_CommitWrite{
+	_, err := p.server.CommitWrite(p.requestContext(), &twirp.Chunkserver_CommitWrite{
 		Chunk:      uint64(chunk),
 		Hash:       string(hash),
 		OldVersion: uint64(oldVersion),
 		NewVersion: uint64(newVersion),
 	})
-	return err
+	return importError(err)
+}
+
+func (p *proxyTwirpAsChunkserver) CommitWriteBatch(commits []apis.CommitWriteRequest) ([]error, error) {
+	input := &twirp.Chunkserver_CommitWriteBatch{
+		Commits: make([]*twirp.Chunkserver_CommitWrite, len(commits)),
+	}
+	for i, c := range commits {
+		input.Commits[i] = &twirp.Chunkserver_CommitWrite{
+			Chunk:      uint64(c.Chunk),
+			Hash:       string(c.Hash),
+			OldVersion: uint64(c.OldVersion),
+			NewVersion: uint64(c.NewVersion),
+		}
+	}
+	result, err := p.server.CommitWriteBatch(p.requestContext(), input)
+	if err != nil {
+		return nil, importError(err)
+	}
+	if len(result.Outcomes) != len(commits) {
+		return nil, fmt.Errorf("expected %d outcomes from batch commit, but got %d", len(commits), len(result.Outcomes))
+	}
+	results := make([]error, len(commits))
+	for i, outcome := range result.Outcomes {
+		if outcome.Error != "" {
+			results[i] = readErrorFromFields(outcome.Error, outcome.ErrorCode, apis.Version(outcome.Version))
+		}
+	}
+	return results, nil
 }
 
 func (p *proxyTwirpAsChunkserver) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.Version,
 	newVersion apis.Version) error {
-	_, err := p.server.UpdateLatestVersion(context.Background(), &twirp.Chunkserver_UpdateLatestVersion{
+	_, err := p.server.UpdateLatestVersion(p.requestContext(), &twirp.Chunkserver_UpdateLatestVersion{
 		Chunk:      uint64(chunk),
 		OldVersion: uint64(oldVersion),
 		NewVersion: uint64(newVersion),
 	})
-	return err
+	return importError(err)
+}
+
+func (p *proxyTwirpAsChunkserver) OverrideLatestVersion(chunk apis.ChunkNum, version apis.Version) error {
+	_, err := p.server.UpdateLatestVersion(p.requestContext(), &twirp.Chunkserver_UpdateLatestVersion{
+		Chunk:      uint64(chunk),
+		NewVersion: uint64(version),
+		Override:   true,
+	})
+	return importError(err)
 }
 
 func (p *proxyTwirpAsChunkserver) Add(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
-	_, err := p.server.Add(context.Background(), &twirp.Chunkserver_Add{
+	_, err := p.server.Add(p.requestContext(), &twirp.Chunkserver_Add{
+		Chunk:       uint64(chunk),
+		InitialData: initialData,
+		Version:     uint64(initialVersion),
+	})
+	return importError(err)
+}
+
+func (p *proxyTwirpAsChunkserver) AddWithMode(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version, mode apis.AddMode) error {
+	_, err := p.server.Add(p.requestContext(), &twirp.Chunkserver_Add{
 		Chunk:       uint64(chunk),
 		InitialData: initialData,
 		Version:     uint64(initialVersion),
+		Mode:        int32(mode),
 	})
-	return err
+	return importError(err)
+}
+
+func (p *proxyTwirpAsChunkserver) ForceAdd(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
+	_, err := p.server.Add(p.requestContext(), &twirp.Chunkserver_Add{
+		Chunk:       uint64(chunk),
+		InitialData: initialData,
+		Version:     uint64(initialVersion),
+		Overwrite:   true,
+	})
+	return importError(err)
+}
+
+func (p *proxyTwirpAsChunkserver) ForceAddChecked(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version, checksum uint32) error {
+	_, err := p.server.Add(p.requestContext(), &twirp.Chunkserver_Add{
+		Chunk:       uint64(chunk),
+		InitialData: initialData,
+		Version:     uint64(initialVersion),
+		Overwrite:   true,
+		Checked:     true,
+		Checksum:    checksum,
+	})
+	return importError(err)
 }
 
 func (p *proxyTwirpAsChunkserver) Delete(chunk apis.ChunkNum, version apis.Version) error {
-	_, err := p.server.Delete(context.Background(), &twirp.Chunkserver_Delete{
+	_, err := p.server.Delete(p.requestContext(), &twirp.Chunkserver_Delete{
 		Chunk:   uint64(chunk),
 		Version: uint64(version),
 	})
-	return err
+	return importError(err)
+}
+
+func (p *proxyTwirpAsChunkserver) ListAllChunks(minimum apis.Version, maximum apis.Version) ([]apis.ChunkVersion, error) {
+	result, err := p.server.ListAllChunks(p.requestContext(), &twirp.Chunkserver_ListAllChunks{
+		MinVersion: uint64(minimum),
+		MaxVersion: uint64(maximum),
+	})
+	if err != nil {
+		return nil, importError(err)
+	}
+	decoded := make([]apis.ChunkVersion, len(result.Chunks))
+	for i, v := range result.Chunks {
+		decoded[i] = apis.ChunkVersion{
+			Chunk:   apis.ChunkNum(v.Chunk),
+			Version: apis.Version(v.Version),
+		}
+	}
+	return decoded, nil
+}
+
+func (p *proxyTwirpAsChunkserver) ListAllChunksWithHashes(minimum apis.Version, maximum apis.Version) ([]apis.ChunkVersionHashes, error) {
+	result, err := p.server.ListAllChunksWithHashes(p.requestContext(), &twirp.Chunkserver_ListAllChunks{
+		MinVersion: uint64(minimum),
+		MaxVersion: uint64(maximum),
+	})
+	if err != nil {
+		return nil, importError(err)
+	}
+	decoded := make([]apis.ChunkVersionHashes, len(result.Chunks))
+	for i, v := range result.Chunks {
+		var hashes []apis.CommitHash
+		for _, hash := range v.Hashes {
+			hashes = append(hashes, apis.CommitHash(hash))
+		}
+		decoded[i] = apis.ChunkVersionHashes{
+			Chunk:   apis.ChunkNum(v.Chunk),
+			Version: apis.Version(v.Version),
+			Hashes:  hashes,
+		}
+	}
+	return decoded, nil
 }
 
-func (p *proxyTwirpAsChunkserver) ListAllChunks() ([]apis.ChunkVersion, error) {
-	result, err := p.server.ListAllChunks(context.Background(), &twirp.Nothing{})
+func (p *proxyTwirpAsChunkserver) ListChunks(filter apis.ChunkFilter) ([]apis.ChunkVersion, error) {
+	result, err := p.server.ListChunks(p.requestContext(), &twirp.Chunkserver_ListChunks{
+		FirstChunk: uint64(filter.FirstChunk),
+		LastChunk:  uint64(filter.LastChunk),
+		MinVersion: uint64(filter.MinVersion),
+		MaxVersion: uint64(filter.MaxVersion),
+	})
+	if err != nil {
+		return nil, importError(err)
+	}
 	decoded := make([]apis.ChunkVersion, len(result.Chunks))
 	for i, v := range result.Chunks {
 		decoded[i] = apis.ChunkVersion{
@@ -192,5 +641,148 @@ func (p *proxyTwirpAsChunkserver) ListAllChunks() ([]apis.ChunkVersion, error) {
 			Version: apis.Version(v.Version),
 		}
 	}
-	return decoded, err
+	return decoded, nil
+}
+
+func (p *proxyTwirpAsChunkserver) ListTombstones() ([]apis.Tombstone, error) {
+	result, err := p.server.ListTombstones(p.requestContext(), &twirp.Nothing{})
+	if err != nil {
+		return nil, importError(err)
+	}
+	decoded := make([]apis.Tombstone, len(result.Tombstones))
+	for i, tombstone := range result.Tombstones {
+		decoded[i] = apis.Tombstone{
+			Chunk:   apis.ChunkNum(tombstone.Chunk),
+			Version: apis.Version(tombstone.Version),
+			Deleted: time.Unix(0, tombstone.Deleted),
+		}
+	}
+	return decoded, nil
+}
+
+func (p *proxyTwirpAsChunkserver) ForgetTombstone(chunk apis.ChunkNum) error {
+	_, err := p.server.ForgetTombstone(p.requestContext(), &twirp.Chunkserver_ForgetTombstone{
+		Chunk: uint64(chunk),
+	})
+	return importError(err)
+}
+
+func (p *proxyTwirpAsChunkserver) SetSlowOperationThresholds(thresholds apis.SlowOperationThresholds) error {
+	_, err := p.server.SetSlowOperationThresholds(p.requestContext(), &twirp.SlowOperationThresholds{
+		Data:    int64(thresholds.Data),
+		Control: int64(thresholds.Control),
+	})
+	return importError(err)
+}
+
+func (p *proxyTwirpAsChunkserver) SetCompactionPaused(paused bool) error {
+	_, err := p.server.SetCompactionPaused(p.requestContext(), &twirp.Chunkserver_SetCompactionPaused{
+		Paused: paused,
+	})
+	return importError(err)
+}
+
+// The findings only arrive once the whole check has finished, and are then handed to found one at a time. Cancelling
+// ctx, or a check that outlasts the client's request timeout, abandons the request, which stops the check on the
+// chunkserver as well.
+func (p *proxyTwirpAsChunkserver) VerifyAll(ctx context.Context, options apis.VerifyOptions, found func(apis.VerifyFinding)) (apis.VerifyReport, error) {
+	result, err := p.server.VerifyAll(ctx, &twirp.Chunkserver_VerifyAll{
+		BytesPerSecond: options.BytesPerSecond,
+		IncludeOK:      options.IncludeOK,
+	})
+	if err != nil {
+		return apis.VerifyReport{}, importError(err)
+	}
+	report := apis.VerifyReport{
+		OK:      result.Ok,
+		Corrupt: result.Corrupt,
+		Missing: result.Missing,
+		Bytes:   result.Bytes,
+	}
+	if found != nil {
+		for _, finding := range result.Findings {
+			found(apis.VerifyFinding{
+				Chunk:   apis.ChunkNum(finding.Chunk),
+				Version: apis.Version(finding.Version),
+				Status:  apis.VerifyStatus(finding.Status),
+				Detail:  finding.Detail,
+			})
+		}
+	}
+	return report, nil
+}
+
+func (p *proxyTwirpAsChunkserver) GetStats() (apis.ChunkserverStats, error) {
+	result, err := p.server.GetStats(p.requestContext(), &twirp.Nothing{})
+	if err != nil {
+		return apis.ChunkserverStats{}, importError(err)
+	}
+	stats := apis.ChunkserverStats{
+		UsedBytes:            result.UsedBytes,
+		Quota:                result.Quota,
+		Chunks:               result.Chunks,
+		Versions:             result.Versions,
+		MinVersionsPerChunk:  result.MinVersionsPerChunk,
+		MaxVersionsPerChunk:  result.MaxVersionsPerChunk,
+		MeanVersionsPerChunk: result.MeanVersionsPerChunk,
+		StagedWrites:         result.StagedWrites,
+		StagedBytes:          result.StagedBytes,
+		LogicalBytes:         result.LogicalBytes,
+		PhysicalBytes:        result.PhysicalBytes,
+		StoredBytes:          result.StoredBytes,
+		AllocatedBytes:       result.AllocatedBytes,
+		OpenFiles:            result.OpenFiles,
+		Durability:           result.Durability,
+		ReadAheadHits:        result.ReadAheadHits,
+		ReadAheadMisses:      result.ReadAheadMisses,
+		ThrottledTransfers:   result.ThrottledTransfers,
+		RejectedTransfers:    result.RejectedTransfers,
+		Uptime:               time.Duration(result.Uptime),
+		SlowOperations:       result.SlowOperations,
+
+		CompactionPaused:         result.CompactionPaused,
+		CompactionProgress:       result.CompactionProgress,
+		CompactionPasses:         result.CompactionPasses,
+		CompactionReclaimedBytes: result.CompactionReclaimedBytes,
+
+		VerifyRuns:    result.VerifyRuns,
+		VerifyOK:      result.VerifyOK,
+		VerifyCorrupt: result.VerifyCorrupt,
+		VerifyMissing: result.VerifyMissing,
+	}
+	if result.SlowOperationThresholds != nil {
+		stats.SlowOperationThresholds = apis.SlowOperationThresholds{
+			Data:    time.Duration(result.SlowOperationThresholds.Data),
+			Control: time.Duration(result.SlowOperationThresholds.Control),
+		}
+	}
+	stats.Operations = importOperationStats(result.Operations)
+	if len(result.StorageCounters) > 0 {
+		stats.StorageCounters = result.StorageCounters
+	}
+	stats.StorageLatencies = importOperationStats(result.StorageLatencies)
+	return stats, nil
+}
+
+// Returns nil if there's nothing to import, as for a chunkserver that isn't metered.
+func importOperationStats(exported map[string]*twirp.OperationStats) map[string]apis.OperationStats {
+	if len(exported) == 0 {
+		return nil
+	}
+	stats := map[string]apis.OperationStats{}
+	for name, op := range exported {
+		decoded := apis.OperationStats{
+			Calls:        op.Calls,
+			Errors:       op.Errors,
+			Bytes:        op.Bytes,
+			TotalLatency: time.Duration(op.TotalLatency),
+			ErrorsByCode: map[apis.ErrorCode]uint64{},
+		}
+		copy(decoded.LatencyHistogram[:], op.LatencyHistogram)
+		for code, count := range op.ErrorsByCode {
+			decoded.ErrorsByCode[apis.ErrorCode(code)] = count
+		}
+		stats[name] = decoded
+	}
+	return stats
 }
@@ -1,9 +1,12 @@
 package rpc
 
 import (
+	"context"
 	"errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"testing"
+	"time"
 	"zircon/apis"
 	"zircon/apis/mocks"
 )
@@ -30,9 +33,9 @@ func TestChunkserver_StartWriteReplicated(t *testing.T) {
 	mocked, teardown, server := beginChunkserverTest(t)
 	defer teardown()
 
-	mocked.On("StartWriteReplicated", apis.ChunkNum(73), uint32(55), []byte("this is a hello\000 world!!\n"),
+	mocked.On("StartWriteReplicatedWithContext", mock.Anything, apis.ChunkNum(73), uint32(55), []byte("this is a hello\000 world!!\n"),
 		[]apis.ServerAddress{"abc", "def", "ghi.mit.edu"}).Return(nil)
-	mocked.On("StartWriteReplicated", apis.ChunkNum(0), uint32(0), []byte("|||"),
+	mocked.On("StartWriteReplicatedWithContext", mock.Anything, apis.ChunkNum(0), uint32(0), []byte("|||"),
 		[]apis.ServerAddress{}).Return(errors.New("hello world 01"))
 
 	err := server.StartWriteReplicated(73, 55, []byte("this is a hello\000 world!!\n"),
@@ -48,14 +51,80 @@ func TestChunkserver_Replicate(t *testing.T) {
 	mocked, teardown, server := beginChunkserverTest(t)
 	defer teardown()
 
-	mocked.On("Replicate", apis.ChunkNum(74), apis.ServerAddress("jkl.mit.edu"), apis.Version(56)).Return(nil)
-	mocked.On("Replicate", apis.ChunkNum(0), apis.ServerAddress(""), apis.Version(0)).Return(errors.New("hello world 02"))
+	mocked.On("ReplicateWithContext", mock.Anything, apis.ChunkNum(74), apis.ServerAddress("jkl.mit.edu"), apis.Version(56)).Return(nil)
+	mocked.On("ReplicateWithContext", mock.Anything, apis.ChunkNum(0), apis.ServerAddress(""), apis.Version(0)).Return(errors.New("hello world 02"))
+	mocked.On("ReplicateWithContext", mock.Anything, apis.ChunkNum(75), apis.ServerAddress("jkl.mit.edu"), apis.Version(56)).Return(
+		apis.NewRetryableError(apis.ErrSourceBusy, 3*time.Second, "hello world 02b"))
 
 	assert.NoError(t, server.Replicate(74, "jkl.mit.edu", 56))
 
 	err := server.Replicate(0, "", 0)
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "hello world 02")
+
+	// the suggested wait makes it across the wire
+	err = server.Replicate(75, "jkl.mit.edu", 56)
+	assert.Equal(t, apis.ErrSourceBusy, apis.ErrorCodeOf(err))
+	assert.Equal(t, 3*time.Second, apis.RetryAfterOf(err))
+}
+
+func TestChunkserver_Push(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("PushWithContext", mock.Anything, apis.ChunkNum(74), apis.ServerAddress("jkl.mit.edu")).Return(apis.Version(56), nil)
+	mocked.On("PushWithContext", mock.Anything, apis.ChunkNum(75), apis.ServerAddress("jkl.mit.edu")).Return(apis.Version(0),
+		apis.NewError(apis.ErrChunkExists, 57, "hello world 02"))
+
+	version, err := server.Push(74, "jkl.mit.edu")
+	assert.NoError(t, err)
+	assert.Equal(t, apis.Version(56), version)
+
+	_, err = server.Push(75, "jkl.mit.edu")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "hello world 02")
+	assert.Equal(t, apis.ErrChunkExists, apis.ErrorCodeOf(err))
+	assert.Equal(t, apis.Version(57), err.(*apis.Error).Version)
+}
+
+func TestChunkserver_RepairChunk(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("RepairChunkWithContext", mock.Anything, apis.ChunkNum(74), apis.Version(56), uint32(0xDEADBEEF),
+		[]apis.ServerAddress{"abc.mit.edu", "jkl.mit.edu"}).Return(apis.ServerAddress("jkl.mit.edu"), nil)
+	mocked.On("RepairChunkWithContext", mock.Anything, apis.ChunkNum(75), apis.Version(57), uint32(0),
+		[]apis.ServerAddress{}).Return(apis.ServerAddress(""), errors.New("hello world 02a"))
+
+	source, err := server.RepairChunk(74, 56, 0xDEADBEEF, []apis.ServerAddress{"abc.mit.edu", "jkl.mit.edu"})
+	assert.NoError(t, err)
+	assert.Equal(t, apis.ServerAddress("jkl.mit.edu"), source)
+
+	_, err = server.RepairChunk(75, 57, 0, []apis.ServerAddress{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "hello world 02a")
+}
+
+func TestChunkserver_WithContext(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	fromUpstream := mock.MatchedBy(func(ctx context.Context) bool {
+		return apis.CallerFrom(ctx) == "upstream"
+	})
+	mocked.On("PushWithContext", fromUpstream, apis.ChunkNum(74), apis.ServerAddress("jkl.mit.edu")).Return(apis.Version(56), nil)
+
+	// even the methods that don't take a context pass on the one the server was bound to
+	bound := ChunkserverWithContext(apis.WithCaller(context.Background(), "upstream"), server)
+	version, err := bound.Push(74, "jkl.mit.edu")
+	assert.NoError(t, err)
+	assert.Equal(t, apis.Version(56), version)
+
+	// and a request that's already been cancelled is never sent
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ChunkserverWithContext(ctx, server).Push(75, "jkl.mit.edu")
+	assert.Error(t, err)
 }
 
 func TestChunkserver_Read(t *testing.T) {
@@ -76,6 +145,25 @@ func TestChunkserver_Read(t *testing.T) {
 	assert.Contains(t, err.Error(), "hello world 03")
 }
 
+func TestChunkserver_ReadNotFound(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("Read", apis.ChunkNum(75), uint32(0), uint32(0), apis.AnyVersion).Return([]byte{}, apis.Version(60), nil)
+	mocked.On("Read", apis.ChunkNum(76), uint32(0), uint32(0), apis.AnyVersion).Return(nil, apis.Version(0),
+		apis.NewError(apis.ErrChunkNotFound, 0, "hello world 03a"))
+
+	// a chunk that exists, but that nothing was read from, is not the same as a missing chunk
+	data, ver, err := server.Read(75, 0, 0, apis.AnyVersion)
+	assert.NoError(t, err)
+	assert.Empty(t, data)
+	assert.Equal(t, apis.Version(60), ver)
+
+	_, _, err = server.Read(76, 0, 0, apis.AnyVersion)
+	assert.Equal(t, apis.ErrChunkNotFound, apis.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "hello world 03a")
+}
+
 func TestChunkserver_StartWrite(t *testing.T) {
 	mocked, teardown, server := beginChunkserverTest(t)
 	defer teardown()
@@ -104,6 +192,35 @@ func TestChunkserver_CommitWrite(t *testing.T) {
 	assert.Contains(t, err.Error(), "hello world 05")
 }
 
+func TestChunkserver_CommitWriteBatch(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	commits := []apis.CommitWriteRequest{
+		{Chunk: 77, Hash: "this is my hash", OldVersion: 62, NewVersion: 63},
+		{Chunk: 78, Hash: "this is another", OldVersion: 64, NewVersion: 65},
+	}
+	mocked.On("CommitWriteBatch", commits).Return([]error{
+		nil,
+		apis.NewError(apis.ErrWrongVersion, 66, "hello world 05a"),
+	}, nil)
+	mocked.On("CommitWriteBatch", []apis.CommitWriteRequest{}).Return(nil, errors.New("hello world 05b"))
+
+	results, err := server.CommitWriteBatch(commits)
+	assert.NoError(t, err)
+	if assert.Len(t, results, 2) {
+		assert.NoError(t, results[0])
+		assert.Error(t, results[1])
+		assert.Contains(t, results[1].Error(), "hello world 05a")
+		assert.Equal(t, apis.ErrWrongVersion, apis.ErrorCodeOf(results[1]))
+		assert.Equal(t, apis.Version(66), results[1].(*apis.Error).Version)
+	}
+
+	_, err = server.CommitWriteBatch([]apis.CommitWriteRequest{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "hello world 05b")
+}
+
 func TestChunkserver_UpdateLatestVersion(t *testing.T) {
 	mocked, teardown, server := beginChunkserverTest(t)
 	defer teardown()
@@ -118,6 +235,54 @@ func TestChunkserver_UpdateLatestVersion(t *testing.T) {
 	assert.Contains(t, err.Error(), "hello world 06")
 }
 
+func TestChunkserver_OutOfBounds_Typed(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("Read", apis.ChunkNum(79), uint32(1<<31), uint32(1), apis.AnyVersion).Return(
+		nil, apis.Version(0), apis.NewError(apis.ErrOutOfBounds, 0, "hello world 06c"))
+	mocked.On("StartWrite", apis.ChunkNum(79), uint32(1<<31), []byte("x")).Return(
+		apis.NewError(apis.ErrOutOfBounds, 0, "hello world 06d"))
+
+	_, _, err := server.Read(79, 1<<31, 1, apis.AnyVersion)
+	assert.Equal(t, apis.ErrOutOfBounds, apis.ErrorCodeOf(err))
+
+	err = server.StartWrite(79, 1<<31, []byte("x"))
+	assert.Equal(t, apis.ErrOutOfBounds, apis.ErrorCodeOf(err))
+}
+
+func TestChunkserver_UpdateLatestVersion_Typed(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("UpdateLatestVersion", apis.ChunkNum(78), apis.Version(65), apis.Version(64)).Return(
+		apis.NewError(apis.ErrVersionRollback, 65, "hello world 06a"))
+	mocked.On("UpdateLatestVersion", apis.ChunkNum(78), apis.Version(63), apis.Version(66)).Return(
+		apis.NewError(apis.ErrWrongVersion, 65, "hello world 06b"))
+
+	err := server.UpdateLatestVersion(78, 65, 64)
+	assert.Equal(t, apis.ErrVersionRollback, apis.ErrorCodeOf(err))
+	assert.Equal(t, apis.Version(65), err.(*apis.Error).Version)
+
+	err = server.UpdateLatestVersion(78, 63, 66)
+	assert.Equal(t, apis.ErrWrongVersion, apis.ErrorCodeOf(err))
+	assert.Equal(t, apis.Version(65), err.(*apis.Error).Version)
+}
+
+func TestChunkserver_OverrideLatestVersion(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("OverrideLatestVersion", apis.ChunkNum(78), apis.Version(64)).Return(nil)
+	mocked.On("OverrideLatestVersion", apis.ChunkNum(79), apis.Version(64)).Return(errors.New("hello world 06c"))
+
+	assert.NoError(t, server.OverrideLatestVersion(78, 64))
+
+	err := server.OverrideLatestVersion(79, 64)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "hello world 06c")
+}
+
 func TestChunkserver_Add(t *testing.T) {
 	mocked, teardown, server := beginChunkserverTest(t)
 	defer teardown()
@@ -132,6 +297,53 @@ func TestChunkserver_Add(t *testing.T) {
 	assert.Contains(t, err.Error(), "hello world 07")
 }
 
+func TestChunkserver_AddWithMode(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("AddWithMode", apis.ChunkNum(79), []byte("quest"), apis.Version(66), apis.AddIgnoreIfExists).Return(nil)
+	mocked.On("AddWithMode", apis.ChunkNum(80), []byte("quest"), apis.Version(66), apis.AddOverwriteSameVersion).Return(
+		apis.NewError(apis.ErrChunkExists, 67, "hello world 07a"))
+
+	assert.NoError(t, server.AddWithMode(79, []byte("quest"), 66, apis.AddIgnoreIfExists))
+
+	err := server.AddWithMode(80, []byte("quest"), 66, apis.AddOverwriteSameVersion)
+	assert.Equal(t, apis.ErrChunkExists, apis.ErrorCodeOf(err))
+	assert.Equal(t, apis.Version(67), err.(*apis.Error).Version)
+	assert.Contains(t, err.Error(), "hello world 07a")
+}
+
+func TestChunkserver_ForceAdd(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("ForceAdd", apis.ChunkNum(79), []byte("quest"), apis.Version(66)).Return(nil)
+	mocked.On("ForceAdd", apis.ChunkNum(80), []byte("quest"), apis.Version(66)).Return(
+		apis.NewError(apis.ErrChunkExists, 67, "hello world 07b"))
+
+	assert.NoError(t, server.ForceAdd(79, []byte("quest"), 66))
+
+	err := server.ForceAdd(80, []byte("quest"), 66)
+	assert.Equal(t, apis.ErrChunkExists, apis.ErrorCodeOf(err))
+	assert.Equal(t, apis.Version(67), err.(*apis.Error).Version)
+	assert.Contains(t, err.Error(), "hello world 07b")
+}
+
+func TestChunkserver_ForceAddChecked(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("ForceAddChecked", apis.ChunkNum(79), []byte("quest"), apis.Version(66), uint32(0x1234abcd)).Return(nil)
+	mocked.On("ForceAddChecked", apis.ChunkNum(80), []byte("quest"), apis.Version(66), uint32(0)).Return(
+		apis.NewError(apis.ErrChecksumMismatch, 0, "hello world 07c"))
+
+	assert.NoError(t, server.ForceAddChecked(79, []byte("quest"), 66, 0x1234abcd))
+
+	err := server.ForceAddChecked(80, []byte("quest"), 66, 0)
+	assert.Equal(t, apis.ErrChecksumMismatch, apis.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "hello world 07c")
+}
+
 func TestChunkserver_Delete(t *testing.T) {
 	mocked, teardown, server := beginChunkserverTest(t)
 	defer teardown()
@@ -146,15 +358,34 @@ func TestChunkserver_Delete(t *testing.T) {
 	assert.Contains(t, err.Error(), "hello world 08")
 }
 
+func TestChunkserver_Delete_Typed(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("Delete", apis.ChunkNum(80), apis.Version(67)).Return(
+		apis.NewError(apis.ErrWrongVersion, 68, "hello world 08a"))
+	mocked.On("Delete", apis.ChunkNum(81), apis.Version(67)).Return(
+		apis.NewError(apis.ErrAlreadyDeleted, 0, "hello world 08b"))
+
+	err := server.Delete(80, 67)
+	assert.Equal(t, apis.ErrWrongVersion, apis.ErrorCodeOf(err))
+	assert.Equal(t, apis.Version(68), err.(*apis.Error).Version)
+	assert.Contains(t, err.Error(), "hello world 08a")
+
+	err = server.Delete(81, 67)
+	assert.Equal(t, apis.ErrAlreadyDeleted, apis.ErrorCodeOf(err))
+	assert.Contains(t, err.Error(), "hello world 08b")
+}
+
 func TestChunkserver_ListAllChunks_Pass(t *testing.T) {
 	mocked, teardown, server := beginChunkserverTest(t)
 	defer teardown()
 
-	mocked.On("ListAllChunks").Return([]apis.ChunkVersion{
+	mocked.On("ListAllChunks", apis.AnyVersion, apis.AnyVersion).Return([]apis.ChunkVersion{
 		{81, 68}, {82, 69},
 	}, nil)
 
-	chunks, err := server.ListAllChunks()
+	chunks, err := server.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 	assert.NoError(t, err)
 	assert.Equal(t, []apis.ChunkVersion{
 		{81, 68}, {82, 69},
@@ -165,12 +396,143 @@ func TestChunkserver_ListAllChunks_Fail(t *testing.T) {
 	mocked, teardown, server := beginChunkserverTest(t)
 	defer teardown()
 
-	mocked.On("ListAllChunks").Return([]apis.ChunkVersion{},
+	mocked.On("ListAllChunks", apis.AnyVersion, apis.AnyVersion).Return([]apis.ChunkVersion{},
 		errors.New("hello world 09"))
 
-	chunks, err := server.ListAllChunks()
+	chunks, err := server.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 	if assert.Error(t, err) {
 		assert.Contains(t, err.Error(), "hello world 09")
 	}
 	assert.Empty(t, chunks)
 }
+
+func TestChunkserver_ListAllChunks_Range(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("ListAllChunks", apis.Version(5), apis.Version(9)).Return([]apis.ChunkVersion{
+		{83, 5}, {84, 9},
+	}, nil)
+
+	chunks, err := server.ListAllChunks(5, 9)
+	assert.NoError(t, err)
+	assert.Equal(t, []apis.ChunkVersion{
+		{83, 5}, {84, 9},
+	}, chunks)
+}
+
+func TestChunkserver_ListAllChunksWithHashes(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("ListAllChunksWithHashes", apis.Version(5), apis.AnyVersion).Return([]apis.ChunkVersionHashes{
+		{Chunk: 83, Version: 5, Hashes: []apis.CommitHash{"hash-1", "hash-2"}},
+		{Chunk: 84, Version: 9},
+	}, nil)
+
+	chunks, err := server.ListAllChunksWithHashes(5, apis.AnyVersion)
+	assert.NoError(t, err)
+	assert.Equal(t, []apis.ChunkVersionHashes{
+		{Chunk: 83, Version: 5, Hashes: []apis.CommitHash{"hash-1", "hash-2"}},
+		{Chunk: 84, Version: 9},
+	}, chunks)
+}
+
+func TestChunkserver_ListChunks(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	filter := apis.ChunkFilter{FirstChunk: 80, LastChunk: 90, MinVersion: 2, MaxVersion: 7}
+	mocked.On("ListChunks", filter).Return([]apis.ChunkVersion{{83, 5}, {84, 2}}, nil)
+	mocked.On("ListChunks", apis.ChunkFilter{}).Return([]apis.ChunkVersion{}, errors.New("hello world 09a"))
+
+	chunks, err := server.ListChunks(filter)
+	assert.NoError(t, err)
+	assert.Equal(t, []apis.ChunkVersion{{83, 5}, {84, 2}}, chunks)
+
+	_, err = server.ListChunks(apis.ChunkFilter{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "hello world 09a")
+}
+
+func TestChunkserver_Tombstones(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	deleted := time.Unix(1500000000, 12345)
+	mocked.On("ListTombstones").Return([]apis.Tombstone{
+		{Chunk: 85, Version: 10, Deleted: deleted},
+	}, nil)
+	mocked.On("ForgetTombstone", apis.ChunkNum(85)).Return(nil)
+	mocked.On("ForgetTombstone", apis.ChunkNum(86)).Return(apis.NewError(apis.ErrShuttingDown, 0, "hello world 09b"))
+
+	tombstones, err := server.ListTombstones()
+	assert.NoError(t, err)
+	if assert.Len(t, tombstones, 1) {
+		assert.Equal(t, apis.ChunkNum(85), tombstones[0].Chunk)
+		assert.Equal(t, apis.Version(10), tombstones[0].Version)
+		assert.True(t, deleted.Equal(tombstones[0].Deleted))
+	}
+	assert.NoError(t, server.ForgetTombstone(85))
+	err = server.ForgetTombstone(86)
+	assert.Equal(t, apis.ErrShuttingDown, apis.ErrorCodeOf(err))
+}
+
+func TestChunkserver_GetStats(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	stats := apis.ChunkserverStats{
+		UsedBytes:       3 * apis.MaxChunkSize,
+		Quota:           10 * apis.MaxChunkSize,
+		Chunks:          2,
+		Versions:        3,
+		StagedWrites:    1,
+		StagedBytes:     17,
+		LogicalBytes:    3000,
+		PhysicalBytes:   1000,
+		Durability:      "commit",
+		ReadAheadHits:   40,
+		ReadAheadMisses: 2,
+		Uptime:          time.Minute,
+		SlowOperationThresholds: apis.SlowOperationThresholds{
+			Data:    time.Second,
+			Control: 100 * time.Millisecond,
+		},
+		SlowOperations: 6,
+		Operations: map[string]apis.OperationStats{
+			"Read": {
+				Calls:            5,
+				Errors:           1,
+				Bytes:            400,
+				TotalLatency:     time.Millisecond,
+				LatencyHistogram: [apis.LatencyBucketCount]uint64{4, 1},
+				ErrorsByCode:     map[apis.ErrorCode]uint64{apis.ErrWrongVersion: 1},
+			},
+		},
+	}
+	mocked.On("GetStats").Return(stats, nil).Once()
+	mocked.On("GetStats").Return(apis.ChunkserverStats{}, errors.New("hello world 10"))
+
+	result, err := server.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, stats, result)
+
+	_, err = server.GetStats()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "hello world 10")
+}
+
+func TestChunkserver_SetSlowOperationThresholds(t *testing.T) {
+	mocked, teardown, server := beginChunkserverTest(t)
+	defer teardown()
+
+	mocked.On("SetSlowOperationThresholds", apis.SlowOperationThresholds{Data: time.Second}).Return(nil)
+	mocked.On("SetSlowOperationThresholds", apis.SlowOperationThresholds{Control: -time.Second}).
+		Return(errors.New("hello world 10a"))
+
+	assert.NoError(t, server.SetSlowOperationThresholds(apis.SlowOperationThresholds{Data: time.Second}))
+	err := server.SetSlowOperationThresholds(apis.SlowOperationThresholds{Control: -time.Second})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "hello world 10a")
+}
@@ -0,0 +1,108 @@
+package rpc
+
+import (
+	"crypto/tls"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Transport settings for the HTTP client used to talk to chunkservers. Any field left as zero takes the corresponding
+// value from DefaultChunkserverClientOptions.
+type ChunkserverClientOptions struct {
+	// Limit on the total number of idle connections kept open, across all servers
+	MaxIdleConns int
+	// Limit on the number of idle connections kept open to each individual server. Chunk transfers are large and often
+	// concurrent, so the net/http default of two is far too low and causes connections to be constantly re-established.
+	MaxIdleConnsPerHost int
+	// How long to wait for a TCP connection to be established
+	DialTimeout time.Duration
+	// How long to wait for a TLS handshake to complete
+	TLSHandshakeTimeout time.Duration
+	// How long an idle connection is kept around before being closed
+	IdleConnTimeout time.Duration
+	// Limit on the total time taken by a single request, including reading the response body
+	RequestTimeout time.Duration
+	// Send every request to a server over a single HTTP/2 connection, rather than a pool of HTTP/1.1 connections, so
+	// that many concurrent calls don't need as many connections. Every server started by LaunchEmbeddedHTTP accepts
+	// this. The limits on idle connections and the TLS handshake timeout don't apply to a multiplexed client.
+	Multiplexed bool
+}
+
+// The transport settings used by NewConnectionCache.
+func DefaultChunkserverClientOptions() ChunkserverClientOptions {
+	return ChunkserverClientOptions{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+		DialTimeout:         5 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+		RequestTimeout:      30 * time.Second,
+	}
+}
+
+func (o ChunkserverClientOptions) withDefaults() ChunkserverClientOptions {
+	defaults := DefaultChunkserverClientOptions()
+	if o.MaxIdleConns == 0 {
+		o.MaxIdleConns = defaults.MaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost == 0 {
+		o.MaxIdleConnsPerHost = defaults.MaxIdleConnsPerHost
+	}
+	if o.DialTimeout == 0 {
+		o.DialTimeout = defaults.DialTimeout
+	}
+	if o.TLSHandshakeTimeout == 0 {
+		o.TLSHandshakeTimeout = defaults.TLSHandshakeTimeout
+	}
+	if o.IdleConnTimeout == 0 {
+		o.IdleConnTimeout = defaults.IdleConnTimeout
+	}
+	if o.RequestTimeout == 0 {
+		o.RequestTimeout = defaults.RequestTimeout
+	}
+	return o
+}
+
+// Build an HTTP client suitable for passing to UncachedSubscribeChunkserver. The client's Transport is an
+// *http.Transport, or an *http2.Transport if the client is multiplexed; either way, it's an IdleConnectionCloser, so
+// that callers can close its idle connections when done with it.
+func DefaultChunkserverClient(opts ChunkserverClientOptions) *http.Client {
+	opts = opts.withDefaults()
+	dialer := &net.Dialer{
+		Timeout:   opts.DialTimeout,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}
+	if opts.Multiplexed {
+		return &http.Client{
+			Timeout: opts.RequestTimeout,
+			Transport: &http2.Transport{
+				// speak HTTP/2 over plain TCP, since that's what chunkservers listen on
+				AllowHTTP: true,
+				DialTLS: func(network, address string, config *tls.Config) (net.Conn, error) {
+					return dialer.Dial(network, address)
+				},
+			},
+		}
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          opts.MaxIdleConns,
+		MaxIdleConnsPerHost:   opts.MaxIdleConnsPerHost,
+		IdleConnTimeout:       opts.IdleConnTimeout,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &http.Client{
+		Timeout:   opts.RequestTimeout,
+		Transport: transport,
+	}
+}
+
+// Implemented by the Transport of every client built by DefaultChunkserverClient.
+type IdleConnectionCloser interface {
+	http.RoundTripper
+	CloseIdleConnections()
+}
@@ -0,0 +1,126 @@
+package rpc
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDefaultChunkserverClient_Configured(t *testing.T) {
+	client := DefaultChunkserverClient(ChunkserverClientOptions{
+		MaxIdleConns:        7,
+		MaxIdleConnsPerHost: 3,
+		TLSHandshakeTimeout: 2 * time.Second,
+		IdleConnTimeout:     11 * time.Second,
+		RequestTimeout:      13 * time.Second,
+	})
+	transport, ok := client.Transport.(*http.Transport)
+	assert.True(t, ok)
+	assert.Equal(t, 7, transport.MaxIdleConns)
+	assert.Equal(t, 3, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 2*time.Second, transport.TLSHandshakeTimeout)
+	assert.Equal(t, 11*time.Second, transport.IdleConnTimeout)
+	assert.Equal(t, 13*time.Second, client.Timeout)
+	assert.NotNil(t, transport.DialContext)
+}
+
+func TestDefaultChunkserverClient_Defaults(t *testing.T) {
+	defaults := DefaultChunkserverClientOptions()
+	client := DefaultChunkserverClient(ChunkserverClientOptions{})
+	transport := client.Transport.(*http.Transport)
+	assert.Equal(t, defaults.MaxIdleConns, transport.MaxIdleConns)
+	assert.Equal(t, defaults.MaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, defaults.TLSHandshakeTimeout, transport.TLSHandshakeTimeout)
+	assert.Equal(t, defaults.IdleConnTimeout, transport.IdleConnTimeout)
+	assert.Equal(t, defaults.RequestTimeout, client.Timeout)
+	// the whole point is to avoid the net/http default of two idle connections per host
+	assert.True(t, transport.MaxIdleConnsPerHost > http.DefaultMaxIdleConnsPerHost)
+}
+
+func TestDefaultChunkserverClient_Multiplexed(t *testing.T) {
+	client := DefaultChunkserverClient(ChunkserverClientOptions{Multiplexed: true, RequestTimeout: 13 * time.Second})
+	transport, ok := client.Transport.(*http2.Transport)
+	assert.True(t, ok)
+	assert.True(t, transport.AllowHTTP)
+	assert.Equal(t, 13*time.Second, client.Timeout)
+}
+
+// Counts the connections accepted from a listener.
+type countingListener struct {
+	net.Listener
+	accepted int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt64(&l.accepted, 1)
+	}
+	return conn, err
+}
+
+func TestMultiplexedClientSharesConnection(t *testing.T) {
+	const calls = 50
+
+	// every call waits until all of them have arrived, so they can only succeed if they're in progress at once
+	var arrived int64
+	allArrived := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&arrived, 1) == calls {
+			close(allArrived)
+		}
+		select {
+		case <-allArrived:
+		case <-time.After(5 * time.Second):
+			http.Error(w, "calls were not concurrent", http.StatusServiceUnavailable)
+			return
+		}
+		if r.ProtoMajor != 2 {
+			http.Error(w, "not multiplexed", http.StatusBadRequest)
+			return
+		}
+	})
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	listener := &countingListener{Listener: inner}
+	teardown, address, err := serveEmbeddedHTTP(handler, listener)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, teardown(true))
+	}()
+
+	client := DefaultChunkserverClient(ChunkserverClientOptions{Multiplexed: true})
+	defer client.Transport.(IdleConnectionCloser).CloseIdleConnections()
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, calls)
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			response, err := client.Get("http://" + string(address) + "/")
+			if !assert.NoError(t, err) {
+				return
+			}
+			response.Body.Close()
+			statuses <- response.StatusCode
+		}()
+	}
+	wg.Wait()
+	close(statuses)
+
+	count := 0
+	for status := range statuses {
+		assert.Equal(t, http.StatusOK, status)
+		count++
+	}
+	assert.Equal(t, calls, count)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&listener.accepted))
+}
@@ -3,6 +3,8 @@ package rpc
 import (
 	"context"
 	"fmt"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"net"
 	"net/http"
 	"zircon/apis"
@@ -18,12 +20,26 @@ func LaunchEmbeddedHTTP(handler http.Handler, address apis.ServerAddress) (func(
 		return nil, "", err
 	}
 
-	httpServer := &http.Server{Handler: handler}
+	return serveEmbeddedHTTP(handler, listener)
+}
+
+// Serves on a listener that's already open, accepting both HTTP/1.1 and unencrypted HTTP/2, so that multiplexed clients
+// can reach the server as well as ordinary ones.
+func serveEmbeddedHTTP(handler http.Handler, listener net.Listener) (func(kill bool) error, apis.ServerAddress, error) {
+	http2Server := &http2.Server{}
+	httpServer := &http.Server{Handler: h2c.NewHandler(withRequestIDs(handler), http2Server)}
+	// so that Shutdown also winds down HTTP/2 connections, which the HTTP/2 server takes over from the http.Server
+	if err := http2.ConfigureServer(httpServer, http2Server); err != nil {
+		listener.Close()
+		return nil, "", err
+	}
 	termErr := make(chan error)
 	go func() {
 		defer func() {
-			err := recover()
-			termErr <- fmt.Errorf("panic: %v", err)
+			// only report a panic if there was one; otherwise, the serve error has already been sent
+			if recovered := recover(); recovered != nil {
+				termErr <- fmt.Errorf("panic: %v", recovered)
+			}
 		}()
 
 		err := httpServer.Serve(listener)
@@ -55,6 +71,29 @@ func LaunchEmbeddedHTTP(handler http.Handler, address apis.ServerAddress) (func(
 	return teardown, apis.ServerAddress(listener.Addr().String()), nil
 }
 
+// Implemented by servers that can tell whether they are able to handle requests right now.
+type ReadinessChecker interface {
+	// Returns why the server isn't ready, or nil if it is.
+	Ready() error
+}
+
+// Serves a readiness check at /readyz alongside the RPC handler: 200 if the server is ready, or if it has no way to
+// tell, and 503 with the reason if it isn't.
+func withReadiness(handler http.Handler, server interface{}) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if checker, ok := server.(ReadinessChecker); ok {
+			if err := checker.Ready(); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
 func StringArrayToAddressArray(strings []string) []apis.ServerAddress {
 	addresses := make([]apis.ServerAddress, len(strings))
 	for i, v := range strings {
@@ -0,0 +1,28 @@
+package rpc
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestLaunchEmbeddedHTTP_CleanShutdown(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "hello")
+	})
+	teardown, address, err := LaunchEmbeddedHTTP(handler, "127.0.0.1:0")
+	require.NoError(t, err)
+
+	response, err := http.Get(fmt.Sprintf("http://%s/", address))
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	assert.NoError(t, err)
+	assert.Equal(t, "hello\n", string(body))
+
+	// nothing went wrong, so there's nothing to report
+	assert.NoError(t, teardown(true))
+}
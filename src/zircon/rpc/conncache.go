@@ -2,10 +2,9 @@ package rpc
 
 import (
 	"errors"
-	"net"
+	"fmt"
 	"net/http"
 	"sync"
-	"time"
 	"zircon/apis"
 )
 
@@ -15,6 +14,11 @@ type ConnectionCache interface {
 	// Failure to connect does *not* cause an error here; just timeouts when trying to call specific methods.
 	SubscribeChunkserver(address apis.ServerAddress) (apis.Chunkserver, error)
 
+	// Subscribes to a chunkserver by name, looking up its current address through the resolver on every call. If the
+	// chunkserver has moved since the last time, as happens when it restarts somewhere else, the connection to its old
+	// address is forgotten.
+	SubscribeChunkserverByName(name apis.ServerName, resolver ServerResolver) (apis.Chunkserver, error)
+
 	// Subscribes to a frontend RPC server over the network on a specific address.
 	// Failure to connect does *not* cause an error here; just timeouts when trying to call specific methods.
 	SubscribeFrontend(address apis.ServerAddress) (apis.Frontend, error)
@@ -27,11 +31,20 @@ type ConnectionCache interface {
 	// Failure to connect does *not* cause an error here; just timeouts when trying to call specific methods.
 	SubscribeSyncServer(address apis.ServerAddress) (apis.SyncServer, error)
 
+	// Drops any cached connections to an address, so that the next subscription to it dials it afresh. This happens
+	// automatically whenever a request to the address fails without reaching the server.
+	Forget(address apis.ServerAddress)
+
 	// Closes as many open connections as possible. May disrupt current operations. Should not be necessary to call if
 	// no subscriptions have been attempted.
 	CloseAll()
 }
 
+// Finds the current address of a server from its name. Implemented by apis.EtcdInterface.
+type ServerResolver interface {
+	GetAddress(name apis.ServerName, kind apis.ServerType) (apis.ServerAddress, error)
+}
+
 type conncache struct {
 	mu             sync.Mutex
 	chunkservers   map[apis.ServerAddress]apis.Chunkserver
@@ -39,34 +52,40 @@ type conncache struct {
 	metadatacaches map[apis.ServerAddress]apis.MetadataCache
 	syncservers    map[apis.ServerAddress]apis.SyncServer
 	client         *http.Client
-	transport      *http.Transport
+	transport      IdleConnectionCloser
 	closed         bool
+	// the address each chunkserver subscribed to by name was last found at
+	resolved map[apis.ServerName]apis.ServerAddress
 }
 
 func NewConnectionCache() ConnectionCache {
-	transport := &http.Transport{
-		DialContext: (&net.Dialer{
-			Timeout:   5 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   5 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-	client := &http.Client{
-		Timeout:   30 * time.Second,
-		Transport: transport,
-	}
-	return &conncache{
-		client:         client,
-		transport:      transport,
+	client := DefaultChunkserverClient(DefaultChunkserverClientOptions())
+	c := &conncache{
+		transport:      client.Transport.(IdleConnectionCloser),
 		chunkservers:   map[apis.ServerAddress]apis.Chunkserver{},
+		resolved:       map[apis.ServerName]apis.ServerAddress{},
 		frontends:      map[apis.ServerAddress]apis.Frontend{},
 		metadatacaches: map[apis.ServerAddress]apis.MetadataCache{},
 		syncservers:    map[apis.ServerAddress]apis.SyncServer{},
 	}
+	client.Transport = &forgettingTransport{cache: c, inner: c.transport}
+	c.client = client
+	return c
+}
+
+// Forgets the connections to a server whenever a request to it fails in transit, so that the next call redials it,
+// instead of going back to a connection that has died along with the server at the other end.
+type forgettingTransport struct {
+	cache *conncache
+	inner http.RoundTripper
+}
+
+func (t *forgettingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	response, err := t.inner.RoundTrip(request)
+	if err != nil {
+		t.cache.Forget(apis.ServerAddress(request.URL.Host))
+	}
+	return response, err
 }
 
 func (c *conncache) SubscribeChunkserver(address apis.ServerAddress) (apis.Chunkserver, error) {
@@ -90,6 +109,21 @@ func (c *conncache) SubscribeChunkserver(address apis.ServerAddress) (apis.Chunk
 	}
 }
 
+func (c *conncache) SubscribeChunkserverByName(name apis.ServerName, resolver ServerResolver) (apis.Chunkserver, error) {
+	address, err := resolver.GetAddress(name, apis.CHUNKSERVER)
+	if err != nil {
+		return nil, fmt.Errorf("[conncache.go/RSV] %v", err)
+	}
+	c.mu.Lock()
+	previous, known := c.resolved[name]
+	c.resolved[name] = address
+	c.mu.Unlock()
+	if known && previous != address {
+		c.Forget(previous)
+	}
+	return c.SubscribeChunkserver(address)
+}
+
 func (c *conncache) SubscribeFrontend(address apis.ServerAddress) (apis.Frontend, error) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -153,6 +187,24 @@ func (c *conncache) SubscribeSyncServer(address apis.ServerAddress) (apis.SyncSe
 	}
 }
 
+func (c *conncache) Forget(address apis.ServerAddress) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, chunkserver := c.chunkservers[address]
+	_, frontend := c.frontends[address]
+	_, metadatacache := c.metadatacaches[address]
+	_, syncserver := c.syncservers[address]
+	if !chunkserver && !frontend && !metadatacache && !syncserver {
+		return
+	}
+	delete(c.chunkservers, address)
+	delete(c.frontends, address)
+	delete(c.metadatacaches, address)
+	delete(c.syncservers, address)
+	// the transport can't close connections to a single host, but idle connections elsewhere are cheap to redial
+	c.transport.CloseIdleConnections()
+}
+
 func (c *conncache) CloseAll() {
 	c.mu.Lock()
 	defer c.mu.Unlock()
@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
+	"testing"
+	"zircon/apis"
+	"zircon/apis/mocks"
+)
+
+// A ServerResolver whose answers can be changed partway through a test.
+type movableResolver struct {
+	mu        sync.Mutex
+	addresses map[apis.ServerName]apis.ServerAddress
+}
+
+func (r *movableResolver) GetAddress(name apis.ServerName, kind apis.ServerType) (apis.ServerAddress, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addresses[name], nil
+}
+
+func (r *movableResolver) move(name apis.ServerName, address apis.ServerAddress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.addresses[name] = address
+}
+
+func TestConnectionCache_FollowsAddressChange(t *testing.T) {
+	cache := NewConnectionCache()
+	defer cache.CloseAll()
+
+	before := new(mocks.Chunkserver)
+	teardownBefore, addressBefore, err := PublishChunkserver(before, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer teardownBefore(true)
+	after := new(mocks.Chunkserver)
+	teardownAfter, addressAfter, err := PublishChunkserver(after, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer teardownAfter(true)
+
+	before.On("GetStats").Return(apis.ChunkserverStats{Chunks: 1}, nil).Once()
+	after.On("GetStats").Return(apis.ChunkserverStats{Chunks: 2}, nil).Once()
+
+	resolver := &movableResolver{addresses: map[apis.ServerName]apis.ServerAddress{"cs0": addressBefore}}
+	server, err := cache.SubscribeChunkserverByName("cs0", resolver)
+	require.NoError(t, err)
+	stats, err := server.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), stats.Chunks)
+
+	// the chunkserver restarts somewhere else
+	resolver.move("cs0", addressAfter)
+	server, err = cache.SubscribeChunkserverByName("cs0", resolver)
+	require.NoError(t, err)
+	stats, err = server.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), stats.Chunks)
+
+	// and the connection to where it used to be is gone
+	_, stale := cache.(*conncache).chunkservers[addressBefore]
+	assert.False(t, stale)
+
+	before.AssertExpectations(t)
+	after.AssertExpectations(t)
+}
+
+func TestConnectionCache_ForgetsDeadConnections(t *testing.T) {
+	cache := NewConnectionCache()
+	defer cache.CloseAll()
+
+	mocked := new(mocks.Chunkserver)
+	teardown, address, err := PublishChunkserver(mocked, "127.0.0.1:0")
+	require.NoError(t, err)
+	mocked.On("GetStats").Return(apis.ChunkserverStats{}, nil)
+
+	server, err := cache.SubscribeChunkserver(address)
+	require.NoError(t, err)
+	_, err = server.GetStats()
+	assert.NoError(t, err)
+	assert.NoError(t, teardown(true))
+
+	_, err = server.GetStats()
+	assert.Equal(t, apis.ErrUnreachable, apis.ErrorCodeOf(err))
+	_, cached := cache.(*conncache).chunkservers[address]
+	assert.False(t, cached)
+
+	// a server that comes back at the same address is reached with a fresh connection
+	teardown, _, err = PublishChunkserver(mocked, address)
+	require.NoError(t, err)
+	defer teardown(true)
+	server, err = cache.SubscribeChunkserver(address)
+	require.NoError(t, err)
+	_, err = server.GetStats()
+	assert.NoError(t, err)
+}
@@ -0,0 +1,96 @@
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	twirplib "github.com/twitchtv/twirp"
+	"log"
+	"runtime/debug"
+	"strconv"
+	"time"
+	"zircon/apis"
+)
+
+const (
+	errorCodeMeta    = "zircon-code"
+	errorVersionMeta = "zircon-version"
+	// in nanoseconds; only set if the error suggests a wait
+	errorRetryAfterMeta = "zircon-retry-after"
+	// set on every error produced by a handler, so that clients can tell them apart from transport failures
+	errorHandlerMeta = "zircon-handler"
+)
+
+// Converts an error from a served interface into a twirp error that preserves its apis.ErrorCode across the wire.
+func exportError(err error) error {
+	if err == nil {
+		return nil
+	}
+	terr := twirplib.NewError(twirplib.Internal, err.Error()).WithMeta(errorHandlerMeta, "true")
+	if coded, ok := err.(*apis.Error); ok && coded != nil {
+		terr = terr.WithMeta(errorCodeMeta, string(coded.Code)).
+			WithMeta(errorVersionMeta, strconv.FormatUint(uint64(coded.Version), 10))
+		if coded.RetryAfter > 0 {
+			terr = terr.WithMeta(errorRetryAfterMeta, strconv.FormatInt(int64(coded.RetryAfter), 10))
+		}
+	}
+	return terr
+}
+
+// Reverses exportError on the client side, so that callers can use apis.ErrorCodeOf on errors from remote servers.
+// Errors that did not come from the remote handler (such as connection failures) are reported as ErrUnreachable.
+func importError(err error) error {
+	if err == nil {
+		return nil
+	}
+	terr, ok := err.(twirplib.Error)
+	if !ok || terr.Meta(errorHandlerMeta) == "" {
+		return apis.NewError(apis.ErrUnreachable, 0, "%v", err)
+	}
+	if terr.Meta(errorCodeMeta) == "" {
+		return errors.New(terr.Msg())
+	}
+	version, perr := strconv.ParseUint(terr.Meta(errorVersionMeta), 10, 64)
+	if perr != nil {
+		version = 0
+	}
+	// a missing or unparseable suggestion is the same as none at all
+	retryAfter, _ := strconv.ParseInt(terr.Meta(errorRetryAfterMeta), 10, 64)
+	return &apis.Error{
+		Code:       apis.ErrorCode(terr.Meta(errorCodeMeta)),
+		Message:    terr.Msg(),
+		Version:    apis.Version(version),
+		RetryAfter: time.Duration(retryAfter),
+	}
+}
+
+// Must be deferred directly by RPC handlers. Converts a panic in the handler into an ErrInternal error, after logging
+// the stack trace, so that a single bad request cannot take down the whole server.
+func recoverAsInternalError(method string, err *error) {
+	if recovered := recover(); recovered != nil {
+		log.Printf("recovered from panic in %s: %v\n%s", method, recovered, debug.Stack())
+		*err = exportError(apis.NewError(apis.ErrInternal, 0, "internal error in %s: %v", method, recovered))
+	}
+}
+
+// Unlike the other errors, Read errors are passed in-band so that the version is always returned.
+func readErrorFields(err error) (message string, code string) {
+	if err == nil {
+		return "", ""
+	}
+	message = err.Error()
+	if message == "" {
+		panic("expected nonempty error code")
+	}
+	return message, string(apis.ErrorCodeOf(err))
+}
+
+func readErrorFromFields(message string, code string, version apis.Version) error {
+	if code == "" {
+		return fmt.Errorf("%s", message)
+	}
+	return &apis.Error{
+		Code:    apis.ErrorCode(code),
+		Message: message,
+		Version: version,
+	}
+}
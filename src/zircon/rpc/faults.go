@@ -0,0 +1,291 @@
+package rpc
+
+import (
+	"context"
+	"sync"
+	"zircon/apis"
+)
+
+// A ConnectionCache that can be told to drop requests to particular chunkservers, to simulate transient network
+// failures in tests. Dropped requests never reach the server, and fail with ErrUnreachable. It can also damage the data
+// carried by requests, to simulate corruption in transit.
+type FaultyCache struct {
+	ConnectionCache
+
+	mu       sync.Mutex
+	drops    map[apis.ServerAddress]int
+	corrupts map[apis.ServerAddress]int
+}
+
+var _ ConnectionCache = &FaultyCache{}
+
+func NewFaultyCache(inner ConnectionCache) *FaultyCache {
+	return &FaultyCache{
+		ConnectionCache: inner,
+		drops:           map[apis.ServerAddress]int{},
+		corrupts:        map[apis.ServerAddress]int{},
+	}
+}
+
+// Cause the next 'count' requests to the chunkserver at this address to be dropped.
+func (f *FaultyCache) DropNext(address apis.ServerAddress, count int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.drops[address] += count
+}
+
+func (f *FaultyCache) checkDrop(address apis.ServerAddress) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.drops[address] > 0 {
+		f.drops[address] -= 1
+		return apis.NewError(apis.ErrUnreachable, 0, "injected fault: dropped request to %s", address)
+	}
+	return nil
+}
+
+// Cause the chunk data carried by the next 'count' requests to the chunkserver at this address to be damaged on the way.
+// Only requests that carry chunk data, such as StartWrite and ForceAdd, are affected or counted.
+func (f *FaultyCache) CorruptNext(address apis.ServerAddress, count int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.corrupts[address] += count
+}
+
+// Returns the data as it arrives at the server: either unchanged, or a damaged copy.
+func (f *FaultyCache) checkCorrupt(address apis.ServerAddress, data []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.corrupts[address] == 0 || len(data) == 0 {
+		return data
+	}
+	f.corrupts[address] -= 1
+	damaged := make([]byte, len(data))
+	copy(damaged, data)
+	damaged[0] ^= 0xFF
+	return damaged
+}
+
+func (f *FaultyCache) SubscribeChunkserver(address apis.ServerAddress) (apis.Chunkserver, error) {
+	server, err := f.ConnectionCache.SubscribeChunkserver(address)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyChunkserver{cache: f, address: address, server: server}, nil
+}
+
+func (f *FaultyCache) SubscribeChunkserverByName(name apis.ServerName, resolver ServerResolver) (apis.Chunkserver, error) {
+	// look the address up just once, so that faults are keyed by the same address that the inner cache connects to
+	address, err := resolver.GetAddress(name, apis.CHUNKSERVER)
+	if err != nil {
+		return nil, err
+	}
+	server, err := f.ConnectionCache.SubscribeChunkserverByName(name, ResolvedAddress(address))
+	if err != nil {
+		return nil, err
+	}
+	return &faultyChunkserver{cache: f, address: address, server: server}, nil
+}
+
+// A ServerResolver that has already been given its answer, for when the address has been looked up already.
+type ResolvedAddress apis.ServerAddress
+
+func (r ResolvedAddress) GetAddress(name apis.ServerName, kind apis.ServerType) (apis.ServerAddress, error) {
+	return apis.ServerAddress(r), nil
+}
+
+type faultyChunkserver struct {
+	cache   *FaultyCache
+	address apis.ServerAddress
+	server  apis.Chunkserver
+}
+
+func (c *faultyChunkserver) StartWriteReplicated(chunk apis.ChunkNum, offset uint32, data []byte, replicas []apis.ServerAddress) error {
+	return c.StartWriteReplicatedWithContext(context.Background(), chunk, offset, data, replicas)
+}
+
+func (c *faultyChunkserver) StartWriteReplicatedWithContext(ctx context.Context, chunk apis.ChunkNum, offset uint32, data []byte, replicas []apis.ServerAddress) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	data = c.cache.checkCorrupt(c.address, data)
+	return c.server.StartWriteReplicatedWithContext(ctx, chunk, offset, data, replicas)
+}
+
+func (c *faultyChunkserver) Replicate(chunk apis.ChunkNum, serverAddress apis.ServerAddress, version apis.Version) error {
+	return c.ReplicateWithContext(context.Background(), chunk, serverAddress, version)
+}
+
+func (c *faultyChunkserver) ReplicateWithContext(ctx context.Context, chunk apis.ChunkNum, serverAddress apis.ServerAddress, version apis.Version) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	return c.server.ReplicateWithContext(ctx, chunk, serverAddress, version)
+}
+
+func (c *faultyChunkserver) Push(chunk apis.ChunkNum, serverAddress apis.ServerAddress) (apis.Version, error) {
+	return c.PushWithContext(context.Background(), chunk, serverAddress)
+}
+
+func (c *faultyChunkserver) PushWithContext(ctx context.Context, chunk apis.ChunkNum, serverAddress apis.ServerAddress) (apis.Version, error) {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return 0, err
+	}
+	return c.server.PushWithContext(ctx, chunk, serverAddress)
+}
+
+func (c *faultyChunkserver) RepairChunk(chunk apis.ChunkNum, version apis.Version, checksum uint32, sources []apis.ServerAddress) (apis.ServerAddress, error) {
+	return c.RepairChunkWithContext(context.Background(), chunk, version, checksum, sources)
+}
+
+func (c *faultyChunkserver) RepairChunkWithContext(ctx context.Context, chunk apis.ChunkNum, version apis.Version, checksum uint32, sources []apis.ServerAddress) (apis.ServerAddress, error) {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return "", err
+	}
+	return c.server.RepairChunkWithContext(ctx, chunk, version, checksum, sources)
+}
+
+func (c *faultyChunkserver) Read(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, error) {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return nil, 0, err
+	}
+	return c.server.Read(chunk, offset, length, minimum)
+}
+
+func (c *faultyChunkserver) StartWrite(chunk apis.ChunkNum, offset uint32, data []byte) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	data = c.cache.checkCorrupt(c.address, data)
+	return c.server.StartWrite(chunk, offset, data)
+}
+
+func (c *faultyChunkserver) CommitWrite(chunk apis.ChunkNum, hash apis.CommitHash, oldVersion apis.Version, newVersion apis.Version) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	return c.server.CommitWrite(chunk, hash, oldVersion, newVersion)
+}
+
+func (c *faultyChunkserver) CommitWriteBatch(commits []apis.CommitWriteRequest) ([]error, error) {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return nil, err
+	}
+	return c.server.CommitWriteBatch(commits)
+}
+
+func (c *faultyChunkserver) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.Version, newVersion apis.Version) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	return c.server.UpdateLatestVersion(chunk, oldVersion, newVersion)
+}
+
+func (c *faultyChunkserver) Add(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	initialData = c.cache.checkCorrupt(c.address, initialData)
+	return c.server.Add(chunk, initialData, initialVersion)
+}
+
+func (c *faultyChunkserver) AddWithMode(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version, mode apis.AddMode) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	initialData = c.cache.checkCorrupt(c.address, initialData)
+	return c.server.AddWithMode(chunk, initialData, initialVersion, mode)
+}
+
+func (c *faultyChunkserver) OverrideLatestVersion(chunk apis.ChunkNum, version apis.Version) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	return c.server.OverrideLatestVersion(chunk, version)
+}
+
+func (c *faultyChunkserver) GetStats() (apis.ChunkserverStats, error) {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return apis.ChunkserverStats{}, err
+	}
+	return c.server.GetStats()
+}
+
+func (c *faultyChunkserver) SetSlowOperationThresholds(thresholds apis.SlowOperationThresholds) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	return c.server.SetSlowOperationThresholds(thresholds)
+}
+
+func (c *faultyChunkserver) SetCompactionPaused(paused bool) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	return c.server.SetCompactionPaused(paused)
+}
+
+func (c *faultyChunkserver) VerifyAll(ctx context.Context, options apis.VerifyOptions, found func(apis.VerifyFinding)) (apis.VerifyReport, error) {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return apis.VerifyReport{}, err
+	}
+	return c.server.VerifyAll(ctx, options, found)
+}
+
+func (c *faultyChunkserver) ForceAdd(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	initialData = c.cache.checkCorrupt(c.address, initialData)
+	return c.server.ForceAdd(chunk, initialData, initialVersion)
+}
+
+func (c *faultyChunkserver) ForceAddChecked(chunk apis.ChunkNum, initialData []byte, initialVersion apis.Version, checksum uint32) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	initialData = c.cache.checkCorrupt(c.address, initialData)
+	return c.server.ForceAddChecked(chunk, initialData, initialVersion, checksum)
+}
+
+func (c *faultyChunkserver) Delete(chunk apis.ChunkNum, version apis.Version) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	return c.server.Delete(chunk, version)
+}
+
+func (c *faultyChunkserver) ListAllChunks(minimum apis.Version, maximum apis.Version) ([]apis.ChunkVersion, error) {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return nil, err
+	}
+	return c.server.ListAllChunks(minimum, maximum)
+}
+
+func (c *faultyChunkserver) ListAllChunksWithHashes(minimum apis.Version, maximum apis.Version) ([]apis.ChunkVersionHashes, error) {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return nil, err
+	}
+	return c.server.ListAllChunksWithHashes(minimum, maximum)
+}
+
+func (c *faultyChunkserver) ListChunks(filter apis.ChunkFilter) ([]apis.ChunkVersion, error) {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return nil, err
+	}
+	return c.server.ListChunks(filter)
+}
+
+func (c *faultyChunkserver) ListTombstones() ([]apis.Tombstone, error) {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return nil, err
+	}
+	return c.server.ListTombstones()
+}
+
+func (c *faultyChunkserver) ForgetTombstone(chunk apis.ChunkNum) error {
+	if err := c.cache.checkDrop(c.address); err != nil {
+		return err
+	}
+	return c.server.ForgetTombstone(chunk)
+}
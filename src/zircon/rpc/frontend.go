@@ -10,7 +10,7 @@ import (
 // Connects to an RPC handler for a Frontend on a certain address.
 func UncachedSubscribeFrontend(address apis.ServerAddress, client *http.Client) (apis.Frontend, error) {
 	saddr := "http://" + string(address)
-	tserve := twirp.NewFrontendProtobufClient(saddr, client)
+	tserve := twirp.NewFrontendProtobufClient(saddr, withRequestIDClient(client))
 
 	return &proxyTwirpAsFrontend{server: tserve}, nil
 }
@@ -61,6 +61,16 @@ func (p *proxyFrontendAsTwirp) Delete(ctx context.Context, request *twirp.Fronte
 	return &twirp.Frontend_Delete_Result{}, err
 }
 
+func (p *proxyFrontendAsTwirp) GetChunkSize(ctx context.Context, request *twirp.Frontend_GetChunkSize) (*twirp.Frontend_GetChunkSize_Result, error) {
+	size, err := p.server.GetChunkSize()
+	if err != nil {
+		return nil, err
+	}
+	return &twirp.Frontend_GetChunkSize_Result{
+		Size: size,
+	}, nil
+}
+
 type proxyTwirpAsFrontend struct {
 	server twirp.Frontend
 }
@@ -102,3 +112,11 @@ func (p *proxyTwirpAsFrontend) Delete(chunk apis.ChunkNum, version apis.Version)
 	})
 	return err
 }
+
+func (p *proxyTwirpAsFrontend) GetChunkSize() (uint32, error) {
+	result, err := p.server.GetChunkSize(context.Background(), &twirp.Frontend_GetChunkSize{})
+	if err != nil {
+		return 0, err
+	}
+	return result.Size, nil
+}
@@ -95,3 +95,19 @@ func TestFrontend_Delete(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "frontend error 4")
 }
+
+func TestFrontend_GetChunkSize(t *testing.T) {
+	mocked, teardown, server := beginFrontendTest(t)
+	defer teardown()
+
+	mocked.On("GetChunkSize").Return(uint32(4096), nil).Once()
+	mocked.On("GetChunkSize").Return(uint32(0), errors.New("frontend error 5")).Once()
+
+	size, err := server.GetChunkSize()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(4096), size)
+
+	_, err = server.GetChunkSize()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "frontend error 5")
+}
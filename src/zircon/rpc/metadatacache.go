@@ -11,15 +11,16 @@ import (
 // Connects to an RPC handler for a MetadataCache on a certain address.
 func UncachedSubscribeMetadataCache(address apis.ServerAddress, client *http.Client) (apis.MetadataCache, error) {
 	saddr := "http://" + string(address)
-	tserve := twirp.NewMetadataCacheProtobufClient(saddr, client)
+	tserve := twirp.NewMetadataCacheProtobufClient(saddr, withRequestIDClient(client))
 
 	return &proxyTwirpAsMetadataCache{server: tserve}, nil
 }
 
 // Starts serving an RPC handler for a MetadataCache on a certain address. Runs forever.
+// If the MetadataCache is a ReadinessChecker, its readiness is also served at /readyz.
 func PublishMetadataCache(server apis.MetadataCache, address apis.ServerAddress) (func(kill bool) error, apis.ServerAddress, error) {
 	tserve := twirp.NewMetadataCacheServer(&proxyMetadataCacheAsTwirp{server: server}, nil)
-	return LaunchEmbeddedHTTP(tserve, address)
+	return LaunchEmbeddedHTTP(withReadiness(tserve, server), address)
 }
 
 type proxyMetadataCacheAsTwirp struct {
@@ -27,7 +28,7 @@ type proxyMetadataCacheAsTwirp struct {
 }
 
 func (p *proxyMetadataCacheAsTwirp) NewEntry(ctx context.Context, request *twirp.MetadataCache_NewEntry) (*twirp.MetadataCache_NewEntry_Result, error) {
-	chunk, err := p.server.NewEntry()
+	chunk, err := p.server.NewEntryWithContext(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -37,7 +38,7 @@ func (p *proxyMetadataCacheAsTwirp) NewEntry(ctx context.Context, request *twirp
 }
 
 func (p *proxyMetadataCacheAsTwirp) ReadEntry(ctx context.Context, request *twirp.MetadataCache_ReadEntry) (*twirp.MetadataCache_ReadEntry_Result, error) {
-	entry, owner, err := p.server.ReadEntry(apis.ChunkNum(request.Chunk))
+	entry, owner, err := p.server.ReadEntry(apis.ChunkNum(request.Chunk), apis.Consistency(request.Consistency))
 	if err != nil {
 		if owner == "" {
 			return nil, err
@@ -56,8 +57,24 @@ func (p *proxyMetadataCacheAsTwirp) ReadEntry(ctx context.Context, request *twir
 	}, nil
 }
 
+func (p *proxyMetadataCacheAsTwirp) EntryExists(ctx context.Context, request *twirp.MetadataCache_EntryExists) (*twirp.MetadataCache_EntryExists_Result, error) {
+	exists, owner, err := p.server.EntryExists(apis.ChunkNum(request.Chunk), apis.Consistency(request.Consistency))
+	if err != nil {
+		if owner == "" {
+			return nil, err
+		}
+		return &twirp.MetadataCache_EntryExists_Result{
+			Owner:    string(owner),
+			OwnerErr: err.Error(),
+		}, nil
+	}
+	return &twirp.MetadataCache_EntryExists_Result{
+		Exists: exists,
+	}, nil
+}
+
 func (p *proxyMetadataCacheAsTwirp) UpdateEntry(ctx context.Context, request *twirp.MetadataCache_UpdateEntry) (*twirp.MetadataCache_UpdateEntry_Result, error) {
-	owner, err := p.server.UpdateEntry(apis.ChunkNum(request.Chunk), apis.MetadataEntry{
+	owner, err := p.server.UpdateEntryWithContext(ctx, apis.ChunkNum(request.Chunk), apis.MetadataEntry{
 		MostRecentVersion:   apis.Version(request.PreviousEntry.MostRecentVersion),
 		LastConsumedVersion: apis.Version(request.PreviousEntry.LastConsumedVersion),
 		Replicas:            IntArrayToIDArray(request.PreviousEntry.ServerIDs),
@@ -77,8 +94,25 @@ func (p *proxyMetadataCacheAsTwirp) UpdateEntry(ctx context.Context, request *tw
 	}, err
 }
 
+func (p *proxyMetadataCacheAsTwirp) SwapReplicas(ctx context.Context, request *twirp.MetadataCache_SwapReplicas) (*twirp.MetadataCache_SwapReplicas_Result, error) {
+	owner, err := p.server.SwapReplicasWithContext(ctx, apis.ChunkNum(request.Chunk), apis.MetadataEntry{
+		MostRecentVersion:   apis.Version(request.ExpectedEntry.MostRecentVersion),
+		LastConsumedVersion: apis.Version(request.ExpectedEntry.LastConsumedVersion),
+		Replicas:            IntArrayToIDArray(request.ExpectedEntry.ServerIDs),
+	}, IntArrayToIDArray(request.NewServerIDs))
+	if owner != "" {
+		return &twirp.MetadataCache_SwapReplicas_Result{
+			Owner:    string(owner),
+			OwnerErr: err.Error(),
+		}, nil
+	}
+	return &twirp.MetadataCache_SwapReplicas_Result{
+		Owner: string(owner),
+	}, err
+}
+
 func (p *proxyMetadataCacheAsTwirp) DeleteEntry(ctx context.Context, request *twirp.MetadataCache_DeleteEntry) (*twirp.MetadataCache_DeleteEntry_Result, error) {
-	owner, err := p.server.DeleteEntry(apis.ChunkNum(request.Chunk), apis.MetadataEntry{
+	owner, err := p.server.DeleteEntryWithContext(ctx, apis.ChunkNum(request.Chunk), apis.MetadataEntry{
 		MostRecentVersion:   apis.Version(request.PreviousEntry.MostRecentVersion),
 		LastConsumedVersion: apis.Version(request.PreviousEntry.LastConsumedVersion),
 		Replicas:            IntArrayToIDArray(request.PreviousEntry.ServerIDs),
@@ -99,16 +133,21 @@ type proxyTwirpAsMetadataCache struct {
 }
 
 func (p *proxyTwirpAsMetadataCache) NewEntry() (apis.ChunkNum, error) {
-	result, err := p.server.NewEntry(context.Background(), &twirp.MetadataCache_NewEntry{})
+	return p.NewEntryWithContext(context.Background())
+}
+
+func (p *proxyTwirpAsMetadataCache) NewEntryWithContext(ctx context.Context) (apis.ChunkNum, error) {
+	result, err := p.server.NewEntry(ctx, &twirp.MetadataCache_NewEntry{})
 	if err != nil {
 		return 0, err
 	}
 	return apis.ChunkNum(result.Chunk), nil
 }
 
-func (p *proxyTwirpAsMetadataCache) ReadEntry(chunk apis.ChunkNum) (apis.MetadataEntry, apis.ServerName, error) {
+func (p *proxyTwirpAsMetadataCache) ReadEntry(chunk apis.ChunkNum, consistency apis.Consistency) (apis.MetadataEntry, apis.ServerName, error) {
 	result, err := p.server.ReadEntry(context.Background(), &twirp.MetadataCache_ReadEntry{
-		Chunk: uint64(chunk),
+		Chunk:       uint64(chunk),
+		Consistency: uint32(consistency),
 	})
 	if err != nil {
 		return apis.MetadataEntry{}, "", err
@@ -123,8 +162,26 @@ func (p *proxyTwirpAsMetadataCache) ReadEntry(chunk apis.ChunkNum) (apis.Metadat
 	}, "", nil
 }
 
+func (p *proxyTwirpAsMetadataCache) EntryExists(chunk apis.ChunkNum, consistency apis.Consistency) (bool, apis.ServerName, error) {
+	result, err := p.server.EntryExists(context.Background(), &twirp.MetadataCache_EntryExists{
+		Chunk:       uint64(chunk),
+		Consistency: uint32(consistency),
+	})
+	if err != nil {
+		return false, "", err
+	}
+	if result.Owner != "" {
+		return false, apis.ServerName(result.Owner), errors.New(result.OwnerErr)
+	}
+	return result.Exists, "", nil
+}
+
 func (p *proxyTwirpAsMetadataCache) UpdateEntry(chunk apis.ChunkNum, previousEntry apis.MetadataEntry, newEntry apis.MetadataEntry) (apis.ServerName, error) {
-	result, err := p.server.UpdateEntry(context.Background(), &twirp.MetadataCache_UpdateEntry{
+	return p.UpdateEntryWithContext(context.Background(), chunk, previousEntry, newEntry)
+}
+
+func (p *proxyTwirpAsMetadataCache) UpdateEntryWithContext(ctx context.Context, chunk apis.ChunkNum, previousEntry apis.MetadataEntry, newEntry apis.MetadataEntry) (apis.ServerName, error) {
+	result, err := p.server.UpdateEntry(ctx, &twirp.MetadataCache_UpdateEntry{
 		Chunk: uint64(chunk),
 		PreviousEntry: &twirp.MetadataEntry{
 			MostRecentVersion:   uint64(previousEntry.MostRecentVersion),
@@ -143,8 +200,35 @@ func (p *proxyTwirpAsMetadataCache) UpdateEntry(chunk apis.ChunkNum, previousEnt
 	return "", err
 }
 
+func (p *proxyTwirpAsMetadataCache) SwapReplicas(chunk apis.ChunkNum, expectedEntry apis.MetadataEntry, newReplicas []apis.ServerID) (apis.ServerName, error) {
+	return p.SwapReplicasWithContext(context.Background(), chunk, expectedEntry, newReplicas)
+}
+
+func (p *proxyTwirpAsMetadataCache) SwapReplicasWithContext(ctx context.Context, chunk apis.ChunkNum, expectedEntry apis.MetadataEntry, newReplicas []apis.ServerID) (apis.ServerName, error) {
+	result, err := p.server.SwapReplicas(ctx, &twirp.MetadataCache_SwapReplicas{
+		Chunk: uint64(chunk),
+		ExpectedEntry: &twirp.MetadataEntry{
+			MostRecentVersion:   uint64(expectedEntry.MostRecentVersion),
+			LastConsumedVersion: uint64(expectedEntry.LastConsumedVersion),
+			ServerIDs:           IDArrayToIntArray(expectedEntry.Replicas),
+		},
+		NewServerIDs: IDArrayToIntArray(newReplicas),
+	})
+	if err != nil {
+		return "", err
+	}
+	if result.Owner != "" {
+		return apis.ServerName(result.Owner), errors.New(result.OwnerErr)
+	}
+	return "", nil
+}
+
 func (p *proxyTwirpAsMetadataCache) DeleteEntry(chunk apis.ChunkNum, previous apis.MetadataEntry) (apis.ServerName, error) {
-	result, err := p.server.DeleteEntry(context.Background(), &twirp.MetadataCache_DeleteEntry{
+	return p.DeleteEntryWithContext(context.Background(), chunk, previous)
+}
+
+func (p *proxyTwirpAsMetadataCache) DeleteEntryWithContext(ctx context.Context, chunk apis.ChunkNum, previous apis.MetadataEntry) (apis.ServerName, error) {
+	result, err := p.server.DeleteEntry(ctx, &twirp.MetadataCache_DeleteEntry{
 		Chunk: uint64(chunk),
 		PreviousEntry: &twirp.MetadataEntry{
 			LastConsumedVersion: uint64(previous.LastConsumedVersion),
@@ -52,15 +52,15 @@ func TestMetadataCache_ReadEntry(t *testing.T) {
 	mocked, teardown, server := beginMetadataCacheTest(t)
 	defer teardown()
 
-	mocked.On("ReadEntry", apis.ChunkNum(556)).Return(apis.MetadataEntry{
+	mocked.On("ReadEntry", apis.ChunkNum(556), apis.Fresh).Return(apis.MetadataEntry{
 		MostRecentVersion:   900,
 		LastConsumedVersion: 910,
 		Replicas:            []apis.ServerID{0, 1, 555555},
 	}, apis.ServerName(""), nil)
-	mocked.On("ReadEntry", apis.ChunkNum(1)).Return(apis.MetadataEntry{}, apis.ServerName("owner"), errors.New("metadatacache error 2a"))
-	mocked.On("ReadEntry", apis.ChunkNum(0)).Return(apis.MetadataEntry{}, apis.ServerName(""), errors.New("metadatacache error 2b"))
+	mocked.On("ReadEntry", apis.ChunkNum(1), apis.Cached).Return(apis.MetadataEntry{}, apis.ServerName("owner"), errors.New("metadatacache error 2a"))
+	mocked.On("ReadEntry", apis.ChunkNum(0), apis.Fresh).Return(apis.MetadataEntry{}, apis.ServerName(""), errors.New("metadatacache error 2b"))
 
-	version, _, err := server.ReadEntry(556)
+	version, _, err := server.ReadEntry(556, apis.Fresh)
 	assert.NoError(t, err)
 	assert.Equal(t, apis.MetadataEntry{
 		MostRecentVersion:   900,
@@ -68,17 +68,45 @@ func TestMetadataCache_ReadEntry(t *testing.T) {
 		Replicas:            []apis.ServerID{0, 1, 555555},
 	}, version)
 
-	_, owner, err := server.ReadEntry(1)
+	_, owner, err := server.ReadEntry(1, apis.Cached)
 	assert.Error(t, err)
 	assert.Equal(t, apis.ServerName("owner"), owner)
 	assert.Contains(t, err.Error(), "metadatacache error 2a")
 
-	_, owner, err = server.ReadEntry(0)
+	_, owner, err = server.ReadEntry(0, apis.Fresh)
 	assert.Error(t, err)
 	assert.Equal(t, apis.ServerName(""), owner)
 	assert.Contains(t, err.Error(), "metadatacache error 2b")
 }
 
+func TestMetadataCache_EntryExists(t *testing.T) {
+	mocked, teardown, server := beginMetadataCacheTest(t)
+	defer teardown()
+
+	mocked.On("EntryExists", apis.ChunkNum(556), apis.Fresh).Return(true, apis.ServerName(""), nil)
+	mocked.On("EntryExists", apis.ChunkNum(557), apis.Cached).Return(false, apis.ServerName(""), nil)
+	mocked.On("EntryExists", apis.ChunkNum(1), apis.Fresh).Return(false, apis.ServerName("owner"), errors.New("metadatacache error 3a"))
+	mocked.On("EntryExists", apis.ChunkNum(0), apis.Fresh).Return(false, apis.ServerName(""), errors.New("metadatacache error 3b"))
+
+	exists, _, err := server.EntryExists(556, apis.Fresh)
+	assert.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, _, err = server.EntryExists(557, apis.Cached)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	_, owner, err := server.EntryExists(1, apis.Fresh)
+	assert.Error(t, err)
+	assert.Equal(t, apis.ServerName("owner"), owner)
+	assert.Contains(t, err.Error(), "metadatacache error 3a")
+
+	_, owner, err = server.EntryExists(0, apis.Fresh)
+	assert.Error(t, err)
+	assert.Equal(t, apis.ServerName(""), owner)
+	assert.Contains(t, err.Error(), "metadatacache error 3b")
+}
+
 func TestMetadataCache_UpdateEntry(t *testing.T) {
 	mocked, teardown, server := beginMetadataCacheTest(t)
 	defer teardown()
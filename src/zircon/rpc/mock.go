@@ -23,6 +23,14 @@ func (mc *MockCache) SubscribeChunkserver(address apis.ServerAddress) (apis.Chun
 	}
 }
 
+func (mc *MockCache) SubscribeChunkserverByName(name apis.ServerName, resolver ServerResolver) (apis.Chunkserver, error) {
+	address, err := resolver.GetAddress(name, apis.CHUNKSERVER)
+	if err != nil {
+		return nil, err
+	}
+	return mc.SubscribeChunkserver(address)
+}
+
 func (mc *MockCache) SubscribeFrontend(address apis.ServerAddress) (apis.Frontend, error) {
 	fe, found := mc.Frontends[address]
 	if found {
@@ -50,6 +58,10 @@ func (mc *MockCache) SubscribeSyncServer(address apis.ServerAddress) (apis.SyncS
 	}
 }
 
+func (mc *MockCache) Forget(address apis.ServerAddress) {
+	// nothing is cached
+}
+
 func (mc *MockCache) CloseAll() {
 	// don't bother doing anything
 }
@@ -0,0 +1,163 @@
+package rpc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+	"zircon/apis"
+)
+
+// Every request carries an ID in this header, so that log records for a single call can be matched up across servers.
+// If the client doesn't send one, the server generates one, and sends it back in the same header of the response.
+const RequestIDHeader = "Zircon-Request-Id"
+
+// The caller attached to a request's context with apis.WithCaller travels in this header, so that the server can
+// attribute what it does to the same caller.
+const CallerHeader = "Zircon-Caller"
+
+type requestIDKey struct{}
+
+// Generates a new random request ID.
+func NewRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		panic("could not generate request ID: " + err.Error())
+	}
+	return hex.EncodeToString(id)
+}
+
+// Attaches a request ID to a context, so that calls made with the context send it along.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// Gets the request ID attached to a context, or an empty string if there isn't one. Within a server handler, this is
+// the ID of the request being handled.
+func RequestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Which end of a call a RequestRecord was produced by.
+type RequestSide string
+
+const (
+	ClientSide RequestSide = "client"
+	ServerSide RequestSide = "server"
+)
+
+// Describes a single completed call, as seen by one end of it.
+type RequestRecord struct {
+	Side      RequestSide
+	RequestID string
+	// The name of the RPC method called, such as "Read"
+	Method   string
+	Duration time.Duration
+	// Any failure to complete the call at the HTTP level; errors returned by the handler itself are not included
+	Err error
+}
+
+// Called once for every call made or served, so that calls can be logged or traced. Must be safe to call concurrently.
+type RequestHook func(record RequestRecord)
+
+var hookLock sync.RWMutex
+var requestHook RequestHook
+
+// Replaces the hook called for every call made or served by this process. A nil hook disables reporting.
+func SetRequestHook(hook RequestHook) {
+	hookLock.Lock()
+	defer hookLock.Unlock()
+	requestHook = hook
+}
+
+// A RequestHook that writes each call to the standard logger.
+func LogRequests(record RequestRecord) {
+	if record.Err != nil {
+		log.Printf("[%s] %s %s failed after %v: %v", record.RequestID, record.Side, record.Method, record.Duration, record.Err)
+	} else {
+		log.Printf("[%s] %s %s took %v", record.RequestID, record.Side, record.Method, record.Duration)
+	}
+}
+
+func reportRequest(record RequestRecord) {
+	hookLock.RLock()
+	hook := requestHook
+	hookLock.RUnlock()
+	if hook != nil {
+		hook(record)
+	}
+}
+
+// Twirp routes each method to a path ending in its name.
+func methodOfPath(urlPath string) string {
+	return path.Base(urlPath)
+}
+
+// Wraps a served handler so that every request has an ID available through RequestIDFrom, which is returned to the
+// client, and the caller the client named available through apis.CallerFrom, and so that every request is reported to
+// the request hook.
+func withRequestIDs(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(RequestIDHeader)
+		if id == "" {
+			id = NewRequestID()
+		}
+		// the header has to be set before the handler starts writing the response
+		w.Header().Set(RequestIDHeader, id)
+		ctx := WithRequestID(r.Context(), id)
+		if caller := r.Header.Get(CallerHeader); caller != "" {
+			ctx = apis.WithCaller(ctx, caller)
+		}
+		handler.ServeHTTP(w, r.WithContext(ctx))
+		reportRequest(RequestRecord{
+			Side:      ServerSide,
+			RequestID: id,
+			Method:    methodOfPath(r.URL.Path),
+			Duration:  time.Since(start),
+		})
+	})
+}
+
+// The part of *http.Client that the twirp clients use.
+type httpDoer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Wraps an HTTP client so that the request ID and caller attached to each request's context (if any) are sent along, and so that
+// every call is reported to the request hook under the ID that the server ended up using.
+type requestIDClient struct {
+	inner httpDoer
+}
+
+func withRequestIDClient(client httpDoer) httpDoer {
+	return &requestIDClient{inner: client}
+}
+
+func (c *requestIDClient) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	id := RequestIDFrom(req.Context())
+	if id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
+	if caller := apis.CallerFrom(req.Context()); caller != "" {
+		req.Header.Set(CallerHeader, caller)
+	}
+	resp, err := c.inner.Do(req)
+	if resp != nil && resp.Header.Get(RequestIDHeader) != "" {
+		id = resp.Header.Get(RequestIDHeader)
+	}
+	reportRequest(RequestRecord{
+		Side:      ClientSide,
+		RequestID: id,
+		Method:    methodOfPath(req.URL.Path),
+		Duration:  time.Since(start),
+		Err:       err,
+	})
+	return resp, err
+}
@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+	"zircon/apis"
+	"zircon/apis/mocks"
+	"zircon/rpc/twirp"
+)
+
+type recordedRequests struct {
+	mu      sync.Mutex
+	records []RequestRecord
+}
+
+func (r *recordedRequests) hook(record RequestRecord) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, record)
+}
+
+func (r *recordedRequests) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = nil
+}
+
+// The server reports a call once it has finished sending the response, which might be after the client has received
+// it, so wait for both ends to have been reported.
+func (r *recordedRequests) waitFor(t *testing.T, count int) []RequestRecord {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		records := append([]RequestRecord(nil), r.records...)
+		r.mu.Unlock()
+		if len(records) >= count || time.Now().After(deadline) {
+			assert.Len(t, records, count)
+			return records
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRequestIDs(t *testing.T) {
+	recorded := &recordedRequests{}
+	SetRequestHook(recorded.hook)
+	defer SetRequestHook(nil)
+
+	mocked := new(mocks.Chunkserver)
+	defer mocked.AssertExpectations(t)
+	mocked.On("GetStats").Return(apis.ChunkserverStats{Chunks: 3}, nil)
+
+	teardown, address, err := PublishChunkserver(mocked, ":0")
+	assert.NoError(t, err)
+	defer teardown(true)
+
+	// the client doesn't send an ID, so the server has to come up with one
+	cache := NewConnectionCache()
+	defer cache.CloseAll()
+	server, err := cache.SubscribeChunkserver(address)
+	assert.NoError(t, err)
+	stats, err := server.GetStats()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), stats.Chunks)
+
+	records := recorded.waitFor(t, 2)
+	if len(records) == 2 {
+		assert.NotEmpty(t, records[0].RequestID)
+		assert.Equal(t, records[0].RequestID, records[1].RequestID)
+		assert.ElementsMatch(t, []RequestSide{ClientSide, ServerSide}, []RequestSide{records[0].Side, records[1].Side})
+		for _, record := range records {
+			assert.Equal(t, "GetStats", record.Method)
+			assert.NoError(t, record.Err)
+		}
+	}
+
+	// an ID supplied by the caller is used by both ends
+	recorded.reset()
+	client := twirp.NewChunkserverProtobufClient("http://"+string(address), withRequestIDClient(http.DefaultClient))
+	_, err = client.GetStats(WithRequestID(context.Background(), "feedface"), &twirp.Nothing{})
+	assert.NoError(t, err)
+	for _, record := range recorded.waitFor(t, 2) {
+		assert.Equal(t, "feedface", record.RequestID)
+	}
+}
@@ -10,7 +10,7 @@ import (
 // Connects to an RPC handler for a SyncServer on a certain address.
 func UncachedSubscribeSyncServer(address apis.ServerAddress, client *http.Client) (apis.SyncServer, error) {
 	saddr := "http://" + string(address)
-	tserve := twirp.NewSyncServerProtobufClient(saddr, client)
+	tserve := twirp.NewSyncServerProtobufClient(saddr, withRequestIDClient(client))
 
 	return &proxyTwirpAsSyncServer{server: tserve}, nil
 }
@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -102,7 +103,7 @@ func (bal *balancer) transferSomeChunk(
 		return errors.New("Chunklist for that source server was zero")
 	}
 
-	entry, owner, err := bal.localCache.ReadEntry(chunknum)
+	entry, owner, err := bal.localCache.ReadEntry(chunknum, apis.Fresh)
 	if owner != apis.NoRedirect {
 		return fmt.Errorf("Metadata for this server currently leased by %v", owner)
 	} else if err != nil {
@@ -144,11 +145,7 @@ func (bal *balancer) transferSomeChunk(
 	replicas = append(replicas[:repI], replicas[repI+1:]...)
 	replicas = append(replicas, dst)
 
-	owner, err = bal.localCache.UpdateEntry(chunknum, entry, apis.MetadataEntry{
-		MostRecentVersion:   entry.MostRecentVersion,
-		LastConsumedVersion: entry.LastConsumedVersion,
-		Replicas:            replicas,
-	})
+	owner, err = bal.localCache.SwapReplicasWithContext(apis.WithCaller(context.Background(), "balancer"), chunknum, entry, replicas)
 
 	if owner != apis.NoRedirect {
 		return fmt.Errorf("Cannot update metadata for chunk %d as server %d has a lease on it.", chunknum, owner)
@@ -184,7 +181,7 @@ func (bal *balancer) genValidChunks() (map[apis.ServerID]map[apis.ChunkVersion]b
 		}
 
 		// This assumes chunkserver to return only its valid chunks
-		cvs, err := cs.ListAllChunks()
+		cvs, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		if err != nil {
 			log.Printf("Server %s threw error: %v while constructing list of valid chunks", chunkserver, err)
 			continue
@@ -202,12 +199,7 @@ func (bal *balancer) genValidChunks() (map[apis.ServerID]map[apis.ChunkVersion]b
 
 // Given a chunkserver id, return a connection to that chunkserver
 func (bal *balancer) idToCS(id apis.ServerID) (apis.Chunkserver, error) {
-	addr, err := chunkupdate.AddressForChunkserver(bal.etcd, id)
-	if err != nil {
-		return nil, err
-	}
-
-	return bal.rpcCache.SubscribeChunkserver(addr)
+	return chunkupdate.SubscribeChunkserverByID(bal.etcd, bal.rpcCache, id)
 }
 
 func minChunkserver(chunks map[apis.ServerID]map[apis.ChunkVersion]bool) (minID apis.ServerID, min int) {
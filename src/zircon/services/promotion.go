@@ -0,0 +1,184 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"zircon/apis"
+	"zircon/chunkupdate"
+	"zircon/rpc"
+)
+
+// A replica of a chunk that is still up after another replica of the chunk was lost.
+type Survivor struct {
+	ID      apis.ServerID
+	Address apis.ServerAddress
+	Server  apis.Chunkserver
+}
+
+// What PromoteReplica did.
+type Promotion struct {
+	// The survivor whose copy is now authoritative, and the version of it that the metadata now records
+	Authority apis.ServerID
+	Version   apis.Version
+	// Survivors that were behind the authority and have been brought up to date
+	Repaired []apis.ServerID
+	// Survivors that were behind the authority and could not be brought up to date. They are kept in the entry, so that
+	// the replicator finds them stale and repairs or replaces them on its next pass.
+	Lagging []apis.ServerID
+	// The metadata entry as it was updated
+	Entry apis.MetadataEntry
+}
+
+// Makes one of the surviving replicas of a chunk authoritative after the server holding the newest copy was lost, such
+// as when it died partway through a commit, leaving the survivors at different versions and the metadata out of step
+// with all of them.
+// The survivor with the highest version that the metadata ever reserved becomes the authority: it is made to serve that
+// version, the metadata entry is updated to record that version with only the survivors as replicas, and the authority
+// then pushes its copy to every survivor that is behind it. Replicas in the entry that aren't survivors are dropped, so
+// the replicator will bring the chunk back up to strength.
+// If every survivor is behind the version in the metadata, the newest surviving version is promoted anyway, since it is
+// the best that is left; this is logged, because any writes after it are lost.
+func PromoteReplica(metadata apis.MetadataCache, chunk apis.ChunkNum, survivors []Survivor) (Promotion, error) {
+	entry, owner, err := metadata.ReadEntry(chunk, apis.Fresh)
+	if owner != apis.NoRedirect {
+		return Promotion{}, fmt.Errorf("[promotion.go/RED] metadata for chunk %d is held by %s", chunk, owner)
+	}
+	if err != nil {
+		return Promotion{}, fmt.Errorf("[promotion.go/RME] %v", err)
+	}
+	if entry.MostRecentVersion > entry.LastConsumedVersion {
+		return Promotion{}, fmt.Errorf("[promotion.go/DEL] chunk %d is being deleted", chunk)
+	}
+	for _, survivor := range survivors {
+		if !containsServer(entry.Replicas, survivor.ID) {
+			return Promotion{}, fmt.Errorf("[promotion.go/REP] Server #%d is not a replica of chunk %d", survivor.ID, chunk)
+		}
+	}
+
+	versions := make([]apis.Version, len(survivors))
+	authority := -1
+	for i, survivor := range survivors {
+		versions[i], err = newestReservedVersion(survivor.Server, chunk, entry.LastConsumedVersion)
+		if err != nil {
+			// it can still be brought up to date from the authority below, if it comes back
+			log.Printf("Could not list versions of chunk %d on Server #%d: %v", chunk, survivor.ID, err)
+			continue
+		}
+		if versions[i] != 0 && (authority < 0 || versions[i] > versions[authority]) {
+			authority = i
+		}
+	}
+	if authority < 0 {
+		return Promotion{}, fmt.Errorf("[promotion.go/NON] no surviving replica holds chunk %d", chunk)
+	}
+	promoted := survivors[authority]
+	version := versions[authority]
+	if version < entry.MostRecentVersion {
+		log.Printf("Promoting version %d of chunk %d on Server #%d, behind version %d in the metadata, which is lost",
+			version, chunk, promoted.ID, entry.MostRecentVersion)
+	}
+
+	if err := serveVersion(promoted.Server, chunk, version); err != nil {
+		return Promotion{}, fmt.Errorf("[promotion.go/SRV] %v", err)
+	}
+
+	updated := apis.MetadataEntry{
+		MostRecentVersion:   version,
+		LastConsumedVersion: entry.LastConsumedVersion,
+		Replicas:            []apis.ServerID{promoted.ID},
+	}
+	for _, survivor := range survivors {
+		if survivor.ID != promoted.ID {
+			updated.Replicas = append(updated.Replicas, survivor.ID)
+		}
+	}
+	owner, err = metadata.UpdateEntryWithContext(apis.WithCaller(context.Background(), "promotion"), chunk, entry, updated)
+	if owner != apis.NoRedirect {
+		return Promotion{}, fmt.Errorf("[promotion.go/URD] metadata for chunk %d is now held by %s", chunk, owner)
+	}
+	if err != nil {
+		return Promotion{}, fmt.Errorf("[promotion.go/UME] %v", err)
+	}
+
+	promotion := Promotion{
+		Authority: promoted.ID,
+		Version:   version,
+		Entry:     updated,
+	}
+	for i, survivor := range survivors {
+		if i == authority {
+			continue
+		}
+		if versions[i] == version {
+			// the commit reached this replica too, so it only needs to start serving it
+			if err := serveVersion(survivor.Server, chunk, version); err != nil {
+				log.Printf("When serving promoted chunk %d on Server #%d: %v", chunk, survivor.ID, err)
+				promotion.Lagging = append(promotion.Lagging, survivor.ID)
+			}
+			continue
+		}
+		pushed, err := promoted.Server.Push(chunk, survivor.Address)
+		if err == nil && pushed != version {
+			// the authority moved on in the meantime, which can only be another promotion racing with this one
+			err = fmt.Errorf("pushed version %d instead of %d", pushed, version)
+		}
+		if err != nil {
+			log.Printf("When pushing promoted chunk %d from Server #%d to Server #%d: %v", chunk, promoted.ID, survivor.ID, err)
+			promotion.Lagging = append(promotion.Lagging, survivor.ID)
+			continue
+		}
+		promotion.Repaired = append(promotion.Repaired, survivor.ID)
+	}
+	return promotion, nil
+}
+
+// Like PromoteReplica, but with the survivors given by ID, and connected to through etcd.
+func PromoteReplicaByID(etcd apis.EtcdInterface, metadata apis.MetadataCache, rpcCache rpc.ConnectionCache, chunk apis.ChunkNum, survivors []apis.ServerID) (Promotion, error) {
+	var resolved []Survivor
+	for _, id := range survivors {
+		address, cs, err := chunkupdate.ResolveChunkserver(etcd, rpcCache, id)
+		if err != nil {
+			return Promotion{}, fmt.Errorf("[promotion.go/SUB] %v", err)
+		}
+		resolved = append(resolved, Survivor{ID: id, Address: address, Server: cs})
+	}
+	return PromoteReplica(metadata, chunk, resolved)
+}
+
+// The newest version of a chunk that a chunkserver stores, whether or not it was ever made latest there, up to the last
+// version that the metadata reserved. Anything newer was never reserved, so it can't be legitimate. Zero if there is no
+// such version.
+func newestReservedVersion(cs apis.Chunkserver, chunk apis.ChunkNum, reserved apis.Version) (apis.Version, error) {
+	if reserved == 0 {
+		return 0, nil
+	}
+	cvs, err := cs.ListChunks(apis.ChunkFilter{FirstChunk: chunk, LastChunk: chunk, MaxVersion: reserved})
+	if err != nil {
+		return 0, err
+	}
+	var newest apis.Version
+	for _, cv := range cvs {
+		if cv.Chunk == chunk && cv.Version > newest {
+			newest = cv.Version
+		}
+	}
+	return newest, nil
+}
+
+// Makes a chunkserver serve a version of a chunk that it already stores, if it doesn't already, such as when a commit
+// reached it but the server coordinating the commit was lost before telling it to serve the new version.
+func serveVersion(cs apis.Chunkserver, chunk apis.ChunkNum, version apis.Version) error {
+	_, current, err := cs.Read(chunk, 0, 0, apis.AnyVersion)
+	if err != nil {
+		return err
+	}
+	if current == version {
+		return nil
+	}
+	if current > version {
+		return errors.New("promoted replica already serves a newer version than it was promoted at")
+	}
+	return cs.UpdateLatestVersion(chunk, current, version)
+}
@@ -0,0 +1,144 @@
+package services
+
+import (
+	"context"
+	"errors"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+)
+
+// Metadata for a single chunk, held in memory.
+type fakeMetadata struct {
+	chunk apis.ChunkNum
+	entry apis.MetadataEntry
+}
+
+func (f *fakeMetadata) NewEntry() (apis.ChunkNum, error) {
+	return 0, errors.New("no new entries in fake")
+}
+
+func (f *fakeMetadata) ReadEntry(chunk apis.ChunkNum, consistency apis.Consistency) (apis.MetadataEntry, apis.ServerName, error) {
+	if chunk != f.chunk {
+		return apis.MetadataEntry{}, apis.NoRedirect, errors.New("no such entry")
+	}
+	return f.entry, apis.NoRedirect, nil
+}
+
+func (f *fakeMetadata) EntryExists(chunk apis.ChunkNum, consistency apis.Consistency) (bool, apis.ServerName, error) {
+	return chunk == f.chunk, apis.NoRedirect, nil
+}
+
+func (f *fakeMetadata) NewEntryWithContext(ctx context.Context) (apis.ChunkNum, error) {
+	return f.NewEntry()
+}
+
+func (f *fakeMetadata) UpdateEntry(chunk apis.ChunkNum, previous apis.MetadataEntry, newEntry apis.MetadataEntry) (apis.ServerName, error) {
+	return f.UpdateEntryWithContext(context.Background(), chunk, previous, newEntry)
+}
+
+func (f *fakeMetadata) UpdateEntryWithContext(ctx context.Context, chunk apis.ChunkNum, previous apis.MetadataEntry, newEntry apis.MetadataEntry) (apis.ServerName, error) {
+	if chunk != f.chunk || !f.entry.Equals(previous) {
+		return apis.NoRedirect, errors.New("entry does not match previous expected entry")
+	}
+	f.entry = newEntry
+	return apis.NoRedirect, nil
+}
+
+func (f *fakeMetadata) SwapReplicas(chunk apis.ChunkNum, expected apis.MetadataEntry, newReplicas []apis.ServerID) (apis.ServerName, error) {
+	return f.SwapReplicasWithContext(context.Background(), chunk, expected, newReplicas)
+}
+
+func (f *fakeMetadata) SwapReplicasWithContext(ctx context.Context, chunk apis.ChunkNum, expected apis.MetadataEntry, newReplicas []apis.ServerID) (apis.ServerName, error) {
+	return apis.NoRedirect, errors.New("no swapping in fake")
+}
+
+func (f *fakeMetadata) DeleteEntry(chunk apis.ChunkNum, previous apis.MetadataEntry) (apis.ServerName, error) {
+	return f.DeleteEntryWithContext(context.Background(), chunk, previous)
+}
+
+func (f *fakeMetadata) DeleteEntryWithContext(ctx context.Context, chunk apis.ChunkNum, previous apis.MetadataEntry) (apis.ServerName, error) {
+	return apis.NoRedirect, errors.New("no deleting in fake")
+}
+
+// A chunkserver holding versions of a single chunk, which only implements what promotion uses. Pushes go to the other
+// fake replicas by address.
+type fakeReplica struct {
+	apis.Chunkserver
+	chunk    apis.ChunkNum
+	versions map[apis.Version]bool
+	latest   apis.Version
+	peers    map[apis.ServerAddress]*fakeReplica
+}
+
+func (f *fakeReplica) ListChunks(filter apis.ChunkFilter) ([]apis.ChunkVersion, error) {
+	var cvs []apis.ChunkVersion
+	for version := range f.versions {
+		if filter.MaxVersion == apis.AnyVersion || version <= filter.MaxVersion {
+			cvs = append(cvs, apis.ChunkVersion{Chunk: f.chunk, Version: version})
+		}
+	}
+	return cvs, nil
+}
+
+func (f *fakeReplica) Read(chunk apis.ChunkNum, offset uint32, length uint32, minimum apis.Version) ([]byte, apis.Version, error) {
+	return make([]byte, length), f.latest, nil
+}
+
+func (f *fakeReplica) UpdateLatestVersion(chunk apis.ChunkNum, oldVersion apis.Version, newVersion apis.Version) error {
+	if oldVersion != f.latest || !f.versions[newVersion] {
+		return apis.NewError(apis.ErrWrongVersion, f.latest, "wrong version")
+	}
+	for version := range f.versions {
+		if version < newVersion {
+			delete(f.versions, version)
+		}
+	}
+	f.latest = newVersion
+	return nil
+}
+
+func (f *fakeReplica) Push(chunk apis.ChunkNum, serverAddress apis.ServerAddress) (apis.Version, error) {
+	peer := f.peers[serverAddress]
+	peer.versions = map[apis.Version]bool{f.latest: true}
+	peer.latest = f.latest
+	return f.latest, nil
+}
+
+func TestPromoteReplica(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	chunk := apis.ChunkNum(73)
+	// the primary, Server #1, died after committing version 5 to Server #2, but before telling anyone to serve it, and
+	// before it reached Server #3
+	metadata := &fakeMetadata{
+		chunk: chunk,
+		entry: apis.MetadataEntry{MostRecentVersion: 4, LastConsumedVersion: 5, Replicas: []apis.ServerID{1, 2, 3}},
+	}
+	peers := map[apis.ServerAddress]*fakeReplica{}
+	behind := &fakeReplica{chunk: chunk, versions: map[apis.Version]bool{4: true}, latest: 4, peers: peers}
+	ahead := &fakeReplica{chunk: chunk, versions: map[apis.Version]bool{4: true, 5: true}, latest: 4, peers: peers}
+	peers["behind"] = behind
+	peers["ahead"] = ahead
+
+	promotion, err := PromoteReplica(metadata, chunk, []Survivor{
+		{ID: 3, Address: "behind", Server: behind},
+		{ID: 2, Address: "ahead", Server: ahead},
+	})
+	require.NoError(t, err)
+	assert.Equal(apis.ServerID(2), promotion.Authority)
+	assert.Equal(apis.Version(5), promotion.Version)
+	assert.Equal([]apis.ServerID{3}, promotion.Repaired)
+	assert.Empty(promotion.Lagging)
+
+	expected := apis.MetadataEntry{MostRecentVersion: 5, LastConsumedVersion: 5, Replicas: []apis.ServerID{2, 3}}
+	assert.True(expected.Equals(metadata.entry), "metadata entry is %v", metadata.entry)
+	assert.True(expected.Equals(promotion.Entry))
+	assert.Equal(apis.Version(5), ahead.latest)
+	assert.Equal(apis.Version(5), behind.latest)
+
+	// only replicas of the chunk can be promoted
+	_, err = PromoteReplica(metadata, chunk, []Survivor{{ID: 4, Address: "ahead", Server: ahead}})
+	assert.Error(err)
+}
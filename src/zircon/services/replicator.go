@@ -1,6 +1,7 @@
 package services
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"time"
@@ -15,6 +16,19 @@ const MinReplicas int = 2
 // Replicaiton Frequency in seconds
 const ReplicationFreq = 5
 
+// How many times sending a chunk is started over after it moves to a new version partway through, before the chunk is
+// left for the next pass
+const MaxSupersededRestarts = 3
+
+// The version that a transfer superseded by a newer version of the chunk should be started over at, if err says so
+func supersededBy(err error) (apis.Version, bool) {
+	coded, ok := err.(*apis.Error)
+	if !ok || coded == nil || coded.Code != apis.ErrReplicationSuperseded {
+		return 0, false
+	}
+	return coded.Version, true
+}
+
 // Explanation of the replication service:
 //     Every chunk in the cluster should be replicated to at least two servers, preferably three.
 //     The replication service goes through, counts valid replicas, and replicates new ones as necessary.
@@ -68,7 +82,7 @@ func (rpl *replicator) Stop() error {
 
 func (rpl *replicator) replicate() error {
 	// Generate a list of valid chunk refences per chunkserver
-	validChunks, err := rpl.genValidChunks()
+	validChunks, tombstones, err := rpl.genValidChunks()
 	if err != nil {
 		return err
 	}
@@ -87,7 +101,8 @@ func (rpl *replicator) replicate() error {
 		for i := 0; i < 1<<apis.EntriesPerBlock; i++ {
 			chunkID := metadatacache.EntryAndBlockToChunkNum(metachunk, uint32(i))
 			// TODO Make this distinguish between the entry just not being there and a critical err
-			entry, owner, err := rpl.localCache.ReadEntry(chunkID)
+			// a slightly stale view is fine for a scan, because UpdateEntry rejects updates based on stale entries
+			entry, owner, err := rpl.localCache.ReadEntry(chunkID, apis.Cached)
 			if owner != apis.NoRedirect {
 				log.Printf("Server %s has lease on metachunk %d. Skipping over it.", owner, metachunk)
 				break
@@ -102,24 +117,26 @@ func (rpl *replicator) replicate() error {
 		if owner != apis.NoRedirect {
 			continue
 		} else if len(entries) == 0 {
-			rpl.replicateChunks(entries, validChunks)
+			rpl.replicateChunks(entries, validChunks, tombstones)
 		}
 	}
 
 	return nil
 }
 
-// Generate a mapping of chunkserver to valid chunks that it currently contains
+// Generate a mapping of chunkserver to valid chunks that it currently contains, along with a mapping of chunkserver to
+// the chunks that it has deleted, and the newest version of each that was deleted
 // This mapping would not contain the chunkservers or its chunks for any chunkserver that is down,
 // and would not contain any chunks that the chunkserver somehow lost or has designated as invalid
-func (rpl *replicator) genValidChunks() (map[apis.ServerID]map[apis.ChunkVersion]bool, error) {
+func (rpl *replicator) genValidChunks() (map[apis.ServerID]map[apis.ChunkVersion]bool, map[apis.ServerID]map[apis.ChunkNum]apis.Version, error) {
 	chunkservers, err := chunkupdate.ListChunkservers(rpl.etcd)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	// Map to chunk version, as a previous version of a chunk doesn't count for our replication goals
 	chunks := make(map[apis.ServerID]map[apis.ChunkVersion]bool)
+	tombstones := make(map[apis.ServerID]map[apis.ChunkNum]apis.Version)
 	for _, chunkserver := range chunkservers {
 		// TODO Make sure this times out if the target is down
 		cs, err := rpl.idToCS(chunkserver)
@@ -129,7 +146,7 @@ func (rpl *replicator) genValidChunks() (map[apis.ServerID]map[apis.ChunkVersion
 		}
 
 		// This assumes chunkserver to return only its valid chunks
-		cvs, err := cs.ListAllChunks()
+		cvs, err := cs.ListAllChunks(apis.AnyVersion, apis.AnyVersion)
 		if err != nil {
 			log.Printf("Server %s threw error: %v while constructing list of valid chunks", chunkserver, err)
 			continue
@@ -140,9 +157,65 @@ func (rpl *replicator) genValidChunks() (map[apis.ServerID]map[apis.ChunkVersion
 			cvsMap[cv] = true
 		}
 		chunks[chunkserver] = cvsMap
+
+		deleted, err := cs.ListTombstones()
+		if err != nil {
+			log.Printf("Server %s threw error: %v while listing deleted chunks", chunkserver, err)
+			continue
+		}
+		deletedMap := make(map[apis.ChunkNum]apis.Version)
+		for _, tombstone := range deleted {
+			deletedMap[tombstone.Chunk] = tombstone.Version
+		}
+		tombstones[chunkserver] = deletedMap
+	}
+
+	return chunks, tombstones, nil
+}
+
+// A chunk is dead, rather than missing, if it is in the middle of being deleted, or if none of its replicas hold the
+// current version because one of them deliberately deleted it
+func isDeadChunk(entry apis.MetadataEntry, hasValidReplica bool, tombstones map[apis.ServerID]map[apis.ChunkNum]apis.Version, chunk apis.ChunkNum) bool {
+	if entry.MostRecentVersion > entry.LastConsumedVersion {
+		return true
+	}
+	if hasValidReplica {
+		return false
 	}
+	for _, serverID := range entry.Replicas {
+		if deleted, found := tombstones[serverID][chunk]; found && deleted >= entry.MostRecentVersion {
+			return true
+		}
+	}
+	return false
+}
 
-	return chunks, nil
+// Delete any copies of a dead chunk left on servers that are up, such as on a replica that was down when the chunk was
+// deleted, so that nothing can mistake them for the last copies of the chunk. Each deletion leaves a tombstone behind,
+// which keeps the chunk from being brought back to that server later.
+func (rpl *replicator) removeDeadCopies(chunk apis.ChunkNum, validChunks map[apis.ServerID]map[apis.ChunkVersion]bool) {
+	for serverID, cvs := range validChunks {
+		var versions []apis.Version
+		for cv := range cvs {
+			if cv.Chunk == chunk {
+				versions = append(versions, cv.Version)
+			}
+		}
+		if len(versions) == 0 {
+			continue
+		}
+		cs, err := rpl.idToCS(serverID)
+		if err != nil {
+			log.Printf("Could not connect to Server #%d to remove dead chunk %d: %v", serverID, chunk, err)
+			continue
+		}
+		for _, version := range versions {
+			err := cs.Delete(chunk, version)
+			if err != nil && apis.ErrorCodeOf(err) != apis.ErrAlreadyDeleted {
+				log.Printf("When removing dead chunk %d/%d from Server #%d: %v", chunk, version, serverID, err)
+			}
+		}
+	}
 }
 
 // Given a list of entries and a list of valid ChunkVersions per chunkserver,
@@ -150,7 +223,8 @@ func (rpl *replicator) genValidChunks() (map[apis.ServerID]map[apis.ChunkVersion
 // 1. Replace any chunk references that are not in our list of valid chunk references
 // 2. Make sure that the replication of each chunk is at least minReplication
 // 3. Replace chunk references that somehow are not up-to-date with the current version
-func (rpl *replicator) replicateChunks(entries map[apis.ChunkNum]apis.MetadataEntry, validChunks map[apis.ServerID]map[apis.ChunkVersion]bool) {
+// Chunks that have been deleted are never replicated; instead, any copies of them that are left are removed
+func (rpl *replicator) replicateChunks(entries map[apis.ChunkNum]apis.MetadataEntry, validChunks map[apis.ServerID]map[apis.ChunkVersion]bool, tombstones map[apis.ServerID]map[apis.ChunkNum]apis.Version) {
 	for chunk, entry := range entries {
 		// TODO Is this the right version to use?
 		cv := apis.ChunkVersion{
@@ -162,18 +236,19 @@ func (rpl *replicator) replicateChunks(entries map[apis.ChunkNum]apis.MetadataEn
 		validReplicas := []apis.ServerID{}
 		invalidReplicas := []apis.ServerID{}
 		for _, serverID := range entry.Replicas {
-			serverChunks, ok := validChunks[serverID]
-			if !ok {
-				invalidReplicas = append(invalidReplicas, serverID)
-			}
-			_, ok = serverChunks[cv]
-			if ok {
+			if validChunks[serverID][cv] {
 				validReplicas = append(validReplicas, serverID)
 			} else {
-				invalidReplicas = append(validReplicas, serverID)
+				invalidReplicas = append(invalidReplicas, serverID)
 			}
 		}
 
+		// A chunk that has been deleted must not be repaired back onto other servers, even if a stale copy survived
+		if isDeadChunk(entry, len(validReplicas) > 0, tombstones, chunk) {
+			rpl.removeDeadCopies(chunk, validChunks)
+			continue
+		}
+
 		// If all references are invalid, log that fact and be sad
 		if len(validReplicas) == 0 {
 			// TODO Maybe try to recover with a previous version
@@ -184,10 +259,15 @@ func (rpl *replicator) replicateChunks(entries map[apis.ChunkNum]apis.MetadataEn
 		// Just choose the first valid replica to replicate from
 		source := validReplicas[0]
 
+		// Replicas that are still up, but have fallen behind (such as after recovering from a crash) can be brought back
+		// up to date in place, rather than needing to be replaced
+		repaired, invalidReplicas := rpl.pushToStaleReplicas(chunk, source, invalidReplicas, validChunks)
+		validReplicas = append(validReplicas, repaired...)
+
 		// TODO Poss. do something better than just using the keys from the server to valid chunks mapping
 		availServers := []apis.ServerID{}
 		for id, _ := range validChunks {
-			if id != source {
+			if !containsServer(validReplicas, id) {
 				availServers = append(availServers, id)
 			}
 		}
@@ -200,7 +280,11 @@ func (rpl *replicator) replicateChunks(entries map[apis.ChunkNum]apis.MetadataEn
 			nReplicas = len(invalidReplicas)
 		}
 
-		err := rpl.replicateChunk(chunk, entry, source, availServers, nReplicas)
+		if nReplicas == 0 && len(repaired) == 0 {
+			continue
+		}
+
+		err := rpl.replicateChunk(chunk, entry, source, validReplicas, availServers, nReplicas)
 		if err != nil {
 			log.Printf("Replicating chunk %d from Server #%d threw err: %v", chunk, source, err)
 			continue
@@ -208,15 +292,93 @@ func (rpl *replicator) replicateChunks(entries map[apis.ChunkNum]apis.MetadataEn
 	}
 }
 
-// Replicate a given chunk from the source server to N of the servers given in availServer where N is nReplications
-func (rpl *replicator) replicateChunk(chunk apis.ChunkNum, entry apis.MetadataEntry, source apis.ServerID, availServers []apis.ServerID, nReplications int) error {
+// Push the current version of a chunk from the source to each stale replica that is still up. Returns the replicas that
+// are now up to date, and the ones that are not.
+func (rpl *replicator) pushToStaleReplicas(chunk apis.ChunkNum, source apis.ServerID, stale []apis.ServerID, validChunks map[apis.ServerID]map[apis.ChunkVersion]bool) (repaired []apis.ServerID, remaining []apis.ServerID) {
+	sourceCS, err := rpl.idToCS(source)
+	if err != nil {
+		log.Printf("Could not connect to Server #%d to push chunk %d: %v", source, chunk, err)
+		return nil, stale
+	}
+	for _, serverID := range stale {
+		if _, up := validChunks[serverID]; !up {
+			remaining = append(remaining, serverID)
+			continue
+		}
+		address, err := chunkupdate.AddressForChunkserver(rpl.etcd, serverID)
+		if err == nil {
+			err = rpl.pushCurrent(sourceCS, chunk, address)
+		}
+		if err != nil {
+			log.Printf("When pushing chunk %d from Server #%d to Server #%d: %v", chunk, source, serverID, err)
+			remaining = append(remaining, serverID)
+			continue
+		}
+		repaired = append(repaired, serverID)
+	}
+	return repaired, remaining
+}
+
+// Pushes whichever version of a chunk the source holds, starting over if the chunk moves to a newer version partway
+// through. Each push sends the newest version, which replaces the stale one the last push left behind.
+func (rpl *replicator) pushCurrent(sourceCS apis.Chunkserver, chunk apis.ChunkNum, address apis.ServerAddress) error {
+	for restarts := 0; ; restarts++ {
+		_, err := sourceCS.Push(chunk, address)
+		version, superseded := supersededBy(err)
+		if !superseded || version == 0 || restarts >= MaxSupersededRestarts {
+			return err
+		}
+	}
+}
+
+func containsServer(servers []apis.ServerID, server apis.ServerID) bool {
+	for _, s := range servers {
+		if s == server {
+			return true
+		}
+	}
+	return false
+}
+
+// Replicate a given chunk from the source server to N of the servers given in availServer where N is nReplications,
+// keeping the replicas that are already valid
+// If the chunk moves to a new version while it's being sent, the copies already made are removed, and replication
+// starts over at the new version once the metadata entry has caught up with it
+func (rpl *replicator) replicateChunk(chunk apis.ChunkNum, entry apis.MetadataEntry, source apis.ServerID, valid []apis.ServerID, availServers []apis.ServerID, nReplications int) error {
 	if nReplications < 0 {
 		return fmt.Errorf("Replication factor is %d, less than 0", nReplications)
 	}
 
-	sourceCS, err := rpl.idToCS(source)
-	if err != nil {
-		return err
+	for restarts := 0; ; restarts++ {
+		err := rpl.replicateChunkAt(chunk, entry, source, valid, availServers, nReplications)
+		version, superseded := supersededBy(err)
+		if !superseded || version == 0 || restarts >= MaxSupersededRestarts {
+			// a deleted chunk is left for the next pass to clean up after
+			return err
+		}
+		fresh, owner, err := rpl.localCache.ReadEntry(chunk, apis.Fresh)
+		if err != nil {
+			return err
+		}
+		if owner != apis.NoRedirect {
+			return fmt.Errorf("chunk %d moved to version %d while replicating, and its entry is now leased by %s", chunk, version, owner)
+		}
+		if fresh.MostRecentVersion != version {
+			return fmt.Errorf("chunk %d moved to version %d while replicating, but its entry has version %d", chunk, version, fresh.MostRecentVersion)
+		}
+		entry = fresh
+	}
+}
+
+// Makes the copies for replicateChunk, all of the version in the entry. Fails with ErrReplicationSuperseded, after
+// removing every copy it made, if the chunk moves to a new version partway through
+func (rpl *replicator) replicateChunkAt(chunk apis.ChunkNum, entry apis.MetadataEntry, source apis.ServerID, valid []apis.ServerID, availServers []apis.ServerID, nReplications int) error {
+	// the chosen source goes first, but any other valid replica can stand in for it if it's too busy
+	sources := []apis.ServerID{source}
+	for _, replica := range valid {
+		if replica != source {
+			sources = append(sources, replica)
+		}
 	}
 
 	// Relying on chunk balancer to fix bad allocations patterns from this
@@ -231,20 +393,22 @@ func (rpl *replicator) replicateChunk(chunk apis.ChunkNum, entry apis.MetadataEn
 
 		repServer := availServers[0]
 		availServers = availServers[1:]
-		repName, err := rpl.etcd.GetNameByID(repServer)
+		repAddress, err := chunkupdate.AddressForChunkserver(rpl.etcd, repServer)
 		if err != nil {
 			return err
 		}
 
-		repAddress, err := rpl.etcd.GetAddress(repName, apis.CHUNKSERVER)
-		if err != nil {
+		// TODO Is this the right way to handle these versions
+		err = rpl.replicateFrom(sources, chunk, repAddress, entry.MostRecentVersion)
+		if _, superseded := supersededBy(err); superseded {
+			// every copy made so far is of a version that is no longer current, including the one that was just made
+			for _, stale := range append(newReplicas, repServer) {
+				rpl.discardStaleCopy(stale, chunk, entry.MostRecentVersion)
+			}
 			return err
 		}
-
-		// TODO Is this the right way to handle these versions
-		err = sourceCS.Replicate(chunk, repAddress, entry.MostRecentVersion)
 		if err != nil {
-			log.Printf("When replicating chunk %d from Server #%d to Server #%d: %v", chunk, source, repServer)
+			log.Printf("When replicating chunk %d from Server #%d to Server #%d: %v", chunk, source, repServer, err)
 			continue
 		}
 
@@ -253,21 +417,45 @@ func (rpl *replicator) replicateChunk(chunk apis.ChunkNum, entry apis.MetadataEn
 	}
 
 	// Update the metadata entry with the new replicas
-	_, err = rpl.localCache.UpdateEntry(chunk, entry, apis.MetadataEntry{
+	_, err := rpl.localCache.UpdateEntryWithContext(apis.WithCaller(context.Background(), "replicator"), chunk, entry, apis.MetadataEntry{
 		MostRecentVersion:   entry.MostRecentVersion,
 		LastConsumedVersion: entry.LastConsumedVersion,
-		Replicas:            append(newReplicas, source),
+		Replicas:            append(newReplicas, valid...),
 	})
 
 	return err
 }
 
-// Given a chunkserver id, return a connection to that chunkserver
-func (rpl *replicator) idToCS(id apis.ServerID) (apis.Chunkserver, error) {
-	addr, err := chunkupdate.AddressForChunkserver(rpl.etcd, id)
-	if err != nil {
-		return nil, err
+// Asks each source in turn to send a chunk to another chunkserver, only moving on to the next if a source is too busy
+// with other transfers, so that the repairs after a failure are spread across every replica that has the data.
+func (rpl *replicator) replicateFrom(sources []apis.ServerID, chunk apis.ChunkNum, target apis.ServerAddress, version apis.Version) error {
+	var err error
+	for _, source := range sources {
+		var sourceCS apis.Chunkserver
+		sourceCS, err = rpl.idToCS(source)
+		if err != nil {
+			return err
+		}
+		err = sourceCS.Replicate(chunk, target, version)
+		if apis.ErrorCodeOf(err) != apis.ErrSourceBusy {
+			return err
+		}
+	}
+	return err
+}
+
+// Removes a copy of a chunk that was made for a replication that didn't finish, so that it isn't mistaken for a replica
+func (rpl *replicator) discardStaleCopy(serverID apis.ServerID, chunk apis.ChunkNum, version apis.Version) {
+	cs, err := rpl.idToCS(serverID)
+	if err == nil {
+		err = cs.Delete(chunk, version)
+	}
+	if err != nil && apis.ErrorCodeOf(err) != apis.ErrAlreadyDeleted {
+		log.Printf("When removing stale copy of chunk %d/%d from Server #%d: %v", chunk, version, serverID, err)
 	}
+}
 
-	return rpl.rpcCache.SubscribeChunkserver(addr)
+// Given a chunkserver id, return a connection to that chunkserver
+func (rpl *replicator) idToCS(id apis.ServerID) (apis.Chunkserver, error) {
+	return chunkupdate.SubscribeChunkserverByID(rpl.etcd, rpl.rpcCache, id)
 }
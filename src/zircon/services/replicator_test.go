@@ -1 +1,111 @@
 package services
+
+import (
+	"errors"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"zircon/apis"
+	"zircon/etcd/mocketcd"
+	"zircon/rpc"
+)
+
+// Connects to fake chunkservers by name, without going over the network.
+type fakeConnections struct {
+	rpc.ConnectionCache
+	servers map[apis.ServerName]apis.Chunkserver
+}
+
+func (f *fakeConnections) SubscribeChunkserverByName(name apis.ServerName, resolver rpc.ServerResolver) (apis.Chunkserver, error) {
+	server, found := f.servers[name]
+	if !found {
+		return nil, errors.New("no such fake chunkserver")
+	}
+	return server, nil
+}
+
+// A chunkserver holding the latest version of a single chunk, which replicates to other fake chunkservers by address.
+// Each replication can be made to find that a write moved the chunk on to a new version before it finished.
+type fakeCopy struct {
+	apis.Chunkserver
+	latest  apis.Version
+	peers   map[apis.ServerAddress]*fakeCopy
+	deleted []apis.Version
+	// how many more replications go through before one is superseded, and what the write that supersedes it does
+	untilWrite int
+	write      func() apis.Version
+}
+
+func (f *fakeCopy) Replicate(chunk apis.ChunkNum, serverAddress apis.ServerAddress, version apis.Version) error {
+	if version != f.latest {
+		return apis.NewError(apis.ErrWrongVersion, f.latest, "wrong version")
+	}
+	f.peers[serverAddress].latest = version
+	if f.write != nil {
+		if f.untilWrite == 0 {
+			f.latest = f.write()
+			f.write = nil
+			return apis.NewError(apis.ErrReplicationSuperseded, f.latest, "superseded")
+		}
+		f.untilWrite -= 1
+	}
+	return nil
+}
+
+func (f *fakeCopy) Delete(chunk apis.ChunkNum, version apis.Version) error {
+	if version != f.latest {
+		return apis.NewError(apis.ErrAlreadyDeleted, 0, "already deleted")
+	}
+	f.latest = 0
+	f.deleted = append(f.deleted, version)
+	return nil
+}
+
+func TestReplicateChunkSuperseded(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	_, subscribe := mocketcd.PrepareSubscribeForTesting(t)
+	copies := map[apis.ServerName]*fakeCopy{}
+	conns := &fakeConnections{servers: map[apis.ServerName]apis.Chunkserver{}}
+	peers := map[apis.ServerAddress]*fakeCopy{}
+	ids := map[apis.ServerName]apis.ServerID{}
+	var iface apis.EtcdInterface
+	for _, name := range []apis.ServerName{"source", "target-1", "target-2"} {
+		var teardown func()
+		iface, teardown = subscribe(name)
+		defer teardown()
+		address := apis.ServerAddress("address-of-" + name)
+		require.NoError(t, iface.UpdateAddress(address, apis.CHUNKSERVER))
+		id, err := iface.GetIDByName(name)
+		require.NoError(t, err)
+		ids[name] = id
+		copies[name] = &fakeCopy{peers: peers}
+		conns.servers[name] = copies[name]
+		peers[address] = copies[name]
+	}
+
+	metadata := &fakeMetadata{chunk: 7, entry: apis.MetadataEntry{
+		MostRecentVersion: 1, LastConsumedVersion: 1, Replicas: []apis.ServerID{ids["source"]},
+	}}
+	source := copies["source"]
+	source.latest = 1
+	// the first target gets its copy, but a write lands while the second is getting its own
+	source.untilWrite = 1
+	source.write = func() apis.Version {
+		metadata.entry = apis.MetadataEntry{MostRecentVersion: 2, LastConsumedVersion: 2, Replicas: metadata.entry.Replicas}
+		return 2
+	}
+
+	rpl := &replicator{etcd: iface, localCache: metadata, rpcCache: conns}
+	err := rpl.replicateChunk(7, metadata.entry, ids["source"], []apis.ServerID{ids["source"]},
+		[]apis.ServerID{ids["target-1"], ids["target-2"]}, 2)
+	assert.NoError(err)
+
+	// both stale copies were removed before starting over, and both targets hold the new version in the end
+	for _, name := range []apis.ServerName{"target-1", "target-2"} {
+		assert.Equal([]apis.Version{1}, copies[name].deleted, "%s", name)
+		assert.Equal(apis.Version(2), copies[name].latest, "%s", name)
+	}
+	assert.Equal(apis.Version(2), metadata.entry.MostRecentVersion)
+	assert.Equal([]apis.ServerID{ids["target-1"], ids["target-2"], ids["source"]}, metadata.entry.Replicas)
+}
@@ -0,0 +1,95 @@
+package util
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Decides how long to wait between attempts of an operation that is being retried. A Backoff holds the state of one
+// sequence of retries, so it is not threadsafe, and should not be shared between operations that are retried
+// independently.
+type Backoff interface {
+	// How long to wait before the next attempt. Each call advances the sequence.
+	Next() time.Duration
+	// Start the sequence over, as if no attempts had been made yet.
+	Reset()
+}
+
+type constantBackoff struct {
+	delay time.Duration
+}
+
+// Waits the same amount of time before every retry.
+func ConstantBackoff(delay time.Duration) Backoff {
+	return constantBackoff{delay: delay}
+}
+
+func (c constantBackoff) Next() time.Duration {
+	return c.delay
+}
+
+func (c constantBackoff) Reset() {
+}
+
+type exponentialBackoff struct {
+	initial time.Duration
+	max     time.Duration
+	next    time.Duration
+}
+
+// Waits initial before the first retry, and twice as long before each retry after that, up to max. A max of zero means
+// that the wait keeps growing.
+func ExponentialBackoff(initial time.Duration, max time.Duration) Backoff {
+	return &exponentialBackoff{initial: initial, max: max, next: initial}
+}
+
+func (e *exponentialBackoff) Next() time.Duration {
+	delay := e.next
+	if e.max > 0 && delay >= e.max {
+		return e.max
+	}
+	e.next *= 2
+	return delay
+}
+
+func (e *exponentialBackoff) Reset() {
+	e.next = e.initial
+}
+
+type jitteredBackoff struct {
+	inner    Backoff
+	fraction float64
+	random   *rand.Rand
+}
+
+// Shortens each wait of another Backoff by a random amount, of up to fraction of the wait, so that servers which fail at
+// the same moment don't all retry at the same moment too. If random is nil, a source seeded from the clock is used.
+func JitteredBackoff(inner Backoff, fraction float64, random *rand.Rand) Backoff {
+	if random == nil {
+		random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &jitteredBackoff{inner: inner, fraction: fraction, random: random}
+}
+
+func (j *jitteredBackoff) Next() time.Duration {
+	delay := j.inner.Next()
+	return delay - time.Duration(float64(delay)*j.fraction*j.random.Float64())
+}
+
+func (j *jitteredBackoff) Reset() {
+	j.inner.Reset()
+}
+
+// Runs op until it succeeds, fails with an error that retryable rejects, or has been attempted the given number of
+// times, waiting as long as backoff says between attempts. Returns the number of attempts made, along with the error
+// from the last one.
+func Retry(attempts int, backoff Backoff, retryable func(error) bool, op func() error) (int, error) {
+	backoff.Reset()
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= attempts || !retryable(err) {
+			return attempt, err
+		}
+		time.Sleep(backoff.Next())
+	}
+}
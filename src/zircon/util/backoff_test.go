@@ -0,0 +1,125 @@
+package util
+
+import (
+	"errors"
+	testifyAssert "github.com/stretchr/testify/assert"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func sequence(backoff Backoff, n int) []time.Duration {
+	var delays []time.Duration
+	for i := 0; i < n; i++ {
+		delays = append(delays, backoff.Next())
+	}
+	return delays
+}
+
+func TestConstantBackoff(t *testing.T) {
+	backoff := ConstantBackoff(time.Second)
+	testifyAssert.Equal(t, []time.Duration{time.Second, time.Second, time.Second}, sequence(backoff, 3))
+	backoff.Reset()
+	testifyAssert.Equal(t, time.Second, backoff.Next())
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	ms := time.Millisecond
+	backoff := ExponentialBackoff(10*ms, 50*ms)
+	assert.Equal([]time.Duration{10 * ms, 20 * ms, 40 * ms, 50 * ms, 50 * ms}, sequence(backoff, 5))
+	backoff.Reset()
+	assert.Equal([]time.Duration{10 * ms, 20 * ms}, sequence(backoff, 2))
+
+	unbounded := ExponentialBackoff(ms, 0)
+	assert.Equal([]time.Duration{ms, 2 * ms, 4 * ms, 8 * ms, 16 * ms}, sequence(unbounded, 5))
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	inner := ExponentialBackoff(100*time.Millisecond, 0)
+	backoff := JitteredBackoff(inner, 0.5, rand.New(rand.NewSource(1)))
+	expected := 100 * time.Millisecond
+	varied := false
+	for _, delay := range sequence(backoff, 8) {
+		assert.True(delay <= expected && delay >= expected/2, "delay %v outside of [%v, %v]", delay, expected/2, expected)
+		varied = varied || delay != expected
+		expected *= 2
+	}
+	assert.True(varied)
+
+	// resetting the jittered backoff resets the backoff underneath it
+	backoff.Reset()
+	assert.True(backoff.Next() <= 100*time.Millisecond)
+
+	// the same seed gives the same sequence
+	first := sequence(JitteredBackoff(ConstantBackoff(time.Second), 1, rand.New(rand.NewSource(7))), 4)
+	second := sequence(JitteredBackoff(ConstantBackoff(time.Second), 1, rand.New(rand.NewSource(7))), 4)
+	assert.Equal(first, second)
+}
+
+// Records every wait that is asked of it, without making anyone wait.
+type recordingBackoff struct {
+	delays []time.Duration
+	resets int
+}
+
+func (r *recordingBackoff) Next() time.Duration {
+	r.delays = append(r.delays, time.Duration(len(r.delays)+1))
+	return 0
+}
+
+func (r *recordingBackoff) Reset() {
+	r.resets += 1
+	r.delays = nil
+}
+
+func TestRetry(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	transient := errors.New("transient")
+	permanent := errors.New("permanent")
+	isTransient := func(err error) bool {
+		return err == transient
+	}
+	failing := func(errs ...error) func() error {
+		return func() error {
+			if len(errs) == 0 {
+				return nil
+			}
+			err := errs[0]
+			errs = errs[1:]
+			return err
+		}
+	}
+
+	// one wait between each pair of attempts
+	backoff := &recordingBackoff{}
+	attempts, err := Retry(5, backoff, isTransient, failing(transient, transient))
+	assert.NoError(err)
+	assert.Equal(3, attempts)
+	assert.Equal(2, len(backoff.delays))
+	assert.Equal(1, backoff.resets)
+
+	// no waiting after the last attempt
+	attempts, err = Retry(3, backoff, isTransient, failing(transient, transient, transient, transient))
+	assert.Equal(transient, err)
+	assert.Equal(3, attempts)
+	assert.Equal(2, len(backoff.delays))
+	assert.Equal(2, backoff.resets)
+
+	// errors that aren't worth retrying stop the loop immediately
+	attempts, err = Retry(3, backoff, isTransient, failing(permanent))
+	assert.Equal(permanent, err)
+	assert.Equal(1, attempts)
+	assert.Equal(0, len(backoff.delays))
+
+	// and the waits really happen
+	start := time.Now()
+	attempts, err = Retry(3, ConstantBackoff(20*time.Millisecond), isTransient, failing(transient, transient))
+	assert.NoError(err)
+	assert.Equal(3, attempts)
+	assert.True(time.Since(start) >= 40*time.Millisecond)
+}
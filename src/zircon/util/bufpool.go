@@ -0,0 +1,63 @@
+package util
+
+import (
+	"sync"
+)
+
+// Reusable byte slices, grouped into size classes so that a request for a small buffer never ties up a large one.
+// The classes double in size from the smallest up to the largest, which is always a class of its own even if it isn't
+// a power of two. Threadsafe.
+// Whoever gets a buffer owns it until putting it back. After that, it must not be used at all, including through any
+// slice of it, because another user may already have been given it.
+type BufferPool struct {
+	classes []int
+	pools   []sync.Pool
+}
+
+func NewBufferPool(smallest int, largest int) *BufferPool {
+	if smallest <= 0 || largest < smallest {
+		panic("invalid buffer pool sizes")
+	}
+	var classes []int
+	for size := smallest; size < largest; size *= 2 {
+		classes = append(classes, size)
+	}
+	classes = append(classes, largest)
+	return &BufferPool{
+		classes: classes,
+		pools:   make([]sync.Pool, len(classes)),
+	}
+}
+
+// The index of the smallest class that can hold size bytes, or -1 if none can.
+func (p *BufferPool) classFor(size int) int {
+	for i, class := range p.classes {
+		if size <= class {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns a buffer of length size, whose contents are arbitrary. Buffers too large for any class are allocated afresh,
+// and putting them back does nothing.
+func (p *BufferPool) Get(size int) []byte {
+	i := p.classFor(size)
+	if i < 0 {
+		return make([]byte, size)
+	}
+	if pooled, ok := p.pools[i].Get().(*[]byte); ok {
+		return (*pooled)[:size]
+	}
+	return make([]byte, size, p.classes[i])
+}
+
+// Returns a buffer from Get to the pool. Buffers that didn't come from this pool are dropped.
+func (p *BufferPool) Put(buf []byte) {
+	i := p.classFor(cap(buf))
+	if i < 0 || p.classes[i] != cap(buf) {
+		return
+	}
+	buf = buf[:cap(buf)]
+	p.pools[i].Put(&buf)
+}
@@ -0,0 +1,54 @@
+package util
+
+import (
+	testifyAssert "github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestBufferPoolClasses(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	pool := NewBufferPool(4, 100)
+	assert.Equal([]int{4, 8, 16, 32, 64, 100}, pool.classes)
+
+	for _, size := range []int{0, 1, 4, 5, 33, 64, 65, 100} {
+		buf := pool.Get(size)
+		assert.Equal(size, len(buf))
+		assert.Equal(pool.classes[pool.classFor(size)], cap(buf))
+		pool.Put(buf)
+	}
+
+	// too large to pool at all
+	buf := pool.Get(101)
+	assert.Equal(101, len(buf))
+	pool.Put(buf)
+}
+
+func TestBufferPoolReuse(t *testing.T) {
+	assert := testifyAssert.New(t)
+
+	pool := NewBufferPool(16, 1024)
+	// sync.Pool may drop buffers whenever it likes, so only check that a reused buffer is the right size, and that
+	// buffers of the wrong capacity are never handed out
+	pool.Put(make([]byte, 10, 20))
+	pool.Put(make([]byte, 512))
+	for i := 0; i < 10; i++ {
+		buf := pool.Get(300)
+		assert.Equal(300, len(buf))
+		assert.Equal(512, cap(buf))
+		small := pool.Get(20)
+		assert.Equal(32, cap(small))
+		pool.Put(buf)
+		pool.Put(small)
+	}
+}
+
+func BenchmarkBufferPool(b *testing.B) {
+	pool := NewBufferPool(4096, 8*1024*1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := pool.Get(8 * 1024 * 1024)
+		buf[0] = byte(i)
+		pool.Put(buf)
+	}
+}